@@ -0,0 +1,401 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/mail"
+	"strings"
+	"time"
+)
+
+// adminExperimentsHandler reports outcomes and ratings per prompt variant
+func adminExperimentsHandler(w http.ResponseWriter, r *http.Request) {
+	stats, err := getVariantStats()
+	if err != nil {
+		log.Printf("Failed to load variant stats: %v", err)
+		dbHTTPError(w, err, "Failed to load experiment report")
+		return
+	}
+
+	data := struct {
+		ActiveVariants []string
+		Variants       []VariantStats
+	}{
+		ActiveVariants: currentConfig().PromptVariants,
+		Variants:       stats,
+	}
+
+	templates.ExecuteTemplate(w, "admin_experiments.html", data)
+}
+
+// adminReportsHandler lists usage report subscriptions
+func adminReportsHandler(w http.ResponseWriter, r *http.Request) {
+	subscriptions, err := getReportSubscriptions()
+	if err != nil {
+		log.Printf("Failed to load report subscriptions: %v", err)
+		dbHTTPError(w, err, "Failed to load report subscriptions")
+		return
+	}
+
+	data := struct {
+		Subscriptions   []ReportSubscription
+		EmailConfigured bool
+	}{
+		Subscriptions:   subscriptions,
+		EmailConfigured: emailConfigured(),
+	}
+
+	templates.ExecuteTemplate(w, "admin_reports.html", data)
+}
+
+// adminSubscribeHandler opts an email address in to daily or weekly reports
+func adminSubscribeHandler(w http.ResponseWriter, r *http.Request) {
+	addr, err := mail.ParseAddress(r.FormValue("email"))
+	if err != nil {
+		http.Error(w, "Invalid email address", http.StatusBadRequest)
+		return
+	}
+
+	frequency := r.FormValue("frequency")
+	if frequency != reportDaily && frequency != reportWeekly {
+		http.Error(w, "Invalid frequency", http.StatusBadRequest)
+		return
+	}
+
+	if err := saveReportSubscription(addr.Address, frequency); err != nil {
+		log.Printf("Failed to save report subscription: %v", err)
+		dbHTTPError(w, err, "Failed to save subscription")
+		return
+	}
+
+	http.Redirect(w, r, "/admin/reports", http.StatusSeeOther)
+}
+
+// adminUnsubscribeHandler removes a usage report subscription
+func adminUnsubscribeHandler(w http.ResponseWriter, r *http.Request) {
+	if err := deleteReportSubscription(r.FormValue("email")); err != nil {
+		log.Printf("Failed to delete report subscription: %v", err)
+		dbHTTPError(w, err, "Failed to delete subscription")
+		return
+	}
+
+	http.Redirect(w, r, "/admin/reports", http.StatusSeeOther)
+}
+
+// adminReportPreviewHandler renders the most recent report as it would be emailed
+func adminReportPreviewHandler(w http.ResponseWriter, r *http.Request) {
+	frequency := r.URL.Query().Get("frequency")
+	if frequency != reportWeekly {
+		frequency = reportDaily
+	}
+
+	from, to := reportPeriod(frequency, time.Now())
+	report, err := buildUsageReport(frequency, from, to)
+	if err != nil {
+		log.Printf("Failed to build usage report: %v", err)
+		dbHTTPError(w, err, "Failed to build report")
+		return
+	}
+
+	templates.ExecuteTemplate(w, "report_email.html", report)
+}
+
+// adminNotificationPreviewHandler renders a completion notification so
+// operators can check their templates. It uses the request given by ?request=
+// or sample data, and the configured templates unless template text is posted
+// in subject, email or webhook fields, so changes can be tried before a
+// reload. ?format= picks email (the default), subject or webhook.
+func adminNotificationPreviewHandler(w http.ResponseWriter, r *http.Request) {
+	data := sampleNotificationData()
+	if requestID := r.FormValue("request"); requestID != "" {
+		req, err := getRequest(requestID)
+		if err != nil {
+			lookupError(w, err, "Request")
+			return
+		}
+		rev, err := getPrimaryRevision(req.ID)
+		if err != nil {
+			http.Error(w, "Request has no completed revision", http.StatusNotFound)
+			return
+		}
+		data = newNotificationData(req, rev)
+	}
+
+	tmpl := currentConfig().NotifyTemplates
+	if r.Method == http.MethodPost {
+		texts := make(map[string]string, len(defaultNotificationTemplates))
+		for name := range defaultNotificationTemplates {
+			texts[name] = r.FormValue(strings.TrimSuffix(name, ".tmpl"))
+		}
+		posted, err := parseNotificationTemplates(texts)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		// Fields left empty keep the configured template
+		preview := *tmpl
+		if texts["subject.tmpl"] != "" {
+			preview.Subject = posted.Subject
+		}
+		if texts["email.tmpl"] != "" {
+			preview.Email = posted.Email
+		}
+		if texts["webhook.tmpl"] != "" {
+			preview.Webhook = posted.Webhook
+		}
+		tmpl = &preview
+	}
+
+	switch r.FormValue("format") {
+	case "webhook":
+		payload, err := tmpl.RenderWebhook(data)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(payload)
+	case "subject":
+		subject, _, err := tmpl.RenderEmail(data)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprintln(w, subject)
+	default:
+		_, body, err := tmpl.RenderEmail(data)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprint(w, body)
+	}
+}
+
+// adminReloadHandler reloads the configuration without restarting the server
+func adminReloadHandler(w http.ResponseWriter, r *http.Request) {
+	if err := reloadConfig(); err != nil {
+		log.Printf("Failed to reload configuration: %v", err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "reloaded"})
+}
+
+// adminQueueHandler shows queued and running image jobs per user
+func adminQueueHandler(w http.ResponseWriter, r *http.Request) {
+	stats := jobQueue.stats()
+
+	var queued, running int
+	for _, s := range stats {
+		queued += s.Queued
+		running += s.Running
+	}
+
+	data := struct {
+		Users   []UserQueueStats
+		Queued  int
+		Running int
+	}{
+		Users:   stats,
+		Queued:  queued,
+		Running: running,
+	}
+
+	templates.ExecuteTemplate(w, "admin_queue.html", data)
+}
+
+// adminSchemaDriftHandler reports provider schema mismatches seen since startup
+func adminSchemaDriftHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, schemaDriftCounts())
+}
+
+// adminPresetsHandler lists preset scenarios with forms to edit them
+func adminPresetsHandler(w http.ResponseWriter, r *http.Request) {
+	presets, err := getPresets(false)
+	if err != nil {
+		log.Printf("Failed to load presets: %v", err)
+		dbHTTPError(w, err, "Failed to load presets")
+		return
+	}
+
+	templates.ExecuteTemplate(w, "admin_presets.html", presets)
+}
+
+// adminSavePresetHandler creates a preset scenario or updates the one with
+// the submitted slug
+func adminSavePresetHandler(w http.ResponseWriter, r *http.Request) {
+	preset := &Preset{
+		Slug:        strings.TrimSpace(r.FormValue("slug")),
+		Name:        strings.TrimSpace(r.FormValue("name")),
+		Description: strings.TrimSpace(r.FormValue("description")),
+		Prompt:      strings.TrimSpace(r.FormValue("prompt")),
+		Enabled:     r.FormValue("enabled") != "",
+	}
+	if err := validatePreset(preset); err != nil {
+		http.Error(w, "Invalid preset: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := savePreset(preset); err != nil {
+		log.Printf("Failed to save preset %s: %v", preset.Slug, err)
+		dbHTTPError(w, err, "Failed to save preset")
+		return
+	}
+
+	http.Redirect(w, r, "/admin/presets", http.StatusSeeOther)
+}
+
+// adminDeletePresetHandler removes a preset scenario
+func adminDeletePresetHandler(w http.ResponseWriter, r *http.Request) {
+	if err := deletePreset(r.FormValue("slug")); err != nil {
+		log.Printf("Failed to delete preset: %v", err)
+		dbHTTPError(w, err, "Failed to delete preset")
+		return
+	}
+
+	http.Redirect(w, r, "/admin/presets", http.StatusSeeOther)
+}
+
+// adminBenchmarksHandler lists recent benchmarks with a form to start one
+func adminBenchmarksHandler(w http.ResponseWriter, r *http.Request) {
+	benchmarks, err := getRecentBenchmarks(20)
+	if err != nil {
+		log.Printf("Failed to load benchmarks: %v", err)
+		dbHTTPError(w, err, "Failed to load benchmarks")
+		return
+	}
+
+	data := struct {
+		Models     []BenchmarkModel
+		Benchmarks []*Benchmark
+		RequestID  string
+	}{
+		Models:     currentConfig().BenchmarkModels,
+		Benchmarks: benchmarks,
+		RequestID:  r.URL.Query().Get("request"),
+	}
+
+	templates.ExecuteTemplate(w, "admin_benchmarks.html", data)
+}
+
+// adminStartBenchmarkHandler runs a request's prompt through the selected models
+func adminStartBenchmarkHandler(w http.ResponseWriter, r *http.Request) {
+	req, err := getRequest(strings.TrimSpace(r.FormValue("request_id")))
+	if err != nil {
+		lookupError(w, err, "Request")
+		return
+	}
+	if req.AIPrompt == "" {
+		http.Error(w, "The request has no prompt yet", http.StatusBadRequest)
+		return
+	}
+
+	var models []BenchmarkModel
+	for _, name := range r.Form["model"] {
+		m, ok := benchmarkModel(name)
+		if !ok {
+			http.Error(w, "Unknown model "+name, http.StatusBadRequest)
+			return
+		}
+		models = append(models, m)
+	}
+	if len(models) == 0 {
+		http.Error(w, "Pick at least one model", http.StatusBadRequest)
+		return
+	}
+
+	bench, err := startBenchmark(req, models)
+	if err != nil {
+		log.Printf("Failed to start benchmark for request %s: %v", req.ID, err)
+		dbHTTPError(w, err, "Failed to start benchmark")
+		return
+	}
+
+	http.Redirect(w, r, "/admin/benchmarks/"+bench.ID, http.StatusSeeOther)
+}
+
+// adminBenchmarkHandler compares a benchmark's runs side by side
+func adminBenchmarkHandler(w http.ResponseWriter, r *http.Request) {
+	bench, err := getBenchmark(r.PathValue("id"))
+	if err != nil {
+		lookupError(w, err, "Benchmark")
+		return
+	}
+
+	runs, err := getBenchmarkRuns(bench.ID)
+	if err != nil {
+		log.Printf("Failed to load runs of benchmark %s: %v", bench.ID, err)
+		dbHTTPError(w, err, "Failed to load benchmark")
+		return
+	}
+
+	// Flag the fastest and cheapest completed runs
+	var fastest, cheapest *BenchmarkRun
+	inProgress := false
+	for _, run := range runs {
+		switch run.Status {
+		case "processing":
+			inProgress = true
+		case "completed":
+			if fastest == nil || run.DurationMS < fastest.DurationMS {
+				fastest = run
+			}
+			if cheapest == nil || run.Cost < cheapest.Cost {
+				cheapest = run
+			}
+		}
+	}
+
+	data := struct {
+		Benchmark  *Benchmark
+		Runs       []*BenchmarkRun
+		Fastest    *BenchmarkRun
+		Cheapest   *BenchmarkRun
+		InProgress bool
+	}{
+		Benchmark:  bench,
+		Runs:       runs,
+		Fastest:    fastest,
+		Cheapest:   cheapest,
+		InProgress: inProgress,
+	}
+
+	templates.ExecuteTemplate(w, "admin_benchmark.html", data)
+}
+
+// adminBenchmarkImageHandler serves a benchmark run's result, or the
+// request's original photo for run "original"
+func adminBenchmarkImageHandler(w http.ResponseWriter, r *http.Request) {
+	bench, err := getBenchmark(r.PathValue("id"))
+	if err != nil {
+		lookupError(w, err, "Benchmark")
+		return
+	}
+
+	if r.PathValue("run") == "original" {
+		req, err := getRequest(bench.RequestID)
+		if err != nil {
+			lookupError(w, err, "Request")
+			return
+		}
+		serveMediaFile(w, r, req.ImagePath)
+		return
+	}
+
+	runs, err := getBenchmarkRuns(bench.ID)
+	if err != nil {
+		dbHTTPError(w, err, "Failed to load benchmark")
+		return
+	}
+	for _, run := range runs {
+		if run.ID == r.PathValue("run") && run.ResultImagePath != "" {
+			serveMediaFile(w, r, run.ResultImagePath)
+			return
+		}
+	}
+	http.Error(w, "Image not found", http.StatusNotFound)
+}
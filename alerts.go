@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"log"
+	"sync"
+	"time"
+)
+
+// Alerts tell the operator about problems users would otherwise report
+// first: a pipeline stage failing more than ALERT_ERROR_RATE of the time
+// within ALERT_WINDOW, and it recovering, and the provider failures only the
+// operator can fix. Every alert is logged; it's also posted to
+// ALERT_WEBHOOK_URL, emailed to ALERT_EMAILS and reported to Sentry when
+// those are configured. Stage outcomes are counted per instance.
+
+// Kinds of alerts
+const (
+	alertStageErrors    = "stage_errors"
+	alertStageRecovered = "stage_recovered"
+	alertProvider       = "provider_failure"
+)
+
+// Alert is an alert as posted to ALERT_WEBHOOK_URL
+type Alert struct {
+	Kind      string    `json:"kind"`
+	Message   string    `json:"message"`
+	Stage     string    `json:"stage,omitempty"`
+	Failures  int       `json:"failures,omitempty"`
+	Total     int       `json:"total,omitempty"`
+	ErrorRate float64   `json:"error_rate,omitempty"`
+	Window    string    `json:"window,omitempty"`
+	ErrorCode string    `json:"error_code,omitempty"`
+	Instance  string    `json:"instance"`
+	Time      time.Time `json:"time"`
+}
+
+// stageOutcome is one pass through a pipeline stage
+type stageOutcome struct {
+	at     time.Time
+	failed bool
+}
+
+// stageMonitor keeps the recent outcomes of each stage, and which stages
+// are alerting
+type stageMonitor struct {
+	mu       sync.Mutex
+	outcomes map[string][]stageOutcome // by stage, oldest first
+	alerting map[string]bool
+}
+
+var stageHealth = &stageMonitor{
+	outcomes: map[string][]stageOutcome{},
+	alerting: map[string]bool{},
+}
+
+// trackStage records whether a pass through a stage failed, and alerts when
+// that tips its error rate over ALERT_ERROR_RATE or back under it. Failures
+// caused by what the user entered, like a place that doesn't exist, aren't
+// failures of the stage.
+func trackStage(stage string, err error) {
+	failed := err != nil && !errors.Is(err, ErrLocationNotFound)
+	if alert := stageHealth.track(stage, failed, time.Now()); alert != nil {
+		sendAlert(*alert)
+	}
+}
+
+// track adds an outcome to a stage's window, returning the alert it causes,
+// if any
+func (m *stageMonitor) track(stage string, failed bool, now time.Time) *Alert {
+	cfg := currentConfig()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// Outcomes arrive in order, so the expired ones are at the front
+	outcomes := append(m.outcomes[stage], stageOutcome{at: now, failed: failed})
+	cutoff := now.Add(-cfg.AlertWindow)
+	expired := 0
+	for expired < len(outcomes) && outcomes[expired].at.Before(cutoff) {
+		expired++
+	}
+	outcomes = append(outcomes[:0], outcomes[expired:]...)
+	m.outcomes[stage] = outcomes
+
+	failures := 0
+	for _, o := range outcomes {
+		if o.failed {
+			failures++
+		}
+	}
+	rate := float64(failures) / float64(len(outcomes))
+	alert := &Alert{
+		Stage:     stage,
+		Failures:  failures,
+		Total:     len(outcomes),
+		ErrorRate: rate,
+		Window:    cfg.AlertWindow.String(),
+	}
+
+	switch {
+	case !m.alerting[stage] && failures >= cfg.AlertMinFailures && rate >= cfg.AlertErrorRate:
+		m.alerting[stage] = true
+		alert.Kind = alertStageErrors
+		alert.Message = fmt.Sprintf("The %s stage failed %d of its last %d times (%.0f%%) within %s",
+			stage, failures, len(outcomes), rate*100, cfg.AlertWindow)
+		return alert
+	case m.alerting[stage] && !failed && rate < cfg.AlertErrorRate:
+		m.alerting[stage] = false
+		alert.Kind = alertStageRecovered
+		alert.Message = fmt.Sprintf("The %s stage recovered, failing %d of its last %d times (%.0f%%) within %s",
+			stage, failures, len(outcomes), rate*100, cfg.AlertWindow)
+		return alert
+	}
+	return nil
+}
+
+// sendAlert logs an alert and sends it to every configured destination in
+// the background. Recoveries aren't reported to Sentry, which only tracks
+// errors.
+func sendAlert(alert Alert) {
+	alert.Instance = instanceID
+	alert.Time = time.Now().UTC()
+	log.Printf("Alert: %s", alert.Message)
+
+	cfg := currentConfig()
+	if alert.Kind != alertStageRecovered {
+		reportError(alert.Message, map[string]interface{}{
+			"kind":       alert.Kind,
+			"stage":      alert.Stage,
+			"error_code": alert.ErrorCode,
+		})
+	}
+	if cfg.AlertWebhookURL != "" {
+		goSafe("", func() {
+			if err := sendAlertWebhook(cfg.AlertWebhookURL, alert); err != nil {
+				log.Printf("Failed to send alert webhook: %v", err)
+			}
+		})
+	}
+	if len(cfg.AlertEmails) > 0 && emailConfigured() {
+		goSafe("", func() {
+			subject := "SkyWeave alert: " + alert.Message
+			if alert.Kind == alertStageRecovered {
+				subject = "SkyWeave recovered: " + alert.Message
+			}
+			body := fmt.Sprintf("<p>%s</p>\n<p>Instance %s, %s</p>", html.EscapeString(alert.Message),
+				html.EscapeString(alert.Instance), alert.Time.Format(time.RFC1123))
+			if err := sendEmail(cfg.AlertEmails, subject, body); err != nil {
+				log.Printf("Failed to email alert: %v", err)
+			}
+		})
+	}
+}
+
+// sendAlertWebhook posts an alert as JSON
+func sendAlertWebhook(webhookURL string, alert Alert) error {
+	payload, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+	resp, err := webhookClient.Post(webhookURL, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("failed to send webhook: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook responded with %s", resp.Status)
+	}
+	return nil
+}
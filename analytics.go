@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Product events trace requests through the funnel, from the form to the
+// download, on the server so no client-side tracker is needed. ANALYTICS
+// picks where they go: the log, PostHog, or the analytics_events table.
+// Events name users by their user cookie ID only.
+
+// Product events
+const (
+	eventRequestCreated      = "request_created"
+	eventWeatherConfirmed    = "weather_confirmed"
+	eventGenerationSucceeded = "generation_succeeded"
+	eventResultDownloaded    = "result_downloaded"
+)
+
+// Analytics sinks selectable with ANALYTICS
+const (
+	analyticsLog     = "log"
+	analyticsPostHog = "posthog"
+	analyticsTable   = "table"
+)
+
+// AnalyticsEvent is one product event
+type AnalyticsEvent struct {
+	Name       string                 `json:"event"`
+	UserID     string                 `json:"user_id"`
+	RequestID  string                 `json:"request_id,omitempty"`
+	Properties map[string]interface{} `json:"properties,omitempty"`
+	Time       time.Time              `json:"time"`
+}
+
+// AnalyticsSink receives product events
+type AnalyticsSink interface {
+	Send(event AnalyticsEvent) error
+}
+
+// newAnalyticsSink builds the sink configured by ANALYTICS. It returns nil
+// when none is configured.
+func newAnalyticsSink(kind, postHogKey, postHogHost string) (AnalyticsSink, error) {
+	switch kind {
+	case "":
+		return nil, nil
+	case analyticsLog:
+		return logAnalytics{}, nil
+	case analyticsTable:
+		return tableAnalytics{}, nil
+	case analyticsPostHog:
+		if postHogKey == "" {
+			return nil, fmt.Errorf("POSTHOG_API_KEY must be set for ANALYTICS=%s", analyticsPostHog)
+		}
+		host, err := url.Parse(postHogHost)
+		if err != nil || (host.Scheme != "https" && host.Scheme != "http") || host.Host == "" {
+			return nil, fmt.Errorf("invalid POSTHOG_HOST %q", postHogHost)
+		}
+		return &postHogAnalytics{apiKey: postHogKey, captureURL: strings.TrimSuffix(postHogHost, "/") + "/capture/"}, nil
+	default:
+		return nil, fmt.Errorf("unknown ANALYTICS %q (expected %s, %s or %s)", kind, analyticsLog, analyticsPostHog, analyticsTable)
+	}
+}
+
+// trackEvent sends a product event to the configured sink, if any, in the
+// background. Failures are only logged; analytics never fail a request.
+func trackEvent(name, userID, requestID string, properties map[string]interface{}) {
+	sink := currentConfig().Analytics
+	if sink == nil {
+		return
+	}
+	event := AnalyticsEvent{
+		Name:       name,
+		UserID:     userID,
+		RequestID:  requestID,
+		Properties: properties,
+		Time:       time.Now().UTC(),
+	}
+	goSafe(requestID, func() {
+		if err := sink.Send(event); err != nil {
+			log.Printf("Failed to send %s event: %v", name, err)
+		}
+	})
+}
+
+// trackRequestEvent sends a product event about a request, on behalf of the
+// request's owner, for code that doesn't have the request at hand
+func trackRequestEvent(name, requestID string, properties map[string]interface{}) {
+	if currentConfig().Analytics == nil {
+		return
+	}
+	req, err := getRequest(requestID)
+	if err != nil {
+		log.Printf("Failed to load request %s for %s event: %v", requestID, name, err)
+		return
+	}
+	trackEvent(name, req.UserID, requestID, properties)
+}
+
+// logAnalytics writes events to the log as JSON, for log pipelines to pick up
+type logAnalytics struct{}
+
+func (logAnalytics) Send(event AnalyticsEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	log.Printf("Event: %s", data)
+	return nil
+}
+
+// tableAnalytics stores events in the analytics_events table, to be queried
+// with SQL
+type tableAnalytics struct{}
+
+func (tableAnalytics) Send(event AnalyticsEvent) error {
+	return insertAnalyticsEvent(event)
+}
+
+// postHogAnalytics sends events to PostHog's capture API
+type postHogAnalytics struct {
+	apiKey     string
+	captureURL string
+}
+
+func (p *postHogAnalytics) Send(event AnalyticsEvent) error {
+	properties := map[string]interface{}{}
+	for name, value := range event.Properties {
+		properties[name] = value
+	}
+	if event.RequestID != "" {
+		properties["request_id"] = event.RequestID
+	}
+	payload, err := json.Marshal(map[string]interface{}{
+		"api_key":     p.apiKey,
+		"event":       event.Name,
+		"distinct_id": event.UserID,
+		"properties":  properties,
+		"timestamp":   event.Time.Format(time.RFC3339Nano),
+	})
+	if err != nil {
+		return err
+	}
+	resp, err := analyticsClient.Post(p.captureURL, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("failed to send to PostHog: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("PostHog responded with %s", resp.Status)
+	}
+	return nil
+}
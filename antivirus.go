@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Uploads can be scanned for malware before anything else is done with
+// them, when ANTIVIRUS names a scanner. The raw bytes are scanned, as
+// received; a flagged photo is moved to DATA_DIR/quarantine instead of being
+// stored, and its request fails with errorCodeUploadInfected.
+
+// Scanners selectable with ANTIVIRUS
+const (
+	antivirusClamAV = "clamav"
+)
+
+// VirusScanner scans uploads for malware. Scan returns the name of what it
+// found, or "" for a clean file, and an error when the file couldn't be
+// scanned.
+type VirusScanner interface {
+	Name() string
+	Scan(r io.Reader) (string, error)
+	Ping() error
+}
+
+// newVirusScanner builds the scanner configured by ANTIVIRUS. It returns nil
+// when none is configured.
+func newVirusScanner(kind, clamAddress string, timeout time.Duration) (VirusScanner, error) {
+	switch kind {
+	case "":
+		return nil, nil
+	case antivirusClamAV:
+		return newClamd(clamAddress, timeout)
+	default:
+		return nil, fmt.Errorf("unknown ANTIVIRUS %q (expected %s)", kind, antivirusClamAV)
+	}
+}
+
+// clamd scans with a ClamAV daemon over its socket, streaming files with
+// the INSTREAM command so clamd needn't share a filesystem with SkyWeave
+type clamd struct {
+	network string // "unix" or "tcp"
+	address string
+	timeout time.Duration
+}
+
+// clamdChunkSize is how much of a file is sent to clamd at a time
+const clamdChunkSize = 64 << 10
+
+// newClamd parses CLAMAV_ADDRESS: a Unix socket path, optionally prefixed
+// with unix:, or host:port, optionally prefixed with tcp://
+func newClamd(address string, timeout time.Duration) (*clamd, error) {
+	c := &clamd{timeout: timeout}
+	switch {
+	case address == "":
+		return nil, fmt.Errorf("CLAMAV_ADDRESS must be set for ANTIVIRUS=%s", antivirusClamAV)
+	case strings.HasPrefix(address, "unix:"):
+		c.network, c.address = "unix", strings.TrimPrefix(strings.TrimPrefix(address, "unix:"), "//")
+	case strings.HasPrefix(address, "tcp://"):
+		c.network, c.address = "tcp", strings.TrimPrefix(address, "tcp://")
+	case strings.HasPrefix(address, "/"):
+		c.network, c.address = "unix", address
+	default:
+		c.network, c.address = "tcp", address
+	}
+	return c, nil
+}
+
+func (c *clamd) Name() string {
+	return fmt.Sprintf("ClamAV at %s:%s", c.network, c.address)
+}
+
+// command sends a command to clamd, writes its payload with send and
+// returns its reply
+func (c *clamd) command(name string, send func(io.Writer) error) (string, error) {
+	conn, err := net.DialTimeout(c.network, c.address, c.timeout)
+	if err != nil {
+		return "", fmt.Errorf("failed to connect to clamd: %w", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(c.timeout))
+
+	// The z prefix delimits commands and replies with NUL bytes
+	w := bufio.NewWriter(conn)
+	if _, err := w.WriteString("z" + name + "\x00"); err != nil {
+		return "", fmt.Errorf("failed to send to clamd: %w", err)
+	}
+	if send != nil {
+		if err := send(w); err != nil {
+			return "", err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return "", fmt.Errorf("failed to send to clamd: %w", err)
+	}
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && reply == "" {
+		return "", fmt.Errorf("failed to read clamd reply: %w", err)
+	}
+	return strings.TrimRight(reply, "\x00\n"), nil
+}
+
+// Scan streams r to clamd in length-prefixed chunks, ended by an empty one.
+// Replies are "stream: OK", "stream: <signature> FOUND" or an error.
+func (c *clamd) Scan(r io.Reader) (string, error) {
+	reply, err := c.command("INSTREAM", func(w io.Writer) error {
+		buf := make([]byte, clamdChunkSize)
+		for {
+			n, err := r.Read(buf)
+			if n > 0 {
+				if err := binary.Write(w, binary.BigEndian, uint32(n)); err != nil {
+					return fmt.Errorf("failed to send to clamd: %w", err)
+				}
+				if _, err := w.Write(buf[:n]); err != nil {
+					return fmt.Errorf("failed to send to clamd: %w", err)
+				}
+			}
+			if err == io.EOF {
+				return binary.Write(w, binary.BigEndian, uint32(0))
+			}
+			if err != nil {
+				return fmt.Errorf("failed to read upload: %w", err)
+			}
+		}
+	})
+	if err != nil {
+		return "", err
+	}
+
+	result := strings.TrimPrefix(reply, "stream: ")
+	switch {
+	case result == "OK":
+		return "", nil
+	case strings.HasSuffix(result, " FOUND"):
+		return strings.TrimSuffix(result, " FOUND"), nil
+	default:
+		return "", fmt.Errorf("clamd: %s", reply)
+	}
+}
+
+// Ping checks that clamd answers
+func (c *clamd) Ping() error {
+	reply, err := c.command("PING", nil)
+	if err != nil {
+		return err
+	}
+	if reply != "PONG" {
+		return fmt.Errorf("unexpected clamd reply %q", reply)
+	}
+	return nil
+}
+
+// quarantineRecord describes a quarantined upload, in a JSON file next to it
+type quarantineRecord struct {
+	RequestID     string    `json:"request_id"`
+	UserID        string    `json:"user_id"`
+	ClientIP      string    `json:"client_ip"`
+	Filename      string    `json:"filename"`
+	Size          int64     `json:"size"`
+	Signature     string    `json:"signature"`
+	Scanner       string    `json:"scanner"`
+	QuarantinedAt time.Time `json:"quarantined_at"`
+}
+
+// quarantineUpload copies a flagged upload into DATA_DIR/quarantine as
+// <request>.bin, readable only by the server's user, with a <request>.json
+// record of where it came from and what was found
+func quarantineUpload(file io.ReadSeeker, record quarantineRecord) error {
+	dir := filepath.Join(dataDir, "quarantine")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	path := filepath.Join(dir, record.RequestID+".bin")
+	out, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	record.Size, err = io.Copy(out, file)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path)
+		return err
+	}
+
+	data, err := json.MarshalIndent(record, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, record.RequestID+".json"), data, 0600)
+}
+
+// scanUpload scans an upload with the configured scanner, if any, rewinding
+// it for whatever reads it next. It returns the signature of the malware
+// found, or "" for a clean upload or when no scanner is configured. With
+// ANTIVIRUS_FAIL_OPEN, uploads that can't be scanned are let through.
+func scanUpload(file io.ReadSeeker) (string, error) {
+	cfg := currentConfig()
+	if cfg.Antivirus == nil {
+		return "", nil
+	}
+	signature, err := cfg.Antivirus.Scan(file)
+	trackStage(stageScan, err)
+	if _, seekErr := file.Seek(0, io.SeekStart); err == nil {
+		err = seekErr
+	}
+	if err != nil && cfg.AntivirusFailOpen {
+		log.Printf("Virus scan failed, accepting the upload unscanned: %v", err)
+		return "", nil
+	}
+	return signature, err
+}
@@ -0,0 +1,595 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// locationsHandler returns geocoding suggestions for the start form autocomplete
+func locationsHandler(w http.ResponseWriter, r *http.Request) {
+	query := strings.TrimSpace(r.URL.Query().Get("q"))
+	if len([]rune(query)) < 2 {
+		writeAPIList(w, r, []LocationSuggestion{}, 0)
+		return
+	}
+
+	// Autocomplete searches on every keystroke, so each client gets a share
+	// of the geocoding quota, counted across instances when the cache is shared
+	if ok, retry := allowRate("locations:"+clientIP(r), currentConfig().LocationSearchRate, time.Minute); !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(retry.Seconds())+1))
+		writeJSON(w, http.StatusTooManyRequests, map[string]string{"error": "Too many location searches, try again shortly"})
+		return
+	}
+
+	results, err := searchLocations(query, 5)
+	if err != nil {
+		log.Printf("Location search failed for %q: %v", query, err)
+		writeJSON(w, http.StatusBadGateway, map[string]string{"error": "Location search unavailable"})
+		return
+	}
+
+	suggestions := make([]LocationSuggestion, 0, len(results))
+	for i := range results {
+		suggestions = append(suggestions, LocationSuggestion{
+			Label:   formatLocationLabel(&results[i]),
+			Name:    results[i].Name,
+			State:   results[i].State,
+			Country: results[i].Country,
+			Lat:     results[i].Lat,
+			Lon:     results[i].Lon,
+			Local:   placeNames(&results[i]),
+		})
+	}
+
+	writeAPIList(w, r, suggestions, 0)
+}
+
+// RequestSummary is a request as listed by the API
+type RequestSummary struct {
+	ID            string   `json:"id"`
+	Location      string   `json:"location"`
+	LocationID    int64    `json:"location_id,omitempty"`
+	Country       string   `json:"country,omitempty"`
+	Date          string   `json:"date"`
+	EndDate       string   `json:"end_date,omitempty"`
+	Status        string   `json:"status"`
+	WeatherSource string   `json:"weather_source,omitempty"` // provider, empty when a preset replaced the weather
+	WeatherType   string   `json:"weather_type,omitempty"`   // observed, reanalysis or forecast
+	RainMM        *float64 `json:"rain_mm,omitempty"`        // average per hour, once the weather is known
+	SnowMM        *float64 `json:"snow_mm,omitempty"`
+	Tags          []string `json:"tags"`
+	ImageURL      string   `json:"image_url,omitempty"`
+	ResultsURL    string   `json:"results_url"`
+	CreatedAt     string   `json:"created_at"`
+
+	RawWeather []RawWeather `json:"raw_weather,omitempty"` // with ?include=raw_weather
+}
+
+// RawWeather is a stored weather provider response, as the API returns it
+type RawWeather struct {
+	Provider  string          `json:"provider"`
+	Units     string          `json:"units"`
+	FetchedAt string          `json:"fetched_at"`
+	Raw       json.RawMessage `json:"raw"`
+}
+
+// newRawWeather converts a weather snapshot for the API
+func newRawWeather(snapshot *WeatherSnapshot) RawWeather {
+	return RawWeather{
+		Provider:  snapshot.Provider,
+		Units:     snapshot.Units,
+		FetchedAt: snapshot.FetchedAt,
+		Raw:       json.RawMessage(snapshot.RawJSON),
+	}
+}
+
+// Indented is the response pretty-printed, as the confirmation page shows it
+func (rw RawWeather) Indented() string {
+	var b bytes.Buffer
+	if err := json.Indent(&b, rw.Raw, "", "  "); err != nil {
+		return string(rw.Raw)
+	}
+	return b.String()
+}
+
+// requestRawWeather returns the provider responses a request's weather was
+// read from, one per day of its dates, or nil if its weather wasn't fetched
+func requestRawWeather(req *Request) ([]RawWeather, error) {
+	dates, err := parseDateRange(req.TargetDate, req.EndDate)
+	if err != nil {
+		return nil, err
+	}
+	snapshots, err := getLatestWeatherSnapshots(req.ID, len(dates))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	raw := make([]RawWeather, 0, len(snapshots))
+	for _, snapshot := range snapshots {
+		raw = append(raw, newRawWeather(snapshot))
+	}
+	return raw, nil
+}
+
+// newRequestSummary summarizes a request for the API
+func newRequestSummary(r *http.Request, req *Request, tags []string) RequestSummary {
+	summary := RequestSummary{
+		ID:            req.ID,
+		Location:      req.LocationName,
+		LocationID:    req.LocationID,
+		Country:       req.Country,
+		Date:          req.TargetDate,
+		EndDate:       req.EndDate,
+		Status:        req.Status,
+		WeatherSource: req.WeatherSource,
+		WeatherType:   req.WeatherDataType(),
+		Tags:          tags,
+		ResultsURL:    absoluteURL(r, "/results/"+req.ID),
+		CreatedAt:     req.CreatedAt,
+	}
+	if summary.Location == "" {
+		summary.Location = req.LocationInput
+	}
+	if req.WeatherConditionID != 0 {
+		summary.RainMM, summary.SnowMM = &req.RainMM, &req.SnowMM
+	}
+	if summary.Tags == nil {
+		summary.Tags = []string{}
+	}
+	if req.Status == "completed" {
+		summary.ImageURL = absoluteURL(r, "/image/"+req.ID)
+	}
+	return summary
+}
+
+// requestsListHandler lists the user's requests, newest first. ?tag= only
+// lists requests with that tag, ?q= only those whose location, prompt or tags
+// contain every word, ?location= only those resolved to that canonical
+// location id, ?precipitation= (rain, snow or dry) only those whose weather
+// had it, and ?limit= (up to 100) and ?offset= page through them.
+// ?include=raw_weather adds the provider responses each request's weather
+// was read from.
+func requestsListHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserID(w, r)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "Failed to identify user"})
+		return
+	}
+
+	query := r.URL.Query()
+	limit, err := strconv.Atoi(query.Get("limit"))
+	if err != nil || limit < 1 || limit > 100 {
+		limit = 20
+	}
+	offset, err := strconv.Atoi(query.Get("offset"))
+	if err != nil || offset < 0 {
+		offset = 0
+	}
+
+	locationID, _ := strconv.ParseInt(query.Get("location"), 10, 64)
+
+	precipitation := query.Get("precipitation")
+	if !isValidPrecipitationFilter(precipitation) {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "precipitation must be rain, snow or dry"})
+		return
+	}
+
+	filter := RequestFilter{
+		Tag:           normalizeTag(query.Get("tag")),
+		Search:        searchQuery(query.Get("q")),
+		LocationID:    locationID,
+		Precipitation: precipitation,
+	}
+	requests, err := listRequests(userID, filter, limit, offset)
+	if err != nil {
+		log.Printf("Failed to list requests for user %s: %v", userID, err)
+		dbJSONError(w, err, "Failed to list requests")
+		return
+	}
+	requestTags, err := getUserRequestTags(userID)
+	if err != nil {
+		log.Printf("Failed to load request tags for user %s: %v", userID, err)
+	}
+
+	includeRaw := query.Get("include") == "raw_weather"
+	summaries := make([]RequestSummary, 0, len(requests))
+	for _, req := range requests {
+		summary := newRequestSummary(r, req, requestTags[req.ID])
+		if includeRaw {
+			summary.RawWeather, err = requestRawWeather(req)
+			if err != nil {
+				log.Printf("Failed to load weather snapshots of request %s: %v", req.ID, err)
+			}
+		}
+		summaries = append(summaries, summary)
+	}
+
+	// A full page may have more after it
+	nextOffset := 0
+	if len(summaries) == limit {
+		nextOffset = offset + limit
+	}
+	writeAPIList(w, r, summaries, nextOffset)
+}
+
+// tagsHandler suggests the user's tags starting with ?q=, most used first,
+// for autocompleting tag inputs
+func tagsHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserID(w, r)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "Failed to identify user"})
+		return
+	}
+
+	tags, err := getUserTags(userID, normalizeTag(r.URL.Query().Get("q")), 10)
+	if err != nil {
+		log.Printf("Failed to load tags for user %s: %v", userID, err)
+		dbJSONError(w, err, "Failed to load tags")
+		return
+	}
+	if tags == nil {
+		tags = []TagCount{}
+	}
+	writeAPIList(w, r, tags, 0)
+}
+
+// limitsHandler returns the upload limits so clients can check a photo
+// before uploading it
+func limitsHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, currentConfig().UploadLimits)
+}
+
+// quotaHandler returns how many generations the visitor has left today, so
+// the start form can keep its count current. Visitors without a limit get
+// {"limited": false}.
+func quotaHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserID(w, r)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "Failed to identify user"})
+		return
+	}
+
+	quota, err := trialQuota(r, userID)
+	if err != nil {
+		log.Printf("Failed to load trial quota for %s: %v", clientIP(r), err)
+		dbJSONError(w, err, "Failed to load quota")
+		return
+	}
+	if quota == nil {
+		writeJSON(w, http.StatusOK, map[string]bool{"limited": false})
+		return
+	}
+	writeJSON(w, http.StatusOK, struct {
+		Limited bool `json:"limited"`
+		*Quota
+	}{true, quota})
+}
+
+// requestWeatherHandler returns the stored weather snapshot of a request along
+// with the weather and prompt regenerated from it, for auditing results
+func requestWeatherHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserID(w, r)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "Failed to identify user"})
+		return
+	}
+
+	req, err := getRequest(r.PathValue("id"))
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		log.Printf("Failed to load request %s: %v", r.PathValue("id"), err)
+		dbJSONError(w, err, "Failed to load request")
+		return
+	}
+	if err != nil || req.UserID != userID {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "Request not found"})
+		return
+	}
+
+	// A date range stores one snapshot per day
+	dates, err := parseDateRange(req.TargetDate, req.EndDate)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "Request has an invalid date range"})
+		return
+	}
+
+	snapshots, err := getLatestWeatherSnapshots(req.ID, len(dates))
+	if err != nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "No weather snapshot for this request"})
+		return
+	}
+
+	days := make([]*WeatherData, 0, len(snapshots))
+	raw := make([]RawWeather, 0, len(snapshots))
+	for _, snapshot := range snapshots {
+		weatherData, err := parseWeatherSnapshot(snapshot.Provider, snapshot.Units, []byte(snapshot.RawJSON))
+		if err != nil {
+			log.Printf("Failed to replay weather snapshot %d: %v", snapshot.ID, err)
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "Stored weather snapshot can't be parsed"})
+			return
+		}
+		days = append(days, weatherData)
+		raw = append(raw, newRawWeather(snapshot))
+	}
+	weatherData := summarizeWeather(days)
+
+	// A blended preset is part of the prompt; if it has since been deleted,
+	// only the weather part can be regenerated
+	var preset *Preset
+	if req.Preset != "" {
+		preset, _ = getPreset(req.Preset)
+	}
+	prompt, err := requestPrompt(req, preset, weatherData, promptLocation(req.PlaceName(), req.Country),
+		req.Caption, req.PromptVariant)
+	if err != nil {
+		log.Printf("Failed to regenerate prompt for request %s: %v", req.ID, err)
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"request_id":   req.ID,
+		"source":       req.WeatherSource,
+		"weather_type": req.WeatherDataType(),
+		"snapshots":    raw,
+		"fetches":      countWeatherSnapshots(req.ID) / len(dates),
+		"weather":      weatherData,
+		"prompt":       prompt,
+	})
+}
+
+// readAPIFields reads the named fields of a JSON or form request body,
+// leaving out the ones the client didn't send. JSON values must be strings.
+func readAPIFields(w http.ResponseWriter, r *http.Request, names ...string) (map[string]string, error) {
+	fields := make(map[string]string)
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		if err := r.ParseForm(); err != nil {
+			return nil, errors.New("invalid form body")
+		}
+		for _, name := range names {
+			if r.PostForm.Has(name) {
+				fields[name] = r.PostForm.Get(name)
+			}
+		}
+		return fields, nil
+	}
+
+	var body map[string]any
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&body); err != nil && err != io.EOF {
+		return nil, errors.New("invalid JSON body")
+	}
+	for _, name := range names {
+		value, ok := body[name]
+		if !ok {
+			continue
+		}
+		text, ok := value.(string)
+		if !ok {
+			return nil, fmt.Errorf("%s must be a string", name)
+		}
+		fields[name] = text
+	}
+	return fields, nil
+}
+
+// regeneratePromptHandler writes a new prompt for a request awaiting
+// confirmation from its stored weather snapshots, without fetching the
+// weather again, so it can be reviewed before confirming. The body (JSON or
+// form) may pick another prompt variant, intensity or time of day; omitted
+// fields keep the request's own. The new prompt replaces the request's.
+func regeneratePromptHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserID(w, r)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "Failed to identify user"})
+		return
+	}
+
+	req, err := getRequest(r.PathValue("id"))
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		log.Printf("Failed to load request %s: %v", r.PathValue("id"), err)
+		dbJSONError(w, err, "Failed to load request")
+		return
+	}
+	if err != nil || req.UserID != userID {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "Request not found"})
+		return
+	}
+	if req.Status != "weather_fetched" {
+		writeJSON(w, http.StatusConflict, map[string]string{"error": "Only requests awaiting confirmation can get a new prompt"})
+		return
+	}
+
+	fields, err := readAPIFields(w, r, "variant", "intensity", "time_of_day")
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": upperFirst(err.Error())})
+		return
+	}
+
+	errs := FieldErrors{}
+	if variant, ok := fields["variant"]; ok {
+		if _, ok := currentConfig().PromptTemplates[variant]; !ok {
+			errs.add("variant", "Unknown prompt variant")
+		}
+		req.PromptVariant = variant
+	}
+	if value, ok := fields["intensity"]; ok {
+		var valid bool
+		if req.Intensity, valid = parseIntensity(value); !valid {
+			errs.add("intensity", "Choose subtle, natural or dramatic")
+		}
+	}
+	if timeOfDay, ok := fields["time_of_day"]; ok {
+		validateTimeOfDay(errs, timeOfDay)
+		req.TimeOfDay = timeOfDay
+	}
+	if len(errs) > 0 {
+		writeFieldErrors(w, errs, nil, http.StatusUnprocessableEntity)
+		return
+	}
+
+	// A preset scenario stands in for the weather, which was never fetched
+	var weatherData *WeatherData
+	if !req.WeatherReplaced() {
+		if weatherData, err = replayRequestWeather(req); err != nil {
+			log.Printf("Failed to replay weather of request %s: %v", req.ID, err)
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "Stored weather snapshot can't be parsed"})
+			return
+		}
+	}
+	var preset *Preset
+	if req.Preset != "" {
+		if preset, err = getPreset(req.Preset); err != nil {
+			writeJSON(w, http.StatusConflict, map[string]string{"error": "The request's preset is no longer available"})
+			return
+		}
+	}
+
+	prompt, err := requestPrompt(req, preset, weatherData, promptLocation(req.PlaceName(), req.Country),
+		req.Caption, req.PromptVariant)
+	if err != nil {
+		log.Printf("Failed to regenerate prompt for request %s: %v", req.ID, err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "Failed to generate prompt"})
+		return
+	}
+
+	err = setRequestPrompt(req.ID, prompt, req.PromptVariant, req.Intensity, req.TimeOfDay)
+	if errors.Is(err, errRequestConfirmed) {
+		writeJSON(w, http.StatusConflict, map[string]string{"error": "Only requests awaiting confirmation can get a new prompt"})
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to save prompt of request %s: %v", req.ID, err)
+		dbJSONError(w, err, "Failed to save prompt")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{
+		"request_id":   req.ID,
+		"prompt":       prompt,
+		"model_prompt": intensityPrompt(prompt, req.Intensity),
+		"variant":      req.PromptVariant,
+		"intensity":    req.Intensity,
+		"time_of_day":  req.TimeOfDay,
+	})
+}
+
+// cloneRequestHandler starts a new request from one of the user's requests,
+// reusing its uploaded photo so a parameter can be swept without uploading
+// it again. The body (JSON or form) may change the date or date range, the
+// location (resolved again), the time of day, intensity and preset; every
+// other field is copied. Weather is looked up as for a new submission.
+func cloneRequestHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserID(w, r)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "Failed to identify user"})
+		return
+	}
+
+	parent, err := getRequest(r.PathValue("id"))
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		log.Printf("Failed to load request %s: %v", r.PathValue("id"), err)
+		dbJSONError(w, err, "Failed to load request")
+		return
+	}
+	if err != nil || parent.UserID != userID {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "Request not found"})
+		return
+	}
+	// Quarantined uploads were never stored
+	if parent.ImagePath == "" {
+		writeJSON(w, http.StatusConflict, map[string]string{"error": "The original request has no photo"})
+		return
+	}
+
+	fields, err := readAPIFields(w, r, "date", "end_date", "location", "location_mode",
+		"time_of_day", "intensity", "preset", "preset_mode")
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": upperFirst(err.Error())})
+		return
+	}
+
+	clone := *parent
+	errs, suggestions := FieldErrors{}, FieldSuggestions{}
+	locationMode := locationModeAuto
+	if location, ok := fields["location"]; ok {
+		if mode, ok := fields["location_mode"]; ok && mode != "" {
+			locationMode = mode
+		}
+		clone.LocationInput = strings.TrimSpace(location)
+		validateLocation(errs, clone.LocationInput, locationMode)
+		// Resolved again, so nothing is kept from the parent's place
+		clone.LocationName, clone.Country, clone.Latitude, clone.Longitude = "", "", 0, 0
+	} else if parent.LocationName == "" {
+		errs.add("location", "The original request has no resolved location, give one")
+	}
+
+	if date, ok := fields["date"]; ok {
+		// A new start date doesn't keep the parent's range unless one is given
+		clone.TargetDate, clone.EndDate = date, fields["end_date"]
+	} else if endDate, ok := fields["end_date"]; ok {
+		clone.EndDate = endDate
+	}
+	if value, ok := fields["intensity"]; ok {
+		var valid bool
+		if clone.Intensity, valid = parseIntensity(value); !valid {
+			errs.add("intensity", "Choose subtle, natural or dramatic")
+		}
+	}
+	if timeOfDay, ok := fields["time_of_day"]; ok {
+		validateTimeOfDay(errs, timeOfDay)
+		clone.TimeOfDay = timeOfDay
+	}
+	if slug, ok := fields["preset"]; ok {
+		clone.Preset, clone.PresetMode = slug, ""
+		if slug != "" {
+			if preset, err := getPreset(slug); err != nil || !preset.Enabled {
+				errs.add("preset", "This scenario isn't available")
+			}
+			clone.PresetMode = presetModeReplace
+		}
+	}
+	if mode, ok := fields["preset_mode"]; ok && clone.Preset != "" {
+		if !isValidPresetMode(mode) {
+			errs.add("preset_mode", "Choose instead of or blended with the real weather")
+		}
+		clone.PresetMode = mode
+	}
+	// Without real weather a range would only repeat the same image
+	if clone.WeatherReplaced() {
+		clone.EndDate = ""
+	}
+	validateDates(errs, suggestions, clone.TargetDate, clone.EndDate)
+	if len(errs) > 0 {
+		writeFieldErrors(w, errs, suggestions, http.StatusUnprocessableEntity)
+		return
+	}
+
+	if clone.ID, err = generateID(16); err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "Failed to generate request ID"})
+		return
+	}
+	if err := cloneRequest(&clone, parent.ID); err != nil {
+		log.Printf("Failed to clone request %s: %v", parent.ID, err)
+		dbJSONError(w, err, "Failed to save request")
+		return
+	}
+	processClone(&clone, parent, locationMode, loadUserSettings(r, userID).Locale)
+	trackEvent(eventRequestCreated, userID, clone.ID, map[string]interface{}{"source": "api", "parent": parent.ID})
+
+	saved, err := getRequest(clone.ID)
+	if err != nil {
+		log.Printf("Failed to load cloned request %s: %v", clone.ID, err)
+		dbJSONError(w, err, "Failed to load request")
+		return
+	}
+	w.Header().Set("Location", absoluteURL(r, "/processing/"+clone.ID))
+	writeJSON(w, http.StatusAccepted, newRequestSummary(r, saved, nil))
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// JSON API versions. A version changes when response shapes change in a way
+// existing clients would trip over; additions don't need one.
+//
+//   - 1: lists are bare JSON arrays
+//   - 2: lists are {"data": [...]} objects, with next_offset when there are more
+const (
+	apiVersionOldest = 1
+	apiVersionLatest = 2
+)
+
+// apiV1Deprecated is when version 2 replaced version 1, announced in the
+// Deprecation header of version 1 responses
+var apiV1Deprecated = time.Date(2026, 10, 16, 0, 0, 0, 0, time.UTC)
+
+// apiVersionMediaType matches Accept media types naming a version, like
+// application/vnd.skyweave.v2+json
+var apiVersionMediaType = regexp.MustCompile(`application/vnd\.skyweave\.v(\d+)\+json`)
+
+// apiVersionKey is the request context key holding the API version
+type apiVersionKey struct{}
+
+// handleAPI registers a JSON API route under /api, where clients pick a
+// version with their Accept header and get version 1 by default, and under
+// /api/v1 and /api/v2, where the path decides
+func handleAPI(mux *http.ServeMux, method, path string, handler http.HandlerFunc) {
+	mux.HandleFunc(method+" /api"+path, withAPIVersion(0, handler))
+	for version := apiVersionOldest; version <= apiVersionLatest; version++ {
+		mux.HandleFunc(fmt.Sprintf("%s /api/v%d%s", method, version, path), withAPIVersion(version, handler))
+	}
+}
+
+// withAPIVersion resolves the API version of a request, 0 meaning it's
+// negotiated from the Accept header, and announces it in the response. Version
+// 1 responses carry Deprecation, Sunset and successor Link headers, and once
+// API_V1_SUNSET has passed version 1 answers 410 Gone.
+func withAPIVersion(version int, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if version == 0 {
+			w.Header().Add("Vary", "Accept")
+			var ok bool
+			if version, ok = acceptedAPIVersion(r); !ok {
+				writeJSON(w, http.StatusNotAcceptable, map[string]string{
+					"error": fmt.Sprintf("Unsupported API version, this server supports versions %d to %d",
+						apiVersionOldest, apiVersionLatest),
+				})
+				return
+			}
+		}
+		w.Header().Set("X-API-Version", strconv.Itoa(version))
+
+		if version == 1 {
+			w.Header().Set("Deprecation", fmt.Sprintf("@%d", apiV1Deprecated.Unix()))
+			path := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/api"), "/v1")
+			w.Header().Set("Link", fmt.Sprintf(`</api/v%d%s>; rel="successor-version"`, apiVersionLatest, path))
+			if sunset := currentConfig().APIV1Sunset; !sunset.IsZero() {
+				w.Header().Set("Sunset", sunset.UTC().Format(http.TimeFormat))
+				if !time.Now().Before(sunset) {
+					writeJSON(w, http.StatusGone, map[string]string{
+						"error": fmt.Sprintf("API version 1 was retired, use /api/v%d", apiVersionLatest),
+					})
+					return
+				}
+			}
+		}
+
+		next(w, r.WithContext(context.WithValue(r.Context(), apiVersionKey{}, version)))
+	}
+}
+
+// acceptedAPIVersion reads the version named by the Accept header. Clients
+// that don't name one get version 1, which existing clients were written for.
+func acceptedAPIVersion(r *http.Request) (int, bool) {
+	for _, accept := range r.Header.Values("Accept") {
+		for _, mediaType := range strings.Split(accept, ",") {
+			match := apiVersionMediaType.FindStringSubmatch(mediaType)
+			if match == nil {
+				continue
+			}
+			version, err := strconv.Atoi(match[1])
+			if err != nil || version < apiVersionOldest || version > apiVersionLatest {
+				return 0, false
+			}
+			return version, true
+		}
+	}
+	return apiVersionOldest, true
+}
+
+// apiVersion returns the API version a handler is answering in
+func apiVersion(r *http.Request) int {
+	if version, ok := r.Context().Value(apiVersionKey{}).(int); ok {
+		return version
+	}
+	return apiVersionOldest
+}
+
+// writeAPIList writes a list in the shape of the request's API version: a
+// bare array in version 1, a {"data": [...]} object from version 2, with
+// next_offset set when another page follows (0 when none does)
+func writeAPIList(w http.ResponseWriter, r *http.Request, items any, nextOffset int) {
+	if apiVersion(r) == 1 {
+		writeJSON(w, http.StatusOK, items)
+		return
+	}
+	writeJSON(w, http.StatusOK, struct {
+		Data       any `json:"data"`
+		NextOffset int `json:"next_offset,omitempty"`
+	}{items, nextOffset})
+}
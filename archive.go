@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// archiveStartDate is the first day Open-Meteo's ERA5 archive covers
+const archiveStartDate = "1940-01-01"
+
+// ArchiveWeatherResponse represents hourly data from Open-Meteo's historical
+// weather archive. Hours without data are null.
+type ArchiveWeatherResponse struct {
+	UTCOffsetSeconds int `json:"utc_offset_seconds"`
+	Hourly           struct {
+		Time                []string   `json:"time"`
+		Temperature         []*float64 `json:"temperature_2m"`
+		ApparentTemperature []*float64 `json:"apparent_temperature"`
+		RelativeHumidity    []*float64 `json:"relative_humidity_2m"`
+		SurfacePressure     []*float64 `json:"surface_pressure"`
+		CloudCover          []*float64 `json:"cloud_cover"`
+		WindSpeed           []*float64 `json:"wind_speed_10m"`
+		WindDirection       []*float64 `json:"wind_direction_10m"`
+		Rain                []*float64 `json:"rain"`
+		Snowfall            []*float64 `json:"snowfall"` // cm
+		WeatherCode         []*float64 `json:"weather_code"`
+	} `json:"hourly"`
+}
+
+// wmoCondition is the OpenWeather-style condition a WMO weather code maps to
+type wmoCondition struct {
+	ID          int
+	Main        string
+	Description string
+}
+
+// wmoConditions maps the WMO weather codes Open-Meteo reports to OpenWeather
+// condition codes, so prompts use the same vocabulary for both providers
+var wmoConditions = map[int]wmoCondition{
+	0:  {800, "Clear", "clear sky"},
+	1:  {801, "Clouds", "few clouds"},
+	2:  {802, "Clouds", "scattered clouds"},
+	3:  {804, "Clouds", "overcast clouds"},
+	45: {741, "Fog", "fog"},
+	48: {741, "Fog", "fog"},
+	51: {300, "Drizzle", "light intensity drizzle"},
+	53: {301, "Drizzle", "drizzle"},
+	55: {302, "Drizzle", "heavy intensity drizzle"},
+	56: {511, "Rain", "freezing rain"},
+	57: {511, "Rain", "freezing rain"},
+	61: {500, "Rain", "light rain"},
+	63: {501, "Rain", "moderate rain"},
+	65: {502, "Rain", "heavy intensity rain"},
+	66: {511, "Rain", "freezing rain"},
+	67: {511, "Rain", "freezing rain"},
+	71: {600, "Snow", "light snow"},
+	73: {601, "Snow", "snow"},
+	75: {602, "Snow", "heavy snow"},
+	77: {600, "Snow", "light snow"},
+	80: {520, "Rain", "light intensity shower rain"},
+	81: {521, "Rain", "shower rain"},
+	82: {522, "Rain", "heavy intensity shower rain"},
+	85: {620, "Snow", "light shower snow"},
+	86: {621, "Snow", "shower snow"},
+	95: {211, "Thunderstorm", "thunderstorm"},
+	96: {201, "Thunderstorm", "thunderstorm with rain"},
+	99: {202, "Thunderstorm", "thunderstorm with heavy rain"},
+}
+
+// getArchiveWeather fetches a past day from Open-Meteo's historical archive,
+// used for dates older than OpenWeather's one-year History API window
+func getArchiveWeather(lat, lon float64, targetDate time.Time, units string) (*WeatherData, error) {
+	temperatureUnit, windSpeedUnit := "celsius", "ms"
+	if units == unitsImperial {
+		temperatureUnit, windSpeedUnit = "fahrenheit", "mph"
+	}
+
+	date := targetDate.Format("2006-01-02")
+	apiURL := fmt.Sprintf("https://archive-api.open-meteo.com/v1/archive?latitude=%f&longitude=%f&start_date=%s&end_date=%s"+
+		"&hourly=temperature_2m,apparent_temperature,relative_humidity_2m,surface_pressure,cloud_cover,"+
+		"wind_speed_10m,wind_direction_10m,rain,snowfall,weather_code"+
+		"&timezone=auto&temperature_unit=%s&wind_speed_unit=%s",
+		lat, lon, date, date, temperatureUnit, windSpeedUnit)
+
+	key := fmt.Sprintf("weather:archive:%f,%f:%s:%s", lat, lon, date, units)
+	if body, ok := cacheGet(key); ok {
+		return parseWeatherSnapshot(weatherProviderArchive, units, body)
+	}
+
+	resp, err := openMeteoClient.Get(apiURL)
+	if err != nil {
+		return nil, fmt.Errorf("archive API request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read archive response: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, providerError(providerOpenMeteo, "archive API", resp, body, ErrWeatherUnavailable)
+	}
+
+	weatherData, err := parseWeatherSnapshot(weatherProviderArchive, units, body)
+	if err == nil {
+		cacheSet(key, body, pastWeatherCacheTTL)
+	}
+	return weatherData, err
+}
+
+// parseArchiveWeather parses and aggregates an Open-Meteo archive response
+func parseArchiveWeather(raw []byte) (*WeatherData, error) {
+	var archive ArchiveWeatherResponse
+	if err := json.Unmarshal(raw, &archive); err != nil {
+		return nil, fmt.Errorf("failed to parse archive response: %w", err)
+	}
+
+	if len(archive.Hourly.Temperature) == 0 || sumHours(archive.Hourly.Temperature) == nil {
+		return nil, fmt.Errorf("%w: no archived data available for this date", ErrWeatherUnavailable)
+	}
+
+	return aggregateArchiveData(&archive), nil
+}
+
+// aggregateArchiveData averages hourly archive data into a daily summary,
+// taking the condition from the middle of the day like aggregateHistoricalData
+func aggregateArchiveData(archive *ArchiveWeatherResponse) *WeatherData {
+	hourly := archive.Hourly
+
+	weatherData := &WeatherData{
+		Temp:       valueOr(averageHours(hourly.Temperature), 0),
+		FeelsLike:  valueOr(averageHours(hourly.ApparentTemperature), 0),
+		Pressure:   int(valueOr(averageHours(hourly.SurfacePressure), 0)),
+		Humidity:   int(valueOr(averageHours(hourly.RelativeHumidity), 0)),
+		Clouds:     int(valueOr(averageHours(hourly.CloudCover), 0)),
+		Visibility: 10000, // not in the archive
+		WindSpeed:  valueOr(averageHours(hourly.WindSpeed), 0),
+		WindDeg:    int(valueOr(averageHours(hourly.WindDirection), 0)),
+		Rain:       valueOr(sumHours(hourly.Rain), 0),
+		// 1 cm of fresh snow holds roughly 1 mm of water, the unit OpenWeather uses
+		Snow: valueOr(sumHours(hourly.Snowfall), 0),
+	}
+
+	if len(hourly.WeatherCode) > 0 {
+		if code := hourly.WeatherCode[len(hourly.WeatherCode)/2]; code != nil {
+			if condition, ok := wmoConditions[int(*code)]; ok {
+				weatherData.ConditionID = condition.ID
+				weatherData.Condition = condition.Main
+				weatherData.Description = condition.Description
+			}
+		}
+	}
+
+	return weatherData
+}
+
+// averageHours averages the hours that have data, or returns nil if none do
+func averageHours(values []*float64) *float64 {
+	total := sumHours(values)
+	if total == nil {
+		return nil
+	}
+	count := 0
+	for _, v := range values {
+		if v != nil {
+			count++
+		}
+	}
+	avg := *total / float64(count)
+	return &avg
+}
+
+// sumHours adds up the hours that have data, or returns nil if none do
+func sumHours(values []*float64) *float64 {
+	var total float64
+	found := false
+	for _, v := range values {
+		if v != nil {
+			total += *v
+			found = true
+		}
+	}
+	if !found {
+		return nil
+	}
+	return &total
+}
+
+// valueOr dereferences v, using fallback when it's nil
+func valueOr(v *float64, fallback float64) float64 {
+	if v == nil {
+		return fallback
+	}
+	return *v
+}
@@ -0,0 +1,18 @@
+package main
+
+import (
+	"embed"
+	"html/template"
+)
+
+// templateFS holds the HTML templates, compiled into the binary so a
+// container only needs the executable and a data directory
+//
+//go:embed templates/*.html
+var templateFS embed.FS
+
+// parseTemplates parses every page from the embedded templates, with the
+// formatting helpers of templateFuncs
+func parseTemplates() (*template.Template, error) {
+	return template.New("").Funcs(templateFuncs).ParseFS(templateFS, "templates/*.html")
+}
@@ -1,32 +1,12 @@
 package main
 
 import (
-	"crypto/rand"
 	"encoding/hex"
 	"log"
 	"net/http"
-	"os"
 	"time"
 )
 
-var accessPassphrase string
-
-func init() {
-	accessPassphrase = os.Getenv("ACCESS_PASSPHRASE")
-	if accessPassphrase == "" {
-		log.Println("Warning: ACCESS_PASSPHRASE not set - authentication disabled")
-	}
-}
-
-// generateSessionID generates a random session ID
-func generateSessionID() (string, error) {
-	bytes := make([]byte, 32)
-	if _, err := rand.Read(bytes); err != nil {
-		return "", err
-	}
-	return hex.EncodeToString(bytes), nil
-}
-
 // getSessionCookie retrieves the session cookie from request
 func getSessionCookie(r *http.Request) string {
 	cookie, err := r.Cookie("skyweave_session")
@@ -36,30 +16,84 @@ func getSessionCookie(r *http.Request) string {
 	return cookie.Value
 }
 
-// setSessionCookie sets the session cookie
-func setSessionCookie(w http.ResponseWriter, sessionID string) {
+// setSessionCookie sets the session cookie, marking it Secure when the client
+// connected over HTTPS (directly or through a trusted proxy)
+func setSessionCookie(w http.ResponseWriter, r *http.Request, sessionID string) {
 	http.SetCookie(w, &http.Cookie{
 		Name:     "skyweave_session",
 		Value:    sessionID,
 		Path:     "/",
-		MaxAge:   86400, // 24 hours
+		MaxAge:   int(sessionTTL.Seconds()),
 		HttpOnly: true,
+		Secure:   isSecureRequest(r),
 		SameSite: http.SameSiteLaxMode,
 	})
 }
 
-// requireAuth middleware checks if user is authenticated
+// getUserID returns the persistent user ID from the user cookie, issuing a new one if missing
+func getUserID(w http.ResponseWriter, r *http.Request) (string, error) {
+	if cookie, err := r.Cookie("skyweave_user"); err == nil && isValidUserID(cookie.Value) {
+		return cookie.Value, nil
+	}
+
+	userID, err := generateID(8)
+	if err != nil {
+		return "", err
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     "skyweave_user",
+		Value:    userID,
+		Path:     "/",
+		MaxAge:   365 * 86400, // 1 year
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return userID, nil
+}
+
+// forgetUser ends the request's session and expires the user, session and
+// units cookies, so the browser starts over as a new visitor
+func forgetUser(w http.ResponseWriter, r *http.Request) {
+	if token := getSessionCookie(r); token != "" {
+		if err := sessionStore.Delete(token); err != nil {
+			log.Printf("Failed to delete session: %v", err)
+		}
+	}
+	for _, name := range []string{"skyweave_session", "skyweave_user", "skyweave_units"} {
+		http.SetCookie(w, &http.Cookie{
+			Name:     name,
+			Path:     "/",
+			MaxAge:   -1,
+			HttpOnly: true,
+			Secure:   isSecureRequest(r),
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
+}
+
+// isValidUserID checks that a user ID looks like one we generated (16 hex chars)
+func isValidUserID(userID string) bool {
+	if len(userID) != 16 {
+		return false
+	}
+	_, err := hex.DecodeString(userID)
+	return err == nil
+}
+
+// requireAuth middleware checks if user is authenticated, and that they
+// accepted the terms when TERMS_VERSION is set
 func requireAuth(next http.HandlerFunc) http.HandlerFunc {
+	next = requireTerms(next)
 	return func(w http.ResponseWriter, r *http.Request) {
 		// If no passphrase is set, skip authentication
-		if accessPassphrase == "" {
+		if currentConfig().AccessPassphrase == "" {
 			next(w, r)
 			return
 		}
 
 		// Check session cookie
-		sessionID := getSessionCookie(r)
-		if sessionID != "" && isValidSession(sessionID) {
+		if requestSession(r).fullAccess() {
 			next(w, r)
 			return
 		}
@@ -69,49 +103,126 @@ func requireAuth(next http.HandlerFunc) http.HandlerFunc {
 	}
 }
 
+// allowTrial lets trial visitors through as well as fully authenticated
+// users. It guards the pages needed to make one image; everything else keeps
+// requiring full access.
+func allowTrial(next http.HandlerFunc) http.HandlerFunc {
+	authed := requireAuth(next)
+	trial := requireTerms(next)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if isTrialVisitor(r) {
+			trial(w, r)
+			return
+		}
+		authed(w, r)
+	}
+}
+
+// allowSignedImage lets signed image links through without a session and
+// sends every other request through allowTrial
+func allowSignedImage(next http.HandlerFunc) http.HandlerFunc {
+	authed := allowTrial(next)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if hasValidImageSignature(r) {
+			next(w, r)
+			return
+		}
+		authed(w, r)
+	}
+}
+
+// allowSignedExport lets signed data export links through without a session,
+// so they can be opened from an email, and otherwise behaves like allowTrial
+func allowSignedExport(next http.HandlerFunc) http.HandlerFunc {
+	authed := allowTrial(next)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if hasValidExportSignature(r) {
+			next(w, r)
+			return
+		}
+		authed(w, r)
+	}
+}
+
+// requireAdmin middleware checks if the user logged in with the admin passphrase
+func requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Admin pages don't exist unless an admin passphrase is configured
+		if currentConfig().AdminPassphrase == "" {
+			http.NotFound(w, r)
+			return
+		}
+
+		if requestSession(r) == sessionAdmin {
+			next(w, r)
+			return
+		}
+
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+	}
+}
+
 // loginHandler displays the login page
 func loginHandler(w http.ResponseWriter, r *http.Request) {
+	cfg := currentConfig()
+	accessPassphrase, adminPassphrase := cfg.AccessPassphrase, cfg.AdminPassphrase
+
 	// If no passphrase is set, redirect to home
-	if accessPassphrase == "" {
+	if accessPassphrase == "" && adminPassphrase == "" {
 		http.Redirect(w, r, "/", http.StatusSeeOther)
 		return
 	}
 
-	// If already authenticated, redirect to home
-	sessionID := getSessionCookie(r)
-	if sessionID != "" && isValidSession(sessionID) {
+	// If already authenticated (as admin, when admin login is possible), redirect to home
+	session := requestSession(r)
+	if session.fullAccess() && (adminPassphrase == "" || session == sessionAdmin) {
 		http.Redirect(w, r, "/", http.StatusSeeOther)
 		return
 	}
 
 	data := struct {
-		Error string
+		Error        string
+		TrialEnabled bool
+		Captcha      *Captcha
 	}{
-		Error: "",
+		Error:        "",
+		TrialEnabled: trialEnabled(),
+		Captcha:      cfg.Captcha,
 	}
 
 	if r.Method == http.MethodPost {
+		// Solving the CAPTCHA first keeps passphrase guessing slow
+		if cfg.Captcha != nil {
+			if err := cfg.Captcha.Verify(r); err != nil {
+				log.Printf("Login CAPTCHA failed for %s: %v", clientIP(r), err)
+				data.Error = "Please complete the CAPTCHA to continue."
+				templates.ExecuteTemplate(w, "login.html", data)
+				return
+			}
+		}
+
 		passphrase := r.FormValue("passphrase")
+		isAdmin := adminPassphrase != "" && passphrase == adminPassphrase
 
-		if passphrase == accessPassphrase {
+		if isAdmin || (accessPassphrase != "" && passphrase == accessPassphrase) {
 			// Create new session
-			sessionID, err := generateSessionID()
-			if err != nil {
-				log.Printf("Failed to generate session ID: %v", err)
-				http.Error(w, "Internal server error", http.StatusInternalServerError)
-				return
+			kind := sessionFull
+			if isAdmin {
+				kind = sessionAdmin
 			}
-
-			if err := createSession(sessionID); err != nil {
+			sessionID, err := sessionStore.Create(kind)
+			if err != nil {
 				log.Printf("Failed to create session: %v", err)
 				http.Error(w, "Internal server error", http.StatusInternalServerError)
 				return
 			}
 
-			setSessionCookie(w, sessionID)
+			log.Printf("Successful login from %s (admin: %t)", clientIP(r), isAdmin)
+			setSessionCookie(w, r, sessionID)
 			http.Redirect(w, r, "/", http.StatusSeeOther)
 			return
 		} else {
+			log.Printf("Failed login attempt from %s", clientIP(r))
 			data.Error = "Invalid passphrase. Please try again."
 		}
 	}
@@ -119,12 +230,55 @@ func loginHandler(w http.ResponseWriter, r *http.Request) {
 	templates.ExecuteTemplate(w, "login.html", data)
 }
 
+// trialHandler lets an anonymous visitor start a trial session after solving
+// a CAPTCHA. The session only reaches the pages needed to make an image, and
+// submitHandler enforces the daily limit.
+func trialHandler(w http.ResponseWriter, r *http.Request) {
+	if !trialEnabled() {
+		http.NotFound(w, r)
+		return
+	}
+
+	cfg := currentConfig()
+	data := struct {
+		Error      string
+		Captcha    *Captcha
+		DailyLimit int
+	}{
+		Captcha:    cfg.Captcha,
+		DailyLimit: cfg.TrialDailyLimit,
+	}
+
+	if r.Method == http.MethodPost {
+		if err := cfg.Captcha.Verify(r); err != nil {
+			log.Printf("Trial CAPTCHA failed for %s: %v", clientIP(r), err)
+			data.Error = "Please complete the CAPTCHA to continue."
+			templates.ExecuteTemplate(w, "trial.html", data)
+			return
+		}
+
+		sessionID, err := sessionStore.Create(sessionTrial)
+		if err != nil {
+			log.Printf("Failed to create trial session: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		log.Printf("Started trial session for %s", clientIP(r))
+		setSessionCookie(w, r, sessionID)
+		http.Redirect(w, r, "/start", http.StatusSeeOther)
+		return
+	}
+
+	templates.ExecuteTemplate(w, "trial.html", data)
+}
+
 // startSessionCleanup starts a background goroutine to clean up expired sessions
 func startSessionCleanup() {
 	ticker := time.NewTicker(1 * time.Hour)
 	go func() {
 		for range ticker.C {
-			if err := cleanupExpiredSessions(); err != nil {
+			if err := sessionStore.Cleanup(); err != nil {
 				log.Printf("Failed to cleanup expired sessions: %v", err)
 			} else {
 				log.Println("Cleaned up expired sessions")
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// benchmarkQueueUser is the job queue lane benchmark runs share, so a large
+// benchmark takes turns with users rather than cutting in front of them
+const benchmarkQueueUser = "admin:benchmark"
+
+// BenchmarkModel is an image model benchmarks can compare, with its estimated
+// price per prediction
+type BenchmarkModel struct {
+	Name string
+	Cost float64
+}
+
+// parseBenchmarkModels parses BENCHMARK_MODELS, a comma separated list of
+// owner/name[:version][=cost] entries. The configured REPLICATE_MODEL is
+// always offered first; models without a cost use defaultCost.
+func parseBenchmarkModels(raw, defaultModel string, defaultCost float64) []BenchmarkModel {
+	models := []BenchmarkModel{{Name: defaultModel, Cost: defaultCost}}
+	for _, entry := range strings.Split(raw, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		name, costStr, hasCost := strings.Cut(entry, "=")
+		name = strings.TrimSpace(name)
+		cost := defaultCost
+		if hasCost {
+			parsed, err := strconv.ParseFloat(strings.TrimSpace(costStr), 64)
+			if err != nil || parsed < 0 {
+				log.Printf("Warning: ignoring invalid cost for %s in BENCHMARK_MODELS", name)
+			} else {
+				cost = parsed
+			}
+		}
+		if owner, model, ok := strings.Cut(name, "/"); !ok || owner == "" || model == "" {
+			log.Printf("Warning: ignoring %q in BENCHMARK_MODELS, expected owner/name", entry)
+			continue
+		}
+
+		if name == defaultModel {
+			models[0].Cost = cost
+			continue
+		}
+		models = append(models, BenchmarkModel{Name: name, Cost: cost})
+	}
+	return models
+}
+
+// benchmarkModel looks up a configured benchmark model by name
+func benchmarkModel(name string) (BenchmarkModel, bool) {
+	for _, m := range currentConfig().BenchmarkModels {
+		if m.Name == name {
+			return m, true
+		}
+	}
+	return BenchmarkModel{}, false
+}
+
+// startBenchmark runs a request's prompt through each of the given models
+// with the same seed and queues the runs
+func startBenchmark(req *Request, models []BenchmarkModel) (*Benchmark, error) {
+	id, err := generateID(8)
+	if err != nil {
+		return nil, err
+	}
+
+	bench := &Benchmark{
+		ID:        id,
+		RequestID: req.ID,
+		Prompt:    req.AIPrompt,
+		Intensity: req.Intensity,
+		Seed:      1 + rand.IntN(1<<31-1),
+	}
+	runs := make([]*BenchmarkRun, 0, len(models))
+	for _, m := range models {
+		runID, err := generateID(8)
+		if err != nil {
+			return nil, err
+		}
+		runs = append(runs, &BenchmarkRun{
+			ID:          runID,
+			BenchmarkID: bench.ID,
+			Model:       m.Name,
+			Cost:        m.Cost,
+		})
+	}
+	if err := createBenchmark(bench, runs); err != nil {
+		return nil, err
+	}
+
+	for _, run := range runs {
+		jobQueue.enqueue(job{
+			userID:    benchmarkQueueUser,
+			requestID: req.ID,
+			run:       func() { runBenchmark(bench, run) },
+		})
+	}
+	return bench, nil
+}
+
+// runBenchmark generates one model's image for a benchmark and records how
+// long it took
+func runBenchmark(bench *Benchmark, run *BenchmarkRun) {
+	started := time.Now()
+	finish := func(status string, err error) {
+		run.Status = status
+		run.DurationMS = time.Since(started).Milliseconds()
+		if err != nil {
+			log.Printf("Benchmark %s run %s (%s) failed: %v", bench.ID, run.ID, run.Model, err)
+			run.ErrorMessage = err.Error()
+		}
+		if err := finishBenchmarkRun(run); err != nil {
+			log.Printf("Failed to save benchmark run %s: %v", run.ID, err)
+		}
+	}
+
+	// Runs share the request's upload; load the request again to see one a
+	// run before this one refreshed
+	req, err := getRequest(bench.RequestID)
+	if err != nil {
+		finish("error", fmt.Errorf("failed to retrieve request details: %w", err))
+		return
+	}
+	imageURL, err := requestUploadURL(req)
+	if err != nil {
+		finish("error", fmt.Errorf("failed to upload image: %w", err))
+		return
+	}
+
+	prediction, err := createImagePrediction(run.Model, bench.Prompt, imageURL, bench.Seed, bench.Intensity)
+	if err != nil {
+		finish("error", fmt.Errorf("failed to create prediction: %w", err))
+		return
+	}
+	run.PredictionID = prediction.ID
+
+	status, err := awaitPrediction(prediction.ID, currentConfig().PollInterval, predictionTimeout(run.Model))
+	if err != nil {
+		finish("error", err)
+		return
+	}
+	if status.Status != "succeeded" {
+		finish("error", fmt.Errorf("%w: prediction %s: %s", ErrModelFailed, status.Status, status.Error))
+		return
+	}
+
+	if t, ok := status.Metrics["predict_time"].(float64); ok {
+		run.PredictTime = t
+	}
+	outputURL := predictionOutputURL(status.Output)
+	if outputURL == "" {
+		finish("error", fmt.Errorf("%w: no output URL in prediction result", ErrModelFailed))
+		return
+	}
+	result, err := downloadImage(outputURL)
+	if err != nil {
+		finish("error", fmt.Errorf("failed to download result: %w", err))
+		return
+	}
+	if run.ResultImagePath, err = storeBlob(result, ".jpg"); err != nil {
+		finish("error", fmt.Errorf("failed to store result: %w", err))
+		return
+	}
+	finish("completed", nil)
+}
+
+// DurationLabel is the run's wall-clock time, from starting the prediction
+// (and uploading the photo if needed) to the downloaded result
+func (run *BenchmarkRun) DurationLabel() string {
+	if run.DurationMS == 0 {
+		return "-"
+	}
+	return (time.Duration(run.DurationMS) * time.Millisecond).Round(100 * time.Millisecond).String()
+}
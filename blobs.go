@@ -0,0 +1,140 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Uploads and results are stored by content, as blobs named after the
+// SHA-256 of their bytes in two levels of directories named after its first
+// bytes. Identical files are stored once, and no directory grows too large.
+// The blobs table counts the rows referring to each blob, kept up to date by
+// triggers, and blobs nothing refers to are deleted.
+
+// blobGracePeriod is how long a blob is kept after it was stored, before
+// the row referring to it was saved, before it can be deleted as unreferenced
+const blobGracePeriod = 10 * time.Minute
+
+// blobPath returns where the blob with a hash is stored
+func blobPath(hash, ext string) string {
+	return filepath.Join(dataDir, "blobs", hash[:2], hash[2:4], hash+ext)
+}
+
+// isBlobPath reports whether path is a stored blob, rather than a file from
+// before blobs that hasn't been moved yet
+func isBlobPath(path string) bool {
+	return strings.HasPrefix(path, filepath.Join(dataDir, "blobs")+string(filepath.Separator))
+}
+
+// storeBlob stores data as a blob, unless the same bytes already are, and
+// returns its path for a row to refer to
+func storeBlob(data []byte, ext string) (string, error) {
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+	path := blobPath(hash, ext)
+
+	// Recorded before the file is written: collectBlobs deletes the record
+	// before the file, in one transaction, so it either finds this one fresh
+	// and keeps it, or is done before it's recorded and written again
+	if err := touchBlob(hash, path, len(data)); err != nil {
+		return "", fmt.Errorf("failed to record blob: %w", err)
+	}
+	if info, err := os.Stat(path); err == nil && info.Size() == int64(len(data)) {
+		return path, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", err
+	}
+	err := writeFileAtomic(path, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// startBlobCollector deletes unreferenced blobs every hour
+func startBlobCollector() {
+	ticker := time.NewTicker(time.Hour)
+	goSafe("", func() {
+		for range ticker.C {
+			collectBlobs()
+		}
+	})
+}
+
+// collectBlobs deletes the blobs no row has referred to since the grace period
+func collectBlobs() {
+	before := time.Now().Add(-blobGracePeriod)
+	paths, err := unreferencedBlobs(before)
+	if err != nil {
+		log.Printf("Failed to list unreferenced blobs: %v", err)
+		return
+	}
+	deleted := 0
+	for _, path := range paths {
+		ok, err := deleteUnreferencedBlob(path, before)
+		if err != nil {
+			log.Printf("Failed to delete blob %s: %v", path, err)
+			continue
+		}
+		if ok {
+			deleted++
+		}
+	}
+	if deleted > 0 {
+		log.Printf("Deleted %d unreferenced blobs", deleted)
+	}
+}
+
+// removeBlobFile deletes a blob's file. One that's already gone is fine.
+func removeBlobFile(path string) error {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// migrateLegacyFiles moves uploads and results stored before blobs, under
+// uploads/, results/ and benchmarks/, into blobs, pointing their rows at them
+func migrateLegacyFiles() error {
+	paths, err := legacyImagePaths()
+	if err != nil || len(paths) == 0 {
+		return err
+	}
+	log.Printf("Moving %d stored images into content-addressed blobs...", len(paths))
+
+	moved := 0
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if os.IsNotExist(err) {
+			continue // migrate-data lists missing files
+		}
+		if err != nil {
+			return err
+		}
+		blob, err := storeBlob(data, filepath.Ext(path))
+		if err != nil {
+			return err
+		}
+		if err := replaceImagePath(path, blob); err != nil {
+			return err
+		}
+		if err := os.Remove(path); err != nil {
+			log.Printf("Failed to remove %s after moving it: %v", path, err)
+		}
+		moved++
+	}
+	log.Printf("Moved %d images into blobs", moved)
+	return nil
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Cache stores short-lived values: provider responses worth reusing and the
+// counters of rate limits. The in-memory cache suits a single instance; with
+// CACHE_URL pointing at Redis, every instance shares the same cache and limits.
+type Cache interface {
+	// Get returns a value and whether it was found and not expired
+	Get(key string) ([]byte, bool, error)
+	// Set stores a value that expires after ttl
+	Set(key string, value []byte, ttl time.Duration) error
+	// Incr adds one to a counter and returns its new value. A counter that
+	// doesn't exist starts at one and expires after ttl.
+	Incr(key string, ttl time.Duration) (int64, error)
+	// Delete removes a value or counter
+	Delete(key string) error
+}
+
+// appCache is the cache used by the server, in memory unless CACHE_URL is set
+var appCache Cache = newMemoryCache()
+
+// setupCache connects to the cache named by CACHE_URL, if any. Only Redis
+// (redis:// and rediss:// URLs) is supported.
+func setupCache() error {
+	rawURL := currentConfig().CacheURL
+	if rawURL == "" {
+		return nil
+	}
+	cache, err := newRedisCache(rawURL)
+	if err != nil {
+		return err
+	}
+	if err := cache.Ping(); err != nil {
+		return fmt.Errorf("failed to reach %s: %w", cache.addr, err)
+	}
+	appCache = cache
+	log.Printf("Using Redis cache at %s", cache.addr)
+	return nil
+}
+
+// cacheGet reads a value from appCache. Caching is best effort, so errors are
+// logged and count as a miss.
+func cacheGet(key string) ([]byte, bool) {
+	value, ok, err := appCache.Get(key)
+	if err != nil {
+		log.Printf("Cache read of %s failed: %v", key, err)
+		return nil, false
+	}
+	return value, ok
+}
+
+// cacheSet stores a value in appCache, logging errors
+func cacheSet(key string, value []byte, ttl time.Duration) {
+	if err := appCache.Set(key, value, ttl); err != nil {
+		log.Printf("Cache write of %s failed: %v", key, err)
+	}
+}
+
+// cacheGetJSON decodes a cached JSON value into v, reporting whether it was found
+func cacheGetJSON(key string, v any) bool {
+	value, ok := cacheGet(key)
+	return ok && json.Unmarshal(value, v) == nil
+}
+
+// cacheSetJSON stores v in appCache as JSON
+func cacheSetJSON(key string, v any, ttl time.Duration) {
+	value, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("Cache write of %s failed: %v", key, err)
+		return
+	}
+	cacheSet(key, value, ttl)
+}
+
+// allowRate counts an event against a limit of limit events per window,
+// fixed windows aligned to the clock. It reports whether the event is within
+// the limit and, if not, how long until the next window starts. When the
+// cache fails the event is allowed, so an outage doesn't lock everyone out.
+func allowRate(key string, limit int, window time.Duration) (bool, time.Duration) {
+	now := time.Now()
+	start := now.Truncate(window)
+	count, err := appCache.Incr(fmt.Sprintf("rate:%s:%d", key, start.Unix()), window)
+	if err != nil {
+		log.Printf("Rate limit check of %s failed: %v", key, err)
+		return true, 0
+	}
+	if count > int64(limit) {
+		return false, start.Add(window).Sub(now)
+	}
+	return true, 0
+}
+
+// cacheKey joins the parts of a cache key, lowercasing and trimming them so
+// equivalent lookups share an entry
+func cacheKey(parts ...string) string {
+	for i, part := range parts {
+		parts[i] = strings.ToLower(strings.TrimSpace(part))
+	}
+	return strings.Join(parts, "|")
+}
+
+// memoryCache is a Cache in the server's memory. Expired entries are dropped
+// when read and swept every memorySweepEvery writes.
+type memoryCache struct {
+	mu      sync.Mutex
+	entries map[string]memoryEntry
+	writes  int
+}
+
+// memoryEntry is a value held by memoryCache
+type memoryEntry struct {
+	value   []byte
+	expires time.Time
+}
+
+const memorySweepEvery = 1000
+
+func newMemoryCache() *memoryCache {
+	return &memoryCache{entries: make(map[string]memoryEntry)}
+}
+
+func (c *memoryCache) Get(key string) ([]byte, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	if !ok {
+		return nil, false, nil
+	}
+	if time.Now().After(entry.expires) {
+		delete(c.entries, key)
+		return nil, false, nil
+	}
+	return entry.value, true, nil
+}
+
+func (c *memoryCache) Set(key string, value []byte, ttl time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[key] = memoryEntry{value: value, expires: time.Now().Add(ttl)}
+	c.wrote()
+	return nil
+}
+
+func (c *memoryCache) Incr(key string, ttl time.Duration) (int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	entry, ok := c.entries[key]
+	count := int64(0)
+	if ok && now.Before(entry.expires) {
+		count, _ = strconv.ParseInt(string(entry.value), 10, 64)
+	} else {
+		entry.expires = now.Add(ttl)
+	}
+	count++
+	entry.value = []byte(strconv.FormatInt(count, 10))
+	c.entries[key] = entry
+	c.wrote()
+	return count, nil
+}
+
+func (c *memoryCache) Delete(key string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, key)
+	return nil
+}
+
+// wrote counts a write, sweeping out expired entries every so often. The
+// caller holds c.mu.
+func (c *memoryCache) wrote() {
+	c.writes++
+	if c.writes%memorySweepEvery != 0 {
+		return
+	}
+	now := time.Now()
+	for key, entry := range c.entries {
+		if now.After(entry.expires) {
+			delete(c.entries, key)
+		}
+	}
+}
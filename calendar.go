@@ -0,0 +1,487 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Scheduled generations sync with calendars over iCalendar (RFC 5545).
+// Each user's schedules are a feed calendar apps can subscribe to, with an
+// all-day event on each date, at /calendar/{token}.ics. The token is a
+// random secret stored for the user, not derived from their user ID, which
+// is all it takes to act as them; replacing it revokes the link. The other way, the
+// events of an imported .ics file become schedules re-running one of the
+// user's requests on each date they fall on, repeating events included.
+
+const (
+	// maxCalendarSize limits imported .ics files
+	maxCalendarSize = 1 << 20
+
+	// maxRecurrenceSteps bounds how many occurrences of a repeating event
+	// are looked at, however far apart they are
+	maxRecurrenceSteps = 1000
+
+	calendarDateFormat = "20060102"
+)
+
+// recurrenceFrequencies are the RRULE frequencies supported: repeating
+// every given number of days, weeks, months or years
+var recurrenceFrequencies = map[string]bool{
+	"DAILY":   true,
+	"WEEKLY":  true,
+	"MONTHLY": true,
+	"YEARLY":  true,
+}
+
+// recurrence is how an event repeats. BYDAY and the other BY parts of an
+// RRULE aren't supported; events repeat on the day they start on.
+type recurrence struct {
+	freq     string // one of recurrenceFrequencies, or "" for events that don't repeat
+	interval int
+	count    int       // how many times it occurs, 0 for no limit
+	until    time.Time // the last date it can occur on, zero for no limit
+}
+
+// dates lists the dates from first to last a recurrence starting on start
+// occurs on, leaving out the excepted ones. Monthly and yearly events
+// starting on a day some months don't have, like the 31st, skip those
+// months.
+func (rule recurrence) dates(start, first, last time.Time, except map[string]bool) []time.Time {
+	if !recurrenceFrequencies[rule.freq] {
+		if start.Before(first) || start.After(last) || except[start.Format(time.DateOnly)] {
+			return nil
+		}
+		return []time.Time{start}
+	}
+
+	interval := max(1, rule.interval)
+	step := func(n int) time.Time {
+		switch rule.freq {
+		case "DAILY":
+			return start.AddDate(0, 0, n*interval)
+		case "WEEKLY":
+			return start.AddDate(0, 0, 7*n*interval)
+		case "MONTHLY":
+			return start.AddDate(0, n*interval, 0)
+		default:
+			return start.AddDate(n*interval, 0, 0)
+		}
+	}
+
+	// Without a COUNT, the occurrences before first don't matter, so
+	// events that started long ago can skip ahead to it
+	n := 0
+	if rule.count == 0 && start.Before(first) {
+		switch rule.freq {
+		case "DAILY", "WEEKLY":
+			n = int(first.Sub(start).Hours()/24) / interval
+			if rule.freq == "WEEKLY" {
+				n /= 7
+			}
+		case "MONTHLY":
+			n = ((first.Year()-start.Year())*12 + int(first.Month()-start.Month())) / interval
+		case "YEARLY":
+			n = (first.Year() - start.Year()) / interval
+		}
+		n = max(0, n-1)
+	}
+
+	var dates []time.Time
+	occurrences := 0
+	for end := n + maxRecurrenceSteps; n < end; n++ {
+		date := step(n)
+		if date.After(last) || (!rule.until.IsZero() && date.After(rule.until)) {
+			break
+		}
+		if (rule.freq == "MONTHLY" || rule.freq == "YEARLY") && date.Day() != start.Day() {
+			continue
+		}
+		// Excepted and past dates still count toward COUNT
+		if occurrences++; rule.count > 0 && occurrences > rule.count {
+			break
+		}
+		if !date.Before(first) && !except[date.Format(time.DateOnly)] {
+			dates = append(dates, date)
+		}
+	}
+	return dates
+}
+
+// calendarEvent is an event of an imported calendar
+type calendarEvent struct {
+	UID       string
+	Summary   string
+	Start     time.Time // the date it starts on, as written
+	Rule      recurrence
+	Except    map[string]bool // dates left out of its recurrence
+	Cancelled bool
+}
+
+// parseCalendar reads the events of an iCalendar file. Times are read as
+// the dates they're written on; events are all-day as far as scheduling is
+// concerned. Events without a start date are left out.
+func parseCalendar(data []byte) ([]*calendarEvent, error) {
+	lines := unfoldCalendarLines(data)
+	if len(lines) == 0 || !strings.EqualFold(lines[0], "BEGIN:VCALENDAR") {
+		return nil, fmt.Errorf("not an iCalendar file")
+	}
+
+	var events []*calendarEvent
+	var event *calendarEvent
+	depth := 0 // of components nested in the event, like alarms
+	for _, line := range lines {
+		name, value := splitCalendarLine(line)
+		switch {
+		case name == "BEGIN" && strings.EqualFold(value, "VEVENT") && event == nil:
+			event = &calendarEvent{Except: map[string]bool{}}
+		case event == nil:
+		case name == "BEGIN":
+			depth++
+		case name == "END" && depth > 0:
+			depth--
+		case name == "END" && strings.EqualFold(value, "VEVENT"):
+			if !event.Start.IsZero() {
+				events = append(events, event)
+			}
+			event = nil
+		case depth > 0:
+		case name == "UID":
+			event.UID = value
+		case name == "SUMMARY":
+			event.Summary = unescapeCalendarText(value)
+		case name == "STATUS":
+			event.Cancelled = strings.EqualFold(value, "CANCELLED")
+		case name == "DTSTART":
+			event.Start, _ = parseCalendarDate(value)
+		case name == "RRULE":
+			event.Rule = parseRecurrence(value)
+		case name == "EXDATE":
+			for _, v := range strings.Split(value, ",") {
+				if date, err := parseCalendarDate(v); err == nil {
+					event.Except[date.Format(time.DateOnly)] = true
+				}
+			}
+		}
+	}
+	return events, nil
+}
+
+// unfoldCalendarLines splits iCalendar data into its lines, joining the
+// ones folded over several
+func unfoldCalendarLines(data []byte) []string {
+	var lines []string
+	scanner := bufio.NewScanner(bytes.NewReader(bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))))
+	scanner.Buffer(make([]byte, 0, 4096), maxCalendarSize)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) && len(lines) > 0 {
+			lines[len(lines)-1] += line[1:]
+		} else if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// splitCalendarLine splits a content line into its upper-cased property
+// name and its value, dropping the parameters between them. Parameter
+// values can be quoted, and the colons in quotes don't end them.
+func splitCalendarLine(line string) (string, string) {
+	quoted := false
+	for i, c := range line {
+		switch {
+		case c == '"':
+			quoted = !quoted
+		case c == ':' && !quoted:
+			name, _, _ := strings.Cut(line[:i], ";")
+			return strings.ToUpper(name), line[i+1:]
+		}
+	}
+	return strings.ToUpper(line), ""
+}
+
+// parseCalendarDate reads the date of a DATE or DATE-TIME value
+func parseCalendarDate(value string) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	if len(value) < len(calendarDateFormat) {
+		return time.Time{}, fmt.Errorf("invalid date %q", value)
+	}
+	return time.Parse(calendarDateFormat, value[:len(calendarDateFormat)])
+}
+
+// parseRecurrence reads an RRULE value, ignoring the parts that aren't
+// supported
+func parseRecurrence(value string) recurrence {
+	var rule recurrence
+	for _, part := range strings.Split(value, ";") {
+		key, v, _ := strings.Cut(part, "=")
+		switch strings.ToUpper(key) {
+		case "FREQ":
+			rule.freq = strings.ToUpper(v)
+		case "INTERVAL":
+			rule.interval, _ = strconv.Atoi(v)
+		case "COUNT":
+			rule.count, _ = strconv.Atoi(v)
+		case "UNTIL":
+			rule.until, _ = parseCalendarDate(v)
+		}
+	}
+	return rule
+}
+
+// unescapeCalendarText undoes the escaping of TEXT values
+func unescapeCalendarText(value string) string {
+	return strings.NewReplacer(`\n`, "\n", `\N`, "\n", `\,`, ",", `\;`, ";", `\\`, `\`).Replace(value)
+}
+
+// escapeCalendarText escapes a TEXT value
+func escapeCalendarText(value string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`, ",", `\,`, ";", `\;`).Replace(value)
+}
+
+// calendarWriter writes iCalendar content lines, ending them with CRLF and
+// folding them at 75 octets without splitting characters
+type calendarWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (cw *calendarWriter) line(name, value string) {
+	line := name + ":" + value
+	for cw.err == nil {
+		if len(line) <= 75 {
+			_, cw.err = io.WriteString(cw.w, line+"\r\n")
+			return
+		}
+		cut := 75
+		for cut > 0 && !utf8.RuneStart(line[cut]) {
+			cut--
+		}
+		_, cw.err = io.WriteString(cw.w, line[:cut]+"\r\n")
+		line = " " + line[cut:]
+	}
+}
+
+// writeCalendar writes a user's schedules as a calendar, each an all-day
+// event on its date linking to its result once it's started
+func writeCalendar(w io.Writer, r *http.Request, schedules []*Schedule, sources map[string]*Request) error {
+	cw := &calendarWriter{w: w}
+	cw.line("BEGIN", "VCALENDAR")
+	cw.line("VERSION", "2.0")
+	cw.line("PRODID", "-//SkyWeave//Scheduled generations//EN")
+	cw.line("CALSCALE", "GREGORIAN")
+	cw.line("METHOD", "PUBLISH")
+	cw.line("X-WR-CALNAME", "SkyWeave")
+
+	for _, s := range schedules {
+		date, err := time.Parse(time.DateOnly, s.RunDate)
+		if err != nil {
+			continue
+		}
+		created := time.Now()
+		if t, err := parseSQLiteTime(s.CreatedAt); err == nil {
+			created = t
+		}
+
+		summary, description := s.Summary, "A photo reimagined with the weather of the day"
+		if source := sources[s.SourceRequestID]; source != nil {
+			if summary == "" {
+				summary = "SkyWeave: " + source.PlaceName()
+			}
+			description = fmt.Sprintf("Your photo of %s, reimagined with the weather of the day", source.PlaceName())
+		}
+		link := absoluteURL(r, "/schedules")
+		switch s.Status {
+		case "started":
+			link = absoluteURL(r, "/processing/"+url.PathEscape(s.RequestID))
+		case "error":
+			description = "Failed: " + s.ErrorMessage
+		}
+		status := "CONFIRMED"
+		if s.Status == "cancelled" {
+			status = "CANCELLED"
+		}
+
+		cw.line("BEGIN", "VEVENT")
+		cw.line("UID", s.ID+"@skyweave")
+		cw.line("DTSTAMP", created.UTC().Format("20060102T150405Z"))
+		cw.line("DTSTART;VALUE=DATE", date.Format(calendarDateFormat))
+		cw.line("DTEND;VALUE=DATE", date.AddDate(0, 0, 1).Format(calendarDateFormat))
+		cw.line("SUMMARY", escapeCalendarText(summary))
+		cw.line("DESCRIPTION", escapeCalendarText(description))
+		cw.line("URL", link)
+		cw.line("STATUS", status)
+		cw.line("TRANSP", "TRANSPARENT")
+		cw.line("END", "VEVENT")
+	}
+	cw.line("END", "VCALENDAR")
+	return cw.err
+}
+
+// calendarFeedTokenBytes is how many random bytes calendar feed tokens are
+// made of
+const calendarFeedTokenBytes = 24
+
+// calendarFeedURL returns an absolute link to a user's calendar feed, or ""
+// when they haven't turned it on
+func calendarFeedURL(r *http.Request, userID string) string {
+	token, err := getCalendarFeedToken(userID)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			log.Printf("Failed to load calendar feed of user %s: %v", userID, err)
+		}
+		return ""
+	}
+	return absoluteURL(r, "/calendar/"+url.PathEscape(token)+".ics")
+}
+
+// calendarFeedHandler serves the calendar feed of a feed link to calendar
+// apps, which fetch it without a session
+func calendarFeedHandler(w http.ResponseWriter, r *http.Request) {
+	token := strings.TrimSuffix(r.PathValue("token"), ".ics")
+	if token == "" {
+		http.Error(w, "Calendar not found", http.StatusNotFound)
+		return
+	}
+	userID, err := getCalendarFeedUser(token)
+	if err != nil {
+		lookupError(w, err, "Calendar")
+		return
+	}
+	serveCalendar(w, r, userID, "")
+}
+
+// resetCalendarFeedHandler turns the user's calendar feed on, or gives it a
+// new link, revoking the one calendar apps were subscribed to
+func resetCalendarFeedHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserID(w, r)
+	if err != nil {
+		http.Error(w, "Failed to generate user ID", http.StatusInternalServerError)
+		return
+	}
+	token, err := generateID(calendarFeedTokenBytes)
+	if err != nil {
+		http.Error(w, "Failed to generate calendar link", http.StatusInternalServerError)
+		return
+	}
+	if err := setCalendarFeedToken(userID, token); err != nil {
+		log.Printf("Failed to save calendar feed of user %s: %v", userID, err)
+		dbHTTPError(w, err, "Failed to save calendar link")
+		return
+	}
+	http.Redirect(w, r, "/schedules", http.StatusSeeOther)
+}
+
+// deleteCalendarFeedHandler turns the user's calendar feed off
+func deleteCalendarFeedHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserID(w, r)
+	if err != nil {
+		http.Error(w, "Failed to generate user ID", http.StatusInternalServerError)
+		return
+	}
+	if err := deleteCalendarFeed(userID); err != nil {
+		log.Printf("Failed to delete calendar feed of user %s: %v", userID, err)
+		dbHTTPError(w, err, "Failed to turn off calendar link")
+		return
+	}
+	http.Redirect(w, r, "/schedules", http.StatusSeeOther)
+}
+
+// calendarDownloadHandler downloads the user's schedules as an .ics file
+func calendarDownloadHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserID(w, r)
+	if err != nil {
+		http.Error(w, "Failed to generate user ID", http.StatusInternalServerError)
+		return
+	}
+	serveCalendar(w, r, userID, `attachment; filename="skyweave.ics"`)
+}
+
+// serveCalendar writes a user's schedules as an iCalendar response
+func serveCalendar(w http.ResponseWriter, r *http.Request, userID, disposition string) {
+	schedules, err := getSchedules(userID)
+	if err != nil {
+		log.Printf("Failed to load schedules for user %s: %v", userID, err)
+		dbHTTPError(w, err, "Failed to load schedules")
+		return
+	}
+	sources, err := scheduleSources(schedules)
+	if err != nil {
+		log.Printf("Failed to load requests of schedules for user %s: %v", userID, err)
+	}
+
+	var buf bytes.Buffer
+	if err := writeCalendar(&buf, r, schedules, sources); err != nil {
+		http.Error(w, "Failed to write calendar", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	if disposition != "" {
+		w.Header().Set("Content-Disposition", disposition)
+	}
+	w.Write(buf.Bytes())
+}
+
+// calendarImportHandler schedules re-runs of one of the user's requests on
+// the dates of an uploaded calendar's events
+func calendarImportHandler(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxCalendarSize+64<<10)
+	parent, ok := scheduleSource(w, r, r.FormValue("request"))
+	if !ok {
+		return
+	}
+
+	file, _, err := r.FormFile("calendar")
+	if err != nil {
+		http.Error(w, "Choose an .ics file to import", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+	data, err := io.ReadAll(io.LimitReader(file, maxCalendarSize+1))
+	if err != nil || len(data) > maxCalendarSize {
+		http.Error(w, "Calendar file is too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	events, err := parseCalendar(data)
+	if err != nil {
+		http.Error(w, "Couldn't read the calendar: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	first, last := scheduleWindow(time.Now())
+	added, skipped := 0, 0
+	for _, event := range events {
+		if event.Cancelled {
+			continue
+		}
+		// Events without a UID are told apart by their contents, so
+		// importing a file again doesn't schedule them twice
+		uid := event.UID
+		if uid == "" {
+			sum := sha256.Sum256([]byte(event.Summary + "\n" + event.Start.Format(time.DateOnly)))
+			uid = hex.EncodeToString(sum[:16])
+		}
+		n, s, err := addSchedules(parent, uid, event.Summary, event.Rule.dates(event.Start, first, last, event.Except))
+		if err != nil {
+			log.Printf("Failed to import calendar event %q for request %s: %v", uid, parent.ID, err)
+			dbHTTPError(w, err, "Failed to save schedule")
+			return
+		}
+		added, skipped = added+n, skipped+s
+	}
+	log.Printf("Imported %d scheduled generations of request %s from %d calendar events", added, parent.ID, len(events))
+	redirectToSchedules(w, r, added, skipped)
+}
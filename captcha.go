@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// CAPTCHA providers selectable with CAPTCHA_PROVIDER
+const (
+	captchaTurnstile = "turnstile"
+	captchaHCaptcha  = "hcaptcha"
+)
+
+// CaptchaProvider describes a CAPTCHA service. Both supported services embed
+// a widget from a script and verify its token with the same siteverify
+// protocol, so they only differ in these details.
+type CaptchaProvider struct {
+	ScriptURL     string
+	WidgetClass   string // class of the element the script turns into a widget
+	ResponseField string // form field the widget submits its token in
+	VerifyURL     string
+}
+
+var captchaProviders = map[string]CaptchaProvider{
+	captchaTurnstile: {
+		ScriptURL:     "https://challenges.cloudflare.com/turnstile/v0/api.js",
+		WidgetClass:   "cf-turnstile",
+		ResponseField: "cf-turnstile-response",
+		VerifyURL:     "https://challenges.cloudflare.com/turnstile/v0/siteverify",
+	},
+	captchaHCaptcha: {
+		ScriptURL:     "https://js.hcaptcha.com/1/api.js",
+		WidgetClass:   "h-captcha",
+		ResponseField: "h-captcha-response",
+		VerifyURL:     "https://api.hcaptcha.com/siteverify",
+	},
+}
+
+// Captcha is a configured CAPTCHA provider with its keys
+type Captcha struct {
+	CaptchaProvider
+	Name      string
+	SiteKey   string
+	secretKey string
+}
+
+// newCaptcha builds the CAPTCHA configured by CAPTCHA_PROVIDER. It returns
+// nil when no provider is configured.
+func newCaptcha(provider, siteKey, secretKey string) (*Captcha, error) {
+	if provider == "" {
+		return nil, nil
+	}
+	p, ok := captchaProviders[provider]
+	if !ok {
+		return nil, fmt.Errorf("unknown CAPTCHA_PROVIDER %q (expected %s or %s)", provider, captchaTurnstile, captchaHCaptcha)
+	}
+	if siteKey == "" || secretKey == "" {
+		return nil, fmt.Errorf("CAPTCHA_PROVIDER %s needs CAPTCHA_SITE_KEY and CAPTCHA_SECRET_KEY", provider)
+	}
+	return &Captcha{CaptchaProvider: p, Name: provider, SiteKey: siteKey, secretKey: secretKey}, nil
+}
+
+// Verify checks the token the widget submitted with r
+func (c *Captcha) Verify(r *http.Request) error {
+	token := r.FormValue(c.ResponseField)
+	if token == "" {
+		return fmt.Errorf("missing CAPTCHA response")
+	}
+
+	form := url.Values{}
+	form.Set("secret", c.secretKey)
+	form.Set("response", token)
+	form.Set("remoteip", clientIP(r))
+	form.Set("sitekey", c.SiteKey)
+
+	resp, err := captchaClient.PostForm(c.VerifyURL, form)
+	if err != nil {
+		return fmt.Errorf("failed to verify CAPTCHA: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Success    bool     `json:"success"`
+		ErrorCodes []string `json:"error-codes"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return fmt.Errorf("failed to decode CAPTCHA verification: %w", err)
+	}
+	if !result.Success {
+		return fmt.Errorf("CAPTCHA rejected: %s", strings.Join(result.ErrorCodes, ", "))
+	}
+	return nil
+}
+
+// submissionCaptcha returns the CAPTCHA a submission must solve, or nil if
+// none is needed. Visitors without full access always solve one, and so do
+// users who've already submitted CAPTCHA_SUBMIT_THRESHOLD requests in the
+// last hour, to slow down scripted use of a shared passphrase.
+func submissionCaptcha(r *http.Request, userID string) *Captcha {
+	cfg := currentConfig()
+	if cfg.Captcha == nil {
+		return nil
+	}
+	if cfg.AccessPassphrase == "" || isTrialVisitor(r) {
+		return cfg.Captcha
+	}
+
+	count, err := countRecentSubmissions(userID, time.Now().Add(-time.Hour))
+	if err != nil {
+		log.Printf("Failed to count recent submissions for user %s: %v", userID, err)
+		return cfg.Captcha
+	}
+	if count >= cfg.CaptchaSubmitThreshold {
+		return cfg.Captcha
+	}
+	return nil
+}
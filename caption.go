@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// maxCaptionLength caps how much of a caption is carried into prompts. It
+// matches the location name limit so sanitizing doesn't cut it mid-word.
+const maxCaptionLength = maxLocationNameLength
+
+// captionImage describes a photo already uploaded to Replicate with the
+// image-captioning model named by CAPTION_MODEL (e.g. BLIP), so prompts can
+// refer to what the photo actually shows. It returns "" without error when
+// captioning is disabled.
+func captionImage(imageURL string) (string, error) {
+	model := currentConfig().CaptionModel
+	if model == "" {
+		return "", nil
+	}
+
+	prediction, err := createModelPrediction(model, map[string]interface{}{
+		"image": imageURL,
+		"task":  "image_captioning",
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to create caption prediction: %w", err)
+	}
+
+	// Captions take seconds; give up after two minutes rather than hold up
+	// the weather confirmation
+	status, err := awaitPrediction(prediction.ID, 2*time.Second, 2*time.Minute)
+	if err != nil {
+		return "", fmt.Errorf("caption prediction failed: %w", err)
+	}
+	if status.Status != "succeeded" {
+		return "", fmt.Errorf("caption prediction %s: %s", status.Status, status.Error)
+	}
+	return cleanCaption(predictionText(status.Output)), nil
+}
+
+// predictionText extracts text output, which models return either as a
+// string or as a list of string chunks
+func predictionText(output interface{}) string {
+	switch v := output.(type) {
+	case string:
+		return v
+	case []interface{}:
+		var b strings.Builder
+		for _, chunk := range v {
+			if s, ok := chunk.(string); ok {
+				b.WriteString(s)
+			}
+		}
+		return b.String()
+	}
+	return ""
+}
+
+// cleanCaption turns model output like "Caption: a cabin by a lake." into a
+// phrase that fits in a sentence, "a cabin by a lake". Captions end up in
+// prompts, so they get the same sanitizing as location names.
+func cleanCaption(caption string) string {
+	caption = strings.TrimSpace(caption)
+	if prefix, rest, ok := strings.Cut(caption, ":"); ok && strings.EqualFold(strings.TrimSpace(prefix), "caption") {
+		caption = strings.TrimSpace(rest)
+	}
+	caption = strings.Join(strings.Fields(caption), " ")
+	caption = strings.TrimRight(caption, ".!")
+	if caption == "" {
+		return ""
+	}
+
+	if len(caption) > maxCaptionLength {
+		caption = caption[:maxCaptionLength]
+		if i := strings.LastIndex(caption, " "); i > 0 {
+			caption = caption[:i]
+		}
+	}
+	return sanitizeLocationName(caption)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+// Instances announce they're alive through the cache, which every instance
+// shares when CACHE_URL is set. Work claimed by an instance whose heartbeat
+// has expired is taken over by the others. Claims are conditional updates
+// of the SQLite database rather than database or Redis locks, so instances
+// must share the database file, on one host or a filesystem with working
+// locks.
+const (
+	heartbeatInterval = 10 * time.Second
+	heartbeatTTL      = 30 * time.Second
+)
+
+// instanceID identifies this process among the instances sharing the
+// database. Requests and revisions are claimed by the instance working on them.
+var instanceID = newInstanceID()
+
+// newInstanceID names the process after its host and PID, with a random
+// suffix so a restarted process with the same PID is a new instance
+func newInstanceID() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "skyweave"
+	}
+	suffix, err := generateID(4)
+	if err != nil {
+		suffix = fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return fmt.Sprintf("%s-%d-%s", host, os.Getpid(), suffix)
+}
+
+// startHeartbeat keeps this instance's heartbeat fresh in the cache
+func startHeartbeat() {
+	beat := func() {
+		cacheSet("instance:"+instanceID, []byte(time.Now().UTC().Format(time.RFC3339)), heartbeatTTL)
+	}
+	beat()
+	ticker := time.NewTicker(heartbeatInterval)
+	goSafe("", func() {
+		for range ticker.C {
+			beat()
+		}
+	})
+	log.Printf("Running as instance %s", instanceID)
+}
+
+// instanceAlive reports whether the instance that claimed some work is still
+// running. Work claimed before instances were tracked has no live owner.
+// While the cache can't be read, every instance counts as alive, so an
+// outage doesn't make instances take over each other's work.
+func instanceAlive(id string) bool {
+	if id == instanceID {
+		return true
+	}
+	if id == "" {
+		return false
+	}
+	_, ok, err := appCache.Get("instance:" + id)
+	if err != nil {
+		log.Printf("Failed to check instance %s: %v", id, err)
+		return true
+	}
+	return ok
+}
@@ -0,0 +1,530 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"text/template"
+	"time"
+)
+
+// Config holds the settings that can be reloaded while the server is running.
+// A Config is never modified after it is published; reloading builds a new
+// one and swaps it in, so every reader sees either the old or the new settings.
+type Config struct {
+	OpenWeatherAPIKey string
+	ReplicateAPIToken string
+	ReplicateModel    string
+	CaptionModel      string
+	AccessPassphrase  string
+	AdminPassphrase   string
+	SentryDSN         string
+	ImageSigningKey   string        // signs image and data export links that work without a session
+	ImageLinkTTL      time.Duration // how long signed image links stay valid
+	FrameRefresh      time.Duration // how often photo frames are told to fetch their image again
+	MetricsToken      string        // bearer token for scraping /metrics
+	SessionKeys       string        // keys signing cookie sessions, read when the session store is set up
+	CacheURL          string        // Redis server shared by instances, read when the cache is set up
+
+	ImageAccessLog        bool     // log every result image served
+	HotlinkProtection     string   // which other sites may embed result images, hotlinkOff for any
+	ImageAllowedReferrers []string // hosts of other sites that may always embed result images
+
+	TrustedProxies []*net.IPNet
+	PublicURL      *url.URL
+	Publisher      *Publisher // nil when results aren't published to a CDN
+
+	AWS              AWSCredentials // S3 access for snapshots and publishing
+	S3Endpoint       string         // S3-compatible endpoint, empty for AWS
+	SnapshotS3Bucket string         // bucket of DB_REPLICATION=s3 snapshots, read at startup
+
+	SMTPHost     string
+	SMTPPort     string
+	SMTPUsername string
+	SMTPPassword string
+	SMTPFrom     string
+
+	NotifyTemplates  *NotificationTemplates
+	NotifyWebhookURL string // receives a JSON payload for every completed result
+
+	AlertErrorRate   float64       // share of a stage's passes failing that raises an alert
+	AlertMinFailures int           // failures within the window needed before alerting
+	AlertWindow      time.Duration // how far back stage error rates look
+	AlertWebhookURL  string        // receives a JSON payload for every alert
+	AlertEmails      []string      // addresses alerts are emailed to
+
+	Analytics AnalyticsSink // nil when no ANALYTICS sink is configured
+
+	UploadLimits      UploadLimits
+	UploadConcurrency int // uploads parsed and saved at once, more are turned away
+
+	Antivirus         VirusScanner // nil when no ANTIVIRUS scanner is configured
+	AntivirusFailOpen bool         // accept uploads unscanned while the scanner is unreachable
+
+	LocationSearchRate int // location autocomplete searches per client IP per minute
+
+	Captcha                *Captcha // nil when no CAPTCHA_PROVIDER is configured
+	CaptchaSubmitThreshold int      // hourly submissions after which users must solve a CAPTCHA
+
+	TrialMode         bool // anonymous visitors may try the app without the passphrase
+	TrialDailyLimit   int  // trial generations per visitor per day
+	TrialMaxDimension int  // longest side of trial results in pixels
+
+	DemoMode bool // seed example requests and show them to visitors without requests of their own
+
+	TermsVersion string // terms users must accept before using the app, empty to ask for none
+	TermsURL     string // where the terms of use are published
+	PrivacyURL   string // where the privacy notice is published, if separately
+
+	ResultDiffMin float64 // difference scores below this flag a barely changed result
+	ResultDiffMax float64 // difference scores above this flag a result that changed too much
+	AutoRetryDiff bool    // automatically retry initial results with a flagged difference
+
+	FaceModel      string  // Replicate face detection model, empty to skip face checks
+	FaceDiffMax    float64 // face scores above this flag a result with altered faces
+	AutoRetryFaces bool    // automatically retry initial results with altered faces
+
+	ForecastRefreshAge time.Duration // forecasts older than this are fetched again on confirmation, 0 never
+
+	WeatherMapLayer string // weather map shown on the confirmation page, weatherMapOff for none
+	MapTileURL      string // base map tiles under the weather map, with {z}, {x} and {y}
+
+	DebugHTTP bool // log outbound API requests and responses, with credentials redacted
+
+	APIV1Sunset time.Time // when version 1 of the JSON API stops being served, zero if not scheduled
+
+	ProcessingTimeout time.Duration            // how long a prediction may run before it's canceled
+	PollInterval      time.Duration            // how often predictions are polled at first
+	PollBackoffAfter  time.Duration            // how long predictions are polled at PollInterval before backing off
+	PollMaxInterval   time.Duration            // the longest wait between polls once backed off
+	ModelTimeouts     map[string]time.Duration // per-model overrides of ProcessingTimeout
+
+	PredictionCost  float64
+	BenchmarkModels []BenchmarkModel // models /admin/benchmarks can compare, REPLICATE_MODEL first
+	PromptTemplates map[string]*template.Template
+	PromptVariants  []string
+	PromptGenerator PromptGenerator
+}
+
+var (
+	config     atomic.Pointer[Config]
+	reloadLock sync.Mutex
+)
+
+// setupConfig loads the configuration and publishes it. It's called from
+// main once flags are parsed, since secret managers are read over the network
+// and their failures should be reported, not crash package initialization.
+func setupConfig() error {
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	config.Store(cfg)
+	logConfigWarnings(cfg)
+	return nil
+}
+
+// currentConfig returns the active configuration
+func currentConfig() *Config {
+	return config.Load()
+}
+
+// loadConfig reads the configuration from the environment. If CONFIG_FILE
+// names a KEY=VALUE file, its values take precedence over the environment so
+// they can be changed and reloaded without restarting the process. Secrets can
+// also come from files or from Vault and AWS Secrets Manager.
+func loadConfig() (*Config, error) {
+	return loadConfigWith(fetchManagedSecrets)
+}
+
+// loadConfigWith loads the configuration, filling in what wasn't set
+// directly with the settings fetchSecrets returns
+func loadConfigWith(fetchSecrets func(lookup func(key string) string) (map[string]string, error)) (*Config, error) {
+	values, err := readConfigFile(os.Getenv("CONFIG_FILE"))
+	if err != nil {
+		return nil, err
+	}
+
+	// Settings are looked up in CONFIG_FILE, then in a file named by <KEY>_FILE
+	// (Docker and Kubernetes secrets), then in the environment
+	var fileErr error
+	lookup := func(key string) string {
+		if value := values[key]; value != "" {
+			return value
+		}
+		path := values[key+"_FILE"]
+		if path == "" {
+			path = os.Getenv(key + "_FILE")
+		}
+		if path != "" {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				if fileErr == nil {
+					fileErr = fmt.Errorf("failed to read %s_FILE: %w", key, err)
+				}
+				return ""
+			}
+			return strings.TrimRight(string(data), "\r\n")
+		}
+		return os.Getenv(key)
+	}
+
+	// Secret managers fill in whatever wasn't set directly
+	secrets, err := fetchSecrets(lookup)
+	if err != nil {
+		return nil, err
+	}
+	get := func(key, def string) string {
+		if value := lookup(key); value != "" {
+			return value
+		}
+		if value := secrets[key]; value != "" {
+			return value
+		}
+		return def
+	}
+
+	cfg := &Config{
+		OpenWeatherAPIKey: get("OPENWEATHER_API_KEY", ""),
+		ReplicateAPIToken: get("REPLICATE_API_TOKEN", ""),
+		ReplicateModel:    get("REPLICATE_MODEL", "black-forest-labs/flux-kontext-pro"),
+		CaptionModel:      get("CAPTION_MODEL", ""),
+		AccessPassphrase:  get("ACCESS_PASSPHRASE", ""),
+		AdminPassphrase:   get("ADMIN_PASSPHRASE", ""),
+		SentryDSN:         get("SENTRY_DSN", ""),
+		ImageSigningKey:   get("IMAGE_SIGNING_KEY", ""),
+		MetricsToken:      get("METRICS_TOKEN", ""),
+		SessionKeys:       get("SESSION_KEYS", ""),
+		CacheURL:          get("CACHE_URL", ""),
+		TrustedProxies:    parseTrustedProxies(get("TRUSTED_PROXIES", "")),
+		PublicURL:         parsePublicURL(get("PUBLIC_URL", "")),
+		SMTPHost:          get("SMTP_HOST", ""),
+		SMTPPort:          get("SMTP_PORT", "587"),
+		SMTPUsername:      get("SMTP_USERNAME", ""),
+		SMTPPassword:      get("SMTP_PASSWORD", ""),
+		SMTPFrom:          get("SMTP_FROM", "skyweave@localhost"),
+		NotifyWebhookURL:  get("NOTIFY_WEBHOOK_URL", ""),
+		TermsVersion:      get("TERMS_VERSION", ""),
+		TermsURL:          get("TERMS_URL", ""),
+		PrivacyURL:        get("PRIVACY_URL", ""),
+	}
+	if cfg.TermsVersion != "" && cfg.TermsURL == "" {
+		return nil, fmt.Errorf("TERMS_VERSION needs TERMS_URL, where the terms are published")
+	}
+
+	cfg.UploadLimits = parseUploadLimits(get("UPLOAD_MAX_MB", "32"), get("UPLOAD_EXTENSIONS", defaultUploadExtensions),
+		get("UPLOAD_MAX_DIMENSION", "10000"))
+	cfg.UploadConcurrency, err = strconv.Atoi(get("UPLOAD_CONCURRENCY", "4"))
+	if err != nil || cfg.UploadConcurrency < 1 {
+		log.Printf("Warning: invalid UPLOAD_CONCURRENCY, using 4")
+		cfg.UploadConcurrency = 4
+	}
+
+	if owner, name, ok := strings.Cut(cfg.ReplicateModel, "/"); !ok || owner == "" || name == "" {
+		return nil, fmt.Errorf("REPLICATE_MODEL must look like owner/name, got %q", cfg.ReplicateModel)
+	}
+
+	cfg.ImageLinkTTL, err = time.ParseDuration(get("IMAGE_LINK_TTL", "168h"))
+	if err != nil || cfg.ImageLinkTTL <= 0 {
+		log.Printf("Warning: invalid IMAGE_LINK_TTL, using 168h")
+		cfg.ImageLinkTTL = 7 * 24 * time.Hour
+	}
+
+	cfg.FrameRefresh, err = time.ParseDuration(get("FRAME_REFRESH", "1h"))
+	if err != nil || cfg.FrameRefresh < minFrameRefresh {
+		log.Printf("Warning: invalid FRAME_REFRESH, using 1h")
+		cfg.FrameRefresh = time.Hour
+	}
+
+	cfg.ImageAccessLog = get("IMAGE_ACCESS_LOG", "true") == "true"
+	cfg.HotlinkProtection = get("IMAGE_HOTLINK_PROTECTION", hotlinkOff)
+	switch cfg.HotlinkProtection {
+	case hotlinkOff, hotlinkReferrer, hotlinkSigned:
+	default:
+		return nil, fmt.Errorf("unknown IMAGE_HOTLINK_PROTECTION %q, expected off, referrer or signed", cfg.HotlinkProtection)
+	}
+	for _, host := range strings.Split(get("IMAGE_ALLOWED_REFERRERS", ""), ",") {
+		if host = strings.ToLower(strings.TrimSpace(host)); host != "" {
+			cfg.ImageAllowedReferrers = append(cfg.ImageAllowedReferrers, host)
+		}
+	}
+
+	cfg.AWS = AWSCredentials{
+		Region:          get("AWS_REGION", "us-east-1"),
+		AccessKeyID:     get("AWS_ACCESS_KEY_ID", ""),
+		SecretAccessKey: get("AWS_SECRET_ACCESS_KEY", ""),
+		SessionToken:    get("AWS_SESSION_TOKEN", ""),
+	}
+	cfg.S3Endpoint = get("S3_ENDPOINT", "")
+	cfg.SnapshotS3Bucket = get("SNAPSHOT_S3_BUCKET", "")
+	cfg.Publisher, err = newPublisher(get("PUBLISH_S3_BUCKET", ""), get("PUBLISH_S3_ENDPOINT", cfg.S3Endpoint),
+		get("PUBLISH_S3_PREFIX", "results/"), get("PUBLISH_BASE_URL", ""), cfg.AWS)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg.Captcha, err = newCaptcha(get("CAPTCHA_PROVIDER", ""), get("CAPTCHA_SITE_KEY", ""), get("CAPTCHA_SECRET_KEY", ""))
+	if err != nil {
+		return nil, err
+	}
+	cfg.CaptchaSubmitThreshold, err = strconv.Atoi(get("CAPTCHA_SUBMIT_THRESHOLD", "10"))
+	if err != nil || cfg.CaptchaSubmitThreshold < 1 {
+		log.Printf("Warning: invalid CAPTCHA_SUBMIT_THRESHOLD, using 10")
+		cfg.CaptchaSubmitThreshold = 10
+	}
+
+	cfg.AlertErrorRate, err = strconv.ParseFloat(get("ALERT_ERROR_RATE", "0.5"), 64)
+	if err != nil || cfg.AlertErrorRate <= 0 || cfg.AlertErrorRate > 1 {
+		log.Printf("Warning: invalid ALERT_ERROR_RATE, using 0.5")
+		cfg.AlertErrorRate = 0.5
+	}
+	cfg.AlertMinFailures, err = strconv.Atoi(get("ALERT_MIN_FAILURES", "3"))
+	if err != nil || cfg.AlertMinFailures < 1 {
+		log.Printf("Warning: invalid ALERT_MIN_FAILURES, using 3")
+		cfg.AlertMinFailures = 3
+	}
+	cfg.AlertWindow, err = time.ParseDuration(get("ALERT_WINDOW", "15m"))
+	if err != nil || cfg.AlertWindow < time.Minute {
+		log.Printf("Warning: invalid ALERT_WINDOW, using 15m")
+		cfg.AlertWindow = 15 * time.Minute
+	}
+	cfg.AlertWebhookURL = get("ALERT_WEBHOOK_URL", "")
+	for _, address := range strings.Split(get("ALERT_EMAILS", ""), ",") {
+		if address = strings.TrimSpace(address); address != "" {
+			cfg.AlertEmails = append(cfg.AlertEmails, address)
+		}
+	}
+
+	cfg.Analytics, err = newAnalyticsSink(get("ANALYTICS", ""), get("POSTHOG_API_KEY", ""),
+		get("POSTHOG_HOST", "https://us.i.posthog.com"))
+	if err != nil {
+		return nil, err
+	}
+
+	clamTimeout, err := time.ParseDuration(get("CLAMAV_TIMEOUT", "30s"))
+	if err != nil || clamTimeout <= 0 {
+		log.Printf("Warning: invalid CLAMAV_TIMEOUT, using 30s")
+		clamTimeout = 30 * time.Second
+	}
+	cfg.Antivirus, err = newVirusScanner(get("ANTIVIRUS", ""), get("CLAMAV_ADDRESS", ""), clamTimeout)
+	if err != nil {
+		return nil, err
+	}
+	cfg.AntivirusFailOpen = get("ANTIVIRUS_FAIL_OPEN", "false") == "true"
+
+	cfg.LocationSearchRate, err = strconv.Atoi(get("LOCATION_SEARCH_RATE", "60"))
+	if err != nil || cfg.LocationSearchRate < 1 {
+		log.Printf("Warning: invalid LOCATION_SEARCH_RATE, using 60")
+		cfg.LocationSearchRate = 60
+	}
+
+	cfg.DemoMode = get("DEMO_MODE", "false") == "true"
+
+	cfg.TrialMode = get("TRIAL_MODE", "false") == "true"
+	if cfg.TrialMode && cfg.Captcha == nil {
+		log.Printf("Warning: TRIAL_MODE needs a CAPTCHA_PROVIDER, trial mode disabled")
+		cfg.TrialMode = false
+	}
+	cfg.TrialDailyLimit, err = strconv.Atoi(get("TRIAL_DAILY_LIMIT", "1"))
+	if err != nil || cfg.TrialDailyLimit < 1 {
+		log.Printf("Warning: invalid TRIAL_DAILY_LIMIT, using 1")
+		cfg.TrialDailyLimit = 1
+	}
+	cfg.TrialMaxDimension, err = strconv.Atoi(get("TRIAL_MAX_DIMENSION", "512"))
+	if err != nil || cfg.TrialMaxDimension < 64 {
+		log.Printf("Warning: invalid TRIAL_MAX_DIMENSION, using 512")
+		cfg.TrialMaxDimension = 512
+	}
+
+	cfg.ResultDiffMin, err = strconv.ParseFloat(get("RESULT_DIFF_MIN", "0.05"), 64)
+	if err != nil || cfg.ResultDiffMin < 0 || cfg.ResultDiffMin > 1 {
+		log.Printf("Warning: invalid RESULT_DIFF_MIN, using 0.05")
+		cfg.ResultDiffMin = 0.05
+	}
+	cfg.ResultDiffMax, err = strconv.ParseFloat(get("RESULT_DIFF_MAX", "0.6"), 64)
+	if err != nil || cfg.ResultDiffMax <= cfg.ResultDiffMin || cfg.ResultDiffMax > 1 {
+		log.Printf("Warning: invalid RESULT_DIFF_MAX, using 0.6")
+		cfg.ResultDiffMax = max(0.6, cfg.ResultDiffMin)
+	}
+	cfg.AutoRetryDiff = get("AUTO_RETRY_DIFF", "false") == "true"
+
+	cfg.FaceModel = get("FACE_MODEL", "")
+	cfg.FaceDiffMax, err = strconv.ParseFloat(get("FACE_DIFF_MAX", "0.35"), 64)
+	if err != nil || cfg.FaceDiffMax <= 0 || cfg.FaceDiffMax > 1 {
+		log.Printf("Warning: invalid FACE_DIFF_MAX, using 0.35")
+		cfg.FaceDiffMax = 0.35
+	}
+	cfg.AutoRetryFaces = get("FACE_AUTO_RETRY", "false") == "true"
+
+	timeout, err := time.ParseDuration(get("PROCESSING_TIMEOUT", "10m"))
+	if err != nil || timeout <= 0 {
+		log.Printf("Warning: invalid PROCESSING_TIMEOUT, using 10m")
+		timeout = 10 * time.Minute
+	}
+	cfg.ProcessingTimeout = timeout
+	cfg.ModelTimeouts = parseModelTimeouts(get("MODEL_TIMEOUTS", ""))
+
+	cfg.PollInterval, err = time.ParseDuration(get("POLL_INTERVAL", "5s"))
+	if err != nil || cfg.PollInterval <= 0 {
+		log.Printf("Warning: invalid POLL_INTERVAL, using 5s")
+		cfg.PollInterval = 5 * time.Second
+	}
+	cfg.PollBackoffAfter, err = time.ParseDuration(get("POLL_BACKOFF_AFTER", "1m"))
+	if err != nil || cfg.PollBackoffAfter < 0 {
+		log.Printf("Warning: invalid POLL_BACKOFF_AFTER, using 1m")
+		cfg.PollBackoffAfter = time.Minute
+	}
+	cfg.PollMaxInterval, err = time.ParseDuration(get("POLL_MAX_INTERVAL", "30s"))
+	if err != nil || cfg.PollMaxInterval <= 0 {
+		log.Printf("Warning: invalid POLL_MAX_INTERVAL, using 30s")
+		cfg.PollMaxInterval = 30 * time.Second
+	}
+	if cfg.PollMaxInterval < cfg.PollInterval {
+		log.Printf("Warning: POLL_MAX_INTERVAL is shorter than POLL_INTERVAL, not backing off")
+		cfg.PollMaxInterval = cfg.PollInterval
+	}
+
+	cfg.ForecastRefreshAge, err = time.ParseDuration(get("FORECAST_REFRESH_AFTER", "6h"))
+	if err != nil || cfg.ForecastRefreshAge < 0 {
+		log.Printf("Warning: invalid FORECAST_REFRESH_AFTER, using 6h")
+		cfg.ForecastRefreshAge = 6 * time.Hour
+	}
+
+	cfg.WeatherMapLayer = get("WEATHER_MAP_LAYER", weatherMapPrecipitation)
+	if _, ok := weatherMapOperations[cfg.WeatherMapLayer]; !ok && cfg.WeatherMapLayer != weatherMapOff {
+		return nil, fmt.Errorf("unknown WEATHER_MAP_LAYER %q, expected precipitation, clouds or off", cfg.WeatherMapLayer)
+	}
+	cfg.MapTileURL = get("MAP_TILE_URL", defaultMapTileURL)
+
+	cfg.DebugHTTP = get("DEBUG_HTTP", "false") == "true"
+
+	if sunset := get("API_V1_SUNSET", ""); sunset != "" {
+		cfg.APIV1Sunset, err = time.Parse(time.DateOnly, sunset)
+		if err != nil {
+			log.Printf("Warning: invalid API_V1_SUNSET, not announcing a sunset")
+		}
+	}
+
+	cost, err := strconv.ParseFloat(get("REPLICATE_COST_PER_PREDICTION", "0.04"), 64)
+	if err != nil {
+		log.Printf("Warning: invalid REPLICATE_COST_PER_PREDICTION, using 0.04: %v", err)
+		cost = 0.04
+	}
+	cfg.PredictionCost = cost
+	cfg.BenchmarkModels = parseBenchmarkModels(get("BENCHMARK_MODELS", ""), cfg.ReplicateModel, cost)
+
+	cfg.PromptTemplates, err = loadPromptTemplates(get("PROMPT_TEMPLATE_DIR", ""))
+	if err != nil {
+		return nil, err
+	}
+	cfg.NotifyTemplates, err = loadNotificationTemplates(get("NOTIFY_TEMPLATE_DIR", ""))
+	if err != nil {
+		return nil, err
+	}
+
+	cfg.PromptVariants = parsePromptVariants(get("PROMPT_EXPERIMENT", ""), cfg.PromptTemplates)
+
+	cfg.PromptGenerator, err = newPromptGenerator(get("PROMPT_GENERATOR", promptGeneratorRules),
+		get("PROMPT_LLM_MODEL", ""), get("PROMPT_LLM_URL", ""), get("PROMPT_LLM_API_KEY", ""))
+	if err != nil {
+		return nil, err
+	}
+
+	if fileErr != nil {
+		return nil, fileErr
+	}
+	return cfg, nil
+}
+
+// readConfigFile parses a file of KEY=VALUE lines. Blank lines and lines
+// starting with # are ignored, and values may be wrapped in quotes.
+func readConfigFile(path string) (map[string]string, error) {
+	values := make(map[string]string)
+	if path == "" {
+		return values, nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open CONFIG_FILE: %w", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(strings.TrimPrefix(line, "export "), "=")
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: expected KEY=VALUE", path, lineNo)
+		}
+		value = strings.TrimSpace(value)
+		if unquoted, err := strconv.Unquote(value); err == nil {
+			value = unquoted
+		} else if len(value) >= 2 && value[0] == '\'' && value[len(value)-1] == '\'' {
+			value = value[1 : len(value)-1]
+		}
+		values[strings.TrimSpace(key)] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read CONFIG_FILE: %w", err)
+	}
+	return values, nil
+}
+
+// logConfigWarnings points out settings that leave features disabled
+func logConfigWarnings(cfg *Config) {
+	if cfg.OpenWeatherAPIKey == "" {
+		// For development, allow empty key (will skip API calls)
+		log.Println("Warning: OPENWEATHER_API_KEY not set")
+	}
+	if cfg.ReplicateAPIToken == "" {
+		log.Println("Warning: REPLICATE_API_TOKEN not set - AI image editing will not work")
+	}
+	if cfg.AccessPassphrase == "" {
+		log.Println("Warning: ACCESS_PASSPHRASE not set - authentication disabled")
+	}
+	if cfg.AdminPassphrase == "" {
+		log.Println("ADMIN_PASSPHRASE not set - admin pages disabled")
+	}
+}
+
+// reloadConfig loads the configuration again and swaps it in. On error the
+// running configuration is left untouched.
+func reloadConfig() error {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	config.Store(cfg)
+	logConfigWarnings(cfg)
+	log.Println("Configuration reloaded")
+	return nil
+}
+
+// watchReloadSignal reloads the configuration whenever the process receives SIGHUP
+func watchReloadSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	goSafe("", func() {
+		for range signals {
+			if err := reloadConfig(); err != nil {
+				log.Printf("Failed to reload configuration: %v", err)
+			}
+		}
+	})
+}
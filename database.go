@@ -2,10 +2,15 @@ package main
 
 import (
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
 
 	_ "modernc.org/sqlite"
 )
@@ -15,18 +20,17 @@ var db *sql.DB
 // initDB initializes the database connection and creates tables
 func initDB() error {
 	// Ensure data directory exists
-	if err := os.MkdirAll("./data", 0755); err != nil {
+	if err := os.MkdirAll(dataDir, 0755); err != nil {
 		return err
 	}
-
-	dbPath := filepath.Join("./data", "skyweave.db")
-	var err error
-	db, err = sql.Open("sqlite", dbPath)
-	if err != nil {
+	if err := openDB(); err != nil {
 		return err
 	}
 
-	// Check if migration is needed
+	// Upgrade what can be upgraded in place, then check the result
+	if err := migrateSchema(); err != nil {
+		return fmt.Errorf("failed to migrate database: %w", err)
+	}
 	if err := checkAndMigrate(); err != nil {
 		log.Printf("Migration check failed, recreating database: %v", err)
 		// If migration fails, drop and recreate tables
@@ -38,61 +42,657 @@ func initDB() error {
 	return nil
 }
 
+// migrateSchema upgrades older databases in place where their data can be
+// kept. Anything it doesn't know how to upgrade is left to checkAndMigrate.
+func migrateSchema() error {
+	var tables int
+	if err := dbQueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'requests'`).Scan(&tables); err != nil || tables == 0 {
+		return err
+	}
+	if err := migrateAddedColumns(); err != nil {
+		return err
+	}
+	if err := migratePrecipitationColumns(); err != nil {
+		return err
+	}
+	if err := migrateAddedTables(); err != nil {
+		return err
+	}
+	if err := migrateRevisions(); err != nil {
+		return err
+	}
+	return migrateSearchIndex()
+}
+
+// erasuresTable records requests to erase a user's data, which are purged in
+// the background. Rows are kept once purged, as the record of the erasure.
+const erasuresTable = `
+	CREATE TABLE IF NOT EXISTS erasures (
+		user_id TEXT PRIMARY KEY,
+		requested_by TEXT NOT NULL,
+		requested_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		completed_at DATETIME,
+		requests_deleted INTEGER NOT NULL DEFAULT 0,
+		files_deleted INTEGER NOT NULL DEFAULT 0
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_erasures_completed_at ON erasures(completed_at);
+`
+
+// dataExportsTable tracks the archives of personal data users download,
+// which are built in the background and deleted once they expire
+const dataExportsTable = `
+	CREATE TABLE IF NOT EXISTS data_exports (
+		id TEXT PRIMARY KEY,
+		user_id TEXT NOT NULL,
+		status TEXT NOT NULL DEFAULT 'building',
+		path TEXT,
+		size INTEGER NOT NULL DEFAULT 0,
+		error_message TEXT,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		completed_at DATETIME,
+		expires_at DATETIME NOT NULL
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_data_exports_user_id ON data_exports(user_id);
+`
+
+// consentsTable records which version of the terms each user accepted, and when
+const consentsTable = `
+	CREATE TABLE IF NOT EXISTS consents (
+		user_id TEXT NOT NULL,
+		terms_version TEXT NOT NULL,
+		accepted_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (user_id, terms_version)
+	);
+`
+
+// schedulesTable holds the generations users planned for later dates, each
+// re-running one of their requests on its date
+const schedulesTable = `
+	CREATE TABLE IF NOT EXISTS schedules (
+		id TEXT PRIMARY KEY,
+		user_id TEXT NOT NULL,
+		source_request_id TEXT NOT NULL,
+		run_date TEXT NOT NULL,
+		run_at DATETIME NOT NULL,
+		uid TEXT NOT NULL,
+		summary TEXT,
+		status TEXT NOT NULL DEFAULT 'scheduled',
+		request_id TEXT,
+		error_message TEXT,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE (user_id, uid, run_date)
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_schedules_due ON schedules(status, run_at);
+`
+
+// calendarFeedsTable holds each user's calendar feed token, the opaque
+// secret their feed link is made of, replaced to revoke the link
+const calendarFeedsTable = `
+	CREATE TABLE IF NOT EXISTS calendar_feeds (
+		user_id TEXT PRIMARY KEY,
+		token TEXT NOT NULL UNIQUE,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+`
+
+// draftsTable keeps the start form of each user who filled it in partway,
+// to pick up where they left off
+const draftsTable = `
+	CREATE TABLE IF NOT EXISTS drafts (
+		user_id TEXT PRIMARY KEY,
+		fields TEXT NOT NULL,
+		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+`
+
+// analyticsEventsTable holds the product events of the table analytics sink,
+// each with its properties as a JSON object
+const analyticsEventsTable = `
+	CREATE TABLE IF NOT EXISTS analytics_events (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL,
+		user_id TEXT NOT NULL,
+		request_id TEXT,
+		properties TEXT NOT NULL DEFAULT '{}',
+		created_at TEXT NOT NULL
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_analytics_events_name ON analytics_events(name, created_at);
+	CREATE INDEX IF NOT EXISTS idx_analytics_events_user_id ON analytics_events(user_id);
+`
+
+// blobsTable records the stored blobs and how many rows refer to each,
+// counted by triggers on the columns holding image paths
+const blobsTable = `
+	CREATE TABLE IF NOT EXISTS blobs (
+		path TEXT PRIMARY KEY,
+		hash TEXT NOT NULL,
+		size INTEGER NOT NULL,
+		refs INTEGER NOT NULL DEFAULT 0,
+		stored_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_blobs_refs ON blobs(refs);
+
+	CREATE TRIGGER IF NOT EXISTS blob_refs_request_insert AFTER INSERT ON requests
+	BEGIN
+		UPDATE blobs SET refs = refs + 1 WHERE path = NEW.image_path;
+		UPDATE blobs SET refs = refs + 1 WHERE path = NEW.result_image_path;
+	END;
+
+	CREATE TRIGGER IF NOT EXISTS blob_refs_request_update AFTER UPDATE OF image_path, result_image_path ON requests
+	BEGIN
+		UPDATE blobs SET refs = refs - 1 WHERE path = OLD.image_path;
+		UPDATE blobs SET refs = refs + 1 WHERE path = NEW.image_path;
+		UPDATE blobs SET refs = refs - 1 WHERE path = OLD.result_image_path;
+		UPDATE blobs SET refs = refs + 1 WHERE path = NEW.result_image_path;
+	END;
+
+	CREATE TRIGGER IF NOT EXISTS blob_refs_request_delete AFTER DELETE ON requests
+	BEGIN
+		UPDATE blobs SET refs = refs - 1 WHERE path = OLD.image_path;
+		UPDATE blobs SET refs = refs - 1 WHERE path = OLD.result_image_path;
+	END;
+
+	CREATE TRIGGER IF NOT EXISTS blob_refs_revision_insert AFTER INSERT ON revisions
+	BEGIN
+		UPDATE blobs SET refs = refs + 1 WHERE path = NEW.result_image_path;
+		UPDATE blobs SET refs = refs + 1 WHERE path = NEW.postcard_image_path;
+	END;
+
+	CREATE TRIGGER IF NOT EXISTS blob_refs_revision_update AFTER UPDATE OF result_image_path, postcard_image_path ON revisions
+	BEGIN
+		UPDATE blobs SET refs = refs - 1 WHERE path = OLD.result_image_path;
+		UPDATE blobs SET refs = refs + 1 WHERE path = NEW.result_image_path;
+		UPDATE blobs SET refs = refs - 1 WHERE path = OLD.postcard_image_path;
+		UPDATE blobs SET refs = refs + 1 WHERE path = NEW.postcard_image_path;
+	END;
+
+	CREATE TRIGGER IF NOT EXISTS blob_refs_revision_delete AFTER DELETE ON revisions
+	BEGIN
+		UPDATE blobs SET refs = refs - 1 WHERE path = OLD.result_image_path;
+		UPDATE blobs SET refs = refs - 1 WHERE path = OLD.postcard_image_path;
+	END;
+
+	CREATE TRIGGER IF NOT EXISTS blob_refs_benchmark_run_insert AFTER INSERT ON benchmark_runs
+	BEGIN
+		UPDATE blobs SET refs = refs + 1 WHERE path = NEW.result_image_path;
+	END;
+
+	CREATE TRIGGER IF NOT EXISTS blob_refs_benchmark_run_update AFTER UPDATE OF result_image_path ON benchmark_runs
+	BEGIN
+		UPDATE blobs SET refs = refs - 1 WHERE path = OLD.result_image_path;
+		UPDATE blobs SET refs = refs + 1 WHERE path = NEW.result_image_path;
+	END;
+
+	CREATE TRIGGER IF NOT EXISTS blob_refs_benchmark_run_delete AFTER DELETE ON benchmark_runs
+	BEGIN
+		UPDATE blobs SET refs = refs - 1 WHERE path = OLD.result_image_path;
+	END;
+`
+
+// addedColumns are the columns added to tables after they were first
+// created, with the definitions they're added with. Columns that are NOT NULL
+// need a default, which the existing rows get. rain_mm and snow_mm are added
+// by migratePrecipitationColumns.
+var addedColumns = []struct {
+	table, column, definition string
+}{
+	{"requests", "location_id", "INTEGER"},
+	{"requests", "place_names", "TEXT"},
+	{"requests", "place_language", "TEXT"},
+	{"requests", "utc_offset", "INTEGER"},
+	{"requests", "end_date", "TEXT"},
+	{"requests", "batch_id", "TEXT"},
+	{"requests", "units", "TEXT NOT NULL DEFAULT 'metric'"},
+	{"requests", "intensity", "TEXT NOT NULL DEFAULT 'natural'"},
+	{"requests", "preset", "TEXT"},
+	{"requests", "preset_mode", "TEXT"},
+	{"requests", "upload_url", "TEXT"},
+	{"requests", "upload_expires_at", "TEXT"},
+	{"requests", "postcard", "INTEGER NOT NULL DEFAULT 0"},
+	{"requests", "weather_source", "TEXT"},
+	{"requests", "weather_condition_id", "INTEGER"},
+	{"requests", "caption", "TEXT"},
+	{"requests", "prompt_variant", "TEXT"},
+	{"requests", "error_code", "TEXT"},
+	{"requests", "parent_request_id", "TEXT"},
+	{"requests", "claimed_by", "TEXT"},
+	{"sessions", "is_admin", "INTEGER NOT NULL DEFAULT 0"},
+	{"sessions", "is_trial", "INTEGER NOT NULL DEFAULT 0"},
+	{"revisions", "intensity", "TEXT NOT NULL DEFAULT 'natural'"},
+	{"revisions", "model", "TEXT"},
+	{"revisions", "postcard_image_path", "TEXT"},
+	{"revisions", "public_url", "TEXT"},
+	{"revisions", "diff_score", "REAL"},
+	{"revisions", "face_score", "REAL"},
+	{"revisions", "claimed_by", "TEXT"},
+	{"revisions", "completed_at", "DATETIME"},
+	{"weather_snapshots", "units", "TEXT NOT NULL DEFAULT 'metric'"},
+}
+
+// migrateAddedColumns adds the columns in addedColumns that a table is
+// missing. Tables that don't exist yet are left to migrateAddedTables.
+func migrateAddedColumns() error {
+	tx, err := dbBegin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, added := range addedColumns {
+		var columns, present int
+		err := tx.QueryRow(`SELECT COUNT(*), COUNT(*) FILTER (WHERE name = ?) FROM pragma_table_info(?)`,
+			added.column, added.table).Scan(&columns, &present)
+		if err != nil {
+			return err
+		}
+		if columns == 0 || present > 0 {
+			continue
+		}
+		log.Printf("Adding column %s.%s...", added.table, added.column)
+		if _, err := tx.Exec("ALTER TABLE " + added.table + " ADD COLUMN " + added.column + " " + added.definition); err != nil {
+			return fmt.Errorf("failed to add %s.%s: %w", added.table, added.column, err)
+		}
+	}
+	return tx.Commit()
+}
+
+// migrateAddedTables creates the tables, indexes and triggers a database
+// created before them is missing, so it doesn't have to be recreated for them
+func migrateAddedTables() error {
+	_, err := dbExec(schema)
+	return err
+}
+
+// migrateRevisions gives results from before revisions existed a completed
+// initial revision, so they still show, and moves the feedback given on
+// requests to that revision. Thumbs up and down votes become 5 and 1 stars.
+func migrateRevisions() error {
+	tx, err := dbBegin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`INSERT INTO revisions (id, request_id, kind, prompt, intensity, status, result_image_path,
+	                                             is_primary, created_at, completed_at)
+	                      SELECT lower(hex(randomblob(16))), id, ?, COALESCE(ai_prompt, ''), intensity, 'completed',
+	                             result_image_path, 1, updated_at, updated_at
+	                      FROM requests r
+	                      WHERE COALESCE(result_image_path, '') != ''
+	                        AND NOT EXISTS (SELECT 1 FROM revisions WHERE request_id = r.id)`, revisionInitial); err != nil {
+		return err
+	}
+
+	var perRequest, votes int
+	err = tx.QueryRow(`SELECT COUNT(*) FILTER (WHERE name = 'request_id'), COUNT(*) FILTER (WHERE name = 'vote')
+	                   FROM pragma_table_info('feedback')`).Scan(&perRequest, &votes)
+	if err != nil {
+		return err
+	}
+	if perRequest > 0 {
+		log.Println("Moving result feedback from requests to their revisions...")
+		rating, issues := "f.rating", "f.issues"
+		if votes > 0 {
+			rating, issues = "CASE WHEN f.vote > 0 THEN 5 ELSE 1 END", "NULL"
+		}
+		for _, stmt := range []string{
+			"ALTER TABLE feedback RENAME TO request_feedback",
+			`CREATE TABLE feedback (
+				revision_id TEXT PRIMARY KEY,
+				rating INTEGER NOT NULL,
+				issues TEXT,
+				created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+			)`,
+			`INSERT INTO feedback (revision_id, rating, issues, created_at)
+			 SELECT rev.id, ` + rating + `, ` + issues + `, f.created_at
+			 FROM request_feedback f JOIN revisions rev ON rev.request_id = f.request_id AND rev.is_primary = 1`,
+			"DROP TABLE request_feedback",
+		} {
+			if _, err := tx.Exec(stmt); err != nil {
+				return err
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+// migrateSearchIndex adds the requests that aren't in the full-text index
+// yet, those made before the index was created along with it
+func migrateSearchIndex() error {
+	_, err := dbExec(`INSERT INTO request_search (request_id, location, prompt, tags)
+	                  SELECT r.id, r.location_input || ' ' || COALESCE(r.location_name, '') || ' ' || COALESCE(r.country, ''),
+	                         COALESCE(r.ai_prompt, ''),
+	                         (SELECT COALESCE(group_concat(t.name, ' '), '') FROM request_tags rt
+	                          JOIN tags t ON t.id = rt.tag_id WHERE rt.request_id = r.id)
+	                  FROM requests r
+	                  WHERE r.id NOT IN (SELECT request_id FROM request_search)`)
+	return err
+}
+
+// migratePrecipitationColumns replaces the precipitation text of requests,
+// like "Rain: 3.2mm", with the rain_mm and snow_mm columns it was written from
+func migratePrecipitationColumns() error {
+	var legacy, current int
+	err := dbQueryRow(`SELECT COUNT(*) FILTER (WHERE name = 'precipitation'), COUNT(*) FILTER (WHERE name = 'rain_mm')
+	                   FROM pragma_table_info('requests')`).Scan(&legacy, &current)
+	if err != nil || legacy == 0 || current > 0 {
+		return err
+	}
+	log.Println("Moving request precipitation into rain_mm and snow_mm columns...")
+
+	tx, err := dbBegin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, stmt := range []string{
+		"ALTER TABLE requests ADD COLUMN rain_mm REAL",
+		"ALTER TABLE requests ADD COLUMN snow_mm REAL",
+	} {
+		if _, err := tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+
+	rows, err := tx.Query(`SELECT id, precipitation FROM requests WHERE COALESCE(precipitation, '') != ''`)
+	if err != nil {
+		return err
+	}
+	amounts := make(map[string][2]float64)
+	for rows.Next() {
+		var id, text string
+		if err := rows.Scan(&id, &text); err != nil {
+			rows.Close()
+			return err
+		}
+		rain, snow := parsePrecipitation(text)
+		amounts[id] = [2]float64{rain, snow}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for id, amount := range amounts {
+		if _, err := tx.Exec(`UPDATE requests SET rain_mm = ?, snow_mm = ? WHERE id = ?`, amount[0], amount[1], id); err != nil {
+			return err
+		}
+	}
+	// Requests with weather but no precipitation text had none
+	if _, err := tx.Exec(`UPDATE requests SET rain_mm = 0, snow_mm = 0
+	                      WHERE rain_mm IS NULL AND (weather_condition_id IS NOT NULL OR weather_condition IS NOT NULL)`); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec("ALTER TABLE requests DROP COLUMN precipitation"); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// dbPath is where the SQLite database lives
+func dbPath() string {
+	return filepath.Join(dataDir, "skyweave.db")
+}
+
+// openDB opens the database without checking or migrating its schema
+func openDB() error {
+	var err error
+	db, err = sql.Open("sqlite", dbDSN())
+	return err
+}
+
+// dbDSN is the connection string the database is opened with
+func dbDSN() string {
+	// Background jobs write concurrently (a batch starts one per day), so wait
+	// for locks instead of failing with SQLITE_BUSY
+	dsn := dbPath() + "?_pragma=busy_timeout(5000)"
+	if replicationMode == replicationLitestream {
+		// Litestream ships the write-ahead log, so the database must use one
+		dsn += "&_pragma=journal_mode(WAL)&_pragma=synchronous(NORMAL)"
+	}
+	return dsn
+}
+
 // checkAndMigrate checks if the table structure matches the current schema
 func checkAndMigrate() error {
 	// Try to query the table with all expected columns
-	testQuery := `SELECT id, user_id, location_input, location_name, country, 
-	              latitude, longitude, target_date, time_of_day, image_path, 
-	              weather_condition, weather_description, temperature, feels_like,
-	              humidity, clouds, wind_speed, visibility, precipitation, ai_prompt,
-	              prediction_id, status, error_message, result_image_path, created_at, updated_at
+	testQuery := `SELECT id, user_id, location_input, location_id, location_name, country, place_names, place_language,
+	              latitude, longitude, utc_offset, target_date, end_date, batch_id, time_of_day, units, intensity, preset, preset_mode, image_path, upload_url, upload_expires_at, postcard,
+	              weather_source, weather_condition_id, weather_condition, weather_description, temperature, feels_like,
+	              humidity, clouds, wind_speed, visibility, rain_mm, snow_mm, caption, ai_prompt, prompt_variant,
+	              prediction_id, status, error_code, error_message, result_image_path, parent_request_id,
+	              claimed_by, created_at, updated_at
 	              FROM requests LIMIT 0`
 
-	_, err := db.Exec(testQuery)
+	_, err := dbExec(testQuery)
 	if err != nil {
 		// Table doesn't exist or structure is wrong
 		return fmt.Errorf("table structure mismatch: %w", err)
 	}
 
 	// Check sessions table
-	sessionQuery := `SELECT session_id, created_at, expires_at FROM sessions LIMIT 0`
-	_, err = db.Exec(sessionQuery)
+	sessionQuery := `SELECT session_id, is_admin, is_trial, created_at, expires_at FROM sessions LIMIT 0`
+	_, err = dbExec(sessionQuery)
 	if err != nil {
 		return fmt.Errorf("sessions table mismatch: %w", err)
 	}
 
-	return nil
-}
+	// Check saved_locations table
+	locationsQuery := `SELECT id, user_id, label, location_name, country, latitude, longitude, created_at
+	                   FROM saved_locations LIMIT 0`
+	_, err = dbExec(locationsQuery)
+	if err != nil {
+		return fmt.Errorf("saved_locations table mismatch: %w", err)
+	}
 
-// recreateTables drops existing tables and creates new ones with current schema
-func recreateTables() error {
-	log.Println("Dropping old tables...")
+	// Check revisions table
+	revisionsQuery := `SELECT id, request_id, parent_revision_id, kind, prompt, seed, intensity, model, prediction_id,
+	                   status, error_code, error_message, result_image_path, postcard_image_path, public_url, diff_score,
+	                   face_score, is_primary, claimed_by, created_at, completed_at
+	                   FROM revisions LIMIT 0`
+	_, err = dbExec(revisionsQuery)
+	if err != nil {
+		return fmt.Errorf("revisions table mismatch: %w", err)
+	}
 
-	// Drop existing tables
-	_, err := db.Exec("DROP TABLE IF EXISTS requests")
+	// Check feedback table
+	feedbackQuery := `SELECT revision_id, rating, issues, created_at FROM feedback LIMIT 0`
+	_, err = dbExec(feedbackQuery)
 	if err != nil {
-		return fmt.Errorf("failed to drop requests table: %w", err)
+		return fmt.Errorf("feedback table mismatch: %w", err)
 	}
-	_, err = db.Exec("DROP TABLE IF EXISTS sessions")
+
+	// Check weather_snapshots table
+	snapshotsQuery := `SELECT id, request_id, provider, units, fetched_at, raw_json FROM weather_snapshots LIMIT 0`
+	_, err = dbExec(snapshotsQuery)
 	if err != nil {
-		return fmt.Errorf("failed to drop sessions table: %w", err)
+		return fmt.Errorf("weather_snapshots table mismatch: %w", err)
 	}
 
-	log.Println("Creating new tables with updated schema...")
+	// Check report_subscriptions table
+	subscriptionsQuery := `SELECT email, frequency, last_sent_at, created_at FROM report_subscriptions LIMIT 0`
+	_, err = dbExec(subscriptionsQuery)
+	if err != nil {
+		return fmt.Errorf("report_subscriptions table mismatch: %w", err)
+	}
+
+	// Check benchmark tables
+	benchmarksQuery := `SELECT id, request_id, prompt, intensity, seed, created_at FROM benchmarks LIMIT 0`
+	_, err = dbExec(benchmarksQuery)
+	if err != nil {
+		return fmt.Errorf("benchmarks table mismatch: %w", err)
+	}
+	benchmarkRunsQuery := `SELECT id, benchmark_id, model, status, prediction_id, duration_ms, predict_time,
+	                       cost, result_image_path, error_message, created_at, completed_at
+	                       FROM benchmark_runs LIMIT 0`
+	_, err = dbExec(benchmarkRunsQuery)
+	if err != nil {
+		return fmt.Errorf("benchmark_runs table mismatch: %w", err)
+	}
+
+	// Check request_events table
+	eventsQuery := `SELECT id, request_id, status, created_at FROM request_events LIMIT 0`
+	_, err = dbExec(eventsQuery)
+	if err != nil {
+		return fmt.Errorf("request_events table mismatch: %w", err)
+	}
+
+	// Check stage_timings table
+	timingsQuery := `SELECT id, request_id, revision_id, stage, duration_ms, created_at FROM stage_timings LIMIT 0`
+	_, err = dbExec(timingsQuery)
+	if err != nil {
+		return fmt.Errorf("stage_timings table mismatch: %w", err)
+	}
+
+	// Check presets table
+	presetsQuery := `SELECT slug, name, description, prompt, enabled, created_at FROM presets LIMIT 0`
+	_, err = dbExec(presetsQuery)
+	if err != nil {
+		return fmt.Errorf("presets table mismatch: %w", err)
+	}
+
+	// Check user_settings table
+	settingsQuery := `SELECT user_id, units, locale, default_location_id, email, model, preset, intensity, updated_at
+	                  FROM user_settings LIMIT 0`
+	_, err = dbExec(settingsQuery)
+	if err != nil {
+		return fmt.Errorf("user_settings table mismatch: %w", err)
+	}
+
+	// Check trial_generations table
+	trialQuery := `SELECT id, request_id, user_id, ip, created_at FROM trial_generations LIMIT 0`
+	_, err = dbExec(trialQuery)
+	if err != nil {
+		return fmt.Errorf("trial_generations table mismatch: %w", err)
+	}
+
+	// Check tags and request_tags tables
+	tagsQuery := `SELECT id, user_id, name FROM tags LIMIT 0`
+	_, err = dbExec(tagsQuery)
+	if err != nil {
+		return fmt.Errorf("tags table mismatch: %w", err)
+	}
+	requestTagsQuery := `SELECT request_id, tag_id FROM request_tags LIMIT 0`
+	_, err = dbExec(requestTagsQuery)
+	if err != nil {
+		return fmt.Errorf("request_tags table mismatch: %w", err)
+	}
+
+	// Check request_search full-text index
+	searchQuery := `SELECT request_id, location, prompt, tags FROM request_search LIMIT 0`
+	_, err = dbExec(searchQuery)
+	if err != nil {
+		return fmt.Errorf("request_search table mismatch: %w", err)
+	}
+
+	// Check locations table
+	locationTableQuery := `SELECT id, key, name, country, latitude, longitude, created_at FROM locations LIMIT 0`
+	_, err = dbExec(locationTableQuery)
+	if err != nil {
+		return fmt.Errorf("locations table mismatch: %w", err)
+	}
+
+	// Check erasures table
+	erasuresQuery := `SELECT user_id, requested_by, requested_at, completed_at, requests_deleted, files_deleted
+	                  FROM erasures LIMIT 0`
+	_, err = dbExec(erasuresQuery)
+	if err != nil {
+		return fmt.Errorf("erasures table mismatch: %w", err)
+	}
+
+	// Check data_exports table
+	exportsQuery := `SELECT id, user_id, status, path, size, error_message, created_at, completed_at, expires_at
+	                 FROM data_exports LIMIT 0`
+	_, err = dbExec(exportsQuery)
+	if err != nil {
+		return fmt.Errorf("data_exports table mismatch: %w", err)
+	}
+
+	// Check consents table
+	consentsQuery := `SELECT user_id, terms_version, accepted_at FROM consents LIMIT 0`
+	_, err = dbExec(consentsQuery)
+	if err != nil {
+		return fmt.Errorf("consents table mismatch: %w", err)
+	}
+
+	// Check blobs table
+	blobsQuery := `SELECT path, hash, size, refs, stored_at FROM blobs LIMIT 0`
+	_, err = dbExec(blobsQuery)
+	if err != nil {
+		return fmt.Errorf("blobs table mismatch: %w", err)
+	}
+
+	// Check schedules table
+	schedulesQuery := `SELECT id, user_id, source_request_id, run_date, run_at, uid, summary, status,
+	                   request_id, error_message, created_at FROM schedules LIMIT 0`
+	_, err = dbExec(schedulesQuery)
+	if err != nil {
+		return fmt.Errorf("schedules table mismatch: %w", err)
+	}
+
+	// Check calendar_feeds table
+	calendarFeedsQuery := `SELECT user_id, token, created_at FROM calendar_feeds LIMIT 0`
+	_, err = dbExec(calendarFeedsQuery)
+	if err != nil {
+		return fmt.Errorf("calendar_feeds table mismatch: %w", err)
+	}
+
+	// Check drafts table
+	draftsQuery := `SELECT user_id, fields, updated_at FROM drafts LIMIT 0`
+	_, err = dbExec(draftsQuery)
+	if err != nil {
+		return fmt.Errorf("drafts table mismatch: %w", err)
+	}
+
+	// Check analytics_events table
+	analyticsQuery := `SELECT id, name, user_id, request_id, properties, created_at FROM analytics_events LIMIT 0`
+	_, err = dbExec(analyticsQuery)
+	if err != nil {
+		return fmt.Errorf("analytics_events table mismatch: %w", err)
+	}
+
+	return nil
+}
 
-	// Create tables with current schema
-	schema := `
+// schema creates every table, index and trigger that's missing
+const schema = coreTables + erasuresTable + dataExportsTable + consentsTable + blobsTable +
+	schedulesTable + calendarFeedsTable + draftsTable + analyticsEventsTable
+
+// coreTables are the requests with their revisions, events and search index,
+// and the sessions, settings and admin records around them
+const coreTables = `
 	CREATE TABLE IF NOT EXISTS requests (
 		id TEXT PRIMARY KEY,
 		user_id TEXT NOT NULL,
 		location_input TEXT NOT NULL,
+		location_id INTEGER,
 		location_name TEXT,
 		country TEXT,
+		place_names TEXT,
+		place_language TEXT,
 		latitude REAL,
 		longitude REAL,
+		utc_offset INTEGER,
 			target_date TEXT NOT NULL,
+			end_date TEXT,
+			batch_id TEXT,
 			time_of_day TEXT,
+			units TEXT NOT NULL DEFAULT 'metric',
+			intensity TEXT NOT NULL DEFAULT 'natural',
+			preset TEXT,
+			preset_mode TEXT,
 			image_path TEXT NOT NULL,
+			upload_url TEXT,
+			upload_expires_at TEXT,
+			postcard INTEGER NOT NULL DEFAULT 0,
+		weather_source TEXT,
+		weather_condition_id INTEGER,
 		weather_condition TEXT,
 		weather_description TEXT,
 		temperature REAL,
@@ -101,12 +701,18 @@ func recreateTables() error {
 		clouds INTEGER,
 		wind_speed REAL,
 		visibility INTEGER,
-		precipitation TEXT,
+		rain_mm REAL,
+		snow_mm REAL,
+		caption TEXT,
 		ai_prompt TEXT,
+		prompt_variant TEXT,
 		prediction_id TEXT,
 		status TEXT NOT NULL DEFAULT 'pending',
+		error_code TEXT,
 		error_message TEXT,
 		result_image_path TEXT,
+		parent_request_id TEXT,
+		claimed_by TEXT,
 		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
 		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
 	);
@@ -114,183 +720,2669 @@ func recreateTables() error {
 	CREATE INDEX IF NOT EXISTS idx_user_id ON requests(user_id);
 	CREATE INDEX IF NOT EXISTS idx_status ON requests(status);
 	CREATE INDEX IF NOT EXISTS idx_prediction_id ON requests(prediction_id);
+	CREATE INDEX IF NOT EXISTS idx_parent_request_id ON requests(parent_request_id);
+	CREATE INDEX IF NOT EXISTS idx_batch_id ON requests(batch_id);
 
 	CREATE TABLE IF NOT EXISTS sessions (
 		session_id TEXT PRIMARY KEY,
+		is_admin INTEGER NOT NULL DEFAULT 0,
+		is_trial INTEGER NOT NULL DEFAULT 0,
 		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
 		expires_at DATETIME NOT NULL
 	);
 
 	CREATE INDEX IF NOT EXISTS idx_expires_at ON sessions(expires_at);
-	`
 
-	_, err = db.Exec(schema)
-	if err != nil {
-		return fmt.Errorf("failed to create tables: %w", err)
-	}
+	CREATE TABLE IF NOT EXISTS saved_locations (
+		id TEXT PRIMARY KEY,
+		user_id TEXT NOT NULL,
+		label TEXT NOT NULL,
+		location_name TEXT NOT NULL,
+		country TEXT,
+		latitude REAL NOT NULL,
+		longitude REAL NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
 
-	log.Println("Database schema updated successfully!")
-	return nil
-}
+	CREATE INDEX IF NOT EXISTS idx_saved_locations_user_id ON saved_locations(user_id);
 
-// Request represents a weather image editing request
-type Request struct {
-	ID                 string
-	UserID             string
-	LocationInput      string
-	LocationName       string
-	Country            string
-	Latitude           float64
-	Longitude          float64
-	TargetDate         string
-	TimeOfDay          string
-	ImagePath          string
-	WeatherCondition   string
-	WeatherDescription string
-	Temperature        float64
-	FeelsLike          float64
-	Humidity           int
-	Clouds             int
-	WindSpeed          float64
-	Visibility         int
-	Precipitation      string
-	AIPrompt           string
-	PredictionID       string
-	Status             string // pending, geocoding, weather_fetching, weather_fetched, confirmed, processing, completed, cancelled, error
-	ErrorMessage       string
-	ResultImagePath    string
-}
+	CREATE TABLE IF NOT EXISTS revisions (
+		id TEXT PRIMARY KEY,
+		request_id TEXT NOT NULL,
+		parent_revision_id TEXT,
+		kind TEXT NOT NULL,
+		prompt TEXT NOT NULL,
+		seed INTEGER,
+		intensity TEXT NOT NULL DEFAULT 'natural',
+		model TEXT,
+		prediction_id TEXT,
+		status TEXT NOT NULL DEFAULT 'processing',
+		error_code TEXT,
+		error_message TEXT,
+		result_image_path TEXT,
+		postcard_image_path TEXT,
+		public_url TEXT,
+		diff_score REAL,
+		face_score REAL,
+		is_primary INTEGER NOT NULL DEFAULT 0,
+		claimed_by TEXT,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		completed_at DATETIME
+	);
 
-// saveRequest saves a new request to the database
-func saveRequest(req *Request) error {
-	query := `INSERT INTO requests (id, user_id, location_input, target_date, time_of_day, image_path, status)
-	          VALUES (?, ?, ?, ?, ?, ?, ?)`
-	_, err := db.Exec(query, req.ID, req.UserID, req.LocationInput, req.TargetDate,
-		req.TimeOfDay, req.ImagePath, req.Status)
-	return err
-}
+	CREATE INDEX IF NOT EXISTS idx_revisions_request_id ON revisions(request_id);
 
-// updateRequestGeocode updates geocoding information for a request
-func updateRequestGeocode(id string, locationName, country string, lat, lon float64) error {
-	query := `UPDATE requests SET location_name = ?, country = ?, latitude = ?, longitude = ?, 
-	          status = 'geocoding', updated_at = CURRENT_TIMESTAMP WHERE id = ?`
-	_, err := db.Exec(query, locationName, country, lat, lon, id)
-	return err
-}
+	CREATE TABLE IF NOT EXISTS feedback (
+		revision_id TEXT PRIMARY KEY,
+		rating INTEGER NOT NULL,
+		issues TEXT,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
 
-// updateRequestWeather updates weather information for a request
-func updateRequestWeather(id string, weatherData *WeatherData, prompt string) error {
-	condition := weatherData.Condition
-	description := weatherData.Description
+	CREATE TABLE IF NOT EXISTS weather_snapshots (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		request_id TEXT NOT NULL,
+		provider TEXT NOT NULL,
+		units TEXT NOT NULL DEFAULT 'metric',
+		fetched_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		raw_json TEXT NOT NULL
+	);
 
-	precipitation := ""
-	if weatherData.Rain > 0 {
-		precipitation = fmt.Sprintf("Rain: %.1fmm", weatherData.Rain)
-	} else if weatherData.Snow > 0 {
-		precipitation = fmt.Sprintf("Snow: %.1fmm", weatherData.Snow)
-	}
+	CREATE INDEX IF NOT EXISTS idx_weather_snapshots_request_id ON weather_snapshots(request_id);
 
-	query := `UPDATE requests SET 
-	          weather_condition = ?, weather_description = ?, temperature = ?, 
-	          feels_like = ?, humidity = ?, clouds = ?, wind_speed = ?, 
-	          visibility = ?, precipitation = ?, ai_prompt = ?,
+	CREATE TABLE IF NOT EXISTS report_subscriptions (
+		email TEXT PRIMARY KEY,
+		frequency TEXT NOT NULL,
+		last_sent_at DATETIME,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE TABLE IF NOT EXISTS benchmarks (
+		id TEXT PRIMARY KEY,
+		request_id TEXT NOT NULL,
+		prompt TEXT NOT NULL,
+		intensity TEXT NOT NULL DEFAULT 'natural',
+		seed INTEGER NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE TABLE IF NOT EXISTS benchmark_runs (
+		id TEXT PRIMARY KEY,
+		benchmark_id TEXT NOT NULL,
+		model TEXT NOT NULL,
+		status TEXT NOT NULL DEFAULT 'processing',
+		prediction_id TEXT,
+		duration_ms INTEGER,
+		predict_time REAL,
+		cost REAL,
+		result_image_path TEXT,
+		error_message TEXT,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		completed_at DATETIME
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_benchmark_runs_benchmark_id ON benchmark_runs(benchmark_id);
+
+	CREATE TABLE IF NOT EXISTS request_events (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		request_id TEXT NOT NULL,
+		status TEXT NOT NULL,
+		created_at TEXT NOT NULL DEFAULT (strftime('%Y-%m-%d %H:%M:%f', 'now'))
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_request_events_request_id ON request_events(request_id);
+
+	-- Every status a request passes through is logged with millisecond
+	-- timestamps, so the time spent in each stage can be measured
+	CREATE TRIGGER IF NOT EXISTS request_created_event AFTER INSERT ON requests
+	BEGIN
+		INSERT INTO request_events (request_id, status) VALUES (NEW.id, NEW.status);
+	END;
+
+	CREATE TRIGGER IF NOT EXISTS request_status_event AFTER UPDATE OF status ON requests
+	WHEN NEW.status IS NOT OLD.status
+	BEGIN
+		INSERT INTO request_events (request_id, status) VALUES (NEW.id, NEW.status);
+	END;
+
+	-- Time spent on each pipeline stage, including the ones that don't change
+	-- the request's status like uploading and downloading
+	CREATE TABLE IF NOT EXISTS stage_timings (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		request_id TEXT NOT NULL,
+		revision_id TEXT,
+		stage TEXT NOT NULL,
+		duration_ms INTEGER NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_stage_timings_created_at ON stage_timings(created_at);
+
+	CREATE TABLE IF NOT EXISTS presets (
+		slug TEXT PRIMARY KEY,
+		name TEXT NOT NULL,
+		description TEXT,
+		prompt TEXT NOT NULL,
+		enabled INTEGER NOT NULL DEFAULT 1,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE TABLE IF NOT EXISTS user_settings (
+		user_id TEXT PRIMARY KEY,
+		units TEXT NOT NULL DEFAULT 'metric',
+		locale TEXT NOT NULL,
+		default_location_id TEXT,
+		email TEXT,
+		model TEXT,
+		preset TEXT,
+		intensity TEXT NOT NULL DEFAULT 'natural',
+		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+
+	-- Requests made by anonymous trial visitors, counted against the daily
+	-- trial limit per IP address and per user cookie
+	CREATE TABLE IF NOT EXISTS trial_generations (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		request_id TEXT NOT NULL UNIQUE,
+		user_id TEXT NOT NULL,
+		ip TEXT NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_trial_generations_created_at ON trial_generations(created_at);
+
+	-- Free-form tags each user attaches to their requests
+	CREATE TABLE IF NOT EXISTS tags (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id TEXT NOT NULL,
+		name TEXT NOT NULL,
+		UNIQUE(user_id, name)
+	);
+
+	CREATE TABLE IF NOT EXISTS request_tags (
+		request_id TEXT NOT NULL,
+		tag_id INTEGER NOT NULL,
+		PRIMARY KEY (request_id, tag_id)
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_request_tags_tag_id ON request_tags(tag_id);
+
+	-- Canonical places requests are resolved to, so differently typed names
+	-- of the same place ("oslo", "Oslo,NO") group together. key is the
+	-- case-folded name and country code; places sharing a key but far apart
+	-- get separate rows.
+	CREATE TABLE IF NOT EXISTS locations (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		key TEXT NOT NULL,
+		name TEXT NOT NULL,
+		country TEXT NOT NULL,
+		latitude REAL NOT NULL,
+		longitude REAL NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_locations_key ON locations(key);
+
+	-- Full-text index of each request's location, prompt and tags, kept up to
+	-- date by triggers. Diacritics are folded so "Zurich" finds "Zürich".
+	CREATE VIRTUAL TABLE IF NOT EXISTS request_search USING fts5(
+		request_id UNINDEXED,
+		location,
+		prompt,
+		tags,
+		tokenize = 'unicode61 remove_diacritics 2'
+	);
+
+	CREATE TRIGGER IF NOT EXISTS request_search_insert AFTER INSERT ON requests
+	BEGIN
+		INSERT INTO request_search (request_id, location, prompt, tags)
+		VALUES (NEW.id, NEW.location_input || ' ' || COALESCE(NEW.location_name, '') || ' ' || COALESCE(NEW.country, ''),
+		        COALESCE(NEW.ai_prompt, ''), '');
+	END;
+
+	CREATE TRIGGER IF NOT EXISTS request_search_update
+	AFTER UPDATE OF location_input, location_name, country, ai_prompt ON requests
+	BEGIN
+		UPDATE request_search
+		SET location = NEW.location_input || ' ' || COALESCE(NEW.location_name, '') || ' ' || COALESCE(NEW.country, ''),
+		    prompt = COALESCE(NEW.ai_prompt, '')
+		WHERE request_id = NEW.id;
+	END;
+
+	CREATE TRIGGER IF NOT EXISTS request_search_delete AFTER DELETE ON requests
+	BEGIN
+		DELETE FROM request_search WHERE request_id = OLD.id;
+	END;
+
+	CREATE TRIGGER IF NOT EXISTS request_search_tag_added AFTER INSERT ON request_tags
+	BEGIN
+		UPDATE request_search
+		SET tags = (SELECT COALESCE(group_concat(t.name, ' '), '') FROM request_tags rt
+		            JOIN tags t ON t.id = rt.tag_id WHERE rt.request_id = NEW.request_id)
+		WHERE request_id = NEW.request_id;
+	END;
+
+	CREATE TRIGGER IF NOT EXISTS request_search_tag_removed AFTER DELETE ON request_tags
+	BEGIN
+		UPDATE request_search
+		SET tags = (SELECT COALESCE(group_concat(t.name, ' '), '') FROM request_tags rt
+		            JOIN tags t ON t.id = rt.tag_id WHERE rt.request_id = OLD.request_id)
+		WHERE request_id = OLD.request_id;
+	END;
+`
+
+// recreateTables drops existing tables and creates new ones with current schema
+func recreateTables() error {
+	log.Println("Dropping old tables...")
+
+	// Drop existing tables
+	_, err := dbExec("DROP TABLE IF EXISTS requests")
+	if err != nil {
+		return fmt.Errorf("failed to drop requests table: %w", err)
+	}
+	_, err = dbExec("DROP TABLE IF EXISTS sessions")
+	if err != nil {
+		return fmt.Errorf("failed to drop sessions table: %w", err)
+	}
+	_, err = dbExec("DROP TABLE IF EXISTS saved_locations")
+	if err != nil {
+		return fmt.Errorf("failed to drop saved_locations table: %w", err)
+	}
+	_, err = dbExec("DROP TABLE IF EXISTS revisions")
+	if err != nil {
+		return fmt.Errorf("failed to drop revisions table: %w", err)
+	}
+	_, err = dbExec("DROP TABLE IF EXISTS feedback")
+	if err != nil {
+		return fmt.Errorf("failed to drop feedback table: %w", err)
+	}
+	_, err = dbExec("DROP TABLE IF EXISTS weather_snapshots")
+	if err != nil {
+		return fmt.Errorf("failed to drop weather_snapshots table: %w", err)
+	}
+	_, err = dbExec("DROP TABLE IF EXISTS report_subscriptions")
+	if err != nil {
+		return fmt.Errorf("failed to drop report_subscriptions table: %w", err)
+	}
+	_, err = dbExec("DROP TABLE IF EXISTS benchmarks")
+	if err != nil {
+		return fmt.Errorf("failed to drop benchmarks table: %w", err)
+	}
+	_, err = dbExec("DROP TABLE IF EXISTS benchmark_runs")
+	if err != nil {
+		return fmt.Errorf("failed to drop benchmark_runs table: %w", err)
+	}
+	_, err = dbExec("DROP TABLE IF EXISTS request_events")
+	if err != nil {
+		return fmt.Errorf("failed to drop request_events table: %w", err)
+	}
+	_, err = dbExec("DROP TABLE IF EXISTS stage_timings")
+	if err != nil {
+		return fmt.Errorf("failed to drop stage_timings table: %w", err)
+	}
+	_, err = dbExec("DROP TABLE IF EXISTS presets")
+	if err != nil {
+		return fmt.Errorf("failed to drop presets table: %w", err)
+	}
+	_, err = dbExec("DROP TABLE IF EXISTS user_settings")
+	if err != nil {
+		return fmt.Errorf("failed to drop user_settings table: %w", err)
+	}
+	_, err = dbExec("DROP TABLE IF EXISTS trial_generations")
+	if err != nil {
+		return fmt.Errorf("failed to drop trial_generations table: %w", err)
+	}
+	_, err = dbExec("DROP TABLE IF EXISTS tags")
+	if err != nil {
+		return fmt.Errorf("failed to drop tags table: %w", err)
+	}
+	_, err = dbExec("DROP TABLE IF EXISTS request_tags")
+	if err != nil {
+		return fmt.Errorf("failed to drop request_tags table: %w", err)
+	}
+	_, err = dbExec("DROP TABLE IF EXISTS request_search")
+	if err != nil {
+		return fmt.Errorf("failed to drop request_search table: %w", err)
+	}
+	_, err = dbExec("DROP TABLE IF EXISTS locations")
+	if err != nil {
+		return fmt.Errorf("failed to drop locations table: %w", err)
+	}
+	_, err = dbExec("DROP TABLE IF EXISTS erasures")
+	if err != nil {
+		return fmt.Errorf("failed to drop erasures table: %w", err)
+	}
+	_, err = dbExec("DROP TABLE IF EXISTS data_exports")
+	if err != nil {
+		return fmt.Errorf("failed to drop data_exports table: %w", err)
+	}
+	_, err = dbExec("DROP TABLE IF EXISTS consents")
+	if err != nil {
+		return fmt.Errorf("failed to drop consents table: %w", err)
+	}
+	_, err = dbExec("DROP TABLE IF EXISTS blobs")
+	if err != nil {
+		return fmt.Errorf("failed to drop blobs table: %w", err)
+	}
+	_, err = dbExec("DROP TABLE IF EXISTS schedules")
+	if err != nil {
+		return fmt.Errorf("failed to drop schedules table: %w", err)
+	}
+	_, err = dbExec("DROP TABLE IF EXISTS calendar_feeds")
+	if err != nil {
+		return fmt.Errorf("failed to drop calendar_feeds table: %w", err)
+	}
+	_, err = dbExec("DROP TABLE IF EXISTS drafts")
+	if err != nil {
+		return fmt.Errorf("failed to drop drafts table: %w", err)
+	}
+	_, err = dbExec("DROP TABLE IF EXISTS analytics_events")
+	if err != nil {
+		return fmt.Errorf("failed to drop analytics_events table: %w", err)
+	}
+
+	log.Println("Creating new tables with updated schema...")
+
+	_, err = dbExec(schema)
+	if err != nil {
+		return fmt.Errorf("failed to create tables: %w", err)
+	}
+
+	for i := range builtinPresets {
+		if err := savePreset(&builtinPresets[i]); err != nil {
+			return fmt.Errorf("failed to seed presets: %w", err)
+		}
+	}
+
+	log.Println("Database schema updated successfully!")
+	return nil
+}
+
+// Request represents a weather image editing request
+type Request struct {
+	ID                 string
+	UserID             string
+	LocationInput      string
+	LocationID         int64 // canonical place in locations, 0 until geocoded
+	LocationName       string
+	PlaceNames         map[string]string // name variants of the place by language, see placeNames
+	PlaceLanguage      string            // language of the variant the user picked, empty for LocationName
+	Country            string
+	Latitude           float64
+	Longitude          float64
+	UTCOffset          int // location's offset from UTC in seconds; TargetDate is a local date there
+	TargetDate         string
+	EndDate            string // last day of a date range summarized into one image, empty for a single day
+	BatchID            string // set on each request of a one-image-per-day batch
+	TimeOfDay          string
+	Units              string // unitsMetric or unitsImperial; temperature and wind speed are stored in these
+	Intensity          string // how strong the first generation's weather is, see intensityLevels
+	Preset             string // slug of a preset scenario, if one was picked
+	PresetMode         string // presetModeReplace or presetModeBlend when Preset is set
+	ImagePath          string
+	UploadURL          string // Replicate file URL of the photo, once uploaded
+	UploadExpiresAt    string // when Replicate deletes the upload, UTC
+	Postcard           bool   // also compose each result into a postcard
+	WeatherSource      string // weatherProvider* the weather came from, empty when a preset replaced it
+	WeatherConditionID int
+	WeatherCondition   string
+	WeatherDescription string
+	Temperature        float64
+	FeelsLike          float64
+	Humidity           int
+	Clouds             int
+	WindSpeed          float64
+	Visibility         int
+	RainMM             float64 // average rain per hour of the day, mm
+	SnowMM             float64 // average snow per hour of the day, mm
+	Caption            string  // what the uploaded photo shows, from CAPTION_MODEL
+	AIPrompt           string
+	PromptVariant      string
+	PredictionID       string
+	Status             string // pending, geocoding, weather_fetching, weather_fetched, confirmed, processing, completed, cancelled, error
+	ErrorCode          string // see errorCode* constants
+	ErrorMessage       string
+	ResultImagePath    string
+	ParentRequestID    string
+	CreatedAt          string
+}
+
+// saveRequest saves a new request to the database, claimed by this instance
+func saveRequest(req *Request) error {
+	query := `INSERT INTO requests (id, user_id, location_input, target_date, end_date, batch_id,
+	          time_of_day, units, intensity, preset, preset_mode, image_path, postcard, status, claimed_by)
+	          VALUES (?, ?, ?, ?, NULLIF(?, ''), NULLIF(?, ''), ?, ?, ?, NULLIF(?, ''), NULLIF(?, ''), ?, ?, ?, ?)`
+	_, err := dbExec(query, req.ID, req.UserID, req.LocationInput, req.TargetDate, req.EndDate, req.BatchID,
+		req.TimeOfDay, req.Units, req.Intensity, req.Preset, req.PresetMode, req.ImagePath, req.Postcard, req.Status, instanceID)
+	return err
+}
+
+// updateRequestGeocode updates geocoding information and the location's UTC
+// offset for a request. The name and country are the canonical location's;
+// names are the place's name variants, of which language is shown.
+func updateRequestGeocode(id string, loc *Location, lat, lon float64, utcOffset int,
+	names map[string]string, language string) error {
+	encoded, err := json.Marshal(names)
+	if err != nil {
+		return err
+	}
+	query := `UPDATE requests SET location_id = ?, location_name = ?, country = ?, place_names = ?,
+	          place_language = NULLIF(?, ''), latitude = ?, longitude = ?, utc_offset = ?,
+	          status = 'geocoding', updated_at = CURRENT_TIMESTAMP WHERE id = ?`
+	_, err = dbExec(query, loc.ID, loc.Name, loc.Country, string(encoded), language, lat, lon, utcOffset, id)
+	return err
+}
+
+// setRequestPlaceLanguage switches the name variant a request's place is
+// shown with, along with the prompt regenerated with it
+func setRequestPlaceLanguage(id, language, prompt string) error {
+	query := `UPDATE requests SET place_language = NULLIF(?, ''), ai_prompt = ?,
+	          updated_at = CURRENT_TIMESTAMP WHERE id = ?`
+	_, err := dbExec(query, language, prompt, id)
+	return err
+}
+
+// errRequestConfirmed is returned when a request's prompt can't change
+// because the request was confirmed, and its prompt is in use
+var errRequestConfirmed = errors.New("request was already confirmed")
+
+// setRequestPrompt replaces the prompt of a request awaiting confirmation,
+// along with the choices it was regenerated with
+func setRequestPrompt(id, prompt, variant, intensity, timeOfDay string) error {
+	query := `UPDATE requests SET ai_prompt = ?, prompt_variant = ?, intensity = ?, time_of_day = ?,
+	          updated_at = CURRENT_TIMESTAMP WHERE id = ? AND status = 'weather_fetched'`
+	result, err := dbExec(query, prompt, variant, intensity, timeOfDay, id)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return errRequestConfirmed
+	}
+	return nil
+}
+
+// updateRequestWeather updates weather information and the generated prompt for a request
+func updateRequestWeather(id string, weatherData *WeatherData, prompt, promptVariant string) error {
+	condition := weatherData.Condition
+	description := weatherData.Description
+
+	query := `UPDATE requests SET weather_source = NULLIF(?, ''),
+	          weather_condition_id = ?, weather_condition = ?, weather_description = ?, temperature = ?, 
+	          feels_like = ?, humidity = ?, clouds = ?, wind_speed = ?, 
+	          visibility = ?, rain_mm = ?, snow_mm = ?, ai_prompt = ?, prompt_variant = ?,
 	          status = 'weather_fetched', updated_at = CURRENT_TIMESTAMP 
 	          WHERE id = ?`
 
-	_, err := db.Exec(query, condition, description, weatherData.Temp, weatherData.FeelsLike,
-		weatherData.Humidity, weatherData.Clouds, weatherData.WindSpeed, weatherData.Visibility, precipitation,
-		prompt, id)
+	_, err := dbExec(query, weatherData.Provider, weatherData.ConditionID, condition, description, weatherData.Temp, weatherData.FeelsLike,
+		weatherData.Humidity, weatherData.Clouds, weatherData.WindSpeed, weatherData.Visibility, weatherData.Rain, weatherData.Snow,
+		prompt, promptVariant, id)
+	return err
+}
+
+// updateRequestUploadURL stores where the request's photo was uploaded to
+// Replicate and until when, so generations can reuse the upload
+func updateRequestUploadURL(id, uploadURL string, expiresAt time.Time) error {
+	query := `UPDATE requests SET upload_url = ?, upload_expires_at = ?, updated_at = CURRENT_TIMESTAMP
+	          WHERE id = ?`
+	_, err := dbExec(query, uploadURL, sqliteTime(expiresAt), id)
+	return err
+}
+
+// updateRequestCaption stores the caption of a request's uploaded photo
+func updateRequestCaption(id, caption string) error {
+	query := `UPDATE requests SET caption = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?`
+	_, err := dbExec(query, caption, id)
 	return err
 }
 
-// updateRequestError updates error status for a request
-func updateRequestError(id, errorMsg string) error {
-	query := `UPDATE requests SET status = 'error', error_message = ?, 
+// updateRequestError updates error status for a request, storing the
+// classified error code alongside the detailed message
+func updateRequestError(id string, failure error) error {
+	query := `UPDATE requests SET status = 'error', error_code = ?, error_message = ?, 
 	          updated_at = CURRENT_TIMESTAMP WHERE id = ?`
-	_, err := db.Exec(query, errorMsg, id)
+	_, err := dbExec(query, errorCode(failure), failure.Error(), id)
+	return err
+}
+
+// workClaim is a request or revision and the instance working on it
+type workClaim struct {
+	ID        string
+	ClaimedBy string // instance ID, empty for work from before instances were tracked
+}
+
+// getRequestClaimsWithStatus lists the requests currently in one of the
+// statuses along with the instance working on each
+func getRequestClaimsWithStatus(statuses ...string) ([]workClaim, error) {
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(statuses)), ", ")
+	args := make([]interface{}, len(statuses))
+	for i, status := range statuses {
+		args[i] = status
+	}
+	rows, err := dbQuery(`SELECT id, COALESCE(claimed_by, '') FROM requests WHERE status IN (`+placeholders+`)`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var claims []workClaim
+	for rows.Next() {
+		var claim workClaim
+		if err := rows.Scan(&claim.ID, &claim.ClaimedBy); err != nil {
+			return nil, err
+		}
+		claims = append(claims, claim)
+	}
+	return claims, rows.Err()
+}
+
+// setRequestClaim records the instance working on a request
+func setRequestClaim(id, owner string) error {
+	_, err := dbExec(`UPDATE requests SET claimed_by = ? WHERE id = ?`, owner, id)
 	return err
 }
 
+// claimRequest hands an unfinished request over to instance owner, provided
+// it's still claimed by from. It reports false when another instance claimed
+// it first, so each request is taken over at most once.
+func claimRequest(id, from, owner string) (bool, error) {
+	result, err := dbExec(`UPDATE requests SET claimed_by = ? WHERE id = ? AND COALESCE(claimed_by, '') = ?`,
+		owner, id, from)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n == 1, err
+}
+
 // updateRequestPredictionID updates the Replicate prediction ID for a request
 func updateRequestPredictionID(id, predictionID string) error {
 	query := `UPDATE requests SET prediction_id = ?, status = 'processing',
 	          updated_at = CURRENT_TIMESTAMP WHERE id = ?`
-	_, err := db.Exec(query, predictionID, id)
+	_, err := dbExec(query, predictionID, id)
 	return err
 }
 
 // updateRequestStatus updates the status of a request
 func updateRequestStatus(id, status string) error {
 	query := `UPDATE requests SET status = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?`
-	_, err := db.Exec(query, status, id)
+	_, err := dbExec(query, status, id)
 	return err
 }
 
-// updateRequestResult updates the result image path and marks as completed
-func updateRequestResult(id, resultPath string) error {
-	query := `UPDATE requests SET result_image_path = ?, status = 'completed', 
-	          updated_at = CURRENT_TIMESTAMP WHERE id = ?`
-	_, err := db.Exec(query, resultPath, id)
-	return err
+// setRequestsImagePath replaces the photo of requests, as a review edit does
+func setRequestsImagePath(ids []string, path string) error {
+	tx, err := dbBegin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `UPDATE requests SET image_path = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?`
+	for _, id := range ids {
+		if _, err := tx.Exec(query, path, id); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
 }
 
-// getRequest retrieves a request by ID
-func getRequest(id string) (*Request, error) {
-	query := `SELECT id, user_id, location_input, 
-	          COALESCE(location_name, ''), COALESCE(country, ''),
-	          COALESCE(latitude, 0), COALESCE(longitude, 0),
-	          target_date, COALESCE(time_of_day, ''), image_path, 
-	          COALESCE(weather_condition, ''), COALESCE(weather_description, ''),
-	          COALESCE(temperature, 0), COALESCE(feels_like, 0),
+// requestColumns is the column list shared by queries that load full requests
+const requestColumns = `id, user_id, location_input, COALESCE(location_id, 0),
+	          COALESCE(location_name, ''), COALESCE(place_names, ''), COALESCE(place_language, ''), COALESCE(country, ''),
+	          COALESCE(latitude, 0), COALESCE(longitude, 0), COALESCE(utc_offset, 0),
+	          target_date, COALESCE(end_date, ''), COALESCE(batch_id, ''), COALESCE(time_of_day, ''), units, intensity,
+	          COALESCE(preset, ''), COALESCE(preset_mode, ''), image_path, COALESCE(upload_url, ''), COALESCE(upload_expires_at, ''), postcard,
+	          COALESCE(weather_source, ''), COALESCE(weather_condition_id, 0), COALESCE(weather_condition, ''),
+	          COALESCE(weather_description, ''), COALESCE(temperature, 0), COALESCE(feels_like, 0),
 	          COALESCE(humidity, 0), COALESCE(clouds, 0),
 	          COALESCE(wind_speed, 0), COALESCE(visibility, 0),
-	          COALESCE(precipitation, ''), COALESCE(ai_prompt, ''),
+	          COALESCE(rain_mm, 0), COALESCE(snow_mm, 0), COALESCE(caption, ''), COALESCE(ai_prompt, ''), COALESCE(prompt_variant, ''),
 	          COALESCE(prediction_id, ''),
-	          status, COALESCE(error_message, ''), COALESCE(result_image_path, '')
-	          FROM requests WHERE id = ?`
+	          status, COALESCE(error_code, ''), COALESCE(error_message, ''), COALESCE(result_image_path, ''),
+	          COALESCE(parent_request_id, ''), COALESCE(created_at, '')`
 
+// rowScanner is implemented by both *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanRequest scans a row selected with requestColumns into a Request
+func scanRequest(row rowScanner) (*Request, error) {
 	req := &Request{}
-	err := db.QueryRow(query, id).Scan(
-		&req.ID, &req.UserID, &req.LocationInput,
-		&req.LocationName, &req.Country, &req.Latitude, &req.Longitude,
-		&req.TargetDate, &req.TimeOfDay, &req.ImagePath,
-		&req.WeatherCondition, &req.WeatherDescription,
+	var placeNames string
+	err := row.Scan(
+		&req.ID, &req.UserID, &req.LocationInput, &req.LocationID,
+		&req.LocationName, &placeNames, &req.PlaceLanguage, &req.Country, &req.Latitude, &req.Longitude, &req.UTCOffset,
+		&req.TargetDate, &req.EndDate, &req.BatchID, &req.TimeOfDay, &req.Units, &req.Intensity,
+		&req.Preset, &req.PresetMode, &req.ImagePath, &req.UploadURL, &req.UploadExpiresAt, &req.Postcard,
+		&req.WeatherSource, &req.WeatherConditionID, &req.WeatherCondition, &req.WeatherDescription,
 		&req.Temperature, &req.FeelsLike, &req.Humidity, &req.Clouds,
-		&req.WindSpeed, &req.Visibility, &req.Precipitation, &req.AIPrompt,
+		&req.WindSpeed, &req.Visibility, &req.RainMM, &req.SnowMM, &req.Caption, &req.AIPrompt, &req.PromptVariant,
 		&req.PredictionID,
-		&req.Status, &req.ErrorMessage, &req.ResultImagePath,
+		&req.Status, &req.ErrorCode, &req.ErrorMessage, &req.ResultImagePath,
+		&req.ParentRequestID, &req.CreatedAt,
 	)
 	if err != nil {
 		return nil, err
 	}
+	if placeNames != "" {
+		if err := json.Unmarshal([]byte(placeNames), &req.PlaceNames); err != nil {
+			log.Printf("Ignoring invalid place names of request %s: %v", req.ID, err)
+		}
+	}
 	return req, nil
 }
 
+// getRequest retrieves a request by ID
+func getRequest(id string) (*Request, error) {
+	query := `SELECT ` + requestColumns + ` FROM requests WHERE id = ?`
+	return scanRequest(dbQueryRow(query, id))
+}
+
+// getRecentRequests retrieves the most recent requests for a user
+func getRecentRequests(userID string, limit int) ([]*Request, error) {
+	query := `SELECT ` + requestColumns + ` FROM requests
+	          WHERE user_id = ? ORDER BY created_at DESC LIMIT ?`
+	rows, err := dbQuery(query, userID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var requests []*Request
+	for rows.Next() {
+		req, err := scanRequest(rows)
+		if err != nil {
+			return nil, err
+		}
+		requests = append(requests, req)
+	}
+	return requests, rows.Err()
+}
+
+// getBatchRequests retrieves the requests of a one-image-per-day batch in date order
+func getBatchRequests(userID, batchID string) ([]*Request, error) {
+	query := `SELECT ` + requestColumns + ` FROM requests
+	          WHERE user_id = ? AND batch_id = ? ORDER BY target_date`
+	rows, err := dbQuery(query, userID, batchID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var requests []*Request
+	for rows.Next() {
+		req, err := scanRequest(rows)
+		if err != nil {
+			return nil, err
+		}
+		requests = append(requests, req)
+	}
+	return requests, rows.Err()
+}
+
+// cloneRequest saves clone, a copy of the request parentID with some fields
+// changed, as a new pending request reusing the parent's uploaded photo,
+// claimed by this instance like saveRequest's
+func cloneRequest(clone *Request, parentID string) error {
+	query := `INSERT INTO requests (id, user_id, location_input, location_name, country,
+	          latitude, longitude, target_date, end_date, time_of_day, units, intensity, preset, preset_mode,
+	          image_path, upload_url, upload_expires_at, postcard, status, parent_request_id, claimed_by)
+	          VALUES (?, ?, ?, NULLIF(?, ''), NULLIF(?, ''), ?, ?, ?, NULLIF(?, ''), ?, ?, ?, NULLIF(?, ''), NULLIF(?, ''),
+	          ?, NULLIF(?, ''), NULLIF(?, ''), ?, 'pending', ?, ?)`
+	_, err := dbExec(query, clone.ID, clone.UserID, clone.LocationInput, clone.LocationName,
+		clone.Country, clone.Latitude, clone.Longitude, clone.TargetDate, clone.EndDate, clone.TimeOfDay,
+		clone.Units, clone.Intensity, clone.Preset, clone.PresetMode, clone.ImagePath,
+		clone.UploadURL, clone.UploadExpiresAt, clone.Postcard, parentID, instanceID)
+	return err
+}
+
 // Session management functions
 
-// createSession creates a new session with 24-hour expiration
-func createSession(sessionID string) error {
-	query := `INSERT INTO sessions (session_id, expires_at) 
-	          VALUES (?, datetime('now', '+24 hours'))`
-	_, err := db.Exec(query, sessionID)
+// createSession stores a new session of a kind, expiring after ttl
+func createSession(sessionID string, kind sessionKind, ttl time.Duration) error {
+	query := `INSERT INTO sessions (session_id, is_admin, is_trial, expires_at)
+	          VALUES (?, ?, ?, datetime('now', ?))`
+	_, err := dbExec(query, sessionID, kind == sessionAdmin, kind == sessionTrial,
+		fmt.Sprintf("+%d seconds", int(ttl.Seconds())))
 	return err
 }
 
-// isValidSession checks if a session exists and hasn't expired
-func isValidSession(sessionID string) bool {
-	query := `SELECT COUNT(*) FROM sessions 
+// getSessionKind looks up what an unexpired session grants
+func getSessionKind(sessionID string) (sessionKind, error) {
+	query := `SELECT is_admin, is_trial FROM sessions
 	          WHERE session_id = ? AND expires_at > datetime('now')`
-	var count int
-	err := db.QueryRow(query, sessionID).Scan(&count)
-	if err != nil {
-		return false
+	var isAdmin, isTrial bool
+	if err := dbQueryRow(query, sessionID).Scan(&isAdmin, &isTrial); err != nil {
+		return "", err
+	}
+	switch {
+	case isAdmin:
+		return sessionAdmin, nil
+	case isTrial:
+		return sessionTrial, nil
 	}
-	return count > 0
+	return sessionFull, nil
+}
+
+// deleteSession ends a session before it expires
+func deleteSession(sessionID string) error {
+	_, err := dbExec(`DELETE FROM sessions WHERE session_id = ?`, sessionID)
+	return err
 }
 
 // cleanupExpiredSessions removes expired sessions from database
 func cleanupExpiredSessions() error {
 	query := `DELETE FROM sessions WHERE expires_at <= datetime('now')`
-	_, err := db.Exec(query)
+	_, err := dbExec(query)
+	return err
+}
+
+// Saved location functions
+
+// SavedLocation represents a named location a user has saved for reuse
+type SavedLocation struct {
+	ID           string
+	UserID       string
+	Label        string
+	LocationName string
+	Country      string
+	Latitude     float64
+	Longitude    float64
+}
+
+// createSavedLocation saves a named location for a user
+func createSavedLocation(loc *SavedLocation) error {
+	query := `INSERT INTO saved_locations (id, user_id, label, location_name, country, latitude, longitude)
+	          VALUES (?, ?, ?, ?, ?, ?, ?)`
+	_, err := dbExec(query, loc.ID, loc.UserID, loc.Label, loc.LocationName, loc.Country,
+		loc.Latitude, loc.Longitude)
+	return err
+}
+
+// getSavedLocations retrieves all saved locations for a user ordered by label
+func getSavedLocations(userID string) ([]SavedLocation, error) {
+	query := `SELECT id, user_id, label, location_name, COALESCE(country, ''), latitude, longitude
+	          FROM saved_locations WHERE user_id = ? ORDER BY label COLLATE NOCASE`
+	rows, err := dbQuery(query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var locations []SavedLocation
+	for rows.Next() {
+		var loc SavedLocation
+		if err := rows.Scan(&loc.ID, &loc.UserID, &loc.Label, &loc.LocationName, &loc.Country,
+			&loc.Latitude, &loc.Longitude); err != nil {
+			return nil, err
+		}
+		locations = append(locations, loc)
+	}
+	return locations, rows.Err()
+}
+
+// deleteSavedLocation removes a saved location owned by the given user
+func deleteSavedLocation(id, userID string) error {
+	query := `DELETE FROM saved_locations WHERE id = ? AND user_id = ?`
+	_, err := dbExec(query, id, userID)
+	return err
+}
+
+// Weather snapshot functions
+
+// WeatherSnapshot is a raw weather provider response stored for a request
+type WeatherSnapshot struct {
+	ID        int64
+	RequestID string
+	Provider  string
+	Units     string
+	FetchedAt string
+	RawJSON   string
+}
+
+// saveWeatherSnapshot stores the raw weather response fetched for a request.
+// Snapshots are never updated; fetching again adds a new one.
+func saveWeatherSnapshot(requestID string, weatherData *WeatherData) error {
+	query := `INSERT INTO weather_snapshots (request_id, provider, units, raw_json) VALUES (?, ?, ?, ?)`
+	_, err := dbExec(query, requestID, weatherData.Provider, weatherData.Units, string(weatherData.Raw))
+	return err
+}
+
+// getLatestWeatherSnapshots retrieves the most recent n weather snapshots of
+// a request, oldest first. A date range stores one snapshot per day.
+func getLatestWeatherSnapshots(requestID string, n int) ([]*WeatherSnapshot, error) {
+	query := `SELECT id, request_id, provider, units, fetched_at, raw_json FROM (
+	          SELECT * FROM weather_snapshots WHERE request_id = ? ORDER BY id DESC LIMIT ?
+	          ) ORDER BY id`
+	rows, err := dbQuery(query, requestID, n)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var snapshots []*WeatherSnapshot
+	for rows.Next() {
+		snapshot := &WeatherSnapshot{}
+		if err := rows.Scan(&snapshot.ID, &snapshot.RequestID, &snapshot.Provider,
+			&snapshot.Units, &snapshot.FetchedAt, &snapshot.RawJSON); err != nil {
+			return nil, err
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(snapshots) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return snapshots, nil
+}
+
+// countWeatherSnapshots returns how many times weather was fetched for a request
+func countWeatherSnapshots(requestID string) int {
+	var count int
+	dbQueryRow(`SELECT COUNT(*) FROM weather_snapshots WHERE request_id = ?`, requestID).Scan(&count)
+	return count
+}
+
+// Revision functions
+
+// Revision kinds
+const (
+	revisionInitial = "initial" // first generation after confirming the weather
+	revisionRetry   = "retry"   // re-run of a low-rated result with a new seed
+	revisionEdit    = "edit"    // re-run with a prompt edited by the user
+	revisionAuto    = "auto"    // automatic re-run of a result that changed too little or too much
+)
+
+// Revision is one generation of a request's result. A request can have many
+// revisions; the primary one is what /image/{id} serves.
+type Revision struct {
+	ID               string
+	RequestID        string
+	ParentRevisionID string
+	Kind             string
+	Prompt           string
+	Seed             int    // model seed, 0 lets the model pick one
+	Intensity        string // see intensityLevels
+	Model            string // Replicate model the revision is generated with
+	PredictionID     string
+	Status           string // processing, completed, cancelled, error
+	ErrorCode        string
+	ErrorMessage     string
+	ResultImagePath  string
+	PostcardPath     string  // the result composed into a postcard, when its request asked for one
+	PublicURL        string  // CDN URL of the published result, empty if not published
+	DiffScore        float64 // difference from the original, see imageDifference; negative if unknown
+	FaceScore        float64 // largest change to a face, see faceDifference; negative if unknown
+	IsPrimary        bool
+	ClaimedBy        string // instance working on the revision while it's processing
+	CreatedAt        string
+}
+
+// createRevision saves a new revision, claimed by this instance, and puts its
+// request back into processing
+func createRevision(rev *Revision) error {
+	tx, err := dbBegin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `INSERT INTO revisions (id, request_id, parent_revision_id, kind, prompt, seed, intensity, model, claimed_by)
+	          VALUES (?, ?, NULLIF(?, ''), ?, ?, ?, ?, ?, ?)`
+	if _, err := tx.Exec(query, rev.ID, rev.RequestID, rev.ParentRevisionID, rev.Kind,
+		rev.Prompt, rev.Seed, rev.Intensity, rev.Model, instanceID); err != nil {
+		return err
+	}
+
+	query = `UPDATE requests SET status = 'confirmed', updated_at = CURRENT_TIMESTAMP WHERE id = ?`
+	if _, err := tx.Exec(query, rev.RequestID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// revisionColumns is the column list shared by queries that load revisions
+const revisionColumns = `id, request_id, COALESCE(parent_revision_id, ''), kind, prompt,
+	          COALESCE(seed, 0), intensity, COALESCE(model, ''), COALESCE(prediction_id, ''), status,
+	          COALESCE(error_code, ''), COALESCE(error_message, ''),
+	          COALESCE(result_image_path, ''), COALESCE(postcard_image_path, ''), COALESCE(public_url, ''),
+	          COALESCE(diff_score, -1), COALESCE(face_score, -1), is_primary,
+	          COALESCE(claimed_by, ''), COALESCE(created_at, '')`
+
+// scanRevision scans a row selected with revisionColumns into a Revision
+func scanRevision(row rowScanner) (*Revision, error) {
+	rev := &Revision{}
+	err := row.Scan(&rev.ID, &rev.RequestID, &rev.ParentRevisionID, &rev.Kind, &rev.Prompt,
+		&rev.Seed, &rev.Intensity, &rev.Model, &rev.PredictionID, &rev.Status, &rev.ErrorCode, &rev.ErrorMessage,
+		&rev.ResultImagePath, &rev.PostcardPath, &rev.PublicURL, &rev.DiffScore, &rev.FaceScore, &rev.IsPrimary, &rev.ClaimedBy, &rev.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return rev, nil
+}
+
+// getRevision retrieves a revision by ID
+func getRevision(id string) (*Revision, error) {
+	query := `SELECT ` + revisionColumns + ` FROM revisions WHERE id = ?`
+	return scanRevision(dbQueryRow(query, id))
+}
+
+// getRevisions retrieves all revisions of a request, oldest first
+func getRevisions(requestID string) ([]*Revision, error) {
+	query := `SELECT ` + revisionColumns + ` FROM revisions
+	          WHERE request_id = ? ORDER BY created_at, rowid`
+	rows, err := dbQuery(query, requestID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var revisions []*Revision
+	for rows.Next() {
+		rev, err := scanRevision(rows)
+		if err != nil {
+			return nil, err
+		}
+		revisions = append(revisions, rev)
+	}
+	return revisions, rows.Err()
+}
+
+// getPrimaryRevision retrieves the revision a request currently shows
+func getPrimaryRevision(requestID string) (*Revision, error) {
+	query := `SELECT ` + revisionColumns + ` FROM revisions WHERE request_id = ? AND is_primary = 1`
+	return scanRevision(dbQueryRow(query, requestID))
+}
+
+// getLatestRevision retrieves the most recently started revision of a request
+func getLatestRevision(requestID string) (*Revision, error) {
+	query := `SELECT ` + revisionColumns + ` FROM revisions
+	          WHERE request_id = ? ORDER BY created_at DESC, rowid DESC LIMIT 1`
+	return scanRevision(dbQueryRow(query, requestID))
+}
+
+// getNewestResult retrieves the shown revision of whichever of a request
+// and its re-runs, theirs included, completed last
+func getNewestResult(requestID string) (*Revision, error) {
+	query := `WITH RECURSIVE family(id) AS (
+	              SELECT id FROM requests WHERE id = ?
+	              UNION SELECT r.id FROM requests r JOIN family f ON r.parent_request_id = f.id
+	          )
+	          SELECT ` + revisionColumns + ` FROM revisions
+	          WHERE request_id IN family AND is_primary = 1 AND status = 'completed'
+	          AND result_image_path IS NOT NULL
+	          ORDER BY completed_at DESC, rowid DESC LIMIT 1`
+	return scanRevision(dbQueryRow(query, requestID))
+}
+
+// getProcessingRevisions retrieves every revision that hasn't finished, oldest first
+func getProcessingRevisions() ([]*Revision, error) {
+	query := `SELECT ` + revisionColumns + ` FROM revisions
+	          WHERE status = 'processing' ORDER BY created_at, rowid`
+	rows, err := dbQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var revisions []*Revision
+	for rows.Next() {
+		rev, err := scanRevision(rows)
+		if err != nil {
+			return nil, err
+		}
+		revisions = append(revisions, rev)
+	}
+	return revisions, rows.Err()
+}
+
+// claimRevision hands a processing revision over to instance owner, provided
+// it's still claimed by from, so two instances never poll one prediction
+func claimRevision(id, from, owner string) (bool, error) {
+	result, err := dbExec(`UPDATE revisions SET claimed_by = ?
+	                       WHERE id = ? AND status = 'processing' AND COALESCE(claimed_by, '') = ?`,
+		owner, id, from)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n == 1, err
+}
+
+// updateRevisionPredictionID records the Replicate prediction for a revision
+// and marks its request as processing
+func updateRevisionPredictionID(rev *Revision, predictionID string) error {
+	rev.PredictionID = predictionID
+	if _, err := dbExec(`UPDATE revisions SET prediction_id = ? WHERE id = ?`, predictionID, rev.ID); err != nil {
+		return err
+	}
+	return updateRequestPredictionID(rev.RequestID, predictionID)
+}
+
+// completeRevision stores a revision's result and makes it the request's
+// primary revision
+func completeRevision(rev *Revision, resultPath string) error {
+	query := `UPDATE revisions SET result_image_path = ?, status = 'completed',
+	          completed_at = CURRENT_TIMESTAMP WHERE id = ?`
+	if _, err := dbExec(query, resultPath, rev.ID); err != nil {
+		return err
+	}
+	rev.ResultImagePath, rev.Status = resultPath, "completed"
+	return setPrimaryRevision(rev.RequestID, rev.ID)
+}
+
+// setRevisionPostcard records the postcard composed of a revision's result
+func setRevisionPostcard(rev *Revision, path string) error {
+	if _, err := dbExec("UPDATE revisions SET postcard_image_path = ? WHERE id = ?", path, rev.ID); err != nil {
+		return err
+	}
+	rev.PostcardPath = path
+	return nil
+}
+
+// setRevisionPublicURL records where a revision's result was published
+func setRevisionPublicURL(rev *Revision, publicURL string) error {
+	rev.PublicURL = publicURL
+	_, err := dbExec(`UPDATE revisions SET public_url = ? WHERE id = ?`, publicURL, rev.ID)
+	return err
+}
+
+// setRevisionDiffScore records how much a revision's result differs from the original
+func setRevisionDiffScore(rev *Revision, score float64) error {
+	rev.DiffScore = score
+	_, err := dbExec(`UPDATE revisions SET diff_score = ? WHERE id = ?`, score, rev.ID)
+	return err
+}
+
+// setRevisionFaceScore records how much a revision's result altered faces
+func setRevisionFaceScore(rev *Revision, score float64) error {
+	rev.FaceScore = score
+	_, err := dbExec(`UPDATE revisions SET face_score = ? WHERE id = ?`, score, rev.ID)
+	return err
+}
+
+// finishRevision marks a revision as errored or cancelled. The request keeps
+// showing its primary revision if it has one; otherwise the outcome is applied
+// to the request itself.
+func finishRevision(rev *Revision, status string, failure error) error {
+	code, message := "", ""
+	if failure != nil {
+		code, message = errorCode(failure), failure.Error()
+	}
+	query := `UPDATE revisions SET status = ?, error_code = NULLIF(?, ''), error_message = NULLIF(?, ''),
+	          completed_at = CURRENT_TIMESTAMP WHERE id = ?`
+	if _, err := dbExec(query, status, code, message, rev.ID); err != nil {
+		return err
+	}
+
+	if _, err := getPrimaryRevision(rev.RequestID); err == nil {
+		return updateRequestStatus(rev.RequestID, "completed")
+	}
+	if failure != nil {
+		return updateRequestError(rev.RequestID, failure)
+	}
+	return updateRequestStatus(rev.RequestID, status)
+}
+
+// setPrimaryRevision marks a completed revision as the one its request shows
+func setPrimaryRevision(requestID, revisionID string) error {
+	tx, err := dbBegin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var resultPath string
+	query := `SELECT result_image_path FROM revisions
+	          WHERE id = ? AND request_id = ? AND status = 'completed'`
+	if err := tx.QueryRow(query, revisionID, requestID).Scan(&resultPath); err != nil {
+		return err
+	}
+
+	query = `UPDATE revisions SET is_primary = (id = ?) WHERE request_id = ?`
+	if _, err := tx.Exec(query, revisionID, requestID); err != nil {
+		return err
+	}
+
+	query = `UPDATE requests SET result_image_path = ?, status = 'completed',
+	         updated_at = CURRENT_TIMESTAMP WHERE id = ?`
+	if _, err := tx.Exec(query, resultPath, requestID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Feedback functions
+
+// saveFeedback records a 1-5 star rating for a revision's result, replacing
+// any earlier rating
+func saveFeedback(revisionID string, rating int) error {
+	query := `INSERT INTO feedback (revision_id, rating) VALUES (?, ?)
+	          ON CONFLICT(revision_id) DO UPDATE SET rating = excluded.rating, created_at = CURRENT_TIMESTAMP`
+	_, err := dbExec(query, revisionID, rating)
+	return err
+}
+
+// saveFeedbackIssues records which aspects of a rated result the user found wrong
+func saveFeedbackIssues(revisionID string, issues []string) error {
+	query := `UPDATE feedback SET issues = ? WHERE revision_id = ?`
+	_, err := dbExec(query, strings.Join(issues, ","), revisionID)
+	return err
+}
+
+// getFeedback returns the rating and issues given for a revision, or 0 and
+// none if it wasn't rated
+func getFeedback(revisionID string) (int, []string) {
+	var rating int
+	var issues string
+	err := dbQueryRow(`SELECT rating, COALESCE(issues, '') FROM feedback WHERE revision_id = ?`, revisionID).
+		Scan(&rating, &issues)
+	if err != nil || issues == "" {
+		return rating, nil
+	}
+	return rating, strings.Split(issues, ",")
+}
+
+// getFeedbackRating returns the rating for a revision, or 0 if none was given
+func getFeedbackRating(revisionID string) int {
+	var rating int
+	if err := dbQueryRow(`SELECT rating FROM feedback WHERE revision_id = ?`, revisionID).Scan(&rating); err != nil {
+		return 0
+	}
+	return rating
+}
+
+// VariantStats summarizes how a prompt variant performed
+type VariantStats struct {
+	Variant     string
+	Requests    int
+	Completed   int
+	Failed      int
+	Ratings     int
+	AvgRating   float64
+	HighRatings int // 4-5 stars
+	LowRatings  int // 1-2 stars
+}
+
+// ApprovalRate is the percentage of ratings that were 4-5 stars
+func (vs VariantStats) ApprovalRate() float64 {
+	if vs.Ratings == 0 {
+		return 0
+	}
+	return float64(vs.HighRatings) / float64(vs.Ratings) * 100
+}
+
+// getVariantStats aggregates request outcomes and ratings per prompt variant.
+// Only initial revisions are rated against a variant, since retries and edits
+// change its prompt.
+func getVariantStats() ([]VariantStats, error) {
+	query := `SELECT r.prompt_variant, COUNT(*),
+	          SUM(CASE WHEN r.status = 'completed' THEN 1 ELSE 0 END),
+	          SUM(CASE WHEN r.status = 'error' THEN 1 ELSE 0 END),
+	          COUNT(f.rating), COALESCE(AVG(f.rating), 0),
+	          SUM(CASE WHEN f.rating >= 4 THEN 1 ELSE 0 END),
+	          SUM(CASE WHEN f.rating <= 2 THEN 1 ELSE 0 END)
+	          FROM requests r
+	          LEFT JOIN revisions v ON v.request_id = r.id AND v.kind = 'initial'
+	          LEFT JOIN feedback f ON f.revision_id = v.id
+	          WHERE r.prompt_variant IS NOT NULL AND r.prompt_variant != ''
+	          GROUP BY r.prompt_variant ORDER BY r.prompt_variant`
+	rows, err := dbQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var stats []VariantStats
+	for rows.Next() {
+		var vs VariantStats
+		if err := rows.Scan(&vs.Variant, &vs.Requests, &vs.Completed, &vs.Failed,
+			&vs.Ratings, &vs.AvgRating, &vs.HighRatings, &vs.LowRatings); err != nil {
+			return nil, err
+		}
+		stats = append(stats, vs)
+	}
+	return stats, rows.Err()
+}
+
+// Usage report functions
+
+// sqliteTime formats a time the way SQLite's CURRENT_TIMESTAMP stores it
+func sqliteTime(t time.Time) string {
+	return t.UTC().Format("2006-01-02 15:04:05")
+}
+
+// parseSQLiteTime parses a timestamp read from the database: CURRENT_TIMESTAMP
+// text, or RFC 3339 for DATETIME columns the driver returned as a time
+func parseSQLiteTime(timestamp string) (time.Time, error) {
+	if t, err := time.Parse("2006-01-02 15:04:05", timestamp); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339Nano, timestamp)
+}
+
+// ErrorCodeCount is the number of failed requests with one error code
+type ErrorCodeCount struct {
+	Code  string
+	Count int
+}
+
+// UsageStats summarizes activity between two points in time
+type UsageStats struct {
+	Requests             int
+	Completed            int
+	Failed               int
+	AvgProcessingSeconds float64
+	Predictions          int
+	TopErrors            []ErrorCodeCount
+	Stages               []StageStats
+}
+
+// getUsageStats aggregates requests created and predictions started in [from, to)
+func getUsageStats(from, to time.Time) (*UsageStats, error) {
+	stats := &UsageStats{}
+	start, end := sqliteTime(from), sqliteTime(to)
+
+	query := `SELECT COUNT(*),
+	          COALESCE(SUM(CASE WHEN status = 'completed' THEN 1 ELSE 0 END), 0),
+	          COALESCE(SUM(CASE WHEN status = 'error' THEN 1 ELSE 0 END), 0)
+	          FROM requests WHERE created_at >= ? AND created_at < ?`
+	if err := dbQueryRow(query, start, end).Scan(&stats.Requests, &stats.Completed, &stats.Failed); err != nil {
+		return nil, err
+	}
+
+	query = `SELECT COUNT(prediction_id),
+	         COALESCE(AVG(CASE WHEN status = 'completed'
+	             THEN (julianday(completed_at) - julianday(created_at)) * 86400 END), 0)
+	         FROM revisions WHERE created_at >= ? AND created_at < ?`
+	if err := dbQueryRow(query, start, end).Scan(&stats.Predictions, &stats.AvgProcessingSeconds); err != nil {
+		return nil, err
+	}
+
+	query = `SELECT error_code, COUNT(*) FROM requests
+	         WHERE status = 'error' AND error_code IS NOT NULL AND created_at >= ? AND created_at < ?
+	         GROUP BY error_code ORDER BY COUNT(*) DESC, error_code LIMIT 5`
+	rows, err := dbQuery(query, start, end)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var ec ErrorCodeCount
+		if err := rows.Scan(&ec.Code, &ec.Count); err != nil {
+			return nil, err
+		}
+		stats.TopErrors = append(stats.TopErrors, ec)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	stats.Stages, err = getStageStats(from, to)
+	if err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// saveStageTiming records how long one pipeline stage took. revisionID is
+// empty for stages that run once per request.
+func saveStageTiming(requestID, revisionID, stage string, duration time.Duration) error {
+	query := `INSERT INTO stage_timings (request_id, revision_id, stage, duration_ms)
+	          VALUES (?, NULLIF(?, ''), ?, ?)`
+	_, err := dbExec(query, requestID, revisionID, stage, duration.Milliseconds())
+	return err
+}
+
+// StageTiming is one recorded pipeline stage of a request
+type StageTiming struct {
+	Stage      string `json:"stage"`
+	RevisionID string `json:"revision_id,omitempty"` // empty for stages run once per request
+	DurationMS int64  `json:"duration_ms"`
+	RecordedAt string `json:"recorded_at"`
+}
+
+// getStageTimings retrieves the timings of a request's own stages and those
+// of one of its revisions, in the order they were recorded
+func getStageTimings(requestID, revisionID string) ([]StageTiming, error) {
+	query := `SELECT stage, COALESCE(revision_id, ''), duration_ms, created_at FROM stage_timings
+	          WHERE request_id = ? AND (revision_id IS NULL OR revision_id = ?)
+	          ORDER BY id`
+	rows, err := dbQuery(query, requestID, revisionID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var timings []StageTiming
+	for rows.Next() {
+		var t StageTiming
+		if err := rows.Scan(&t.Stage, &t.RevisionID, &t.DurationMS, &t.RecordedAt); err != nil {
+			return nil, err
+		}
+		timings = append(timings, t)
+	}
+	return timings, rows.Err()
+}
+
+// StageStats summarizes the timings recorded for one pipeline stage
+type StageStats struct {
+	Stage   string
+	Count   int
+	TotalMs int64
+	AvgMs   float64
+	MaxMs   int64
+}
+
+// getStageStats aggregates the stage timings recorded in [from, to). Zero
+// times select every timing recorded.
+func getStageStats(from, to time.Time) ([]StageStats, error) {
+	query := `SELECT stage, COUNT(*), SUM(duration_ms), AVG(duration_ms), MAX(duration_ms)
+	          FROM stage_timings`
+	var args []any
+	if !from.IsZero() && !to.IsZero() {
+		query += ` WHERE created_at >= ? AND created_at < ?`
+		args = append(args, sqliteTime(from), sqliteTime(to))
+	}
+	query += ` GROUP BY stage`
+
+	rows, err := dbQuery(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	byStage := make(map[string]StageStats)
+	for rows.Next() {
+		var s StageStats
+		if err := rows.Scan(&s.Stage, &s.Count, &s.TotalMs, &s.AvgMs, &s.MaxMs); err != nil {
+			return nil, err
+		}
+		byStage[s.Stage] = s
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Report stages in pipeline order, including ones nothing was timed for
+	stats := make([]StageStats, 0, len(pipelineStages))
+	for _, stage := range pipelineStages {
+		s := byStage[stage]
+		s.Stage = stage
+		stats = append(stats, s)
+	}
+	return stats, nil
+}
+
+// getUserSettings retrieves a user's saved settings, returning sql.ErrNoRows
+// if they haven't saved any
+func getUserSettings(userID string) (*UserSettings, error) {
+	query := `SELECT user_id, units, locale, COALESCE(default_location_id, ''), COALESCE(email, ''),
+	          COALESCE(model, ''), COALESCE(preset, ''), intensity
+	          FROM user_settings WHERE user_id = ?`
+	settings := &UserSettings{}
+	err := dbQueryRow(query, userID).Scan(&settings.UserID, &settings.Units, &settings.Locale,
+		&settings.DefaultLocationID, &settings.Email, &settings.Model, &settings.Preset, &settings.Intensity)
+	if err != nil {
+		return nil, err
+	}
+	return settings, nil
+}
+
+// saveUserSettings creates or replaces a user's settings
+func saveUserSettings(settings *UserSettings) error {
+	query := `INSERT INTO user_settings (user_id, units, locale, default_location_id, email, model, preset, intensity)
+	          VALUES (?, ?, ?, NULLIF(?, ''), NULLIF(?, ''), NULLIF(?, ''), NULLIF(?, ''), ?)
+	          ON CONFLICT(user_id) DO UPDATE SET units = excluded.units, locale = excluded.locale,
+	          default_location_id = excluded.default_location_id, email = excluded.email,
+	          model = excluded.model, preset = excluded.preset, intensity = excluded.intensity,
+	          updated_at = CURRENT_TIMESTAMP`
+	_, err := dbExec(query, settings.UserID, settings.Units, settings.Locale, settings.DefaultLocationID,
+		settings.Email, settings.Model, settings.Preset, settings.Intensity)
+	return err
+}
+
+// claimTrialGeneration records a trial request unless the visitor's IP
+// address or user cookie already made limit requests since the given time.
+// It reports whether the request was allowed.
+func claimTrialGeneration(requestID, userID, ip string, limit int, since time.Time) (bool, error) {
+	query := `INSERT INTO trial_generations (request_id, user_id, ip)
+	          SELECT ?, ?, ? WHERE (SELECT COUNT(*) FROM trial_generations
+	              WHERE (user_id = ? OR ip = ?) AND created_at >= ?) < ?`
+	result, err := dbExec(query, requestID, userID, ip, userID, ip, sqliteTime(since), limit)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// countTrialGenerations counts the trial requests made since the given time
+// by a user or from an IP address, as claimTrialGeneration does
+func countTrialGenerations(userID, ip string, since time.Time) (int, error) {
+	query := `SELECT COUNT(*) FROM trial_generations
+	          WHERE (user_id = ? OR ip = ?) AND created_at >= ?`
+	var count int
+	err := dbQueryRow(query, userID, ip, sqliteTime(since)).Scan(&count)
+	return count, err
+}
+
+// countRecentSubmissions counts the submissions a user made since the given
+// time. A batch is one submission however many days it covers.
+func countRecentSubmissions(userID string, since time.Time) (int, error) {
+	query := `SELECT COUNT(DISTINCT COALESCE(batch_id, id)) FROM requests
+	          WHERE user_id = ? AND created_at >= ?`
+	var count int
+	err := dbQueryRow(query, userID, sqliteTime(since)).Scan(&count)
+	return count, err
+}
+
+// isTrialRequest reports whether a request was made by a trial visitor
+func isTrialRequest(requestID string) bool {
+	var count int
+	err := dbQueryRow(`SELECT COUNT(*) FROM trial_generations WHERE request_id = ?`, requestID).Scan(&count)
+	return err == nil && count > 0
+}
+
+// ReportSubscription is an email address that opted in to usage reports
+type ReportSubscription struct {
+	Email      string
+	Frequency  string // daily or weekly
+	LastSentAt string
+}
+
+// saveReportSubscription subscribes an email address to usage reports,
+// replacing the frequency of an existing subscription
+func saveReportSubscription(email, frequency string) error {
+	query := `INSERT INTO report_subscriptions (email, frequency) VALUES (?, ?)
+	          ON CONFLICT(email) DO UPDATE SET frequency = excluded.frequency`
+	_, err := dbExec(query, email, frequency)
+	return err
+}
+
+// deleteReportSubscription unsubscribes an email address from usage reports
+func deleteReportSubscription(email string) error {
+	_, err := dbExec(`DELETE FROM report_subscriptions WHERE email = ?`, email)
+	return err
+}
+
+// getReportSubscriptions retrieves all usage report subscriptions
+func getReportSubscriptions() ([]ReportSubscription, error) {
+	query := `SELECT email, frequency, COALESCE(last_sent_at, '')
+	          FROM report_subscriptions ORDER BY email`
+	rows, err := dbQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var subscriptions []ReportSubscription
+	for rows.Next() {
+		var sub ReportSubscription
+		if err := rows.Scan(&sub.Email, &sub.Frequency, &sub.LastSentAt); err != nil {
+			return nil, err
+		}
+		subscriptions = append(subscriptions, sub)
+	}
+	return subscriptions, rows.Err()
+}
+
+// markReportSent records when a subscription last received a report
+func markReportSent(email string, sentAt time.Time) error {
+	_, err := dbExec(`UPDATE report_subscriptions SET last_sent_at = ? WHERE email = ?`,
+		sqliteTime(sentAt), email)
+	return err
+}
+
+// getPreset retrieves a preset scenario by slug
+func getPreset(slug string) (*Preset, error) {
+	query := `SELECT slug, name, COALESCE(description, ''), prompt, enabled FROM presets WHERE slug = ?`
+	preset := &Preset{}
+	err := dbQueryRow(query, slug).Scan(&preset.Slug, &preset.Name, &preset.Description,
+		&preset.Prompt, &preset.Enabled)
+	if err != nil {
+		return nil, err
+	}
+	return preset, nil
+}
+
+// getPresets retrieves preset scenarios by name, optionally only enabled ones
+func getPresets(enabledOnly bool) ([]Preset, error) {
+	query := `SELECT slug, name, COALESCE(description, ''), prompt, enabled FROM presets`
+	if enabledOnly {
+		query += ` WHERE enabled = 1`
+	}
+	query += ` ORDER BY name`
+	rows, err := dbQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var presets []Preset
+	for rows.Next() {
+		var preset Preset
+		if err := rows.Scan(&preset.Slug, &preset.Name, &preset.Description,
+			&preset.Prompt, &preset.Enabled); err != nil {
+			return nil, err
+		}
+		presets = append(presets, preset)
+	}
+	return presets, rows.Err()
+}
+
+// savePreset creates a preset scenario or replaces the one with its slug
+func savePreset(preset *Preset) error {
+	query := `INSERT INTO presets (slug, name, description, prompt, enabled) VALUES (?, ?, ?, ?, ?)
+	          ON CONFLICT(slug) DO UPDATE SET name = excluded.name, description = excluded.description,
+	          prompt = excluded.prompt, enabled = excluded.enabled`
+	_, err := dbExec(query, preset.Slug, preset.Name, preset.Description, preset.Prompt, preset.Enabled)
+	return err
+}
+
+// deletePreset removes a preset scenario. Requests that used it keep their
+// generated prompt.
+func deletePreset(slug string) error {
+	_, err := dbExec(`DELETE FROM presets WHERE slug = ?`, slug)
+	return err
+}
+
+// Benchmark is one request's prompt run through several image models with
+// the same seed, for comparing them side by side
+type Benchmark struct {
+	ID        string
+	RequestID string
+	Prompt    string
+	Intensity string
+	Seed      int
+	CreatedAt string
+}
+
+// BenchmarkRun is one model's result in a benchmark
+type BenchmarkRun struct {
+	ID              string
+	BenchmarkID     string
+	Model           string
+	Status          string // processing, completed, error
+	PredictionID    string
+	DurationMS      int64   // wall-clock time from upload to downloaded result
+	PredictTime     float64 // seconds of model time reported by Replicate
+	Cost            float64 // estimated USD, from BENCHMARK_MODELS
+	ResultImagePath string
+	ErrorMessage    string
+	CreatedAt       string
+}
+
+// createBenchmark saves a benchmark together with its pending runs
+func createBenchmark(bench *Benchmark, runs []*BenchmarkRun) error {
+	tx, err := dbBegin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `INSERT INTO benchmarks (id, request_id, prompt, intensity, seed) VALUES (?, ?, ?, ?, ?)`
+	if _, err := tx.Exec(query, bench.ID, bench.RequestID, bench.Prompt, bench.Intensity, bench.Seed); err != nil {
+		return err
+	}
+
+	query = `INSERT INTO benchmark_runs (id, benchmark_id, model, cost) VALUES (?, ?, ?, ?)`
+	for _, run := range runs {
+		if _, err := tx.Exec(query, run.ID, run.BenchmarkID, run.Model, run.Cost); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// finishBenchmarkRun records the outcome and timings of a benchmark run
+func finishBenchmarkRun(run *BenchmarkRun) error {
+	query := `UPDATE benchmark_runs SET status = ?, prediction_id = NULLIF(?, ''), duration_ms = ?,
+	          predict_time = ?, result_image_path = NULLIF(?, ''), error_message = NULLIF(?, ''),
+	          completed_at = CURRENT_TIMESTAMP
+	          WHERE id = ?`
+	_, err := dbExec(query, run.Status, run.PredictionID, run.DurationMS, run.PredictTime,
+		run.ResultImagePath, run.ErrorMessage, run.ID)
+	return err
+}
+
+// getBenchmark retrieves a benchmark by ID
+func getBenchmark(id string) (*Benchmark, error) {
+	query := `SELECT id, request_id, prompt, intensity, seed, COALESCE(created_at, '')
+	          FROM benchmarks WHERE id = ?`
+	bench := &Benchmark{}
+	err := dbQueryRow(query, id).Scan(&bench.ID, &bench.RequestID, &bench.Prompt,
+		&bench.Intensity, &bench.Seed, &bench.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return bench, nil
+}
+
+// getRecentBenchmarks retrieves the most recent benchmarks, newest first
+func getRecentBenchmarks(limit int) ([]*Benchmark, error) {
+	query := `SELECT id, request_id, prompt, intensity, seed, COALESCE(created_at, '')
+	          FROM benchmarks ORDER BY created_at DESC, rowid DESC LIMIT ?`
+	rows, err := dbQuery(query, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var benchmarks []*Benchmark
+	for rows.Next() {
+		bench := &Benchmark{}
+		if err := rows.Scan(&bench.ID, &bench.RequestID, &bench.Prompt,
+			&bench.Intensity, &bench.Seed, &bench.CreatedAt); err != nil {
+			return nil, err
+		}
+		benchmarks = append(benchmarks, bench)
+	}
+	return benchmarks, rows.Err()
+}
+
+// getBenchmarkRuns retrieves a benchmark's runs in the order they were queued
+func getBenchmarkRuns(benchmarkID string) ([]*BenchmarkRun, error) {
+	query := `SELECT id, benchmark_id, model, status, COALESCE(prediction_id, ''),
+	          COALESCE(duration_ms, 0), COALESCE(predict_time, 0), COALESCE(cost, 0),
+	          COALESCE(result_image_path, ''), COALESCE(error_message, ''), COALESCE(created_at, '')
+	          FROM benchmark_runs WHERE benchmark_id = ? ORDER BY rowid`
+	rows, err := dbQuery(query, benchmarkID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var runs []*BenchmarkRun
+	for rows.Next() {
+		run := &BenchmarkRun{}
+		if err := rows.Scan(&run.ID, &run.BenchmarkID, &run.Model, &run.Status, &run.PredictionID,
+			&run.DurationMS, &run.PredictTime, &run.Cost, &run.ResultImagePath,
+			&run.ErrorMessage, &run.CreatedAt); err != nil {
+			return nil, err
+		}
+		runs = append(runs, run)
+	}
+	return runs, rows.Err()
+}
+
+// RequestAnalytics is one request's row in the analytics export. Stage
+// timestamps are when the request first reached each status, empty if it
+// never did.
+type RequestAnalytics struct {
+	ID                 string
+	CreatedAt          string
+	Status             string
+	ErrorCode          string
+	LocationName       string
+	Country            string
+	TargetDate         string
+	EndDate            string
+	WeatherCondition   string
+	WeatherDescription string
+	Temperature        float64
+	Units              string
+	PromptVariant      string
+	Preset             string
+	Intensity          string
+	Models             []string // model of every revision that reached the model
+	Revisions          int
+	Rating             int // primary revision's rating, 0 if unrated
+	PendingAt          string
+	GeocodedAt         string
+	WeatherFetchedAt   string
+	ConfirmedAt        string
+	ProcessingAt       string
+	FinishedAt         string // first completed, error or cancelled
+}
+
+// streamRequestAnalytics calls fn for every request created in [from, to),
+// oldest first, without loading them all into memory
+func streamRequestAnalytics(from, to time.Time, fn func(*RequestAnalytics) error) error {
+	query := `SELECT r.id, COALESCE(r.created_at, ''), r.status, COALESCE(r.error_code, ''),
+	          COALESCE(r.location_name, ''), COALESCE(r.country, ''), r.target_date, COALESCE(r.end_date, ''),
+	          COALESCE(r.weather_condition, ''), COALESCE(r.weather_description, ''),
+	          COALESCE(r.temperature, 0), r.units, COALESCE(r.prompt_variant, ''),
+	          COALESCE(r.preset, ''), r.intensity,
+	          (SELECT COALESCE(GROUP_CONCAT(COALESCE(v.model, ''), ','), '') FROM revisions v
+	           WHERE v.request_id = r.id AND v.prediction_id IS NOT NULL),
+	          (SELECT COUNT(*) FROM revisions v WHERE v.request_id = r.id),
+	          (SELECT COALESCE(MAX(f.rating), 0) FROM revisions v JOIN feedback f ON f.revision_id = v.id
+	           WHERE v.request_id = r.id AND v.is_primary = 1),
+	          ` + stageQuery("'pending'") + `,
+	          ` + stageQuery("'geocoding'") + `,
+	          ` + stageQuery("'weather_fetched'") + `,
+	          ` + stageQuery("'confirmed'") + `,
+	          ` + stageQuery("'processing'") + `,
+	          ` + stageQuery("'completed', 'error', 'cancelled'") + `
+	          FROM requests r
+	          WHERE r.created_at >= ? AND r.created_at < ?
+	          ORDER BY r.created_at, r.rowid`
+	rows, err := dbQuery(query, sqliteTime(from), sqliteTime(to))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		a := &RequestAnalytics{}
+		var models string
+		if err := rows.Scan(&a.ID, &a.CreatedAt, &a.Status, &a.ErrorCode,
+			&a.LocationName, &a.Country, &a.TargetDate, &a.EndDate,
+			&a.WeatherCondition, &a.WeatherDescription, &a.Temperature, &a.Units, &a.PromptVariant,
+			&a.Preset, &a.Intensity, &models, &a.Revisions, &a.Rating,
+			&a.PendingAt, &a.GeocodedAt, &a.WeatherFetchedAt, &a.ConfirmedAt,
+			&a.ProcessingAt, &a.FinishedAt); err != nil {
+			return err
+		}
+		if models != "" {
+			a.Models = strings.Split(models, ",")
+		}
+		if err := fn(a); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// stageQuery selects when a request first reached one of the given statuses
+func stageQuery(statuses string) string {
+	return `(SELECT COALESCE(MIN(e.created_at), '') FROM request_events e
+	           WHERE e.request_id = r.id AND e.status IN (` + statuses + `))`
+}
+
+// Tag functions
+
+// TagCount is a tag with the number of requests it's attached to
+type TagCount struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+// setRequestTags replaces the tags of a user's request. Tags no request uses
+// anymore are removed so they stop being suggested.
+func setRequestTags(userID, requestID string, tags []string) error {
+	tx, err := dbBegin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM request_tags WHERE request_id = ?`, requestID); err != nil {
+		return err
+	}
+	for _, tag := range tags {
+		query := `INSERT INTO tags (user_id, name) VALUES (?, ?) ON CONFLICT(user_id, name) DO NOTHING`
+		if _, err := tx.Exec(query, userID, tag); err != nil {
+			return err
+		}
+		query = `INSERT OR IGNORE INTO request_tags (request_id, tag_id)
+		         SELECT ?, id FROM tags WHERE user_id = ? AND name = ?`
+		if _, err := tx.Exec(query, requestID, userID, tag); err != nil {
+			return err
+		}
+	}
+
+	query := `DELETE FROM tags WHERE user_id = ? AND id NOT IN (SELECT tag_id FROM request_tags)`
+	if _, err := tx.Exec(query, userID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// getRequestTags retrieves the tags of a request in alphabetical order
+func getRequestTags(requestID string) ([]string, error) {
+	query := `SELECT t.name FROM request_tags rt JOIN tags t ON t.id = rt.tag_id
+	          WHERE rt.request_id = ? ORDER BY t.name`
+	rows, err := dbQuery(query, requestID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tags []string
+	for rows.Next() {
+		var tag string
+		if err := rows.Scan(&tag); err != nil {
+			return nil, err
+		}
+		tags = append(tags, tag)
+	}
+	return tags, rows.Err()
+}
+
+// getUserRequestTags retrieves the tags of all of a user's requests, keyed by
+// request ID
+func getUserRequestTags(userID string) (map[string][]string, error) {
+	query := `SELECT rt.request_id, t.name FROM request_tags rt JOIN tags t ON t.id = rt.tag_id
+	          WHERE t.user_id = ? ORDER BY t.name`
+	rows, err := dbQuery(query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tags := make(map[string][]string)
+	for rows.Next() {
+		var requestID, tag string
+		if err := rows.Scan(&requestID, &tag); err != nil {
+			return nil, err
+		}
+		tags[requestID] = append(tags[requestID], tag)
+	}
+	return tags, rows.Err()
+}
+
+// getUserTags retrieves a user's tags starting with prefix, most used first
+func getUserTags(userID, prefix string, limit int) ([]TagCount, error) {
+	query := `SELECT t.name, COUNT(rt.request_id) FROM tags t
+	          JOIN request_tags rt ON rt.tag_id = t.id
+	          WHERE t.user_id = ? AND substr(t.name, 1, ?) = ?
+	          GROUP BY t.id ORDER BY COUNT(rt.request_id) DESC, t.name LIMIT ?`
+	rows, err := dbQuery(query, userID, len(prefix), prefix, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tags []TagCount
+	for rows.Next() {
+		var tag TagCount
+		if err := rows.Scan(&tag.Name, &tag.Count); err != nil {
+			return nil, err
+		}
+		tags = append(tags, tag)
+	}
+	return tags, rows.Err()
+}
+
+// RequestFilter narrows down a user's requests; zero fields don't filter
+type RequestFilter struct {
+	Tag           string
+	Search        string // FTS5 query built by searchQuery
+	LocationID    int64
+	Precipitation string // precipitation* filter
+}
+
+// Precipitation filters of the gallery and API
+const (
+	precipitationRain = "rain" // some rain fell
+	precipitationSnow = "snow" // some snow fell
+	precipitationDry  = "dry"  // weather was fetched and neither fell
+)
+
+// isValidPrecipitationFilter checks a precipitation filter, empty meaning none
+func isValidPrecipitationFilter(filter string) bool {
+	switch filter {
+	case "", precipitationRain, precipitationSnow, precipitationDry:
+		return true
+	}
+	return false
+}
+
+// listRequests retrieves a page of a user's requests matching filter, newest first
+func listRequests(userID string, filter RequestFilter, limit, offset int) ([]*Request, error) {
+	query := `SELECT ` + requestColumns + ` FROM requests
+	          WHERE user_id = ? AND (? = '' OR id IN (
+	              SELECT rt.request_id FROM request_tags rt JOIN tags t ON t.id = rt.tag_id
+	              WHERE t.user_id = requests.user_id AND t.name = ?))
+	          AND (? = '' OR id IN (SELECT request_id FROM request_search WHERE request_search MATCH ?))
+	          AND (? = 0 OR location_id = ?)
+	          AND CASE ?
+	              WHEN 'rain' THEN rain_mm > 0
+	              WHEN 'snow' THEN snow_mm > 0
+	              WHEN 'dry' THEN rain_mm = 0 AND snow_mm = 0
+	              ELSE 1 END
+	          ORDER BY created_at DESC, rowid DESC LIMIT ? OFFSET ?`
+	rows, err := dbQuery(query, userID, filter.Tag, filter.Tag, filter.Search, filter.Search,
+		filter.LocationID, filter.LocationID, filter.Precipitation, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var requests []*Request
+	for rows.Next() {
+		req, err := scanRequest(rows)
+		if err != nil {
+			return nil, err
+		}
+		requests = append(requests, req)
+	}
+	return requests, rows.Err()
+}
+
+// Location functions
+
+// Location is a canonical place requests are resolved to
+type Location struct {
+	ID        int64
+	Name      string
+	Country   string
+	Latitude  float64
+	Longitude float64
+}
+
+// LocationCount is a canonical location with the number of a user's
+// requests resolved to it
+type LocationCount struct {
+	Location
+	Count int
+}
+
+// canonicalLocation returns the canonical location for a geocoded place,
+// creating it the first time the place is seen. Places with the same
+// case-folded name and country within sameLocationRadiusKm are one location,
+// and keep the name they were first stored with.
+func canonicalLocation(name, country string, lat, lon float64) (*Location, error) {
+	key := locationKey(name, country)
+
+	query := `SELECT id, name, country, latitude, longitude FROM locations WHERE key = ? ORDER BY id`
+	rows, err := dbQuery(query, key)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		loc := &Location{}
+		if err := rows.Scan(&loc.ID, &loc.Name, &loc.Country, &loc.Latitude, &loc.Longitude); err != nil {
+			return nil, err
+		}
+		if distanceKm(lat, lon, loc.Latitude, loc.Longitude) <= sameLocationRadiusKm {
+			return loc, nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	loc := &Location{
+		Name:      strings.Join(strings.Fields(name), " "),
+		Country:   strings.ToUpper(strings.TrimSpace(country)),
+		Latitude:  lat,
+		Longitude: lon,
+	}
+	query = `INSERT INTO locations (key, name, country, latitude, longitude) VALUES (?, ?, ?, ?, ?)`
+	result, err := dbExec(query, key, loc.Name, loc.Country, lat, lon)
+	if err != nil {
+		return nil, err
+	}
+	loc.ID, err = result.LastInsertId()
+	return loc, err
+}
+
+// getUserLocations retrieves the locations of a user's requests, most used first
+func getUserLocations(userID string) ([]LocationCount, error) {
+	query := `SELECT l.id, l.name, l.country, l.latitude, l.longitude, COUNT(r.id)
+	          FROM locations l JOIN requests r ON r.location_id = l.id
+	          WHERE r.user_id = ?
+	          GROUP BY l.id ORDER BY COUNT(r.id) DESC, l.name`
+	rows, err := dbQuery(query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var locations []LocationCount
+	for rows.Next() {
+		var loc LocationCount
+		if err := rows.Scan(&loc.ID, &loc.Name, &loc.Country, &loc.Latitude, &loc.Longitude, &loc.Count); err != nil {
+			return nil, err
+		}
+		locations = append(locations, loc)
+	}
+	return locations, rows.Err()
+}
+
+// Erasure functions
+
+// requestErasure queues the erasure of a user's data, starting over if it
+// was erased before
+func requestErasure(userID, requestedBy string) error {
+	query := `INSERT INTO erasures (user_id, requested_by) VALUES (?, ?)
+	          ON CONFLICT(user_id) DO UPDATE SET requested_by = excluded.requested_by,
+	          requested_at = CURRENT_TIMESTAMP, completed_at = NULL, requests_deleted = 0, files_deleted = 0`
+	_, err := dbExec(query, userID, requestedBy)
+	return err
+}
+
+// scanErasures reads the rows of an erasures query
+func scanErasures(rows *sql.Rows) ([]Erasure, error) {
+	defer rows.Close()
+	var erasures []Erasure
+	for rows.Next() {
+		var e Erasure
+		if err := rows.Scan(&e.UserID, &e.RequestedBy, &e.RequestedAt, &e.CompletedAt,
+			&e.RequestsDeleted, &e.FilesDeleted); err != nil {
+			return nil, err
+		}
+		erasures = append(erasures, e)
+	}
+	return erasures, rows.Err()
+}
+
+const erasureColumns = `user_id, requested_by, COALESCE(requested_at, ''), COALESCE(completed_at, ''),
+	requests_deleted, files_deleted`
+
+// getPendingErasures retrieves the erasures that haven't been purged yet, oldest first
+func getPendingErasures() ([]Erasure, error) {
+	rows, err := dbQuery(`SELECT ` + erasureColumns + ` FROM erasures
+	                      WHERE completed_at IS NULL ORDER BY requested_at`)
+	if err != nil {
+		return nil, err
+	}
+	return scanErasures(rows)
+}
+
+// getRecentErasures retrieves the latest erasures, pending ones first
+func getRecentErasures(limit int) ([]Erasure, error) {
+	rows, err := dbQuery(`SELECT `+erasureColumns+` FROM erasures
+	                      ORDER BY completed_at IS NOT NULL, requested_at DESC LIMIT ?`, limit)
+	if err != nil {
+		return nil, err
+	}
+	return scanErasures(rows)
+}
+
+// countUserData counts a user's requests and saved locations
+func countUserData(userID string) (requests, locations int, err error) {
+	query := `SELECT (SELECT COUNT(*) FROM requests WHERE user_id = ?),
+	                 (SELECT COUNT(*) FROM saved_locations WHERE user_id = ?)`
+	err = dbQueryRow(query, userID, userID).Scan(&requests, &locations)
+	return requests, locations, err
+}
+
+// userWorkInProgress reports whether any of a user's requests or revisions
+// are still being worked on without waiting for the user
+func userWorkInProgress(userID string) (bool, error) {
+	query := `SELECT EXISTS (SELECT 1 FROM requests WHERE user_id = ?
+	              AND status IN ('pending', 'geocoding', 'weather_fetching', 'confirmed', 'processing'))
+	          OR EXISTS (SELECT 1 FROM revisions v JOIN requests r ON r.id = v.request_id
+	              WHERE r.user_id = ? AND v.status = 'processing')`
+	var busy bool
+	err := dbQueryRow(query, userID, userID).Scan(&busy)
+	return busy, err
+}
+
+// UserData is what of a user's data lives outside the database: stored
+// images and published results
+type UserData struct {
+	Files     []string    // uploads, results and benchmark results of their requests, and their data exports
+	Published []*Revision // revisions with a public URL, with RequestID, ID and PublicURL set
+	Reviewing []string    // requests whose photo waits for review in the cache
+}
+
+// getUserData collects the files and published results of a user's requests
+func getUserData(userID string) (*UserData, error) {
+	data := &UserData{}
+	query := `SELECT image_path FROM requests WHERE user_id = ?
+	          UNION SELECT result_image_path FROM requests WHERE user_id = ? AND result_image_path IS NOT NULL
+	          UNION SELECT v.result_image_path FROM revisions v JOIN requests r ON r.id = v.request_id
+	              WHERE r.user_id = ? AND v.result_image_path IS NOT NULL
+	          UNION SELECT v.postcard_image_path FROM revisions v JOIN requests r ON r.id = v.request_id
+	              WHERE r.user_id = ? AND v.postcard_image_path IS NOT NULL
+	          UNION SELECT br.result_image_path FROM benchmark_runs br
+	              JOIN benchmarks b ON b.id = br.benchmark_id JOIN requests r ON r.id = b.request_id
+	              WHERE r.user_id = ? AND br.result_image_path IS NOT NULL
+	          UNION SELECT path FROM data_exports WHERE user_id = ? AND path IS NOT NULL`
+	rows, err := dbQuery(query, userID, userID, userID, userID, userID, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var path string
+		if err := rows.Scan(&path); err != nil {
+			return nil, err
+		}
+		if path != "" {
+			data.Files = append(data.Files, path)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	query = `SELECT v.id, v.request_id, v.public_url FROM revisions v JOIN requests r ON r.id = v.request_id
+	         WHERE r.user_id = ? AND COALESCE(v.public_url, '') != ''`
+	rows, err = dbQuery(query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		rev := &Revision{}
+		if err := rows.Scan(&rev.ID, &rev.RequestID, &rev.PublicURL); err != nil {
+			return nil, err
+		}
+		data.Published = append(data.Published, rev)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = dbQuery(`SELECT id FROM requests WHERE user_id = ? AND status = 'reviewing'`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		data.Reviewing = append(data.Reviewing, id)
+	}
+	return data, rows.Err()
+}
+
+// eraseUserRows deletes every row about a user and their requests, and the
+// blobs nothing else refers to, and marks their erasure as done, returning
+// how many requests and files were deleted. The canonical places in
+// locations aren't anyone's and are kept.
+func eraseUserRows(userID string, filesDeleted int, blobs []string) (int, int, error) {
+	tx, err := dbBegin()
+	if err != nil {
+		return 0, 0, err
+	}
+	defer tx.Rollback()
+
+	const userRequests = `(SELECT id FROM requests WHERE user_id = ?)`
+	const userBenchmarks = `(SELECT id FROM benchmarks WHERE request_id IN ` + userRequests + `)`
+	for _, stmt := range []string{
+		`DELETE FROM feedback WHERE revision_id IN (SELECT id FROM revisions WHERE request_id IN ` + userRequests + `)`,
+		`DELETE FROM revisions WHERE request_id IN ` + userRequests,
+		`DELETE FROM weather_snapshots WHERE request_id IN ` + userRequests,
+		`DELETE FROM stage_timings WHERE request_id IN ` + userRequests,
+		`DELETE FROM request_tags WHERE request_id IN ` + userRequests,
+		`DELETE FROM benchmark_runs WHERE benchmark_id IN ` + userBenchmarks,
+		`DELETE FROM benchmarks WHERE request_id IN ` + userRequests,
+		`DELETE FROM request_events WHERE request_id IN ` + userRequests,
+		`DELETE FROM trial_generations WHERE user_id = ?`,
+		`DELETE FROM tags WHERE user_id = ?`,
+		`DELETE FROM saved_locations WHERE user_id = ?`,
+		`DELETE FROM user_settings WHERE user_id = ?`,
+		`DELETE FROM data_exports WHERE user_id = ?`,
+		`DELETE FROM consents WHERE user_id = ?`,
+		`DELETE FROM schedules WHERE user_id = ?`,
+		`DELETE FROM calendar_feeds WHERE user_id = ?`,
+		`DELETE FROM drafts WHERE user_id = ?`,
+		`DELETE FROM analytics_events WHERE user_id = ?`,
+	} {
+		if _, err := tx.Exec(stmt, userID); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	result, err := tx.Exec(`DELETE FROM requests WHERE user_id = ?`, userID)
+	if err != nil {
+		return 0, 0, err
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// Blobs stored in the grace period may be about to be referenced by a
+	// request of someone else with the same photo, and are left to collectBlobs
+	before := time.Now().Add(-blobGracePeriod)
+	for _, path := range blobs {
+		ok, err := deleteUnreferencedBlobTx(tx, path, before)
+		if err != nil {
+			return 0, 0, err
+		}
+		if ok {
+			filesDeleted++
+		}
+	}
+
+	query := `UPDATE erasures SET completed_at = CURRENT_TIMESTAMP, requests_deleted = ?, files_deleted = ?
+	          WHERE user_id = ?`
+	if _, err := tx.Exec(query, deleted, filesDeleted, userID); err != nil {
+		return 0, 0, err
+	}
+	return int(deleted), filesDeleted, tx.Commit()
+}
+
+// Data export functions
+
+// createDataExport records a data export that's about to be built
+func createDataExport(export *DataExport) error {
+	query := `INSERT INTO data_exports (id, user_id, status, expires_at) VALUES (?, ?, ?, ?)`
+	_, err := dbExec(query, export.ID, export.UserID, export.Status, export.ExpiresAt)
+	return err
+}
+
+const dataExportColumns = `id, user_id, status, COALESCE(path, ''), size, COALESCE(error_message, ''),
+	COALESCE(created_at, ''), COALESCE(completed_at, ''), expires_at`
+
+// scanDataExport reads a row of data_exports
+func scanDataExport(row rowScanner) (*DataExport, error) {
+	export := &DataExport{}
+	err := row.Scan(&export.ID, &export.UserID, &export.Status, &export.Path, &export.Size,
+		&export.ErrorMessage, &export.CreatedAt, &export.CompletedAt, &export.ExpiresAt)
+	if err != nil {
+		return nil, err
+	}
+	return export, nil
+}
+
+// getDataExport retrieves a data export
+func getDataExport(id string) (*DataExport, error) {
+	return scanDataExport(dbQueryRow(`SELECT `+dataExportColumns+` FROM data_exports WHERE id = ?`, id))
+}
+
+// getLatestDataExport retrieves a user's most recent data export that hasn't expired
+func getLatestDataExport(userID string) (*DataExport, error) {
+	query := `SELECT ` + dataExportColumns + ` FROM data_exports
+	          WHERE user_id = ? AND expires_at > ? ORDER BY created_at DESC, rowid DESC LIMIT 1`
+	return scanDataExport(dbQueryRow(query, userID, sqliteTime(time.Now())))
+}
+
+// finishDataExport records the archive of a built export, or why building it failed
+func finishDataExport(export *DataExport) error {
+	query := `UPDATE data_exports SET status = ?, path = NULLIF(?, ''), size = ?, error_message = NULLIF(?, ''),
+	          completed_at = CURRENT_TIMESTAMP WHERE id = ?`
+	_, err := dbExec(query, export.Status, export.Path, export.Size, export.ErrorMessage, export.ID)
+	return err
+}
+
+// getExpiredDataExports retrieves the exports past their expiry
+func getExpiredDataExports() ([]*DataExport, error) {
+	rows, err := dbQuery(`SELECT `+dataExportColumns+` FROM data_exports WHERE expires_at <= ?`, sqliteTime(time.Now()))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var exports []*DataExport
+	for rows.Next() {
+		export, err := scanDataExport(rows)
+		if err != nil {
+			return nil, err
+		}
+		exports = append(exports, export)
+	}
+	return exports, rows.Err()
+}
+
+// deleteDataExport removes a data export's row
+func deleteDataExport(id string) error {
+	_, err := dbExec(`DELETE FROM data_exports WHERE id = ?`, id)
+	return err
+}
+
+// getTrialGenerations retrieves the trial requests a user made, with the IP
+// address each was made from
+func getTrialGenerations(userID string) ([]TrialGeneration, error) {
+	query := `SELECT request_id, ip, COALESCE(created_at, '') FROM trial_generations
+	          WHERE user_id = ? ORDER BY created_at`
+	rows, err := dbQuery(query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var generations []TrialGeneration
+	for rows.Next() {
+		var g TrialGeneration
+		if err := rows.Scan(&g.RequestID, &g.IP, &g.CreatedAt); err != nil {
+			return nil, err
+		}
+		generations = append(generations, g)
+	}
+	return generations, rows.Err()
+}
+
+// Consent functions
+
+// recordConsent records that a user accepted a version of the terms. Accepting
+// the same version again keeps the first acceptance.
+func recordConsent(userID, termsVersion string) error {
+	query := `INSERT INTO consents (user_id, terms_version) VALUES (?, ?)
+	          ON CONFLICT(user_id, terms_version) DO NOTHING`
+	_, err := dbExec(query, userID, termsVersion)
+	return err
+}
+
+// hasConsented reports whether a user accepted a version of the terms
+func hasConsented(userID, termsVersion string) (bool, error) {
+	var accepted bool
+	query := `SELECT EXISTS (SELECT 1 FROM consents WHERE user_id = ? AND terms_version = ?)`
+	err := dbQueryRow(query, userID, termsVersion).Scan(&accepted)
+	return accepted, err
+}
+
+// getConsents retrieves every version of the terms a user accepted, oldest first
+func getConsents(userID string) ([]Consent, error) {
+	query := `SELECT terms_version, COALESCE(accepted_at, '') FROM consents
+	          WHERE user_id = ? ORDER BY accepted_at, rowid`
+	rows, err := dbQuery(query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var consents []Consent
+	for rows.Next() {
+		var c Consent
+		if err := rows.Scan(&c.TermsVersion, &c.AcceptedAt); err != nil {
+			return nil, err
+		}
+		consents = append(consents, c)
+	}
+	return consents, rows.Err()
+}
+
+// Blob functions
+
+// touchBlob records a blob that's about to be stored, or marks one that's
+// stored again as just stored, keeping it from being collected for a while
+func touchBlob(hash, path string, size int) error {
+	query := `INSERT INTO blobs (path, hash, size) VALUES (?, ?, ?)
+	          ON CONFLICT(path) DO UPDATE SET stored_at = CURRENT_TIMESTAMP`
+	_, err := dbExec(query, path, hash, size)
+	return err
+}
+
+// unreferencedBlobs lists the paths of blobs no row refers to that were last
+// stored before a time
+func unreferencedBlobs(before time.Time) ([]string, error) {
+	rows, err := dbQuery(`SELECT path FROM blobs WHERE refs <= 0 AND stored_at < ?`, sqliteTime(before))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var paths []string
+	for rows.Next() {
+		var path string
+		if err := rows.Scan(&path); err != nil {
+			return nil, err
+		}
+		paths = append(paths, path)
+	}
+	return paths, rows.Err()
+}
+
+// deleteUnreferencedBlob deletes a blob and its file if nothing refers to it
+// and it was last stored before a time, reporting whether it did
+func deleteUnreferencedBlob(path string, before time.Time) (bool, error) {
+	tx, err := dbBegin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	deleted, err := deleteUnreferencedBlobTx(tx, path, before)
+	if err != nil || !deleted {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// deleteUnreferencedBlobTx deletes an unreferenced blob in a transaction.
+// The file is removed while the transaction holds the write lock, so
+// storeBlob can't record the blob again until it's gone.
+func deleteUnreferencedBlobTx(tx *sql.Tx, path string, before time.Time) (bool, error) {
+	result, err := tx.Exec(`DELETE FROM blobs WHERE path = ? AND refs <= 0 AND stored_at < ?`, path, sqliteTime(before))
+	if err != nil {
+		return false, err
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		return false, err
+	}
+	return true, removeBlobFile(path)
+}
+
+// imagePathColumns are the columns that refer to stored images
+var imagePathColumns = []struct{ table, column string }{
+	{"requests", "image_path"},
+	{"requests", "result_image_path"},
+	{"revisions", "result_image_path"},
+	{"revisions", "postcard_image_path"},
+	{"benchmark_runs", "result_image_path"},
+}
+
+// legacyImagePaths lists the images rows refer to that aren't blobs
+func legacyImagePaths() ([]string, error) {
+	var selects []string
+	for _, c := range imagePathColumns {
+		selects = append(selects, fmt.Sprintf(`SELECT %s AS path FROM %s WHERE %s IS NOT NULL AND %s != ''`,
+			c.column, c.table, c.column, c.column))
+	}
+	query := `SELECT path FROM (` + strings.Join(selects, " UNION ") + `)
+	          WHERE path NOT IN (SELECT path FROM blobs)`
+	rows, err := dbQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var paths []string
+	for rows.Next() {
+		var path string
+		if err := rows.Scan(&path); err != nil {
+			return nil, err
+		}
+		paths = append(paths, path)
+	}
+	return paths, rows.Err()
+}
+
+// replaceImagePath points every row referring to an image at another path
+func replaceImagePath(oldPath, newPath string) error {
+	tx, err := dbBegin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, c := range imagePathColumns {
+		query := fmt.Sprintf(`UPDATE %s SET %s = ? WHERE %s = ?`, c.table, c.column, c.column)
+		if _, err := tx.Exec(query, newPath, oldPath); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Schedule functions
+
+// scheduleColumns is the column list shared by queries that load schedules
+const scheduleColumns = `id, user_id, source_request_id, run_date, run_at, uid, COALESCE(summary, ''), status,
+	COALESCE(request_id, ''), COALESCE(error_message, ''), COALESCE(created_at, '')`
+
+func scanSchedule(row rowScanner) (*Schedule, error) {
+	var s Schedule
+	err := row.Scan(&s.ID, &s.UserID, &s.SourceRequestID, &s.RunDate, &s.RunAt, &s.UID, &s.Summary,
+		&s.Status, &s.RequestID, &s.ErrorMessage, &s.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// saveSchedules stores new schedules, skipping those of an event that's
+// already scheduled on the same date, and returns how many were added
+func saveSchedules(schedules []*Schedule) (int, error) {
+	tx, err := dbBegin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	added := 0
+	for _, s := range schedules {
+		result, err := tx.Exec(`INSERT OR IGNORE INTO schedules
+		    (id, user_id, source_request_id, run_date, run_at, uid, summary)
+		    VALUES (?, ?, ?, ?, ?, ?, NULLIF(?, ''))`,
+			s.ID, s.UserID, s.SourceRequestID, s.RunDate, s.RunAt, s.UID, s.Summary)
+		if err != nil {
+			return 0, err
+		}
+		if n, err := result.RowsAffected(); err == nil && n > 0 {
+			added++
+		}
+	}
+	return added, tx.Commit()
+}
+
+// getSchedules lists a user's schedules by date
+func getSchedules(userID string) ([]*Schedule, error) {
+	return querySchedules(`SELECT `+scheduleColumns+` FROM schedules
+	    WHERE user_id = ? ORDER BY run_date, created_at`, userID)
+}
+
+// dueSchedules lists the schedules whose time has come
+func dueSchedules(now time.Time) ([]*Schedule, error) {
+	return querySchedules(`SELECT `+scheduleColumns+` FROM schedules
+	    WHERE status = 'scheduled' AND run_at <= ? ORDER BY run_at`, sqliteTime(now))
+}
+
+func querySchedules(query string, args ...any) ([]*Schedule, error) {
+	rows, err := dbQuery(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var schedules []*Schedule
+	for rows.Next() {
+		s, err := scanSchedule(rows)
+		if err != nil {
+			return nil, err
+		}
+		schedules = append(schedules, s)
+	}
+	return schedules, rows.Err()
+}
+
+// countPendingSchedules counts a user's schedules that haven't run yet
+func countPendingSchedules(userID string) (int, error) {
+	var n int
+	err := dbQueryRow(`SELECT COUNT(*) FROM schedules WHERE user_id = ? AND status = 'scheduled'`, userID).Scan(&n)
+	return n, err
+}
+
+// claimSchedule marks a due schedule as started, reporting false when
+// another instance or tick started it first
+func claimSchedule(id string) (bool, error) {
+	result, err := dbExec(`UPDATE schedules SET status = 'started' WHERE id = ? AND status = 'scheduled'`, id)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// setScheduleRequest records the request a schedule started
+func setScheduleRequest(id, requestID string) error {
+	_, err := dbExec(`UPDATE schedules SET request_id = ? WHERE id = ?`, requestID, id)
+	return err
+}
+
+// failSchedule records why a schedule couldn't start its request
+func failSchedule(id string, failure error) error {
+	_, err := dbExec(`UPDATE schedules SET status = 'error', error_message = ? WHERE id = ?`, failure.Error(), id)
+	return err
+}
+
+// cancelSchedule cancels one of a user's schedules that hasn't run yet,
+// reporting false when there's none
+func cancelSchedule(userID, id string) (bool, error) {
+	result, err := dbExec(`UPDATE schedules SET status = 'cancelled'
+	    WHERE id = ? AND user_id = ? AND status = 'scheduled'`, id, userID)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// Calendar feed functions
+
+// setCalendarFeedToken gives a user's calendar feed a new token, revoking
+// the link made of the previous one
+func setCalendarFeedToken(userID, token string) error {
+	_, err := dbExec(`INSERT INTO calendar_feeds (user_id, token) VALUES (?, ?)
+	    ON CONFLICT(user_id) DO UPDATE SET token = excluded.token, created_at = CURRENT_TIMESTAMP`,
+		userID, token)
+	return err
+}
+
+// getCalendarFeedToken retrieves a user's calendar feed token
+func getCalendarFeedToken(userID string) (string, error) {
+	var token string
+	err := dbQueryRow(`SELECT token FROM calendar_feeds WHERE user_id = ?`, userID).Scan(&token)
+	return token, err
+}
+
+// getCalendarFeedUser retrieves the user a calendar feed token belongs to
+func getCalendarFeedUser(token string) (string, error) {
+	var userID string
+	err := dbQueryRow(`SELECT user_id FROM calendar_feeds WHERE token = ?`, token).Scan(&userID)
+	return userID, err
+}
+
+// deleteCalendarFeed turns a user's calendar feed off
+func deleteCalendarFeed(userID string) error {
+	_, err := dbExec(`DELETE FROM calendar_feeds WHERE user_id = ?`, userID)
+	return err
+}
+
+// Draft functions
+
+// saveDraft stores the start form a user filled in partway, replacing
+// their previous draft
+func saveDraft(userID string, fields url.Values) error {
+	_, err := dbExec(`INSERT INTO drafts (user_id, fields) VALUES (?, ?)
+	    ON CONFLICT(user_id) DO UPDATE SET fields = excluded.fields, updated_at = CURRENT_TIMESTAMP`,
+		userID, fields.Encode())
+	return err
+}
+
+// getDraft retrieves a user's draft
+func getDraft(userID string) (*Draft, error) {
+	draft := &Draft{UserID: userID}
+	var encoded string
+	err := dbQueryRow(`SELECT fields, COALESCE(updated_at, '') FROM drafts WHERE user_id = ?`, userID).
+		Scan(&encoded, &draft.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	draft.Fields, err = url.ParseQuery(encoded)
+	return draft, err
+}
+
+// deleteDraft removes a user's draft, if they have one
+func deleteDraft(userID string) error {
+	_, err := dbExec(`DELETE FROM drafts WHERE user_id = ?`, userID)
+	return err
+}
+
+// deleteStaleDrafts removes the drafts not saved since before
+func deleteStaleDrafts(before time.Time) (int64, error) {
+	result, err := dbExec(`DELETE FROM drafts WHERE updated_at < ?`, sqliteTime(before))
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// insertAnalyticsEvent stores a product event for the table analytics sink
+func insertAnalyticsEvent(event AnalyticsEvent) error {
+	properties, err := json.Marshal(event.Properties)
+	if err != nil {
+		return err
+	}
+	_, err = dbExec(`INSERT INTO analytics_events (name, user_id, request_id, properties, created_at)
+	    VALUES (?, ?, NULLIF(?, ''), ?, ?)`,
+		event.Name, event.UserID, event.RequestID, string(properties), event.Time.UTC().Format(eventTimeLayout))
 	return err
 }
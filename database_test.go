@@ -0,0 +1,157 @@
+package main
+
+import (
+	"testing"
+)
+
+// useTestDB opens a fresh database in a temporary data directory, closing it
+// and restoring the previous one when the test ends
+func useTestDB(t *testing.T) {
+	t.Helper()
+	previousDir, previousDB := dataDir, db
+	dataDir = t.TempDir()
+	if err := initDB(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Close()
+		dataDir, db = previousDir, previousDB
+	})
+}
+
+// TestClonedRequestIsNotInterrupted checks that a clone, like a redo or a
+// scheduled request, is claimed by the instance processing it, so the
+// recovery loop doesn't take it for stranded work of a stopped instance
+func TestClonedRequestIsNotInterrupted(t *testing.T) {
+	useTestDB(t)
+
+	parent := &Request{ID: "parent", UserID: "user", LocationInput: "Oslo", TargetDate: "2024-05-01",
+		TimeOfDay: "noon", Units: unitsMetric, Intensity: "normal", ImagePath: "photo.jpg", Status: "completed"}
+	if err := saveRequest(parent); err != nil {
+		t.Fatal(err)
+	}
+	clone := *parent
+	clone.ID = "clone"
+	if err := cloneRequest(&clone, parent.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	resumeInterruptedWork()
+
+	got, err := getRequest(clone.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Status != "pending" || got.ErrorMessage != "" {
+		t.Errorf("clone was marked %q (%s) while being processed", got.Status, got.ErrorMessage)
+	}
+	claims, err := getRequestClaimsWithStatus("pending")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(claims) != 1 || claims[0].ClaimedBy != instanceID {
+		t.Errorf("pending claims = %+v, want the clone claimed by %s", claims, instanceID)
+	}
+}
+
+// legacySchema is the database of the first release, plus the per-request
+// votes added before revisions
+const legacySchema = `
+	CREATE TABLE requests (
+		id TEXT PRIMARY KEY,
+		user_id TEXT NOT NULL,
+		location_input TEXT NOT NULL,
+		location_name TEXT,
+		country TEXT,
+		latitude REAL,
+		longitude REAL,
+		target_date TEXT NOT NULL,
+		time_of_day TEXT,
+		image_path TEXT NOT NULL,
+		weather_condition TEXT,
+		weather_description TEXT,
+		temperature REAL,
+		feels_like REAL,
+		humidity INTEGER,
+		clouds INTEGER,
+		wind_speed REAL,
+		visibility INTEGER,
+		precipitation TEXT,
+		ai_prompt TEXT,
+		prediction_id TEXT,
+		status TEXT NOT NULL DEFAULT 'pending',
+		error_message TEXT,
+		result_image_path TEXT,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE TABLE sessions (
+		session_id TEXT PRIMARY KEY,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		expires_at DATETIME NOT NULL
+	);
+
+	CREATE TABLE feedback (
+		request_id TEXT PRIMARY KEY,
+		vote INTEGER NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+
+	INSERT INTO requests (id, user_id, location_input, location_name, country, target_date, time_of_day, image_path,
+	                      weather_condition, precipitation, ai_prompt, status, result_image_path)
+	VALUES ('old', 'user', 'zurich', 'Zürich', 'CH', '2024-01-15', 'morning', 'uploads/old.jpg',
+	        'Snow', 'Snow: 1.5mm', 'A snowy morning', 'completed', 'results/old.jpg');
+
+	INSERT INTO sessions (session_id, expires_at) VALUES ('session', '2999-01-01 00:00:00');
+
+	INSERT INTO feedback (request_id, vote) VALUES ('old', 1);
+`
+
+// TestUpgradeKeepsData checks that a database from before the current schema
+// is upgraded in place instead of being recreated empty
+func TestUpgradeKeepsData(t *testing.T) {
+	previousDir, previousDB := dataDir, db
+	dataDir = t.TempDir()
+	if err := openDB(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(legacySchema); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	if err := initDB(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Close()
+		dataDir, db = previousDir, previousDB
+	})
+
+	req, err := getRequest("old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.LocationName != "Zürich" || req.SnowMM != 1.5 || req.Units != unitsMetric || req.Status != "completed" {
+		t.Errorf("request = %+v, want the stored one", req)
+	}
+	if kind, err := getSessionKind("session"); err != nil || kind != sessionFull {
+		t.Errorf("session kind = %v, %v, want a full session", kind, err)
+	}
+
+	rev, err := getPrimaryRevision("old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rev.Kind != revisionInitial || rev.Status != "completed" || rev.ResultImagePath != "results/old.jpg" || rev.Prompt != "A snowy morning" {
+		t.Errorf("revision = %+v, want the request's result", rev)
+	}
+	if rating := getFeedbackRating(rev.ID); rating != 5 {
+		t.Errorf("rating = %d, want the thumbs up as 5 stars", rating)
+	}
+
+	var found string
+	if err := db.QueryRow(`SELECT request_id FROM request_search WHERE request_search MATCH 'zurich snowy'`).Scan(&found); err != nil || found != "old" {
+		t.Errorf("search found %q, %v, want the request", found, err)
+	}
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// dbMu guards swapping db when the database is reopened. All access goes
+// through the db* wrappers below, which read db under it.
+var dbMu sync.RWMutex
+
+// Retries of statements that failed with SQLITE_BUSY or SQLITE_LOCKED after
+// busy_timeout already waited. WAL readers upgrading to writers and shared
+// table locks fail immediately instead of waiting, so they're worth retrying.
+const (
+	dbRetries      = 3
+	dbRetryBackoff = 50 * time.Millisecond
+)
+
+// Error codes sent in the X-Error-Code header of responses failed by the database
+const (
+	errorCodeDatabaseBusy        = "database_busy"
+	errorCodeDatabaseUnavailable = "database_unavailable"
+	errorCodeDatabaseError       = "database_error"
+)
+
+// currentDB returns the open database handle
+func currentDB() *sql.DB {
+	dbMu.RLock()
+	defer dbMu.RUnlock()
+	return db
+}
+
+// closeDB closes the database on shutdown
+func closeDB() error {
+	return currentDB().Close()
+}
+
+// sqliteCode returns the primary SQLite result code of err, 0 if it isn't
+// an SQLite error
+func sqliteCode(err error) int {
+	var sqliteErr *sqlite.Error
+	if errors.As(err, &sqliteErr) {
+		return sqliteErr.Code() & 0xff
+	}
+	return 0
+}
+
+// isDBBusy reports whether err is a lock conflict that goes away on its own
+func isDBBusy(err error) bool {
+	code := sqliteCode(err)
+	return code == sqlite3.SQLITE_BUSY || code == sqlite3.SQLITE_LOCKED
+}
+
+// isDBUnavailable reports whether err means the database itself can't be
+// used: the connection is gone, or the file is unreadable, unwritable or full
+func isDBUnavailable(err error) bool {
+	if errors.Is(err, sql.ErrConnDone) || errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	switch sqliteCode(err) {
+	case sqlite3.SQLITE_IOERR, sqlite3.SQLITE_CORRUPT, sqlite3.SQLITE_FULL, sqlite3.SQLITE_CANTOPEN,
+		sqlite3.SQLITE_READONLY, sqlite3.SQLITE_NOTADB:
+		return true
+	}
+	return false
+}
+
+// withDBRetry runs fn, retrying with backoff while it fails with a lock conflict
+func withDBRetry(fn func() error) error {
+	err := fn()
+	for attempt := 1; attempt <= dbRetries && isDBBusy(err); attempt++ {
+		time.Sleep(dbRetryBackoff << (attempt - 1))
+		err = fn()
+	}
+	return err
+}
+
+// dbExec runs a statement, retrying lock conflicts
+func dbExec(query string, args ...any) (sql.Result, error) {
+	var result sql.Result
+	err := withDBRetry(func() error {
+		var err error
+		result, err = currentDB().Exec(query, args...)
+		return err
+	})
+	return result, err
+}
+
+// dbQuery runs a query, retrying lock conflicts
+func dbQuery(query string, args ...any) (*sql.Rows, error) {
+	var rows *sql.Rows
+	err := withDBRetry(func() error {
+		var err error
+		rows, err = currentDB().Query(query, args...)
+		return err
+	})
+	return rows, err
+}
+
+// dbQueryRow runs a query returning at most one row. Its error only surfaces
+// on Scan, so it relies on busy_timeout alone.
+func dbQueryRow(query string, args ...any) *sql.Row {
+	return currentDB().QueryRow(query, args...)
+}
+
+// dbBegin starts a transaction, retrying lock conflicts
+func dbBegin() (*sql.Tx, error) {
+	var tx *sql.Tx
+	err := withDBRetry(func() error {
+		var err error
+		tx, err = currentDB().Begin()
+		return err
+	})
+	return tx, err
+}
+
+// dbHealth is the result of the last database health check
+var dbHealth struct {
+	sync.Mutex
+	err      error
+	failures int
+}
+
+// checkDB verifies the database answers a query within a few seconds
+func checkDB() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var one int
+	return currentDB().QueryRowContext(ctx, "SELECT 1").Scan(&one)
+}
+
+// reopenDB replaces the database handle with a freshly opened one. The old
+// handle is closed once the statements running on it finish.
+func reopenDB() error {
+	fresh, err := sql.Open("sqlite", dbDSN())
+	if err != nil {
+		return err
+	}
+	if err := fresh.Ping(); err != nil {
+		fresh.Close()
+		return err
+	}
+
+	dbMu.Lock()
+	old := db
+	db = fresh
+	dbMu.Unlock()
+	return old.Close()
+}
+
+// startDBMonitor checks the database every DB_HEALTH_INTERVAL, logging when
+// it becomes unhealthy or recovers, and reopens it after consecutive failed
+// checks
+func startDBMonitor() {
+	const reopenAfter = 3
+
+	interval, err := time.ParseDuration(envOrDefault("DB_HEALTH_INTERVAL", "30s"))
+	if err != nil || interval < time.Second {
+		log.Printf("Warning: invalid DB_HEALTH_INTERVAL, using 30s")
+		interval = 30 * time.Second
+	}
+
+	ticker := time.NewTicker(interval)
+	goSafe("", func() {
+		for range ticker.C {
+			err := checkDB()
+
+			dbHealth.Lock()
+			wasHealthy := dbHealth.err == nil
+			dbHealth.err = err
+			if err != nil {
+				dbHealth.failures++
+			} else {
+				dbHealth.failures = 0
+			}
+			failures := dbHealth.failures
+			dbHealth.Unlock()
+
+			switch {
+			case err == nil && !wasHealthy:
+				log.Printf("Database recovered")
+			case err != nil && wasHealthy:
+				log.Printf("Database health check failed: %v", err)
+				reportError("database unhealthy: "+err.Error(), nil)
+			}
+			if err != nil && failures%reopenAfter == 0 {
+				if err := reopenDB(); err != nil {
+					log.Printf("Failed to reopen database: %v", err)
+				} else {
+					log.Printf("Reopened database after %d failed health checks", failures)
+				}
+			}
+		}
+	})
+}
+
+// dbErrorStatus maps a database error to the HTTP status and error code a
+// response reports for it
+func dbErrorStatus(err error) (int, string) {
+	switch {
+	case isDBBusy(err):
+		return http.StatusServiceUnavailable, errorCodeDatabaseBusy
+	case isDBUnavailable(err):
+		return http.StatusServiceUnavailable, errorCodeDatabaseUnavailable
+	default:
+		return http.StatusInternalServerError, errorCodeDatabaseError
+	}
+}
+
+// dbHTTPError responds to a request that failed because of a database error.
+// Busy and unavailable databases get 503 with Retry-After, since retrying
+// shortly is likely to succeed, and the X-Error-Code header tells clients
+// which it was.
+func dbHTTPError(w http.ResponseWriter, err error, message string) {
+	status, code := dbErrorStatus(err)
+	w.Header().Set("X-Error-Code", code)
+	if status == http.StatusServiceUnavailable {
+		w.Header().Set("Retry-After", "5")
+	}
+	http.Error(w, message, status)
+}
+
+// dbJSONError is dbHTTPError for the JSON API, with the code in the body too
+func dbJSONError(w http.ResponseWriter, err error, message string) {
+	status, code := dbErrorStatus(err)
+	if status == http.StatusServiceUnavailable {
+		w.Header().Set("Retry-After", "5")
+	}
+	writeJSON(w, status, map[string]string{"error": message, "code": code})
+}
+
+// lookupError responds to a record that couldn't be loaded or isn't the
+// user's, what being its name such as "Request": 404 when it doesn't exist,
+// the database error otherwise
+func lookupError(w http.ResponseWriter, err error, what string) {
+	if err == nil || errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, what+" not found", http.StatusNotFound)
+		return
+	}
+	log.Printf("Failed to load %s: %v", strings.ToLower(what), err)
+	dbHTTPError(w, err, "Failed to load "+strings.ToLower(what))
+}
+
+// healthHandler reports whether the server and its database are usable, for
+// load balancer and container health checks
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	if err := checkDB(); err != nil {
+		log.Printf("Health check failed: %v", err)
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{
+			"status":   "unhealthy",
+			"database": err.Error(),
+		})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok", "database": "ok"})
+}
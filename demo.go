@@ -0,0 +1,179 @@
+package main
+
+import (
+	"embed"
+	"fmt"
+	"log"
+)
+
+// demoUserID owns the example requests seeded in demo mode. Real user IDs are
+// 16 hex characters, so it can't collide with one.
+const demoUserID = "demo"
+
+// sampleFS holds the photos and results of the demo examples
+//
+//go:embed samples/*.jpg
+var sampleFS embed.FS
+
+// demoExample is an example request seeded in demo mode, with canned weather
+// in place of a provider response
+type demoExample struct {
+	Sample    string // samples/{Sample}-original.jpg and samples/{Sample}-result.jpg
+	Location  string
+	Country   string
+	Lat, Lon  float64
+	UTCOffset int
+	Date      string
+	Weather   WeatherData
+	Tags      []string
+}
+
+// demoExamples are the requests a demo instance starts with
+var demoExamples = []demoExample{
+	{
+		Sample: "oslo", Location: "Oslo", Country: "NO", Lat: 59.9133, Lon: 10.7389, UTCOffset: 3600,
+		Date: "2024-01-14",
+		Weather: WeatherData{
+			Temp: -6.2, FeelsLike: -11.5, Pressure: 1008, Humidity: 91, Clouds: 100, Visibility: 1200,
+			WindSpeed: 4.1, WindDeg: 20, ConditionID: 601, Condition: "Snow", Description: "snow",
+			Snow: 3.4, Units: unitsMetric, Provider: weatherProviderHistory,
+		},
+		Tags: []string{"example", "snow"},
+	},
+	{
+		Sample: "london", Location: "London", Country: "GB", Lat: 51.5073, Lon: -0.1277, UTCOffset: 0,
+		Date: "2023-10-20",
+		Weather: WeatherData{
+			Temp: 11.8, FeelsLike: 10.9, Pressure: 994, Humidity: 94, Clouds: 100, Visibility: 4000,
+			WindSpeed: 9.3, WindDeg: 230, ConditionID: 502, Condition: "Rain", Description: "heavy intensity rain",
+			Rain: 8.7, Units: unitsMetric, Provider: weatherProviderHistory,
+		},
+		Tags: []string{"example", "rain"},
+	},
+	{
+		Sample: "kyoto", Location: "Kyoto", Country: "JP", Lat: 35.0116, Lon: 135.7681, UTCOffset: 32400,
+		Date: "2024-04-02",
+		Weather: WeatherData{
+			Temp: 9.4, FeelsLike: 8.8, Pressure: 1016, Humidity: 97, Clouds: 40, Visibility: 600,
+			WindSpeed: 0.8, WindDeg: 90, ConditionID: 741, Condition: "Fog", Description: "fog",
+			Units: unitsMetric, Provider: weatherProviderHistory,
+		},
+		Tags: []string{"example", "fog"},
+	},
+}
+
+// demoEnabled reports whether the demo examples are shown
+func demoEnabled() bool {
+	return currentConfig().DemoMode
+}
+
+// isDemoRequest reports whether a request is one of the demo examples, which
+// every visitor can view but nobody can change
+func isDemoRequest(req *Request) bool {
+	return req.UserID == demoUserID
+}
+
+// seedDemoData adds the demo examples as completed requests, unless they
+// were seeded before. Nothing is sent to the weather or image APIs.
+func seedDemoData() error {
+	if !demoEnabled() {
+		return nil
+	}
+	existing, err := listRequests(demoUserID, RequestFilter{}, 1, 0)
+	if err != nil {
+		return err
+	}
+	if len(existing) > 0 {
+		return nil
+	}
+
+	for _, example := range demoExamples {
+		if err := seedDemoExample(example); err != nil {
+			return fmt.Errorf("failed to seed %s example: %w", example.Sample, err)
+		}
+	}
+	log.Printf("Seeded %d demo examples", len(demoExamples))
+	return nil
+}
+
+// seedDemoExample stores one example the way the pipeline would have: its
+// photo, geocode, weather and prompt, and a completed initial revision
+func seedDemoExample(example demoExample) error {
+	requestID, err := generateID(16)
+	if err != nil {
+		return err
+	}
+	revisionID, err := generateID(16)
+	if err != nil {
+		return err
+	}
+
+	imagePath, err := storeSample(example.Sample + "-original.jpg")
+	if err != nil {
+		return err
+	}
+	resultPath, err := storeSample(example.Sample + "-result.jpg")
+	if err != nil {
+		return err
+	}
+
+	req := &Request{
+		ID:            requestID,
+		UserID:        demoUserID,
+		LocationInput: example.Location,
+		TargetDate:    example.Date,
+		Units:         unitsMetric,
+		Intensity:     intensityNatural,
+		ImagePath:     imagePath,
+		Status:        "pending",
+	}
+	if err := saveRequest(req); err != nil {
+		return err
+	}
+
+	loc, err := canonicalLocation(example.Location, example.Country, example.Lat, example.Lon)
+	if err != nil {
+		return err
+	}
+	if err := updateRequestGeocode(requestID, loc, example.Lat, example.Lon, example.UTCOffset, nil, ""); err != nil {
+		return err
+	}
+
+	// The rule-based prompt, so seeding never calls an LLM. No prompt variant
+	// is recorded, which keeps the examples out of experiment reports.
+	weatherData := example.Weather
+	prompt, _ := rulePromptGenerator{}.GeneratePrompt(PromptInput{
+		Weather:  weatherData.metric(),
+		Location: promptLocation(loc.Name, loc.Country),
+		Seed:     requestID,
+		Variant:  defaultPromptVariant,
+	})
+	if err := updateRequestWeather(requestID, &weatherData, prompt, ""); err != nil {
+		return err
+	}
+
+	rev := &Revision{
+		ID:        revisionID,
+		RequestID: requestID,
+		Kind:      revisionInitial,
+		Prompt:    prompt,
+		Intensity: intensityNatural,
+		Model:     currentConfig().ReplicateModel,
+	}
+	if err := createRevision(rev); err != nil {
+		return err
+	}
+	if err := completeRevision(rev, resultPath); err != nil {
+		return err
+	}
+	return setRequestTags(demoUserID, requestID, example.Tags)
+}
+
+// storeSample stores an embedded sample image as a blob, returning its path
+func storeSample(name string) (string, error) {
+	data, err := sampleFS.ReadFile("samples/" + name)
+	if err != nil {
+		return "", err
+	}
+	return storeBlob(data, ".jpg")
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package main
+
+import "errors"
+
+// freeDiskSpace isn't supported on this platform
+func freeDiskSpace(path string) (uint64, error) {
+	return 0, errors.New("free disk space can't be checked on this platform")
+}
@@ -0,0 +1,449 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Results of a --doctor check
+const (
+	doctorPass = "PASS"
+	doctorWarn = "WARN"
+	doctorFail = "FAIL"
+)
+
+// Free space below lowDiskSpace is a warning and below minDiskSpace a
+// failure, since uploads and results are written to DATA_DIR
+const (
+	minDiskSpace = 200 << 20
+	lowDiskSpace = 2 << 30
+)
+
+// requiredTemplates are the pages and fragments the handlers render by name
+var requiredTemplates = []string{
+	"home.html", "login.html", "terms.html", "trial.html", "start.html", "review.html", "confirm.html", "processing.html",
+	"status.html", "batch.html", "results.html", "settings.html", "data_export.html", "delete_data.html", "500.html", "report_email.html",
+	"admin_experiments.html", "admin_queue.html", "admin_reports.html", "admin_presets.html",
+	"admin_benchmarks.html", "admin_benchmark.html", "admin_erasures.html",
+	"weather_card", "gallery_tile", "queue_position",
+}
+
+// doctorCheck is one line of the --doctor report
+type doctorCheck struct {
+	Name   string
+	Status string // doctorPass, doctorWarn or doctorFail
+	Detail string
+}
+
+// runDoctor checks the deployment without starting the server: templates,
+// database schema, disk space and every configured API credential, using
+// read-only calls that cost nothing. It prints a report and returns the
+// process exit code, 1 if any check failed.
+func runDoctor(out io.Writer) int {
+	cfg, checks := checkConfig()
+	checks = append(checks, checkTemplates(), checkDataDir(), checkDatabase(), checkDiskSpace())
+	if cfg == nil {
+		return printDoctorReport(out, checks)
+	}
+	config.Store(cfg)
+
+	checks = append(checks, checkOpenWeather(cfg), checkReplicateToken(cfg))
+	if cfg.ReplicateAPIToken != "" {
+		for _, m := range cfg.BenchmarkModels {
+			checks = append(checks, checkReplicateModel(cfg, m.Name))
+		}
+		if cfg.CaptionModel != "" {
+			checks = append(checks, checkReplicateModel(cfg, cfg.CaptionModel))
+		}
+		if cfg.FaceModel != "" {
+			checks = append(checks, checkReplicateModel(cfg, cfg.FaceModel))
+		}
+	}
+	checks = append(checks, checkPromptGenerator(cfg), checkSMTP(cfg), checkAntivirus(cfg), checkCache(cfg), checkSessions(cfg), checkGeoIP(), checkPassphrases(cfg))
+	return printDoctorReport(out, checks)
+}
+
+// printDoctorReport prints the checks and returns the process exit code, 1
+// if any check failed
+func printDoctorReport(out io.Writer, checks []doctorCheck) int {
+	tw := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	failed := 0
+	for _, c := range checks {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", c.Status, c.Name, c.Detail)
+		if c.Status == doctorFail {
+			failed++
+		}
+	}
+	tw.Flush()
+
+	if failed > 0 {
+		fmt.Fprintf(out, "\n%d of %d checks failed\n", failed, len(checks))
+		return 1
+	}
+	fmt.Fprintf(out, "\nAll %d checks passed\n", len(checks))
+	return 0
+}
+
+// checkConfig loads the configuration. Secret managers that can't be read
+// are reported as a check of their own, and the rest of the configuration is
+// checked without their settings; a configuration that can't be loaded at all
+// returns nil, leaving only the checks that don't need it.
+func checkConfig() (*Config, []doctorCheck) {
+	secrets := doctorCheck{Name: "secret managers"}
+	cfg, err := loadConfigWith(func(lookup func(key string) string) (map[string]string, error) {
+		if lookup("VAULT_SECRET_PATH") == "" && lookup("AWS_SECRETS_MANAGER_SECRET_ID") == "" {
+			secrets.Status, secrets.Detail = doctorPass, "VAULT_SECRET_PATH and AWS_SECRETS_MANAGER_SECRET_ID not set"
+			return nil, nil
+		}
+		values, err := fetchManagedSecrets(lookup)
+		if err != nil {
+			secrets.Status, secrets.Detail = doctorFail, err.Error()+"; checking the rest without their settings"
+			return nil, nil
+		}
+		secrets.Status, secrets.Detail = doctorPass, fmt.Sprintf("%d settings read", len(values))
+		return values, nil
+	})
+
+	var checks []doctorCheck
+	if secrets.Status != "" {
+		checks = append(checks, secrets)
+	}
+	if err != nil {
+		return nil, append(checks, doctorCheck{Name: "configuration", Status: doctorFail, Detail: err.Error()})
+	}
+	return cfg, append(checks, doctorCheck{Name: "configuration", Status: doctorPass, Detail: "settings are valid"})
+}
+
+// checkTemplates parses the templates the way the server does and makes sure
+// every page is there
+func checkTemplates() doctorCheck {
+	check := doctorCheck{Name: "templates"}
+	parsed, err := parseTemplates()
+	if err != nil {
+		check.Status, check.Detail = doctorFail, err.Error()
+		return check
+	}
+	var missing []string
+	for _, name := range requiredTemplates {
+		if parsed.Lookup(name) == nil {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		check.Status, check.Detail = doctorFail, "missing "+strings.Join(missing, ", ")
+		return check
+	}
+	check.Status, check.Detail = doctorPass, fmt.Sprintf("%d pages and fragments found", len(requiredTemplates))
+	return check
+}
+
+// checkDataDir makes sure uploads and the database can be written
+func checkDataDir() doctorCheck {
+	check := doctorCheck{Name: "data directory"}
+	if err := os.MkdirAll(dataDir, 0755); err != nil {
+		check.Status, check.Detail = doctorFail, err.Error()
+		return check
+	}
+	file, err := os.CreateTemp(dataDir, ".doctor-*")
+	if err != nil {
+		check.Status, check.Detail = doctorFail, "not writable: "+err.Error()
+		return check
+	}
+	file.Close()
+	os.Remove(file.Name())
+	abs, _ := filepath.Abs(dataDir)
+	check.Status, check.Detail = doctorPass, abs+" is writable"
+	return check
+}
+
+// checkDatabase opens the database and compares its tables with the current
+// schema. An outdated one is upgraded in a copy, to tell whether starting the
+// server keeps its data; the database itself isn't migrated.
+func checkDatabase() doctorCheck {
+	check := doctorCheck{Name: "database schema"}
+	if _, err := os.Stat(dbPath()); os.IsNotExist(err) {
+		check.Status, check.Detail = doctorPass, "no database yet, it will be created on startup"
+		return check
+	}
+	if err := openDB(); err != nil {
+		check.Status, check.Detail = doctorFail, err.Error()
+		return check
+	}
+	defer db.Close()
+	if err := db.Ping(); err != nil {
+		check.Status, check.Detail = doctorFail, err.Error()
+		return check
+	}
+	if err := checkAndMigrate(); err == nil {
+		check.Status, check.Detail = doctorPass, "up to date"
+		return check
+	}
+	if err := checkDatabaseUpgrade(); err != nil {
+		check.Status = doctorFail
+		check.Detail = "out of date, starting the server will drop and recreate every table: " + err.Error()
+		return check
+	}
+	check.Status, check.Detail = doctorPass, "out of date, starting the server will upgrade it in place"
+	return check
+}
+
+// checkDatabaseUpgrade migrates a copy of the open database in a temporary
+// directory and compares the result with the current schema
+func checkDatabaseUpgrade() error {
+	dir, err := os.MkdirTemp("", "skyweave-doctor-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	if _, err := dbExec("VACUUM INTO ?", filepath.Join(dir, "skyweave.db")); err != nil {
+		return err
+	}
+
+	original, originalDir := db, dataDir
+	defer func() { db, dataDir = original, originalDir }()
+	dataDir = dir
+	if err := openDB(); err != nil {
+		return err
+	}
+	defer db.Close()
+	if err := migrateSchema(); err != nil {
+		return err
+	}
+	return checkAndMigrate()
+}
+
+// checkDiskSpace warns when the data directory's filesystem is filling up
+func checkDiskSpace() doctorCheck {
+	check := doctorCheck{Name: "disk space"}
+	free, err := freeDiskSpace(dataDir)
+	if err != nil {
+		check.Status, check.Detail = doctorWarn, err.Error()
+		return check
+	}
+	detail := fmt.Sprintf("%.1f GB free", float64(free)/(1<<30))
+	switch {
+	case free < minDiskSpace:
+		check.Status, check.Detail = doctorFail, detail
+	case free < lowDiskSpace:
+		check.Status, check.Detail = doctorWarn, detail
+	default:
+		check.Status, check.Detail = doctorPass, detail
+	}
+	return check
+}
+
+// checkOpenWeather looks up a city to verify OPENWEATHER_API_KEY
+func checkOpenWeather(cfg *Config) doctorCheck {
+	check := doctorCheck{Name: "OpenWeather API key"}
+	if cfg.OpenWeatherAPIKey == "" {
+		check.Status, check.Detail = doctorWarn, "OPENWEATHER_API_KEY not set, weather lookups are skipped"
+		return check
+	}
+	apiURL := "http://api.openweathermap.org/geo/1.0/direct?q=London&limit=1&appid=" + url.QueryEscape(cfg.OpenWeatherAPIKey)
+	return doctorGet(check, apiURL, nil)
+}
+
+// checkReplicateToken fetches the Replicate account to verify REPLICATE_API_TOKEN
+func checkReplicateToken(cfg *Config) doctorCheck {
+	check := doctorCheck{Name: "Replicate API token"}
+	if cfg.ReplicateAPIToken == "" {
+		check.Status, check.Detail = doctorFail, "REPLICATE_API_TOKEN not set, images can't be generated"
+		return check
+	}
+	return doctorGet(check, "https://api.replicate.com/v1/account",
+		map[string]string{"Authorization": "Bearer " + cfg.ReplicateAPIToken})
+}
+
+// checkReplicateModel makes sure a configured model (and version) exists
+func checkReplicateModel(cfg *Config, model string) doctorCheck {
+	check := doctorCheck{Name: "model " + model}
+	name, version, hasVersion := strings.Cut(model, ":")
+	apiURL := "https://api.replicate.com/v1/models/" + name
+	if hasVersion {
+		apiURL += "/versions/" + version
+	}
+	return doctorGet(check, apiURL, map[string]string{"Authorization": "Bearer " + cfg.ReplicateAPIToken})
+}
+
+// checkPromptGenerator lists the LLM provider's models to verify its URL and key
+func checkPromptGenerator(cfg *Config) doctorCheck {
+	check := doctorCheck{Name: "prompt generator"}
+	g, ok := cfg.PromptGenerator.(*llmPromptGenerator)
+	if !ok {
+		check.Status, check.Detail = doctorPass, "rule-based, nothing to check"
+		return check
+	}
+	check.Name = "prompt generator (" + g.Provider + ")"
+	switch g.Provider {
+	case promptGeneratorOpenAI:
+		return doctorGet(check, g.BaseURL+"/models", map[string]string{"Authorization": "Bearer " + g.APIKey})
+	case promptGeneratorAnthropic:
+		return doctorGet(check, g.BaseURL+"/v1/models",
+			map[string]string{"x-api-key": g.APIKey, "anthropic-version": "2023-06-01"})
+	default:
+		return doctorGet(check, g.BaseURL+"/api/tags", nil)
+	}
+}
+
+// checkSMTP connects to the mail server report emails are sent through
+func checkSMTP(cfg *Config) doctorCheck {
+	check := doctorCheck{Name: "SMTP server"}
+	if cfg.SMTPHost == "" {
+		check.Status, check.Detail = doctorPass, "SMTP_HOST not set, report emails are disabled"
+		return check
+	}
+	addr := net.JoinHostPort(cfg.SMTPHost, cfg.SMTPPort)
+	conn, err := net.DialTimeout("tcp", addr, 10*time.Second)
+	if err != nil {
+		check.Status, check.Detail = doctorFail, err.Error()
+		return check
+	}
+	conn.Close()
+	check.Status, check.Detail = doctorPass, addr+" is reachable"
+	return check
+}
+
+// checkAntivirus pings the virus scanner named by ANTIVIRUS. Without
+// ANTIVIRUS_FAIL_OPEN uploads are turned away while it can't be reached.
+func checkAntivirus(cfg *Config) doctorCheck {
+	check := doctorCheck{Name: "virus scanner"}
+	if cfg.Antivirus == nil {
+		check.Status, check.Detail = doctorPass, "ANTIVIRUS not set, uploads aren't scanned"
+		return check
+	}
+	if err := cfg.Antivirus.Ping(); err != nil {
+		check.Status, check.Detail = doctorFail, err.Error()
+		if cfg.AntivirusFailOpen {
+			check.Status, check.Detail = doctorWarn, err.Error()+", uploads are accepted unscanned"
+		}
+		return check
+	}
+	check.Status, check.Detail = doctorPass, cfg.Antivirus.Name()+" is reachable"
+	return check
+}
+
+// checkCache pings the Redis server named by CACHE_URL
+func checkCache(cfg *Config) doctorCheck {
+	check := doctorCheck{Name: "cache"}
+	rawURL := cfg.CacheURL
+	if rawURL == "" {
+		check.Status, check.Detail = doctorPass, "CACHE_URL not set, caching in memory"
+		return check
+	}
+	cache, err := newRedisCache(rawURL)
+	if err == nil {
+		err = cache.Ping()
+	}
+	if err != nil {
+		check.Status, check.Detail = doctorFail, err.Error()
+		return check
+	}
+	check.Status, check.Detail = doctorPass, "Redis at "+cache.addr+" answers"
+	return check
+}
+
+// checkSessions checks the settings of the SESSION_STORE picked
+func checkSessions(cfg *Config) doctorCheck {
+	check := doctorCheck{Name: "sessions"}
+	switch store := envOrDefault("SESSION_STORE", "database"); store {
+	case "database":
+		check.Status, check.Detail = doctorPass, "kept in the database"
+	case "redis":
+		if cfg.CacheURL == "" {
+			check.Status, check.Detail = doctorFail, "SESSION_STORE=redis needs CACHE_URL to point at Redis"
+		} else {
+			check.Status, check.Detail = doctorPass, "kept in the Redis server of CACHE_URL"
+		}
+	case "cookie":
+		keys, err := parseSessionKeys(cfg.SessionKeys)
+		if err != nil {
+			check.Status, check.Detail = doctorFail, err.Error()
+		} else {
+			check.Status, check.Detail = doctorPass, fmt.Sprintf("signed cookies, %d key(s) accepted", len(keys))
+		}
+	default:
+		check.Status, check.Detail = doctorFail, fmt.Sprintf("unknown SESSION_STORE %q", store)
+	}
+	return check
+}
+
+// checkGeoIP checks that the GEOIP_DB database can be read
+func checkGeoIP() doctorCheck {
+	check := doctorCheck{Name: "GeoIP"}
+	path := os.Getenv("GEOIP_DB")
+	if path == "" {
+		check.Status, check.Detail = doctorPass, "GEOIP_DB not set, no location suggestions"
+		return check
+	}
+	db, err := openGeoIPDB(path)
+	if err != nil {
+		check.Status, check.Detail = doctorFail, err.Error()
+		return check
+	}
+	check.Status, check.Detail = doctorPass, fmt.Sprintf("%s, IPv%d", db.databaseType, db.ipVersion)
+	return check
+}
+
+// checkPassphrases points out an app open to everyone
+func checkPassphrases(cfg *Config) doctorCheck {
+	check := doctorCheck{Name: "passphrases"}
+	switch {
+	case cfg.AccessPassphrase == "":
+		check.Status, check.Detail = doctorWarn, "ACCESS_PASSPHRASE not set, anyone can use the app"
+	case cfg.AdminPassphrase == "":
+		check.Status, check.Detail = doctorWarn, "ADMIN_PASSPHRASE not set, admin pages are disabled"
+	default:
+		check.Status, check.Detail = doctorPass, "access and admin passphrases set"
+	}
+	return check
+}
+
+// doctorGet makes a read-only API call and fills in check from the response status
+func doctorGet(check doctorCheck, apiURL string, headers map[string]string) doctorCheck {
+	req, err := http.NewRequest("GET", apiURL, nil)
+	if err != nil {
+		check.Status, check.Detail = doctorFail, err.Error()
+		return check
+	}
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		check.Status, check.Detail = doctorFail, fmt.Sprintf("request failed: %v", redactURLError(err))
+		return check
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		check.Status, check.Detail = doctorPass, "OK"
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		check.Status, check.Detail = doctorFail, fmt.Sprintf("rejected (%s), check the credentials", resp.Status)
+	case resp.StatusCode == http.StatusNotFound:
+		check.Status, check.Detail = doctorFail, "not found"
+	default:
+		check.Status, check.Detail = doctorWarn, "unexpected response: "+resp.Status
+	}
+	return check
+}
+
+// redactURLError drops the URL from an HTTP client error, since some APIs
+// take their key as a query parameter
+func redactURLError(err error) error {
+	if urlErr, ok := err.(*url.Error); ok {
+		return urlErr.Err
+	}
+	return err
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Drafts keep what a user entered on the start form before submitting it,
+// so leaving the page, or coming back days later, doesn't lose it. The form
+// saves itself as it's filled in, and the "Save draft" button saves it
+// without scripts; rejected submissions are kept the same way. One draft is
+// kept per user cookie, the identity requests are tied to, and the start page
+// offers to resume it. Photos aren't kept, since browsers can't fill a file
+// input back in.
+
+const (
+	// draftTTL is how long a draft is kept after it was last saved
+	draftTTL = 30 * 24 * time.Hour
+
+	// maxDraftValue leaves out values no field of the form needs
+	maxDraftValue = 4096
+)
+
+// draftFields are the fields of the start form a draft keeps; uploaded
+// photos, CAPTCHA tokens and anything else posted are left out
+var draftFields = []string{
+	"location", "location_mode", "location_name", "country", "latitude", "longitude", "local_names",
+	"date", "end_date", "range_mode", "time_of_day", "units", "intensity", "preset", "preset_mode",
+	"photo_url", "review_photo", "postcard",
+}
+
+// Draft is the start form of a user who filled it in partway
+type Draft struct {
+	UserID    string
+	Fields    url.Values
+	UpdatedAt string
+}
+
+// draftValues picks the fields a draft keeps out of a posted form. It
+// returns nil when nothing worth resuming was entered: no location or date.
+func draftValues(form url.Values) url.Values {
+	if form.Get("location") == "" && form.Get("date") == "" && form.Get("end_date") == "" {
+		return nil
+	}
+	fields := url.Values{}
+	for _, name := range draftFields {
+		if value := form.Get(name); value != "" && len(value) <= maxDraftValue {
+			fields.Set(name, value)
+		}
+	}
+	return fields
+}
+
+// keepDraft saves what was entered on a posted start form as the user's
+// draft, if anything was. Failures are only logged; a draft is never worth
+// failing a request over.
+func keepDraft(userID string, form url.Values) {
+	fields := draftValues(form)
+	if fields == nil {
+		return
+	}
+	if err := saveDraft(userID, fields); err != nil {
+		log.Printf("Failed to save draft of user %s: %v", userID, err)
+	}
+}
+
+// loadDraft returns a user's draft, or nil when they have none
+func loadDraft(userID string) *Draft {
+	draft, err := getDraft(userID)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			log.Printf("Failed to load draft of user %s: %v", userID, err)
+		}
+		return nil
+	}
+	return draft
+}
+
+// saveDraftHandler saves the start form as it's being filled in. The form
+// posts itself here when it changes and when the page is left.
+func saveDraftHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserID(w, r)
+	if err != nil {
+		http.Error(w, "Failed to generate user ID", http.StatusInternalServerError)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, 64<<10)
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Failed to parse form", http.StatusBadRequest)
+		return
+	}
+	// A form emptied again has nothing left to resume
+	if draftValues(r.PostForm) == nil {
+		if err := deleteDraft(userID); err != nil {
+			log.Printf("Failed to discard draft of user %s: %v", userID, err)
+		}
+	} else {
+		keepDraft(userID, r.PostForm)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// discardDraftHandler removes the user's draft and shows an empty start form
+func discardDraftHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserID(w, r)
+	if err != nil {
+		http.Error(w, "Failed to generate user ID", http.StatusInternalServerError)
+		return
+	}
+	if err := deleteDraft(userID); err != nil {
+		log.Printf("Failed to discard draft of user %s: %v", userID, err)
+		dbHTTPError(w, err, "Failed to discard draft")
+		return
+	}
+	http.Redirect(w, r, "/start", http.StatusSeeOther)
+}
+
+// startDraftCleanup deletes drafts left alone for longer than draftTTL,
+// now and every hour
+func startDraftCleanup() {
+	ticker := time.NewTicker(time.Hour)
+	goSafe("", func() {
+		cleanupDrafts()
+		for range ticker.C {
+			cleanupDrafts()
+		}
+	})
+}
+
+// cleanupDrafts deletes the drafts not saved within draftTTL
+func cleanupDrafts() {
+	n, err := deleteStaleDrafts(time.Now().Add(-draftTTL))
+	if err != nil {
+		log.Printf("Failed to delete stale drafts: %v", err)
+		return
+	}
+	if n > 0 {
+		log.Printf("Deleted %d stale drafts", n)
+	}
+}
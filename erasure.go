@@ -0,0 +1,242 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Erasure is a request to delete everything stored about a user: their
+// requests with uploads, results and feedback, tags, saved locations and
+// settings. Erasures are purged in the background.
+type Erasure struct {
+	UserID          string
+	RequestedBy     string // erasureByUser or erasureByAdmin
+	RequestedAt     string
+	CompletedAt     string // empty until purged
+	RequestsDeleted int
+	FilesDeleted    int
+}
+
+// Who asked for an erasure
+const (
+	erasureByUser  = "user"
+	erasureByAdmin = "admin"
+)
+
+// erasureConfirmation is what users type to confirm deleting their data
+const erasureConfirmation = "DELETE"
+
+// erasureGracePeriod is how long a purge waits for the user's generations in
+// progress to finish, so their results aren't written after it
+const erasureGracePeriod = time.Hour
+
+// erasureMu keeps this instance's purges from overlapping
+var erasureMu sync.Mutex
+
+// startErasures purges pending erasures at startup and every minute
+func startErasures() {
+	ticker := time.NewTicker(time.Minute)
+	goSafe("", func() {
+		purgeErasures()
+		for range ticker.C {
+			purgeErasures()
+		}
+	})
+}
+
+// purgeErasures purges the pending erasures of users with nothing in
+// progress, and of the others once erasureGracePeriod has passed
+func purgeErasures() {
+	erasureMu.Lock()
+	defer erasureMu.Unlock()
+
+	erasures, err := getPendingErasures()
+	if err != nil {
+		log.Printf("Failed to load pending erasures: %v", err)
+		return
+	}
+	for _, e := range erasures {
+		busy, err := userWorkInProgress(e.UserID)
+		if err != nil {
+			log.Printf("Failed to check work in progress of user %s: %v", e.UserID, err)
+			continue
+		}
+		if busy {
+			requested, err := parseSQLiteTime(e.RequestedAt)
+			if err == nil && time.Since(requested) < erasureGracePeriod {
+				continue
+			}
+		}
+		if err := purgeUserData(e.UserID); err != nil {
+			log.Printf("Failed to erase data of user %s: %v", e.UserID, err)
+		}
+	}
+}
+
+// purgeUserData deletes a user's data: photos waiting for review, published
+// results and stored files first, then their rows, so a purge that fails
+// part way can be run again. Blobs can be shared with other requests, so
+// they're deleted with the rows, if nothing else refers to them; blobs left
+// behind by a failure are collected later.
+func purgeUserData(userID string) error {
+	data, err := getUserData(userID)
+	if err != nil {
+		return err
+	}
+
+	for _, id := range data.Reviewing {
+		if primary, ok := cacheGet("reviewing:" + id); ok {
+			if sub, ok := claimPhotoReview(string(primary)); ok {
+				forgetPhotoReview(string(primary), sub)
+			}
+		}
+	}
+
+	if len(data.Published) > 0 {
+		publisher := currentConfig().Publisher
+		if publisher == nil {
+			return errors.New("results were published but PUBLISH_S3_BUCKET is no longer set")
+		}
+		for _, rev := range data.Published {
+			if err := publisher.Unpublish(rev); err != nil {
+				return err
+			}
+		}
+	}
+
+	files := 0
+	var blobs []string
+	for _, path := range data.Files {
+		if isBlobPath(path) {
+			blobs = append(blobs, path)
+			continue
+		}
+		err := os.Remove(path)
+		if err == nil {
+			files++
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	requests, files, err := eraseUserRows(userID, files, blobs)
+	if err != nil {
+		return err
+	}
+	log.Printf("Erased data of user %s: %d requests and %d files", userID, requests, files)
+	return nil
+}
+
+// deleteDataHandler shows what deleting the user's data removes, asking them
+// to confirm by typing erasureConfirmation
+func deleteDataHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserID(w, r)
+	if err != nil {
+		http.Error(w, "Failed to generate user ID", http.StatusInternalServerError)
+		return
+	}
+	renderDeleteData(w, r, userID, http.StatusOK, "")
+}
+
+// renderDeleteData renders the confirmation page, with an error if the last
+// confirmation was wrong
+func renderDeleteData(w http.ResponseWriter, r *http.Request, userID string, status int, errMsg string) {
+	requests, locations, err := countUserData(userID)
+	if err != nil {
+		log.Printf("Failed to count data of user %s: %v", userID, err)
+		dbHTTPError(w, err, "Failed to load your data")
+		return
+	}
+
+	data := struct {
+		Locale       string
+		Requests     int
+		Locations    int
+		Confirmation string
+		Error        string
+		Requested    bool
+	}{
+		Locale:       loadUserSettings(r, userID).Locale,
+		Requests:     requests,
+		Locations:    locations,
+		Confirmation: erasureConfirmation,
+		Error:        errMsg,
+	}
+
+	w.WriteHeader(status)
+	templates.ExecuteTemplate(w, "delete_data.html", data)
+}
+
+// confirmDeleteDataHandler queues the erasure of the user's data and signs
+// them out. The purge runs in the background right away.
+func confirmDeleteDataHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserID(w, r)
+	if err != nil {
+		http.Error(w, "Failed to generate user ID", http.StatusInternalServerError)
+		return
+	}
+	if strings.TrimSpace(r.FormValue("confirm")) != erasureConfirmation {
+		renderDeleteData(w, r, userID, http.StatusUnprocessableEntity,
+			"Type "+erasureConfirmation+" to confirm.")
+		return
+	}
+
+	if err := requestErasure(userID, erasureByUser); err != nil {
+		log.Printf("Failed to request erasure of user %s: %v", userID, err)
+		dbHTTPError(w, err, "Failed to delete your data")
+		return
+	}
+	log.Printf("User %s asked for their data to be erased", userID)
+	forgetUser(w, r)
+	goSafe("", purgeErasures)
+
+	data := struct {
+		Locale    string
+		Requested bool
+	}{
+		Locale:    loadUserSettings(r, userID).Locale,
+		Requested: true,
+	}
+	templates.ExecuteTemplate(w, "delete_data.html", data)
+}
+
+// adminErasuresHandler lists recent erasures with a form to erase a user's data
+func adminErasuresHandler(w http.ResponseWriter, r *http.Request) {
+	erasures, err := getRecentErasures(50)
+	if err != nil {
+		log.Printf("Failed to load erasures: %v", err)
+		dbHTTPError(w, err, "Failed to load erasures")
+		return
+	}
+
+	templates.ExecuteTemplate(w, "admin_erasures.html", erasures)
+}
+
+// adminEraseHandler queues the erasure of a user's data on an operator's
+// behalf, for requests that don't come through the settings page
+func adminEraseHandler(w http.ResponseWriter, r *http.Request) {
+	userID := strings.TrimSpace(r.FormValue("user_id"))
+	if !isValidUserID(userID) {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+	if r.FormValue("confirm") == "" {
+		http.Error(w, "Erasure not confirmed", http.StatusBadRequest)
+		return
+	}
+
+	if err := requestErasure(userID, erasureByAdmin); err != nil {
+		log.Printf("Failed to request erasure of user %s: %v", userID, err)
+		dbHTTPError(w, err, "Failed to request erasure")
+		return
+	}
+	log.Printf("Admin asked for the data of user %s to be erased", userID)
+	goSafe("", purgeErasures)
+
+	http.Redirect(w, r, "/admin/erasures", http.StatusSeeOther)
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Pipeline errors. Failures are wrapped with one of these so the stage that
+// stores the error can classify it without parsing message text.
+var (
+	ErrLocationNotFound   = errors.New("location not found")
+	ErrWeatherUnavailable = errors.New("weather data unavailable")
+	ErrProviderQuota      = errors.New("provider quota exceeded")
+	ErrProviderAuth       = errors.New("provider rejected the API key")
+	ErrProviderBilling    = errors.New("provider billing limit reached")
+	ErrModelFailed        = errors.New("image model failed")
+	ErrInterrupted        = errors.New("interrupted by a server restart")
+	ErrUploadInfected     = errors.New("upload flagged by the virus scanner")
+)
+
+// Error codes stored in requests.error_code and used to pick the error template
+const (
+	errorCodeLocationNotFound   = "location_not_found"
+	errorCodeWeatherUnavailable = "weather_unavailable"
+	errorCodeProviderQuota      = "provider_quota"
+	errorCodeModelFailed        = "model_failed"
+	errorCodeInterrupted        = "interrupted"
+	errorCodeUploadInfected     = "upload_infected"
+	errorCodeInternal           = "internal"
+)
+
+// Providers, named in the error codes of their failures, as
+// <provider>_auth, <provider>_quota or <provider>_billing
+const (
+	providerOpenWeather = "openweather"
+	providerOpenMeteo   = "openmeteo"
+	providerMapTiles    = "tiles"
+	providerReplicate   = "replicate"
+	providerLLM         = "llm"
+)
+
+// providerNames name providers to users and in alerts
+var providerNames = map[string]string{
+	providerOpenWeather: "OpenWeather",
+	providerOpenMeteo:   "Open-Meteo",
+	providerMapTiles:    "the map tile server",
+	providerReplicate:   "Replicate",
+	providerLLM:         "the prompt model",
+}
+
+// providerFailures are the provider failures with error codes of their own,
+// by the suffix of the code
+var providerFailures = map[error]string{
+	ErrProviderAuth:    "auth",
+	ErrProviderQuota:   "quota",
+	ErrProviderBilling: "billing",
+}
+
+// errorCode maps an error to the code stored with the request
+func errorCode(err error) string {
+	var perr *ProviderError
+	if errors.As(err, &perr) {
+		if failure, ok := providerFailures[perr.Kind]; ok && perr.Provider != "" {
+			return perr.Provider + "_" + failure
+		}
+	}
+	switch {
+	case errors.Is(err, ErrLocationNotFound):
+		return errorCodeLocationNotFound
+	case errors.Is(err, ErrWeatherUnavailable):
+		return errorCodeWeatherUnavailable
+	case errors.Is(err, ErrProviderQuota):
+		return errorCodeProviderQuota
+	case errors.Is(err, ErrModelFailed):
+		return errorCodeModelFailed
+	case errors.Is(err, ErrInterrupted):
+		return errorCodeInterrupted
+	case errors.Is(err, ErrUploadInfected):
+		return errorCodeUploadInfected
+	default:
+		return errorCodeInternal
+	}
+}
+
+// providerFailure splits an error code into the provider and failure it
+// names, or returns empty strings for codes that aren't a provider's
+func providerFailure(code string) (provider, failure string) {
+	i := strings.LastIndexByte(code, '_')
+	if i < 0 {
+		return "", ""
+	}
+	provider, failure = code[:i], code[i+1:]
+	if _, ok := providerNames[provider]; !ok {
+		return "", ""
+	}
+	for _, known := range providerFailures {
+		if failure == known {
+			return provider, failure
+		}
+	}
+	return "", ""
+}
+
+// ProviderError is a non-success response from one of the outside APIs
+type ProviderError struct {
+	Provider string // one of the provider* constants
+	API      string
+	Status   string
+	Body     string
+	Kind     error // classification of the failure, nil when unclassified
+}
+
+func (e *ProviderError) Error() string {
+	if e.Kind == nil {
+		return fmt.Sprintf("%s error: %s - %s", e.API, e.Status, e.Body)
+	}
+	return fmt.Sprintf("%s error: %s - %s: %v", e.API, e.Status, e.Body, e.Kind)
+}
+
+func (e *ProviderError) Unwrap() error {
+	return e.Kind
+}
+
+// providerError builds an error for a non-success provider response. Rejected
+// keys are classified as ErrProviderAuth, rate limits as ErrProviderQuota and
+// billing responses as ErrProviderBilling, and the operator is alerted about
+// them; anything else is classified as kind (which may be nil for unclassified
+// failures). Responses expected to fail are given no provider and classified
+// as kind only.
+func providerError(provider, api string, resp *http.Response, body []byte, kind error) error {
+	switch {
+	case provider == "":
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		kind = ErrProviderAuth
+	case resp.StatusCode == http.StatusTooManyRequests:
+		kind = ErrProviderQuota
+	case resp.StatusCode == http.StatusPaymentRequired:
+		kind = ErrProviderBilling
+	}
+	err := &ProviderError{Provider: provider, API: api, Status: resp.Status, Body: string(body), Kind: kind}
+	if _, ok := providerFailures[kind]; ok {
+		alertProviderFailure(err)
+	}
+	return err
+}
+
+// providerAlertInterval is how often the same failure of a provider is
+// alerted about at most
+const providerAlertInterval = time.Hour
+
+var (
+	providerAlertsMu sync.Mutex
+	providerAlerts   = map[string]time.Time{} // error code -> last alerted
+)
+
+// alertProviderFailure tells the operator about a provider failure only they
+// can fix, like an expired key or a spent budget, once an hour per provider
+// and failure, since every request hits it until it's fixed
+func alertProviderFailure(err *ProviderError) {
+	code := errorCode(err)
+	providerAlertsMu.Lock()
+	if last, ok := providerAlerts[code]; ok && time.Since(last) < providerAlertInterval {
+		providerAlertsMu.Unlock()
+		return
+	}
+	providerAlerts[code] = time.Now()
+	providerAlertsMu.Unlock()
+
+	var message string
+	switch err.Kind {
+	case ErrProviderAuth:
+		message = fmt.Sprintf("%s rejected the API key (%s); check the key and the account", providerNames[err.Provider], err.Status)
+	case ErrProviderBilling:
+		message = fmt.Sprintf("%s turned down a request for billing (%s); check the account's credit and spend limit", providerNames[err.Provider], err.Status)
+	default:
+		message = fmt.Sprintf("%s rate limited a request (%s); requests fail until the limit resets", providerNames[err.Provider], err.Status)
+	}
+	sendAlert(Alert{Kind: alertProvider, Message: message + ", calling the " + err.API, ErrorCode: code})
+}
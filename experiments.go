@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+// defaultPromptVariant is the baseline prompt wording used outside experiments
+const defaultPromptVariant = "control"
+
+// promptFields are the values available to prompt templates
+type promptFields struct {
+	Location      string
+	Condition     string
+	Cloudiness    string
+	Temp          float64
+	TempDesc      string
+	TimeOfDay     string
+	Precipitation string
+	Visibility    string
+	Wind          string
+	Clouds        int
+	Scene         string // caption of the uploaded photo, if captioning is enabled
+}
+
+// WholeTemp is the temperature to the nearest degree, halves away from zero
+// like roundMeasurement, for wordings without decimals
+func (f promptFields) WholeTemp() int {
+	return int(math.Round(f.Temp))
+}
+
+// promptVariantTemplates are the prompt wordings that can be compared in an experiment
+var promptVariantTemplates = map[string]string{
+	"control": `Transform this landscape photo to accurately depict {{.Location}} weather conditions. ` +
+		`{{with .Scene}}The photo shows {{.}}; keep it clearly recognizable. {{end}}` +
+		`The scene should show {{.Condition}}, with {{.Cloudiness}} and a temperature of {{printf "%.1f" .Temp}}°C ({{.TempDesc}}). ` +
+		`{{with .TimeOfDay}}{{.}} {{end}}` +
+		`{{with .Precipitation}}Add {{.}} falling in the scene. {{end}}` +
+		`{{with .Visibility}}The atmosphere should appear {{.}}. {{end}}` +
+		`{{with .Wind}}Show signs of wind {{.}} such as swaying trees or grass. {{end}}` +
+		`The lighting should match the cloudiness level (clouds: {{.Clouds}}%). ` +
+		`Maintain the original composition and main subjects of the photo while ` +
+		`authentically applying these weather conditions. The result should look ` +
+		`natural and photorealistic.`,
+
+	"cinematic": `Re-light and re-weather this photo as a cinematic still of {{.Location}}: ` +
+		`{{.Condition}}, {{.Cloudiness}}, a {{.TempDesc}} day at {{.WholeTemp}}°C. ` +
+		`{{with .Scene}}The subject is {{.}}. {{end}}` +
+		`{{with .TimeOfDay}}{{.}} {{end}}` +
+		`{{with .Precipitation}}Visible {{.}} in the air and on surfaces. {{end}}` +
+		`{{with .Visibility}}Atmosphere {{.}}. {{end}}` +
+		`{{with .Wind}}Motion in vegetation and loose objects {{.}}. {{end}}` +
+		`Keep every structure, subject and the camera framing exactly as in the original; ` +
+		`change only sky, light, atmosphere and weather effects so it reads as a real photograph.`,
+
+	"concise": `Edit this photo{{with .Scene}} of {{.}}{{end}} to show {{.Condition}} in {{.Location}} with {{.Cloudiness}}` +
+		`{{with .Precipitation}} and {{.}}{{end}}{{with .Wind}} {{.}}{{end}}. ` +
+		`{{with .TimeOfDay}}{{.}} {{end}}` +
+		`Keep the composition unchanged and the result photorealistic.`,
+}
+
+// loadPromptTemplates compiles the built-in prompt variants. Every *.tmpl
+// file in dir (PROMPT_TEMPLATE_DIR) adds a variant named after the file, or
+// replaces the built-in wording of that name.
+func loadPromptTemplates(dir string) (map[string]*template.Template, error) {
+	texts := make(map[string]string, len(promptVariantTemplates))
+	for name, text := range promptVariantTemplates {
+		texts[name] = text
+	}
+
+	if dir != "" {
+		paths, err := filepath.Glob(filepath.Join(dir, "*.tmpl"))
+		if err != nil {
+			return nil, err
+		}
+		for _, path := range paths {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read prompt template: %w", err)
+			}
+			texts[strings.TrimSuffix(filepath.Base(path), ".tmpl")] = strings.TrimSpace(string(data))
+		}
+	}
+
+	templates := make(map[string]*template.Template, len(texts))
+	for name, text := range texts {
+		tmpl, err := template.New(name).Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid prompt template %s: %w", name, err)
+		}
+		templates[name] = tmpl
+	}
+	return templates, nil
+}
+
+// parsePromptVariants parses PROMPT_EXPERIMENT, the variants requests are
+// randomly split between, e.g. "control,cinematic". Without it every request
+// uses the control wording.
+func parsePromptVariants(raw string, templates map[string]*template.Template) []string {
+	var variants []string
+	for _, name := range strings.Split(raw, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if _, ok := templates[name]; !ok {
+			log.Printf("Warning: ignoring unknown prompt variant %q in PROMPT_EXPERIMENT", name)
+			continue
+		}
+		variants = append(variants, name)
+	}
+	if len(variants) == 0 {
+		variants = []string{defaultPromptVariant}
+	}
+	return variants
+}
+
+// assignPromptVariant randomly assigns a request to one of the active variants
+func assignPromptVariant() string {
+	variants := currentConfig().PromptVariants
+	return variants[rand.IntN(len(variants))]
+}
+
+// renderPromptVariant renders the named prompt template, falling back to the
+// control wording for unknown variants
+func renderPromptVariant(variant string, fields promptFields) string {
+	templates := currentConfig().PromptTemplates
+	tmpl, ok := templates[variant]
+	if !ok {
+		tmpl = templates[defaultPromptVariant]
+	}
+
+	var b strings.Builder
+	if err := tmpl.Execute(&b, fields); err != nil {
+		log.Printf("Failed to render prompt variant %s: %v", variant, err)
+		if variant != defaultPromptVariant {
+			return renderPromptVariant(defaultPromptVariant, fields)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// eventTimeLayout is how request_events timestamps are stored
+const eventTimeLayout = "2006-01-02 15:04:05.000"
+
+// exportRow is one request in the analytics export. Stage durations are in
+// milliseconds and null for stages the request never finished.
+type exportRow struct {
+	ID                 string   `json:"id"`
+	CreatedAt          string   `json:"created_at"`
+	Outcome            string   `json:"outcome"` // completed, error, cancelled or in_progress
+	ErrorCode          string   `json:"error_code"`
+	Location           string   `json:"location"`
+	Country            string   `json:"country"`
+	TargetDate         string   `json:"target_date"`
+	EndDate            string   `json:"end_date"`
+	WeatherCondition   string   `json:"weather_condition"`
+	WeatherDescription string   `json:"weather_description"`
+	Temperature        float64  `json:"temperature"`
+	Units              string   `json:"units"`
+	PromptVariant      string   `json:"prompt_variant"`
+	Preset             string   `json:"preset"`
+	Intensity          string   `json:"intensity"`
+	Model              string   `json:"model"` // model of the latest prediction
+	Predictions        int      `json:"predictions"`
+	CostUSD            float64  `json:"cost_usd"`
+	Revisions          int      `json:"revisions"`
+	Rating             int      `json:"rating"`
+	GeocodeMS          *float64 `json:"geocode_ms"`
+	WeatherMS          *float64 `json:"weather_ms"`
+	ReviewMS           *float64 `json:"review_ms"`
+	QueueMS            *float64 `json:"queue_ms"`
+	GenerationMS       *float64 `json:"generation_ms"`
+	TotalMS            *float64 `json:"total_ms"`
+}
+
+// exportColumns is the CSV header, in exportRow field order
+var exportColumns = []string{
+	"id", "created_at", "outcome", "error_code", "location", "country", "target_date", "end_date",
+	"weather_condition", "weather_description", "temperature", "units", "prompt_variant", "preset",
+	"intensity", "model", "predictions", "cost_usd", "revisions", "rating",
+	"geocode_ms", "weather_ms", "review_ms", "queue_ms", "generation_ms", "total_ms",
+}
+
+// newExportRow computes a request's stage timings, model and cost
+func newExportRow(a *RequestAnalytics) *exportRow {
+	row := &exportRow{
+		ID:                 a.ID,
+		CreatedAt:          a.CreatedAt,
+		Outcome:            a.Status,
+		ErrorCode:          a.ErrorCode,
+		Location:           a.LocationName,
+		Country:            a.Country,
+		TargetDate:         a.TargetDate,
+		EndDate:            a.EndDate,
+		WeatherCondition:   a.WeatherCondition,
+		WeatherDescription: a.WeatherDescription,
+		Temperature:        a.Temperature,
+		Units:              a.Units,
+		PromptVariant:      a.PromptVariant,
+		Preset:             a.Preset,
+		Intensity:          a.Intensity,
+		Predictions:        len(a.Models),
+		Revisions:          a.Revisions,
+		Rating:             a.Rating,
+		GeocodeMS:          stageMillis(a.PendingAt, a.GeocodedAt),
+		WeatherMS:          stageMillis(a.GeocodedAt, a.WeatherFetchedAt),
+		ReviewMS:           stageMillis(a.WeatherFetchedAt, a.ConfirmedAt),
+		QueueMS:            stageMillis(a.ConfirmedAt, a.ProcessingAt),
+		GenerationMS:       stageMillis(a.ProcessingAt, a.FinishedAt),
+		TotalMS:            stageMillis(a.PendingAt, a.FinishedAt),
+	}
+	if a.Status != "completed" && a.Status != "error" && a.Status != "cancelled" {
+		row.Outcome = "in_progress"
+	}
+	for _, model := range a.Models {
+		row.CostUSD += modelCost(model)
+	}
+	if len(a.Models) > 0 {
+		row.Model = a.Models[len(a.Models)-1]
+	}
+	return row
+}
+
+// stageMillis is the time between two stage timestamps, or nil if either
+// stage wasn't reached
+func stageMillis(from, to string) *float64 {
+	start, err := time.Parse(eventTimeLayout, from)
+	if err != nil {
+		return nil
+	}
+	end, err := time.Parse(eventTimeLayout, to)
+	if err != nil || end.Before(start) {
+		return nil
+	}
+	ms := float64(end.Sub(start).Milliseconds())
+	return &ms
+}
+
+// modelCost is the estimated price of one prediction with a model
+func modelCost(model string) float64 {
+	if m, ok := benchmarkModel(model); ok {
+		return m.Cost
+	}
+	return currentConfig().PredictionCost
+}
+
+// csvRecord formats a row in exportColumns order
+func (row *exportRow) csvRecord() []string {
+	millis := func(ms *float64) string {
+		if ms == nil {
+			return ""
+		}
+		return strconv.FormatFloat(*ms, 'f', 0, 64)
+	}
+	return []string{
+		row.ID, row.CreatedAt, row.Outcome, row.ErrorCode, row.Location, row.Country,
+		row.TargetDate, row.EndDate, row.WeatherCondition, row.WeatherDescription,
+		strconv.FormatFloat(row.Temperature, 'f', 1, 64), row.Units, row.PromptVariant, row.Preset,
+		row.Intensity, row.Model, strconv.Itoa(row.Predictions),
+		strconv.FormatFloat(row.CostUSD, 'f', 4, 64), strconv.Itoa(row.Revisions), strconv.Itoa(row.Rating),
+		millis(row.GeocodeMS), millis(row.WeatherMS), millis(row.ReviewMS),
+		millis(row.QueueMS), millis(row.GenerationMS), millis(row.TotalMS),
+	}
+}
+
+// adminExportHandler streams per-request analytics as CSV or JSON for BI
+// tools. Rows are written as they're read, so large exports don't have to
+// fit in memory. from and to (YYYY-MM-DD, to inclusive) limit the range.
+func adminExportHandler(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "csv"
+	}
+	if format != "csv" && format != "json" {
+		http.Error(w, "format must be csv or json", http.StatusBadRequest)
+		return
+	}
+
+	from, to := time.Time{}, time.Now().AddDate(0, 0, 1)
+	if v := r.URL.Query().Get("from"); v != "" {
+		t, err := time.Parse("2006-01-02", v)
+		if err != nil {
+			http.Error(w, "Invalid from date", http.StatusBadRequest)
+			return
+		}
+		from = t
+	}
+	if v := r.URL.Query().Get("to"); v != "" {
+		t, err := time.Parse("2006-01-02", v)
+		if err != nil {
+			http.Error(w, "Invalid to date", http.StatusBadRequest)
+			return
+		}
+		to = t.AddDate(0, 0, 1)
+	}
+
+	filename := fmt.Sprintf("skyweave-requests-%s.%s", time.Now().UTC().Format("20060102"), format)
+	w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+
+	var err error
+	if format == "csv" {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		err = streamCSVExport(w, from, to)
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		err = streamJSONExport(w, from, to)
+	}
+	if err != nil {
+		// The status line has already been sent, so the export is just cut short
+		log.Printf("Analytics export failed: %v", err)
+	}
+}
+
+// streamCSVExport writes the export as CSV, flushing every 100 rows
+func streamCSVExport(w http.ResponseWriter, from, to time.Time) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(exportColumns); err != nil {
+		return err
+	}
+
+	count := 0
+	err := streamRequestAnalytics(from, to, func(a *RequestAnalytics) error {
+		if err := cw.Write(newExportRow(a).csvRecord()); err != nil {
+			return err
+		}
+		if count++; count%100 == 0 {
+			cw.Flush()
+			flushResponse(w)
+		}
+		return cw.Error()
+	})
+	cw.Flush()
+	if err != nil {
+		return err
+	}
+	return cw.Error()
+}
+
+// streamJSONExport writes the export as a JSON array, one row at a time
+func streamJSONExport(w http.ResponseWriter, from, to time.Time) error {
+	if _, err := w.Write([]byte("[")); err != nil {
+		return err
+	}
+
+	count := 0
+	err := streamRequestAnalytics(from, to, func(a *RequestAnalytics) error {
+		data, err := json.Marshal(newExportRow(a))
+		if err != nil {
+			return err
+		}
+		sep := ",\n"
+		if count == 0 {
+			sep = "\n"
+		}
+		if _, err := w.Write([]byte(sep + string(data))); err != nil {
+			return err
+		}
+		if count++; count%100 == 0 {
+			flushResponse(w)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	_, err = w.Write([]byte("\n]\n"))
+	return err
+}
+
+// flushResponse sends buffered output to the client if the writer supports it
+func flushResponse(w http.ResponseWriter) {
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
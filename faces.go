@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"log"
+	"time"
+)
+
+// faceThumbnailSize is the side of the thumbnails faces are compared at.
+// Faces smaller than this in the original are too small to judge and skipped.
+const faceThumbnailSize = 32
+
+// detectFaces finds faces in an image already uploaded to Replicate with the
+// face detection model named by FACE_MODEL, returning their boxes in pixels
+func detectFaces(imageURL string) ([]image.Rectangle, error) {
+	prediction, err := createModelPrediction(currentConfig().FaceModel, map[string]interface{}{
+		"image": imageURL,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create face detection prediction: %w", err)
+	}
+
+	status, err := awaitPrediction(prediction.ID, 2*time.Second, 2*time.Minute)
+	if err != nil {
+		return nil, fmt.Errorf("face detection prediction failed: %w", err)
+	}
+	if status.Status != "succeeded" {
+		return nil, fmt.Errorf("face detection prediction %s: %s", status.Status, status.Error)
+	}
+	return parseFaceBoxes(status.Output), nil
+}
+
+// parseFaceBoxes extracts face boxes from a detection model's output. Models
+// disagree on the shape, so it accepts a list of faces, optionally under a
+// "faces" key or as a JSON string, where each face has a "bbox" or "box" of
+// [x1, y1, x2, y2] or x, y, width and height fields.
+func parseFaceBoxes(output interface{}) []image.Rectangle {
+	switch v := output.(type) {
+	case string:
+		var decoded interface{}
+		if err := json.Unmarshal([]byte(v), &decoded); err != nil {
+			return nil
+		}
+		return parseFaceBoxes(decoded)
+	case map[string]interface{}:
+		if faces, ok := v["faces"]; ok {
+			return parseFaceBoxes(faces)
+		}
+	case []interface{}:
+		var boxes []image.Rectangle
+		for _, item := range v {
+			face, ok := item.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			if box, ok := faceBox(face); ok {
+				boxes = append(boxes, box)
+			}
+		}
+		return boxes
+	}
+	return nil
+}
+
+// faceBox reads one face's box from its detection output
+func faceBox(face map[string]interface{}) (image.Rectangle, bool) {
+	for _, key := range []string{"bbox", "box"} {
+		coords, ok := face[key].([]interface{})
+		if !ok || len(coords) != 4 {
+			continue
+		}
+		var c [4]int
+		for i, coord := range coords {
+			f, ok := coord.(float64)
+			if !ok {
+				return image.Rectangle{}, false
+			}
+			c[i] = int(f)
+		}
+		return image.Rect(c[0], c[1], c[2], c[3]), true
+	}
+
+	x, okX := face["x"].(float64)
+	y, okY := face["y"].(float64)
+	w, okW := face["width"].(float64)
+	h, okH := face["height"].(float64)
+	if !okX || !okY || !okW || !okH {
+		return image.Rectangle{}, false
+	}
+	return image.Rect(int(x), int(y), int(x+w), int(y+h)), true
+}
+
+// faceDifference compares the faces found in the original with the same
+// regions of the result and returns the largest difference, from 0 to 1. A
+// result with fewer faces than the original scores 1. ok is false when the
+// original has no faces large enough to compare.
+func faceDifference(originalPath, resultPath string, originalFaces, resultFaces []image.Rectangle) (score float64, ok bool, err error) {
+	original, err := decodeImageFile(originalPath)
+	if err != nil {
+		return 0, false, fmt.Errorf("original: %w", err)
+	}
+	result, err := decodeImageFile(resultPath)
+	if err != nil {
+		return 0, false, fmt.Errorf("result: %w", err)
+	}
+
+	// The result may have a different size, so map each box across
+	ob, rb := original.Bounds(), result.Bounds()
+	scaleX := float64(rb.Dx()) / float64(ob.Dx())
+	scaleY := float64(rb.Dy()) / float64(ob.Dy())
+
+	for _, face := range originalFaces {
+		a, err := grayThumbnail(original, face, faceThumbnailSize)
+		if err != nil {
+			continue // too small to judge
+		}
+		mapped := image.Rect(
+			rb.Min.X+int(float64(face.Min.X-ob.Min.X)*scaleX), rb.Min.Y+int(float64(face.Min.Y-ob.Min.Y)*scaleY),
+			rb.Min.X+int(float64(face.Max.X-ob.Min.X)*scaleX), rb.Min.Y+int(float64(face.Max.Y-ob.Min.Y)*scaleY))
+		b, err := grayThumbnail(result, mapped, faceThumbnailSize)
+		if err != nil {
+			// Shrunk below the thumbnail size in a smaller result, as for
+			// trial results
+			continue
+		}
+		score = max(score, ssimDifference(a, b, faceThumbnailSize))
+		ok = true
+	}
+	if ok && len(resultFaces) < len(originalFaces) {
+		score = 1
+	}
+	return score, ok, nil
+}
+
+// checkFaces scores how much a completed revision altered the faces in the
+// original photo, when FACE_MODEL is set. Faces are detected in both images
+// so a result where people vanished is caught too; outputURL is the result as
+// Replicate returned it, so it doesn't have to be uploaded again. Failures
+// only leave the revision unscored.
+func checkFaces(rev *Revision, outputURL string) {
+	if currentConfig().FaceModel == "" {
+		return
+	}
+	req, err := getRequest(rev.RequestID)
+	if err != nil {
+		log.Printf("Failed to load request %s for face check: %v", rev.RequestID, err)
+		return
+	}
+	originalURL, err := requestUploadURL(req)
+	if err != nil {
+		log.Printf("Failed to upload original of request %s for face check: %v", req.ID, err)
+		return
+	}
+
+	originalFaces, err := detectFaces(originalURL)
+	if err != nil {
+		log.Printf("Failed to detect faces in request %s: %v", req.ID, err)
+		return
+	}
+	if len(originalFaces) == 0 {
+		return
+	}
+	resultFaces, err := detectFaces(outputURL)
+	if err != nil {
+		log.Printf("Failed to detect faces in revision %s: %v", rev.ID, err)
+		return
+	}
+
+	score, ok, err := faceDifference(req.ImagePath, rev.ResultImagePath, originalFaces, resultFaces)
+	if err != nil {
+		log.Printf("Failed to compare faces of revision %s: %v", rev.ID, err)
+		return
+	}
+	if !ok {
+		return
+	}
+	if err := setRevisionFaceScore(rev, score); err != nil {
+		log.Printf("Failed to save face score of revision %s: %v", rev.ID, err)
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// templateFuncs are the formatting helpers available in every page template.
+// Handlers pass raw values and leave presenting them to the templates.
+var templateFuncs = template.FuncMap{
+	"countryFlag":     countryFlag,
+	"countryName":     countryName,
+	"formatDate":      formatDate,
+	"formatDateRange": formatDateRange,
+	"formatTemp":      formatTemp,
+	"formatWind":      formatWind,
+	"timeAgo":         timeAgo,
+	"humanFileSize":   humanFileSize,
+	"weatherIcon":     weatherIcon,
+}
+
+// countryFlag returns the flag emoji of an ISO 3166 country code, empty for
+// anything that isn't a two-letter code
+func countryFlag(code string) string {
+	code = strings.ToUpper(code)
+	if len(code) != 2 || code[0] < 'A' || code[0] > 'Z' || code[1] < 'A' || code[1] > 'Z' {
+		return ""
+	}
+	// Flags are the code's letters as regional indicator symbols
+	const regionalIndicatorA = 0x1F1E6
+	return string([]rune{regionalIndicatorA + rune(code[0]-'A'), regionalIndicatorA + rune(code[1]-'A')})
+}
+
+// countryNames are the English names of countries, by ISO 3166 code
+var countryNames = map[string]string{
+	"AE": "United Arab Emirates", "AR": "Argentina", "AT": "Austria", "AU": "Australia",
+	"BE": "Belgium", "BG": "Bulgaria", "BR": "Brazil", "CA": "Canada", "CH": "Switzerland",
+	"CL": "Chile", "CN": "China", "CO": "Colombia", "CZ": "Czechia", "DE": "Germany",
+	"DK": "Denmark", "EE": "Estonia", "EG": "Egypt", "ES": "Spain", "FI": "Finland",
+	"FR": "France", "GB": "United Kingdom", "GR": "Greece", "HK": "Hong Kong", "HR": "Croatia",
+	"HU": "Hungary", "ID": "Indonesia", "IE": "Ireland", "IL": "Israel", "IN": "India",
+	"IS": "Iceland", "IT": "Italy", "JP": "Japan", "KE": "Kenya", "KR": "South Korea",
+	"LT": "Lithuania", "LU": "Luxembourg", "LV": "Latvia", "MA": "Morocco", "MX": "Mexico",
+	"MY": "Malaysia", "NL": "Netherlands", "NO": "Norway", "NZ": "New Zealand", "PE": "Peru",
+	"PH": "Philippines", "PL": "Poland", "PT": "Portugal", "RO": "Romania", "RS": "Serbia",
+	"RU": "Russia", "SA": "Saudi Arabia", "SE": "Sweden", "SG": "Singapore", "SI": "Slovenia",
+	"SK": "Slovakia", "TH": "Thailand", "TR": "Türkiye", "TW": "Taiwan", "UA": "Ukraine",
+	"US": "United States", "VN": "Vietnam", "ZA": "South Africa",
+}
+
+// countryName returns the English name of an ISO 3166 country code, or the
+// code itself when it isn't known
+func countryName(code string) string {
+	if name, ok := countryNames[strings.ToUpper(code)]; ok {
+		return name
+	}
+	return code
+}
+
+// dateLayouts spell out dates the way each supported locale's language
+// writes them. Month names are substituted for the "January" placeholder,
+// since time.Format only knows English ones.
+var dateLayouts = map[string]struct {
+	layout string
+	months [12]string
+}{
+	"en-US": {"January 2, 2006", [12]string{"January", "February", "March", "April", "May", "June",
+		"July", "August", "September", "October", "November", "December"}},
+	"en-GB": {"2 January 2006", [12]string{"January", "February", "March", "April", "May", "June",
+		"July", "August", "September", "October", "November", "December"}},
+	"de": {"2. January 2006", [12]string{"Januar", "Februar", "März", "April", "Mai", "Juni",
+		"Juli", "August", "September", "Oktober", "November", "Dezember"}},
+	"es": {"2 de January de 2006", [12]string{"enero", "febrero", "marzo", "abril", "mayo", "junio",
+		"julio", "agosto", "septiembre", "octubre", "noviembre", "diciembre"}},
+	"fr": {"2 January 2006", [12]string{"janvier", "février", "mars", "avril", "mai", "juin",
+		"juillet", "août", "septembre", "octobre", "novembre", "décembre"}},
+	"it": {"2 January 2006", [12]string{"gennaio", "febbraio", "marzo", "aprile", "maggio", "giugno",
+		"luglio", "agosto", "settembre", "ottobre", "novembre", "dicembre"}},
+	"nl": {"2 January 2006", [12]string{"januari", "februari", "maart", "april", "mei", "juni",
+		"juli", "augustus", "september", "oktober", "november", "december"}},
+	"pt": {"2 de January de 2006", [12]string{"janeiro", "fevereiro", "março", "abril", "maio", "junho",
+		"julho", "agosto", "setembro", "outubro", "novembro", "dezembro"}},
+	"ja": {"2006年1月2日", [12]string{}},
+}
+
+// formatDate formats a YYYY-MM-DD date in a locale's long date format,
+// falling back to its language's and then to en-US. Anything that isn't a
+// date is returned as is.
+func formatDate(date, locale string) string {
+	t, err := time.Parse("2006-01-02", date)
+	if err != nil {
+		return date
+	}
+	format, ok := dateLayouts[locale]
+	if !ok {
+		if format, ok = dateLayouts[localeLanguage(locale)]; !ok {
+			format = dateLayouts[defaultLocale]
+		}
+	}
+
+	if format.months[0] == "" {
+		return t.Format(format.layout)
+	}
+	before, after, _ := strings.Cut(format.layout, "January")
+	return t.Format(before) + format.months[t.Month()-1] + t.Format(after)
+}
+
+// formatDateRange formats a date range like formatDate, or a single date
+// when end is empty
+func formatDateRange(start, end, locale string) string {
+	if end == "" {
+		return formatDate(start, locale)
+	}
+	return fmt.Sprintf("%s – %s", formatDate(start, locale), formatDate(end, locale))
+}
+
+// formatTemp formats a temperature stored in units, e.g. "12.3°C"
+func formatTemp(value float64, units string) string {
+	return formatMeasurement(value) + tempUnit(units)
+}
+
+// formatWind formats a wind speed stored in units, e.g. "4.1 m/s"
+func formatWind(speed float64, units string) string {
+	return formatMeasurement(speed) + " " + windUnit(units)
+}
+
+// timeAgo describes how long ago a timestamp stored by SQLite was, e.g.
+// "3 hours ago". Timestamps that can't be parsed are returned as is.
+func timeAgo(timestamp string) string {
+	t, err := parseSQLiteTime(timestamp)
+	if err != nil {
+		return timestamp
+	}
+
+	plural := func(n int, unit string) string {
+		if n == 1 {
+			return "1 " + unit + " ago"
+		}
+		return fmt.Sprintf("%d %ss ago", n, unit)
+	}
+	switch elapsed := time.Since(t); {
+	case elapsed < time.Minute:
+		return "just now"
+	case elapsed < time.Hour:
+		return plural(int(elapsed/time.Minute), "minute")
+	case elapsed < 24*time.Hour:
+		return plural(int(elapsed/time.Hour), "hour")
+	case elapsed < 30*24*time.Hour:
+		return plural(int(elapsed/(24*time.Hour)), "day")
+	default:
+		return t.Format("2006-01-02")
+	}
+}
+
+// humanFileSize formats a size in bytes with binary units, e.g. "1.5 MB"
+func humanFileSize(bytes int64) string {
+	const unit = 1 << 10
+	if bytes < unit {
+		return strconv.FormatInt(bytes, 10) + " B"
+	}
+	value := float64(bytes)
+	suffix := ""
+	for _, s := range []string{"KB", "MB", "GB", "TB"} {
+		value /= unit
+		suffix = s
+		if value < unit {
+			break
+		}
+	}
+	return strconv.FormatFloat(math.Round(value*10)/10, 'f', -1, 64) + " " + suffix
+}
+
+// weatherIcons are emoji for OpenWeather's main condition groups
+var weatherIcons = map[string]string{
+	"Clear": "☀️", "Clouds": "☁️", "Rain": "🌧️", "Drizzle": "🌦️", "Thunderstorm": "⛈️",
+	"Snow": "❄️", "Mist": "🌫️", "Fog": "🌫️", "Haze": "🌫️", "Smoke": "🌫️", "Dust": "🌪️",
+	"Sand": "🌪️", "Ash": "🌋", "Squall": "💨", "Tornado": "🌪️",
+}
+
+// weatherIcon returns the emoji of a weather condition, empty for unknown ones
+func weatherIcon(condition string) string {
+	return weatherIcons[condition]
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+)
+
+// The /fragments/ routes render single components of a page for HTMX to
+// swap in. Each fragment is a template in templates/fragments.html that the
+// full pages render too, so a swapped-in component matches the page around it.
+
+// QueuePosition is where a confirmed request's generation is in the job queue
+type QueuePosition struct {
+	RequestID string
+	Status    string
+	Queued    bool // waiting in this instance's queue
+	Ahead     int  // jobs that will start before it when Queued
+}
+
+// queuePosition looks up a request's place in the job queue. Requests
+// queued on another instance show as waiting without a position.
+func queuePosition(req *Request) *QueuePosition {
+	position := &QueuePosition{RequestID: req.ID, Status: req.Status}
+	if req.Status == "confirmed" {
+		position.Ahead, position.Queued = jobQueue.position(req.UserID, req.ID)
+	}
+	return position
+}
+
+// galleryItem is a request shown as a gallery tile
+type galleryItem struct {
+	*Request
+	Tags []string
+}
+
+// InProgress reports whether the request is being worked on without waiting
+// for the user, so its tile keeps refreshing
+func (r *Request) InProgress() bool {
+	status, ok := requestStatuses[r.Status]
+	return !ok || (!status.Terminal && status.Action == "")
+}
+
+// fragmentRequest loads the user's request a fragment shows, answering 404
+// for other users' requests
+func fragmentRequest(w http.ResponseWriter, r *http.Request) (*Request, bool) {
+	userID, err := getUserID(w, r)
+	if err != nil {
+		http.Error(w, "Failed to generate user ID", http.StatusInternalServerError)
+		return nil, false
+	}
+	req, err := getRequest(r.PathValue("id"))
+	if err == nil && req.UserID != userID {
+		err = sql.ErrNoRows
+	}
+	if err != nil {
+		lookupError(w, err, "Request")
+		return nil, false
+	}
+	return req, true
+}
+
+// renderFragment renders a fragment template on its own
+func renderFragment(w http.ResponseWriter, name string, data any) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := templates.ExecuteTemplate(w, name, data); err != nil {
+		log.Printf("Failed to render fragment %s: %v", name, err)
+	}
+}
+
+// weatherFragmentHandler renders a request's weather card
+func weatherFragmentHandler(w http.ResponseWriter, r *http.Request) {
+	req, ok := fragmentRequest(w, r)
+	if !ok {
+		return
+	}
+	if req.Status == "pending" || req.Status == "geocoding" || req.Status == "weather_fetching" {
+		http.Error(w, "Weather not fetched yet", http.StatusNotFound)
+		return
+	}
+	renderFragment(w, "weather_card", req)
+}
+
+// queueFragmentHandler renders a request's place in the job queue
+func queueFragmentHandler(w http.ResponseWriter, r *http.Request) {
+	req, ok := fragmentRequest(w, r)
+	if !ok {
+		return
+	}
+	renderFragment(w, "queue_position", queuePosition(req))
+}
+
+// galleryTileFragmentHandler renders a request's gallery tile, which in
+// progress tiles poll to replace themselves with
+func galleryTileFragmentHandler(w http.ResponseWriter, r *http.Request) {
+	req, ok := fragmentRequest(w, r)
+	if !ok {
+		return
+	}
+	tags, err := getRequestTags(req.ID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		log.Printf("Failed to load tags of request %s: %v", req.ID, err)
+	}
+	renderFragment(w, "gallery_tile", galleryItem{Request: req, Tags: tags})
+}
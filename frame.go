@@ -0,0 +1,90 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Photo frame links serve the newest result of a photo: the request they
+// were made for, or whichever of its re-runs, scheduled generations
+// included, completed last. E-ink frames and dashboards point at the one
+// URL and are told how often to fetch it again. Links are signed like
+// calendar feeds, as /frame/{request}.{signature}, and don't expire.
+
+const (
+	minFrameRefresh = time.Minute
+	maxFrameRefresh = 24 * time.Hour
+)
+
+// frameSignature signs the photo frame link of a request
+func frameSignature(key, requestID string) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	fmt.Fprintf(mac, "frame\n%s", requestID)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// frameURL returns an absolute photo frame link for a request, or "" when
+// no signing key is configured
+func frameURL(r *http.Request, requestID string) string {
+	key := currentConfig().ImageSigningKey
+	if key == "" {
+		return ""
+	}
+	return absoluteURL(r, "/frame/"+url.PathEscape(requestID+"."+frameSignature(key, requestID)))
+}
+
+// frameRefresh is how often a frame should fetch its image again: FRAME_REFRESH,
+// or the link's refresh parameter within limits
+func frameRefresh(r *http.Request) time.Duration {
+	refresh := currentConfig().FrameRefresh
+	if param := r.URL.Query().Get("refresh"); param != "" {
+		if d, err := time.ParseDuration(param); err == nil {
+			refresh = min(max(d, minFrameRefresh), maxFrameRefresh)
+		} else if seconds, err := strconv.Atoi(param); err == nil {
+			refresh = min(max(time.Duration(seconds)*time.Second, minFrameRefresh), maxFrameRefresh)
+		}
+	}
+	return refresh
+}
+
+// frameHandler serves the newest result of a photo frame link. Responses
+// say when to fetch again three ways, for the clients that only understand
+// one: Refresh for browsers showing the image, Cache-Control and Expires
+// for frames and caches. Fetches of an unchanged result are answered with
+// 304 Not Modified.
+func frameHandler(w http.ResponseWriter, r *http.Request) {
+	requestID, sig, _ := strings.Cut(r.PathValue("token"), ".")
+	key := currentConfig().ImageSigningKey
+	if key == "" || !hmac.Equal([]byte(sig), []byte(frameSignature(key, requestID))) {
+		http.Error(w, "Frame not found", http.StatusNotFound)
+		return
+	}
+
+	refresh := frameRefresh(r)
+	seconds := strconv.Itoa(int(refresh.Seconds()))
+	w.Header().Set("Refresh", seconds)
+	w.Header().Set("Cache-Control", "private, max-age="+seconds)
+	w.Header().Set("Expires", time.Now().Add(refresh).UTC().Format(http.TimeFormat))
+
+	rev, err := getNewestResult(requestID)
+	if err != nil {
+		// Frames keep asking until the first result is there
+		w.Header().Set("Retry-After", seconds)
+		lookupError(w, err, "Result")
+		return
+	}
+	if rev.ResultImagePath == "" || !fileExists(rev.ResultImagePath) {
+		log.Printf("Result file of revision %s for frame of request %s is missing", rev.ID, requestID)
+		http.Error(w, "Image file not found", http.StatusNotFound)
+		return
+	}
+	serveMediaFile(w, r, rev.ResultImagePath)
+}
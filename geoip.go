@@ -0,0 +1,357 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"os"
+)
+
+// geoIP looks up where clients connect from to suggest a location, when
+// GEOIP_DB points at a MaxMind city database. nil when there is none.
+var geoIP *geoIPDB
+
+// setupGeoIP loads the GEOIP_DB database, read at startup
+func setupGeoIP() error {
+	path := os.Getenv("GEOIP_DB")
+	if path == "" {
+		return nil
+	}
+	db, err := openGeoIPDB(path)
+	if err != nil {
+		return err
+	}
+	geoIP = db
+	log.Printf("Using GeoIP database %s (%s)", path, db.databaseType)
+	return nil
+}
+
+// LocationGuess is where a client's IP address places them. It's only ever
+// offered on the start form, and nothing of it is kept unless submitted.
+type LocationGuess struct {
+	Name      string
+	Country   string // ISO 3166 code
+	Latitude  float64
+	Longitude float64
+}
+
+// guessLocation looks up the client's city in the GeoIP database, in the
+// user's locale when the database has it. It returns nil without a
+// database, for private addresses and for addresses without a city.
+func guessLocation(r *http.Request, locale string) *LocationGuess {
+	if geoIP == nil {
+		return nil
+	}
+	ip := net.ParseIP(clientIP(r))
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() {
+		return nil
+	}
+	record, err := geoIP.Lookup(ip)
+	if err != nil {
+		log.Printf("GeoIP lookup failed: %v", err)
+		return nil
+	}
+
+	city, _ := record["city"].(map[string]any)
+	names, _ := city["names"].(map[string]any)
+	name, _ := names[locale].(string)
+	if name == "" {
+		name, _ = names["en"].(string)
+	}
+	location, _ := record["location"].(map[string]any)
+	lat, okLat := location["latitude"].(float64)
+	lon, okLon := location["longitude"].(float64)
+	if name == "" || !okLat || !okLon {
+		return nil
+	}
+	country, _ := record["country"].(map[string]any)
+	code, _ := country["iso_code"].(string)
+	return &LocationGuess{Name: name, Country: code, Latitude: lat, Longitude: lon}
+}
+
+// geoIPDB is a MaxMind DB file (https://maxmind.github.io/MaxMind-DB/) held
+// in memory: a binary search tree over the bits of addresses whose leaves
+// point into a section of typed data
+type geoIPDB struct {
+	buf          []byte
+	data         []byte // the data section
+	nodeCount    uint
+	recordSize   uint // bits per record, 24, 28 or 32
+	ipVersion    uint
+	databaseType string
+}
+
+// geoIPMetadataMarker precedes the metadata at the end of the file
+var geoIPMetadataMarker = []byte("\xAB\xCD\xEFMaxMind.com")
+
+// openGeoIPDB reads a MaxMind DB file and its metadata
+func openGeoIPDB(path string) (*geoIPDB, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	start := bytes.LastIndex(buf, geoIPMetadataMarker)
+	if start < 0 {
+		return nil, fmt.Errorf("%s is not a MaxMind DB file", path)
+	}
+	decoder := &mmdbDecoder{buf: buf[start+len(geoIPMetadataMarker):]}
+	value, _, err := decoder.decode(0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read metadata of %s: %w", path, err)
+	}
+	meta, _ := value.(map[string]any)
+
+	db := &geoIPDB{buf: buf}
+	nodeCount, _ := meta["node_count"].(uint64)
+	recordSize, _ := meta["record_size"].(uint64)
+	ipVersion, _ := meta["ip_version"].(uint64)
+	db.nodeCount, db.recordSize, db.ipVersion = uint(nodeCount), uint(recordSize), uint(ipVersion)
+	db.databaseType, _ = meta["database_type"].(string)
+	if db.recordSize != 24 && db.recordSize != 28 && db.recordSize != 32 {
+		return nil, fmt.Errorf("%s has an unsupported record size of %d bits", path, db.recordSize)
+	}
+	if db.ipVersion != 4 && db.ipVersion != 6 {
+		return nil, fmt.Errorf("%s has an unsupported IP version %d", path, db.ipVersion)
+	}
+
+	// The search tree is followed by 16 zero bytes, then the data
+	treeSize := db.nodeCount * db.recordSize / 4
+	if treeSize+16 > uint(start) {
+		return nil, fmt.Errorf("%s is truncated", path)
+	}
+	db.data = buf[treeSize+16 : start]
+	return db, nil
+}
+
+// Lookup returns the record of the network ip belongs to, nil if there's none
+func (db *geoIPDB) Lookup(ip net.IP) (map[string]any, error) {
+	addr := ip.To4()
+	if addr == nil {
+		if db.ipVersion == 4 {
+			return nil, nil
+		}
+		addr = ip.To16()
+	} else if db.ipVersion == 6 {
+		// IPv4 addresses are stored as ::a.b.c.d in IPv6 databases
+		addr = append(make(net.IP, 12), addr...)
+	}
+
+	node := uint(0)
+	for i := 0; i < len(addr)*8 && node < db.nodeCount; i++ {
+		bit := uint(addr[i/8]>>(7-i%8)) & 1
+		node = db.readRecord(node, bit)
+	}
+	if node <= db.nodeCount {
+		return nil, nil // not found, or the address is shorter than the tree
+	}
+
+	offset := node - db.nodeCount - 16
+	if offset >= uint(len(db.data)) {
+		return nil, errors.New("record points outside the data section")
+	}
+	value, _, err := (&mmdbDecoder{buf: db.data}).decode(offset)
+	if err != nil {
+		return nil, err
+	}
+	record, _ := value.(map[string]any)
+	return record, nil
+}
+
+// readRecord reads the left (bit 0) or right (bit 1) record of a tree node
+func (db *geoIPDB) readRecord(node, bit uint) uint {
+	b := db.buf[node*db.recordSize/4:]
+	switch db.recordSize {
+	case 24:
+		b = b[bit*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		// The middle byte holds the high nibble of both records
+		if bit == 0 {
+			return uint(b[3]&0xF0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0F)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		return uint(binary.BigEndian.Uint32(b[bit*4:]))
+	}
+}
+
+// mmdbDecoder decodes values of a MaxMind DB data section. Pointers are
+// offsets from the start of buf.
+type mmdbDecoder struct {
+	buf []byte
+}
+
+// MaxMind DB data types
+const (
+	mmdbExtended = 0
+	mmdbPointer  = 1
+	mmdbString   = 2
+	mmdbDouble   = 3
+	mmdbBytes    = 4
+	mmdbUint16   = 5
+	mmdbUint32   = 6
+	mmdbMap      = 7
+	mmdbInt32    = 8
+	mmdbUint64   = 9
+	mmdbUint128  = 10
+	mmdbArray    = 11
+	mmdbBool     = 14
+	mmdbFloat    = 15
+)
+
+var errMMDBTruncated = errors.New("unexpected end of MaxMind DB data")
+
+// decode decodes the value at offset, returning it and the offset after it.
+// Maps decode to map[string]any, arrays to []any, unsigned integers to
+// uint64 (uint128 to []byte), int32 to int64 and floats to float64.
+func (d *mmdbDecoder) decode(offset uint) (any, uint, error) {
+	typ, size, offset, err := d.decodeControl(offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	if typ == mmdbPointer {
+		// The pointed to value is decoded, and decoding continues after the pointer
+		value, _, err := d.decode(size)
+		return value, offset, err
+	}
+
+	switch typ {
+	case mmdbMap:
+		m := make(map[string]any, size)
+		for range size {
+			var key, value any
+			key, offset, err = d.decode(offset)
+			if err != nil {
+				return nil, 0, err
+			}
+			value, offset, err = d.decode(offset)
+			if err != nil {
+				return nil, 0, err
+			}
+			name, ok := key.(string)
+			if !ok {
+				return nil, 0, errors.New("MaxMind DB map key is not a string")
+			}
+			m[name] = value
+		}
+		return m, offset, nil
+	case mmdbArray:
+		a := make([]any, 0, size)
+		for range size {
+			var value any
+			value, offset, err = d.decode(offset)
+			if err != nil {
+				return nil, 0, err
+			}
+			a = append(a, value)
+		}
+		return a, offset, nil
+	case mmdbBool:
+		return size != 0, offset, nil
+	}
+
+	if offset+size > uint(len(d.buf)) {
+		return nil, 0, errMMDBTruncated
+	}
+	b := d.buf[offset : offset+size]
+	offset += size
+	switch typ {
+	case mmdbString:
+		return string(b), offset, nil
+	case mmdbBytes, mmdbUint128:
+		return bytes.Clone(b), offset, nil
+	case mmdbDouble:
+		if size != 8 {
+			return nil, 0, fmt.Errorf("MaxMind DB double of %d bytes", size)
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), offset, nil
+	case mmdbFloat:
+		if size != 4 {
+			return nil, 0, fmt.Errorf("MaxMind DB float of %d bytes", size)
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), offset, nil
+	case mmdbUint16, mmdbUint32, mmdbUint64:
+		var n uint64
+		for _, c := range b {
+			n = n<<8 | uint64(c)
+		}
+		return n, offset, nil
+	case mmdbInt32:
+		var n uint32
+		for _, c := range b {
+			n = n<<8 | uint32(c)
+		}
+		return int64(int32(n)), offset, nil
+	}
+	return nil, 0, fmt.Errorf("unsupported MaxMind DB data type %d", typ)
+}
+
+// decodeControl decodes the control byte at offset and the bytes extending
+// it. It returns the value's type and size, where a pointer's size is the
+// offset it points to, and the offset of the value's payload.
+func (d *mmdbDecoder) decodeControl(offset uint) (typ, size, next uint, err error) {
+	// read reads n bytes as a big-endian number
+	read := func(n uint) (uint, error) {
+		if offset+n > uint(len(d.buf)) {
+			return 0, errMMDBTruncated
+		}
+		v := uint(0)
+		for _, c := range d.buf[offset : offset+n] {
+			v = v<<8 | uint(c)
+		}
+		offset += n
+		return v, nil
+	}
+
+	ctrl, err := read(1)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	typ = ctrl >> 5
+
+	if typ == mmdbPointer {
+		ss, vvv := (ctrl>>3)&3, ctrl&7
+		v, err := read(ss + 1)
+		if err != nil {
+			return 0, 0, 0, err
+		}
+		switch ss {
+		case 0:
+			size = vvv<<8 | v
+		case 1:
+			size = (vvv<<16 | v) + 2048
+		case 2:
+			size = (vvv<<24 | v) + 526336
+		default:
+			size = v
+		}
+		return typ, size, offset, nil
+	}
+
+	if typ == mmdbExtended {
+		ext, err := read(1)
+		if err != nil {
+			return 0, 0, 0, err
+		}
+		typ = 7 + ext
+	}
+
+	size = ctrl & 0x1F
+	switch size {
+	case 29:
+		size, err = read(1)
+		size += 29
+	case 30:
+		size, err = read(2)
+		size += 285
+	case 31:
+		size, err = read(3)
+		size += 65821
+	}
+	return typ, size, offset, err
+}
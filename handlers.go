@@ -1,11 +1,18 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
 	"log"
+	"mime/multipart"
 	"net/http"
-	"os"
+	"net/mail"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -14,7 +21,7 @@ var templates *template.Template
 // initTemplates loads all HTML templates
 func initTemplates() {
 	var err error
-	templates, err = template.ParseGlob("templates/*.html")
+	templates, err = parseTemplates()
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -27,28 +34,134 @@ func home(w http.ResponseWriter, r *http.Request) {
 
 // startHandler displays the form for creating a new request
 func startHandler(w http.ResponseWriter, r *http.Request) {
-	// Generate user ID
-	userID, err := generateID(8)
+	// Identify the user so their saved locations can be offered
+	userID, err := getUserID(w, r)
 	if err != nil {
 		http.Error(w, "Failed to generate user ID", http.StatusInternalServerError)
 		return
 	}
 
-	now := time.Now()
-	// Calculate date range: 1 year ago to 16 days ahead
-	minDate := now.AddDate(-1, 0, 0).Format("2006-01-02")
-	maxDate := now.AddDate(0, 0, 16).Format("2006-01-02")
+	// Fill the form back in from the user's draft when they resume it
+	if r.URL.Query().Get("draft") == "resume" {
+		if draft := loadDraft(userID); draft != nil {
+			renderStart(w, r, userID, &startFormState{Values: draft.Fields, Status: http.StatusOK})
+			return
+		}
+	}
+	renderStart(w, r, userID, nil)
+}
+
+// startFormState is what a rejected submission brings back to the start form
+type startFormState struct {
+	Values      url.Values            // the entered values, filled back in
+	Errors      FieldErrors           // what's wrong, shown next to each field
+	Suggestions FieldSuggestions      // valid values offered for some fields
+	Upload      *multipart.FileHeader // the chosen photo, which browsers make users choose again
+	Status      int
+}
+
+// renderStart renders the start form, filled in from a rejected submission
+// when state isn't nil
+func renderStart(w http.ResponseWriter, r *http.Request, userID string, state *startFormState) {
+	savedLocations, err := getSavedLocations(userID)
+	if err != nil {
+		log.Printf("Failed to load saved locations for user %s: %v", userID, err)
+	}
+
+	recentRequests, err := getRecentRequests(userID, 5)
+	if err != nil {
+		log.Printf("Failed to load recent requests for user %s: %v", userID, err)
+	}
+
+	presets, err := getPresets(true)
+	if err != nil {
+		log.Printf("Failed to load presets: %v", err)
+	}
+
+	quota, err := trialQuota(r, userID)
+	if err != nil {
+		log.Printf("Failed to load trial quota for %s: %v", clientIP(r), err)
+	}
+
+	settings := loadUserSettings(r, userID)
+	units := settings.Units
+	if state == nil {
+		state = &startFormState{Status: http.StatusOK}
+	}
+	if form := state.Values; form != nil {
+		// The submitted choices take the place of the user's defaults
+		defaults := *settings
+		defaults.DefaultLocationID = ""
+		defaults.Preset = form.Get("preset")
+		if intensity, ok := parseIntensity(form.Get("intensity")); ok {
+			defaults.Intensity = intensity
+		}
+		settings = &defaults
+		if isValidUnits(form.Get("units")) {
+			units = form.Get("units")
+		}
+	}
+
+	// Offer to resume a draft on an empty form
+	var draft *Draft
+	if state.Values == nil {
+		draft = loadDraft(userID)
+	}
+
+	// Suggest where the client seems to be when there's nothing else to fill in
+	var guess *LocationGuess
+	hasDefault := slices.ContainsFunc(savedLocations, func(loc SavedLocation) bool { return loc.ID == settings.DefaultLocationID })
+	if state.Values == nil && !hasDefault {
+		guess = guessLocation(r, settings.Locale)
+	}
+
+	// Offer the days weather can be looked up for, which submissions are checked against
+	first, last := weatherWindow(time.Now())
+	minDate := first.Format("2006-01-02")
+	maxDate := last.Format("2006-01-02")
 
 	data := struct {
-		UserID  string
-		MinDate string
-		MaxDate string
+		MinDate        string
+		MaxDate        string
+		Units          string
+		Settings       *UserSettings
+		Trial          bool
+		Quota          *Quota
+		Captcha        *Captcha
+		SavedLocations []SavedLocation
+		LocationGuess  *LocationGuess
+		RecentRequests []*Request
+		Presets        []Preset
+		UploadLimits   UploadLimits
+		Form           url.Values
+		Errors         FieldErrors
+		Suggestions    FieldSuggestions
+		Upload         *multipart.FileHeader
+		Draft          *Draft
 	}{
-		UserID:  userID,
-		MinDate: minDate,
-		MaxDate: maxDate,
+		MinDate:        minDate,
+		MaxDate:        maxDate,
+		Units:          units,
+		Settings:       settings,
+		Trial:          isTrialVisitor(r),
+		Quota:          quota,
+		Captcha:        submissionCaptcha(r, userID),
+		SavedLocations: savedLocations,
+		LocationGuess:  guess,
+		RecentRequests: recentRequests,
+		Presets:        presets,
+		UploadLimits:   currentConfig().UploadLimits,
+		Form:           state.Values,
+		Errors:         state.Errors,
+		Suggestions:    state.Suggestions,
+		Upload:         state.Upload,
+		Draft:          draft,
 	}
 
+	if state.Status != http.StatusOK {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(state.Status)
+	}
 	templates.ExecuteTemplate(w, "start.html", data)
 }
 
@@ -59,31 +172,80 @@ func submitHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Parse multipart form (32MB max)
-	if err := r.ParseMultipartForm(32 << 20); err != nil {
-		http.Error(w, "Failed to parse form", http.StatusBadRequest)
+	// Limit how many uploads are buffered and decoded at once
+	release, ok := acquireUploadSlot()
+	if !ok {
+		log.Printf("Turning away upload from %s, %d uploads in progress", clientIP(r), currentConfig().UploadConcurrency)
+		w.Header().Set("Retry-After", "10")
+		http.Error(w, "Too many uploads in progress, please try again in a few seconds", http.StatusServiceUnavailable)
 		return
 	}
+	defer release()
 
-	userID := r.FormValue("user_id")
-	location := r.FormValue("location")
-	dateStr := r.FormValue("date")
-	timeOfDay := r.FormValue("time_of_day")
-
-	// Parse target date
-	targetDate, err := time.Parse("2006-01-02", dateStr)
+	userID, err := getUserID(w, r)
 	if err != nil {
-		http.Error(w, "Invalid date format", http.StatusBadRequest)
+		http.Error(w, "Failed to generate user ID", http.StatusInternalServerError)
+		return
+	}
+
+	// Parse the multipart form, allowing a little room for the other fields.
+	// A body over the limit is cut off, so nothing entered can be shown again.
+	// Clients submitting a photo_url may post a plain form instead.
+	limits := currentConfig().UploadLimits
+	r.Body = http.MaxBytesReader(w, r.Body, limits.MaxBytes+1<<20)
+	if err := r.ParseMultipartForm(limits.MaxBytes); err != nil && !errors.Is(err, http.ErrNotMultipart) {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			r.Form = nil
+			rejectSubmission(w, r, userID, FieldErrors{"photo": "Photos can be at most " + humanFileSize(limits.MaxBytes)},
+				nil, http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, "Failed to parse form", http.StatusBadRequest)
+		return
+	}
+
+	// "Save draft" keeps what was entered without submitting it
+	if r.FormValue("save_draft") != "" {
+		keepDraft(userID, r.Form)
+		http.Redirect(w, r, "/start?draft=resume", http.StatusSeeOther)
 		return
 	}
 
-	// Get uploaded file
+	if captcha := submissionCaptcha(r, userID); captcha != nil {
+		if err := captcha.Verify(r); err != nil {
+			log.Printf("Submission CAPTCHA failed for %s: %v", clientIP(r), err)
+			rejectSubmission(w, r, userID, FieldErrors{"captcha": "Please complete the CAPTCHA and submit again"}, nil,
+				http.StatusForbidden)
+			return
+		}
+	}
+
+	// Check every field, the photo's name and size included, so all problems
+	// are reported at once. Without a chosen file, the photo is fetched from
+	// the link given instead, if any.
+	trial := isTrialVisitor(r)
+	form, errs := validateSubmission(r, trial)
 	file, header, err := r.FormFile("photo")
-	if err != nil {
-		http.Error(w, "Failed to get uploaded file", http.StatusBadRequest)
+	photoURL := strings.TrimSpace(r.FormValue("photo_url"))
+	fromURL := err != nil && photoURL != ""
+	if fromURL {
+		file, header, err = fetchPhotoURL(r.Context(), photoURL, limits)
+		if err != nil {
+			log.Printf("Failed to fetch photo for %s from %s: %v", clientIP(r), redactPhotoURL(photoURL), err)
+			errs.add("photo", photoURLMessage(err, limits))
+		}
+	}
+	if err == nil {
+		defer file.Close()
+	}
+	validatePhoto(errs, header, limits)
+	if len(errs) > 0 {
+		rejectSubmission(w, r, userID, errs, form.Suggestions, http.StatusBadRequest)
 		return
 	}
-	defer file.Close()
+	setPreferredUnits(w, form.Units)
+	location, locationMode, dates := form.Location, form.LocationMode, form.Dates
 
 	// Generate request ID
 	requestID, err := generateID(16)
@@ -92,49 +254,458 @@ func submitHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Scan the upload before anything reads it, so a flagged one doesn't
+	// use up a trial generation either
+	scanStarted := time.Now()
+	signature, err := scanUpload(file)
+	if err != nil {
+		log.Printf("Failed to scan upload from %s: %v", clientIP(r), err)
+		keepDraft(userID, r.Form)
+		w.Header().Set("Retry-After", "60")
+		http.Error(w, "Uploads can't be checked right now, please try again in a minute", http.StatusServiceUnavailable)
+		return
+	}
+	if currentConfig().Antivirus != nil {
+		recordStage(requestID, "", stageScan, scanStarted)
+	}
+	if signature != "" {
+		rejectInfectedUpload(w, r, userID, requestID, file, header, form, signature)
+		return
+	}
+
+	// Trial visitors get a few requests a day, counted per IP address and
+	// per user cookie so clearing cookies alone doesn't reset the limit
+	if trial {
+		allowed, err := claimTrialGeneration(requestID, userID, clientIP(r),
+			currentConfig().TrialDailyLimit, trialDayStart(time.Now()))
+		if err != nil {
+			log.Printf("Failed to check trial limit for %s: %v", clientIP(r), err)
+			dbHTTPError(w, err, "Failed to save request")
+			return
+		}
+		if !allowed {
+			http.Error(w, "You've used today's free trial. Ask for access to make more images, or come back tomorrow.",
+				http.StatusTooManyRequests)
+			return
+		}
+	}
+
 	// Save uploaded file
-	imagePath, err := saveUploadedFile(file, header, requestID)
+	imagePath, err := saveUploadedFile(file, limits)
+	if errors.Is(err, ErrInvalidImage) {
+		rejectSubmission(w, r, userID, FieldErrors{"photo": "Please upload a " + limits.FormatList() + " image"},
+			nil, http.StatusBadRequest)
+		return
+	}
+	if errors.Is(err, ErrImageTooLarge) {
+		rejectSubmission(w, r, userID,
+			FieldErrors{"photo": fmt.Sprintf("Photos can be at most %d pixels wide and high", limits.MaxDimension)},
+			nil, http.StatusRequestEntityTooLarge)
+		return
+	}
 	if err != nil {
 		http.Error(w, "Failed to save file", http.StatusInternalServerError)
 		return
 	}
 
-	// Create request record
+	// The photo can be cropped and rotated before anything is done with it
+	reviewPhoto := r.FormValue("review_photo") == "on"
+	status := "pending"
+	if reviewPhoto {
+		status = "reviewing"
+	}
+
+	// Create the request record. A range becomes either one request covering
+	// every day or a batch of single-day requests sharing the upload.
 	req := &Request{
 		ID:            requestID,
 		UserID:        userID,
 		LocationInput: location,
-		TargetDate:    dateStr,
-		TimeOfDay:     timeOfDay,
+		TargetDate:    form.StartDate,
+		TimeOfDay:     form.TimeOfDay,
+		Units:         form.Units,
+		Intensity:     form.Intensity,
+		Preset:        form.Preset,
+		PresetMode:    form.PresetMode,
 		ImagePath:     imagePath,
-		Status:        "pending",
+		Postcard:      r.FormValue("postcard") == "on",
+		Status:        status,
+	}
+	batch := []*Request{req}
+	if len(dates) > 1 {
+		if form.RangeMode == rangeModeSummary {
+			req.EndDate = dates[len(dates)-1].Format("2006-01-02")
+		} else {
+			if batch, err = batchRequests(req, dates); err != nil {
+				http.Error(w, "Failed to generate request ID", http.StatusInternalServerError)
+				return
+			}
+		}
 	}
 
-	if err := saveRequest(req); err != nil {
-		http.Error(w, "Failed to save request", http.StatusInternalServerError)
-		return
+	for _, req := range batch {
+		if err := saveRequest(req); err != nil {
+			dbHTTPError(w, err, "Failed to save request")
+			return
+		}
+	}
+	for _, req := range batch {
+		trackEvent(eventRequestCreated, userID, req.ID, map[string]interface{}{
+			"source": "form", "batch": req.BatchID != "", "range": req.EndDate != "",
+			"preset": req.Preset, "trial": trial, "review_photo": reviewPhoto,
+			"photo_url": fromURL,
+		})
+	}
+
+	// The draft was submitted
+	if err := deleteDraft(userID); err != nil {
+		log.Printf("Failed to delete submitted draft of user %s: %v", userID, err)
 	}
 
+	// Use the coordinates picked from autocomplete, if any, to skip geocoding
+	var resolved *GeocodingResult
+	lat, latErr := strconv.ParseFloat(r.FormValue("latitude"), 64)
+	lon, lonErr := strconv.ParseFloat(r.FormValue("longitude"), 64)
+	if latErr == nil && lonErr == nil && r.FormValue("location_name") != "" {
+		// These fields come from the client, so normalize them like geocoder output
+		resolved = &GeocodingResult{
+			Name:    sanitizeLocationName(r.FormValue("location_name")),
+			Country: sanitizeLocationName(r.FormValue("country")),
+			Lat:     lat,
+			Lon:     lon,
+		}
+		if len(resolved.Country) > 3 {
+			resolved.Country = ""
+		}
+		// Name variants of the picked place; placeNames keeps only the
+		// languages worth offering and sanitizes them
+		if localNames := r.FormValue("local_names"); localNames != "" {
+			if err := json.Unmarshal([]byte(localNames), &resolved.Local); err != nil {
+				resolved.Local = nil
+			}
+		}
+	}
+
+	// Name the place in the user's language by default
+	locale := loadUserSettings(r, userID).Locale
+
 	// Start async processing
-	go processWeatherRequest(requestID, location, targetDate)
+	sub := &submission{
+		RequestIDs:   make([]string, 0, len(batch)),
+		Location:     location,
+		LocationMode: locationMode,
+		Locale:       locale,
+		Resolved:     resolved,
+	}
+	for _, req := range batch {
+		sub.RequestIDs = append(sub.RequestIDs, req.ID)
+	}
+	if reviewPhoto {
+		awaitPhotoReview(requestID, sub)
+		http.Redirect(w, r, "/review/"+requestID, http.StatusSeeOther)
+		return
+	}
+	sub.start()
 
 	// Redirect to processing page immediately
+	if batchID := batch[0].BatchID; batchID != "" {
+		http.Redirect(w, r, "/batches/"+batchID, http.StatusSeeOther)
+		return
+	}
+	http.Redirect(w, r, "/processing/"+requestID, http.StatusSeeOther)
+}
+
+// rejectInfectedUpload quarantines an upload the virus scanner flagged and
+// records the request as failed with errorCodeUploadInfected, so the user
+// is shown why nothing was made and the incident can be looked up by its ID
+func rejectInfectedUpload(w http.ResponseWriter, r *http.Request, userID, requestID string,
+	file multipart.File, header *multipart.FileHeader, form *submissionForm, signature string) {
+	log.Printf("Upload for request %s from %s flagged as %s", requestID, clientIP(r), signature)
+	err := quarantineUpload(file, quarantineRecord{
+		RequestID:     requestID,
+		UserID:        userID,
+		ClientIP:      clientIP(r),
+		Filename:      header.Filename,
+		Signature:     signature,
+		Scanner:       currentConfig().Antivirus.Name(),
+		QuarantinedAt: time.Now().UTC(),
+	})
+	if err != nil {
+		log.Printf("Failed to quarantine upload for request %s: %v", requestID, err)
+	}
+
+	req := &Request{
+		ID:            requestID,
+		UserID:        userID,
+		LocationInput: form.Location,
+		TargetDate:    form.StartDate,
+		TimeOfDay:     form.TimeOfDay,
+		Units:         form.Units,
+		Intensity:     form.Intensity,
+		Preset:        form.Preset,
+		PresetMode:    form.PresetMode,
+		Status:        "error",
+	}
+	if err := saveRequest(req); err != nil {
+		dbHTTPError(w, err, "Failed to save request")
+		return
+	}
+	if err := updateRequestError(requestID, fmt.Errorf("%w: %s", ErrUploadInfected, signature)); err != nil {
+		log.Printf("Failed to update request %s: %v", requestID, err)
+	}
+	http.Redirect(w, r, "/processing/"+requestID, http.StatusSeeOther)
+}
+
+// batchRequests expands a request into one request per date, grouped under a
+// new batch ID. The first keeps the original request's ID.
+func batchRequests(req *Request, dates []time.Time) ([]*Request, error) {
+	batchID, err := generateID(8)
+	if err != nil {
+		return nil, err
+	}
+
+	batch := make([]*Request, 0, len(dates))
+	for i, date := range dates {
+		day := *req
+		day.BatchID = batchID
+		day.TargetDate = date.Format("2006-01-02")
+		if i > 0 {
+			if day.ID, err = generateID(16); err != nil {
+				return nil, err
+			}
+		}
+		batch = append(batch, &day)
+	}
+	return batch, nil
+}
+
+// redoHandler clones an existing request with a new target date, reusing the
+// uploaded image and resolved location
+func redoHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserID(w, r)
+	if err != nil {
+		http.Error(w, "Failed to generate user ID", http.StatusInternalServerError)
+		return
+	}
+
+	parent, err := getRequest(r.PathValue("id"))
+	if err != nil || parent.UserID != userID {
+		lookupError(w, err, "Request")
+		return
+	}
+
+	if parent.LocationName == "" {
+		http.Error(w, "Original request has no resolved location", http.StatusConflict)
+		return
+	}
+
+	dateStr := r.FormValue("date")
+	errs, suggestions := FieldErrors{}, FieldSuggestions{}
+	if validateDates(errs, suggestions, dateStr, ""); len(errs) > 0 {
+		if wantsJSON(r) {
+			writeFieldErrors(w, errs, suggestions, http.StatusBadRequest)
+			return
+		}
+		http.Error(w, errs["date"], http.StatusBadRequest)
+		return
+	}
+
+	requestID, err := generateID(16)
+	if err != nil {
+		http.Error(w, "Failed to generate request ID", http.StatusInternalServerError)
+		return
+	}
+
+	clone := *parent
+	clone.ID, clone.TargetDate, clone.EndDate = requestID, dateStr, ""
+	if err := cloneRequest(&clone, parent.ID); err != nil {
+		log.Printf("Failed to clone request %s: %v", parent.ID, err)
+		dbHTTPError(w, err, "Failed to save request")
+		return
+	}
+	processClone(&clone, parent, locationModeAuto, loadUserSettings(r, userID).Locale)
+	trackEvent(eventRequestCreated, userID, requestID, map[string]interface{}{"source": "redo", "parent": parent.ID})
+
 	http.Redirect(w, r, "/processing/"+requestID, http.StatusSeeOther)
 }
 
-// processWeatherRequest handles async geocoding and weather fetching
-func processWeatherRequest(requestID, location string, targetDate time.Time) {
+// processClone starts looking up the weather of a saved clone, reusing the
+// parent's resolved location and place name variant unless the clone was
+// given a location of its own
+func processClone(clone, parent *Request, locationMode, locale string) {
+	resolved, locale := cloneLocation(clone, parent, locale)
+	goSafe(clone.ID, func() {
+		processWeatherRequest(clone.ID, clone.LocationInput, locationMode, locale, resolved)
+	})
+}
+
+// cloneLocation returns the parent's resolved location and the locale of its
+// place name for a clone that kept the parent's location, or nil and locale
+// for one that needs its own looked up
+func cloneLocation(clone, parent *Request, locale string) (*GeocodingResult, string) {
+	if clone.LocationName == "" {
+		return nil, locale
+	}
+	resolved := &GeocodingResult{
+		Name:    parent.LocationName,
+		Country: parent.Country,
+		Lat:     parent.Latitude,
+		Lon:     parent.Longitude,
+		Local:   parent.PlaceNames,
+	}
+	if parent.PlaceLanguage != "" {
+		locale = parent.PlaceLanguage
+	}
+	return resolved, locale
+}
+
+// refreshStaleForecast fetches the forecast of a request again when it's
+// older than FORECAST_REFRESH_AFTER, storing the new snapshots, weather and
+// prompt, and returns the updated request. Observed and reanalysis weather
+// doesn't change, so it's left alone. On failure the request is returned
+// unchanged along with the error.
+func refreshStaleForecast(req *Request) (*Request, error) {
+	maxAge := currentConfig().ForecastRefreshAge
+	if maxAge == 0 || req.WeatherDataType() != weatherTypeForecast {
+		return req, nil
+	}
+	snapshots, err := getLatestWeatherSnapshots(req.ID, 1)
+	if err != nil {
+		return req, err
+	}
+	fetchedAt, err := parseSQLiteTime(snapshots[0].FetchedAt)
+	if err != nil {
+		return req, err
+	}
+	if time.Since(fetchedAt) < maxAge {
+		return req, nil
+	}
+
+	dates, err := parseDateRange(req.TargetDate, req.EndDate)
+	if err != nil {
+		return req, err
+	}
+	started := time.Now()
+	days, err := getRangeWeather(req.Latitude, req.Longitude, dates, locationZone(req.UTCOffset), req.Units)
+	recordStage(req.ID, "", stageWeather, started)
+	trackStage(stageWeather, err)
+	if err != nil {
+		return req, err
+	}
+	for _, day := range days {
+		if err := saveWeatherSnapshot(req.ID, day); err != nil {
+			return req, err
+		}
+	}
+	weatherData := summarizeWeather(days)
+
+	var preset *Preset
+	if req.Preset != "" {
+		if preset, err = getPreset(req.Preset); err != nil {
+			return req, fmt.Errorf("preset %q is no longer available", req.Preset)
+		}
+	}
+	prompt, err := requestPrompt(req, preset, weatherData, promptLocation(req.PlaceName(), req.Country),
+		req.Caption, req.PromptVariant)
+	if err != nil {
+		return req, err
+	}
+	if err := updateRequestWeather(req.ID, weatherData, prompt, req.PromptVariant); err != nil {
+		return req, err
+	}
+	log.Printf("Refreshed the %s old forecast of request %s", time.Since(fetchedAt).Round(time.Minute), req.ID)
+
+	refreshed, err := getRequest(req.ID)
+	if err != nil {
+		return req, err
+	}
+	return refreshed, nil
+}
+
+// submission is an upload's requests and what their weather lookup needs.
+// It's plain data, so it can wait in the cache for the photo to be reviewed.
+type submission struct {
+	RequestIDs   []string // the request, or every day of its batch
+	Location     string
+	LocationMode string
+	Locale       string
+	Resolved     *GeocodingResult // the place picked from autocomplete, if any
+}
+
+// start looks up the weather of each of the submission's requests in the background
+func (s *submission) start() {
+	for _, id := range s.RequestIDs {
+		goSafe(id, func() {
+			processWeatherRequest(id, s.Location, s.LocationMode, s.Locale, s.Resolved)
+		})
+	}
+}
+
+// processWeatherRequest handles async geocoding and weather fetching.
+// If resolved is non-nil the location was already picked by the user and
+// geocoding is skipped. The place is named in the language of locale when
+// it has a name in it.
+func processWeatherRequest(requestID, location, locationMode, locale string, resolved *GeocodingResult) {
+	req, err := getRequest(requestID)
+	if err != nil {
+		log.Printf("Failed to get request %s: %v", requestID, err)
+		updateRequestError(requestID, fmt.Errorf("failed to retrieve request details: %w", err))
+		return
+	}
+
+	// Upload the photo to Replicate and caption it while the location and
+	// weather are looked up, since neither depends on them. A caption only
+	// enriches the prompt and generation uploads again if this upload fails,
+	// so neither failure is fatal.
+	captionCh := make(chan string, 1)
+	goSafe(requestID, func() {
+		var caption string
+		defer func() { captionCh <- caption }()
+
+		imageURL, err := requestUploadURL(req)
+		if err != nil {
+			log.Printf("Early upload failed for request %s: %v", requestID, err)
+			return
+		}
+		if caption, err = captionImage(imageURL); err != nil {
+			log.Printf("Captioning failed for request %s: %v", requestID, err)
+		}
+	})
+
 	// Step 1: Geocode location
-	geoResult, err := geocodeLocation(location)
+	geoResult := resolved
+	if geoResult == nil {
+		started := time.Now()
+		geoResult, err = geocodeLocation(location, locationMode)
+		recordStage(requestID, "", stageGeocode, started)
+		trackStage(stageGeocode, err)
+		if err != nil {
+			log.Printf("Geocoding failed for request %s: %v", requestID, err)
+			updateRequestError(requestID, fmt.Errorf("failed to find location: %w", err))
+			return
+		}
+	}
+
+	// The target date is a calendar date at the location, so find its timezone
+	utcOffset, err := lookupUTCOffset(geoResult.Lat, geoResult.Lon)
+	if err != nil {
+		log.Printf("Using estimated UTC offset %s for request %s: %v", formatUTCOffset(utcOffset), requestID, err)
+	}
+
+	// Resolve the place to its canonical location, so the same place typed
+	// differently is stored under one name
+	loc, err := canonicalLocation(geoResult.Name, geoResult.Country, geoResult.Lat, geoResult.Lon)
 	if err != nil {
-		log.Printf("Geocoding failed for request %s: %v", requestID, err)
-		updateRequestError(requestID, fmt.Sprintf("Failed to find location: %v", err))
+		log.Printf("Failed to resolve canonical location for request %s: %v", requestID, err)
+		updateRequestError(requestID, fmt.Errorf("failed to save location: %w", err))
 		return
 	}
 
+	names := placeNames(geoResult)
+	language := placeLanguage(names, locale)
+
 	// Update with geocoding results
-	if err := updateRequestGeocode(requestID, geoResult.Name, geoResult.Country,
-		geoResult.Lat, geoResult.Lon); err != nil {
+	if err := updateRequestGeocode(requestID, loc, geoResult.Lat, geoResult.Lon, utcOffset, names, language); err != nil {
 		log.Printf("Failed to update geocode for request %s: %v", requestID, err)
 		return
 	}
@@ -142,34 +713,78 @@ func processWeatherRequest(requestID, location string, targetDate time.Time) {
 	// Update status to weather_fetching
 	updateRequestStatus(requestID, "weather_fetching")
 
-	// Step 2: Fetch weather data
-	weatherData, err := getHistoricalWeather(geoResult.Lat, geoResult.Lon, targetDate)
+	dates, err := parseDateRange(req.TargetDate, req.EndDate)
 	if err != nil {
-		log.Printf("Weather fetch failed for request %s: %v", requestID, err)
-		updateRequestError(requestID, fmt.Sprintf("Failed to fetch weather: %v", err))
+		updateRequestError(requestID, err)
 		return
 	}
 
-	// Step 3: Generate AI prompt
-	locationStr := geoResult.Name
-	if geoResult.Country != "" {
-		locationStr += ", " + geoResult.Country
+	// Step 2: Fetch weather data in the user's units for every day, unless a
+	// preset scenario stands in for it
+	var weatherData *WeatherData
+	if !req.WeatherReplaced() {
+		started := time.Now()
+		days, err := getRangeWeather(geoResult.Lat, geoResult.Lon, dates, locationZone(utcOffset), req.Units)
+		recordStage(requestID, "", stageWeather, started)
+		trackStage(stageWeather, err)
+		if err != nil {
+			log.Printf("Weather fetch failed for request %s: %v", requestID, err)
+			updateRequestError(requestID, fmt.Errorf("failed to fetch weather: %w", err))
+			return
+		}
+
+		// Keep the raw provider responses so the weather can be audited and the
+		// prompt regenerated from exactly the same data later
+		for _, day := range days {
+			if err := saveWeatherSnapshot(requestID, day); err != nil {
+				log.Printf("Failed to save weather snapshot for request %s: %v", requestID, err)
+				updateRequestError(requestID, fmt.Errorf("failed to save weather data: %w", err))
+				return
+			}
+		}
+
+		// A range is described by its dominant conditions
+		weatherData = summarizeWeather(days)
+	}
+
+	caption := <-captionCh
+	if caption != "" {
+		if err := updateRequestCaption(requestID, caption); err != nil {
+			log.Printf("Failed to save caption for request %s: %v", requestID, err)
+		}
 	}
 
-	// Get the time of day from the request
-	req, err := getRequest(requestID)
+	// Step 3: Generate AI prompt, using the geocoder's canonical name rather
+	// than the raw text the user typed, in the language picked above
+	placeName := geoResult.Name
+	if language != "" {
+		placeName = names[language]
+	}
+	locationStr := promptLocation(placeName, geoResult.Country)
+
+	var preset *Preset
+	if req.Preset != "" {
+		if preset, err = getPreset(req.Preset); err != nil {
+			updateRequestError(requestID, fmt.Errorf("preset %q is no longer available", req.Preset))
+			return
+		}
+	}
+
+	variant := assignPromptVariant()
+	prompt, err := requestPrompt(req, preset, weatherData, locationStr, caption, variant)
 	if err != nil {
-		log.Printf("Failed to get request for prompt generation: %v", err)
-		updateRequestError(requestID, "Failed to retrieve request details")
+		log.Printf("Prompt generation failed for request %s: %v", requestID, err)
+		updateRequestError(requestID, fmt.Errorf("failed to generate prompt: %w", err))
 		return
 	}
-
-	prompt := generatePrompt(weatherData, locationStr, req.TimeOfDay)
+	if weatherData == nil {
+		weatherData = &WeatherData{}
+	}
 
 	// Update with weather data and prompt
-	if err := updateRequestWeather(requestID, weatherData, prompt); err != nil {
+	if err := updateRequestWeather(requestID, weatherData, prompt, variant); err != nil {
 		log.Printf("Failed to update weather for request %s: %v", requestID, err)
-		updateRequestError(requestID, "Failed to save weather data")
+		updateRequestError(requestID, fmt.Errorf("failed to save weather data: %w", err))
 		return
 	}
 
@@ -182,7 +797,7 @@ func weatherHandler(w http.ResponseWriter, r *http.Request) {
 
 	req, err := getRequest(requestID)
 	if err != nil {
-		http.Error(w, "Request not found", http.StatusNotFound)
+		lookupError(w, err, "Request")
 		return
 	}
 
@@ -192,14 +807,285 @@ func weatherHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	userID, err := getUserID(w, r)
+	if err != nil {
+		http.Error(w, "Failed to generate user ID", http.StatusInternalServerError)
+		return
+	}
+
+	cfg := currentConfig()
 	data := struct {
-		Request *Request
+		Request       *Request
+		LocationSaved bool
+		Locale        string // dates are formatted in it
+		WeatherMap    string // the layer of the weather map shown, empty for none
+		RawWeather    []RawWeather
 	}{
-		Request: req,
+		Request:       req,
+		LocationSaved: r.URL.Query().Get("saved") == "1",
+		Locale:        loadUserSettings(r, userID).Locale,
+	}
+	if cfg.WeatherMapLayer != weatherMapOff && cfg.OpenWeatherAPIKey != "" && !req.WeatherReplaced() {
+		data.WeatherMap = cfg.WeatherMapLayer
+	}
+	data.RawWeather, err = requestRawWeather(req)
+	if err != nil {
+		log.Printf("Failed to load weather snapshots of request %s: %v", req.ID, err)
 	}
 
 	templates.ExecuteTemplate(w, "confirm.html", data)
-} // confirmHandler handles user confirmation or cancellation
+}
+
+// placeNameHandler switches the name a request's place is shown and prompted
+// with to another language's, regenerating the prompt before it's confirmed
+func placeNameHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserID(w, r)
+	if err != nil {
+		http.Error(w, "Failed to generate user ID", http.StatusInternalServerError)
+		return
+	}
+
+	req, err := getRequest(r.PathValue("id"))
+	if err != nil || req.UserID != userID {
+		lookupError(w, err, "Request")
+		return
+	}
+
+	// Once confirmed the prompt is in use, so the name can't change anymore
+	if req.Status != "weather_fetched" {
+		http.Redirect(w, r, "/processing/"+req.ID, http.StatusSeeOther)
+		return
+	}
+
+	language := r.FormValue("language")
+	name, ok := req.PlaceNames[language]
+	if !ok {
+		http.Error(w, "Unknown place name language", http.StatusBadRequest)
+		return
+	}
+
+	// A preset scenario stands in for the weather, which was never fetched
+	var weatherData *WeatherData
+	if !req.WeatherReplaced() {
+		if weatherData, err = replayRequestWeather(req); err != nil {
+			log.Printf("Failed to replay weather of request %s: %v", req.ID, err)
+			http.Error(w, "Failed to load weather data", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	var preset *Preset
+	if req.Preset != "" {
+		if preset, err = getPreset(req.Preset); err != nil {
+			http.Error(w, fmt.Sprintf("Preset %q is no longer available", req.Preset), http.StatusConflict)
+			return
+		}
+	}
+
+	prompt, err := requestPrompt(req, preset, weatherData, promptLocation(name, req.Country), req.Caption, req.PromptVariant)
+	if err != nil {
+		log.Printf("Failed to regenerate prompt for request %s: %v", req.ID, err)
+		http.Error(w, "Failed to generate prompt", http.StatusInternalServerError)
+		return
+	}
+
+	if err := setRequestPlaceLanguage(req.ID, language, prompt); err != nil {
+		log.Printf("Failed to save place name of request %s: %v", req.ID, err)
+		dbHTTPError(w, err, "Failed to save place name")
+		return
+	}
+
+	http.Redirect(w, r, "/weather/"+req.ID, http.StatusSeeOther)
+}
+
+// saveLocationHandler saves the resolved location of a request under a user-chosen label
+func saveLocationHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserID(w, r)
+	if err != nil {
+		http.Error(w, "Failed to generate user ID", http.StatusInternalServerError)
+		return
+	}
+
+	requestID := r.FormValue("request_id")
+	label := strings.TrimSpace(r.FormValue("label"))
+	if label == "" || len(label) > 50 {
+		http.Error(w, "Label must be between 1 and 50 characters", http.StatusBadRequest)
+		return
+	}
+
+	req, err := getRequest(requestID)
+	if err != nil || req.UserID != userID {
+		lookupError(w, err, "Request")
+		return
+	}
+
+	if req.LocationName == "" {
+		http.Error(w, "Location has not been resolved yet", http.StatusConflict)
+		return
+	}
+
+	locationID, err := generateID(8)
+	if err != nil {
+		http.Error(w, "Failed to generate location ID", http.StatusInternalServerError)
+		return
+	}
+
+	loc := &SavedLocation{
+		ID:           locationID,
+		UserID:       userID,
+		Label:        label,
+		LocationName: req.LocationName,
+		Country:      req.Country,
+		Latitude:     req.Latitude,
+		Longitude:    req.Longitude,
+	}
+	if err := createSavedLocation(loc); err != nil {
+		log.Printf("Failed to save location for user %s: %v", userID, err)
+		dbHTTPError(w, err, "Failed to save location")
+		return
+	}
+
+	http.Redirect(w, r, "/weather/"+requestID+"?saved=1", http.StatusSeeOther)
+}
+
+// deleteLocationHandler removes one of the user's saved locations
+func deleteLocationHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserID(w, r)
+	if err != nil {
+		http.Error(w, "Failed to generate user ID", http.StatusInternalServerError)
+		return
+	}
+
+	if err := deleteSavedLocation(r.PathValue("id"), userID); err != nil {
+		log.Printf("Failed to delete saved location for user %s: %v", userID, err)
+		dbHTTPError(w, err, "Failed to delete location")
+		return
+	}
+
+	http.Redirect(w, r, "/start", http.StatusSeeOther)
+}
+
+// settingsHandler displays the user's settings
+func settingsHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserID(w, r)
+	if err != nil {
+		http.Error(w, "Failed to generate user ID", http.StatusInternalServerError)
+		return
+	}
+
+	savedLocations, err := getSavedLocations(userID)
+	if err != nil {
+		log.Printf("Failed to load saved locations for user %s: %v", userID, err)
+	}
+
+	presets, err := getPresets(true)
+	if err != nil {
+		log.Printf("Failed to load presets: %v", err)
+	}
+
+	data := struct {
+		Settings        *UserSettings
+		Saved           bool
+		Locales         []Locale
+		SavedLocations  []SavedLocation
+		Presets         []Preset
+		Models          []BenchmarkModel
+		EmailConfigured bool
+	}{
+		Settings:        loadUserSettings(r, userID),
+		Saved:           r.URL.Query().Get("saved") == "1",
+		Locales:         supportedLocales,
+		SavedLocations:  savedLocations,
+		Presets:         presets,
+		Models:          currentConfig().BenchmarkModels,
+		EmailConfigured: emailConfigured(),
+	}
+
+	templates.ExecuteTemplate(w, "settings.html", data)
+}
+
+// saveSettingsHandler validates and stores the user's settings
+func saveSettingsHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserID(w, r)
+	if err != nil {
+		http.Error(w, "Failed to generate user ID", http.StatusInternalServerError)
+		return
+	}
+
+	settings := &UserSettings{
+		UserID:            userID,
+		Units:             r.FormValue("units"),
+		Locale:            r.FormValue("locale"),
+		DefaultLocationID: r.FormValue("default_location"),
+		Email:             strings.TrimSpace(r.FormValue("email")),
+		Model:             r.FormValue("model"),
+		Preset:            r.FormValue("preset"),
+	}
+
+	if !isValidUnits(settings.Units) {
+		http.Error(w, "Invalid units", http.StatusBadRequest)
+		return
+	}
+	if !isSupportedLocale(settings.Locale) {
+		http.Error(w, "Unsupported locale", http.StatusBadRequest)
+		return
+	}
+	var ok bool
+	if settings.Intensity, ok = parseIntensity(r.FormValue("intensity")); !ok {
+		http.Error(w, "Invalid intensity", http.StatusBadRequest)
+		return
+	}
+
+	if settings.DefaultLocationID != "" {
+		locations, err := getSavedLocations(userID)
+		if err != nil {
+			log.Printf("Failed to load saved locations for user %s: %v", userID, err)
+			dbHTTPError(w, err, "Failed to save settings")
+			return
+		}
+		if !slices.ContainsFunc(locations, func(loc SavedLocation) bool { return loc.ID == settings.DefaultLocationID }) {
+			http.Error(w, "Unknown saved location", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if settings.Email != "" {
+		addr, err := mail.ParseAddress(settings.Email)
+		if err != nil {
+			http.Error(w, "Invalid email address", http.StatusBadRequest)
+			return
+		}
+		settings.Email = addr.Address
+	}
+
+	// REPLICATE_MODEL is the default, so it's stored as no preference and
+	// follows configuration changes
+	if settings.Model == currentConfig().ReplicateModel {
+		settings.Model = ""
+	}
+	if _, ok := benchmarkModel(settings.Model); settings.Model != "" && !ok {
+		http.Error(w, "Unknown model", http.StatusBadRequest)
+		return
+	}
+
+	if settings.Preset != "" {
+		preset, err := getPreset(settings.Preset)
+		if err != nil || !preset.Enabled {
+			http.Error(w, "Unknown preset", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if err := saveUserSettings(settings); err != nil {
+		log.Printf("Failed to save settings for user %s: %v", userID, err)
+		dbHTTPError(w, err, "Failed to save settings")
+		return
+	}
+
+	http.Redirect(w, r, "/settings?saved=1", http.StatusSeeOther)
+}
+
+// confirmHandler handles user confirmation or cancellation
 func confirmHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -218,7 +1104,7 @@ func confirmHandler(w http.ResponseWriter, r *http.Request) {
 	// Check current status to prevent duplicate processing
 	req, err := getRequest(requestID)
 	if err != nil {
-		http.Error(w, "Request not found", http.StatusNotFound)
+		lookupError(w, err, "Request")
 		return
 	}
 
@@ -230,11 +1116,18 @@ func confirmHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Confirm action - start async Replicate processing
-	updateRequestStatus(requestID, "confirmed")
+	// A forecast may have changed since it was fetched
+	if req, err = refreshStaleForecast(req); err != nil {
+		log.Printf("Failed to refresh forecast for request %s, using the stored one: %v", requestID, err)
+	}
 
-	// Start real AI image editing with Replicate
-	go processImageWithReplicate(requestID)
+	// Confirm action - start async Replicate processing of the first revision
+	if _, err := startRevision(req, "", revisionInitial, req.AIPrompt, 0, req.Intensity); err != nil {
+		log.Printf("Failed to start revision for request %s: %v", requestID, err)
+		http.Error(w, "Failed to start processing", http.StatusInternalServerError)
+		return
+	}
+	trackEvent(eventWeatherConfirmed, req.UserID, requestID, nil)
 
 	// Redirect to processing page
 	http.Redirect(w, r, "/processing/"+requestID, http.StatusSeeOther)
@@ -253,36 +1146,553 @@ func processingHandler(w http.ResponseWriter, r *http.Request) {
 	templates.ExecuteTemplate(w, "processing.html", data)
 }
 
-// statusHandler returns the current status for HTMX polling
+// batchHandler lists the days of a one-image-per-day batch with their progress
+func batchHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserID(w, r)
+	if err != nil {
+		http.Error(w, "Failed to generate user ID", http.StatusInternalServerError)
+		return
+	}
+
+	batchID := r.PathValue("id")
+	requests, err := getBatchRequests(userID, batchID)
+	if err != nil || len(requests) == 0 {
+		lookupError(w, err, "Batch")
+		return
+	}
+
+	// Keep refreshing while any day is still being worked on
+	ready, inProgress := 0, false
+	for _, req := range requests {
+		switch req.Status {
+		case "weather_fetched":
+			ready++
+		case "completed", "cancelled", "error":
+		default:
+			inProgress = true
+		}
+	}
+
+	data := struct {
+		BatchID    string
+		Requests   []*Request
+		Ready      int
+		InProgress bool
+	}{
+		BatchID:    batchID,
+		Requests:   requests,
+		Ready:      ready,
+		InProgress: inProgress,
+	}
+
+	templates.ExecuteTemplate(w, "batch.html", data)
+}
+
+// batchConfirmHandler starts image generation for every day of a batch whose
+// weather is ready
+func batchConfirmHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserID(w, r)
+	if err != nil {
+		http.Error(w, "Failed to generate user ID", http.StatusInternalServerError)
+		return
+	}
+
+	batchID := r.PathValue("id")
+	requests, err := getBatchRequests(userID, batchID)
+	if err != nil || len(requests) == 0 {
+		lookupError(w, err, "Batch")
+		return
+	}
+
+	for _, req := range requests {
+		if req.Status != "weather_fetched" {
+			continue
+		}
+		if req, err = refreshStaleForecast(req); err != nil {
+			log.Printf("Failed to refresh forecast for request %s, using the stored one: %v", req.ID, err)
+		}
+		if _, err := startRevision(req, "", revisionInitial, req.AIPrompt, 0, req.Intensity); err != nil {
+			log.Printf("Failed to start revision for request %s: %v", req.ID, err)
+			http.Error(w, "Failed to start processing", http.StatusInternalServerError)
+			return
+		}
+		trackEvent(eventWeatherConfirmed, userID, req.ID, map[string]interface{}{"batch": true})
+	}
+
+	http.Redirect(w, r, "/batches/"+batchID, http.StatusSeeOther)
+}
+
+// statusHandler returns the current status for HTMX polling, or as JSON to
+// clients that ask for it in their Accept header
 func statusHandler(w http.ResponseWriter, r *http.Request) {
 	requestID := r.PathValue("id")
+	w.Header().Add("Vary", "Accept")
 
 	req, err := getRequest(requestID)
 	if err != nil {
-		http.Error(w, "Request not found", http.StatusNotFound)
+		lookupError(w, err, "Request")
 		return
 	}
 
 	data := struct {
-		Status       string
-		RequestID    string
-		ErrorMessage string
+		Status         string
+		RequestID      string
+		RevisionID     string
+		Postcard       bool
+		ErrorCode      string
+		Provider       string // provider whose failure ErrorCode names, if any
+		ProviderName   string
+		Failure        string // auth, quota or billing
+		Rating         int
+		RetryOffers    []retryAspect
+		RevisionFailed bool
+		RevisionCount  int
+		Queue          *QueuePosition
 	}{
-		Status:       req.Status,
-		RequestID:    requestID,
-		ErrorMessage: req.ErrorMessage,
+		Status:      req.Status,
+		RequestID:   requestID,
+		ErrorCode:   req.ErrorCode,
+		RetryOffers: retryAspects,
+		Queue:       queuePosition(req),
+	}
+	if data.Provider, data.Failure = providerFailure(req.ErrorCode); data.Provider != "" {
+		data.ProviderName = providerNames[data.Provider]
+	}
+
+	if req.Status == "completed" {
+		revisions, err := getRevisions(requestID)
+		if err != nil {
+			log.Printf("Failed to load revisions for request %s: %v", requestID, err)
+		}
+		data.RevisionCount = len(revisions)
+		for _, rev := range revisions {
+			if rev.IsPrimary {
+				data.RevisionID = rev.ID
+				data.Postcard = rev.PostcardPath != ""
+				data.Rating = getFeedbackRating(rev.ID)
+			}
+		}
+		// A failed retry leaves the previous primary result in place
+		if n := len(revisions); n > 0 && revisions[n-1].Status == "error" {
+			data.RevisionFailed = true
+		}
+	}
+
+	// API clients get the status as JSON rather than a page fragment
+	if wantsJSON(r) {
+		writeStatusJSON(w, r, req, data.RevisionID)
+		return
+	}
+
+	// HTMX stops polling when it receives status 286, so terminal states
+	// (and the feedback controls on the result) aren't re-rendered every poll
+	switch req.Status {
+	case "completed", "cancelled", "error":
+		w.WriteHeader(286)
 	}
 
 	templates.ExecuteTemplate(w, "status.html", data)
 }
 
+// feedbackHandler records a 1-5 star rating on a completed revision
+func feedbackHandler(w http.ResponseWriter, r *http.Request) {
+	requestID := r.PathValue("id")
+
+	rev, err := getRevision(r.FormValue("revision"))
+	if err != nil || rev.RequestID != requestID || rev.Status != "completed" {
+		lookupError(w, err, "Revision")
+		return
+	}
+
+	rating, err := strconv.Atoi(r.FormValue("rating"))
+	if err != nil || rating < 1 || rating > 5 {
+		http.Error(w, "Invalid rating", http.StatusBadRequest)
+		return
+	}
+
+	if err := saveFeedback(rev.ID, rating); err != nil {
+		log.Printf("Failed to save feedback for revision %s: %v", rev.ID, err)
+		dbHTTPError(w, err, "Failed to save feedback")
+		return
+	}
+
+	data := struct {
+		RequestID   string
+		RevisionID  string
+		Rating      int
+		RetryOffers []retryAspect
+	}{
+		RequestID:   requestID,
+		RevisionID:  rev.ID,
+		Rating:      rating,
+		RetryOffers: retryAspects,
+	}
+
+	templates.ExecuteTemplate(w, "feedback", data)
+}
+
+// startRevision creates a new revision of a request and queues it for
+// generation in the background
+func startRevision(req *Request, parentRevisionID, kind, prompt string, seed int, intensity string) (*Revision, error) {
+	revisionID, err := generateID(16)
+	if err != nil {
+		return nil, err
+	}
+
+	rev := &Revision{
+		ID:               revisionID,
+		RequestID:        req.ID,
+		ParentRevisionID: parentRevisionID,
+		Kind:             kind,
+		Prompt:           prompt,
+		Seed:             seed,
+		Intensity:        intensity,
+		Model:            userModel(req.UserID),
+	}
+	if err := createRevision(rev); err != nil {
+		return nil, err
+	}
+
+	jobQueue.enqueue(job{
+		userID:    req.UserID,
+		requestID: req.ID,
+		run:       func() { processImageWithReplicate(rev) },
+	})
+	return rev, nil
+}
+
+// ownedRevision loads a request owned by the current user together with one of
+// its completed revisions, writing a 404 if either doesn't match
+func ownedRevision(w http.ResponseWriter, r *http.Request, revisionID string) (*Request, *Revision, bool) {
+	userID, err := getUserID(w, r)
+	if err != nil {
+		http.Error(w, "Failed to generate user ID", http.StatusInternalServerError)
+		return nil, nil, false
+	}
+
+	req, err := getRequest(r.PathValue("id"))
+	if err != nil || req.UserID != userID {
+		lookupError(w, err, "Request")
+		return nil, nil, false
+	}
+
+	rev, err := getRevision(revisionID)
+	if err != nil || rev.RequestID != req.ID || rev.Status != "completed" {
+		lookupError(w, err, "Revision")
+		return nil, nil, false
+	}
+	return req, rev, true
+}
+
+// retryHandler re-runs the prediction for a low-rated revision with a new
+// seed and a prompt emphasizing the aspects the user flagged
+func retryHandler(w http.ResponseWriter, r *http.Request) {
+	req, parent, ok := ownedRevision(w, r, r.FormValue("revision"))
+	if !ok {
+		return
+	}
+
+	rating := getFeedbackRating(parent.ID)
+	if rating == 0 || rating > lowRatingThreshold {
+		http.Error(w, "Only low-rated results can be retried", http.StatusConflict)
+		return
+	}
+
+	var aspects []retryAspect
+	var issues []string
+	for _, key := range r.Form["issue"] {
+		aspect, ok := findRetryAspect(key)
+		if !ok {
+			http.Error(w, "Invalid issue", http.StatusBadRequest)
+			return
+		}
+		aspects = append(aspects, aspect)
+		issues = append(issues, aspect.Key)
+	}
+
+	if err := saveFeedbackIssues(parent.ID, issues); err != nil {
+		log.Printf("Failed to save feedback issues for revision %s: %v", parent.ID, err)
+	}
+
+	prompt := emphasizePrompt(parent.Prompt, aspects)
+	if _, err := startRevision(req, parent.ID, revisionRetry, prompt, perturbSeed(parent.Seed), parent.Intensity); err != nil {
+		log.Printf("Failed to start retry of revision %s: %v", parent.ID, err)
+		http.Error(w, "Failed to start processing", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/processing/"+req.ID, http.StatusSeeOther)
+}
+
+// editRevisionHandler re-runs a revision with a prompt edited by the user
+func editRevisionHandler(w http.ResponseWriter, r *http.Request) {
+	req, parent, ok := ownedRevision(w, r, r.FormValue("revision"))
+	if !ok {
+		return
+	}
+
+	prompt := strings.TrimSpace(r.FormValue("prompt"))
+	if prompt == "" || len(prompt) > maxPromptLength {
+		http.Error(w, fmt.Sprintf("Prompt must be between 1 and %d characters", maxPromptLength), http.StatusBadRequest)
+		return
+	}
+
+	intensity := parent.Intensity
+	if value := r.FormValue("intensity"); value != "" {
+		if intensity, ok = parseIntensity(value); !ok {
+			http.Error(w, "Invalid intensity", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if _, err := startRevision(req, parent.ID, revisionEdit, prompt, parent.Seed, intensity); err != nil {
+		log.Printf("Failed to start edit of revision %s: %v", parent.ID, err)
+		http.Error(w, "Failed to start processing", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/processing/"+req.ID, http.StatusSeeOther)
+}
+
+// resultsHandler shows every revision of a request and lets the user flip
+// between them
+func resultsHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserID(w, r)
+	if err != nil {
+		http.Error(w, "Failed to generate user ID", http.StatusInternalServerError)
+		return
+	}
+
+	// Demo examples can be viewed by anyone
+	req, err := getRequest(r.PathValue("id"))
+	if err != nil || (req.UserID != userID && !isDemoRequest(req)) {
+		lookupError(w, err, "Request")
+		return
+	}
+	example := isDemoRequest(req)
+
+	revisions, err := getRevisions(req.ID)
+	if err != nil {
+		log.Printf("Failed to load revisions for request %s: %v", req.ID, err)
+		dbHTTPError(w, err, "Failed to load revisions")
+		return
+	}
+
+	// Show the requested revision, defaulting to the primary one
+	want := r.URL.Query().Get("rev")
+	var selected *Revision
+	for _, rev := range revisions {
+		if rev.Status != "completed" {
+			continue
+		}
+		if rev.ID == want {
+			selected = rev
+			break
+		}
+		if rev.IsPrimary {
+			selected = rev
+		}
+	}
+	if selected == nil {
+		http.Redirect(w, r, "/processing/"+req.ID, http.StatusSeeOther)
+		return
+	}
+
+	type revisionRow struct {
+		*Revision
+		Number int
+	}
+	rows := make([]revisionRow, len(revisions))
+	for i, rev := range revisions {
+		rows[i] = revisionRow{Revision: rev, Number: i + 1}
+	}
+
+	tags, err := getRequestTags(req.ID)
+	if err != nil {
+		log.Printf("Failed to load tags for request %s: %v", req.ID, err)
+	}
+
+	data := struct {
+		Request         *Request
+		Revisions       []revisionRow
+		Selected        *Revision
+		RequestID       string
+		RevisionID      string
+		Rating          int
+		RetryOffers     []retryAspect
+		MaxPromptLength int
+		ShareURL        string
+		FrameURL        string
+		Tags            []string
+		CanTag          bool
+		Example         bool
+	}{
+		Request:         req,
+		Revisions:       rows,
+		Selected:        selected,
+		RequestID:       req.ID,
+		RevisionID:      selected.ID,
+		Rating:          getFeedbackRating(selected.ID),
+		RetryOffers:     retryAspects,
+		MaxPromptLength: maxPromptLength,
+		ShareURL:        shareURL(r, selected),
+		FrameURL:        frameURL(r, req.ID),
+		Tags:            tags,
+		CanTag:          !isTrialVisitor(r) && !example,
+		Example:         example,
+	}
+
+	templates.ExecuteTemplate(w, "results.html", data)
+}
+
+// saveTagsHandler replaces the tags of one of the user's requests
+func saveTagsHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserID(w, r)
+	if err != nil {
+		http.Error(w, "Failed to generate user ID", http.StatusInternalServerError)
+		return
+	}
+
+	req, err := getRequest(r.PathValue("id"))
+	if err != nil || req.UserID != userID {
+		lookupError(w, err, "Request")
+		return
+	}
+
+	tags, ok := parseTags(r.FormValue("tags"))
+	if !ok {
+		http.Error(w, fmt.Sprintf("A request can have at most %d tags", maxRequestTags), http.StatusBadRequest)
+		return
+	}
+	if err := setRequestTags(userID, req.ID, tags); err != nil {
+		log.Printf("Failed to save tags for request %s: %v", req.ID, err)
+		dbHTTPError(w, err, "Failed to save tags")
+		return
+	}
+
+	http.Redirect(w, r, "/results/"+req.ID, http.StatusSeeOther)
+}
+
+// galleryPageSize is how many requests the gallery shows per page
+const galleryPageSize = 24
+
+// galleryHandler lists the user's requests, newest first, optionally only
+// those with a tag, at a location or matching a search
+func galleryHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserID(w, r)
+	if err != nil {
+		http.Error(w, "Failed to generate user ID", http.StatusInternalServerError)
+		return
+	}
+
+	tag := normalizeTag(r.URL.Query().Get("tag"))
+	search := strings.TrimSpace(r.URL.Query().Get("q"))
+	locationID, _ := strconv.ParseInt(r.URL.Query().Get("location"), 10, 64)
+	precipitation := r.URL.Query().Get("precipitation")
+	if !isValidPrecipitationFilter(precipitation) {
+		precipitation = ""
+	}
+	page, err := strconv.Atoi(r.URL.Query().Get("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+
+	// Load one extra request to know whether there's a next page
+	filter := RequestFilter{Tag: tag, Search: searchQuery(search), LocationID: locationID, Precipitation: precipitation}
+	requests, err := listRequests(userID, filter, galleryPageSize+1, (page-1)*galleryPageSize)
+	if err != nil {
+		log.Printf("Failed to list requests for user %s: %v", userID, err)
+		dbHTTPError(w, err, "Failed to load requests")
+		return
+	}
+	hasNext := len(requests) > galleryPageSize
+	if hasNext {
+		requests = requests[:galleryPageSize]
+	}
+
+	requestTags, err := getUserRequestTags(userID)
+	if err != nil {
+		log.Printf("Failed to load request tags for user %s: %v", userID, err)
+	}
+	tags, err := getUserTags(userID, "", 30)
+	if err != nil {
+		log.Printf("Failed to load tags for user %s: %v", userID, err)
+	}
+	locations, err := getUserLocations(userID)
+	if err != nil {
+		log.Printf("Failed to load locations for user %s: %v", userID, err)
+	}
+
+	items := make([]galleryItem, len(requests))
+	for i, req := range requests {
+		items[i] = galleryItem{Request: req, Tags: requestTags[req.ID]}
+	}
+
+	// A demo instance shows its examples to users who haven't made anything yet
+	var examples []*Request
+	filtered := tag != "" || search != "" || locationID != 0 || precipitation != ""
+	if demoEnabled() && len(items) == 0 && !filtered && page == 1 {
+		if examples, err = listRequests(demoUserID, RequestFilter{}, galleryPageSize, 0); err != nil {
+			log.Printf("Failed to load demo examples: %v", err)
+		}
+	}
+
+	data := struct {
+		Items         []galleryItem
+		Examples      []*Request
+		Tags          []TagCount
+		Tag           string
+		Locations     []LocationCount
+		LocationID    int64
+		Precipitation string
+		Search        string
+		Page          int
+		PrevPage      int
+		NextPage      int
+	}{
+		Items:         items,
+		Examples:      examples,
+		Tags:          tags,
+		Tag:           tag,
+		Locations:     locations,
+		LocationID:    locationID,
+		Precipitation: precipitation,
+		Search:        search,
+		Page:          page,
+	}
+	if page > 1 {
+		data.PrevPage = page - 1
+	}
+	if hasNext {
+		data.NextPage = page + 1
+	}
+
+	templates.ExecuteTemplate(w, "gallery.html", data)
+}
+
+// primaryRevisionHandler makes a completed revision the one the request shows
+func primaryRevisionHandler(w http.ResponseWriter, r *http.Request) {
+	req, rev, ok := ownedRevision(w, r, r.FormValue("revision"))
+	if !ok {
+		return
+	}
+
+	if err := setPrimaryRevision(req.ID, rev.ID); err != nil {
+		log.Printf("Failed to set primary revision %s: %v", rev.ID, err)
+		dbHTTPError(w, err, "Failed to update request")
+		return
+	}
+
+	http.Redirect(w, r, "/results/"+req.ID+"?rev="+rev.ID, http.StatusSeeOther)
+}
+
 // imageHandler serves the processed image
 func imageHandler(w http.ResponseWriter, r *http.Request) {
 	requestID := r.PathValue("id")
 
 	req, err := getRequest(requestID)
 	if err != nil {
-		http.Error(w, "Request not found", http.StatusNotFound)
+		lookupError(w, err, "Request")
 		return
 	}
 
@@ -291,12 +1701,77 @@ func imageHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Serve the image file
+	// Serve the primary result unless a specific revision was asked for
 	imagePath := req.ResultImagePath
-	if _, err := os.Stat(imagePath); os.IsNotExist(err) {
-		http.Error(w, "Image file not found", http.StatusNotFound)
+	var rev *Revision
+	if revisionID := r.URL.Query().Get("rev"); revisionID != "" {
+		rev, err = getRevision(revisionID)
+		if err != nil || rev.RequestID != req.ID || rev.Status != "completed" {
+			lookupError(w, err, "Revision")
+			return
+		}
+		imagePath = rev.ResultImagePath
+	}
+
+	// ?download=1 saves the file instead of showing it. Only downloads are
+	// counted as such; the results page shows the same image many times.
+	download := r.URL.Query().Get("download") == "1"
+	downloaded := func(output, filename string) {
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
+		properties := map[string]interface{}{"output": output}
+		if rev != nil {
+			properties["revision_id"] = rev.ID
+		}
+		trackEvent(eventResultDownloaded, req.UserID, req.ID, properties)
+	}
+
+	// ?output=postcard serves the result composed into a postcard instead
+	output := imageOutput(r.URL.Query())
+	if output == imageOutputPostcard {
+		if rev == nil {
+			if rev, err = getPrimaryRevision(req.ID); err != nil {
+				lookupError(w, err, "Revision")
+				return
+			}
+		}
+		if rev.PostcardPath == "" {
+			http.Error(w, "Postcard not available", http.StatusNotFound)
+			return
+		}
+		if download {
+			downloaded("postcard", "skyweave-"+req.ID+"-postcard.jpg")
+		}
+		serveMediaFile(w, r, rev.PostcardPath)
+		return
+	}
+
+	// ?sidecar=1 downloads the image zipped with the prompt and weather it was made from
+	if output == imageOutputSidecar {
+		if rev == nil {
+			if rev, err = getPrimaryRevision(req.ID); err != nil {
+				lookupError(w, err, "Revision")
+				return
+			}
+		}
+		trackEvent(eventResultDownloaded, req.UserID, req.ID, map[string]interface{}{"output": "bundle", "revision_id": rev.ID})
+		serveResultBundle(w, req, rev)
+		return
+	}
+
+	if download {
+		downloaded("image", "skyweave-"+req.ID+".jpg")
+	}
+	serveMediaFile(w, r, imagePath)
+}
+
+// originalHandler serves the sanitized copy of the uploaded original
+func originalHandler(w http.ResponseWriter, r *http.Request) {
+	req, err := getRequest(r.PathValue("id"))
+	if err != nil {
+		lookupError(w, err, "Request")
 		return
 	}
 
-	http.ServeFile(w, r, imagePath)
+	// Uploads are re-encoded to JPEG on ingestion and stored as .jpg
+	serveMediaFile(w, r, req.ImagePath)
 }
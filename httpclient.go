@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"time"
+)
+
+// Outbound calls go through one client per provider, so connections to it
+// are kept alive and reused rather than opened for every call, which under
+// batch loads ran out of ephemeral ports. Each client has its own pool, sized
+// for how many calls to the provider run at once, and logs through the
+// outbound logging transport. Calls that must finish sooner than the
+// client's timeout set a deadline on their request's context.
+var (
+	openWeatherClient = newProviderClient(15*time.Second, 16) // geocoding, weather, timezones and map layers
+	openMeteoClient   = newProviderClient(30*time.Second, 8)
+	replicateClient   = newProviderClient(60*time.Second, 32) // the API and result downloads
+	promptLLMClient   = newProviderClient(60*time.Second, 8)
+	mapTileClient     = newProviderClient(10*time.Second, 8)
+	s3Client          = newProviderClient(5*time.Minute, 16)
+	captchaClient     = newProviderClient(10*time.Second, 4)
+	webhookClient     = newProviderClient(10*time.Second, 4)
+	sentryClient      = newProviderClient(10*time.Second, 2)
+	analyticsClient   = newProviderClient(10*time.Second, 4)
+	secretsClient     = newSecretsClient(10*time.Second, 2)
+)
+
+// newProviderClient returns a client with its own connection pool, keeping
+// up to maxIdlePerHost idle connections to each host for reuse. HTTP/2 is
+// used where the server offers it.
+func newProviderClient(timeout time.Duration, maxIdlePerHost int) *http.Client {
+	return &http.Client{Transport: &loggingTransport{base: newProviderTransport(maxIdlePerHost)}, Timeout: timeout}
+}
+
+// newSecretsClient is a provider client for the secret managers. Their
+// responses are the secrets themselves, so the outbound log leaves the
+// bodies out.
+func newSecretsClient(timeout time.Duration, maxIdlePerHost int) *http.Client {
+	transport := &loggingTransport{base: newProviderTransport(maxIdlePerHost), secretResponses: true}
+	return &http.Client{Transport: transport, Timeout: timeout}
+}
+
+// newProviderTransport returns a transport with its own connection pool
+func newProviderTransport(maxIdlePerHost int) *http.Transport {
+	return &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   10 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          4 * maxIdlePerHost,
+		MaxIdleConnsPerHost:   maxIdlePerHost,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: time.Second,
+	}
+}
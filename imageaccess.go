@@ -0,0 +1,102 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// IMAGE_HOTLINK_PROTECTION values: whether result images may be embedded
+// in pages of other sites than SkyWeave and IMAGE_ALLOWED_REFERRERS
+const (
+	hotlinkOff      = "off"      // anywhere
+	hotlinkReferrer = "referrer" // nowhere else
+	hotlinkSigned   = "signed"   // only from signed links, which expire
+)
+
+// guardImage logs every image it serves, results and share cards, and
+// refuses images requested from pages of other sites that
+// IMAGE_HOTLINK_PROTECTION doesn't allow.
+// Requests without a Referer, like links opened from emails or browsers
+// that don't send one, are never refused.
+func guardImage(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cfg := currentConfig()
+		referrer := r.Referer()
+		if !hotlinkAllowed(r, referrer, cfg) {
+			log.Printf("Refused hotlinked image %s for %s from %s", imageLogName(r), clientIP(r), referrer)
+			http.Error(w, "Images can't be embedded on other sites", http.StatusForbidden)
+			return
+		}
+		if !cfg.ImageAccessLog {
+			next(w, r)
+			return
+		}
+
+		counter := &countingResponseWriter{ResponseWriter: w, status: http.StatusOK}
+		next(counter, r)
+		if counter.status < http.StatusBadRequest {
+			log.Printf("Served image %s to %s: %d, %d bytes, referrer %q",
+				imageLogName(r), clientIP(r), counter.status, counter.bytes, referrer)
+		}
+	}
+}
+
+// imageLogName names the image requested in the log: a request's result and
+// its revision, or the card of a share
+func imageLogName(r *http.Request) string {
+	if token := r.PathValue("token"); token != "" {
+		return "card of share " + token
+	}
+	rev := r.URL.Query().Get("rev")
+	if rev == "" {
+		rev = "primary"
+	}
+	return r.PathValue("id") + " (revision " + rev + ")"
+}
+
+// hotlinkAllowed reports whether an image may be served to a page at referrer
+func hotlinkAllowed(r *http.Request, referrer string, cfg *Config) bool {
+	if cfg.HotlinkProtection == hotlinkOff || referrer == "" {
+		return true
+	}
+	from, err := url.Parse(referrer)
+	if err != nil || from.Hostname() == "" {
+		return false
+	}
+	host := strings.ToLower(from.Hostname())
+
+	if own, err := url.Parse(absoluteURL(r, "/")); err == nil && strings.EqualFold(own.Hostname(), host) {
+		return true
+	}
+	for _, allowed := range cfg.ImageAllowedReferrers {
+		if host == allowed || (strings.HasPrefix(allowed, "*.") && strings.HasSuffix(host, allowed[1:])) {
+			return true
+		}
+	}
+	return cfg.HotlinkProtection == hotlinkSigned && hasValidImageSignature(r)
+}
+
+// countingResponseWriter records the status and body size of a response
+type countingResponseWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *countingResponseWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *countingResponseWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (w *countingResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
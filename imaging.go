@@ -0,0 +1,505 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	// ErrInvalidImage is returned when an upload isn't a decodable raster image
+	// in one of the allowed formats
+	ErrInvalidImage = errors.New("unsupported or corrupt image")
+	// ErrImageTooLarge is returned when an upload exceeds the size limits
+	ErrImageTooLarge = errors.New("image is too large")
+)
+
+const (
+	maxUploadPixels   = 50_000_000 // guards against decompression bombs
+	sanitizedQuality  = 92
+	exifOrientationID = 0x0112
+)
+
+// uploadFormat is an image format uploads can be decoded from
+type uploadFormat struct {
+	Name     string // as reported by image.DecodeConfig
+	Label    string
+	MIMEType string
+}
+
+// uploadFormats maps the file extensions UPLOAD_EXTENSIONS may allow to
+// their decoders
+var uploadFormats = map[string]uploadFormat{
+	".jpg":  {"jpeg", "JPEG", "image/jpeg"},
+	".jpeg": {"jpeg", "JPEG", "image/jpeg"},
+	".png":  {"png", "PNG", "image/png"},
+	".gif":  {"gif", "GIF", "image/gif"},
+}
+
+// defaultUploadExtensions are the file types accepted unless UPLOAD_EXTENSIONS says otherwise
+const defaultUploadExtensions = ".jpg,.jpeg,.png,.gif"
+
+// UploadLimits restrict uploaded photos. They're enforced on the server and
+// handed to the start form, so it can reject a file before uploading it.
+type UploadLimits struct {
+	MaxBytes     int64    `json:"max_bytes"`
+	Extensions   []string `json:"extensions"` // lower case, with the leading dot
+	MIMETypes    []string `json:"mime_types"`
+	MaxDimension int      `json:"max_dimension"` // longest side in pixels
+}
+
+// uploadSlots counts the uploads being parsed and saved. Each buffers up to
+// UPLOAD_MAX_MB in memory or temporary files and then decodes the image, so
+// a burst of them could exhaust a small server's memory and disk IO.
+var uploadSlots struct {
+	sync.Mutex
+	active int
+}
+
+// acquireUploadSlot claims a slot for parsing and saving an upload, unless
+// UPLOAD_CONCURRENCY uploads already hold one. It doesn't wait, so the client
+// can be told to retry instead of its connection being held open.
+func acquireUploadSlot() (release func(), ok bool) {
+	uploadSlots.Lock()
+	defer uploadSlots.Unlock()
+	if uploadSlots.active >= currentConfig().UploadConcurrency {
+		return nil, false
+	}
+	uploadSlots.active++
+	return func() {
+		uploadSlots.Lock()
+		uploadSlots.active--
+		uploadSlots.Unlock()
+	}, true
+}
+
+// parseUploadLimits reads UPLOAD_MAX_MB, UPLOAD_EXTENSIONS and
+// UPLOAD_MAX_DIMENSION, falling back to the defaults for invalid values
+func parseUploadLimits(maxMB, extensions, maxDimension string) UploadLimits {
+	limits := UploadLimits{MaxBytes: 32 << 20, MaxDimension: 10000}
+
+	if mb, err := strconv.ParseFloat(maxMB, 64); err != nil || mb <= 0 {
+		log.Printf("Warning: invalid UPLOAD_MAX_MB %q, using 32", maxMB)
+	} else {
+		limits.MaxBytes = int64(mb * (1 << 20))
+	}
+
+	if px, err := strconv.Atoi(maxDimension); err != nil || px <= 0 {
+		log.Printf("Warning: invalid UPLOAD_MAX_DIMENSION %q, using 10000", maxDimension)
+	} else {
+		limits.MaxDimension = px
+	}
+
+	seenTypes := make(map[string]bool)
+	for _, ext := range strings.Split(extensions, ",") {
+		ext = strings.ToLower(strings.TrimSpace(ext))
+		if ext == "" {
+			continue
+		}
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		format, ok := uploadFormats[ext]
+		if !ok {
+			log.Printf("Warning: ignoring %s in UPLOAD_EXTENSIONS, only .jpg, .jpeg, .png and .gif can be decoded", ext)
+			continue
+		}
+		if slices.Contains(limits.Extensions, ext) {
+			continue
+		}
+		limits.Extensions = append(limits.Extensions, ext)
+		if !seenTypes[format.MIMEType] {
+			seenTypes[format.MIMEType] = true
+			limits.MIMETypes = append(limits.MIMETypes, format.MIMEType)
+		}
+	}
+	if len(limits.Extensions) == 0 {
+		log.Printf("Warning: UPLOAD_EXTENSIONS allows no image formats, using the defaults")
+		return parseUploadLimits(maxMB, defaultUploadExtensions, maxDimension)
+	}
+	return limits
+}
+
+// AllowsFile reports whether an upload's file name has an allowed extension
+func (l UploadLimits) AllowsFile(filename string) bool {
+	return slices.Contains(l.Extensions, strings.ToLower(filepath.Ext(filename)))
+}
+
+// allowsFormat reports whether a decoded image format is allowed
+func (l UploadLimits) allowsFormat(name string) bool {
+	for _, ext := range l.Extensions {
+		if uploadFormats[ext].Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// FormatList names the allowed formats for error messages, e.g. "JPEG, PNG or GIF"
+func (l UploadLimits) FormatList() string {
+	var labels []string
+	for _, ext := range l.Extensions {
+		if label := uploadFormats[ext].Label; !slices.Contains(labels, label) {
+			labels = append(labels, label)
+		}
+	}
+	if len(labels) == 1 {
+		return labels[0]
+	}
+	return strings.Join(labels[:len(labels)-1], ", ") + " or " + labels[len(labels)-1]
+}
+
+// Accept is the file input's accept attribute
+func (l UploadLimits) Accept() string {
+	return strings.Join(append(slices.Clone(l.MIMETypes), l.Extensions...), ",")
+}
+
+// sanitizeImage decodes an uploaded image, applies its EXIF orientation and
+// re-encodes it as a fresh JPEG. Only pixel data survives, so embedded
+// scripts, polyglot payloads and metadata are dropped.
+func sanitizeImage(src io.Reader, limits UploadLimits) ([]byte, error) {
+	data, err := io.ReadAll(src)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read upload: %w", err)
+	}
+
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidImage, err)
+	}
+	if !limits.allowsFormat(format) {
+		return nil, fmt.Errorf("%w: %s uploads aren't allowed", ErrInvalidImage, format)
+	}
+	if config.Width > limits.MaxDimension || config.Height > limits.MaxDimension ||
+		config.Width*config.Height > maxUploadPixels {
+		return nil, fmt.Errorf("%w: %dx%d", ErrImageTooLarge, config.Width, config.Height)
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidImage, err)
+	}
+
+	img = applyOrientation(img, exifOrientation(data))
+	return encodeJPEG(img)
+}
+
+// encodeJPEG encodes img as a JPEG at the quality stored images are kept at
+func encodeJPEG(img image.Image) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: sanitizedQuality}); err != nil {
+		return nil, fmt.Errorf("failed to encode image: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// exifOrientation returns the EXIF orientation (1-8) of a JPEG or PNG, or 1
+// if absent
+func exifOrientation(data []byte) int {
+	if bytes.HasPrefix(data, []byte(pngSignature)) {
+		return pngOrientation(data)
+	}
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return 1
+	}
+
+	// Walk the JPEG segments looking for the APP1 Exif segment
+	pos := 2
+	for pos+4 <= len(data) {
+		if data[pos] != 0xFF {
+			return 1
+		}
+		marker := data[pos+1]
+		if marker == 0xDA || marker == 0xD9 {
+			// Start of scan or end of image: no more metadata
+			return 1
+		}
+		size := int(binary.BigEndian.Uint16(data[pos+2 : pos+4]))
+		if size < 2 || pos+2+size > len(data) {
+			return 1
+		}
+		segment := data[pos+4 : pos+2+size]
+		if marker == 0xE1 && len(segment) > 6 && string(segment[:6]) == "Exif\x00\x00" {
+			return parseTIFFOrientation(segment[6:])
+		}
+		pos += 2 + size
+	}
+	return 1
+}
+
+// pngSignature starts every PNG file
+const pngSignature = "\x89PNG\r\n\x1a\n"
+
+// pngOrientation returns the orientation from a PNG's eXIf chunk, which
+// phones and editors write when saving screenshots and exports and browsers
+// honor when displaying them. The chunk holds EXIF data without a header.
+func pngOrientation(data []byte) int {
+	pos := len(pngSignature)
+	for pos+8 <= len(data) {
+		size := int(binary.BigEndian.Uint32(data[pos : pos+4]))
+		chunkType := string(data[pos+4 : pos+8])
+		if size < 0 || pos+12+size > len(data) {
+			return 1
+		}
+		switch chunkType {
+		case "eXIf":
+			return parseTIFFOrientation(data[pos+8 : pos+8+size])
+		case "IDAT", "IEND":
+			// eXIf must come before the image data
+			return 1
+		}
+		pos += 12 + size // length, type, data and CRC
+	}
+	return 1
+}
+
+// parseTIFFOrientation reads the orientation tag from IFD0 of a TIFF header
+func parseTIFFOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+
+	ifd := int(order.Uint32(tiff[4:8]))
+	if ifd+2 > len(tiff) {
+		return 1
+	}
+	entries := int(order.Uint16(tiff[ifd : ifd+2]))
+	for i := 0; i < entries; i++ {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(tiff) {
+			return 1
+		}
+		if order.Uint16(tiff[entry:entry+2]) == exifOrientationID {
+			orientation := int(order.Uint16(tiff[entry+8 : entry+10]))
+			if orientation < 1 || orientation > 8 {
+				return 1
+			}
+			return orientation
+		}
+	}
+	return 1
+}
+
+// applyOrientation rotates/flips an image so it displays upright for the
+// given EXIF orientation value
+func applyOrientation(img image.Image, orientation int) image.Image {
+	if orientation <= 1 || orientation > 8 {
+		return img
+	}
+
+	bounds := img.Bounds()
+	src := image.NewNRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(src, src.Bounds(), img, bounds.Min, draw.Src)
+
+	w, h := src.Bounds().Dx(), src.Bounds().Dy()
+	dw, dh := w, h
+	if orientation >= 5 {
+		// Orientations 5-8 swap width and height
+		dw, dh = h, w
+	}
+	dst := image.NewNRGBA(image.Rect(0, 0, dw, dh))
+
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2: // mirror horizontal
+				dx, dy = w-1-x, y
+			case 3: // rotate 180
+				dx, dy = w-1-x, h-1-y
+			case 4: // mirror vertical
+				dx, dy = x, h-1-y
+			case 5: // transpose
+				dx, dy = y, x
+			case 6: // rotate 90 clockwise
+				dx, dy = h-1-y, x
+			case 7: // transverse
+				dx, dy = h-1-y, w-1-x
+			case 8: // rotate 90 counter-clockwise
+				dx, dy = y, w-1-x
+			}
+			si := src.PixOffset(x, y)
+			di := dst.PixOffset(dx, dy)
+			copy(dst.Pix[di:di+4], src.Pix[si:si+4])
+		}
+	}
+	return dst
+}
+
+// downscaleImage shrinks an image so neither side is longer than
+// maxDimension, re-encoded as a JPEG. Smaller images are returned untouched.
+func downscaleImage(data []byte, maxDimension int) ([]byte, error) {
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode image: %w", err)
+	}
+
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	if w <= maxDimension && h <= maxDimension {
+		return data, nil
+	}
+	scale := float64(maxDimension) / float64(max(w, h))
+	dw, dh := max(1, int(math.Round(float64(w)*scale))), max(1, int(math.Round(float64(h)*scale)))
+	return encodeJPEG(resizeImage(img, bounds, dw, dh))
+}
+
+// resizeImage scales the part of img in rect to dw by dh pixels, averaging
+// the block of source pixels behind each destination pixel when shrinking
+func resizeImage(img image.Image, rect image.Rectangle, dw, dh int) *image.NRGBA {
+	w, h := rect.Dx(), rect.Dy()
+	src := image.NewNRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(src, src.Bounds(), img, rect.Min, draw.Src)
+
+	dst := image.NewNRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		y0, y1 := y*h/dh, max((y+1)*h/dh, y*h/dh+1)
+		for x := 0; x < dw; x++ {
+			x0, x1 := x*w/dw, max((x+1)*w/dw, x*w/dw+1)
+			var sum [4]int
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					i := src.PixOffset(sx, sy)
+					for c := range sum {
+						sum[c] += int(src.Pix[i+c])
+					}
+				}
+			}
+			n := (y1 - y0) * (x1 - x0)
+			di := dst.PixOffset(x, y)
+			for c := range sum {
+				dst.Pix[di+c] = uint8(sum[c] / n)
+			}
+		}
+	}
+	return dst
+}
+
+// diffThumbnailSize is the side of the grayscale thumbnails images are
+// compared at. Comparing thumbnails ignores JPEG noise and differences in
+// output size, and keeps the comparison cheap.
+const diffThumbnailSize = 64
+
+// decodeImageFile decodes the image stored at path
+func decodeImageFile(path string) (image.Image, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	img, _, err := image.Decode(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode image: %w", err)
+	}
+	return img, nil
+}
+
+// grayThumbnail averages the part of img inside rect down to a size×size
+// grayscale thumbnail, stretching it if the aspect ratio differs
+func grayThumbnail(img image.Image, rect image.Rectangle, size int) ([]float64, error) {
+	rect = rect.Intersect(img.Bounds())
+	w, h := rect.Dx(), rect.Dy()
+	if w < size || h < size {
+		return nil, fmt.Errorf("image is smaller than %dx%d", size, size)
+	}
+	gray := image.NewGray(image.Rect(0, 0, w, h))
+	draw.Draw(gray, gray.Bounds(), img, rect.Min, draw.Src)
+
+	thumb := make([]float64, size*size)
+	for y := 0; y < size; y++ {
+		y0, y1 := y*h/size, (y+1)*h/size
+		for x := 0; x < size; x++ {
+			x0, x1 := x*w/size, (x+1)*w/size
+			sum := 0
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					sum += int(gray.Pix[gray.PixOffset(sx, sy)])
+				}
+			}
+			thumb[y*size+x] = float64(sum) / float64((y1-y0)*(x1-x0))
+		}
+	}
+	return thumb, nil
+}
+
+// ssimDifference is one minus the structural similarity (SSIM) of two
+// size×size thumbnails, averaged over 8×8 windows: 0 for identical images and
+// up to 1 for unrelated ones
+func ssimDifference(a, b []float64, size int) float64 {
+	const window = 8
+	const c1, c2 = (0.01 * 255) * (0.01 * 255), (0.03 * 255) * (0.03 * 255)
+	var total float64
+	var windows int
+	for wy := 0; wy < size; wy += window {
+		for wx := 0; wx < size; wx += window {
+			var sumA, sumB, sumAA, sumBB, sumAB float64
+			for y := wy; y < wy+window; y++ {
+				for x := wx; x < wx+window; x++ {
+					pa, pb := a[y*size+x], b[y*size+x]
+					sumA += pa
+					sumB += pb
+					sumAA += pa * pa
+					sumBB += pb * pb
+					sumAB += pa * pb
+				}
+			}
+			n := float64(window * window)
+			meanA, meanB := sumA/n, sumB/n
+			varA, varB := sumAA/n-meanA*meanA, sumBB/n-meanB*meanB
+			cov := sumAB/n - meanA*meanB
+			total += ((2*meanA*meanB + c1) * (2*cov + c2)) /
+				((meanA*meanA + meanB*meanB + c1) * (varA + varB + c2))
+			windows++
+		}
+	}
+	return min(1, max(0, 1-total/float64(windows)))
+}
+
+// imageDifference scores how much the result at resultPath differs from the
+// original at originalPath, from 0 (identical) to 1 (unrelated), by comparing
+// their thumbnails
+func imageDifference(originalPath, resultPath string) (float64, error) {
+	original, err := decodeImageFile(originalPath)
+	if err != nil {
+		return 0, fmt.Errorf("original: %w", err)
+	}
+	result, err := decodeImageFile(resultPath)
+	if err != nil {
+		return 0, fmt.Errorf("result: %w", err)
+	}
+
+	a, err := grayThumbnail(original, original.Bounds(), diffThumbnailSize)
+	if err != nil {
+		return 0, fmt.Errorf("original: %w", err)
+	}
+	b, err := grayThumbnail(result, result.Bounds(), diffThumbnailSize)
+	if err != nil {
+		return 0, fmt.Errorf("result: %w", err)
+	}
+	return ssimDifference(a, b, diffThumbnailSize), nil
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"slices"
+	"sort"
+	"sync"
+)
+
+// job is a unit of background image generation work owned by a user
+type job struct {
+	userID    string
+	requestID string
+	run       func()
+}
+
+// fairQueue hands out jobs round-robin across users, so one user queueing
+// many jobs can't starve everyone else. Each user's own jobs stay in order.
+type fairQueue struct {
+	mu      sync.Mutex
+	ready   *sync.Cond
+	pending map[string][]job // queued jobs per user
+	order   []string         // users with queued jobs, in round-robin order
+	running map[string]int   // jobs currently running per user
+}
+
+// UserQueueStats is the number of queued and running jobs for one user
+type UserQueueStats struct {
+	UserID  string
+	Queued  int
+	Running int
+}
+
+var jobQueue = newFairQueue()
+
+func newFairQueue() *fairQueue {
+	q := &fairQueue{
+		pending: make(map[string][]job),
+		running: make(map[string]int),
+	}
+	q.ready = sync.NewCond(&q.mu)
+	return q
+}
+
+// enqueue adds a job behind the user's earlier jobs
+func (q *fairQueue) enqueue(j job) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.pending[j.userID]) == 0 {
+		q.order = append(q.order, j.userID)
+	}
+	q.pending[j.userID] = append(q.pending[j.userID], j)
+	q.ready.Signal()
+}
+
+// next blocks until a job is available and takes the oldest job of the user
+// whose turn it is
+func (q *fairQueue) next() job {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for len(q.order) == 0 {
+		q.ready.Wait()
+	}
+
+	userID := q.order[0]
+	q.order = q.order[1:]
+	jobs := q.pending[userID]
+	j := jobs[0]
+	if len(jobs) > 1 {
+		q.pending[userID] = jobs[1:]
+		q.order = append(q.order, userID)
+	} else {
+		delete(q.pending, userID)
+	}
+	q.running[userID]++
+	return j
+}
+
+// done marks a job taken with next as finished
+func (q *fairQueue) done(j job) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.running[j.userID]--; q.running[j.userID] <= 0 {
+		delete(q.running, j.userID)
+	}
+}
+
+// position counts the queued jobs that will be handed out before the user's
+// job for a request, replaying next's round-robin without taking anything.
+// It's false when no such job is queued on this instance.
+func (q *fairQueue) position(userID, requestID string) (int, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	order := slices.Clone(q.order)
+	taken := make(map[string]int, len(order))
+	ahead := 0
+	for len(order) > 0 {
+		user := order[0]
+		order = order[1:]
+		jobs := q.pending[user]
+		if j := jobs[taken[user]]; j.userID == userID && j.requestID == requestID {
+			return ahead, true
+		}
+		ahead++
+		if taken[user]++; taken[user] < len(jobs) {
+			order = append(order, user)
+		}
+	}
+	return 0, false
+}
+
+// stats returns per-user queued and running counts, busiest users first
+func (q *fairQueue) stats() []UserQueueStats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	byUser := make(map[string]*UserQueueStats)
+	get := func(userID string) *UserQueueStats {
+		if byUser[userID] == nil {
+			byUser[userID] = &UserQueueStats{UserID: userID}
+		}
+		return byUser[userID]
+	}
+	for userID, jobs := range q.pending {
+		get(userID).Queued = len(jobs)
+	}
+	for userID, n := range q.running {
+		get(userID).Running = n
+	}
+
+	stats := make([]UserQueueStats, 0, len(byUser))
+	for _, s := range byUser {
+		stats = append(stats, *s)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if a, b := stats[i].Queued+stats[i].Running, stats[j].Queued+stats[j].Running; a != b {
+			return a > b
+		}
+		return stats[i].UserID < stats[j].UserID
+	})
+	return stats
+}
+
+// startJobWorkers starts n workers that process queued jobs
+func startJobWorkers(n int) {
+	for i := 0; i < n; i++ {
+		go func() {
+			for {
+				j := jobQueue.next()
+				runSafe(j.requestID, j.run)
+				jobQueue.done(j)
+			}
+		}()
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+)
+
+// systemdListenFDStart is the first file descriptor passed by systemd socket activation
+const systemdListenFDStart = 3
+
+// newListener creates the server listener. In order of precedence it uses a
+// socket passed by systemd socket activation, a Unix socket at socketPath, or
+// a TCP socket on host:port (host may be empty, a hostname, or an IPv4/IPv6 address).
+func newListener(host, port, socketPath string) (net.Listener, error) {
+	if listener, err := systemdListener(); listener != nil || err != nil {
+		return listener, err
+	}
+
+	if socketPath != "" {
+		// Remove a stale socket left behind by a previous run
+		if err := os.Remove(socketPath); err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("failed to remove stale socket: %w", err)
+		}
+		listener, err := net.Listen("unix", socketPath)
+		if err != nil {
+			return nil, err
+		}
+		// Allow a reverse proxy running as another user in the same group to connect
+		if err := os.Chmod(socketPath, 0660); err != nil {
+			listener.Close()
+			return nil, fmt.Errorf("failed to set socket permissions: %w", err)
+		}
+		return listener, nil
+	}
+
+	return net.Listen("tcp", net.JoinHostPort(host, port))
+}
+
+// systemdListener returns the first socket passed via systemd socket
+// activation (LISTEN_PID/LISTEN_FDS), or nil if the process wasn't activated
+func systemdListener() (net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+
+	fds, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || fds < 1 {
+		return nil, nil
+	}
+
+	// Don't pass the sockets on to child processes
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	file := os.NewFile(uintptr(systemdListenFDStart), "systemd-socket")
+	defer file.Close()
+
+	listener, err := net.FileListener(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to use systemd socket: %w", err)
+	}
+	return listener, nil
+}
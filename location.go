@@ -0,0 +1,283 @@
+package main
+
+import (
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Location input modes selectable on the start form
+const (
+	locationModeAuto   = "auto"
+	locationModeCity   = "city"
+	locationModeZip    = "zip"
+	locationModeCoords = "coords"
+)
+
+// postalCodePatterns holds the postal code formats we recognize, keyed by
+// ISO 3166 country code
+var postalCodePatterns = map[string]*regexp.Regexp{
+	"US": regexp.MustCompile(`^\d{5}(-\d{4})?$`),
+	"CA": regexp.MustCompile(`^[A-Z]\d[A-Z] ?\d[A-Z]\d$`),
+	"GB": regexp.MustCompile(`^[A-Z]{1,2}\d[A-Z\d]? ?\d[A-Z]{2}$`),
+	"DE": regexp.MustCompile(`^\d{5}$`),
+	"FR": regexp.MustCompile(`^\d{5}$`),
+	"ES": regexp.MustCompile(`^\d{5}$`),
+	"IT": regexp.MustCompile(`^\d{5}$`),
+	"NL": regexp.MustCompile(`^\d{4} ?[A-Z]{2}$`),
+	"AU": regexp.MustCompile(`^\d{4}$`),
+	"JP": regexp.MustCompile(`^\d{3}-?\d{4}$`),
+	"IN": regexp.MustCompile(`^\d{6}$`),
+	"BR": regexp.MustCompile(`^\d{5}-?\d{3}$`),
+}
+
+var coordinatesPattern = regexp.MustCompile(`^\s*(-?\d{1,3}(?:\.\d+)?)\s*[, ]\s*(-?\d{1,3}(?:\.\d+)?)\s*$`)
+
+// maxLocationNameLength caps how much of a location name can reach the prompt
+const maxLocationNameLength = 80
+
+// directivePattern matches instruction-like phrases that have no place in a place name
+var directivePattern = regexp.MustCompile(`(?i)\b(ignore|disregard|forget|override)\b[^,]*\b(instructions?|prompts?|above|previous|rules)\b|\b(system|assistant|user|prompt|instruction)s?\s*:|\b(you must|you should|instead|do not|don't)\b`)
+
+// isValidLocationMode reports whether mode is one of the supported input modes
+func isValidLocationMode(mode string) bool {
+	switch mode {
+	case locationModeAuto, locationModeCity, locationModeZip, locationModeCoords:
+		return true
+	}
+	return false
+}
+
+// parseCoordinates parses "lat,lon" input and validates the ranges
+func parseCoordinates(input string) (lat, lon float64, ok bool) {
+	matches := coordinatesPattern.FindStringSubmatch(input)
+	if matches == nil {
+		return 0, 0, false
+	}
+
+	lat, err := strconv.ParseFloat(matches[1], 64)
+	if err != nil || lat < -90 || lat > 90 {
+		return 0, 0, false
+	}
+	lon, err = strconv.ParseFloat(matches[2], 64)
+	if err != nil || lon < -180 || lon > 180 {
+		return 0, 0, false
+	}
+	return lat, lon, true
+}
+
+// unqualifiedPostalCountries lists, in priority order, the countries whose
+// postal codes we accept without an explicit country code
+var unqualifiedPostalCountries = []string{"US", "CA", "GB", "NL"}
+
+// parsePostalCode splits "code,CC" input and checks the code against the
+// country's format. Without a country code, only formats that are unambiguous
+// (US first, as OpenWeather defaults to it) are accepted.
+// It returns the query to send to the zip geocoding API.
+func parsePostalCode(input string) (query string, ok bool) {
+	code := strings.ToUpper(strings.TrimSpace(input))
+	country := ""
+	if i := strings.LastIndex(code, ","); i >= 0 {
+		country = strings.TrimSpace(code[i+1:])
+		code = strings.TrimSpace(code[:i])
+	}
+
+	if country == "" {
+		for _, candidate := range unqualifiedPostalCountries {
+			if postalCodePatterns[candidate].MatchString(code) {
+				country = candidate
+				break
+			}
+		}
+	}
+
+	pattern, known := postalCodePatterns[country]
+	if !known || !pattern.MatchString(code) {
+		return "", false
+	}
+
+	// OpenWeather only resolves the outward part of UK and Canadian codes
+	if country == "GB" || country == "CA" {
+		code = strings.ReplaceAll(code, " ", "")
+		code = code[:len(code)-3]
+	}
+
+	return code + "," + country, true
+}
+
+// detectLocationMode picks the input mode for auto-detected location input
+func detectLocationMode(input string) string {
+	if _, _, ok := parseCoordinates(input); ok {
+		return locationModeCoords
+	}
+	if _, ok := parsePostalCode(input); ok {
+		return locationModeZip
+	}
+	return locationModeCity
+}
+
+// sanitizeLocationName normalizes a location name before it is embedded in the
+// image prompt: only the first line is kept, instruction-like phrases are
+// dropped, only characters found in place names survive and the result is
+// length-capped
+func sanitizeLocationName(name string) string {
+	// A place name is a single line; anything after a line break is not part of it
+	if i := strings.IndexAny(name, "\r\n"); i >= 0 {
+		name = name[:i]
+	}
+	name = directivePattern.ReplaceAllString(name, " ")
+
+	var b strings.Builder
+	for _, r := range name {
+		switch {
+		case unicode.IsLetter(r), unicode.IsDigit(r), unicode.IsMark(r):
+			b.WriteRune(r)
+		case strings.ContainsRune(" ,.-'()", r):
+			b.WriteRune(r)
+		case unicode.IsSpace(r), unicode.IsControl(r):
+			b.WriteRune(' ')
+		}
+	}
+
+	cleaned := strings.Join(strings.Fields(b.String()), " ")
+
+	if runes := []rune(cleaned); len(runes) > maxLocationNameLength {
+		cleaned = strings.TrimSpace(string(runes[:maxLocationNameLength]))
+	}
+	cleaned = strings.Trim(cleaned, " ,.-")
+
+	if cleaned == "" {
+		return "the pictured location"
+	}
+	return cleaned
+}
+
+// sameLocationRadiusKm is how close two geocoded places with the same name
+// and country must be to count as one location
+const sameLocationRadiusKm = 25
+
+// locationKey is the case-folded, whitespace-normalized form of a place name
+// and country code that canonical locations are matched on
+func locationKey(name, country string) string {
+	return strings.ToLower(strings.Join(strings.Fields(name), " ")) + "," + strings.ToUpper(strings.TrimSpace(country))
+}
+
+// distanceKm is the great-circle distance between two coordinates
+func distanceKm(lat1, lon1, lat2, lon2 float64) float64 {
+	const earthRadiusKm = 6371
+	rad := math.Pi / 180
+	dLat := (lat2 - lat1) * rad
+	dLon := (lon2 - lon1) * rad
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(lat1*rad)*math.Cos(lat2*rad)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadiusKm * math.Asin(math.Sqrt(a))
+}
+
+// countryLanguages is the main language place names are written in locally,
+// by ISO 3166 country code, for offering the local name of a place
+var countryLanguages = map[string]string{
+	"AT": "de", "BE": "nl", "BR": "pt", "CH": "de", "CN": "zh", "CZ": "cs", "DE": "de",
+	"DK": "da", "ES": "es", "FI": "fi", "FR": "fr", "GR": "el", "HU": "hu", "IT": "it",
+	"JP": "ja", "KR": "ko", "MX": "es", "NL": "nl", "NO": "no", "PL": "pl", "PT": "pt",
+	"RU": "ru", "SE": "sv", "TR": "tr", "TW": "zh", "UA": "uk",
+}
+
+// languageNames labels the languages place names can be shown in
+var languageNames = map[string]string{
+	"cs": "Čeština", "da": "Dansk", "de": "Deutsch", "el": "Ελληνικά", "en": "English",
+	"es": "Español", "fi": "Suomi", "fr": "Français", "hu": "Magyar", "it": "Italiano",
+	"ja": "日本語", "ko": "한국어", "nl": "Nederlands", "no": "Norsk", "pl": "Polski",
+	"pt": "Português", "ru": "Русский", "sv": "Svenska", "tr": "Türkçe", "uk": "Українська",
+	"zh": "中文",
+}
+
+// localeLanguage is the language part of a locale tag, e.g. "de" for "de-DE"
+func localeLanguage(tag string) string {
+	language, _, _ := strings.Cut(tag, "-")
+	return strings.ToLower(language)
+}
+
+// placeNames picks the name variants of a geocoded place worth offering: the
+// place's local name and its name in each language the UI supports. The
+// geocoder's own name is kept as English when it has no English variant.
+func placeNames(geo *GeocodingResult) map[string]string {
+	wanted := map[string]bool{"en": true, countryLanguages[strings.ToUpper(geo.Country)]: true}
+	for _, l := range supportedLocales {
+		wanted[localeLanguage(l.Tag)] = true
+	}
+
+	names := map[string]string{}
+	for language, name := range geo.Local {
+		name = sanitizeLocationName(name)
+		if wanted[language] && name != "" {
+			names[language] = name
+		}
+	}
+	if _, ok := names["en"]; !ok && geo.Name != "" {
+		names["en"] = geo.Name
+	}
+	return names
+}
+
+// placeLanguage picks the language a place is named in by default: the
+// user's language if the place has a name in it, otherwise none, which keeps
+// the geocoder's name
+func placeLanguage(names map[string]string, locale string) string {
+	if _, ok := names[localeLanguage(locale)]; ok {
+		return localeLanguage(locale)
+	}
+	return ""
+}
+
+// PlaceNameOption is a name variant the user can pick for a request's place
+type PlaceNameOption struct {
+	Language string
+	Label    string
+	Name     string
+}
+
+// PlaceNameOptions lists the distinct names the request's place can be shown
+// with, labeled by language, local name first
+func (r *Request) PlaceNameOptions() []PlaceNameOption {
+	local := countryLanguages[strings.ToUpper(r.Country)]
+	var options []PlaceNameOption
+	seen := map[string]bool{}
+	add := func(language string) {
+		name, ok := r.PlaceNames[language]
+		if !ok || seen[name] {
+			return
+		}
+		seen[name] = true
+		label := languageNames[language]
+		if label == "" {
+			label = language
+		}
+		if language == local {
+			label += ", local"
+		}
+		options = append(options, PlaceNameOption{Language: language, Label: label, Name: name})
+	}
+
+	add(local)
+	languages := make([]string, 0, len(r.PlaceNames))
+	for language := range r.PlaceNames {
+		languages = append(languages, language)
+	}
+	sort.Strings(languages)
+	for _, language := range languages {
+		add(language)
+	}
+	return options
+}
+
+// PlaceName is the name the request's place is shown and prompted with: the
+// variant the user picked, or the canonical location name
+func (r *Request) PlaceName() string {
+	if name, ok := r.PlaceNames[r.PlaceLanguage]; ok {
+		return name
+	}
+	return r.LocationName
+}
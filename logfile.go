@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// logRotation is when a log file is rotated and how many rotated files are kept
+type logRotation struct {
+	MaxBytes int64         // rotate once the file would grow past this, 0 for no limit
+	Interval time.Duration // rotate at every multiple of this since the Unix epoch (UTC), 0 never
+	Backups  int           // rotated files kept, path.1 being the most recent
+	MaxAge   time.Duration // rotated files older than this are deleted, 0 to keep them
+}
+
+// logRotationFromEnv reads the rotation of log files from LOG_MAX_SIZE_MB,
+// LOG_ROTATE_INTERVAL, LOG_MAX_BACKUPS and LOG_MAX_AGE
+func logRotationFromEnv() logRotation {
+	var rotation logRotation
+
+	maxMB, err := strconv.Atoi(envOrDefault("LOG_MAX_SIZE_MB", "100"))
+	if err != nil || maxMB < 0 {
+		log.Printf("Warning: invalid LOG_MAX_SIZE_MB, using 100")
+		maxMB = 100
+	}
+	rotation.MaxBytes = int64(maxMB) << 20
+
+	rotation.Interval, err = time.ParseDuration(envOrDefault("LOG_ROTATE_INTERVAL", "0"))
+	if err != nil || (rotation.Interval != 0 && rotation.Interval < time.Minute) {
+		log.Printf("Warning: invalid LOG_ROTATE_INTERVAL, rotating by size only")
+		rotation.Interval = 0
+	}
+
+	rotation.Backups, err = strconv.Atoi(envOrDefault("LOG_MAX_BACKUPS", "7"))
+	if err != nil || rotation.Backups < 0 {
+		log.Printf("Warning: invalid LOG_MAX_BACKUPS, using 7")
+		rotation.Backups = 7
+	}
+
+	rotation.MaxAge, err = time.ParseDuration(envOrDefault("LOG_MAX_AGE", "0"))
+	if err != nil || rotation.MaxAge < 0 {
+		log.Printf("Warning: invalid LOG_MAX_AGE, keeping rotated logs regardless of age")
+		rotation.MaxAge = 0
+	}
+	return rotation
+}
+
+// setupLogFile sends the server log to LOG_FILE, if set, instead of stderr.
+// Warnings about the configuration itself are logged before this runs, so
+// they still go to stderr.
+func setupLogFile() error {
+	path := os.Getenv("LOG_FILE")
+	if path == "" {
+		return nil
+	}
+	file, err := openRotatingFile(path, logRotationFromEnv())
+	if err != nil {
+		return err
+	}
+	log.SetOutput(file)
+	return nil
+}
+
+// rotatingFile is a log file that is renamed aside when it reaches its size
+// limit or a new rotation interval begins. It's a plain io.Writer, so it
+// could be swapped for another rotating writer such as lumberjack's.
+type rotatingFile struct {
+	mu       sync.Mutex
+	path     string
+	rotation logRotation
+	file     *os.File
+	size     int64
+	period   time.Time // start of the interval the current file belongs to
+}
+
+// openRotatingFile opens a log file for appending, creating its directory
+func openRotatingFile(path string, rotation logRotation) (*rotatingFile, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	f := &rotatingFile{path: path, rotation: rotation}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// open opens the current file, picking up the size it already has. A file
+// left from an earlier run belongs to the interval it was last written in.
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file, f.size = file, info.Size()
+	if f.rotation.Interval > 0 {
+		lastWrite := time.Now()
+		if info.Size() > 0 {
+			lastWrite = info.ModTime()
+		}
+		f.period = lastWrite.UTC().Truncate(f.rotation.Interval)
+	}
+	return nil
+}
+
+// Write appends to the file, rotating it first when p would take it past
+// its size limit or a new interval has begun. A single write is never split
+// across files.
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	tooBig := f.rotation.MaxBytes > 0 && f.size > 0 && f.size+int64(len(p)) > f.rotation.MaxBytes
+	newPeriod := f.rotation.Interval > 0 && time.Now().UTC().Truncate(f.rotation.Interval).After(f.period)
+	if tooBig || (newPeriod && f.size > 0) {
+		// Reported on stderr, since this may be the file the server logs to
+		if err := f.rotate(); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to rotate %s: %v\n", f.path, err)
+		}
+	} else if newPeriod {
+		f.period = time.Now().UTC().Truncate(f.rotation.Interval)
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// rotate shifts the backups along, dropping the oldest and any past their
+// maximum age, and starts a new file
+func (f *rotatingFile) rotate() error {
+	f.file.Close()
+	backup := func(i int) string { return fmt.Sprintf("%s.%d", f.path, i) }
+
+	os.Remove(backup(f.rotation.Backups))
+	for i := f.rotation.Backups - 1; i >= 1; i-- {
+		os.Rename(backup(i), backup(i+1))
+	}
+	var err error
+	if f.rotation.Backups > 0 {
+		err = os.Rename(f.path, backup(1))
+	} else {
+		err = os.Remove(f.path)
+	}
+
+	if f.rotation.MaxAge > 0 {
+		cutoff := time.Now().Add(-f.rotation.MaxAge)
+		for i := 1; i <= f.rotation.Backups; i++ {
+			if info, statErr := os.Stat(backup(i)); statErr == nil && info.ModTime().Before(cutoff) {
+				os.Remove(backup(i))
+			}
+		}
+	}
+
+	// Keep logging to the old file if it couldn't be moved aside
+	if openErr := f.open(); openErr != nil {
+		return openErr
+	}
+	return err
+}
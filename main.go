@@ -1,17 +1,89 @@
 package main
 
 import (
+	"flag"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
 )
 
 func main() {
+	// `skyweave migrate-data` exports the database instead of serving
+	if len(os.Args) > 1 && os.Args[1] == "migrate-data" {
+		dataDir = envOrDefault("DATA_DIR", "./data")
+		os.Exit(runMigrateData(os.Args[2:], os.Stdout))
+	}
+
+	// Listen address flags default to the HOST, PORT and UNIX_SOCKET environment variables
+	host := flag.String("host", os.Getenv("HOST"), "host or IP address to listen on (empty for all interfaces)")
+	port := flag.String("port", envOrDefault("PORT", "4000"), "TCP port to listen on")
+	socketPath := flag.String("socket", os.Getenv("UNIX_SOCKET"), "listen on this Unix socket path instead of TCP")
+	doctor := flag.Bool("doctor", false, "check the configuration, database and API keys, then exit")
+	flag.Parse()
+
+	dataDir = envOrDefault("DATA_DIR", "./data")
+
+	if *doctor {
+		os.Exit(runDoctor(os.Stdout))
+	}
+
+	// Load the configuration, reading Vault and AWS Secrets Manager if set
+	if err := setupConfig(); err != nil {
+		log.Fatal("Failed to load configuration: ", err)
+	}
+
+	// Log to LOG_FILE instead of stderr when it's set
+	if err := setupLogFile(); err != nil {
+		log.Fatal("Failed to open LOG_FILE: ", err)
+	}
+
+	// Log outbound API requests when DEBUG_HTTP is enabled
+	if err := installOutboundLogging(); err != nil {
+		log.Fatal("Failed to open DEBUG_HTTP_LOG: ", err)
+	}
+
+	// Share the cache and rate limits with other instances through CACHE_URL
+	if err := setupCache(); err != nil {
+		log.Fatal("Failed to set up cache: ", err)
+	}
+
+	// Keep sessions in the database, in Redis or in signed cookies
+	if err := setupSessions(); err != nil {
+		log.Fatal("Failed to set up sessions: ", err)
+	}
+
+	// Suggest locations from client IP addresses when GEOIP_DB is set
+	if err := setupGeoIP(); err != nil {
+		log.Fatal("Failed to load GEOIP_DB: ", err)
+	}
+
+	// Restore the database from its replica if this is a fresh instance
+	if err := setupReplication(); err != nil {
+		log.Fatal("Failed to set up database replication: ", err)
+	}
+
 	// Initialize database
 	if err := initDB(); err != nil {
 		log.Fatal("Failed to initialize database:", err)
 	}
-	defer db.Close()
+	defer closeDB()
+
+	// Check the database periodically, reopening it if it stops answering
+	startDBMonitor()
+
+	// Add the example requests of a demo instance
+	if err := seedDemoData(); err != nil {
+		log.Printf("Failed to seed demo data: %v", err)
+	}
+
+	// Remove files left half-written by a crash
+	removeStaleTempFiles()
+
+	// Move images stored before content addressing into blobs
+	if err := migrateLegacyFiles(); err != nil {
+		log.Printf("Failed to move stored images into blobs: %v", err)
+	}
 
 	// Initialize templates
 	initTemplates()
@@ -19,30 +91,153 @@ func main() {
 	// Start session cleanup background task
 	startSessionCleanup()
 
+	// Start the workers that generate images, fairly shared between users
+	workers, err := strconv.Atoi(envOrDefault("MAX_CONCURRENT_JOBS", "4"))
+	if err != nil || workers < 1 {
+		log.Fatal("MAX_CONCURRENT_JOBS must be a positive number")
+	}
+	startJobWorkers(workers)
+
+	// Announce this instance to the others sharing the cache
+	startHeartbeat()
+
+	// Poll predictions that were running when the server or another instance
+	// stopped, now and periodically
+	startWorkRecovery()
+
+	// Start emailing usage reports to subscribed admins
+	startReportScheduler()
+
+	// Start the generations scheduled for today
+	startScheduler()
+
+	// Purge the data of users who asked for it to be erased
+	startErasures()
+
+	// Delete drafts of the start form left alone for a month
+	startDraftCleanup()
+
+	// Delete data exports once their links expire
+	startDataExportCleanup()
+
+	// Prune the weather maps cached for confirmation pages
+	startWeatherMapCleanup()
+
+	// Delete blobs no request, revision or benchmark refers to anymore
+	startBlobCollector()
+
+	// Upload database snapshots when replicating to S3
+	startSnapshots()
+
+	// Reload configuration on SIGHUP
+	watchReloadSignal()
+
 	mux := http.NewServeMux()
 
 	// Public routes (no authentication required)
 	mux.HandleFunc("GET /login", loginHandler)
 	mux.HandleFunc("POST /login", loginHandler)
+	mux.HandleFunc("GET /trial", trialHandler)
+	mux.HandleFunc("POST /trial", trialHandler)
+
+	// Protected routes (authentication required; allowTrial also admits trial visitors)
+	mux.HandleFunc("GET /terms", allowTrial(termsHandler))
+	mux.HandleFunc("POST /terms", allowTrial(acceptTermsHandler))
+	mux.HandleFunc("GET /{$}", allowTrial(home))
+	mux.HandleFunc("GET /start", allowTrial(startHandler))
+	mux.HandleFunc("POST /submit", allowTrial(submitHandler))
+	mux.HandleFunc("POST /drafts", allowTrial(saveDraftHandler))
+	mux.HandleFunc("POST /drafts/delete", allowTrial(discardDraftHandler))
+	mux.HandleFunc("GET /review/{id}", allowTrial(reviewHandler))
+	mux.HandleFunc("POST /review/{id}", allowTrial(saveReviewHandler))
+	mux.HandleFunc("GET /weather/{id}", allowTrial(weatherHandler))
+	mux.HandleFunc("GET /weather/{id}/map", allowTrial(weatherMapHandler))
+	mux.HandleFunc("POST /requests/{id}/place-name", allowTrial(placeNameHandler))
+	mux.HandleFunc("POST /confirm", allowTrial(confirmHandler))
+	mux.HandleFunc("GET /processing/{id}", allowTrial(processingHandler))
+	mux.HandleFunc("GET /status/{id}", allowTrial(statusHandler))
+	mux.HandleFunc("GET /fragments/status/{id}", allowTrial(statusHandler))
+	mux.HandleFunc("GET /fragments/weather/{id}", allowTrial(weatherFragmentHandler))
+	mux.HandleFunc("GET /fragments/queue/{id}", allowTrial(queueFragmentHandler))
+	mux.HandleFunc("GET /fragments/gallery-tile/{id}", requireAuth(galleryTileFragmentHandler))
+	mux.HandleFunc("GET /batches/{id}", requireAuth(batchHandler))
+	mux.HandleFunc("POST /batches/{id}/confirm", requireAuth(batchConfirmHandler))
+	mux.HandleFunc("GET /image/{id}", guardImage(allowSignedImage(imageHandler)))
+	mux.HandleFunc("GET /original/{id}", allowTrial(originalHandler))
+	mux.HandleFunc("GET /share/{token}", shareHandler)
+	mux.HandleFunc("GET /share/{token}/card.jpg", guardImage(shareCardHandler))
+	mux.HandleFunc("GET /frame/{token}", frameHandler)
+	mux.HandleFunc("POST /requests/{id}/redo", requireAuth(redoHandler))
+	mux.HandleFunc("POST /feedback/{id}", requireAuth(feedbackHandler))
+	mux.HandleFunc("POST /requests/{id}/retry", requireAuth(retryHandler))
+	mux.HandleFunc("POST /requests/{id}/revisions", requireAuth(editRevisionHandler))
+	mux.HandleFunc("GET /results/{id}", allowTrial(resultsHandler))
+	mux.HandleFunc("POST /results/{id}/primary", requireAuth(primaryRevisionHandler))
+	mux.HandleFunc("POST /requests/{id}/tags", requireAuth(saveTagsHandler))
+	mux.HandleFunc("GET /gallery", requireAuth(galleryHandler))
+	mux.HandleFunc("GET /schedules", requireAuth(schedulesHandler))
+	mux.HandleFunc("POST /schedules", requireAuth(createScheduleHandler))
+	mux.HandleFunc("POST /schedules/import", requireAuth(calendarImportHandler))
+	mux.HandleFunc("POST /schedules/{id}/cancel", requireAuth(cancelScheduleHandler))
+	mux.HandleFunc("GET /schedules/calendar.ics", requireAuth(calendarDownloadHandler))
+	mux.HandleFunc("POST /schedules/feed", requireAuth(resetCalendarFeedHandler))
+	mux.HandleFunc("POST /schedules/feed/delete", requireAuth(deleteCalendarFeedHandler))
+	mux.HandleFunc("GET /calendar/{token}", calendarFeedHandler)
+	mux.HandleFunc("POST /locations", requireAuth(saveLocationHandler))
+	mux.HandleFunc("POST /locations/{id}/delete", requireAuth(deleteLocationHandler))
+	mux.HandleFunc("GET /settings", requireAuth(settingsHandler))
+	mux.HandleFunc("POST /settings", requireAuth(saveSettingsHandler))
+	mux.HandleFunc("GET /settings/export", requireAuth(dataExportHandler))
+	mux.HandleFunc("POST /settings/export", requireAuth(requestDataExportHandler))
+	mux.HandleFunc("GET /exports/{id}", allowSignedExport(downloadDataExportHandler))
+	mux.HandleFunc("GET /settings/delete", requireAuth(deleteDataHandler))
+	mux.HandleFunc("POST /settings/delete", requireAuth(confirmDeleteDataHandler))
+
+	// Admin routes (admin passphrase required)
+	mux.HandleFunc("GET /admin/experiments", requireAdmin(adminExperimentsHandler))
+	mux.HandleFunc("GET /admin/queue", requireAdmin(adminQueueHandler))
+	mux.HandleFunc("GET /admin/reports", requireAdmin(adminReportsHandler))
+	mux.HandleFunc("POST /admin/reports", requireAdmin(adminSubscribeHandler))
+	mux.HandleFunc("POST /admin/reports/delete", requireAdmin(adminUnsubscribeHandler))
+	mux.HandleFunc("GET /admin/reports/preview", requireAdmin(adminReportPreviewHandler))
+	mux.HandleFunc("GET /admin/notifications/preview", requireAdmin(adminNotificationPreviewHandler))
+	mux.HandleFunc("POST /admin/notifications/preview", requireAdmin(adminNotificationPreviewHandler))
+	mux.HandleFunc("POST /admin/reload", requireAdmin(adminReloadHandler))
+	mux.HandleFunc("GET /admin/schema-drift", requireAdmin(adminSchemaDriftHandler))
+	mux.HandleFunc("GET /admin/presets", requireAdmin(adminPresetsHandler))
+	mux.HandleFunc("POST /admin/presets", requireAdmin(adminSavePresetHandler))
+	mux.HandleFunc("POST /admin/presets/delete", requireAdmin(adminDeletePresetHandler))
+	mux.HandleFunc("GET /admin/benchmarks", requireAdmin(adminBenchmarksHandler))
+	mux.HandleFunc("POST /admin/benchmarks", requireAdmin(adminStartBenchmarkHandler))
+	mux.HandleFunc("GET /admin/benchmarks/{id}", requireAdmin(adminBenchmarkHandler))
+	mux.HandleFunc("GET /admin/benchmarks/{id}/images/{run}", requireAdmin(adminBenchmarkImageHandler))
+	mux.HandleFunc("GET /admin/export", requireAdmin(adminExportHandler))
+	mux.HandleFunc("GET /admin/erasures", requireAdmin(adminErasuresHandler))
+	mux.HandleFunc("POST /admin/erasures", requireAdmin(adminEraseHandler))
+
+	// Prometheus scrape endpoint, authenticated with METRICS_TOKEN
+	mux.HandleFunc("GET /metrics", metricsHandler)
+
+	// Health check for load balancers and container orchestrators
+	mux.HandleFunc("GET /healthz", healthHandler)
 
-	// Protected routes (authentication required)
-	mux.HandleFunc("GET /{$}", requireAuth(home))
-	mux.HandleFunc("GET /start", requireAuth(startHandler))
-	mux.HandleFunc("POST /submit", requireAuth(submitHandler))
-	mux.HandleFunc("GET /weather/{id}", requireAuth(weatherHandler))
-	mux.HandleFunc("POST /confirm", requireAuth(confirmHandler))
-	mux.HandleFunc("GET /processing/{id}", requireAuth(processingHandler))
-	mux.HandleFunc("GET /status/{id}", requireAuth(statusHandler))
-	mux.HandleFunc("GET /image/{id}", requireAuth(imageHandler))
+	// JSON API routes, under /api and each versioned /api/vN
+	handleAPI(mux, "GET", "/locations", allowTrial(locationsHandler))
+	handleAPI(mux, "GET", "/limits", allowTrial(limitsHandler))
+	handleAPI(mux, "GET", "/quota", allowTrial(quotaHandler))
+	handleAPI(mux, "GET", "/requests", requireAuth(requestsListHandler))
+	handleAPI(mux, "GET", "/requests/{id}/weather", requireAuth(requestWeatherHandler))
+	handleAPI(mux, "POST", "/requests/{id}/prompt:regenerate", requireAuth(regeneratePromptHandler))
+	handleAPI(mux, "POST", "/requests/{id}/clone", requireAuth(cloneRequestHandler))
+	handleAPI(mux, "GET", "/tags", requireAuth(tagsHandler))
 
-	// Support PORT environment variable
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "4000"
+	listener, err := newListener(*host, *port, *socketPath)
+	if err != nil {
+		log.Fatal("Failed to listen:", err)
 	}
 
-	log.Print("starting server on :" + port)
+	log.Print("starting server on " + listener.Addr().String())
 
-	err := http.ListenAndServe(":"+port, mux)
+	err = http.Serve(listener, recoverPanics(mux))
 	log.Fatal(err)
 }
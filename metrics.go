@@ -0,0 +1,90 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Pipeline stages whose durations are recorded in stage_timings
+const (
+	stageScan     = "scan"
+	stageGeocode  = "geocode"
+	stageWeather  = "weather"
+	stageUpload   = "upload"
+	stagePredict  = "predict"
+	stageDownload = "download"
+	stagePublish  = "publish"
+)
+
+// pipelineStages lists the stages in the order a request passes through them
+var pipelineStages = []string{stageScan, stageGeocode, stageWeather, stageUpload, stagePredict, stageDownload, stagePublish}
+
+// recordStage stores the time since started as the duration of a stage.
+// Timings only feed reports, so a failure to store one is logged and ignored.
+func recordStage(requestID, revisionID, stage string, started time.Time) {
+	if err := saveStageTiming(requestID, revisionID, stage, time.Since(started)); err != nil {
+		log.Printf("Failed to record %s timing for request %s: %v", stage, requestID, err)
+	}
+}
+
+// formatMillis formats a stage duration for reports, rounded to a precision
+// that suits its size
+func formatMillis(ms float64) string {
+	d := time.Duration(ms * float64(time.Millisecond))
+	if d >= time.Second {
+		return d.Round(100 * time.Millisecond).String()
+	}
+	return d.Round(time.Millisecond).String()
+}
+
+// Avg returns the stage's average duration for reports, "-" if nothing was timed
+func (s StageStats) Avg() string {
+	if s.Count == 0 {
+		return "-"
+	}
+	return formatMillis(s.AvgMs)
+}
+
+// Max returns the stage's slowest duration for reports, "-" if nothing was timed
+func (s StageStats) Max() string {
+	if s.Count == 0 {
+		return "-"
+	}
+	return formatMillis(float64(s.MaxMs))
+}
+
+// metricsHandler serves the stage timings in the Prometheus text format. The
+// endpoint only exists when METRICS_TOKEN is set, and scrapers authenticate
+// with it as a bearer token since they can't log in.
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	token := currentConfig().MetricsToken
+	if token == "" {
+		http.NotFound(w, r)
+		return
+	}
+	bearer, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(bearer), []byte(token)) != 1 {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="metrics"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	stages, err := getStageStats(time.Time{}, time.Time{})
+	if err != nil {
+		log.Printf("Failed to load stage timings: %v", err)
+		http.Error(w, "Failed to load metrics", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	fmt.Fprintln(w, "# HELP skyweave_stage_duration_seconds Time spent in each request pipeline stage.")
+	fmt.Fprintln(w, "# TYPE skyweave_stage_duration_seconds summary")
+	for _, s := range stages {
+		fmt.Fprintf(w, "skyweave_stage_duration_seconds_sum{stage=%q} %g\n", s.Stage, float64(s.TotalMs)/1000)
+		fmt.Fprintf(w, "skyweave_stage_duration_seconds_count{stage=%q} %d\n", s.Stage, s.Count)
+	}
+}
@@ -0,0 +1,521 @@
+package main
+
+import (
+	"bufio"
+	"crypto/md5"
+	"database/sql"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// migrateBatchRows is how many rows go into each INSERT of a data dump
+const migrateBatchRows = 500
+
+// migrateColumn is a column of a table being dumped
+type migrateColumn struct {
+	Name    string
+	Type    string // PostgreSQL type
+	NotNull bool
+	Default string // SQLite default expression, empty for none
+	PK      int    // position in the primary key, 0 if not part of it
+}
+
+// migrateTable is a table being dumped along with what verifies its copy
+type migrateTable struct {
+	Name     string
+	Columns  []migrateColumn
+	Unique   [][]string // columns of each UNIQUE constraint
+	Rows     int
+	Checksum string // MD5 of the primary keys in order, see keyChecksumSQL
+}
+
+// runMigrateData implements `skyweave migrate-data`: it writes the SQLite
+// database as a PostgreSQL script that creates the tables, copies every row
+// and then checks each table's row count and a checksum of its primary keys,
+// failing the load if anything didn't arrive. It returns the exit code.
+func runMigrateData(args []string, out io.Writer) int {
+	flags := flag.NewFlagSet("migrate-data", flag.ContinueOnError)
+	flags.SetOutput(out)
+	from := flags.String("from", "sqlite", "database to read, only sqlite (DATA_DIR/skyweave.db) is supported")
+	to := flags.String("to", "", "file to write the PostgreSQL script to, - for stdout")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	if *from != "sqlite" {
+		fmt.Fprintf(out, "migrate-data: unsupported --from %q, only sqlite is supported\n", *from)
+		return 2
+	}
+	if *to == "" {
+		fmt.Fprintln(out, "migrate-data: --to is required")
+		return 2
+	}
+	// There's no PostgreSQL driver in the binary, so the data goes through psql
+	if strings.HasPrefix(*to, "postgres://") || strings.HasPrefix(*to, "postgresql://") {
+		fmt.Fprintln(out, "migrate-data: SkyWeave can't connect to PostgreSQL itself. Write a script and load it with psql:")
+		fmt.Fprintln(out, "  skyweave migrate-data --from sqlite --to skyweave.sql")
+		fmt.Fprintln(out, `  psql "$DATABASE_URL" -v ON_ERROR_STOP=1 -f skyweave.sql`)
+		return 2
+	}
+
+	if _, err := os.Stat(dbPath()); err != nil {
+		fmt.Fprintf(out, "migrate-data: %v\n", err)
+		return 1
+	}
+	// Opened without migrating, which would drop an outdated schema's data
+	if err := openDB(); err != nil {
+		fmt.Fprintf(out, "migrate-data: %v\n", err)
+		return 1
+	}
+	defer db.Close()
+
+	var w io.Writer = os.Stdout
+	if *to != "-" {
+		file, err := os.Create(*to)
+		if err != nil {
+			fmt.Fprintf(out, "migrate-data: %v\n", err)
+			return 1
+		}
+		defer file.Close()
+		w = file
+	}
+	buf := bufio.NewWriter(w)
+
+	tables, err := dumpPostgres(buf)
+	if err == nil {
+		err = buf.Flush()
+	}
+	if err != nil {
+		fmt.Fprintf(out, "migrate-data: %v\n", err)
+		if *to != "-" {
+			os.Remove(*to)
+		}
+		return 1
+	}
+
+	// The report goes to stderr when the script itself goes to stdout
+	if *to == "-" {
+		out = os.Stderr
+	}
+	for _, t := range tables {
+		fmt.Fprintf(out, "%-22s %8d rows  %s\n", t.Name, t.Rows, t.Checksum)
+	}
+	missing, err := missingDataFiles()
+	if err != nil {
+		fmt.Fprintf(out, "migrate-data: failed to check files: %v\n", err)
+		return 1
+	}
+	if len(missing) > 0 {
+		fmt.Fprintf(out, "\n%d referenced files are missing from %s:\n", len(missing), dataDir)
+		for _, path := range missing {
+			fmt.Fprintln(out, "  "+path)
+		}
+	}
+	fmt.Fprintf(out, "\nCopy %s/blobs, and %s/uploads and %s/results if they're left from older versions, along with the database; the script refers to them by path.\n",
+		dataDir, dataDir, dataDir)
+	return 0
+}
+
+// dumpPostgres writes the schema and data of every table as a PostgreSQL
+// script run in one transaction, ending with its own verification
+func dumpPostgres(w io.Writer) ([]migrateTable, error) {
+	tables, err := migrateTables()
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Fprintf(w, "-- SkyWeave data exported from %s on %s\n", dbPath(), time.Now().UTC().Format(time.RFC3339))
+	fmt.Fprintln(w, "-- Load with: psql \"$DATABASE_URL\" -v ON_ERROR_STOP=1 -f <this file>")
+	fmt.Fprintln(w, "BEGIN;")
+	for i := range tables {
+		t := &tables[i]
+		writeCreateTable(w, t)
+		if err := writeTableRows(w, t); err != nil {
+			return nil, fmt.Errorf("failed to dump %s: %w", t.Name, err)
+		}
+		if t.Checksum, err = keyChecksum(t); err != nil {
+			return nil, fmt.Errorf("failed to checksum %s: %w", t.Name, err)
+		}
+	}
+	writeVerification(w, tables)
+	_, err = fmt.Fprintln(w, "COMMIT;")
+	return tables, err
+}
+
+// migrateTables lists the ordinary tables with their columns. The full-text
+// index and its shadow tables are SQLite-specific and left out.
+func migrateTables() ([]migrateTable, error) {
+	rows, err := db.Query(`SELECT name FROM pragma_table_list
+	                       WHERE schema = 'main' AND type = 'table' AND name NOT LIKE 'sqlite_%'
+	                       ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	tables := make([]migrateTable, 0, len(names))
+	for _, name := range names {
+		t := migrateTable{Name: name}
+		rows, err := db.Query(`SELECT name, type, "notnull", COALESCE(dflt_value, ''), pk FROM pragma_table_info(?)`, name)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var c migrateColumn
+			var sqliteType string
+			if err := rows.Scan(&c.Name, &sqliteType, &c.NotNull, &c.Default, &c.PK); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			c.Type = postgresType(sqliteType)
+			t.Columns = append(t.Columns, c)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+		if t.Unique, err = uniqueConstraints(name); err != nil {
+			return nil, err
+		}
+		tables = append(tables, t)
+	}
+	return tables, nil
+}
+
+// uniqueConstraints returns the columns of each UNIQUE constraint of a table.
+// Other indexes only speed up SkyWeave's own queries and aren't carried over.
+func uniqueConstraints(table string) ([][]string, error) {
+	rows, err := db.Query(`SELECT name FROM pragma_index_list(?) WHERE origin = 'u' ORDER BY name`, table)
+	if err != nil {
+		return nil, err
+	}
+	var indexes []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		indexes = append(indexes, name)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var unique [][]string
+	for _, index := range indexes {
+		rows, err := db.Query(`SELECT name FROM pragma_index_info(?) ORDER BY seqno`, index)
+		if err != nil {
+			return nil, err
+		}
+		var columns []string
+		for rows.Next() {
+			var name string
+			if err := rows.Scan(&name); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			columns = append(columns, quoteIdent(name))
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+		unique = append(unique, columns)
+	}
+	return unique, nil
+}
+
+// postgresType maps an SQLite column type to the PostgreSQL one
+func postgresType(sqliteType string) string {
+	switch strings.ToUpper(sqliteType) {
+	case "INTEGER":
+		return "BIGINT"
+	case "REAL":
+		return "DOUBLE PRECISION"
+	case "DATETIME":
+		return "TIMESTAMP"
+	case "BLOB":
+		return "BYTEA"
+	default:
+		return "TEXT"
+	}
+}
+
+// postgresDefault translates a column default. Only the SQLite timestamp
+// function SkyWeave uses needs it; literals and CURRENT_TIMESTAMP carry over.
+func postgresDefault(def string) string {
+	if strings.Contains(def, "strftime(") {
+		return `(to_char(now() AT TIME ZONE 'UTC', 'YYYY-MM-DD HH24:MI:SS.MS'))`
+	}
+	return def
+}
+
+// primaryKey returns a table's primary key columns in key order
+func (t *migrateTable) primaryKey() []migrateColumn {
+	var key []migrateColumn
+	for _, c := range t.Columns {
+		if c.PK > 0 {
+			key = append(key, c)
+		}
+	}
+	sort.Slice(key, func(i, j int) bool { return key[i].PK < key[j].PK })
+	return key
+}
+
+// writeCreateTable writes a table's CREATE TABLE. A single integer primary
+// key becomes an identity column, like SQLite's rowid alias.
+func writeCreateTable(w io.Writer, t *migrateTable) {
+	key := t.primaryKey()
+	defs := make([]string, 0, len(t.Columns)+1)
+	for _, c := range t.Columns {
+		def := quoteIdent(c.Name) + " " + c.Type
+		if len(key) == 1 && c.PK == 1 && c.Type == "BIGINT" {
+			def += " GENERATED BY DEFAULT AS IDENTITY"
+		}
+		if c.NotNull {
+			def += " NOT NULL"
+		}
+		if c.Default != "" {
+			def += " DEFAULT " + postgresDefault(c.Default)
+		}
+		defs = append(defs, def)
+	}
+	if len(key) > 0 {
+		names := make([]string, len(key))
+		for i, c := range key {
+			names[i] = quoteIdent(c.Name)
+		}
+		defs = append(defs, "PRIMARY KEY ("+strings.Join(names, ", ")+")")
+	}
+	for _, columns := range t.Unique {
+		defs = append(defs, "UNIQUE ("+strings.Join(columns, ", ")+")")
+	}
+	fmt.Fprintf(w, "\nCREATE TABLE %s (\n  %s\n);\n", quoteIdent(t.Name), strings.Join(defs, ",\n  "))
+}
+
+// writeTableRows writes a table's rows as batched INSERTs, in primary key
+// order, and counts them
+func writeTableRows(w io.Writer, t *migrateTable) error {
+	names := make([]string, len(t.Columns))
+	for i, c := range t.Columns {
+		names[i] = quoteIdent(c.Name)
+	}
+	query := "SELECT " + strings.Join(names, ", ") + " FROM " + quoteIdent(t.Name)
+	if key := t.primaryKey(); len(key) > 0 {
+		query += " ORDER BY " + strings.Join(columnNames(key), ", ")
+	}
+
+	rows, err := db.Query(query)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	values := make([]any, len(t.Columns))
+	pointers := make([]any, len(t.Columns))
+	for i := range values {
+		pointers[i] = &values[i]
+	}
+	insert := "INSERT INTO " + quoteIdent(t.Name) + " (" + strings.Join(names, ", ") + ") VALUES\n"
+	for rows.Next() {
+		if err := rows.Scan(pointers...); err != nil {
+			return err
+		}
+		if t.Rows%migrateBatchRows == 0 {
+			if t.Rows > 0 {
+				fmt.Fprint(w, ";\n")
+			}
+			fmt.Fprint(w, insert)
+		} else {
+			fmt.Fprint(w, ",\n")
+		}
+		literals := make([]string, len(values))
+		for i, v := range values {
+			literals[i] = postgresLiteral(v)
+		}
+		fmt.Fprintf(w, "  (%s)", strings.Join(literals, ", "))
+		t.Rows++
+	}
+	if t.Rows > 0 {
+		fmt.Fprint(w, ";\n")
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	// Identity columns continue after the copied IDs
+	if key := t.primaryKey(); len(key) == 1 && key[0].Type == "BIGINT" && t.Rows > 0 {
+		fmt.Fprintf(w, "SELECT setval(pg_get_serial_sequence('%s', '%s'), (SELECT max(%s) FROM %s));\n",
+			t.Name, key[0].Name, quoteIdent(key[0].Name), quoteIdent(t.Name))
+	}
+	return nil
+}
+
+// postgresLiteral formats a value read from SQLite as a PostgreSQL literal
+func postgresLiteral(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return "NULL"
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	case bool:
+		if v {
+			return "1"
+		}
+		return "0"
+	case time.Time:
+		return "'" + v.UTC().Format("2006-01-02 15:04:05.999999") + "'"
+	case []byte:
+		return `'\x` + hex.EncodeToString(v) + "'"
+	case string:
+		return "'" + strings.ReplaceAll(v, "'", "''") + "'"
+	default:
+		return "'" + strings.ReplaceAll(fmt.Sprint(v), "'", "''") + "'"
+	}
+}
+
+// keyChecksum is the MD5 of a table's primary keys in key order, computed
+// the way keyChecksumSQL computes it in PostgreSQL: the columns of each key
+// joined by "|", and the keys joined by ",". Text sorts bytewise in both.
+func keyChecksum(t *migrateTable) (string, error) {
+	key := t.primaryKey()
+	if len(key) == 0 {
+		return "", nil
+	}
+	rows, err := db.Query("SELECT " + strings.Join(columnNames(key), ", ") + " FROM " + quoteIdent(t.Name) +
+		" ORDER BY " + strings.Join(columnNames(key), ", "))
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+
+	values := make([]any, len(key))
+	pointers := make([]any, len(key))
+	for i := range values {
+		pointers[i] = &values[i]
+	}
+	hash := md5.New()
+	first := true
+	for rows.Next() {
+		if err := rows.Scan(pointers...); err != nil {
+			return "", err
+		}
+		parts := make([]string, len(values))
+		for i, v := range values {
+			if b, ok := v.([]byte); ok {
+				v = string(b)
+			}
+			parts[i] = fmt.Sprint(v)
+		}
+		if !first {
+			io.WriteString(hash, ",")
+		}
+		first = false
+		io.WriteString(hash, strings.Join(parts, "|"))
+	}
+	if err := rows.Err(); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// keyChecksumSQL is the PostgreSQL expression matching keyChecksum
+func keyChecksumSQL(t *migrateTable) string {
+	key := t.primaryKey()
+	joined := make([]string, len(key))
+	order := make([]string, len(key))
+	for i, c := range key {
+		joined[i] = quoteIdent(c.Name) + "::text"
+		order[i] = quoteIdent(c.Name)
+		if c.Type == "TEXT" {
+			order[i] += ` COLLATE "C"`
+		}
+	}
+	return fmt.Sprintf("SELECT md5(COALESCE(string_agg(%s, ',' ORDER BY %s), '')) FROM %s",
+		strings.Join(joined, " || '|' || "), strings.Join(order, ", "), quoteIdent(t.Name))
+}
+
+// writeVerification writes a block that fails the transaction unless every
+// table has the rows and keys it had in SQLite
+func writeVerification(w io.Writer, tables []migrateTable) {
+	fmt.Fprintln(w, "\n-- Verify the copy before committing it")
+	fmt.Fprintln(w, "DO $$")
+	fmt.Fprintln(w, "BEGIN")
+	for i := range tables {
+		t := &tables[i]
+		fmt.Fprintf(w, "  IF (SELECT count(*) FROM %s) <> %d THEN\n", quoteIdent(t.Name), t.Rows)
+		fmt.Fprintf(w, "    RAISE EXCEPTION '%s: expected %d rows';\n  END IF;\n", t.Name, t.Rows)
+		if t.Checksum != "" {
+			fmt.Fprintf(w, "  IF (%s) <> '%s' THEN\n", keyChecksumSQL(t), t.Checksum)
+			fmt.Fprintf(w, "    RAISE EXCEPTION '%s: keys differ from the SQLite database';\n  END IF;\n", t.Name)
+		}
+	}
+	fmt.Fprintln(w, "END $$;")
+}
+
+// missingDataFiles lists the uploads and results the database refers to that
+// aren't on disk, so they can be found before the old server is retired
+func missingDataFiles() ([]string, error) {
+	rows, err := db.Query(`SELECT image_path FROM requests
+	                       UNION SELECT result_image_path FROM revisions WHERE result_image_path IS NOT NULL
+	                       UNION SELECT postcard_image_path FROM revisions WHERE postcard_image_path IS NOT NULL
+	                       UNION SELECT result_image_path FROM requests WHERE result_image_path IS NOT NULL
+	                       UNION SELECT result_image_path FROM benchmark_runs WHERE result_image_path IS NOT NULL`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var missing []string
+	for rows.Next() {
+		var path sql.NullString
+		if err := rows.Scan(&path); err != nil {
+			return nil, err
+		}
+		if !path.Valid || path.String == "" {
+			continue
+		}
+		if _, err := os.Stat(filepath.Clean(path.String)); os.IsNotExist(err) {
+			missing = append(missing, path.String)
+		}
+	}
+	return missing, rows.Err()
+}
+
+// columnNames returns the quoted names of columns
+func columnNames(columns []migrateColumn) []string {
+	names := make([]string, len(columns))
+	for i, c := range columns {
+		names[i] = quoteIdent(c.Name)
+	}
+	return names
+}
+
+// quoteIdent quotes an SQL identifier
+func quoteIdent(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"log"
+	"mime"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	texttemplate "text/template"
+	"time"
+)
+
+// emailConfigured reports whether outgoing email is set up
+func emailConfigured() bool {
+	return currentConfig().SMTPHost != ""
+}
+
+// sendEmail sends an HTML email through the configured SMTP server. The
+// connection is upgraded with STARTTLS when the server supports it.
+func sendEmail(to []string, subject, htmlBody string) error {
+	cfg := currentConfig()
+	if cfg.SMTPHost == "" {
+		return fmt.Errorf("SMTP_HOST not set")
+	}
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", cfg.SMTPFrom)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/html; charset=UTF-8\r\n")
+	msg.WriteString("\r\n")
+	msg.WriteString(strings.ReplaceAll(htmlBody, "\n", "\r\n"))
+
+	var auth smtp.Auth
+	if cfg.SMTPUsername != "" {
+		auth = smtp.PlainAuth("", cfg.SMTPUsername, cfg.SMTPPassword, cfg.SMTPHost)
+	}
+
+	addr := net.JoinHostPort(cfg.SMTPHost, cfg.SMTPPort)
+	if err := smtp.SendMail(addr, auth, cfg.SMTPFrom, to, msg.Bytes()); err != nil {
+		return fmt.Errorf("failed to send email: %w", err)
+	}
+	return nil
+}
+
+// Default notification templates, each replaceable by a file of the same
+// name in NOTIFY_TEMPLATE_DIR
+var defaultNotificationTemplates = map[string]string{
+	"subject.tmpl": `Your SkyWeave photo of {{.Place}} is ready`,
+
+	"email.tmpl": `<p>Your photo of {{.Place}} on {{.Date}} is ready.</p>
+{{with .ImageURL}}<p><a href="{{.}}"><img src="{{.}}" alt="Your SkyWeave photo" width="480"></a></p>
+{{end}}{{with .ResultsURL}}<p><a href="{{.}}">View it on SkyWeave</a></p>
+{{end}}`,
+
+	"webhook.tmpl": `{
+  "event": "revision.completed",
+  "request_id": {{json .Request.ID}},
+  "revision_id": {{json .Revision.ID}},
+  "place": {{json .Place}},
+  "country": {{json .Request.Country}},
+  "date": {{json .Date}},
+  "weather": {{json .Request.WeatherDescription}},
+  "temperature": {{json .Request.Temperature}},
+  "temperature_unit": {{json .Request.TempUnit}},
+  "results_url": {{json .ResultsURL}},
+  "image_url": {{json .ImageURL}}
+}`,
+}
+
+// NotificationTemplates render the subject and body of completion emails and
+// the JSON payload of completion webhooks
+type NotificationTemplates struct {
+	Subject *texttemplate.Template
+	Email   *htmltemplate.Template
+	Webhook *texttemplate.Template
+}
+
+// NotificationData is what notification templates can use: the request with
+// its weather fields, the completed revision and ready-made links
+type NotificationData struct {
+	Request    *Request
+	Revision   *Revision
+	Place      string
+	Date       string
+	ResultsURL string // results page, empty without PUBLIC_URL
+	ImageURL   string // published image, or a signed link to it; may be empty
+}
+
+// notificationFuncs are available in every notification template. json
+// encodes a value, so webhook payloads stay valid whatever the value holds.
+var notificationFuncs = map[string]any{
+	"json": func(v any) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+}
+
+// loadNotificationTemplates parses the notification templates, reading
+// replacements for the defaults from dir when it's set
+func loadNotificationTemplates(dir string) (*NotificationTemplates, error) {
+	texts := make(map[string]string, len(defaultNotificationTemplates))
+	for name, text := range defaultNotificationTemplates {
+		texts[name] = text
+		if dir == "" {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read notification template: %w", err)
+		}
+		texts[name] = string(data)
+	}
+	return parseNotificationTemplates(texts)
+}
+
+// parseNotificationTemplates parses notification templates from their text
+func parseNotificationTemplates(texts map[string]string) (*NotificationTemplates, error) {
+	var t NotificationTemplates
+	var err error
+	if t.Subject, err = texttemplate.New("subject.tmpl").Funcs(notificationFuncs).Parse(texts["subject.tmpl"]); err != nil {
+		return nil, fmt.Errorf("invalid notification template: %w", err)
+	}
+	if t.Email, err = htmltemplate.New("email.tmpl").Funcs(notificationFuncs).Parse(texts["email.tmpl"]); err != nil {
+		return nil, fmt.Errorf("invalid notification template: %w", err)
+	}
+	if t.Webhook, err = texttemplate.New("webhook.tmpl").Funcs(notificationFuncs).Parse(texts["webhook.tmpl"]); err != nil {
+		return nil, fmt.Errorf("invalid notification template: %w", err)
+	}
+	return &t, nil
+}
+
+// RenderEmail renders a completion email's subject and HTML body
+func (t *NotificationTemplates) RenderEmail(data *NotificationData) (subject, body string, err error) {
+	var b strings.Builder
+	if err := t.Subject.Execute(&b, data); err != nil {
+		return "", "", fmt.Errorf("failed to render subject: %w", err)
+	}
+	// Headers can't span lines, so a template's trailing newline is dropped
+	subject = strings.Join(strings.Fields(b.String()), " ")
+
+	b.Reset()
+	if err := t.Email.Execute(&b, data); err != nil {
+		return "", "", fmt.Errorf("failed to render email: %w", err)
+	}
+	return subject, b.String(), nil
+}
+
+// RenderWebhook renders a completion webhook's JSON payload, checking that
+// the template produced valid JSON
+func (t *NotificationTemplates) RenderWebhook(data *NotificationData) ([]byte, error) {
+	var b bytes.Buffer
+	if err := t.Webhook.Execute(&b, data); err != nil {
+		return nil, fmt.Errorf("failed to render webhook: %w", err)
+	}
+	if !json.Valid(b.Bytes()) {
+		return nil, fmt.Errorf("webhook template didn't produce valid JSON")
+	}
+	return b.Bytes(), nil
+}
+
+// newNotificationData gathers what the templates need about a completed
+// revision. Links use PUBLIC_URL, since there's no request to build an
+// absolute URL from. An unpublished image gets a signed link, so it opens
+// without logging in.
+func newNotificationData(req *Request, rev *Revision) *NotificationData {
+	data := &NotificationData{
+		Request:  req,
+		Revision: rev,
+		Place:    req.LocationName,
+		Date:     req.DateLabel(),
+		ImageURL: rev.PublicURL,
+	}
+	if data.Place == "" {
+		data.Place = req.LocationInput
+	}
+	if publicURL := currentConfig().PublicURL; publicURL != nil {
+		data.ResultsURL = publicURL.String() + "/results/" + req.ID
+		if data.ImageURL == "" {
+			data.ImageURL = signedImageURL(publicURL.String(), req.ID, rev.ID)
+		}
+	}
+	return data
+}
+
+// sampleNotificationData stands in for a real result when previewing
+// notification templates
+func sampleNotificationData() *NotificationData {
+	req := &Request{
+		ID:                 "sample",
+		LocationInput:      "Oslo",
+		LocationName:       "Oslo",
+		Country:            "NO",
+		TargetDate:         time.Now().Format("2006-01-02"),
+		Units:              unitsMetric,
+		Intensity:          "natural",
+		WeatherCondition:   "Snow",
+		WeatherDescription: "light snow",
+		Temperature:        -2.5,
+		FeelsLike:          -6,
+		Humidity:           86,
+		Clouds:             90,
+		WindSpeed:          3.1,
+		Visibility:         4000,
+		Status:             "completed",
+	}
+	rev := &Revision{ID: "sample-revision", RequestID: req.ID, Kind: revisionInitial, Status: "completed", DiffScore: -1, FaceScore: -1}
+	return newNotificationData(req, rev)
+}
+
+// sendWebhook posts a notification payload to NOTIFY_WEBHOOK_URL
+func sendWebhook(payload []byte) error {
+	resp, err := webhookClient.Post(currentConfig().NotifyWebhookURL, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("failed to send webhook: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook responded with %s", resp.Status)
+	}
+	return nil
+}
+
+// notifyRevisionCompleted tells NOTIFY_WEBHOOK_URL about every completed
+// revision, and emails the request's owner that a new result is ready if they
+// gave an address in their settings
+func notifyRevisionCompleted(rev *Revision) {
+	cfg := currentConfig()
+	if !emailConfigured() && cfg.NotifyWebhookURL == "" {
+		return
+	}
+	req, err := getRequest(rev.RequestID)
+	if err != nil {
+		log.Printf("Failed to load request %s for notification: %v", rev.RequestID, err)
+		return
+	}
+	data := newNotificationData(req, rev)
+
+	if cfg.NotifyWebhookURL != "" {
+		payload, err := cfg.NotifyTemplates.RenderWebhook(data)
+		if err == nil {
+			err = sendWebhook(payload)
+		}
+		if err != nil {
+			log.Printf("Failed to send webhook for request %s: %v", req.ID, err)
+		}
+	}
+
+	if !emailConfigured() {
+		return
+	}
+	settings, err := getUserSettings(req.UserID)
+	if err != nil || settings.Email == "" {
+		return
+	}
+	subject, body, err := cfg.NotifyTemplates.RenderEmail(data)
+	if err != nil {
+		log.Printf("Failed to render notification for request %s: %v", req.ID, err)
+		return
+	}
+	if err := sendEmail([]string{settings.Email}, subject, body); err != nil {
+		log.Printf("Failed to notify user %s about request %s: %v", req.UserID, req.ID, err)
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// outboundBodyLimit is how many bytes of each body the outbound log shows
+const outboundBodyLimit = 4 << 10
+
+// outboundLog receives the outbound request log: DEBUG_HTTP_LOG when set,
+// rotated like LOG_FILE, the server log otherwise
+var outboundLog = log.Default()
+
+// installOutboundLogging routes every outbound request through the logging
+// transport. The provider clients (see httpclient.go) log through it
+// already; wrapping http.DefaultTransport covers any other client. Nothing is
+// logged unless DEBUG_HTTP is enabled.
+func installOutboundLogging() error {
+	if path := os.Getenv("DEBUG_HTTP_LOG"); path != "" {
+		file, err := openRotatingFile(path, logRotationFromEnv())
+		if err != nil {
+			return err
+		}
+		outboundLog = log.New(file, "", log.LstdFlags)
+	}
+	http.DefaultTransport = &loggingTransport{base: http.DefaultTransport}
+	return nil
+}
+
+// loggingTransport logs the requests sent through it and their responses,
+// with API keys, tokens and other credentials redacted
+type loggingTransport struct {
+	base http.RoundTripper
+	// secretResponses leaves response bodies out entirely, for services
+	// whose answers are credentials
+	secretResponses bool
+}
+
+func (t *loggingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if cfg := currentConfig(); cfg == nil || !cfg.DebugHTTP {
+		return t.base.RoundTrip(req)
+	}
+
+	var entry strings.Builder
+	start := time.Now()
+	fmt.Fprintf(&entry, "%s %s", req.Method, redactURL(req.URL))
+
+	// Request bodies are read through GetBody, leaving the one sent untouched
+	requestBody := ""
+	if req.GetBody != nil && isTextContent(req.Header.Get("Content-Type")) {
+		if body, err := req.GetBody(); err == nil {
+			data, _ := io.ReadAll(io.LimitReader(body, outboundBodyLimit+1))
+			body.Close()
+			requestBody = redactBody(data, req.Header.Get("Content-Type"))
+		}
+	}
+
+	resp, err := t.base.RoundTrip(req)
+	elapsed := time.Since(start).Round(time.Millisecond)
+	if err != nil {
+		fmt.Fprintf(&entry, " failed after %s: %v", elapsed, err)
+	} else {
+		fmt.Fprintf(&entry, " -> %s (%s)", resp.Status, elapsed)
+	}
+	fmt.Fprintf(&entry, "\n  request headers: %s", redactHeaders(req.Header))
+	if requestBody != "" {
+		fmt.Fprintf(&entry, "\n  request body: %s", requestBody)
+	}
+
+	if resp != nil {
+		fmt.Fprintf(&entry, "\n  response headers: %s", redactHeaders(resp.Header))
+		if t.secretResponses {
+			fmt.Fprintf(&entry, "\n  response body: %s", redacted)
+		} else if isTextContent(resp.Header.Get("Content-Type")) {
+			// Only the start that's logged is read here, the caller reads it
+			// again followed by the rest, however large
+			data, readErr := io.ReadAll(io.LimitReader(resp.Body, outboundBodyLimit+1))
+			resp.Body = replayBody{Reader: io.MultiReader(bytes.NewReader(data), resp.Body), Closer: resp.Body}
+			if readErr != nil {
+				fmt.Fprintf(&entry, "\n  response body: failed to read: %v", readErr)
+			} else if len(data) > 0 {
+				fmt.Fprintf(&entry, "\n  response body: %s", redactBody(data, resp.Header.Get("Content-Type")))
+			}
+		}
+	}
+
+	outboundLog.Print(entry.String())
+	return resp, err
+}
+
+// replayBody is a response body whose start was read for the log, read
+// again before the rest
+type replayBody struct {
+	io.Reader
+	io.Closer
+}
+
+// isTextContent reports whether a content type is worth logging, leaving
+// out images and other binary uploads and downloads
+func isTextContent(contentType string) bool {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	return strings.HasPrefix(mediaType, "text/") || strings.HasSuffix(mediaType, "json") ||
+		strings.HasSuffix(mediaType, "+xml") || mediaType == "application/xml" ||
+		mediaType == "application/x-www-form-urlencoded"
+}
+
+// redacted replaces credentials in the outbound log
+const redacted = "REDACTED"
+
+// secretNameParts mark query parameters, headers and JSON fields that hold
+// credentials
+var secretNameParts = []string{"key", "token", "secret", "password", "passphrase", "signature",
+	"credential", "authorization", "x-sentry-auth", "cookie", "appid"}
+
+// isSecretName reports whether a parameter, header or field name looks like
+// it holds a credential
+func isSecretName(name string) bool {
+	name = strings.ToLower(name)
+	for _, part := range secretNameParts {
+		if strings.Contains(name, part) {
+			return true
+		}
+	}
+	return false
+}
+
+// redactURL returns a URL with its credentials and secret query parameters
+// redacted
+func redactURL(u *url.URL) string {
+	clean := *u
+	if clean.User != nil {
+		clean.User = url.User(redacted)
+	}
+	query := clean.Query()
+	for name := range query {
+		if isSecretName(name) {
+			query[name] = []string{redacted}
+		}
+	}
+	clean.RawQuery = query.Encode()
+	return clean.String()
+}
+
+// redactHeaders formats headers sorted by name, with secret ones redacted
+func redactHeaders(header http.Header) string {
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	parts := make([]string, 0, len(names))
+	for _, name := range names {
+		value := strings.Join(header[name], ", ")
+		if isSecretName(name) {
+			value = redacted
+		}
+		parts = append(parts, name+": "+value)
+	}
+	return strings.Join(parts, "; ")
+}
+
+// jsonStringField matches a JSON field with a string value
+var jsonStringField = regexp.MustCompile(`"([^"\\]*)"(\s*:\s*)("(?:[^"\\]|\\.)*")`)
+
+// urlUserInfo matches the user info of URLs in text, such as a DSN's key or
+// a connection URL's password
+var urlUserInfo = regexp.MustCompile(`([A-Za-z][A-Za-z0-9+.-]*://)[^\s/?#@"'<>]+@`)
+
+// bearerToken matches bearer tokens that end up in bodies, such as error
+// messages echoing a request
+var bearerToken = regexp.MustCompile(`(?i)(bearer\s+)[A-Za-z0-9._~+/=-]+`)
+
+// redactURLValue redacts a value that's a URL with credentials in it, user
+// info or secret query parameters, reporting whether it was one
+func redactURLValue(value string) (string, bool) {
+	u, err := url.Parse(value)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return value, false
+	}
+	secret := u.User != nil
+	for name := range u.Query() {
+		secret = secret || isSecretName(name)
+	}
+	if !secret {
+		return value, false
+	}
+	return redactURL(u), true
+}
+
+// redactBody returns a body for the log, with the values of secret fields
+// and the credentials in URLs redacted, and anything past outboundBodyLimit
+// cut off
+func redactBody(data []byte, contentType string) string {
+	truncated := len(data) > outboundBodyLimit
+	if truncated {
+		data = data[:outboundBodyLimit]
+	}
+
+	body := string(data)
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	if mediaType == "application/x-www-form-urlencoded" {
+		if values, err := url.ParseQuery(body); err == nil {
+			for name, list := range values {
+				if isSecretName(name) {
+					values[name] = []string{redacted}
+					continue
+				}
+				for i, value := range list {
+					list[i], _ = redactURLValue(value)
+				}
+			}
+			body = values.Encode()
+		}
+	} else {
+		body = jsonStringField.ReplaceAllStringFunc(body, func(field string) string {
+			match := jsonStringField.FindStringSubmatch(field)
+			if isSecretName(match[1]) {
+				return `"` + match[1] + `"` + match[2] + `"` + redacted + `"`
+			}
+			var value string
+			if json.Unmarshal([]byte(match[3]), &value) == nil {
+				if clean, ok := redactURLValue(value); ok {
+					return `"` + match[1] + `"` + match[2] + strconv.Quote(clean)
+				}
+			}
+			return field
+		})
+	}
+	body = bearerToken.ReplaceAllString(body, "${1}"+redacted)
+	body = urlUserInfo.ReplaceAllString(body, "${1}"+redacted+"@")
+
+	if truncated {
+		body += fmt.Sprintf("... (truncated at %d bytes)", outboundBodyLimit)
+	}
+	return body
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"path"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Photos can be submitted as a link instead of a file, for photos already
+// hosted elsewhere and for API clients. Since the server fetches them, the
+// fetch is fenced in: only http and https, only public addresses, checked
+// on the address actually dialed so a name can't resolve to an internal one
+// after it was checked, a few redirects, and the upload limits on size and
+// type.
+
+const (
+	maxPhotoURLLength    = 2048
+	maxPhotoURLRedirects = 3
+	photoURLTimeout      = 30 * time.Second
+)
+
+var (
+	// ErrPhotoURLInvalid is returned for photo links that aren't absolute
+	// http or https URLs
+	ErrPhotoURLInvalid = errors.New("not an http or https URL")
+	// ErrPhotoURLBlocked is returned when a photo link leads to an address
+	// that isn't public, such as the server's own network
+	ErrPhotoURLBlocked = errors.New("address isn't public")
+	// ErrPhotoURLFetch is returned when a photo couldn't be downloaded from
+	// its link
+	ErrPhotoURLFetch = errors.New("failed to download photo")
+	// ErrPhotoTooLarge is returned when a photo's link is to a file over
+	// UPLOAD_MAX_MB
+	ErrPhotoTooLarge = errors.New("photo is over the upload size limit")
+
+	errTooManyRedirects = errors.New("too many redirects")
+)
+
+// nonPublicPrefixes are the special-purpose ranges not covered by the
+// net/netip classifications: shared carrier-grade NAT space, documentation
+// and benchmarking networks, reserved space, and IPv6 prefixes that embed an
+// IPv4 address, which could be an internal one
+var nonPublicPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("192.0.2.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("198.51.100.0/24"),
+	netip.MustParsePrefix("203.0.113.0/24"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("64:ff9b::/96"),
+	netip.MustParsePrefix("64:ff9b:1::/48"),
+	netip.MustParsePrefix("2001::/32"),
+	netip.MustParsePrefix("2001:db8::/32"),
+	netip.MustParsePrefix("2002::/16"),
+}
+
+// photoURLClient fetches submitted photo links. It doesn't go through a
+// proxy, which would connect on its behalf past the address check, nor the
+// outbound log: the links and what they answer are the users', not API
+// traffic, and the photo has to stay within the upload limits as it's read.
+var photoURLClient = newPhotoURLClient()
+
+func newPhotoURLClient() *http.Client {
+	transport := &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout:   10 * time.Second,
+			KeepAlive: 30 * time.Second,
+			Control:   dialPublicOnly,
+		}).DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          8,
+		MaxIdleConnsPerHost:   2,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: time.Second,
+	}
+	return &http.Client{
+		Transport: transport,
+		Timeout:   photoURLTimeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) > maxPhotoURLRedirects {
+				return errTooManyRedirects
+			}
+			_, err := parsePhotoURL(req.URL.String())
+			return err
+		},
+	}
+}
+
+// dialPublicOnly refuses connections to addresses that aren't public. It
+// runs after the host name was resolved, on each address dialed.
+func dialPublicOnly(network, address string, _ syscall.RawConn) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrPhotoURLBlocked, address)
+	}
+	if !isPublicAddress(addrPort.Addr()) {
+		return fmt.Errorf("%w: %s", ErrPhotoURLBlocked, addrPort.Addr())
+	}
+	return nil
+}
+
+// isPublicAddress reports whether an address is reachable on the internet,
+// rather than loopback, private, link-local or otherwise reserved
+func isPublicAddress(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if !addr.IsGlobalUnicast() || addr.IsPrivate() {
+		return false
+	}
+	for _, prefix := range nonPublicPrefixes {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+// parsePhotoURL checks that a photo link is an absolute http or https URL
+// without credentials, naming its host by a public address if by one at all
+func parsePhotoURL(raw string) (*url.URL, error) {
+	if len(raw) > maxPhotoURLLength {
+		return nil, fmt.Errorf("%w: longer than %d characters", ErrPhotoURLInvalid, maxPhotoURLLength)
+	}
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" || u.User != nil {
+		return nil, ErrPhotoURLInvalid
+	}
+	// Literal addresses are refused up front; names are checked once resolved
+	if addr, err := netip.ParseAddr(strings.Trim(u.Hostname(), "[]")); err == nil && !isPublicAddress(addr) {
+		return nil, fmt.Errorf("%w: %s", ErrPhotoURLBlocked, addr)
+	}
+	return u, nil
+}
+
+// redactPhotoURL returns a photo link for the log, with credentials such as
+// signed URLs' tokens redacted
+func redactPhotoURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "an invalid URL"
+	}
+	return redactURL(u)
+}
+
+// fetchedPhoto is a photo downloaded from its link, read like an upload
+type fetchedPhoto struct {
+	*bytes.Reader
+}
+
+func (fetchedPhoto) Close() error { return nil }
+
+// fetchPhotoURL downloads a photo from its link, within the upload limits,
+// returning it like an uploaded file. The file name is taken from the link,
+// with the extension of the type the server answered with when the link
+// doesn't end in an allowed one.
+func fetchPhotoURL(ctx context.Context, raw string, limits UploadLimits) (multipart.File, *multipart.FileHeader, error) {
+	u, err := parsePhotoURL(raw)
+	if err != nil {
+		return nil, nil, err
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, nil, ErrPhotoURLInvalid
+	}
+	httpReq.Header.Set("Accept", strings.Join(limits.MIMETypes, ", "))
+	httpReq.Header.Set("User-Agent", "SkyWeave")
+
+	resp, err := photoURLClient.Do(httpReq)
+	if err != nil {
+		// The URL is left out, it's logged redacted by the caller
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return nil, nil, fmt.Errorf("%w: %w", ErrPhotoURLFetch, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("%w: the link answered %s", ErrPhotoURLFetch, resp.Status)
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if !slices.Contains(limits.MIMETypes, mediaType) {
+		return nil, nil, fmt.Errorf("%w: the link is to %q", ErrInvalidImage, mediaType)
+	}
+	if resp.ContentLength > limits.MaxBytes {
+		return nil, nil, fmt.Errorf("%w: %d bytes", ErrPhotoTooLarge, resp.ContentLength)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, limits.MaxBytes+1))
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", ErrPhotoURLFetch, err)
+	}
+	if int64(len(data)) > limits.MaxBytes {
+		return nil, nil, fmt.Errorf("%w: over %d bytes", ErrPhotoTooLarge, limits.MaxBytes)
+	}
+
+	filename := path.Base(resp.Request.URL.Path)
+	if !limits.AllowsFile(filename) {
+		for _, ext := range limits.Extensions {
+			if uploadFormats[ext].MIMEType == mediaType {
+				filename = "photo" + ext
+				break
+			}
+		}
+	}
+	header := &multipart.FileHeader{Filename: filename, Size: int64(len(data))}
+	return fetchedPhoto{bytes.NewReader(data)}, header, nil
+}
+
+// photoURLMessage explains to the user why a photo couldn't be fetched from
+// its link
+func photoURLMessage(err error, limits UploadLimits) string {
+	switch {
+	case errors.Is(err, ErrPhotoURLInvalid):
+		return "Enter an http or https link to a photo"
+	case errors.Is(err, ErrPhotoURLBlocked):
+		return "Photos can only be fetched from public addresses on the internet"
+	case errors.Is(err, ErrInvalidImage):
+		return "The link isn't to a " + limits.FormatList() + " image"
+	case errors.Is(err, ErrPhotoTooLarge):
+		return "Photos can be at most " + humanFileSize(limits.MaxBytes)
+	case errors.Is(err, errTooManyRedirects):
+		return "The link redirects too many times"
+	default:
+		return "The photo couldn't be downloaded from the link"
+	}
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"log"
+	"strings"
+	"unicode/utf8"
+)
+
+// Postcards frame a result on paper, with the place and date written under
+// it and a strip of the weather next to them. They're drawn with the small
+// bitmap font and icons below, so they need nothing but the standard library.
+
+var (
+	postcardPaper   = color.RGBA{0xfa, 0xf6, 0xee, 0xff}
+	postcardInk     = color.RGBA{0x33, 0x2b, 0x24, 0xff}
+	postcardFaded   = color.RGBA{0x7c, 0x70, 0x64, 0xff}
+	postcardOutline = color.RGBA{0xd6, 0xcc, 0xbe, 0xff}
+)
+
+// postcardGlyphs is a 5x7 pixel font of the characters postcards are
+// written in, one row per byte with the leftmost pixel in bit 4
+var postcardGlyphs = map[rune][7]uint8{
+	'A':  {0b01110, 0b10001, 0b10001, 0b11111, 0b10001, 0b10001, 0b10001},
+	'B':  {0b11110, 0b10001, 0b10001, 0b11110, 0b10001, 0b10001, 0b11110},
+	'C':  {0b01110, 0b10001, 0b10000, 0b10000, 0b10000, 0b10001, 0b01110},
+	'D':  {0b11110, 0b10001, 0b10001, 0b10001, 0b10001, 0b10001, 0b11110},
+	'E':  {0b11111, 0b10000, 0b10000, 0b11110, 0b10000, 0b10000, 0b11111},
+	'F':  {0b11111, 0b10000, 0b10000, 0b11110, 0b10000, 0b10000, 0b10000},
+	'G':  {0b01110, 0b10001, 0b10000, 0b10111, 0b10001, 0b10001, 0b01111},
+	'H':  {0b10001, 0b10001, 0b10001, 0b11111, 0b10001, 0b10001, 0b10001},
+	'I':  {0b01110, 0b00100, 0b00100, 0b00100, 0b00100, 0b00100, 0b01110},
+	'J':  {0b00111, 0b00010, 0b00010, 0b00010, 0b00010, 0b10010, 0b01100},
+	'K':  {0b10001, 0b10010, 0b10100, 0b11000, 0b10100, 0b10010, 0b10001},
+	'L':  {0b10000, 0b10000, 0b10000, 0b10000, 0b10000, 0b10000, 0b11111},
+	'M':  {0b10001, 0b11011, 0b10101, 0b10101, 0b10001, 0b10001, 0b10001},
+	'N':  {0b10001, 0b10001, 0b11001, 0b10101, 0b10011, 0b10001, 0b10001},
+	'O':  {0b01110, 0b10001, 0b10001, 0b10001, 0b10001, 0b10001, 0b01110},
+	'P':  {0b11110, 0b10001, 0b10001, 0b11110, 0b10000, 0b10000, 0b10000},
+	'Q':  {0b01110, 0b10001, 0b10001, 0b10001, 0b10101, 0b10010, 0b01101},
+	'R':  {0b11110, 0b10001, 0b10001, 0b11110, 0b10100, 0b10010, 0b10001},
+	'S':  {0b01111, 0b10000, 0b10000, 0b01110, 0b00001, 0b00001, 0b11110},
+	'T':  {0b11111, 0b00100, 0b00100, 0b00100, 0b00100, 0b00100, 0b00100},
+	'U':  {0b10001, 0b10001, 0b10001, 0b10001, 0b10001, 0b10001, 0b01110},
+	'V':  {0b10001, 0b10001, 0b10001, 0b10001, 0b10001, 0b01010, 0b00100},
+	'W':  {0b10001, 0b10001, 0b10001, 0b10101, 0b10101, 0b10101, 0b01010},
+	'X':  {0b10001, 0b10001, 0b01010, 0b00100, 0b01010, 0b10001, 0b10001},
+	'Y':  {0b10001, 0b10001, 0b01010, 0b00100, 0b00100, 0b00100, 0b00100},
+	'Z':  {0b11111, 0b00001, 0b00010, 0b00100, 0b01000, 0b10000, 0b11111},
+	'0':  {0b01110, 0b10001, 0b10011, 0b10101, 0b11001, 0b10001, 0b01110},
+	'1':  {0b00100, 0b01100, 0b00100, 0b00100, 0b00100, 0b00100, 0b01110},
+	'2':  {0b01110, 0b10001, 0b00001, 0b00010, 0b00100, 0b01000, 0b11111},
+	'3':  {0b11111, 0b00010, 0b00100, 0b00010, 0b00001, 0b10001, 0b01110},
+	'4':  {0b00010, 0b00110, 0b01010, 0b10010, 0b11111, 0b00010, 0b00010},
+	'5':  {0b11111, 0b10000, 0b11110, 0b00001, 0b00001, 0b10001, 0b01110},
+	'6':  {0b00110, 0b01000, 0b10000, 0b11110, 0b10001, 0b10001, 0b01110},
+	'7':  {0b11111, 0b00001, 0b00010, 0b00100, 0b01000, 0b01000, 0b01000},
+	'8':  {0b01110, 0b10001, 0b10001, 0b01110, 0b10001, 0b10001, 0b01110},
+	'9':  {0b01110, 0b10001, 0b10001, 0b01111, 0b00001, 0b00010, 0b01100},
+	' ':  {},
+	'.':  {0, 0, 0, 0, 0, 0b01100, 0b01100},
+	',':  {0, 0, 0, 0, 0b01100, 0b00100, 0b01000},
+	'-':  {0, 0, 0, 0b11111, 0, 0, 0},
+	'\'': {0b00100, 0b00100, 0b01000, 0, 0, 0, 0},
+	'/':  {0b00001, 0b00001, 0b00010, 0b00100, 0b01000, 0b10000, 0b10000},
+	':':  {0, 0b01100, 0b01100, 0, 0b01100, 0b01100, 0},
+	'(':  {0b00010, 0b00100, 0b01000, 0b01000, 0b01000, 0b00100, 0b00010},
+	')':  {0b01000, 0b00100, 0b00010, 0b00010, 0b00010, 0b00100, 0b01000},
+	'&':  {0b01100, 0b10010, 0b10100, 0b01000, 0b10101, 0b10010, 0b01101},
+	'%':  {0b11000, 0b11001, 0b00010, 0b00100, 0b01000, 0b10011, 0b00011},
+	'°':  {0b01100, 0b10010, 0b10010, 0b01100, 0, 0, 0},
+	'·':  {0, 0, 0, 0b01100, 0b01100, 0, 0},
+}
+
+// postcardFolding writes the accented letters place names commonly have,
+// already upper case, as the letters the font has
+var postcardFolding = strings.NewReplacer(
+	"À", "A", "Á", "A", "Â", "A", "Ã", "A", "Ä", "A", "Å", "A", "Æ", "AE", "Ç", "C",
+	"È", "E", "É", "E", "Ê", "E", "Ë", "E", "Ì", "I", "Í", "I", "Î", "I", "Ï", "I",
+	"Ñ", "N", "Ò", "O", "Ó", "O", "Ô", "O", "Õ", "O", "Ö", "O", "Ø", "O", "Œ", "OE",
+	"Ù", "U", "Ú", "U", "Û", "U", "Ü", "U", "Ý", "Y", "Ÿ", "Y", "ß", "SS",
+	"Ą", "A", "Ć", "C", "Č", "C", "Ď", "D", "Ę", "E", "Ě", "E", "Ł", "L", "Ń", "N",
+	"Ň", "N", "Ř", "R", "Ś", "S", "Š", "S", "Ş", "S", "Ť", "T", "Ů", "U", "Ź", "Z",
+	"Ż", "Z", "Ž", "Z", "Ğ", "G", "İ", "I", "–", "-", "—", "-", "’", "'",
+)
+
+// postcardIcon is a 9x9 pixel icon in one color, one row per element with
+// the leftmost pixel in bit 8. There's one for each of OpenWeather's main
+// condition groups, and for the humidity and wind next to them.
+type postcardIcon struct {
+	rows  [9]uint16
+	color color.RGBA
+}
+
+var (
+	postcardSun = postcardIcon{[9]uint16{
+		0b000010000, 0b010000010, 0b000111000, 0b001111100, 0b101111101,
+		0b001111100, 0b000111000, 0b010000010, 0b000010000,
+	}, color.RGBA{0xf5, 0x9e, 0x0b, 0xff}}
+	postcardCloud = postcardIcon{[9]uint16{
+		0, 0, 0b000111000, 0b001111100, 0b011111110,
+		0b111111111, 0b111111111, 0b011111110, 0,
+	}, color.RGBA{0x94, 0xa3, 0xb8, 0xff}}
+	postcardRain = postcardIcon{[9]uint16{
+		0b000111000, 0b001111100, 0b011111110, 0b111111111, 0b011111110,
+		0, 0b010010010, 0, 0b100100100,
+	}, color.RGBA{0x3b, 0x82, 0xf6, 0xff}}
+	postcardThunder = postcardIcon{[9]uint16{
+		0b000111000, 0b001111100, 0b011111110, 0b111111111, 0b000010000,
+		0b000100000, 0b001111000, 0b000010000, 0b000100000,
+	}, color.RGBA{0x6b, 0x5b, 0x95, 0xff}}
+	postcardSnow = postcardIcon{[9]uint16{
+		0b000010000, 0b010010010, 0b001010100, 0b000111000, 0b111111111,
+		0b000111000, 0b001010100, 0b010010010, 0b000010000,
+	}, color.RGBA{0x38, 0xbd, 0xf8, 0xff}}
+	postcardFog = postcardIcon{[9]uint16{
+		0, 0b111111110, 0, 0b011111111, 0,
+		0b111111110, 0, 0b011111111, 0,
+	}, color.RGBA{0x9c, 0xa3, 0xaf, 0xff}}
+	postcardWind = postcardIcon{[9]uint16{
+		0b000001100, 0b000010010, 0b111111100, 0, 0b111111110,
+		0, 0b111111000, 0b000000100, 0b000011000,
+	}, color.RGBA{0x64, 0x74, 0x8b, 0xff}}
+	postcardDrop = postcardIcon{[9]uint16{
+		0b000010000, 0b000010000, 0b000111000, 0b000111000, 0b001111100,
+		0b011111110, 0b011111110, 0b001111100, 0b000111000,
+	}, color.RGBA{0x3b, 0x82, 0xf6, 0xff}}
+)
+
+var postcardConditionIcons = map[string]postcardIcon{
+	"Clear": postcardSun, "Clouds": postcardCloud, "Rain": postcardRain, "Drizzle": postcardRain,
+	"Thunderstorm": postcardThunder, "Snow": postcardSnow, "Mist": postcardFog, "Fog": postcardFog,
+	"Haze": postcardFog, "Smoke": postcardFog, "Dust": postcardWind, "Sand": postcardWind,
+	"Ash": postcardFog, "Squall": postcardWind, "Tornado": postcardWind,
+}
+
+// composePostcard draws a request's result into a postcard and stores it,
+// returning the path of its blob
+func composePostcard(result []byte, req *Request) (string, error) {
+	img, _, err := image.Decode(bytes.NewReader(result))
+	if err != nil {
+		return "", fmt.Errorf("failed to decode result: %w", err)
+	}
+	data, err := encodeJPEG(renderPostcard(img, req))
+	if err != nil {
+		return "", err
+	}
+	return storeBlob(data, ".jpg")
+}
+
+// addPostcard composes a revision's postcard when its request asked for
+// one. The result stands without it, so failing is only logged.
+func addPostcard(rev *Revision, result []byte) {
+	req, err := getRequest(rev.RequestID)
+	if err != nil {
+		log.Printf("Failed to get request %s for its postcard: %v", rev.RequestID, err)
+		return
+	}
+	if !req.Postcard {
+		return
+	}
+	path, err := composePostcard(result, req)
+	if err == nil {
+		err = setRevisionPostcard(rev, path)
+	}
+	if err != nil {
+		log.Printf("Failed to compose postcard of revision %s: %v", rev.ID, err)
+	}
+}
+
+// renderPostcard draws a result on a paper border, above the request's
+// place in capitals, its dates and time of day, and its weather
+func renderPostcard(result image.Image, req *Request) image.Image {
+	bounds := result.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	border := max(16, w/24)
+	scale := max(2, w/240) // pixels per font pixel
+
+	// The weather is written next to the place, or on a line of its own
+	// under the date when the place doesn't fit next to it
+	title := postcardPlace(req)
+	strip := postcardWeather(req)
+	stripWidth := strip.width(scale)
+	ownLine := stripWidth > w*2/3 || textWidth(title, scale) > w-stripWidth-8*scale
+	for ownLine && stripWidth > w && len(strip) > 1 {
+		strip = strip[:len(strip)-1]
+		stripWidth = strip.width(scale)
+	}
+
+	// The place is written twice as large as the rest when it fits
+	room := w
+	if !ownLine {
+		room -= stripWidth + 8*scale
+	}
+	titleScale := 2 * scale
+	if textWidth(title, titleScale) > room {
+		titleScale = scale
+	}
+	title = truncateText(title, titleScale, room)
+
+	subtitle := postcardText(formatDateRange(req.TargetDate, req.EndDate, defaultLocale))
+	if req.TimeOfDay != "" {
+		subtitle += " · " + postcardText(req.TimeOfDay)
+	}
+	subtitle = truncateText(subtitle, scale, w)
+
+	captionHeight := 7*titleScale + 3*scale + 7*scale
+	if ownLine {
+		captionHeight += 4*scale + 9*scale
+	}
+	canvas := image.NewRGBA(image.Rect(0, 0, w+2*border, h+3*border+captionHeight))
+	draw.Draw(canvas, canvas.Bounds(), &image.Uniform{postcardPaper}, image.Point{}, draw.Src)
+
+	// A thin outline sets the photo off the paper
+	outline := max(1, scale/2)
+	frame := image.Rect(border-outline, border-outline, border+w+outline, border+h+outline)
+	draw.Draw(canvas, frame, &image.Uniform{postcardOutline}, image.Point{}, draw.Src)
+	draw.Draw(canvas, image.Rect(border, border, border+w, border+h), result, bounds.Min, draw.Src)
+
+	top := 2*border + h
+	drawText(canvas, title, border, top, titleScale, postcardInk)
+	drawText(canvas, subtitle, border, top+7*titleScale+3*scale, scale, postcardFaded)
+
+	// Icons are 9 font pixels tall, centered on the text after them
+	x, y := border+w-stripWidth, top+(7*titleScale-9*scale)/2
+	if ownLine {
+		x, y = border, top+7*titleScale+3*scale+7*scale+4*scale
+	}
+	strip.draw(canvas, x, y, scale, postcardInk)
+	return canvas
+}
+
+// weatherStrip is a row of icons, each followed by the measurement it stands for
+type weatherStrip []weatherStripItem
+
+type weatherStripItem struct {
+	icon postcardIcon
+	text string
+}
+
+// postcardWeather is the strip of a request's weather: its condition with
+// the temperature, the humidity and the wind
+func postcardWeather(req *Request) weatherStrip {
+	var strip weatherStrip
+	if icon, ok := postcardConditionIcons[req.WeatherCondition]; ok {
+		strip = append(strip, weatherStripItem{icon, postcardText(formatTemp(req.Temperature, req.Units))})
+	}
+	return append(strip,
+		weatherStripItem{postcardDrop, fmt.Sprintf("%d%%", req.Humidity)},
+		weatherStripItem{postcardWind, postcardText(formatWind(req.WindSpeed, req.Units))},
+	)
+}
+
+// width is how wide the strip is drawn at a scale
+func (s weatherStrip) width(scale int) int {
+	if len(s) == 0 {
+		return 0
+	}
+	width := -6 * scale
+	for _, item := range s {
+		width += 11*scale + textWidth(item.text, scale) + 6*scale
+	}
+	return width
+}
+
+// draw draws the strip with its top left corner at x, y
+func (s weatherStrip) draw(img *image.RGBA, x, y, scale int, c color.RGBA) {
+	for _, item := range s {
+		drawIcon(img, item.icon, x, y, scale)
+		x += 11 * scale
+		drawText(img, item.text, x, y+scale, scale, c)
+		x += textWidth(item.text, scale) + 6*scale
+	}
+}
+
+// postcardPlace is the place a postcard is written from: the request's
+// place name, or when the font can't write that, its canonical name or
+// what the user typed
+func postcardPlace(req *Request) string {
+	for _, name := range []string{req.PlaceName(), req.LocationName} {
+		folded := postcardFolding.Replace(strings.ToUpper(strings.TrimSpace(name)))
+		if folded != "" && postcardText(name) == folded {
+			return folded
+		}
+	}
+	return postcardText(req.LocationInput)
+}
+
+// postcardText writes s in capitals, as far as the font has its letters;
+// the others are left out
+func postcardText(s string) string {
+	s = postcardFolding.Replace(strings.ToUpper(s))
+	return strings.Map(func(r rune) rune {
+		if _, ok := postcardGlyphs[r]; !ok {
+			return -1
+		}
+		return r
+	}, strings.TrimSpace(s))
+}
+
+// textWidth is how wide text is drawn at a scale: 5 pixels a character and
+// one between them
+func textWidth(text string, scale int) int {
+	n := utf8.RuneCountInString(text)
+	if n == 0 {
+		return 0
+	}
+	return (6*n - 1) * scale
+}
+
+// truncateText shortens text to fit width, ending it with "..."
+func truncateText(text string, scale, width int) string {
+	if textWidth(text, scale) <= width {
+		return text
+	}
+	runes := []rune(text)
+	for len(runes) > 0 && textWidth(string(runes)+"...", scale) > width {
+		runes = runes[:len(runes)-1]
+	}
+	if len(runes) == 0 {
+		return ""
+	}
+	return strings.TrimSpace(string(runes)) + "..."
+}
+
+// drawText writes text with its top left corner at x, y
+func drawText(img *image.RGBA, text string, x, y, scale int, c color.RGBA) {
+	for _, r := range text {
+		glyph := postcardGlyphs[r]
+		for row, bits := range glyph {
+			for col := range 5 {
+				if bits&(1<<(4-col)) != 0 {
+					fillSquare(img, x+col*scale, y+row*scale, scale, c)
+				}
+			}
+		}
+		x += 6 * scale
+	}
+}
+
+// drawIcon draws an icon with its top left corner at x, y
+func drawIcon(img *image.RGBA, icon postcardIcon, x, y, scale int) {
+	for row, bits := range icon.rows {
+		for col := range 9 {
+			if bits&(1<<(8-col)) != 0 {
+				fillSquare(img, x+col*scale, y+row*scale, scale, icon.color)
+			}
+		}
+	}
+}
+
+// fillSquare fills a size by size square at x, y
+func fillSquare(img *image.RGBA, x, y, size int, c color.RGBA) {
+	draw.Draw(img, image.Rect(x, y, x+size, y+size), &image.Uniform{c}, image.Point{}, draw.Src)
+}
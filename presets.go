@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"text/template"
+)
+
+// Ways a preset scenario can be combined with real weather
+const (
+	presetModeReplace = "replace" // the preset instead of real weather
+	presetModeBlend   = "blend"   // real weather with the preset's atmosphere
+)
+
+// presetSlugPattern restricts preset slugs to URL- and form-safe names
+var presetSlugPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,39}$`)
+
+// Preset is a curated weather scenario users can pick on the start form.
+// Its prompt is a text/template over the same fields as prompt variants, but
+// in replace mode only Location, TimeOfDay and Scene are set.
+type Preset struct {
+	Slug        string
+	Name        string
+	Description string
+	Prompt      string
+	Enabled     bool
+}
+
+// builtinPresets seed the presets table of a new database. Admins can edit,
+// disable or delete them from /admin/presets.
+var builtinPresets = []Preset{
+	{
+		Slug:        "cozy-snowfall",
+		Name:        "Cozy snowfall",
+		Description: "Soft, steady snow and a warm, quiet winter mood",
+		Prompt: `Transform this photo of {{.Location}}{{with .Scene}}, which shows {{.}},{{end}} into a cozy snowfall: ` +
+			`large soft flakes drifting down, a fresh blanket of snow on every surface, a pale overcast sky ` +
+			`and warm light glowing wherever there are windows or lamps.{{with .TimeOfDay}} {{.}}{{end}} ` +
+			`Keep the original composition and subjects; the result should look natural and photorealistic.`,
+		Enabled: true,
+	},
+	{
+		Slug:        "dramatic-thunderstorm",
+		Name:        "Dramatic thunderstorm",
+		Description: "Towering storm clouds, lightning and heavy rain",
+		Prompt: `Transform this photo of {{.Location}}{{with .Scene}}, which shows {{.}},{{end}} into a dramatic thunderstorm: ` +
+			`towering dark cumulonimbus clouds, a bright fork of lightning, sheets of heavy rain, ` +
+			`wet reflective surfaces and moody, high-contrast light.{{with .TimeOfDay}} {{.}}{{end}} ` +
+			`Keep the original composition and subjects; the result should look natural and photorealistic.`,
+		Enabled: true,
+	},
+	{
+		Slug:        "golden-hour-haze",
+		Name:        "Golden-hour haze",
+		Description: "Low sun through warm, hazy air",
+		Prompt: `Transform this photo of {{.Location}}{{with .Scene}}, which shows {{.}},{{end}} into a hazy golden hour: ` +
+			`a low sun casting long shadows, warm amber light, soft haze softening the distance ` +
+			`and a glowing, lightly clouded sky. ` +
+			`Keep the original composition and subjects; the result should look natural and photorealistic.`,
+		Enabled: true,
+	},
+	{
+		Slug:        "monsoon-rain",
+		Name:        "Monsoon rain",
+		Description: "Torrential tropical downpour under a heavy sky",
+		Prompt: `Transform this photo of {{.Location}}{{with .Scene}}, which shows {{.}},{{end}} into a monsoon downpour: ` +
+			`torrential rain, a heavy grey-green sky, water pooling and streaming across the ground, ` +
+			`humid mist and lush, saturated colors.{{with .TimeOfDay}} {{.}}{{end}} ` +
+			`Keep the original composition and subjects; the result should look natural and photorealistic.`,
+		Enabled: true,
+	},
+}
+
+// isValidPresetMode reports whether mode is a known preset mode
+func isValidPresetMode(mode string) bool {
+	return mode == presetModeReplace || mode == presetModeBlend
+}
+
+// validatePreset checks an admin-submitted preset, including that its prompt
+// template parses and renders
+func validatePreset(preset *Preset) error {
+	if !presetSlugPattern.MatchString(preset.Slug) {
+		return fmt.Errorf("slug must be lowercase letters, digits and dashes")
+	}
+	if strings.TrimSpace(preset.Name) == "" {
+		return fmt.Errorf("name is required")
+	}
+	if strings.TrimSpace(preset.Prompt) == "" {
+		return fmt.Errorf("prompt is required")
+	}
+	if _, err := renderPresetPrompt(preset, promptFields{Location: "Oslo", TimeOfDay: timeOfDayVocabulary["dusk"]}); err != nil {
+		return err
+	}
+	return nil
+}
+
+// renderPresetPrompt renders a preset's prompt template
+func renderPresetPrompt(preset *Preset, fields promptFields) (string, error) {
+	tmpl, err := template.New(preset.Slug).Parse(preset.Prompt)
+	if err != nil {
+		return "", fmt.Errorf("invalid prompt template: %w", err)
+	}
+
+	var b strings.Builder
+	if err := tmpl.Execute(&b, fields); err != nil {
+		return "", fmt.Errorf("invalid prompt template: %w", err)
+	}
+	prompt := strings.TrimSpace(b.String())
+	if len(prompt) > maxPromptLength {
+		return "", fmt.Errorf("prompt is longer than %d characters", maxPromptLength)
+	}
+	return prompt, nil
+}
+
+// requestPrompt builds a request's prompt from its weather and preset. With
+// no preset it is the regular weather prompt. In replace mode the preset's
+// template stands in for the weather, and weatherData is nil; in blend mode
+// the weather prompt gains the preset's atmosphere from its description.
+func requestPrompt(req *Request, preset *Preset, weatherData *WeatherData, locationName, scene, variant string) (string, error) {
+	if preset != nil && req.PresetMode == presetModeReplace {
+		prompt, err := renderPresetPrompt(preset, presetFields(req, locationName, scene))
+		if err != nil {
+			return "", fmt.Errorf("preset %s: %w", preset.Slug, err)
+		}
+		return prompt, nil
+	}
+
+	prompt := generatePrompt(weatherData, locationName, req.TimeOfDay, scene, req.ID, variant)
+	if preset == nil || preset.Description == "" {
+		return prompt, nil
+	}
+
+	blended := fmt.Sprintf("%s Give it the atmosphere of %s: %s.", prompt,
+		strings.ToLower(preset.Name), strings.ToLower(strings.TrimRight(preset.Description, ".")))
+	if len(blended) > maxPromptLength {
+		return prompt, nil
+	}
+	return blended, nil
+}
+
+// presetFields are the prompt fields available to preset templates
+func presetFields(req *Request, locationName, scene string) promptFields {
+	return promptFields{
+		Location:  sanitizeLocationName(locationName),
+		TimeOfDay: timeOfDayVocabulary[req.TimeOfDay],
+		Scene:     scene,
+	}
+}
+
+// PresetName is the name of the request's preset, if it has one
+func (r *Request) PresetName() string {
+	if r.Preset == "" {
+		return ""
+	}
+	if preset, err := getPreset(r.Preset); err == nil {
+		return preset.Name
+	}
+	return r.Preset
+}
+
+// WeatherReplaced reports whether a preset stands in for the real weather
+func (r *Request) WeatherReplaced() bool {
+	return r.Preset != "" && r.PresetMode == presetModeReplace
+}
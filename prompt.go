@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// PromptInput is everything a prompt is generated from
+type PromptInput struct {
+	Weather   *WeatherData // metric
+	Location  string
+	TimeOfDay string
+	Scene     string // caption of the uploaded photo, may be empty
+	Seed      string // varies phrasing deterministically, normally the request ID
+	Variant   string // prompt experiment variant
+}
+
+// PromptGenerator turns weather data into a prompt for the image model
+type PromptGenerator interface {
+	GeneratePrompt(in PromptInput) (string, error)
+}
+
+// Prompt generators selectable with PROMPT_GENERATOR
+const (
+	promptGeneratorRules     = "rules"
+	promptGeneratorOpenAI    = "openai"
+	promptGeneratorAnthropic = "anthropic"
+	promptGeneratorOllama    = "ollama"
+)
+
+// generatePrompt creates an AI prompt for image editing based on weather data,
+// using the configured prompt generator. If an LLM generator fails, the
+// rule-based prompt is used instead. Imperial weather is converted first, so
+// the model always gets °C.
+func generatePrompt(weatherData *WeatherData, locationName, timeOfDay, scene, seed, variant string) string {
+	in := PromptInput{
+		Weather: weatherData.metric(),
+		// The location name may originate from user input; never pass it through raw
+		Location:  sanitizeLocationName(locationName),
+		TimeOfDay: timeOfDay,
+		Scene:     scene,
+		Seed:      seed,
+		Variant:   variant,
+	}
+
+	generator := currentConfig().PromptGenerator
+	prompt, err := generator.GeneratePrompt(in)
+	if err != nil {
+		log.Printf("Prompt generator failed, falling back to rules: %v", err)
+		prompt, _ = rulePromptGenerator{}.GeneratePrompt(in)
+	}
+	return prompt
+}
+
+// rulePromptGenerator words prompts from the variant templates. Phrasing is
+// drawn from the vocabulary tables, varied deterministically by seed so a
+// request always regenerates the same prompt.
+type rulePromptGenerator struct{}
+
+// GeneratePrompt renders the input's prompt variant
+func (rulePromptGenerator) GeneratePrompt(in PromptInput) (string, error) {
+	return renderPromptVariant(in.Variant, promptFieldsFor(in)), nil
+}
+
+// promptFieldsFor describes the weather with vocabulary phrases
+func promptFieldsFor(in PromptInput) promptFields {
+	weatherData := in.Weather
+	fields := promptFields{
+		Location:   in.Location,
+		Condition:  conditionPhrase(weatherData, in.Seed),
+		Cloudiness: bucketPhrase(cloudVocabulary, float64(weatherData.Clouds), in.Seed, "clouds"),
+		Temp:       weatherData.Temp,
+		TempDesc:   bucketPhrase(temperatureVocabulary, weatherData.Temp, in.Seed, "temperature"),
+		TimeOfDay:  timeOfDayVocabulary[in.TimeOfDay],
+		Visibility: bucketPhrase(visibilityVocabulary, float64(weatherData.Visibility), in.Seed, "visibility"),
+		Wind:       bucketPhrase(windVocabulary, weatherData.WindSpeed, in.Seed, "wind"),
+		Clouds:     weatherData.Clouds,
+		Scene:      in.Scene,
+	}
+
+	// Rain/Snow
+	if weatherData.Rain > 0 {
+		fields.Precipitation = bucketPhrase(rainVocabulary, weatherData.Rain, in.Seed, "rain")
+	} else if weatherData.Snow > 0 {
+		fields.Precipitation = bucketPhrase(snowVocabulary, weatherData.Snow, in.Seed, "snow")
+	}
+	return fields
+}
+
+// llmPromptGenerator asks a language model to rewrite the rule-based prompt
+// into a richer one, keeping every weather fact
+type llmPromptGenerator struct {
+	Provider string // promptGeneratorOpenAI, promptGeneratorAnthropic or promptGeneratorOllama
+	Model    string
+	BaseURL  string
+	APIKey   string
+}
+
+// llmPromptInstructions is the system prompt given to every LLM provider
+const llmPromptInstructions = `You write prompts for an image editing model that changes the weather in landscape photos.
+You get the weather facts, sometimes what the photo shows, and a plain draft prompt. Rewrite the draft into
+one vivid, concrete paragraph describing how the sky, light, atmosphere and surfaces should look, referring
+to the photo's actual subjects where they are known. Keep every fact from the draft,
+invent no new weather, and keep the instruction to preserve the photo's composition and subjects.
+Reply with the prompt only, under 150 words, without quotes or preamble.`
+
+// newPromptGenerator builds the prompt generator named by PROMPT_GENERATOR.
+// LLM generators use model and baseURL when given, or each provider's default.
+func newPromptGenerator(kind, model, baseURL, apiKey string) (PromptGenerator, error) {
+	var defaultModel, defaultURL string
+	switch kind {
+	case "", promptGeneratorRules:
+		return rulePromptGenerator{}, nil
+	case promptGeneratorOpenAI:
+		defaultModel, defaultURL = "gpt-4o-mini", "https://api.openai.com/v1"
+	case promptGeneratorAnthropic:
+		defaultModel, defaultURL = "claude-3-5-haiku-latest", "https://api.anthropic.com"
+	case promptGeneratorOllama:
+		defaultModel, defaultURL = "llama3.1", "http://localhost:11434"
+	default:
+		return nil, fmt.Errorf("unknown PROMPT_GENERATOR %q", kind)
+	}
+
+	if apiKey == "" && kind != promptGeneratorOllama {
+		return nil, fmt.Errorf("PROMPT_GENERATOR=%s needs PROMPT_LLM_API_KEY", kind)
+	}
+	if model == "" {
+		model = defaultModel
+	}
+	if baseURL == "" {
+		baseURL = defaultURL
+	}
+	return &llmPromptGenerator{
+		Provider: kind,
+		Model:    model,
+		BaseURL:  strings.TrimRight(baseURL, "/"),
+		APIKey:   apiKey,
+	}, nil
+}
+
+// GeneratePrompt asks the configured provider for a prompt
+func (g *llmPromptGenerator) GeneratePrompt(in PromptInput) (string, error) {
+	draft, _ := rulePromptGenerator{}.GeneratePrompt(in)
+	message := llmPromptFacts(in) + "\nDraft prompt:\n" + draft
+
+	var prompt string
+	var err error
+	switch g.Provider {
+	case promptGeneratorOpenAI:
+		prompt, err = g.openAI(message)
+	case promptGeneratorAnthropic:
+		prompt, err = g.anthropic(message)
+	case promptGeneratorOllama:
+		prompt, err = g.ollama(message)
+	}
+	if err != nil {
+		return "", fmt.Errorf("%s prompt generation failed: %w", g.Provider, err)
+	}
+
+	prompt = strings.Trim(strings.TrimSpace(prompt), `"`)
+	if prompt == "" || len(prompt) > maxPromptLength {
+		return "", fmt.Errorf("%s returned an unusable prompt (%d characters)", g.Provider, len(prompt))
+	}
+	return prompt, nil
+}
+
+// llmPromptFacts lists the structured weather facts for the LLM
+func llmPromptFacts(in PromptInput) string {
+	fields := promptFieldsFor(in)
+	var b strings.Builder
+	fmt.Fprintf(&b, "Location: %s\n", fields.Location)
+	if fields.Scene != "" {
+		fmt.Fprintf(&b, "The photo shows: %s\n", fields.Scene)
+	}
+	fmt.Fprintf(&b, "Conditions: %s\n", fields.Condition)
+	fmt.Fprintf(&b, "Cloud cover: %d%% (%s)\n", fields.Clouds, fields.Cloudiness)
+	fmt.Fprintf(&b, "Temperature: %s (%s)\n", formatTemp(fields.Temp, unitsMetric), fields.TempDesc)
+	if fields.Precipitation != "" {
+		fmt.Fprintf(&b, "Precipitation: %s\n", fields.Precipitation)
+	}
+	if fields.Visibility != "" {
+		fmt.Fprintf(&b, "Visibility: %s\n", fields.Visibility)
+	}
+	if fields.Wind != "" {
+		fmt.Fprintf(&b, "Wind: %s\n", fields.Wind)
+	}
+	if fields.TimeOfDay != "" {
+		fmt.Fprintf(&b, "Time of day: %s\n", fields.TimeOfDay)
+	}
+	return b.String()
+}
+
+// openAI calls an OpenAI-compatible chat completions API
+func (g *llmPromptGenerator) openAI(message string) (string, error) {
+	reqBody := map[string]interface{}{
+		"model": g.Model,
+		"messages": []map[string]string{
+			{"role": "system", "content": llmPromptInstructions},
+			{"role": "user", "content": message},
+		},
+		"temperature": 0.8,
+	}
+	headers := map[string]string{"Authorization": "Bearer " + g.APIKey}
+
+	var resp struct {
+		Choices []struct {
+			Message struct {
+				Content string `json:"content"`
+			} `json:"message"`
+		} `json:"choices"`
+	}
+	if err := postLLM(g.BaseURL+"/chat/completions", headers, reqBody, &resp); err != nil {
+		return "", err
+	}
+	if len(resp.Choices) == 0 {
+		return "", fmt.Errorf("no choices in response")
+	}
+	return resp.Choices[0].Message.Content, nil
+}
+
+// anthropic calls the Anthropic Messages API
+func (g *llmPromptGenerator) anthropic(message string) (string, error) {
+	reqBody := map[string]interface{}{
+		"model":      g.Model,
+		"max_tokens": 400,
+		"system":     llmPromptInstructions,
+		"messages": []map[string]string{
+			{"role": "user", "content": message},
+		},
+		"temperature": 0.8,
+	}
+	headers := map[string]string{
+		"x-api-key":         g.APIKey,
+		"anthropic-version": "2023-06-01",
+	}
+
+	var resp struct {
+		Content []struct {
+			Type string `json:"type"`
+			Text string `json:"text"`
+		} `json:"content"`
+	}
+	if err := postLLM(g.BaseURL+"/v1/messages", headers, reqBody, &resp); err != nil {
+		return "", err
+	}
+	var text strings.Builder
+	for _, block := range resp.Content {
+		if block.Type == "text" {
+			text.WriteString(block.Text)
+		}
+	}
+	return text.String(), nil
+}
+
+// ollama calls a local Ollama server's chat API
+func (g *llmPromptGenerator) ollama(message string) (string, error) {
+	reqBody := map[string]interface{}{
+		"model": g.Model,
+		"messages": []map[string]string{
+			{"role": "system", "content": llmPromptInstructions},
+			{"role": "user", "content": message},
+		},
+		"stream":  false,
+		"options": map[string]interface{}{"temperature": 0.8},
+	}
+
+	var resp struct {
+		Message struct {
+			Content string `json:"content"`
+		} `json:"message"`
+	}
+	if err := postLLM(g.BaseURL+"/api/chat", nil, reqBody, &resp); err != nil {
+		return "", err
+	}
+	return resp.Message.Content, nil
+}
+
+// postLLM sends a JSON request to an LLM API and decodes the JSON response
+func postLLM(apiURL string, headers map[string]string, reqBody, out interface{}) error {
+	jsonData, err := json.Marshal(reqBody)
+	if err != nil {
+		return fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	req, err := http.NewRequest("POST", apiURL, bytes.NewReader(jsonData))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := promptLLMClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return providerError(providerLLM, "LLM API", resp, body, nil)
+	}
+
+	if err := json.Unmarshal(body, out); err != nil {
+		return fmt.Errorf("failed to parse response: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// parseTrustedProxies parses TRUSTED_PROXIES, a comma separated list of IPs
+// or CIDR ranges whose X-Forwarded-* headers we believe
+func parseTrustedProxies(raw string) []*net.IPNet {
+	var networks []*net.IPNet
+	for _, entry := range strings.Split(raw, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			if strings.Contains(entry, ":") {
+				entry += "/128"
+			} else {
+				entry += "/32"
+			}
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			log.Printf("Warning: ignoring invalid TRUSTED_PROXIES entry %q: %v", entry, err)
+			continue
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+// parsePublicURL parses PUBLIC_URL, which pins the externally visible base
+// URL and overrides forwarded headers
+func parsePublicURL(raw string) *url.URL {
+	if raw == "" {
+		return nil
+	}
+	parsed, err := url.Parse(strings.TrimRight(raw, "/"))
+	if err != nil || parsed.Scheme == "" || parsed.Host == "" {
+		log.Printf("Warning: ignoring invalid PUBLIC_URL %q", raw)
+		return nil
+	}
+	return parsed
+}
+
+// isTrustedProxy reports whether a peer IP belongs to a configured trusted proxy
+func isTrustedProxy(ip net.IP) bool {
+	for _, network := range currentConfig().TrustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// peerIP returns the IP of the directly connected peer, or nil for Unix sockets
+func peerIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+// isFromTrustedProxy reports whether the request arrived through a trusted proxy.
+// Connections over a Unix socket can only come from local processes and are trusted.
+func isFromTrustedProxy(r *http.Request) bool {
+	ip := peerIP(r)
+	if ip == nil {
+		return true
+	}
+	return isTrustedProxy(ip)
+}
+
+// clientIP returns the real client IP. Forwarded headers are only honored when
+// the peer is a trusted proxy; X-Forwarded-For is walked right to left,
+// skipping further trusted hops.
+func clientIP(r *http.Request) string {
+	ip := peerIP(r)
+	if !isFromTrustedProxy(r) {
+		return ip.String()
+	}
+
+	if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+		hops := strings.Split(forwarded, ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := net.ParseIP(strings.TrimSpace(hops[i]))
+			if hop == nil {
+				break
+			}
+			if i == 0 || !isTrustedProxy(hop) {
+				return hop.String()
+			}
+		}
+	}
+
+	if realIP := net.ParseIP(strings.TrimSpace(r.Header.Get("X-Real-IP"))); realIP != nil {
+		return realIP.String()
+	}
+
+	if ip == nil {
+		return "unix"
+	}
+	return ip.String()
+}
+
+// isSecureRequest reports whether the client connected over HTTPS, either
+// directly or to a trusted proxy that set X-Forwarded-Proto
+func isSecureRequest(r *http.Request) bool {
+	if r.TLS != nil {
+		return true
+	}
+	if publicURL := currentConfig().PublicURL; publicURL != nil {
+		return publicURL.Scheme == "https"
+	}
+	return isFromTrustedProxy(r) && strings.EqualFold(r.Header.Get("X-Forwarded-Proto"), "https")
+}
+
+// absoluteURL builds an externally reachable URL for path, for use in share
+// links and outgoing notifications. PUBLIC_URL wins if set; otherwise the
+// forwarded host and scheme are used when the peer is a trusted proxy.
+func absoluteURL(r *http.Request, path string) string {
+	if publicURL := currentConfig().PublicURL; publicURL != nil {
+		return publicURL.String() + path
+	}
+
+	scheme := "http"
+	if isSecureRequest(r) {
+		scheme = "https"
+	}
+
+	host := r.Host
+	if isFromTrustedProxy(r) {
+		if forwardedHost := r.Header.Get("X-Forwarded-Host"); forwardedHost != "" {
+			host = strings.TrimSpace(strings.Split(forwardedHost, ",")[0])
+		}
+	}
+
+	return scheme + "://" + host + path
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+)
+
+// Publisher copies completed results to a public bucket, usually behind a
+// CDN, so share links and notification emails don't have to fetch images
+// through the server
+type Publisher struct {
+	Bucket  *S3Bucket
+	Prefix  string // key prefix results are stored under
+	BaseURL string // public URL of the bucket root, without a trailing slash
+}
+
+// newPublisher builds the publisher configured by PUBLISH_S3_BUCKET. It
+// returns nil when publishing isn't configured.
+func newPublisher(bucket, endpoint, prefix, baseURL string, creds AWSCredentials) (*Publisher, error) {
+	if bucket == "" {
+		return nil, nil
+	}
+	if u, err := url.Parse(baseURL); err != nil || u.Host == "" {
+		return nil, fmt.Errorf("PUBLISH_S3_BUCKET needs PUBLISH_BASE_URL, the public URL of the bucket")
+	}
+	b, err := newS3Bucket(bucket, endpoint, creds)
+	if err != nil {
+		return nil, err
+	}
+	return &Publisher{
+		Bucket:  b,
+		Prefix:  strings.TrimPrefix(prefix, "/"),
+		BaseURL: strings.TrimSuffix(baseURL, "/"),
+	}, nil
+}
+
+// Publish uploads a revision's result and returns its public URL. Revision
+// IDs are random and results never change, so the object can be cached
+// forever.
+func (p *Publisher) Publish(rev *Revision) (string, error) {
+	key := p.Prefix + rev.RequestID + "/" + rev.ID + ".jpg"
+	if err := p.Bucket.PutFile(key, rev.ResultImagePath, "image/jpeg"); err != nil {
+		return "", err
+	}
+	return p.BaseURL + "/" + key, nil
+}
+
+// Unpublish deletes a published revision's result from the bucket
+func (p *Publisher) Unpublish(rev *Revision) error {
+	key, ok := strings.CutPrefix(rev.PublicURL, p.BaseURL+"/")
+	if !ok {
+		return fmt.Errorf("%s isn't under PUBLISH_BASE_URL", rev.PublicURL)
+	}
+	return p.Bucket.Delete(key)
+}
+
+// publishRevision publishes a completed revision when a publisher is
+// configured and records its public URL. It reports whether the result was
+// published; on failure the result is still served by the server itself.
+func publishRevision(rev *Revision) bool {
+	publisher := currentConfig().Publisher
+	if publisher == nil {
+		return false
+	}
+
+	publicURL, err := publisher.Publish(rev)
+	if err != nil {
+		log.Printf("Failed to publish revision %s: %v", rev.ID, err)
+		return false
+	}
+	if err := setRevisionPublicURL(rev, publicURL); err != nil {
+		log.Printf("Failed to save public URL of revision %s: %v", rev.ID, err)
+		return false
+	}
+	log.Printf("Published revision %s to %s", rev.ID, publicURL)
+	return true
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// maxRangeDays caps how many days a date range may span
+const maxRangeDays = 14
+
+// maxForecastDays is how many days ahead the forecast covers
+const maxForecastDays = 16
+
+// weatherWindow returns the first and last days weather can be looked up for:
+// from the start of the historical archive to the end of the forecast, counted
+// from today in UTC. Both the start form and the server check dates against it.
+func weatherWindow(now time.Time) (first, last time.Time) {
+	first, _ = time.Parse(time.DateOnly, archiveStartDate)
+	today := now.UTC().Truncate(24 * time.Hour)
+	return first, today.AddDate(0, 0, maxForecastDays)
+}
+
+// nearestInWindow returns the day in [first, last] closest to date
+func nearestInWindow(date, first, last time.Time) time.Time {
+	if date.Before(first) {
+		return first
+	}
+	if date.After(last) {
+		return last
+	}
+	return date
+}
+
+// Ways a date range can be turned into images
+const (
+	rangeModeSummary = "summary" // one image from the range's dominant conditions
+	rangeModeDaily   = "daily"   // a batch with one image per day
+)
+
+// parseDateRange parses an inclusive date range and returns each date in it.
+// An empty end date means a single day.
+func parseDateRange(startStr, endStr string) ([]time.Time, error) {
+	start, err := time.Parse("2006-01-02", startStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid date format")
+	}
+	if endStr == "" || endStr == startStr {
+		return []time.Time{start}, nil
+	}
+
+	end, err := time.Parse("2006-01-02", endStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid end date format")
+	}
+	days := daysBetween(start, end) + 1
+	if days < 1 {
+		return nil, fmt.Errorf("end date is before the start date")
+	}
+	if days > maxRangeDays {
+		return nil, fmt.Errorf("date ranges can span at most %d days", maxRangeDays)
+	}
+
+	dates := make([]time.Time, days)
+	for i := range dates {
+		dates[i] = start.AddDate(0, 0, i)
+	}
+	return dates, nil
+}
+
+// getRangeWeather fetches the weather for every date in a range
+func getRangeWeather(lat, lon float64, dates []time.Time, loc *time.Location, units string) ([]*WeatherData, error) {
+	days := make([]*WeatherData, 0, len(dates))
+	for _, date := range dates {
+		weatherData, err := getHistoricalWeather(lat, lon, date, loc, units)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", date.Format("2006-01-02"), err)
+		}
+		days = append(days, weatherData)
+	}
+	return days, nil
+}
+
+// summarizeWeather combines several days into one: the most frequent
+// condition (the first day with it also supplies the wind direction, which
+// can't be averaged) and the averages of everything else, precipitation
+// included, so vocabulary buckets calibrated for a single day still apply.
+func summarizeWeather(days []*WeatherData) *WeatherData {
+	if len(days) == 1 {
+		return days[0]
+	}
+
+	counts := make(map[int]int)
+	dominant := days[0]
+	for _, day := range days {
+		counts[day.ConditionID]++
+		if counts[day.ConditionID] > counts[dominant.ConditionID] {
+			dominant = day
+		}
+	}
+
+	summary := &WeatherData{
+		ConditionID: dominant.ConditionID,
+		Condition:   dominant.Condition,
+		Description: dominant.Description,
+		WindDeg:     dominant.WindDeg,
+		Units:       days[0].Units,
+		Provider:    days[0].Provider,
+	}
+	// A range reaching into the future is only as reliable as its forecast
+	for _, day := range days {
+		if day.Provider == weatherProviderForecast {
+			summary.Provider = weatherProviderForecast
+		}
+	}
+
+	var pressure, humidity, clouds, visibility int
+	for _, day := range days {
+		summary.Temp += day.Temp
+		summary.FeelsLike += day.FeelsLike
+		summary.WindSpeed += day.WindSpeed
+		summary.Rain += day.Rain
+		summary.Snow += day.Snow
+		pressure += day.Pressure
+		humidity += day.Humidity
+		clouds += day.Clouds
+		visibility += day.Visibility
+	}
+
+	n := float64(len(days))
+	summary.Temp /= n
+	summary.FeelsLike /= n
+	summary.WindSpeed /= n
+	summary.Rain /= n
+	summary.Snow /= n
+	summary.Pressure = pressure / len(days)
+	summary.Humidity = humidity / len(days)
+	summary.Clouds = clouds / len(days)
+	summary.Visibility = visibility / len(days)
+	summary.roundMeasurements()
+	return summary
+}
+
+// replayRequestWeather rebuilds a request's weather from its latest stored
+// snapshots, summarized the way it was when its prompt was generated
+func replayRequestWeather(req *Request) (*WeatherData, error) {
+	dates, err := parseDateRange(req.TargetDate, req.EndDate)
+	if err != nil {
+		return nil, err
+	}
+	snapshots, err := getLatestWeatherSnapshots(req.ID, len(dates))
+	if err != nil {
+		return nil, err
+	}
+
+	days := make([]*WeatherData, 0, len(snapshots))
+	for _, snapshot := range snapshots {
+		weatherData, err := parseWeatherSnapshot(snapshot.Provider, snapshot.Units, []byte(snapshot.RawJSON))
+		if err != nil {
+			return nil, fmt.Errorf("failed to replay weather snapshot %d: %w", snapshot.ID, err)
+		}
+		days = append(days, weatherData)
+	}
+	return summarizeWeather(days), nil
+}
+
+// DateLabel is the request's target date, or its date range
+func (r *Request) DateLabel() string {
+	if r.EndDate == "" {
+		return r.TargetDate
+	}
+	return r.TargetDate + " – " + r.EndDate
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Redis client limits
+const (
+	redisTimeout   = 3 * time.Second // per command, including dialing
+	redisIdleConns = 8               // connections kept open between commands
+	redisKeyPrefix = "skyweave:"     // keeps keys apart from other users of the server
+)
+
+// redisCache is a Cache backed by Redis, speaking just enough of the RESP
+// protocol for GET, SET, INCR, PEXPIRE and DEL
+type redisCache struct {
+	addr     string
+	username string
+	password string
+	db       int
+	useTLS   bool
+	idle     chan *redisConn
+}
+
+// redisConn is an open connection to Redis
+type redisConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+// redisError is an error reply from Redis
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+// newRedisCache configures a client from a URL like
+// redis://:password@host:6379/0, or rediss:// for TLS
+func newRedisCache(rawURL string) (*redisCache, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid CACHE_URL: %w", err)
+	}
+	if u.Scheme != "redis" && u.Scheme != "rediss" {
+		return nil, fmt.Errorf("invalid CACHE_URL: unsupported scheme %q, expected redis or rediss", u.Scheme)
+	}
+
+	c := &redisCache{addr: u.Host, useTLS: u.Scheme == "rediss", idle: make(chan *redisConn, redisIdleConns)}
+	if u.Port() == "" {
+		c.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		// redis://password@host is common shorthand for a password alone
+		if password, ok := u.User.Password(); ok {
+			c.username, c.password = u.User.Username(), password
+		} else {
+			c.password = u.User.Username()
+		}
+	}
+	if db := strings.TrimPrefix(u.Path, "/"); db != "" {
+		if c.db, err = strconv.Atoi(db); err != nil {
+			return nil, fmt.Errorf("invalid CACHE_URL: database %q is not a number", db)
+		}
+	}
+	return c, nil
+}
+
+// Ping checks that Redis answers
+func (c *redisCache) Ping() error {
+	_, err := c.do("PING")
+	return err
+}
+
+func (c *redisCache) Get(key string) ([]byte, bool, error) {
+	reply, err := c.do("GET", redisKeyPrefix+key)
+	if err != nil || reply == nil {
+		return nil, false, err
+	}
+	value, ok := reply.([]byte)
+	if !ok {
+		return nil, false, fmt.Errorf("redis: unexpected reply %v to GET", reply)
+	}
+	return value, true, nil
+}
+
+func (c *redisCache) Set(key string, value []byte, ttl time.Duration) error {
+	_, err := c.do("SET", redisKeyPrefix+key, string(value), "PX", strconv.FormatInt(ttl.Milliseconds(), 10))
+	return err
+}
+
+func (c *redisCache) Incr(key string, ttl time.Duration) (int64, error) {
+	reply, err := c.do("INCR", redisKeyPrefix+key)
+	if err != nil {
+		return 0, err
+	}
+	count, ok := reply.(int64)
+	if !ok {
+		return 0, fmt.Errorf("redis: unexpected reply %v to INCR", reply)
+	}
+	if count == 1 {
+		if _, err := c.do("PEXPIRE", redisKeyPrefix+key, strconv.FormatInt(ttl.Milliseconds(), 10)); err != nil {
+			return 0, err
+		}
+	}
+	return count, nil
+}
+
+func (c *redisCache) Delete(key string) error {
+	_, err := c.do("DEL", redisKeyPrefix+key)
+	return err
+}
+
+// do sends a command and returns its reply: nil, a string, an int64 or a
+// []byte. Error replies come back as redisError.
+func (c *redisCache) do(args ...string) (any, error) {
+	conn, err := c.conn()
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(redisTimeout))
+	reply, err := conn.command(args...)
+
+	// A connection that failed mid-reply can't be reused, one that got an
+	// error reply can
+	var replyErr redisError
+	if err != nil && !errors.As(err, &replyErr) {
+		conn.Close()
+		return nil, err
+	}
+	select {
+	case c.idle <- conn:
+	default:
+		conn.Close()
+	}
+	return reply, err
+}
+
+// conn returns an idle connection, or dials, authenticates and selects the
+// database on a new one
+func (c *redisCache) conn() (*redisConn, error) {
+	select {
+	case conn := <-c.idle:
+		return conn, nil
+	default:
+	}
+
+	dialer := &net.Dialer{Timeout: redisTimeout}
+	var netConn net.Conn
+	var err error
+	if c.useTLS {
+		host, _, _ := net.SplitHostPort(c.addr)
+		netConn, err = tls.DialWithDialer(dialer, "tcp", c.addr, &tls.Config{ServerName: host})
+	} else {
+		netConn, err = dialer.Dial("tcp", c.addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	conn := &redisConn{Conn: netConn, reader: bufio.NewReader(netConn)}
+	conn.SetDeadline(time.Now().Add(redisTimeout))
+
+	if c.password != "" {
+		auth := []string{"AUTH", c.password}
+		if c.username != "" {
+			auth = []string{"AUTH", c.username, c.password}
+		}
+		if _, err := conn.command(auth...); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if c.db != 0 {
+		if _, err := conn.command("SELECT", strconv.Itoa(c.db)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// command writes a command as an array of bulk strings and reads the reply
+func (conn *redisConn) command(args ...string) (any, error) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := io.WriteString(conn, b.String()); err != nil {
+		return nil, err
+	}
+	return conn.readReply()
+}
+
+// readReply reads a simple string, error, integer or bulk string reply
+func (conn *redisConn) readReply() (any, error) {
+	line, err := conn.reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, fmt.Errorf("redis: empty reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("redis: invalid bulk length %q", line[1:])
+		}
+		if size < 0 {
+			return nil, nil
+		}
+		value := make([]byte, size+2) // with the trailing \r\n
+		if _, err := io.ReadFull(conn.reader, value); err != nil {
+			return nil, err
+		}
+		return value[:size], nil
+	default:
+		return nil, fmt.Errorf("redis: unsupported reply %q", line)
+	}
+}
@@ -2,47 +2,49 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"image"
 	"io"
 	"log"
+	"math/rand/v2"
 	"mime/multipart"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 )
 
-var replicateAPIToken string
-
-func init() {
-	replicateAPIToken = os.Getenv("REPLICATE_API_TOKEN")
-	if replicateAPIToken == "" {
-		fmt.Println("Warning: REPLICATE_API_TOKEN not set - AI image editing will not work")
-	}
-}
-
 // ReplicatePredictionRequest represents the request to create a prediction
 type ReplicatePredictionRequest struct {
-	Input ReplicateInput `json:"input"`
+	Version string      `json:"version,omitempty"` // only for pinned model versions
+	Input   interface{} `json:"input"`
 }
 
 // ReplicateInput represents the input parameters for the model
 type ReplicateInput struct {
-	Prompt       string `json:"prompt"`
-	InputImage   string `json:"input_image"`
-	OutputFormat string `json:"output_format"`
+	Prompt       string  `json:"prompt"`
+	InputImage   string  `json:"input_image"`
+	OutputFormat string  `json:"output_format"`
+	Seed         int     `json:"seed,omitempty"`
+	Guidance     float64 `json:"guidance,omitempty"` // only sent to models that take it
 }
 
 // ReplicatePrediction represents a prediction response from Replicate
 type ReplicatePrediction struct {
-	ID     string                 `json:"id"`
-	Status string                 `json:"status"` // starting, processing, succeeded, failed, canceled
-	Input  map[string]interface{} `json:"input"`
-	Output interface{}            `json:"output"` // can be string URL or array of URLs
-	Error  string                 `json:"error,omitempty"`
-	Logs   string                 `json:"logs,omitempty"`
-	URLs   struct {
+	ID      string                 `json:"id"`
+	Status  string                 `json:"status"` // starting, processing, succeeded, failed, canceled
+	Input   map[string]interface{} `json:"input"`
+	Output  interface{}            `json:"output"` // can be string URL or array of URLs
+	Error   string                 `json:"error,omitempty"`
+	Logs    string                 `json:"logs,omitempty"`
+	Metrics map[string]interface{} `json:"metrics,omitempty"` // e.g. predict_time in seconds, once finished
+	URLs    struct {
 		Get    string `json:"get"`
 		Cancel string `json:"cancel"`
 	} `json:"urls"`
@@ -50,21 +52,58 @@ type ReplicatePrediction struct {
 
 // ReplicateFileUpload represents the file upload response
 type ReplicateFileUpload struct {
-	URLs struct {
+	ExpiresAt string `json:"expires_at"` // RFC 3339
+	URLs      struct {
 		Get string `json:"get"`
 	} `json:"urls"`
 }
 
-// uploadFileToReplicate uploads a local file to Replicate and returns the URL
-func uploadFileToReplicate(localPath string) (string, error) {
-	if replicateAPIToken == "" {
-		return "", fmt.Errorf("REPLICATE_API_TOKEN not set")
+const (
+	// defaultUploadLifetime is how long an uploaded file is assumed to be
+	// kept when Replicate doesn't say
+	defaultUploadLifetime = 24 * time.Hour
+	// uploadExpiryMargin is how much life an upload needs left to be reused,
+	// so it doesn't expire while a prediction waits to start
+	uploadExpiryMargin = time.Hour
+)
+
+// requestUploadURL returns the Replicate URL of a request's photo, reusing
+// the stored upload while it's valid so retries and revisions don't upload the
+// same photo again. Expired or missing uploads are replaced with a new one.
+func requestUploadURL(req *Request) (string, error) {
+	if req.UploadURL != "" {
+		expiresAt, err := time.Parse("2006-01-02 15:04:05", req.UploadExpiresAt)
+		if err == nil && time.Until(expiresAt) > uploadExpiryMargin {
+			return req.UploadURL, nil
+		}
+	}
+
+	log.Printf("Uploading image to Replicate for request %s", req.ID)
+	started := time.Now()
+	imageURL, expiresAt, err := uploadFileToReplicate(req.ImagePath)
+	trackStage(stageUpload, err)
+	if err != nil {
+		return "", err
+	}
+	recordStage(req.ID, "", stageUpload, started)
+	if err := updateRequestUploadURL(req.ID, imageURL, expiresAt); err != nil {
+		log.Printf("Failed to save upload URL for request %s: %v", req.ID, err)
+	}
+	return imageURL, nil
+}
+
+// uploadFileToReplicate uploads a local file to Replicate and returns its URL
+// and when Replicate will delete it
+func uploadFileToReplicate(localPath string) (string, time.Time, error) {
+	token := currentConfig().ReplicateAPIToken
+	if token == "" {
+		return "", time.Time{}, fmt.Errorf("REPLICATE_API_TOKEN not set")
 	}
 
 	// Open the file
 	file, err := os.Open(localPath)
 	if err != nil {
-		return "", fmt.Errorf("failed to open file: %w", err)
+		return "", time.Time{}, fmt.Errorf("failed to open file: %w", err)
 	}
 	defer file.Close()
 
@@ -76,11 +115,11 @@ func uploadFileToReplicate(localPath string) (string, error) {
 	filename := filepath.Base(localPath)
 	part, err := writer.CreateFormFile("content", filename)
 	if err != nil {
-		return "", fmt.Errorf("failed to create form file: %w", err)
+		return "", time.Time{}, fmt.Errorf("failed to create form file: %w", err)
 	}
 
 	if _, err = io.Copy(part, file); err != nil {
-		return "", fmt.Errorf("failed to copy file: %w", err)
+		return "", time.Time{}, fmt.Errorf("failed to copy file: %w", err)
 	}
 
 	writer.Close()
@@ -88,49 +127,70 @@ func uploadFileToReplicate(localPath string) (string, error) {
 	// Make request to Replicate files API
 	req, err := http.NewRequest("POST", "https://api.replicate.com/v1/files", &buf)
 	if err != nil {
-		return "", fmt.Errorf("failed to create request: %w", err)
+		return "", time.Time{}, fmt.Errorf("failed to create request: %w", err)
 	}
 
-	req.Header.Set("Authorization", "Bearer "+replicateAPIToken)
+	req.Header.Set("Authorization", "Bearer "+token)
 	req.Header.Set("Content-Type", writer.FormDataContentType())
 
-	client := &http.Client{Timeout: 60 * time.Second}
-	resp, err := client.Do(req)
+	resp, err := replicateClient.Do(req)
 	if err != nil {
-		return "", fmt.Errorf("file upload request failed: %w", err)
+		return "", time.Time{}, fmt.Errorf("file upload request failed: %w", err)
 	}
 	defer resp.Body.Close()
 
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return "", fmt.Errorf("failed to read upload response: %w", err)
+		return "", time.Time{}, fmt.Errorf("failed to read upload response: %w", err)
 	}
 
 	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("file upload failed: %s - %s", resp.Status, string(body))
+		return "", time.Time{}, providerError(providerReplicate, "file upload", resp, body, nil)
+	}
+
+	if err := validateResponse(uploadSchema, body, ErrModelFailed); err != nil {
+		return "", time.Time{}, err
 	}
 
 	var upload ReplicateFileUpload
 	if err := json.Unmarshal(body, &upload); err != nil {
-		return "", fmt.Errorf("failed to parse upload response: %w", err)
+		return "", time.Time{}, fmt.Errorf("failed to parse upload response: %w", err)
 	}
 
-	return upload.URLs.Get, nil
+	expiresAt, err := time.Parse(time.RFC3339, upload.ExpiresAt)
+	if err != nil {
+		expiresAt = time.Now().Add(defaultUploadLifetime)
+	}
+	return upload.URLs.Get, expiresAt, nil
+}
+
+// createImagePrediction creates a new image edit prediction with the given
+// model. A zero seed lets the model choose a random one. The intensity is
+// worded into the prompt and, for models that take one, sets the guidance scale.
+func createImagePrediction(model, prompt, imageURL string, seed int, intensity string) (*ReplicatePrediction, error) {
+	return createModelPrediction(model, ReplicateInput{
+		Prompt:       intensityPrompt(prompt, intensity),
+		InputImage:   imageURL,
+		OutputFormat: "jpg",
+		Seed:         seed,
+		Guidance:     intensityGuidance(model, intensity),
+	})
 }
 
-// createReplicatePrediction creates a new prediction on Replicate
-func createReplicatePrediction(prompt, imageURL string) (*ReplicatePrediction, error) {
-	if replicateAPIToken == "" {
+// createModelPrediction starts a prediction of any Replicate model. Models
+// given as owner/name run their latest version; owner/name:version pins one.
+func createModelPrediction(model string, input interface{}) (*ReplicatePrediction, error) {
+	token := currentConfig().ReplicateAPIToken
+	if token == "" {
 		return nil, fmt.Errorf("REPLICATE_API_TOKEN not set")
 	}
 
 	// Prepare request body
-	reqBody := ReplicatePredictionRequest{
-		Input: ReplicateInput{
-			Prompt:       prompt,
-			InputImage:   imageURL,
-			OutputFormat: "jpg",
-		},
+	apiURL := fmt.Sprintf("https://api.replicate.com/v1/models/%s/predictions", model)
+	reqBody := ReplicatePredictionRequest{Input: input}
+	if _, version, ok := strings.Cut(model, ":"); ok {
+		apiURL = "https://api.replicate.com/v1/predictions"
+		reqBody.Version = version
 	}
 
 	jsonData, err := json.Marshal(reqBody)
@@ -139,21 +199,18 @@ func createReplicatePrediction(prompt, imageURL string) (*ReplicatePrediction, e
 	}
 
 	// Create request
-	req, err := http.NewRequest(
-		"POST",
-		"https://api.replicate.com/v1/models/black-forest-labs/flux-kontext-pro/predictions",
-		bytes.NewBuffer(jsonData),
-	)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", apiURL, bytes.NewBuffer(jsonData))
 	if err != nil {
 		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
 
-	req.Header.Set("Authorization", "Bearer "+replicateAPIToken)
+	req.Header.Set("Authorization", "Bearer "+token)
 	req.Header.Set("Content-Type", "application/json")
 
 	// Make request
-	client := &http.Client{Timeout: 30 * time.Second}
-	resp, err := client.Do(req)
+	resp, err := replicateClient.Do(req)
 	if err != nil {
 		return nil, fmt.Errorf("prediction request failed: %w", err)
 	}
@@ -165,7 +222,11 @@ func createReplicatePrediction(prompt, imageURL string) (*ReplicatePrediction, e
 	}
 
 	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("prediction creation failed: %s - %s", resp.Status, string(body))
+		return nil, providerError(providerReplicate, "prediction creation", resp, body, ErrModelFailed)
+	}
+
+	if err := validateResponse(predictionSchema, body, ErrModelFailed); err != nil {
+		return nil, err
 	}
 
 	var prediction ReplicatePrediction
@@ -178,21 +239,23 @@ func createReplicatePrediction(prompt, imageURL string) (*ReplicatePrediction, e
 
 // getPredictionStatus checks the status of a prediction
 func getPredictionStatus(predictionID string) (*ReplicatePrediction, error) {
-	if replicateAPIToken == "" {
+	token := currentConfig().ReplicateAPIToken
+	if token == "" {
 		return nil, fmt.Errorf("REPLICATE_API_TOKEN not set")
 	}
 
 	url := fmt.Sprintf("https://api.replicate.com/v1/predictions/%s", predictionID)
 
-	req, err := http.NewRequest("GET", url, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
 
-	req.Header.Set("Authorization", "Bearer "+replicateAPIToken)
+	req.Header.Set("Authorization", "Bearer "+token)
 
-	client := &http.Client{Timeout: 10 * time.Second}
-	resp, err := client.Do(req)
+	resp, err := replicateClient.Do(req)
 	if err != nil {
 		return nil, fmt.Errorf("status check failed: %w", err)
 	}
@@ -204,7 +267,11 @@ func getPredictionStatus(predictionID string) (*ReplicatePrediction, error) {
 	}
 
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("status check failed: %s - %s", resp.Status, string(body))
+		return nil, providerError(providerReplicate, "status check", resp, body, nil)
+	}
+
+	if err := validateResponse(predictionSchema, body, ErrModelFailed); err != nil {
+		return nil, err
 	}
 
 	var prediction ReplicatePrediction
@@ -215,144 +282,358 @@ func getPredictionStatus(predictionID string) (*ReplicatePrediction, error) {
 	return &prediction, nil
 }
 
-// downloadImage downloads an image from a URL and saves it locally
-func downloadImage(imageURL, savePath string) error {
-	resp, err := http.Get(imageURL)
+// cancelPrediction stops a running prediction so it's no longer billed
+func cancelPrediction(predictionID string) error {
+	token := currentConfig().ReplicateAPIToken
+	if token == "" {
+		return fmt.Errorf("REPLICATE_API_TOKEN not set")
+	}
+
+	url := fmt.Sprintf("https://api.replicate.com/v1/predictions/%s/cancel", predictionID)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", url, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := replicateClient.Do(req)
 	if err != nil {
-		return fmt.Errorf("failed to download image: %w", err)
+		return fmt.Errorf("cancel request failed: %w", err)
 	}
 	defer resp.Body.Close()
 
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read response: %w", err)
+	}
+
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("download failed with status: %s", resp.Status)
+		return providerError(providerReplicate, "prediction cancel", resp, body, nil)
+	}
+	return nil
+}
+
+// awaitPrediction polls a prediction until it succeeds, fails or is
+// canceled: every interval for the first POLL_BACKOFF_AFTER, then less and
+// less often (see nextPollWait). A prediction still running after timeout is
+// canceled rather than left running (and billing) in the background.
+func awaitPrediction(predictionID string, interval, timeout time.Duration) (*ReplicatePrediction, error) {
+	started := time.Now()
+	deadline := started.Add(timeout)
+	next := interval
+	for {
+		next = nextPollWait(next, interval, time.Since(started))
+		// Jitter keeps predictions started together from polling together
+		wait := min(time.Duration(float64(next)*(0.8+0.4*rand.Float64())), time.Until(deadline))
+		if wait <= 0 {
+			break
+		}
+		time.Sleep(wait)
+
+		status, err := getPredictionStatus(predictionID)
+		if err != nil {
+			log.Printf("Failed to check status for prediction %s: %v", predictionID, err)
+			continue
+		}
+
+		switch status.Status {
+		case "succeeded", "failed", "canceled":
+			return status, nil
+		}
 	}
 
-	// Ensure directory exists
-	dir := filepath.Dir(savePath)
-	if err := os.MkdirAll(dir, 0755); err != nil {
-		return fmt.Errorf("failed to create directory: %w", err)
+	if err := cancelPrediction(predictionID); err != nil {
+		log.Printf("Failed to cancel timed out prediction %s: %v", predictionID, err)
 	}
+	return nil, fmt.Errorf("%w: prediction timed out after %s", ErrModelFailed, timeout)
+}
+
+// nextPollWait is how long to wait before polling a prediction again, given
+// the last wait and how long it has been polled for. Fast models finish
+// within POLL_BACKOFF_AFTER and are polled every interval; after that each
+// wait is half again as long as the last, up to POLL_MAX_INTERVAL, so long
+// running models cost fewer calls.
+func nextPollWait(last, interval, elapsed time.Duration) time.Duration {
+	cfg := currentConfig()
+	if elapsed < cfg.PollBackoffAfter {
+		return interval
+	}
+	return max(interval, min(last*3/2, cfg.PollMaxInterval))
+}
+
+// parseModelTimeouts parses MODEL_TIMEOUTS, a comma separated list of
+// owner/name[:version]=duration entries overriding PROCESSING_TIMEOUT
+func parseModelTimeouts(raw string) map[string]time.Duration {
+	timeouts := make(map[string]time.Duration)
+	for _, entry := range strings.Split(raw, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		model, value, _ := strings.Cut(entry, "=")
+		timeout, err := time.ParseDuration(strings.TrimSpace(value))
+		if err != nil || timeout <= 0 {
+			log.Printf("Warning: ignoring %q in MODEL_TIMEOUTS, expected owner/name=duration", entry)
+			continue
+		}
+		timeouts[strings.TrimSpace(model)] = timeout
+	}
+	return timeouts
+}
+
+// predictionTimeout is how long a prediction of model may run. A timeout set
+// for owner/name applies to all of its versions.
+func predictionTimeout(model string) time.Duration {
+	cfg := currentConfig()
+	if timeout, ok := cfg.ModelTimeouts[model]; ok {
+		return timeout
+	}
+	name, _, _ := strings.Cut(model, ":")
+	if timeout, ok := cfg.ModelTimeouts[name]; ok {
+		return timeout
+	}
+	return cfg.ProcessingTimeout
+}
 
-	// Create file
-	file, err := os.Create(savePath)
+// predictionOutputURL extracts the result URL from a prediction's output,
+// which is either a URL or a list of them
+func predictionOutputURL(output interface{}) string {
+	switch v := output.(type) {
+	case string:
+		return v
+	case []interface{}:
+		if len(v) > 0 {
+			if url, ok := v[0].(string); ok {
+				return url
+			}
+		}
+	}
+	return ""
+}
+
+// downloadAttempts is how many times a result is downloaded before giving up
+const downloadAttempts = 3
+
+// errRetryableDownload marks download failures that may not happen again
+var errRetryableDownload = errors.New("retryable download failure")
+
+// downloadImage downloads a result image, retrying failed and broken
+// downloads. Only a verified image is returned.
+func downloadImage(imageURL string) ([]byte, error) {
+	var data []byte
+	var err error
+	for attempt := 1; attempt <= downloadAttempts; attempt++ {
+		if attempt > 1 {
+			time.Sleep(time.Duration(attempt-1) * 2 * time.Second)
+		}
+		data, err = downloadImageOnce(imageURL)
+		if err == nil || !errors.Is(err, errRetryableDownload) {
+			break
+		}
+		log.Printf("Download %d of %d of %s failed: %v", attempt, downloadAttempts, imageURL, err)
+	}
+	return data, err
+}
+
+// downloadImageOnce downloads an image and checks it: the response must be
+// an image, as long as it said, match its MD5 checksum if it sent one, and
+// decode in full, which a truncated image doesn't.
+func downloadImageOnce(imageURL string) ([]byte, error) {
+	resp, err := replicateClient.Get(imageURL)
 	if err != nil {
-		return fmt.Errorf("failed to create file: %w", err)
+		return nil, fmt.Errorf("failed to download image: %w: %w", err, errRetryableDownload)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		err := fmt.Errorf("download failed with status: %s", resp.Status)
+		if resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusRequestTimeout {
+			err = fmt.Errorf("%w: %w", err, errRetryableDownload)
+		}
+		return nil, err
+	}
+	contentType := resp.Header.Get("Content-Type")
+	if contentType != "" && !strings.HasPrefix(contentType, "image/") && !strings.HasPrefix(contentType, "application/octet-stream") {
+		return nil, fmt.Errorf("download is %s, not an image", contentType)
 	}
-	defer file.Close()
 
-	// Copy data
-	if _, err := io.Copy(file, resp.Body); err != nil {
-		return fmt.Errorf("failed to save image: %w", err)
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read image: %w: %w", err, errRetryableDownload)
 	}
 
+	switch {
+	case len(data) == 0:
+		return nil, fmt.Errorf("downloaded image is empty: %w", errRetryableDownload)
+	case resp.ContentLength >= 0 && int64(len(data)) != resp.ContentLength:
+		return nil, fmt.Errorf("downloaded %d of %d bytes: %w", len(data), resp.ContentLength, errRetryableDownload)
+	}
+	if want := responseMD5(resp.Header); want != nil {
+		if sum := md5.Sum(data); !bytes.Equal(want, sum[:]) {
+			return nil, fmt.Errorf("downloaded image doesn't match its checksum: %w", errRetryableDownload)
+		}
+	}
+	if _, _, err := image.Decode(bytes.NewReader(data)); err != nil {
+		return nil, fmt.Errorf("downloaded image is broken: %w: %w", err, errRetryableDownload)
+	}
+
+	return data, nil
+}
+
+// responseMD5 returns the MD5 checksum a response declared for its body, in
+// Content-MD5 or, from Google Cloud Storage, X-Goog-Hash. nil if it has none.
+func responseMD5(header http.Header) []byte {
+	values := []string{header.Get("Content-MD5")}
+	for _, hashes := range header.Values("X-Goog-Hash") {
+		for _, hash := range strings.Split(hashes, ",") {
+			if value, ok := strings.CutPrefix(strings.TrimSpace(hash), "md5="); ok {
+				values = append(values, value)
+			}
+		}
+	}
+	for _, value := range values {
+		if sum, err := base64.StdEncoding.DecodeString(value); err == nil && len(sum) == md5.Size {
+			return sum
+		}
+	}
 	return nil
 }
 
-// processImageWithReplicate handles the full image processing workflow
-func processImageWithReplicate(requestID string) {
-	log.Printf("Starting Replicate processing for request %s", requestID)
+// processImageWithReplicate handles the full image processing workflow for
+// one revision of a request
+func processImageWithReplicate(rev *Revision) {
+	requestID := rev.RequestID
+	log.Printf("Starting Replicate processing for request %s (revision %s)", requestID, rev.ID)
 
 	// Get request details
 	req, err := getRequest(requestID)
 	if err != nil {
 		log.Printf("Failed to get request %s: %v", requestID, err)
-		updateRequestError(requestID, "Failed to retrieve request details")
+		finishRevision(rev, "error", fmt.Errorf("failed to retrieve request details: %w", err))
 		return
 	}
 
-	// Upload original image to Replicate
-	log.Printf("Uploading image to Replicate for request %s", requestID)
-	imageURL, err := uploadFileToReplicate(req.ImagePath)
+	// The photo is normally uploaded while the weather is fetched, and reused
+	// by later revisions until the upload expires
+	imageURL, err := requestUploadURL(req)
 	if err != nil {
 		log.Printf("Failed to upload image for request %s: %v", requestID, err)
-		updateRequestError(requestID, fmt.Sprintf("Failed to upload image: %v", err))
+		finishRevision(rev, "error", fmt.Errorf("failed to upload image: %w", err))
 		return
 	}
 
-	log.Printf("Image uploaded successfully: %s", imageURL)
-
 	// Create prediction
 	log.Printf("Creating prediction for request %s with prompt", requestID)
-	prediction, err := createReplicatePrediction(req.AIPrompt, imageURL)
+	// Use the model the revision was queued with, even if REPLICATE_MODEL has
+	// been reloaded since
+	prediction, err := createImagePrediction(rev.Model, rev.Prompt, imageURL, rev.Seed, rev.Intensity)
 	if err != nil {
 		log.Printf("Failed to create prediction for request %s: %v", requestID, err)
-		updateRequestError(requestID, fmt.Sprintf("Failed to create prediction: %v", err))
+		trackStage(stagePredict, err)
+		finishRevision(rev, "error", fmt.Errorf("failed to create prediction: %w", err))
 		return
 	}
 
 	log.Printf("Prediction created: %s (status: %s)", prediction.ID, prediction.Status)
 
 	// Save prediction ID
-	if err := updateRequestPredictionID(requestID, prediction.ID); err != nil {
+	if err := updateRevisionPredictionID(rev, prediction.ID); err != nil {
 		log.Printf("Failed to save prediction ID for request %s: %v", requestID, err)
 	}
 
-	// Poll for completion
-	maxAttempts := 120 // 10 minutes (5 seconds * 120)
-	for i := 0; i < maxAttempts; i++ {
-		time.Sleep(5 * time.Second)
+	awaitRevision(rev)
+}
 
-		status, err := getPredictionStatus(prediction.ID)
-		if err != nil {
-			log.Printf("Failed to check status for prediction %s: %v", prediction.ID, err)
-			continue
-		}
+// awaitRevision waits for a revision's prediction to finish and stores the
+// result, or the failure, on the revision
+func awaitRevision(rev *Revision) {
+	requestID := rev.RequestID
+	// A prediction resumed after a restart is only timed from the restart
+	started := time.Now()
+	status, err := awaitPrediction(rev.PredictionID, currentConfig().PollInterval, predictionTimeout(rev.Model))
+	recordStage(requestID, rev.ID, stagePredict, started)
+	if err != nil {
+		log.Printf("Prediction timeout for request %s: %v", requestID, err)
+		trackStage(stagePredict, err)
+		finishRevision(rev, "error", err)
+		return
+	}
 
-		log.Printf("Prediction %s status: %s", prediction.ID, status.Status)
+	log.Printf("Prediction %s status: %s", rev.PredictionID, status.Status)
 
-		switch status.Status {
-		case "succeeded":
-			// Extract output URL
-			var outputURL string
-			switch v := status.Output.(type) {
-			case string:
-				outputURL = v
-			case []interface{}:
-				if len(v) > 0 {
-					outputURL = v[0].(string)
-				}
-			}
+	switch status.Status {
+	case "succeeded":
+		trackStage(stagePredict, nil)
+		outputURL := predictionOutputURL(status.Output)
+		if outputURL == "" {
+			finishRevision(rev, "error", fmt.Errorf("%w: no output URL in prediction result", ErrModelFailed))
+			return
+		}
 
-			if outputURL == "" {
-				updateRequestError(requestID, "No output URL in prediction result")
-				return
-			}
+		log.Printf("Prediction succeeded, downloading result: %s", outputURL)
 
-			log.Printf("Prediction succeeded, downloading result: %s", outputURL)
+		// Download result image
+		started = time.Now()
+		result, err := downloadImage(outputURL)
+		trackStage(stageDownload, err)
+		if err != nil {
+			log.Printf("Failed to download result for request %s: %v", requestID, err)
+			finishRevision(rev, "error", fmt.Errorf("failed to download result: %w", err))
+			return
+		}
+		recordStage(requestID, rev.ID, stageDownload, started)
 
-			// Download result image
-			resultPath := filepath.Join("./data", "results", requestID+".jpg")
-			if err := downloadImage(outputURL, resultPath); err != nil {
-				log.Printf("Failed to download result for request %s: %v", requestID, err)
-				updateRequestError(requestID, fmt.Sprintf("Failed to download result: %v", err))
+		// Trial results are kept small so the trial is a taste, not a product
+		if isTrialRequest(requestID) {
+			if result, err = downscaleImage(result, currentConfig().TrialMaxDimension); err != nil {
+				log.Printf("Failed to downscale trial result for request %s: %v", requestID, err)
+				finishRevision(rev, "error", fmt.Errorf("failed to downscale result: %w", err))
 				return
 			}
+		}
 
-			// Update request as completed
-			if err := updateRequestResult(requestID, resultPath); err != nil {
-				log.Printf("Failed to update result for request %s: %v", requestID, err)
-			}
-
-			log.Printf("Request %s completed successfully", requestID)
+		resultPath, err := storeBlob(result, ".jpg")
+		if err != nil {
+			log.Printf("Failed to store result for request %s: %v", requestID, err)
+			finishRevision(rev, "error", fmt.Errorf("failed to store result: %w", err))
 			return
+		}
 
-		case "failed":
-			errMsg := "Prediction failed"
-			if status.Error != "" {
-				errMsg = status.Error
-			}
-			log.Printf("Prediction failed for request %s: %s", requestID, errMsg)
-			updateRequestError(requestID, errMsg)
+		// Update revision as completed and show it on the request
+		if err := completeRevision(rev, resultPath); err != nil {
+			log.Printf("Failed to update result for request %s: %v", requestID, err)
 			return
+		}
+		scoreRevision(rev)
+		checkFaces(rev, outputURL)
+		addPostcard(rev, result)
+
+		log.Printf("Request %s completed successfully", requestID)
+		trackRequestEvent(eventGenerationSucceeded, requestID, map[string]interface{}{
+			"revision_id": rev.ID, "kind": rev.Kind, "model": rev.Model,
+		})
+		started = time.Now()
+		if publishRevision(rev) {
+			recordStage(requestID, rev.ID, stagePublish, started)
+		}
+		notifyRevisionCompleted(rev)
+		autoRetryRevision(rev)
 
-		case "canceled":
-			log.Printf("Prediction canceled for request %s", requestID)
-			updateRequestStatus(requestID, "cancelled")
-			return
+	case "failed":
+		errMsg := "Prediction failed"
+		if status.Error != "" {
+			errMsg = status.Error
 		}
-	}
+		log.Printf("Prediction failed for request %s: %s", requestID, errMsg)
+		trackStage(stagePredict, ErrModelFailed)
+		finishRevision(rev, "error", fmt.Errorf("%w: %s", ErrModelFailed, errMsg))
 
-	// Timeout
-	log.Printf("Prediction timeout for request %s", requestID)
-	updateRequestError(requestID, "Image processing timeout")
+	case "canceled":
+		log.Printf("Prediction canceled for request %s", requestID)
+		finishRevision(rev, "cancelled", nil)
+	}
 }
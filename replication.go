@@ -0,0 +1,124 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// Database replication modes selectable with DB_REPLICATION
+const (
+	replicationNone       = ""
+	replicationLitestream = "litestream"
+	replicationS3         = "s3"
+)
+
+// replicationMode is how the database is kept safe from losing the instance
+// it lives on. It's read once at startup.
+var replicationMode = replicationNone
+
+// snapshotBucket and snapshotKey are where S3 snapshots are stored
+var (
+	snapshotBucket *S3Bucket
+	snapshotKey    string
+)
+
+// setupReplication reads the replication settings, taking the snapshot
+// bucket and its credentials from the configuration. In s3 mode it restores
+// the latest snapshot when the database is missing, as on a freshly replaced
+// container, so it must run before initDB.
+func setupReplication() error {
+	replicationMode = os.Getenv("DB_REPLICATION")
+	switch replicationMode {
+	case replicationNone:
+		return nil
+	case replicationLitestream:
+		// Litestream replicates the WAL itself; openDB switches to WAL mode
+		log.Println("Database configured for Litestream replication")
+		return nil
+	case replicationS3:
+	default:
+		return fmt.Errorf("DB_REPLICATION must be %s or %s, got %q", replicationLitestream, replicationS3, replicationMode)
+	}
+
+	cfg := currentConfig()
+	if cfg.SnapshotS3Bucket == "" {
+		return fmt.Errorf("DB_REPLICATION=s3 requires SNAPSHOT_S3_BUCKET")
+	}
+	var err error
+	if snapshotBucket, err = newS3Bucket(cfg.SnapshotS3Bucket, cfg.S3Endpoint, cfg.AWS); err != nil {
+		return err
+	}
+	snapshotKey = envOrDefault("SNAPSHOT_S3_KEY", "skyweave/skyweave.db")
+
+	if _, err := os.Stat(dbPath()); err == nil {
+		return nil
+	}
+	if err := os.MkdirAll(dataDir, 0755); err != nil {
+		return err
+	}
+	err = snapshotBucket.GetFile(snapshotKey, dbPath())
+	if errors.Is(err, errS3NotFound) {
+		log.Printf("No database snapshot at %s, starting with an empty database", snapshotKey)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to restore database snapshot: %w", err)
+	}
+	log.Printf("Restored database from snapshot %s", snapshotKey)
+	return nil
+}
+
+// snapshotDatabase uploads a consistent copy of the database to S3.
+// VACUUM INTO writes the copy in one transaction, so requests keep being
+// served while it's taken.
+func snapshotDatabase() error {
+	tmp := filepath.Join(dataDir, fmt.Sprintf(".snapshot-%d.db", time.Now().UnixNano()))
+	defer os.Remove(tmp)
+
+	if _, err := dbExec(`VACUUM INTO ?`, tmp); err != nil {
+		return fmt.Errorf("failed to copy database: %w", err)
+	}
+	return snapshotBucket.PutFile(snapshotKey, tmp, "application/vnd.sqlite3")
+}
+
+// startSnapshots uploads a database snapshot every SNAPSHOT_INTERVAL in s3
+// mode, and a last one when the process is asked to stop, so a replaced
+// instance loses at most the writes since the last snapshot
+func startSnapshots() {
+	if replicationMode != replicationS3 {
+		return
+	}
+
+	interval, err := time.ParseDuration(envOrDefault("SNAPSHOT_INTERVAL", "5m"))
+	if err != nil || interval < time.Minute {
+		log.Printf("Warning: invalid SNAPSHOT_INTERVAL, using 5m")
+		interval = 5 * time.Minute
+	}
+
+	ticker := time.NewTicker(interval)
+	goSafe("", func() {
+		for range ticker.C {
+			if err := snapshotDatabase(); err != nil {
+				log.Printf("Failed to snapshot database: %v", err)
+			}
+		}
+	})
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	goSafe("", func() {
+		<-signals
+		log.Println("Shutting down, taking a final database snapshot")
+		ticker.Stop()
+		if err := snapshotDatabase(); err != nil {
+			log.Printf("Failed to snapshot database: %v", err)
+		}
+		os.Exit(0)
+	})
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"runtime/debug"
+	"strings"
+	"time"
+)
+
+// sentryEvent is the minimal event payload accepted by Sentry's store endpoint
+type sentryEvent struct {
+	EventID   string                 `json:"event_id"`
+	Timestamp string                 `json:"timestamp"`
+	Level     string                 `json:"level"`
+	Platform  string                 `json:"platform"`
+	Logger    string                 `json:"logger"`
+	Message   string                 `json:"message"`
+	Extra     map[string]interface{} `json:"extra,omitempty"`
+}
+
+// reportError sends an error to Sentry if SENTRY_DSN is configured.
+// Reporting happens in the background and never blocks the caller.
+func reportError(message string, extra map[string]interface{}) {
+	if currentConfig().SentryDSN == "" {
+		return
+	}
+
+	go func() {
+		if err := sendSentryEvent(message, extra); err != nil {
+			log.Printf("Failed to report error to Sentry: %v", err)
+		}
+	}()
+}
+
+// sendSentryEvent posts an event to the Sentry store API described by the DSN
+// (https://<key>@<host>/<project_id>)
+func sendSentryEvent(message string, extra map[string]interface{}) error {
+	dsn, err := url.Parse(currentConfig().SentryDSN)
+	if err != nil || dsn.User == nil {
+		return fmt.Errorf("invalid SENTRY_DSN")
+	}
+	projectID := strings.Trim(dsn.Path, "/")
+	storeURL := fmt.Sprintf("%s://%s/api/%s/store/", dsn.Scheme, dsn.Host, projectID)
+
+	eventID, err := generateID(16)
+	if err != nil {
+		return err
+	}
+
+	event := sentryEvent{
+		EventID:   eventID,
+		Timestamp: time.Now().UTC().Format(time.RFC3339),
+		Level:     "error",
+		Platform:  "go",
+		Logger:    "skyweave",
+		Message:   message,
+		Extra:     extra,
+	}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", storeURL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Sentry-Auth", fmt.Sprintf(
+		"Sentry sentry_version=7, sentry_client=skyweave/1.0, sentry_key=%s", dsn.User.Username()))
+
+	resp, err := sentryClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("sentry responded with %s", resp.Status)
+	}
+	return nil
+}
+
+// recoverPanics middleware converts handler panics into a 500 page, logging
+// the stack trace tagged with a per-request ID
+func recoverPanics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID, err := generateID(8)
+		if err != nil {
+			requestID = "unknown"
+		}
+		w.Header().Set("X-Request-ID", requestID)
+
+		defer func() {
+			if rec := recover(); rec != nil {
+				if rec == http.ErrAbortHandler {
+					panic(rec)
+				}
+				stack := string(debug.Stack())
+				log.Printf("Panic serving %s %s for %s (request %s): %v\n%s",
+					r.Method, r.URL.Path, clientIP(r), requestID, rec, stack)
+				reportError(fmt.Sprintf("panic: %v", rec), map[string]interface{}{
+					"request_id": requestID,
+					"method":     r.Method,
+					"path":       r.URL.Path,
+					"client_ip":  clientIP(r),
+					"stack":      stack,
+				})
+
+				w.WriteHeader(http.StatusInternalServerError)
+				templates.ExecuteTemplate(w, "500.html", struct{ RequestID string }{RequestID: requestID})
+			}
+		}()
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// goSafe runs fn in a goroutine, recovering and reporting any panic. If the
+// goroutine works on a request, requestID marks it as errored so it doesn't
+// stay stuck in a processing state.
+func goSafe(requestID string, fn func()) {
+	go runSafe(requestID, fn)
+}
+
+// runSafe runs fn, recovering and reporting any panic like goSafe
+func runSafe(requestID string, fn func()) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			stack := string(debug.Stack())
+			log.Printf("Panic in background task for request %s: %v\n%s", requestID, rec, stack)
+			reportError(fmt.Sprintf("panic: %v", rec), map[string]interface{}{
+				"request_id": requestID,
+				"stack":      stack,
+			})
+			if requestID != "" {
+				updateRequestError(requestID, fmt.Errorf("background task panicked: %v", rec))
+			}
+		}
+	}()
+
+	fn()
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"time"
+)
+
+// Report frequencies admins can subscribe to
+const (
+	reportDaily  = "daily"
+	reportWeekly = "weekly"
+)
+
+// UsageReport is the data rendered into the usage report email
+type UsageReport struct {
+	Frequency     string
+	From          time.Time
+	To            time.Time
+	Stats         *UsageStats
+	SuccessRate   string
+	AvgProcessing string
+	Spend         string
+}
+
+// reportPeriod returns the most recent complete reporting period before now.
+// Periods end at midnight UTC, weekly ones on Mondays.
+func reportPeriod(frequency string, now time.Time) (from, to time.Time) {
+	now = now.UTC()
+	to = time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	if frequency == reportWeekly {
+		to = to.AddDate(0, 0, -((int(to.Weekday()) + 6) % 7))
+		return to.AddDate(0, 0, -7), to
+	}
+	return to.AddDate(0, 0, -1), to
+}
+
+// buildUsageReport gathers the usage report for a period
+func buildUsageReport(frequency string, from, to time.Time) (*UsageReport, error) {
+	stats, err := getUsageStats(from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &UsageReport{
+		Frequency:     frequency,
+		From:          from,
+		To:            to,
+		Stats:         stats,
+		SuccessRate:   "-",
+		AvgProcessing: "-",
+		Spend:         fmt.Sprintf("$%.2f", float64(stats.Predictions)*currentConfig().PredictionCost),
+	}
+	if finished := stats.Completed + stats.Failed; finished > 0 {
+		report.SuccessRate = fmt.Sprintf("%.0f%%", float64(stats.Completed)/float64(finished)*100)
+	}
+	if stats.AvgProcessingSeconds > 0 {
+		report.AvgProcessing = (time.Duration(stats.AvgProcessingSeconds) * time.Second).String()
+	}
+	return report, nil
+}
+
+// renderUsageReport renders a usage report as the HTML email body
+func renderUsageReport(report *UsageReport) (string, error) {
+	var body bytes.Buffer
+	if err := templates.ExecuteTemplate(&body, "report_email.html", report); err != nil {
+		return "", err
+	}
+	return body.String(), nil
+}
+
+// sendDueReports emails every subscription whose last report predates the
+// end of its most recent period
+func sendDueReports(now time.Time) {
+	subscriptions, err := getReportSubscriptions()
+	if err != nil {
+		log.Printf("Failed to load report subscriptions: %v", err)
+		return
+	}
+
+	for _, sub := range subscriptions {
+		from, to := reportPeriod(sub.Frequency, now)
+		if sub.LastSentAt >= sqliteTime(to) {
+			continue
+		}
+
+		report, err := buildUsageReport(sub.Frequency, from, to)
+		if err != nil {
+			log.Printf("Failed to build %s usage report: %v", sub.Frequency, err)
+			return
+		}
+		body, err := renderUsageReport(report)
+		if err != nil {
+			log.Printf("Failed to render %s usage report: %v", sub.Frequency, err)
+			return
+		}
+
+		subject := fmt.Sprintf("SkyWeave %s report for %s", sub.Frequency, from.Format("2006-01-02"))
+		if err := sendEmail([]string{sub.Email}, subject, body); err != nil {
+			log.Printf("Failed to send %s usage report to %s: %v", sub.Frequency, sub.Email, err)
+			continue
+		}
+		if err := markReportSent(sub.Email, now); err != nil {
+			log.Printf("Failed to record report sent to %s: %v", sub.Email, err)
+		}
+		log.Printf("Sent %s usage report to %s", sub.Frequency, sub.Email)
+	}
+}
+
+// startReportScheduler checks hourly for usage reports that are due. It does
+// nothing unless SMTP is configured.
+func startReportScheduler() {
+	if !emailConfigured() {
+		return
+	}
+
+	ticker := time.NewTicker(1 * time.Hour)
+	goSafe("", func() {
+		sendDueReports(time.Now())
+		for now := range ticker.C {
+			sendDueReports(now)
+		}
+	})
+}
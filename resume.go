@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// interruptedStatuses are the request statuses that only a background
+// goroutine moves on from, so a request found in one whose instance is gone
+// is stranded
+var interruptedStatuses = []string{"reviewing", "pending", "geocoding", "weather_fetching"}
+
+// recoveryInterval is how often instances look for work left by instances
+// that stopped
+const recoveryInterval = time.Minute
+
+// startWorkRecovery takes over the work of stopped instances at startup and
+// every recoveryInterval after, so a crashed instance's predictions are
+// still finished by the others
+func startWorkRecovery() {
+	resumeInterruptedWork()
+	ticker := time.NewTicker(recoveryInterval)
+	goSafe("", func() {
+		for range ticker.C {
+			resumeInterruptedWork()
+		}
+	})
+}
+
+// resumeInterruptedWork picks up what stopped instances, including this
+// process's previous run, left unfinished. Revisions whose prediction was
+// already created on Replicate are polled again, since the prediction keeps
+// running without us. Work that existed only in an instance's memory, like
+// queued jobs and weather lookups, is lost and marked as interrupted so users
+// are told to resubmit instead of waiting forever. Each piece of work is
+// claimed in the database first, so only one instance takes it over.
+func resumeInterruptedWork() {
+	revisions, err := getProcessingRevisions()
+	if err != nil {
+		log.Printf("Failed to load unfinished revisions: %v", err)
+	}
+	resumed, lost := 0, 0
+	for _, rev := range revisions {
+		if instanceAlive(rev.ClaimedBy) {
+			continue
+		}
+		claimed, err := claimRevision(rev.ID, rev.ClaimedBy, instanceID)
+		if err != nil {
+			log.Printf("Failed to claim revision %s: %v", rev.ID, err)
+			continue
+		}
+		if !claimed {
+			continue
+		}
+
+		if rev.PredictionID == "" {
+			lost++
+			failure := fmt.Errorf("%w: revision %s was waiting to be generated", ErrInterrupted, rev.ID)
+			if err := finishRevision(rev, "error", failure); err != nil {
+				log.Printf("Failed to mark revision %s as interrupted: %v", rev.ID, err)
+			}
+			continue
+		}
+
+		resumed++
+		// The prediction gets the full timeout again, counted from now
+		goSafe(rev.RequestID, func() { awaitRevision(rev) })
+	}
+
+	requests, err := getRequestClaimsWithStatus(interruptedStatuses...)
+	if err != nil {
+		log.Printf("Failed to load interrupted requests: %v", err)
+	}
+	for _, claim := range requests {
+		if instanceAlive(claim.ClaimedBy) {
+			continue
+		}
+		// A photo waiting for review can still be reviewed on any instance
+		if awaitingPhotoReview(claim.ID) {
+			continue
+		}
+		claimed, err := claimRequest(claim.ID, claim.ClaimedBy, instanceID)
+		if err != nil {
+			log.Printf("Failed to claim request %s: %v", claim.ID, err)
+			continue
+		}
+		if !claimed {
+			continue
+		}
+
+		lost++
+		failure := fmt.Errorf("%w: the weather lookup didn't finish", ErrInterrupted)
+		if err := updateRequestError(claim.ID, failure); err != nil {
+			log.Printf("Failed to mark request %s as interrupted: %v", claim.ID, err)
+		}
+	}
+
+	if resumed > 0 || lost > 0 {
+		log.Printf("Resumed %d predictions of stopped instances, marked %d interrupted requests as failed", resumed, lost)
+	}
+}
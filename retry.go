@@ -0,0 +1,186 @@
+package main
+
+import (
+	"log"
+	"math/rand/v2"
+	"strings"
+)
+
+const (
+	// lowRatingThreshold is the highest star rating that offers a retry
+	lowRatingThreshold = 2
+
+	// maxPromptLength caps prompts edited by users
+	maxPromptLength = 2000
+)
+
+// retryAspect is an aspect of a result users can flag as wrong when retrying
+type retryAspect struct {
+	Key      string
+	Label    string
+	Emphasis string
+}
+
+// retryAspects are the choices offered in the retry survey, with the prompt
+// sentence that is added to emphasize each one
+var retryAspects = []retryAspect{
+	{
+		Key:      "weather",
+		Label:    "Weather doesn't match",
+		Emphasis: "It is essential that the weather conditions described above are clearly and unmistakably visible.",
+	},
+	{
+		Key:      "sky",
+		Label:    "Sky looks wrong",
+		Emphasis: "Pay particular attention to the sky: its clouds and colour must match the described conditions.",
+	},
+	{
+		Key:      "lighting",
+		Label:    "Lighting looks wrong",
+		Emphasis: "Make the lighting, shadows and overall brightness consistent with the described weather and time of day.",
+	},
+	{
+		Key:      "composition",
+		Label:    "Photo was changed too much",
+		Emphasis: "Do not alter, move or remove any buildings, people, objects or the camera framing of the original photo.",
+	},
+	{
+		Key:      "faces",
+		Label:    "Faces look different",
+		Emphasis: "Keep every person's face, features and expression exactly as in the original photo; only the weather and light around them may change.",
+	},
+	{
+		Key:      "realism",
+		Label:    "Doesn't look realistic",
+		Emphasis: "The result must be indistinguishable from a real, unedited photograph with no painterly or artificial look.",
+	},
+}
+
+// findRetryAspect looks up a retry aspect by key
+func findRetryAspect(key string) (retryAspect, bool) {
+	for _, aspect := range retryAspects {
+		if aspect.Key == key {
+			return aspect, true
+		}
+	}
+	return retryAspect{}, false
+}
+
+// emphasizePrompt appends the emphasis sentences for the flagged aspects to a
+// prompt. Without any flagged aspect the prompt is returned unchanged and only
+// the seed differs on retry.
+func emphasizePrompt(prompt string, aspects []retryAspect) string {
+	if len(aspects) == 0 {
+		return prompt
+	}
+
+	var b strings.Builder
+	b.WriteString(prompt)
+	for _, aspect := range aspects {
+		b.WriteString(" ")
+		b.WriteString(aspect.Emphasis)
+	}
+	return b.String()
+}
+
+// perturbSeed picks a new model seed that differs from the previous one
+func perturbSeed(previous int) int {
+	for {
+		seed := 1 + rand.IntN(1<<31-1)
+		if seed != previous {
+			return seed
+		}
+	}
+}
+
+// Flags shown on results whose difference score is outside the expected range
+const (
+	diffFlagUnchanged   = "Barely changed"
+	diffFlagOverchanged = "Changed a lot"
+)
+
+// faceFlagAltered is shown on results whose face score is too high
+const faceFlagAltered = "Faces altered"
+
+// FaceFlag returns a warning when the faces in the result were noticeably
+// altered, or "" when they weren't or weren't checked
+func (rev *Revision) FaceFlag() string {
+	if rev.FaceScore > currentConfig().FaceDiffMax {
+		return faceFlagAltered
+	}
+	return ""
+}
+
+// DiffFlag returns a warning when the result barely differs from the original
+// or differs far more than a weather change should, or "" when it looks
+// reasonable or wasn't scored
+func (rev *Revision) DiffFlag() string {
+	cfg := currentConfig()
+	switch {
+	case rev.DiffScore < 0:
+		return ""
+	case rev.DiffScore < cfg.ResultDiffMin:
+		return diffFlagUnchanged
+	case rev.DiffScore > cfg.ResultDiffMax:
+		return diffFlagOverchanged
+	}
+	return ""
+}
+
+// scoreRevision compares a completed revision's result with the uploaded
+// original and stores the difference score. Failures only leave it unscored.
+func scoreRevision(rev *Revision) {
+	req, err := getRequest(rev.RequestID)
+	if err != nil {
+		log.Printf("Failed to load request %s for scoring: %v", rev.RequestID, err)
+		return
+	}
+	score, err := imageDifference(req.ImagePath, rev.ResultImagePath)
+	if err != nil {
+		log.Printf("Failed to score revision %s: %v", rev.ID, err)
+		return
+	}
+	if err := setRevisionDiffScore(rev, score); err != nil {
+		log.Printf("Failed to save difference score of revision %s: %v", rev.ID, err)
+	}
+}
+
+// autoRetryRevision retries an initial result whose faces were altered, when
+// FACE_AUTO_RETRY is on, or that was flagged as barely or overly changed, when
+// AUTO_RETRY_DIFF is on. The retry emphasizes the faces, the weather or
+// keeping the photo intact accordingly. Only initial revisions are retried,
+// so a request is retried automatically at most once, and trial requests are
+// never retried since they count against the visitor's limit.
+func autoRetryRevision(rev *Revision) {
+	cfg := currentConfig()
+	if rev.Kind != revisionInitial {
+		return
+	}
+
+	var key string
+	switch {
+	case cfg.AutoRetryFaces && rev.FaceFlag() != "":
+		key = "faces"
+	case cfg.AutoRetryDiff && rev.DiffFlag() == diffFlagUnchanged:
+		key = "weather"
+	case cfg.AutoRetryDiff && rev.DiffFlag() == diffFlagOverchanged:
+		key = "composition"
+	default:
+		return
+	}
+	if isTrialRequest(rev.RequestID) {
+		return
+	}
+
+	req, err := getRequest(rev.RequestID)
+	if err != nil {
+		log.Printf("Failed to load request %s for automatic retry: %v", rev.RequestID, err)
+		return
+	}
+	aspect, _ := findRetryAspect(key)
+	prompt := emphasizePrompt(rev.Prompt, []retryAspect{aspect})
+	log.Printf("Revision %s flagged for %s, retrying automatically", rev.ID, aspect.Key)
+	if _, err := startRevision(req, rev.ID, revisionAuto, prompt, perturbSeed(rev.Seed), rev.Intensity); err != nil {
+		log.Printf("Failed to start automatic retry of revision %s: %v", rev.ID, err)
+	}
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Limits of the photo review controls
+const (
+	maxStraightenDegrees = 15
+	maxCropPercent       = 40 // per side
+)
+
+// reviewTimeout is how long a photo waits to be reviewed before its request
+// is cancelled
+const reviewTimeout = 24 * time.Hour
+
+// pendingReviewTTL is how long a submission waiting for review is kept in
+// the cache, outliving reviewTimeout so the timeout can still cancel it
+const pendingReviewTTL = reviewTimeout + time.Hour
+
+// awaitPhotoReview holds back the processing of a submission until its photo
+// is reviewed, cancelling it if that doesn't happen within reviewTimeout. The
+// submission waits in the cache, so any instance can take the review.
+func awaitPhotoReview(requestID string, sub *submission) {
+	cacheSetJSON("review:"+requestID, sub, pendingReviewTTL)
+	for _, id := range sub.RequestIDs {
+		cacheSet("reviewing:"+id, []byte(requestID), pendingReviewTTL)
+	}
+	time.AfterFunc(reviewTimeout, func() {
+		if _, ok := claimPhotoReview(requestID); !ok {
+			return
+		}
+		for _, id := range sub.RequestIDs {
+			updateRequestStatus(id, "cancelled")
+		}
+		forgetPhotoReview(requestID, sub)
+	})
+}
+
+// awaitingPhotoReview reports whether a request, or the batch it's part of,
+// is waiting for its photo to be reviewed
+func awaitingPhotoReview(id string) bool {
+	_, ok := cacheGet("reviewing:" + id)
+	return ok
+}
+
+// forgetPhotoReview removes a submission that's done waiting from the cache
+func forgetPhotoReview(requestID string, sub *submission) {
+	appCache.Delete("review:" + requestID)
+	for _, id := range sub.RequestIDs {
+		appCache.Delete("reviewing:" + id)
+	}
+}
+
+// claimPhotoReview takes a submission waiting for review, so only one review
+// of it is applied, even across instances. It reports false when it wasn't
+// waiting or someone else took it.
+func claimPhotoReview(requestID string) (*submission, bool) {
+	var sub submission
+	if !cacheGetJSON("review:"+requestID, &sub) {
+		return nil, false
+	}
+	claims, err := appCache.Incr("review-claim:"+requestID, pendingReviewTTL)
+	if err != nil {
+		log.Printf("Failed to claim review of request %s: %v", requestID, err)
+		return nil, false
+	}
+	return &sub, claims == 1
+}
+
+// releasePhotoReview puts a claimed submission back to wait for review
+func releasePhotoReview(requestID string) {
+	if err := appCache.Delete("review-claim:" + requestID); err != nil {
+		log.Printf("Failed to release review of request %s: %v", requestID, err)
+	}
+}
+
+// startReviewedSubmission starts processing a reviewed submission on this
+// instance, which takes its requests over from the one that accepted the upload
+func startReviewedSubmission(requestID string, sub *submission) {
+	for _, id := range sub.RequestIDs {
+		if err := setRequestClaim(id, instanceID); err != nil {
+			log.Printf("Failed to claim request %s: %v", id, err)
+		}
+		updateRequestStatus(id, "pending")
+	}
+	forgetPhotoReview(requestID, sub)
+	sub.start()
+}
+
+// PhotoEdit is how a photo is changed in review: rotated by a multiple of
+// 90°, straightened by a few degrees and cropped. Positive angles turn the
+// photo clockwise; crops are percentages trimmed off each side afterwards.
+type PhotoEdit struct {
+	Rotate                   int
+	Straighten               float64
+	Left, Top, Right, Bottom float64
+}
+
+// IsZero reports whether the edit leaves the photo unchanged
+func (e PhotoEdit) IsZero() bool {
+	return e == PhotoEdit{}
+}
+
+// parsePhotoEdit reads a photo edit from the review form
+func parsePhotoEdit(r *http.Request) (PhotoEdit, error) {
+	var edit PhotoEdit
+	var err error
+
+	if edit.Rotate, err = strconv.Atoi(r.FormValue("rotate")); err != nil || edit.Rotate%90 != 0 {
+		return edit, fmt.Errorf("rotation must be a multiple of 90 degrees")
+	}
+	edit.Rotate = (edit.Rotate%360 + 360) % 360
+
+	edit.Straighten, err = strconv.ParseFloat(r.FormValue("straighten"), 64)
+	if err != nil || math.Abs(edit.Straighten) > maxStraightenDegrees {
+		return edit, fmt.Errorf("straightening must be between -%d and %d degrees", maxStraightenDegrees, maxStraightenDegrees)
+	}
+
+	for _, side := range []struct {
+		name  string
+		value *float64
+	}{{"crop_left", &edit.Left}, {"crop_top", &edit.Top}, {"crop_right", &edit.Right}, {"crop_bottom", &edit.Bottom}} {
+		*side.value, err = strconv.ParseFloat(r.FormValue(side.name), 64)
+		if err != nil || *side.value < 0 || *side.value > maxCropPercent {
+			return edit, fmt.Errorf("crops must be between 0 and %d%% per side", maxCropPercent)
+		}
+	}
+	return edit, nil
+}
+
+// editPhotoFile applies a review edit to the JPEG at path, storing the
+// edited photo as a new blob and returning its path
+func editPhotoFile(path string, edit PhotoEdit) (string, error) {
+	img, err := decodeImageFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	// Quarter turns are the matching EXIF orientations
+	switch edit.Rotate {
+	case 90:
+		img = applyOrientation(img, 6)
+	case 180:
+		img = applyOrientation(img, 3)
+	case 270:
+		img = applyOrientation(img, 8)
+	}
+	if edit.Straighten != 0 {
+		img = straightenImage(img, edit.Straighten)
+	}
+
+	bounds := img.Bounds()
+	w, h := float64(bounds.Dx()), float64(bounds.Dy())
+	crop := image.Rect(
+		bounds.Min.X+int(math.Round(w*edit.Left/100)), bounds.Min.Y+int(math.Round(h*edit.Top/100)),
+		bounds.Max.X-int(math.Round(w*edit.Right/100)), bounds.Max.Y-int(math.Round(h*edit.Bottom/100)),
+	)
+	if crop.Empty() {
+		return "", fmt.Errorf("crop leaves nothing of the photo")
+	}
+	cropped := image.NewNRGBA(image.Rect(0, 0, crop.Dx(), crop.Dy()))
+	draw.Draw(cropped, cropped.Bounds(), img, crop.Min, draw.Src)
+
+	data, err := encodeJPEG(cropped)
+	if err != nil {
+		return "", err
+	}
+	return storeBlob(data, ".jpg")
+}
+
+// straightenImage rotates an image by a small angle in degrees, clockwise
+// when positive, and crops it to the largest rectangle of the same aspect
+// ratio that the rotated image covers, so no blank corners show
+func straightenImage(img image.Image, degrees float64) image.Image {
+	bounds := img.Bounds()
+	src := image.NewNRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(src, src.Bounds(), img, bounds.Min, draw.Src)
+
+	w, h := float64(bounds.Dx()), float64(bounds.Dy())
+	theta := degrees * math.Pi / 180
+	sin, cos := math.Abs(math.Sin(theta)), math.Cos(theta)
+	scale := min(w/(w*cos+h*sin), h/(w*sin+h*cos))
+	dw, dh := max(1, int(w*scale)), max(1, int(h*scale))
+
+	dst := image.NewNRGBA(image.Rect(0, 0, dw, dh))
+	s, c := math.Sin(theta), math.Cos(theta)
+	for y := 0; y < dh; y++ {
+		v := float64(y) + 0.5 - float64(dh)/2
+		for x := 0; x < dw; x++ {
+			u := float64(x) + 0.5 - float64(dw)/2
+			// The source pixel is the destination one turned back by the angle
+			sx := u*c + v*s + w/2 - 0.5
+			sy := -u*s + v*c + h/2 - 0.5
+			bilinear(src, sx, sy, dst.Pix[dst.PixOffset(x, y):])
+		}
+	}
+	return dst
+}
+
+// bilinear samples src at a fractional position into out, clamping to its edges
+func bilinear(src *image.NRGBA, x, y float64, out []uint8) {
+	maxX, maxY := src.Rect.Dx()-1, src.Rect.Dy()-1
+	x = math.Max(0, math.Min(x, float64(maxX)))
+	y = math.Max(0, math.Min(y, float64(maxY)))
+	x0, y0 := int(x), int(y)
+	x1, y1 := min(x0+1, maxX), min(y0+1, maxY)
+	fx, fy := x-float64(x0), y-float64(y0)
+
+	p00, p10 := src.PixOffset(x0, y0), src.PixOffset(x1, y0)
+	p01, p11 := src.PixOffset(x0, y1), src.PixOffset(x1, y1)
+	for i := 0; i < 4; i++ {
+		top := float64(src.Pix[p00+i])*(1-fx) + float64(src.Pix[p10+i])*fx
+		bottom := float64(src.Pix[p01+i])*(1-fx) + float64(src.Pix[p11+i])*fx
+		out[i] = uint8(math.Round(top*(1-fy) + bottom*fy))
+	}
+}
+
+// reviewHandler shows the photo review step, where a submitted photo can be
+// rotated, straightened and cropped before its weather is looked up
+func reviewHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserID(w, r)
+	if err != nil {
+		http.Error(w, "Failed to generate user ID", http.StatusInternalServerError)
+		return
+	}
+
+	req, err := getRequest(r.PathValue("id"))
+	if err != nil || req.UserID != userID {
+		lookupError(w, err, "Request")
+		return
+	}
+	if req.Status != "reviewing" {
+		http.Redirect(w, r, "/processing/"+req.ID, http.StatusSeeOther)
+		return
+	}
+
+	data := struct {
+		Request       *Request
+		MaxStraighten int
+		MaxCrop       int
+		CropSides     []string
+	}{
+		Request:       req,
+		MaxStraighten: maxStraightenDegrees,
+		MaxCrop:       maxCropPercent,
+		CropSides:     []string{"left", "top", "right", "bottom"},
+	}
+
+	templates.ExecuteTemplate(w, "review.html", data)
+}
+
+// saveReviewHandler applies the reviewed edit to a submitted photo, if any,
+// and starts processing the submission
+func saveReviewHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserID(w, r)
+	if err != nil {
+		http.Error(w, "Failed to generate user ID", http.StatusInternalServerError)
+		return
+	}
+
+	req, err := getRequest(r.PathValue("id"))
+	if err != nil || req.UserID != userID {
+		lookupError(w, err, "Request")
+		return
+	}
+	if req.Status != "reviewing" {
+		http.Redirect(w, r, "/processing/"+req.ID, http.StatusSeeOther)
+		return
+	}
+
+	var edit PhotoEdit
+	if r.FormValue("action") != "skip" {
+		if edit, err = parsePhotoEdit(r); err != nil {
+			http.Error(w, "Invalid edit: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	sub, ok := claimPhotoReview(req.ID)
+	if !ok {
+		// Reviewed in another tab in the meantime, or expired
+		http.Redirect(w, r, "/processing/"+req.ID, http.StatusSeeOther)
+		return
+	}
+	if !edit.IsZero() {
+		// The requests of a batch share the photo, and all get the edited one
+		edited, err := editPhotoFile(req.ImagePath, edit)
+		if err == nil {
+			err = setRequestsImagePath(sub.RequestIDs, edited)
+		}
+		if err != nil {
+			log.Printf("Failed to edit photo of request %s: %v", req.ID, err)
+			releasePhotoReview(req.ID)
+			http.Error(w, "Failed to edit photo", http.StatusInternalServerError)
+			return
+		}
+	}
+	startReviewedSubmission(req.ID, sub)
+
+	if req.BatchID != "" {
+		http.Redirect(w, r, "/batches/"+req.BatchID, http.StatusSeeOther)
+		return
+	}
+	http.Redirect(w, r, "/processing/"+req.ID, http.StatusSeeOther)
+}
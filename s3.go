@@ -0,0 +1,159 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// errS3NotFound is returned when an S3 object doesn't exist
+var errS3NotFound = errors.New("object not found")
+
+// S3Bucket is a bucket on AWS S3 or an S3-compatible store (Tigris, R2,
+// MinIO), addressed path-style so custom endpoints work without DNS setup
+type S3Bucket struct {
+	Endpoint        *url.URL
+	Region          string
+	Bucket          string
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+}
+
+// AWSCredentials are the standard AWS settings S3 buckets are accessed with,
+// read through the configuration so they can come from files or a secret
+// manager like other secrets
+type AWSCredentials struct {
+	Region          string
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+}
+
+// newS3Bucket builds a bucket accessed with creds. endpoint may be empty
+// for AWS itself.
+func newS3Bucket(bucket, endpoint string, creds AWSCredentials) (*S3Bucket, error) {
+	b := &S3Bucket{
+		Region:          creds.Region,
+		Bucket:          bucket,
+		AccessKeyID:     creds.AccessKeyID,
+		SecretAccessKey: creds.SecretAccessKey,
+		SessionToken:    creds.SessionToken,
+	}
+	if b.AccessKeyID == "" || b.SecretAccessKey == "" {
+		return nil, fmt.Errorf("S3 access requires AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+	}
+	if endpoint == "" {
+		endpoint = "https://s3." + b.Region + ".amazonaws.com"
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid S3_ENDPOINT %q", endpoint)
+	}
+	b.Endpoint = u
+	return b, nil
+}
+
+// objectURL is the path-style URL of a key in the bucket
+func (b *S3Bucket) objectURL(key string) string {
+	u := *b.Endpoint
+	u.Path = "/" + b.Bucket + "/" + strings.TrimPrefix(key, "/")
+	return u.String()
+}
+
+// do signs and sends a request for an object. body may be nil.
+func (b *S3Bucket) do(method, key string, body io.Reader, size int64, payloadHash, contentType string) (*http.Response, error) {
+	req, err := http.NewRequest(method, b.objectURL(key), body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if b.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", b.SessionToken)
+	}
+	signAWSRequest(req, payloadHash, b.Endpoint.Host, b.Region, "s3", b.AccessKeyID, b.SecretAccessKey, time.Now())
+
+	return s3Client.Do(req)
+}
+
+// PutFile uploads a local file to key, streaming it from disk
+func (b *S3Bucket) PutFile(key, path, contentType string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// The signature covers the body's hash, so read it once to hash it and
+	// again to send it
+	hash := sha256.New()
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	resp, err := b.do(http.MethodPut, key, file, size, hex.EncodeToString(hash.Sum(nil)), contentType)
+	if err != nil {
+		return fmt.Errorf("S3 upload failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("S3 upload of %s responded with %s: %s", key, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// GetFile downloads key to a local file, returning errS3NotFound if the
+// object doesn't exist
+func (b *S3Bucket) GetFile(key, path string) error {
+	resp, err := b.do(http.MethodGet, key, nil, 0, sha256Hex(nil), "")
+	if err != nil {
+		return fmt.Errorf("S3 download failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return errS3NotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("S3 download of %s responded with %s: %s", key, resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	return writeFileAtomic(path, func(w io.Writer) error {
+		if _, err := io.Copy(w, resp.Body); err != nil {
+			return fmt.Errorf("S3 download of %s failed: %w", key, err)
+		}
+		return nil
+	})
+}
+
+// Delete removes an object. Deleting one that doesn't exist isn't an error.
+func (b *S3Bucket) Delete(key string) error {
+	resp, err := b.do(http.MethodDelete, key, nil, 0, sha256Hex(nil), "")
+	if err != nil {
+		return fmt.Errorf("S3 delete failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("S3 delete of %s responded with %s: %s", key, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
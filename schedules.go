@@ -0,0 +1,352 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Scheduled generations re-run one of a user's requests, with its photo,
+// place and settings, on a date to come, like redo does on the spot. Each
+// runs around its time of day at the place (noon without one), so the
+// weather it's made with is the day's, and is confirmed automatically since
+// nobody is there to look at the weather first.
+
+const (
+	// maxScheduleDaysAhead is how far ahead generations can be scheduled
+	maxScheduleDaysAhead = 366
+
+	// maxPendingSchedules is how many generations a user can have waiting,
+	// so an imported calendar can't queue up more than anyone meant to
+	maxPendingSchedules = 100
+
+	scheduleCheckInterval = 5 * time.Minute
+)
+
+// Schedule is a generation planned for a date
+type Schedule struct {
+	ID              string
+	UserID          string
+	SourceRequestID string // the request re-run
+	RunDate         string // YYYY-MM-DD, the target date of the new request
+	RunAt           string // when it runs, UTC
+	UID             string // the iCalendar UID of the event it was imported from
+	Summary         string // the imported event's title
+	Status          string // scheduled, started, cancelled or error
+	RequestID       string // the request it started
+	ErrorMessage    string
+	CreatedAt       string
+}
+
+// scheduleRunAt is when a re-run of parent on date runs: its time of day on
+// that date at its place
+func scheduleRunAt(parent *Request, date time.Time) (time.Time, error) {
+	day := *parent
+	day.TargetDate = date.Format(time.DateOnly)
+	at, err := weatherMapTime(&day)
+	return at.UTC(), err
+}
+
+// addSchedules schedules re-runs of parent on dates, as far as the user's
+// pending limit allows, skipping dates already scheduled for the same
+// event. It returns how many were added and
+// how many dates were skipped.
+func addSchedules(parent *Request, uid, summary string, dates []time.Time) (int, int, error) {
+	pending, err := countPendingSchedules(parent.UserID)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var schedules []*Schedule
+	for _, date := range dates {
+		if pending+len(schedules) >= maxPendingSchedules {
+			break
+		}
+		id, err := generateID(16)
+		if err != nil {
+			return 0, 0, err
+		}
+		runAt, err := scheduleRunAt(parent, date)
+		if err != nil {
+			return 0, 0, err
+		}
+		if uid == "" {
+			uid = id
+		}
+		schedules = append(schedules, &Schedule{
+			ID:              id,
+			UserID:          parent.UserID,
+			SourceRequestID: parent.ID,
+			RunDate:         date.Format(time.DateOnly),
+			RunAt:           sqliteTime(runAt),
+			UID:             uid,
+			Summary:         summary,
+		})
+	}
+	added, err := saveSchedules(schedules)
+	return added, len(dates) - added, err
+}
+
+// scheduleWindow is the first and last dates generations can be scheduled on
+func scheduleWindow(now time.Time) (time.Time, time.Time) {
+	today, _ := time.Parse(time.DateOnly, now.UTC().Format(time.DateOnly))
+	return today, today.AddDate(0, 0, maxScheduleDaysAhead)
+}
+
+// startScheduler starts the generations whose time has come, now and every
+// few minutes
+func startScheduler() {
+	ticker := time.NewTicker(scheduleCheckInterval)
+	goSafe("", func() {
+		runDueSchedules()
+		for range ticker.C {
+			runDueSchedules()
+		}
+	})
+}
+
+// runDueSchedules starts each due schedule another instance hasn't claimed
+func runDueSchedules() {
+	schedules, err := dueSchedules(time.Now())
+	if err != nil {
+		log.Printf("Failed to list due schedules: %v", err)
+		return
+	}
+	for _, s := range schedules {
+		claimed, err := claimSchedule(s.ID)
+		if err != nil {
+			log.Printf("Failed to claim schedule %s: %v", s.ID, err)
+			continue
+		}
+		if claimed {
+			goSafe("", func() { runSchedule(s) })
+		}
+	}
+}
+
+// runSchedule re-runs a schedule's request on its date: the clone's
+// weather is looked up, and its generation started once it's there
+func runSchedule(s *Schedule) {
+	parent, err := getRequest(s.SourceRequestID)
+	if err != nil {
+		log.Printf("Failed to load request %s of schedule %s: %v", s.SourceRequestID, s.ID, err)
+		failSchedule(s.ID, fmt.Errorf("the request to re-run is gone"))
+		return
+	}
+	requestID, err := generateID(16)
+	if err != nil {
+		failSchedule(s.ID, err)
+		return
+	}
+
+	clone := *parent
+	clone.ID, clone.TargetDate, clone.EndDate = requestID, s.RunDate, ""
+	if err := cloneRequest(&clone, parent.ID); err != nil {
+		log.Printf("Failed to clone request %s for schedule %s: %v", parent.ID, s.ID, err)
+		failSchedule(s.ID, fmt.Errorf("failed to save request: %w", err))
+		return
+	}
+	if err := setScheduleRequest(s.ID, requestID); err != nil {
+		log.Printf("Failed to record request of schedule %s: %v", s.ID, err)
+	}
+	log.Printf("Schedule %s started request %s for %s", s.ID, requestID, s.RunDate)
+	trackEvent(eventRequestCreated, s.UserID, requestID, map[string]interface{}{"source": "schedule", "parent": parent.ID})
+
+	locale := defaultLocale
+	if settings, err := getUserSettings(s.UserID); err == nil {
+		locale = settings.Locale
+	}
+	resolved, locale := cloneLocation(&clone, parent, locale)
+	runSafe(requestID, func() {
+		processWeatherRequest(requestID, clone.LocationInput, locationModeAuto, locale, resolved)
+	})
+
+	// The request records why when the weather couldn't be had
+	req, err := getRequest(requestID)
+	if err != nil || req.Status != "weather_fetched" {
+		return
+	}
+	if _, err := startRevision(req, "", revisionInitial, req.AIPrompt, 0, req.Intensity); err != nil {
+		log.Printf("Failed to start revision for scheduled request %s: %v", requestID, err)
+		updateRequestError(requestID, fmt.Errorf("failed to start processing: %w", err))
+		return
+	}
+	// Nobody is there to confirm it, so it's confirmed on their behalf
+	trackEvent(eventWeatherConfirmed, s.UserID, requestID, map[string]interface{}{"automatic": true})
+}
+
+// schedulesHandler lists the user's scheduled generations, with the forms
+// to import a calendar and the link to subscribe to them
+func schedulesHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserID(w, r)
+	if err != nil {
+		http.Error(w, "Failed to generate user ID", http.StatusInternalServerError)
+		return
+	}
+
+	schedules, err := getSchedules(userID)
+	if err != nil {
+		log.Printf("Failed to load schedules for user %s: %v", userID, err)
+		dbHTTPError(w, err, "Failed to load schedules")
+		return
+	}
+	recent, err := getRecentRequests(userID, 50)
+	if err != nil {
+		log.Printf("Failed to load recent requests for user %s: %v", userID, err)
+	}
+
+	// Requests that can be re-run are those whose place was resolved
+	var sources []*Request
+	for _, req := range recent {
+		if req.LocationName != "" {
+			sources = append(sources, req)
+		}
+	}
+	places, err := scheduleSources(schedules)
+	if err != nil {
+		log.Printf("Failed to load requests of schedules for user %s: %v", userID, err)
+	}
+
+	type scheduleRow struct {
+		*Schedule
+		Source *Request
+	}
+	rows := make([]scheduleRow, len(schedules))
+	for i, s := range schedules {
+		rows[i] = scheduleRow{Schedule: s, Source: places[s.SourceRequestID]}
+	}
+
+	query := r.URL.Query()
+	first, last := scheduleWindow(time.Now())
+	data := struct {
+		Schedules  []scheduleRow
+		Sources    []*Request
+		Source     string
+		MinDate    string
+		MaxDate    string
+		Imported   string
+		Skipped    string
+		FeedURL    string
+		MaxPending int
+	}{
+		Schedules:  rows,
+		Sources:    sources,
+		Source:     query.Get("request"),
+		MinDate:    first.Format(time.DateOnly),
+		MaxDate:    last.Format(time.DateOnly),
+		Imported:   query.Get("imported"),
+		Skipped:    query.Get("skipped"),
+		FeedURL:    calendarFeedURL(r, userID),
+		MaxPending: maxPendingSchedules,
+	}
+	templates.ExecuteTemplate(w, "schedules.html", data)
+}
+
+// scheduleSources loads the requests schedules re-run, by ID
+func scheduleSources(schedules []*Schedule) (map[string]*Request, error) {
+	sources := map[string]*Request{}
+	for _, s := range schedules {
+		if _, ok := sources[s.SourceRequestID]; ok {
+			continue
+		}
+		req, err := getRequest(s.SourceRequestID)
+		if err != nil {
+			return sources, err
+		}
+		sources[s.SourceRequestID] = req
+	}
+	return sources, nil
+}
+
+// createScheduleHandler schedules re-runs of one of the user's requests on
+// a date, and optionally on the dates repeating it
+func createScheduleHandler(w http.ResponseWriter, r *http.Request) {
+	parent, ok := scheduleSource(w, r, r.FormValue("request"))
+	if !ok {
+		return
+	}
+
+	start, err := time.Parse(time.DateOnly, r.FormValue("date"))
+	if err != nil {
+		http.Error(w, "Choose a date", http.StatusBadRequest)
+		return
+	}
+	rule := recurrence{freq: r.FormValue("repeat"), interval: 1}
+	if rule.freq != "" && !recurrenceFrequencies[rule.freq] {
+		http.Error(w, "Unknown repetition", http.StatusBadRequest)
+		return
+	}
+	if rule.freq != "" {
+		rule.count, err = strconv.Atoi(r.FormValue("count"))
+		if err != nil || rule.count < 1 || rule.count > maxPendingSchedules {
+			http.Error(w, fmt.Sprintf("Repeat between 1 and %d times", maxPendingSchedules), http.StatusBadRequest)
+			return
+		}
+	}
+	first, last := scheduleWindow(time.Now())
+	if start.Before(first) || start.After(last) {
+		http.Error(w, fmt.Sprintf("Generations can be scheduled from today to %d days ahead", maxScheduleDaysAhead),
+			http.StatusBadRequest)
+		return
+	}
+
+	added, skipped, err := addSchedules(parent, "", "", rule.dates(start, first, last, nil))
+	if err != nil {
+		log.Printf("Failed to schedule request %s: %v", parent.ID, err)
+		dbHTTPError(w, err, "Failed to save schedule")
+		return
+	}
+	redirectToSchedules(w, r, added, skipped)
+}
+
+// scheduleSource loads one of the user's requests to re-run, writing an
+// error when it isn't theirs or its place was never resolved
+func scheduleSource(w http.ResponseWriter, r *http.Request, requestID string) (*Request, bool) {
+	userID, err := getUserID(w, r)
+	if err != nil {
+		http.Error(w, "Failed to generate user ID", http.StatusInternalServerError)
+		return nil, false
+	}
+	parent, err := getRequest(requestID)
+	if err != nil || parent.UserID != userID {
+		lookupError(w, err, "Request")
+		return nil, false
+	}
+	if parent.LocationName == "" {
+		http.Error(w, "Original request has no resolved location", http.StatusConflict)
+		return nil, false
+	}
+	return parent, true
+}
+
+// redirectToSchedules shows the schedules page, saying how many dates were
+// scheduled and skipped
+func redirectToSchedules(w http.ResponseWriter, r *http.Request, added, skipped int) {
+	query := url.Values{}
+	query.Set("imported", strconv.Itoa(added))
+	query.Set("skipped", strconv.Itoa(skipped))
+	http.Redirect(w, r, "/schedules?"+query.Encode(), http.StatusSeeOther)
+}
+
+// cancelScheduleHandler cancels one of the user's scheduled generations
+func cancelScheduleHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserID(w, r)
+	if err != nil {
+		http.Error(w, "Failed to generate user ID", http.StatusInternalServerError)
+		return
+	}
+	cancelled, err := cancelSchedule(userID, r.PathValue("id"))
+	if err != nil {
+		log.Printf("Failed to cancel schedule %s: %v", r.PathValue("id"), err)
+		dbHTTPError(w, err, "Failed to cancel schedule")
+		return
+	}
+	if !cancelled {
+		http.Error(w, "Schedule not found or already started", http.StatusNotFound)
+		return
+	}
+	http.Redirect(w, r, "/schedules", http.StatusSeeOther)
+}
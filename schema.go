@@ -0,0 +1,232 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// responseSchema describes what a provider response is expected to look like.
+// Paths use dots for nested objects and [] for every element of an array,
+// e.g. "list[].main.temp".
+type responseSchema struct {
+	Name     string
+	Shape    interface{} // struct the response is decoded into; its json tags are the known fields
+	Required []string    // fields that must be present for the response to be usable
+	Ignored  []string    // fields providers send that we know about but don't use
+}
+
+var (
+	historySchema = responseSchema{
+		Name:     weatherProviderHistory,
+		Shape:    HistoricalWeatherResponse{},
+		Required: []string{"list", "list[].main.temp", "list[].clouds.all", "list[].weather"},
+		Ignored: []string{"calctime", "list[].main.sea_level", "list[].main.grnd_level",
+			"list[].wind.gust", "list[].visibility", "list[].weather[].icon"},
+	}
+
+	forecastSchema = responseSchema{
+		Name:     weatherProviderForecast,
+		Shape:    ForecastResponse{},
+		Required: []string{"list", "list[].temp.day", "list[].clouds", "list[].weather"},
+		Ignored:  []string{"city", "message", "list[].sunrise", "list[].sunset", "list[].gust"},
+	}
+
+	archiveSchema = responseSchema{
+		Name:     weatherProviderArchive,
+		Shape:    ArchiveWeatherResponse{},
+		Required: []string{"hourly.time", "hourly.temperature_2m", "hourly.cloud_cover", "hourly.weather_code"},
+		Ignored: []string{"latitude", "longitude", "generationtime_ms", "timezone",
+			"timezone_abbreviation", "elevation", "hourly_units"},
+	}
+
+	predictionSchema = responseSchema{
+		Name:     "replicate_prediction",
+		Shape:    ReplicatePrediction{},
+		Required: []string{"id", "status"},
+		Ignored: []string{"model", "version", "created_at", "started_at", "completed_at",
+			"data_removed", "source", "urls.stream", "urls.web"},
+	}
+
+	uploadSchema = responseSchema{
+		Name:     "replicate_file",
+		Shape:    ReplicateFileUpload{},
+		Required: []string{"urls.get"},
+		Ignored: []string{"id", "name", "content_type", "size", "etag", "checksums",
+			"metadata", "created_at"},
+	}
+)
+
+// schemaDrift counts unknown and missing fields per schema and path since
+// startup. Each combination is logged the first time it's seen.
+var (
+	schemaDrift   = make(map[string]int)
+	schemaDriftMu sync.Mutex
+)
+
+// SchemaDriftCount is how often a field has been unexpectedly seen or missed
+type SchemaDriftCount struct {
+	Schema string `json:"schema"`
+	Kind   string `json:"kind"` // unknown or missing
+	Path   string `json:"path"`
+	Count  int    `json:"count"`
+}
+
+// validateResponse checks a raw provider response against its schema. Unknown
+// fields are only recorded, since providers add fields over time, but missing
+// required fields return an error wrapped with kind so callers don't build
+// prompts or results from zero values.
+func validateResponse(schema responseSchema, raw []byte, kind error) error {
+	var doc interface{}
+	if err := json.Unmarshal(raw, &doc); err != nil {
+		return fmt.Errorf("failed to parse %s response: %w", schema.Name, err)
+	}
+
+	ignored := make(map[string]bool, len(schema.Ignored))
+	for _, path := range schema.Ignored {
+		ignored[path] = true
+	}
+	for _, path := range unknownFields(doc, reflect.TypeOf(schema.Shape), "") {
+		if !ignored[path] {
+			recordSchemaDrift(schema.Name, "unknown", path)
+		}
+	}
+
+	var missing []string
+	for _, path := range schema.Required {
+		if !hasField(doc, strings.Split(path, ".")) {
+			recordSchemaDrift(schema.Name, "missing", path)
+			missing = append(missing, path)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("%w: %s response is missing %s", kind, schema.Name, strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// unknownFields lists the paths in doc that have no matching json tag in t
+func unknownFields(doc interface{}, t reflect.Type, prefix string) []string {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	var paths []string
+	switch v := doc.(type) {
+	case map[string]interface{}:
+		if t.Kind() != reflect.Struct {
+			return nil // maps and interface{} fields accept anything
+		}
+		fields := jsonFields(t)
+		for key, value := range v {
+			field, ok := fields[key]
+			if !ok {
+				paths = append(paths, prefix+key)
+				continue
+			}
+			paths = append(paths, unknownFields(value, field, prefix+key+".")...)
+		}
+	case []interface{}:
+		if t.Kind() != reflect.Slice {
+			return nil
+		}
+		seen := make(map[string]bool)
+		for _, item := range v {
+			for _, path := range unknownFields(item, t.Elem(), strings.TrimSuffix(prefix, ".")+"[].") {
+				if !seen[path] {
+					seen[path] = true
+					paths = append(paths, path)
+				}
+			}
+		}
+	}
+	return paths
+}
+
+// jsonFields maps the json names of a struct's fields to their types
+func jsonFields(t reflect.Type) map[string]reflect.Type {
+	fields := make(map[string]reflect.Type, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		fields[name] = f.Type
+	}
+	return fields
+}
+
+// hasField reports whether the path is present (and not null) in doc. A path
+// through an array must be present in every element; empty arrays are left
+// for the caller to reject with a more specific error.
+func hasField(doc interface{}, path []string) bool {
+	if len(path) == 0 {
+		return doc != nil
+	}
+
+	obj, ok := doc.(map[string]interface{})
+	if !ok {
+		return false
+	}
+
+	key, isArray := strings.CutSuffix(path[0], "[]")
+	value, ok := obj[key]
+	if !ok || value == nil {
+		return false
+	}
+	if !isArray {
+		return hasField(value, path[1:])
+	}
+
+	items, ok := value.([]interface{})
+	if !ok {
+		return false
+	}
+	for _, item := range items {
+		if !hasField(item, path[1:]) {
+			return false
+		}
+	}
+	return true
+}
+
+// recordSchemaDrift counts a schema mismatch, logging it the first time
+func recordSchemaDrift(schema, kind, path string) {
+	key := schema + "\x00" + kind + "\x00" + path
+
+	schemaDriftMu.Lock()
+	schemaDrift[key]++
+	first := schemaDrift[key] == 1
+	schemaDriftMu.Unlock()
+
+	if first {
+		log.Printf("Provider schema drift: %s response has %s field %q", schema, kind, path)
+	}
+}
+
+// schemaDriftCounts returns the recorded schema mismatches, most frequent first
+func schemaDriftCounts() []SchemaDriftCount {
+	schemaDriftMu.Lock()
+	defer schemaDriftMu.Unlock()
+
+	counts := make([]SchemaDriftCount, 0, len(schemaDrift))
+	for key, count := range schemaDrift {
+		parts := strings.SplitN(key, "\x00", 3)
+		counts = append(counts, SchemaDriftCount{Schema: parts[0], Kind: parts[1], Path: parts[2], Count: count})
+	}
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].Count != counts[j].Count {
+			return counts[i].Count > counts[j].Count
+		}
+		return counts[i].Schema+counts[i].Path < counts[j].Schema+counts[j].Path
+	})
+	return counts
+}
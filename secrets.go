@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// fetchManagedSecrets loads settings from the secret managers configured
+// through lookup. Vault takes precedence over AWS Secrets Manager when both
+// provide a key.
+func fetchManagedSecrets(lookup func(key string) string) (map[string]string, error) {
+	secrets := make(map[string]string)
+
+	if id := lookup("AWS_SECRETS_MANAGER_SECRET_ID"); id != "" {
+		values, err := fetchAWSSecret(id, lookup("AWS_REGION"), lookup("AWS_ACCESS_KEY_ID"),
+			lookup("AWS_SECRET_ACCESS_KEY"), lookup("AWS_SESSION_TOKEN"))
+		if err != nil {
+			return nil, err
+		}
+		for key, value := range values {
+			secrets[key] = value
+		}
+	}
+
+	if path := lookup("VAULT_SECRET_PATH"); path != "" {
+		values, err := fetchVaultSecret(lookup("VAULT_ADDR"), lookup("VAULT_TOKEN"), path)
+		if err != nil {
+			return nil, err
+		}
+		for key, value := range values {
+			secrets[key] = value
+		}
+	}
+
+	return secrets, nil
+}
+
+// fetchVaultSecret reads a key/value secret from HashiCorp Vault. Both KV
+// version 1 paths (secret/skyweave) and version 2 paths (secret/data/skyweave)
+// are supported.
+func fetchVaultSecret(addr, token, path string) (map[string]string, error) {
+	if addr == "" || token == "" {
+		return nil, fmt.Errorf("VAULT_SECRET_PATH requires VAULT_ADDR and VAULT_TOKEN")
+	}
+
+	apiURL := strings.TrimRight(addr, "/") + "/v1/" + strings.TrimLeft(path, "/")
+	req, err := http.NewRequest("GET", apiURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Vault request: %w", err)
+	}
+	req.Header.Set("X-Vault-Token", token)
+
+	body, err := doSecretRequest(req, "Vault")
+	if err != nil {
+		return nil, err
+	}
+
+	var secret struct {
+		Data map[string]json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(body, &secret); err != nil {
+		return nil, fmt.Errorf("failed to parse Vault response: %w", err)
+	}
+
+	// KV v2 nests the values under data.data next to data.metadata
+	data := secret.Data
+	if nested, ok := data["data"]; ok {
+		if _, isV2 := data["metadata"]; isV2 {
+			data = nil
+			if err := json.Unmarshal(nested, &data); err != nil {
+				return nil, fmt.Errorf("failed to parse Vault secret data: %w", err)
+			}
+		}
+	}
+	return stringValues(data, "Vault")
+}
+
+// fetchAWSSecret reads a secret from AWS Secrets Manager whose SecretString is
+// a JSON object of setting names to values
+func fetchAWSSecret(secretID, region, accessKeyID, secretAccessKey, sessionToken string) (map[string]string, error) {
+	if region == "" || accessKeyID == "" || secretAccessKey == "" {
+		return nil, fmt.Errorf("AWS_SECRETS_MANAGER_SECRET_ID requires AWS_REGION, AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+	}
+
+	payload, err := json.Marshal(map[string]string{"SecretId": secretID})
+	if err != nil {
+		return nil, err
+	}
+
+	host := fmt.Sprintf("secretsmanager.%s.amazonaws.com", region)
+	req, err := http.NewRequest("POST", "https://"+host+"/", bytes.NewReader(payload))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Secrets Manager request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "secretsmanager.GetSecretValue")
+	if sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", sessionToken)
+	}
+	signAWSRequest(req, sha256Hex(payload), host, region, "secretsmanager", accessKeyID, secretAccessKey, time.Now())
+
+	body, err := doSecretRequest(req, "Secrets Manager")
+	if err != nil {
+		return nil, err
+	}
+
+	var secret struct {
+		SecretString string `json:"SecretString"`
+	}
+	if err := json.Unmarshal(body, &secret); err != nil {
+		return nil, fmt.Errorf("failed to parse Secrets Manager response: %w", err)
+	}
+
+	var data map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(secret.SecretString), &data); err != nil {
+		return nil, fmt.Errorf("Secrets Manager secret %s is not a JSON object: %w", secretID, err)
+	}
+	return stringValues(data, "Secrets Manager")
+}
+
+// doSecretRequest performs a secret manager request and returns the body of a
+// successful response
+func doSecretRequest(req *http.Request, service string) ([]byte, error) {
+	resp, err := secretsClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%s request failed: %w", service, err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s response: %w", service, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		// The body may echo request details but never the secret values
+		return nil, fmt.Errorf("%s responded with %s: %s", service, resp.Status, bytes.TrimSpace(body))
+	}
+	return body, nil
+}
+
+// stringValues keeps the string values of a decoded secret
+func stringValues(data map[string]json.RawMessage, service string) (map[string]string, error) {
+	values := make(map[string]string, len(data))
+	for key, raw := range data {
+		var value string
+		if err := json.Unmarshal(raw, &value); err != nil {
+			return nil, fmt.Errorf("%s secret value for %s is not a string", service, key)
+		}
+		values[key] = value
+	}
+	return values, nil
+}
+
+// signAWSRequest adds an AWS Signature Version 4 Authorization header
+// (https://docs.aws.amazon.com/IAM/latest/UserGuide/reference_sigv.html).
+// payloadHash is the hex SHA-256 of the body, so large bodies can be hashed
+// while streaming them from disk.
+func signAWSRequest(req *http.Request, payloadHash, host, region, service, accessKeyID, secretAccessKey string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+
+	headers := map[string]string{"host": host}
+	for name := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(req.Header.Get(name))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	canonicalRequest := strings.Join([]string{
+		req.Method, path, req.URL.RawQuery, canonicalHeaders.String(), signedHeaders, payloadHash,
+	}, "\n")
+
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+secretAccessKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKeyID, scope, signedHeaders, signature))
+}
+
+// sha256Hex returns the hex SHA-256 of data
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// hmacSHA256 computes HMAC-SHA256 of data with key
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sessionTTL is how long a login or trial session lasts
+const sessionTTL = 24 * time.Hour
+
+// minSessionKeyLength is the shortest SESSION_KEYS entry accepted, in bytes
+const minSessionKeyLength = 32
+
+// sessionKind is what a session grants
+type sessionKind string
+
+// Session kinds. An empty kind means no session.
+const (
+	sessionFull  sessionKind = "full"  // logged in with the access passphrase
+	sessionAdmin sessionKind = "admin" // logged in with the admin passphrase, which includes full access
+	sessionTrial sessionKind = "trial" // anonymous trial visitor
+)
+
+// fullAccess reports whether the session reaches every page, not only the trial ones
+func (k sessionKind) fullAccess() bool {
+	return k == sessionFull || k == sessionAdmin
+}
+
+// SessionStore keeps login and trial sessions. The session cookie holds the
+// token Create returns. The database store suits a single instance, the
+// Redis store shares sessions between instances, and the cookie store keeps
+// nothing on the server at all.
+type SessionStore interface {
+	// Create starts a session that expires after sessionTTL and returns its token
+	Create(kind sessionKind) (string, error)
+	// Get returns the kind of an unexpired session, or "" for unknown tokens
+	Get(token string) (sessionKind, error)
+	// Delete ends a session before it expires, where the store can
+	Delete(token string) error
+	// Cleanup removes expired sessions, for stores that don't expire them on their own
+	Cleanup() error
+}
+
+// sessionStore is the store used by the server, picked by SESSION_STORE
+var sessionStore SessionStore = dbSessionStore{}
+
+// setupSessions picks the session store named by SESSION_STORE: database
+// (the default), redis, which needs CACHE_URL to point at Redis, or cookie,
+// which signs sessions with SESSION_KEYS
+func setupSessions() error {
+	switch kind := envOrDefault("SESSION_STORE", "database"); kind {
+	case "database":
+		sessionStore = dbSessionStore{}
+	case "redis":
+		cache, ok := appCache.(*redisCache)
+		if !ok {
+			return errors.New("SESSION_STORE=redis needs CACHE_URL to point at Redis")
+		}
+		sessionStore = redisSessionStore{cache}
+	case "cookie":
+		keys, err := parseSessionKeys(currentConfig().SessionKeys)
+		if err != nil {
+			return err
+		}
+		sessionStore = cookieSessionStore{keys}
+	default:
+		return fmt.Errorf("unknown SESSION_STORE %q, expected database, redis or cookie", kind)
+	}
+	return nil
+}
+
+// parseSessionKeys reads SESSION_KEYS, a comma-separated list of secrets.
+// New sessions are signed with the first; the others still verify, so a key
+// can be rotated by putting the new one first and removing the old one once
+// the sessions it signed have expired.
+func parseSessionKeys(raw string) ([][]byte, error) {
+	var keys [][]byte
+	for _, key := range strings.Split(raw, ",") {
+		key = strings.TrimSpace(key)
+		if key == "" {
+			continue
+		}
+		if len(key) < minSessionKeyLength {
+			return nil, fmt.Errorf("SESSION_KEYS entries must be at least %d characters", minSessionKeyLength)
+		}
+		keys = append(keys, []byte(key))
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("SESSION_STORE=cookie needs SESSION_KEYS")
+	}
+	return keys, nil
+}
+
+// requestSession returns the kind of session the request's cookie holds, or
+// "" when it has none. Store errors count as no session.
+func requestSession(r *http.Request) sessionKind {
+	token := getSessionCookie(r)
+	if token == "" {
+		return ""
+	}
+	kind, err := sessionStore.Get(token)
+	if err != nil {
+		log.Printf("Failed to look up session: %v", err)
+		return ""
+	}
+	return kind
+}
+
+// generateSessionID generates a random session ID
+func generateSessionID() (string, error) {
+	bytes := make([]byte, 32)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(bytes), nil
+}
+
+// dbSessionStore keeps sessions in the sessions table
+type dbSessionStore struct{}
+
+func (dbSessionStore) Create(kind sessionKind) (string, error) {
+	sessionID, err := generateSessionID()
+	if err != nil {
+		return "", err
+	}
+	return sessionID, createSession(sessionID, kind, sessionTTL)
+}
+
+func (dbSessionStore) Get(token string) (sessionKind, error) {
+	kind, err := getSessionKind(token)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	return kind, err
+}
+
+func (dbSessionStore) Delete(token string) error {
+	return deleteSession(token)
+}
+
+func (dbSessionStore) Cleanup() error {
+	return cleanupExpiredSessions()
+}
+
+// redisSessionStore keeps sessions in Redis, which expires them
+type redisSessionStore struct {
+	cache *redisCache
+}
+
+func (s redisSessionStore) Create(kind sessionKind) (string, error) {
+	sessionID, err := generateSessionID()
+	if err != nil {
+		return "", err
+	}
+	return sessionID, s.cache.Set("session:"+sessionID, []byte(kind), sessionTTL)
+}
+
+func (s redisSessionStore) Get(token string) (sessionKind, error) {
+	value, ok, err := s.cache.Get("session:" + token)
+	if err != nil || !ok {
+		return "", err
+	}
+	return sessionKind(value), nil
+}
+
+func (s redisSessionStore) Delete(token string) error {
+	return s.cache.Delete("session:" + token)
+}
+
+func (redisSessionStore) Cleanup() error {
+	return nil
+}
+
+// cookieSessionStore keeps nothing on the server: the token carries the
+// session's kind and expiry, signed with the first of keys. Sessions can't be
+// revoked one by one; removing every key they verify with ends them all.
+type cookieSessionStore struct {
+	keys [][]byte
+}
+
+// sessionSignature signs a cookie session's fields
+func sessionSignature(key []byte, kind sessionKind, expires int64, nonce string) string {
+	mac := hmac.New(sha256.New, key)
+	fmt.Fprintf(mac, "session\n%s\n%d\n%s", kind, expires, nonce)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (s cookieSessionStore) Create(kind sessionKind) (string, error) {
+	nonce := make([]byte, 8)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	expires := time.Now().Add(sessionTTL).Unix()
+	encoded := hex.EncodeToString(nonce)
+	return fmt.Sprintf("%s.%d.%s.%s", kind, expires, encoded, sessionSignature(s.keys[0], kind, expires, encoded)), nil
+}
+
+func (s cookieSessionStore) Get(token string) (sessionKind, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 4 {
+		return "", nil
+	}
+	kind := sessionKind(parts[0])
+	expires, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return "", nil
+	}
+	for _, key := range s.keys {
+		if hmac.Equal([]byte(parts[3]), []byte(sessionSignature(key, kind, expires, parts[2]))) {
+			return kind, nil
+		}
+	}
+	return "", nil
+}
+
+// Delete can't end a cookie session; clearing the cookie is all there is
+func (cookieSessionStore) Delete(token string) error {
+	return nil
+}
+
+func (cookieSessionStore) Cleanup() error {
+	return nil
+}
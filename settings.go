@@ -0,0 +1,115 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// UserSettings are a user's preferences, applied as defaults on the start
+// form and when their images are generated
+type UserSettings struct {
+	UserID            string
+	Units             string
+	Locale            string
+	DefaultLocationID string // saved location preselected on the start form
+	Email             string // where to send notifications, empty for none
+	Model             string // image model, empty for REPLICATE_MODEL
+	Preset            string // preset scenario preselected on the start form
+	Intensity         string
+}
+
+// Locale is a language and region the UI can be shown in
+type Locale struct {
+	Tag   string // BCP 47 language tag
+	Label string
+}
+
+// defaultLocale is used when the browser asks for none we support
+const defaultLocale = "en-US"
+
+// supportedLocales are the locales users can choose in their settings
+var supportedLocales = []Locale{
+	{"en-US", "English (United States)"},
+	{"en-GB", "English (United Kingdom)"},
+	{"de-DE", "Deutsch"},
+	{"es-ES", "Español"},
+	{"fr-FR", "Français"},
+	{"it-IT", "Italiano"},
+	{"nl-NL", "Nederlands"},
+	{"pt-BR", "Português (Brasil)"},
+	{"ja-JP", "日本語"},
+}
+
+// isSupportedLocale reports whether tag is one of supportedLocales
+func isSupportedLocale(tag string) bool {
+	for _, l := range supportedLocales {
+		if l.Tag == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// browserLocale picks the supported locale that best matches the request's
+// Accept-Language header. Languages are tried in the order listed, ignoring
+// quality values, and a bare language matches its first supported region.
+func browserLocale(r *http.Request) string {
+	for _, entry := range strings.Split(r.Header.Get("Accept-Language"), ",") {
+		tag, _, _ := strings.Cut(strings.TrimSpace(entry), ";")
+		if tag == "" {
+			continue
+		}
+		language, _, _ := strings.Cut(tag, "-")
+		for _, l := range supportedLocales {
+			if strings.EqualFold(l.Tag, tag) {
+				return l.Tag
+			}
+		}
+		for _, l := range supportedLocales {
+			if strings.EqualFold(strings.SplitN(l.Tag, "-", 2)[0], language) {
+				return l.Tag
+			}
+		}
+	}
+	return defaultLocale
+}
+
+// loadUserSettings returns the user's saved settings, or the defaults for a
+// user who hasn't saved any: the units they last picked and their browser's
+// locale
+func loadUserSettings(r *http.Request, userID string) *UserSettings {
+	settings, err := getUserSettings(userID)
+	if err == nil {
+		return settings
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		log.Printf("Failed to load settings for user %s: %v", userID, err)
+	}
+	return &UserSettings{
+		UserID:    userID,
+		Units:     preferredUnits(r),
+		Locale:    browserLocale(r),
+		Intensity: intensityNatural,
+	}
+}
+
+// userModel returns the image model a user's revisions are generated with.
+// A model that has since been removed from BENCHMARK_MODELS falls back to
+// REPLICATE_MODEL.
+func userModel(userID string) string {
+	settings, err := getUserSettings(userID)
+	if err == nil && settings.Model != "" {
+		if m, ok := benchmarkModel(settings.Model); ok {
+			return m.Name
+		}
+	}
+	return currentConfig().ReplicateModel
+}
+
+// IntensityPosition is the default intensity as a slider position
+func (s *UserSettings) IntensityPosition() int {
+	return intensityPosition(s.Intensity)
+}
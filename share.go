@@ -0,0 +1,193 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Share links open a public page of one revision's result. Its Open Graph
+// and Twitter card tags make social networks and chat apps show a preview
+// when the link is posted: a card of the result with the place, date and
+// weather written on it. Links are signed like image links, as
+// /share/{revision}.{expires}.{signature}, and expire with them.
+
+const (
+	shareCardWidth  = 1200
+	shareCardHeight = 630
+)
+
+var (
+	shareCardShade = color.RGBA{0x0f, 0x17, 0x2a, 0xc8} // premultiplied
+	shareCardInk   = color.RGBA{0xff, 0xff, 0xff, 0xff}
+	shareCardFaded = color.RGBA{0xcb, 0xd5, 0xe1, 0xff}
+)
+
+// shareSignature signs the share page of one revision until expires (Unix seconds)
+func shareSignature(key, revisionID string, expires int64) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	fmt.Fprintf(mac, "share\n%s\n%d", revisionID, expires)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// sharePageURL returns an absolute link to the share page of a revision,
+// valid until IMAGE_LINK_TTL passes. It returns "" when no signing key is
+// configured.
+func sharePageURL(r *http.Request, rev *Revision) string {
+	cfg := currentConfig()
+	if cfg.ImageSigningKey == "" {
+		return ""
+	}
+	expires := time.Now().Add(cfg.ImageLinkTTL).Unix()
+	token := fmt.Sprintf("%s.%d.%s", rev.ID, expires, shareSignature(cfg.ImageSigningKey, rev.ID, expires))
+	return absoluteURL(r, "/share/"+url.PathEscape(token))
+}
+
+// sharedResult loads the request and revision of a share link, answering
+// with an error when the link is invalid, expired or its result is gone
+func sharedResult(w http.ResponseWriter, r *http.Request) (*Request, *Revision, bool) {
+	token := r.PathValue("token")
+	revisionID, rest, _ := strings.Cut(token, ".")
+	expiresParam, sig, _ := strings.Cut(rest, ".")
+	expires, err := strconv.ParseInt(expiresParam, 10, 64)
+
+	key := currentConfig().ImageSigningKey
+	if key == "" || err != nil || time.Now().Unix() > expires ||
+		!hmac.Equal([]byte(sig), []byte(shareSignature(key, revisionID, expires))) {
+		http.Error(w, "Share link not found or expired", http.StatusNotFound)
+		return nil, nil, false
+	}
+
+	rev, err := getRevision(revisionID)
+	if err != nil || rev.Status != "completed" {
+		lookupError(w, err, "Result")
+		return nil, nil, false
+	}
+	req, err := getRequest(rev.RequestID)
+	if err != nil {
+		lookupError(w, err, "Result")
+		return nil, nil, false
+	}
+	return req, rev, true
+}
+
+// shareHandler serves the public page of a shared result, with the tags
+// social networks build link previews from
+func shareHandler(w http.ResponseWriter, r *http.Request) {
+	req, rev, ok := sharedResult(w, r)
+	if !ok {
+		return
+	}
+
+	title := fmt.Sprintf("%s on %s", req.PlaceName(), formatDateRange(req.TargetDate, req.EndDate, defaultLocale))
+	description := "A photo reimagined with the real weather of that day"
+	if req.WeatherDescription != "" {
+		description = fmt.Sprintf("%s, %s. %s.", upperFirst(req.WeatherDescription),
+			formatTemp(req.Temperature, req.Units), description)
+	}
+	path := "/share/" + url.PathEscape(r.PathValue("token"))
+	imageURL := rev.PublicURL
+	if imageURL == "" {
+		imageURL = signedImageURL(absoluteURL(r, ""), req.ID, rev.ID)
+	}
+
+	data := struct {
+		Title       string
+		Description string
+		PageURL     string
+		CardURL     string
+		ImageURL    string
+		CardWidth   int
+		CardHeight  int
+	}{
+		Title:       title,
+		Description: description,
+		PageURL:     absoluteURL(r, path),
+		CardURL:     absoluteURL(r, path+"/card.jpg"),
+		ImageURL:    imageURL,
+		CardWidth:   shareCardWidth,
+		CardHeight:  shareCardHeight,
+	}
+	templates.ExecuteTemplate(w, "share.html", data)
+}
+
+// shareCardHandler serves the preview image of a shared result. Cards are
+// drawn when asked for; link previews are fetched once when a link is
+// posted, and cached by the network that shows them.
+func shareCardHandler(w http.ResponseWriter, r *http.Request) {
+	req, rev, ok := sharedResult(w, r)
+	if !ok {
+		return
+	}
+	result, err := decodeImageFile(rev.ResultImagePath)
+	if err != nil {
+		log.Printf("Failed to read result of revision %s for its share card: %v", rev.ID, err)
+		http.Error(w, "Preview unavailable", http.StatusInternalServerError)
+		return
+	}
+	card, err := encodeJPEG(renderShareCard(result, req))
+	if err != nil {
+		log.Printf("Failed to encode share card of revision %s: %v", rev.ID, err)
+		http.Error(w, "Preview unavailable", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	w.Write(card)
+}
+
+// renderShareCard fills a 1200x630 card, the size link previews are shown
+// at, with the middle of a result, and writes the place, date and weather
+// across a shaded band at its bottom
+func renderShareCard(result image.Image, req *Request) image.Image {
+	canvas := image.NewRGBA(image.Rect(0, 0, shareCardWidth, shareCardHeight))
+
+	// Crop the result to the card's proportions, keeping its middle
+	bounds := result.Bounds()
+	crop := bounds
+	if bounds.Dx()*shareCardHeight > bounds.Dy()*shareCardWidth {
+		w := bounds.Dy() * shareCardWidth / shareCardHeight
+		crop.Min.X += (bounds.Dx() - w) / 2
+		crop.Max.X = crop.Min.X + w
+	} else {
+		h := bounds.Dx() * shareCardHeight / shareCardWidth
+		crop.Min.Y += (bounds.Dy() - h) / 2
+		crop.Max.Y = crop.Min.Y + h
+	}
+	draw.Draw(canvas, canvas.Bounds(), resizeImage(result, crop, shareCardWidth, shareCardHeight), image.Point{}, draw.Src)
+
+	const margin, titleScale, scale = 48, 6, 4
+	const bandHeight = 28 + 7*titleScale + 20 + 9*scale + 28
+	band := image.Rect(0, shareCardHeight-bandHeight, shareCardWidth, shareCardHeight)
+	draw.Draw(canvas, band, &image.Uniform{shareCardShade}, image.Point{}, draw.Over)
+
+	// The place, with the weather to its right
+	top := band.Min.Y + 28
+	room := shareCardWidth - 2*margin
+	strip := postcardWeather(req)
+	stripWidth := strip.width(scale)
+	strip.draw(canvas, shareCardWidth-margin-stripWidth, top+(7*titleScale-9*scale)/2, scale, shareCardInk)
+	title := truncateText(postcardPlace(req), titleScale, room-stripWidth-8*scale)
+	drawText(canvas, title, margin, top, titleScale, shareCardInk)
+
+	// The date and time of day, with the site's name to their right
+	const brand = "SKYWEAVE"
+	top += 7*titleScale + 20 + scale
+	subtitle := postcardText(formatDateRange(req.TargetDate, req.EndDate, defaultLocale))
+	if req.TimeOfDay != "" {
+		subtitle += " · " + postcardText(req.TimeOfDay)
+	}
+	drawText(canvas, truncateText(subtitle, scale, room-textWidth(brand, scale)-8*scale), margin, top, scale, shareCardFaded)
+	drawText(canvas, brand, shareCardWidth-margin-textWidth(brand, scale), top, scale, shareCardFaded)
+	return canvas
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"archive/zip"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// resultSidecar is the context a result was generated from, downloaded as a
+// .json file next to the image so archives and other tools keep it
+type resultSidecar struct {
+	RequestID     string          `json:"request_id"`
+	RevisionID    string          `json:"revision_id"`
+	Kind          string          `json:"kind"` // initial, retry or edit
+	CreatedAt     string          `json:"created_at"`
+	Location      sidecarLocation `json:"location"`
+	TargetDate    string          `json:"target_date"`
+	EndDate       string          `json:"end_date,omitempty"`
+	TimeOfDay     string          `json:"time_of_day,omitempty"`
+	Intensity     string          `json:"intensity"`
+	Preset        string          `json:"preset,omitempty"`
+	PresetMode    string          `json:"preset_mode,omitempty"`
+	Caption       string          `json:"caption,omitempty"`
+	Prompt        string          `json:"prompt"`
+	PromptVariant string          `json:"prompt_variant,omitempty"`
+	Model         string          `json:"model"`
+	Seed          int             `json:"seed,omitempty"`
+	PredictionID  string          `json:"prediction_id,omitempty"`
+	DiffScore     *float64        `json:"diff_score,omitempty"`
+	Weather       *sidecarWeather `json:"weather,omitempty"` // nil when a preset replaced the weather
+	Timings       []StageTiming   `json:"timings"`
+}
+
+// sidecarLocation is where a result's weather is from
+type sidecarLocation struct {
+	Input     string  `json:"input"`
+	Name      string  `json:"name,omitempty"`
+	Country   string  `json:"country,omitempty"`
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+}
+
+// sidecarWeather is the weather a result's prompt was written from, along
+// with the provider responses it was read from
+type sidecarWeather struct {
+	Source      string            `json:"source"`
+	Type        string            `json:"type,omitempty"` // observed, reanalysis or forecast
+	Units       string            `json:"units"`
+	Condition   string            `json:"condition"`
+	Description string            `json:"description"`
+	Temperature float64           `json:"temperature"`
+	FeelsLike   float64           `json:"feels_like"`
+	Humidity    int               `json:"humidity"`
+	Clouds      int               `json:"clouds"`
+	WindSpeed   float64           `json:"wind_speed"`
+	Visibility  int               `json:"visibility"`
+	RainMM      float64           `json:"rain_mm"`
+	SnowMM      float64           `json:"snow_mm"`
+	Snapshots   []sidecarSnapshot `json:"snapshots"`
+}
+
+// sidecarSnapshot is one stored weather provider response
+type sidecarSnapshot struct {
+	Provider  string          `json:"provider"`
+	Units     string          `json:"units"`
+	FetchedAt string          `json:"fetched_at"`
+	Raw       json.RawMessage `json:"raw"`
+}
+
+// newResultSidecar collects the context of one revision of a request
+func newResultSidecar(req *Request, rev *Revision) (*resultSidecar, error) {
+	sidecar := &resultSidecar{
+		RequestID:  req.ID,
+		RevisionID: rev.ID,
+		Kind:       rev.Kind,
+		CreatedAt:  rev.CreatedAt,
+		Location: sidecarLocation{
+			Input:     req.LocationInput,
+			Name:      req.PlaceName(),
+			Country:   req.Country,
+			Latitude:  req.Latitude,
+			Longitude: req.Longitude,
+		},
+		TargetDate:    req.TargetDate,
+		EndDate:       req.EndDate,
+		TimeOfDay:     req.TimeOfDay,
+		Intensity:     rev.Intensity,
+		Preset:        req.Preset,
+		PresetMode:    req.PresetMode,
+		Caption:       req.Caption,
+		Prompt:        rev.Prompt,
+		PromptVariant: req.PromptVariant,
+		Model:         rev.Model,
+		Seed:          rev.Seed,
+		PredictionID:  rev.PredictionID,
+	}
+	if rev.DiffScore >= 0 {
+		sidecar.DiffScore = &rev.DiffScore
+	}
+
+	weather, err := newSidecarWeather(req)
+	if err != nil {
+		return nil, err
+	}
+	sidecar.Weather = weather
+
+	timings, err := getStageTimings(req.ID, rev.ID)
+	if err != nil {
+		return nil, err
+	}
+	sidecar.Timings = timings
+	if sidecar.Timings == nil {
+		sidecar.Timings = []StageTiming{}
+	}
+	return sidecar, nil
+}
+
+// newSidecarWeather collects a request's weather with the provider
+// responses it was read from, or nil when a preset replaced the weather
+func newSidecarWeather(req *Request) (*sidecarWeather, error) {
+	if req.WeatherSource == "" {
+		return nil, nil
+	}
+	weather := &sidecarWeather{
+		Source:      req.WeatherSource,
+		Type:        req.WeatherDataType(),
+		Units:       req.Units,
+		Condition:   req.WeatherCondition,
+		Description: req.WeatherDescription,
+		Temperature: req.Temperature,
+		FeelsLike:   req.FeelsLike,
+		Humidity:    req.Humidity,
+		Clouds:      req.Clouds,
+		WindSpeed:   req.WindSpeed,
+		Visibility:  req.Visibility,
+		RainMM:      req.RainMM,
+		SnowMM:      req.SnowMM,
+		Snapshots:   []sidecarSnapshot{},
+	}
+	// A date range stores one snapshot per day
+	days := 1
+	if dates, err := parseDateRange(req.TargetDate, req.EndDate); err == nil {
+		days = len(dates)
+	}
+	snapshots, err := getLatestWeatherSnapshots(req.ID, days)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+	for _, snapshot := range snapshots {
+		weather.Snapshots = append(weather.Snapshots, sidecarSnapshot{
+			Provider:  snapshot.Provider,
+			Units:     snapshot.Units,
+			FetchedAt: snapshot.FetchedAt,
+			Raw:       json.RawMessage(snapshot.RawJSON),
+		})
+	}
+	return weather, nil
+}
+
+// serveResultBundle sends a revision's result image and its sidecar JSON as
+// one zip, named after the request
+func serveResultBundle(w http.ResponseWriter, req *Request, rev *Revision) {
+	image, err := os.Open(rev.ResultImagePath)
+	if err != nil {
+		http.Error(w, "Image file not found", http.StatusNotFound)
+		return
+	}
+	defer image.Close()
+	info, err := image.Stat()
+	if err != nil {
+		http.Error(w, "Image file not found", http.StatusNotFound)
+		return
+	}
+
+	sidecar, err := newResultSidecar(req, rev)
+	if err != nil {
+		log.Printf("Failed to collect sidecar for revision %s: %v", rev.ID, err)
+		dbHTTPError(w, err, "Failed to load result details")
+		return
+	}
+	sidecarJSON, err := json.MarshalIndent(sidecar, "", "  ")
+	if err != nil {
+		http.Error(w, "Failed to encode result details", http.StatusInternalServerError)
+		return
+	}
+
+	name := "skyweave-" + req.ID
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.zip"`, name))
+	w.Header().Set("Cache-Control", "private, no-cache")
+
+	// The image is already compressed, so it's stored as is
+	archive := zip.NewWriter(w)
+	entry, err := archive.CreateHeader(&zip.FileHeader{
+		Name:     name + filepath.Ext(rev.ResultImagePath),
+		Method:   zip.Store,
+		Modified: info.ModTime(),
+	})
+	if err == nil {
+		_, err = io.Copy(entry, image)
+	}
+	if err == nil {
+		entry, err = archive.CreateHeader(&zip.FileHeader{
+			Name:     name + ".json",
+			Method:   zip.Deflate,
+			Modified: time.Now(),
+		})
+	}
+	if err == nil {
+		_, err = entry.Write(sidecarJSON)
+	}
+	if err == nil {
+		err = archive.Close()
+	}
+	if err != nil {
+		// Headers are sent; the client sees a truncated zip
+		log.Printf("Failed to send result bundle of revision %s: %v", rev.ID, err)
+	}
+}
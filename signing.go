@@ -0,0 +1,90 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Outputs of /image, see imageOutput
+const (
+	imageOutputImage    = "image"
+	imageOutputPostcard = "postcard"
+	imageOutputSidecar  = "sidecar"
+)
+
+// imageOutput is what an /image request asks for: the result itself, its
+// postcard (?output=postcard), or the bundle with the prompt and weather it
+// was made from (?sidecar=1)
+func imageOutput(query url.Values) string {
+	switch {
+	case query.Get("output") == "postcard":
+		return imageOutputPostcard
+	case query.Get("sidecar") == "1":
+		return imageOutputSidecar
+	default:
+		return imageOutputImage
+	}
+}
+
+// imageSignature signs one output of one revision until expires (Unix
+// seconds). The output leads the message, so a link to the image doesn't
+// unlock the postcard or the prompt and weather bundle.
+func imageSignature(key, output, requestID, revisionID string, expires int64) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%d", output, requestID, revisionID, expires)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// signedImageURL returns a link under baseURL to a revision's image that
+// works without a session until IMAGE_LINK_TTL passes, for emails and shared
+// links. Rotating IMAGE_SIGNING_KEY revokes every link handed out. It returns
+// "" when no signing key is configured.
+func signedImageURL(baseURL, requestID, revisionID string) string {
+	cfg := currentConfig()
+	if cfg.ImageSigningKey == "" {
+		return ""
+	}
+
+	expires := time.Now().Add(cfg.ImageLinkTTL).Unix()
+	query := url.Values{}
+	query.Set("rev", revisionID)
+	query.Set("expires", strconv.FormatInt(expires, 10))
+	query.Set("sig", imageSignature(cfg.ImageSigningKey, imageOutputImage, requestID, revisionID, expires))
+	return baseURL + "/image/" + url.PathEscape(requestID) + "?" + query.Encode()
+}
+
+// shareURL returns the link a completed revision is shared with: its share
+// page, which social networks show a preview of, or its CDN URL when it was
+// published and links can't be signed
+func shareURL(r *http.Request, rev *Revision) string {
+	if link := sharePageURL(r, rev); link != "" {
+		return link
+	}
+	return rev.PublicURL
+}
+
+// hasValidImageSignature reports whether r is a signed image link that
+// hasn't expired. Links are signed for one output of one revision, so they
+// can't be changed to show another result or another output of it.
+func hasValidImageSignature(r *http.Request) bool {
+	key := currentConfig().ImageSigningKey
+	query := r.URL.Query()
+	sig := query.Get("sig")
+	if key == "" || sig == "" {
+		return false
+	}
+
+	expires, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return false
+	}
+
+	want := imageSignature(key, imageOutput(query), r.PathValue("id"), query.Get("rev"), expires)
+	return hmac.Equal([]byte(sig), []byte(want))
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestImageSignatureCoversOutput(t *testing.T) {
+	previous := config.Load()
+	config.Store(&Config{ImageSigningKey: "test-key", ImageLinkTTL: time.Hour})
+	t.Cleanup(func() { config.Store(previous) })
+
+	link, err := url.Parse(signedImageURL("https://skyweave.example", "request", "revision"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		extra string
+		want  bool
+	}{
+		{"", true},
+		{"&download=1", true},
+		{"&output=postcard", false},
+		{"&sidecar=1", false},
+		{"&sidecar=1&output=postcard", false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", link.RequestURI()+tt.extra, nil)
+		r.SetPathValue("id", "request")
+		if got := hasValidImageSignature(r); got != tt.want {
+			t.Errorf("signed image link with %q accepted = %v, want %v", tt.extra, got, tt.want)
+		}
+	}
+
+	// Another revision of the request isn't covered either
+	query := link.Query()
+	query.Set("rev", "other")
+	r := httptest.NewRequest("GET", "/image/request?"+query.Encode(), nil)
+	r.SetPathValue("id", "request")
+	if hasValidImageSignature(r) {
+		t.Error("signed image link accepted for another revision")
+	}
+}
+
+func TestNotificationImageURL(t *testing.T) {
+	publicURL, _ := url.Parse("https://skyweave.example")
+	previous := config.Load()
+	config.Store(&Config{PublicURL: publicURL, ImageSigningKey: "test-key", ImageLinkTTL: time.Hour})
+	t.Cleanup(func() { config.Store(previous) })
+
+	req := &Request{ID: "request"}
+	data := newNotificationData(req, &Revision{ID: "revision", PublicURL: "https://cdn.example/revision.jpg"})
+	if data.ImageURL != "https://cdn.example/revision.jpg" {
+		t.Errorf("published image: ImageURL = %q", data.ImageURL)
+	}
+
+	data = newNotificationData(req, &Revision{ID: "revision"})
+	link, err := url.Parse(data.ImageURL)
+	if err != nil || link.Host != "skyweave.example" || link.Path != "/image/request" || link.Query().Get("sig") == "" {
+		t.Errorf("unpublished image: ImageURL = %q, want a signed link", data.ImageURL)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"log"
+	"net/http"
+)
+
+// requestStatus describes a request status for API clients
+type requestStatus struct {
+	Label    string // what the status page says
+	Percent  int    // rough progress through the pipeline
+	Terminal bool   // the request won't change status again on its own
+	Action   string // what the user has to do before it can continue, if anything
+}
+
+// requestStatuses describes every request status, in pipeline order.
+// Unknown statuses are reported as in progress.
+var requestStatuses = map[string]requestStatus{
+	"reviewing":        {Label: "Waiting for the photo to be reviewed", Percent: 5, Action: "review"},
+	"pending":          {Label: "Initializing request", Percent: 10},
+	"geocoding":        {Label: "Looking up location", Percent: 20},
+	"weather_fetching": {Label: "Fetching weather data", Percent: 35},
+	"weather_fetched":  {Label: "Waiting for the weather to be confirmed", Percent: 50, Action: "confirm"},
+	"confirmed":        {Label: "Queued for AI transformation", Percent: 60},
+	"processing":       {Label: "AI is transforming the image", Percent: 75},
+	"completed":        {Label: "Completed", Percent: 100, Terminal: true},
+	"cancelled":        {Label: "Cancelled", Percent: 100, Terminal: true},
+	"error":            {Label: "Failed", Percent: 100, Terminal: true},
+}
+
+// statusResponse is the JSON form of the status page
+type statusResponse struct {
+	RequestID  string        `json:"request_id"`
+	Status     string        `json:"status"`               // see requestStatuses
+	ErrorCode  string        `json:"error_code,omitempty"` // see errorCode* constants
+	Label      string        `json:"label"`
+	Percent    int           `json:"percent"`
+	Terminal   bool          `json:"terminal"`
+	Action     string        `json:"action,omitempty"`     // review or confirm
+	ActionURL  string        `json:"action_url,omitempty"` // page where the user takes the action
+	RevisionID string        `json:"revision_id,omitempty"`
+	ImageURL   string        `json:"image_url,omitempty"`
+	Timings    []StageTiming `json:"timings"`
+}
+
+// writeStatusJSON answers a status poll from a client that asked for JSON,
+// with the stage timings of the request and its primary (or latest) revision
+func writeStatusJSON(w http.ResponseWriter, r *http.Request, req *Request, revisionID string) {
+	status, ok := requestStatuses[req.Status]
+	if !ok {
+		status = requestStatus{Label: "Processing", Percent: 50}
+	}
+	response := statusResponse{
+		RequestID:  req.ID,
+		Status:     req.Status,
+		ErrorCode:  req.ErrorCode,
+		Label:      status.Label,
+		Percent:    status.Percent,
+		Terminal:   status.Terminal,
+		Action:     status.Action,
+		RevisionID: revisionID,
+	}
+	switch status.Action {
+	case "review":
+		response.ActionURL = absoluteURL(r, "/review/"+req.ID)
+	case "confirm":
+		response.ActionURL = absoluteURL(r, "/weather/"+req.ID)
+	}
+	if req.Status == "completed" && revisionID != "" {
+		response.ImageURL = absoluteURL(r, "/image/"+req.ID+"?rev="+revisionID)
+	}
+
+	if revisionID == "" {
+		if rev, err := getLatestRevision(req.ID); err == nil {
+			revisionID = rev.ID
+		}
+	}
+	timings, err := getStageTimings(req.ID, revisionID)
+	if err != nil {
+		log.Printf("Failed to load stage timings of request %s: %v", req.ID, err)
+	}
+	response.Timings = timings
+	if response.Timings == nil {
+		response.Timings = []StageTiming{}
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, response)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+)
+
+const (
+	// maxTagLength caps a single tag, in characters
+	maxTagLength = 32
+
+	// maxRequestTags caps how many tags a request can carry
+	maxRequestTags = 10
+)
+
+// normalizeTag turns user input like " Summer Trip " into the stored form,
+// "summer-trip": lowercase letters, digits, dashes and underscores. It
+// returns "" for input with nothing usable in it.
+func normalizeTag(raw string) string {
+	var b strings.Builder
+	for _, word := range strings.Fields(strings.ToLower(raw)) {
+		if b.Len() > 0 {
+			b.WriteByte('-')
+		}
+		for _, r := range word {
+			if unicode.IsLetter(r) || unicode.IsDigit(r) || r == '-' || r == '_' {
+				b.WriteRune(r)
+			}
+		}
+	}
+	tag := strings.Trim(b.String(), "-_")
+	if runes := []rune(tag); len(runes) > maxTagLength {
+		tag = strings.TrimRight(string(runes[:maxTagLength]), "-_")
+	}
+	return tag
+}
+
+// parseTags splits comma-separated tags, normalizing them and dropping
+// duplicates. ok is false when there are more than maxRequestTags.
+func parseTags(raw string) (tags []string, ok bool) {
+	seen := make(map[string]bool)
+	for _, part := range strings.Split(raw, ",") {
+		tag := normalizeTag(part)
+		if tag == "" || seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		tags = append(tags, tag)
+	}
+	return tags, len(tags) <= maxRequestTags
+}
+
+// searchQuery turns what a user typed into a search box into an FTS5 query
+// matching requests that contain every word, as a prefix so "port" finds
+// "portfolio". Words are quoted, so FTS5 syntax in the input is taken
+// literally. It returns "" when there's nothing to search for.
+func searchQuery(input string) string {
+	var terms []string
+	for _, word := range strings.FieldsFunc(input, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		terms = append(terms, `"`+word+`"*`)
+	}
+	return strings.Join(terms, " ")
+}
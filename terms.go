@@ -0,0 +1,168 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Consent is a user's acceptance of a version of the terms
+type Consent struct {
+	TermsVersion string `json:"terms_version"`
+	AcceptedAt   string `json:"accepted_at"`
+}
+
+// termsExemptPaths stay reachable before the terms are accepted: the terms
+// page itself, and exporting or deleting one's data, which no one should
+// have to agree to anything for
+var termsExemptPaths = []string{"/terms", "/settings/export", "/settings/delete", "/exports/"}
+
+// requireTerms sends users who haven't accepted the current TERMS_VERSION
+// to /terms first. API clients get a 403 with the terms_not_accepted code.
+func requireTerms(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		version := currentConfig().TermsVersion
+		if version == "" || isTermsExempt(r.URL.Path) {
+			next(w, r)
+			return
+		}
+
+		userID, err := getUserID(w, r)
+		if err != nil {
+			http.Error(w, "Failed to generate user ID", http.StatusInternalServerError)
+			return
+		}
+		accepted, err := hasConsented(userID, version)
+		if err != nil {
+			log.Printf("Failed to check terms acceptance of user %s: %v", userID, err)
+			dbHTTPError(w, err, "Failed to check terms acceptance")
+			return
+		}
+		if accepted {
+			next(w, r)
+			return
+		}
+
+		if strings.HasPrefix(r.URL.Path, "/api/") || wantsJSON(r) {
+			writeJSON(w, http.StatusForbidden, map[string]string{
+				"error":     "The terms of use must be accepted first",
+				"code":      "terms_not_accepted",
+				"terms_url": absoluteURL(r, "/terms"),
+			})
+			return
+		}
+
+		// Come back to the page after accepting; form posts start over
+		target := "/terms"
+		if r.Method == http.MethodGet {
+			target += "?next=" + url.QueryEscape(r.URL.RequestURI())
+		}
+		if r.Header.Get("HX-Request") == "true" {
+			w.Header().Set("HX-Redirect", target)
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		http.Redirect(w, r, target, http.StatusSeeOther)
+	}
+}
+
+// isTermsExempt reports whether a path is one of termsExemptPaths
+func isTermsExempt(path string) bool {
+	for _, exempt := range termsExemptPaths {
+		if path == exempt || (strings.HasSuffix(exempt, "/") && strings.HasPrefix(path, exempt)) {
+			return true
+		}
+	}
+	return false
+}
+
+// termsNext is where to go after accepting the terms: the local path given
+// in ?next=, or home
+func termsNext(r *http.Request) string {
+	next := r.FormValue("next")
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/"
+	}
+	return next
+}
+
+// termsHandler asks the user to accept the current terms, mentioning the
+// version they accepted before if the terms changed since
+func termsHandler(w http.ResponseWriter, r *http.Request) {
+	cfg := currentConfig()
+	if cfg.TermsVersion == "" {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	userID, err := getUserID(w, r)
+	if err != nil {
+		http.Error(w, "Failed to generate user ID", http.StatusInternalServerError)
+		return
+	}
+	renderTerms(w, r, userID, http.StatusOK, "")
+}
+
+// renderTerms renders the terms page, with an error if acceptance was missing
+func renderTerms(w http.ResponseWriter, r *http.Request, userID string, status int, errMsg string) {
+	cfg := currentConfig()
+	consents, err := getConsents(userID)
+	if err != nil {
+		log.Printf("Failed to load consents of user %s: %v", userID, err)
+	}
+
+	data := struct {
+		Locale          string
+		Version         string
+		TermsURL        string
+		PrivacyURL      string
+		PreviousVersion string
+		Next            string
+		Error           string
+	}{
+		Locale:     loadUserSettings(r, userID).Locale,
+		Version:    cfg.TermsVersion,
+		TermsURL:   cfg.TermsURL,
+		PrivacyURL: cfg.PrivacyURL,
+		Next:       termsNext(r),
+		Error:      errMsg,
+	}
+	if len(consents) > 0 {
+		data.PreviousVersion = consents[len(consents)-1].TermsVersion
+	}
+
+	w.WriteHeader(status)
+	templates.ExecuteTemplate(w, "terms.html", data)
+}
+
+// acceptTermsHandler records the user's acceptance of the current terms and
+// continues to the page they were on
+func acceptTermsHandler(w http.ResponseWriter, r *http.Request) {
+	cfg := currentConfig()
+	if cfg.TermsVersion == "" {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	userID, err := getUserID(w, r)
+	if err != nil {
+		http.Error(w, "Failed to generate user ID", http.StatusInternalServerError)
+		return
+	}
+
+	// The version shown is checked, so a page left open over a change
+	// doesn't accept terms the user never saw
+	if r.FormValue("accept") == "" || r.FormValue("version") != cfg.TermsVersion {
+		renderTerms(w, r, userID, http.StatusUnprocessableEntity,
+			"Please read and accept the terms to continue.")
+		return
+	}
+
+	if err := recordConsent(userID, cfg.TermsVersion); err != nil {
+		log.Printf("Failed to record consent of user %s: %v", userID, err)
+		dbHTTPError(w, err, "Failed to record your acceptance")
+		return
+	}
+	log.Printf("User %s accepted terms version %s", userID, cfg.TermsVersion)
+
+	http.Redirect(w, r, termsNext(r), http.StatusSeeOther)
+}
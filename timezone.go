@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+)
+
+// lookupUTCOffset finds a location's current UTC offset in seconds. The
+// geocoder doesn't report timezones, so this asks OpenWeather's current
+// weather API, which does; if that fails the offset is estimated from the
+// longitude.
+func lookupUTCOffset(lat, lon float64) (int, error) {
+	apiURL := fmt.Sprintf("https://api.openweathermap.org/data/2.5/weather?lat=%f&lon=%f&appid=%s",
+		lat, lon, currentConfig().OpenWeatherAPIKey)
+
+	resp, err := openWeatherClient.Get(apiURL)
+	if err != nil {
+		return approximateUTCOffset(lon), fmt.Errorf("timezone lookup failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var current struct {
+		Timezone *int `json:"timezone"`
+	}
+	if resp.StatusCode != http.StatusOK {
+		return approximateUTCOffset(lon), fmt.Errorf("timezone lookup error: %s", resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&current); err != nil || current.Timezone == nil {
+		return approximateUTCOffset(lon), fmt.Errorf("timezone lookup returned no timezone")
+	}
+	return *current.Timezone, nil
+}
+
+// approximateUTCOffset estimates the UTC offset from the solar time at a
+// longitude, rounded to the hour
+func approximateUTCOffset(lon float64) int {
+	return int(math.Round(lon/15)) * 3600
+}
+
+// locationZone returns a fixed zone for a UTC offset, named like "UTC+05:30"
+func locationZone(offset int) *time.Location {
+	return time.FixedZone(formatUTCOffset(offset), offset)
+}
+
+// formatUTCOffset formats an offset in seconds as "UTC", "UTC+13:00" or "UTC-03:30"
+func formatUTCOffset(offset int) string {
+	if offset == 0 {
+		return "UTC"
+	}
+	sign := '+'
+	if offset < 0 {
+		sign = '-'
+		offset = -offset
+	}
+	return fmt.Sprintf("UTC%c%02d:%02d", sign, offset/3600, offset%3600/60)
+}
+
+// daysBetween counts calendar days from one date to another, ignoring the
+// time of day. Both dates are read in their own locations.
+func daysBetween(from, to time.Time) int {
+	a := time.Date(from.Year(), from.Month(), from.Day(), 0, 0, 0, 0, time.UTC)
+	b := time.Date(to.Year(), to.Month(), to.Day(), 0, 0, 0, 0, time.UTC)
+	return int(b.Sub(a).Hours() / 24)
+}
+
+// UTCOffsetLabel names the timezone the request's target date is read in
+func (r *Request) UTCOffsetLabel() string {
+	return formatUTCOffset(r.UTCOffset)
+}
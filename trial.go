@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+// Quota is how many generations a visitor has left before their limit resets
+type Quota struct {
+	Limit     int       `json:"limit"`
+	Used      int       `json:"used"`
+	Remaining int       `json:"remaining"`
+	ResetsAt  time.Time `json:"resets_at"`
+}
+
+// Exhausted reports whether no generations are left
+func (q *Quota) Exhausted() bool {
+	return q.Remaining == 0
+}
+
+// trialEnabled reports whether anonymous visitors can start a trial. Without
+// an access passphrase everyone has full access anyway.
+func trialEnabled() bool {
+	cfg := currentConfig()
+	return cfg.TrialMode && cfg.AccessPassphrase != ""
+}
+
+// isTrialVisitor reports whether the request comes with a trial session
+// rather than full access
+func isTrialVisitor(r *http.Request) bool {
+	if !trialEnabled() {
+		return false
+	}
+	return requestSession(r) == sessionTrial
+}
+
+// trialDayStart is when the current trial day began. Trial limits reset at
+// midnight UTC.
+func trialDayStart(now time.Time) time.Time {
+	now = now.UTC()
+	return time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// trialQuota returns a trial visitor's generations left today, nil for
+// visitors with full access, who have no limit
+func trialQuota(r *http.Request, userID string) (*Quota, error) {
+	if !isTrialVisitor(r) {
+		return nil, nil
+	}
+
+	now := time.Now()
+	dayStart := trialDayStart(now)
+	used, err := countTrialGenerations(userID, clientIP(r), dayStart)
+	if err != nil {
+		return nil, err
+	}
+	limit := currentConfig().TrialDailyLimit
+	return &Quota{
+		Limit:     limit,
+		Used:      used,
+		Remaining: max(limit-used, 0),
+		ResetsAt:  dayStart.AddDate(0, 0, 1),
+	}, nil
+}
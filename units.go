@@ -0,0 +1,165 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Measurement systems weather can be fetched in. OpenWeather returns
+// temperatures in °C or °F and wind speed in m/s or mph; visibility and
+// precipitation are metric either way.
+const (
+	unitsMetric   = "metric"
+	unitsImperial = "imperial"
+)
+
+// isValidUnits checks that units names a supported measurement system
+func isValidUnits(units string) bool {
+	return units == unitsMetric || units == unitsImperial
+}
+
+// preferredUnits returns the measurement system the user last picked,
+// defaulting to metric
+func preferredUnits(r *http.Request) string {
+	if cookie, err := r.Cookie("skyweave_units"); err == nil && isValidUnits(cookie.Value) {
+		return cookie.Value
+	}
+	return unitsMetric
+}
+
+// setPreferredUnits remembers the user's measurement system for later requests
+func setPreferredUnits(w http.ResponseWriter, units string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     "skyweave_units",
+		Value:    units,
+		Path:     "/",
+		MaxAge:   365 * 86400, // 1 year
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// fahrenheitToCelsius converts a temperature from °F to °C
+func fahrenheitToCelsius(f float64) float64 {
+	return (f - 32) * 5 / 9
+}
+
+// mphToMetersPerSecond converts a wind speed from mph to m/s
+func mphToMetersPerSecond(mph float64) float64 {
+	return mph * 0.44704
+}
+
+// Temperatures and wind speeds are kept to one decimal everywhere: rounded
+// once when weather is parsed or aggregated, so the value stored with a
+// request, shown on its pages and written into its prompt is the same number,
+// and the vocabulary buckets of the prompt see exactly what the user sees.
+// Precipitation keeps its precision, since a trace of drizzle rounded to zero
+// would drop it from the prompt; formatPrecipitation shows it.
+const measurementDecimals = 1
+
+// roundMeasurement rounds a temperature, speed or amount to
+// measurementDecimals, halves away from zero
+func roundMeasurement(value float64) float64 {
+	scale := math.Pow10(measurementDecimals)
+	rounded := math.Round(value*scale) / scale
+	if rounded == 0 {
+		return 0 // no "-0.0"
+	}
+	return rounded
+}
+
+// formatMeasurement writes a measurement with measurementDecimals decimals
+func formatMeasurement(value float64) string {
+	return strconv.FormatFloat(roundMeasurement(value), 'f', measurementDecimals, 64)
+}
+
+// formatPrecipitation writes an amount of rain or snow in mm, showing
+// amounts too small for one decimal as "<0.1" rather than "0.0"
+func formatPrecipitation(mm float64) string {
+	if mm > 0 && roundMeasurement(mm) == 0 {
+		return "<0.1mm"
+	}
+	return formatMeasurement(mm) + "mm"
+}
+
+// roundMeasurements rounds the weather's temperatures and wind speed in place
+func (w *WeatherData) roundMeasurements() {
+	w.Temp = roundMeasurement(w.Temp)
+	w.FeelsLike = roundMeasurement(w.FeelsLike)
+	w.WindSpeed = roundMeasurement(w.WindSpeed)
+}
+
+// metric returns the weather converted to metric units. The prompt
+// vocabulary and the model always work in °C and m/s, whatever the user sees.
+// Converted values are rounded again, so the prompt states what it was worded from.
+func (w *WeatherData) metric() *WeatherData {
+	if w.Units != unitsImperial {
+		return w
+	}
+	converted := *w
+	converted.Temp = fahrenheitToCelsius(w.Temp)
+	converted.FeelsLike = fahrenheitToCelsius(w.FeelsLike)
+	converted.WindSpeed = mphToMetersPerSecond(w.WindSpeed)
+	converted.Units = unitsMetric
+	converted.roundMeasurements()
+	return &converted
+}
+
+// tempUnit is the temperature unit of a measurement system
+func tempUnit(units string) string {
+	if units == unitsImperial {
+		return "°F"
+	}
+	return "°C"
+}
+
+// windUnit is the wind speed unit of a measurement system
+func windUnit(units string) string {
+	if units == unitsImperial {
+		return "mph"
+	}
+	return "m/s"
+}
+
+// TempUnit is the temperature unit the request's weather is stored in
+func (r *Request) TempUnit() string {
+	return tempUnit(r.Units)
+}
+
+// Precipitation describes the request's rain or snow for display, like
+// "Rain: 3.2mm", or is empty when there was none
+func (r *Request) Precipitation() string {
+	switch {
+	case r.RainMM > 0:
+		return "Rain: " + formatPrecipitation(r.RainMM)
+	case r.SnowMM > 0:
+		return "Snow: " + formatPrecipitation(r.SnowMM)
+	}
+	return ""
+}
+
+// parsePrecipitation reads rain and snow back from the text Precipitation
+// writes, for databases that stored the text. A trace ("<0.1mm") counts as 0.05mm.
+func parsePrecipitation(text string) (rain, snow float64) {
+	kind, amount, ok := strings.Cut(text, ": ")
+	if !ok {
+		return 0, 0
+	}
+	amount = strings.TrimSuffix(amount, "mm")
+	value, err := strconv.ParseFloat(strings.TrimPrefix(amount, "<"), 64)
+	if err != nil {
+		return 0, 0
+	}
+	if strings.HasPrefix(amount, "<") {
+		value /= 2
+	}
+	switch kind {
+	case "Rain":
+		return value, 0
+	case "Snow":
+		return 0, value
+	}
+	return 0, 0
+}
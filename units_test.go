@@ -0,0 +1,146 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestRoundMeasurement(t *testing.T) {
+	tests := []struct {
+		value, want float64
+	}{
+		{12.34, 12.3},
+		{12.36, 12.4},
+		{2.25, 2.3}, // halves away from zero
+		{-2.25, -2.3},
+		{0.05, 0.1},
+		{-0.05, -0.1},
+		{1.35, 1.4},
+		{-0.04, 0},
+		{0, 0},
+	}
+	for _, tt := range tests {
+		got := roundMeasurement(tt.value)
+		if got != tt.want {
+			t.Errorf("roundMeasurement(%v) = %v, want %v", tt.value, got, tt.want)
+		}
+		if got == 0 && math.Signbit(got) {
+			t.Errorf("roundMeasurement(%v) = -0", tt.value)
+		}
+	}
+}
+
+func TestFormatMeasurement(t *testing.T) {
+	tests := []struct {
+		value float64
+		want  string
+	}{
+		{12.34, "12.3"},
+		{2.25, "2.3"},
+		{-2.25, "-2.3"},
+		{10, "10.0"},
+		{-0.04, "0.0"}, // never "-0.0"
+		{-0.05, "-0.1"},
+		{math.Copysign(0, -1), "0.0"},
+	}
+	for _, tt := range tests {
+		if got := formatMeasurement(tt.value); got != tt.want {
+			t.Errorf("formatMeasurement(%v) = %q, want %q", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestFormatPrecipitation(t *testing.T) {
+	tests := []struct {
+		mm   float64
+		want string
+	}{
+		{0, "0.0mm"},
+		{0.01, "<0.1mm"}, // a trace isn't shown as none
+		{0.049, "<0.1mm"},
+		{0.05, "0.1mm"},
+		{3.25, "3.3mm"},
+		{12.345, "12.3mm"},
+	}
+	for _, tt := range tests {
+		if got := formatPrecipitation(tt.mm); got != tt.want {
+			t.Errorf("formatPrecipitation(%v) = %q, want %q", tt.mm, got, tt.want)
+		}
+	}
+}
+
+func TestWeatherDataMetric(t *testing.T) {
+	metric := &WeatherData{Temp: 14.6, WindSpeed: 3.2, Units: unitsMetric}
+	if got := metric.metric(); got != metric {
+		t.Errorf("metric() of metric weather returned a copy")
+	}
+
+	tests := []struct {
+		temp, feelsLike, wind         float64 // °F and mph
+		wantTemp, wantFeels, wantWind float64 // °C and m/s, re-rounded
+	}{
+		{50, 33.1, 10, 10, 0.6, 4.5},
+		{31.9, 32.05, 0, -0.1, 0, 0},
+		{-40, -40, 100, -40, -40, 44.7},
+		{98.6, 100.4, 2.3, 37, 38, 1},
+	}
+	for _, tt := range tests {
+		w := &WeatherData{Temp: tt.temp, FeelsLike: tt.feelsLike, WindSpeed: tt.wind, Units: unitsImperial}
+		got := w.metric()
+		if got.Temp != tt.wantTemp || got.FeelsLike != tt.wantFeels || got.WindSpeed != tt.wantWind {
+			t.Errorf("metric() of %v°F (feels %v°F), %v mph = %v°C (feels %v°C), %v m/s, want %v°C (feels %v°C), %v m/s",
+				tt.temp, tt.feelsLike, tt.wind, got.Temp, got.FeelsLike, got.WindSpeed,
+				tt.wantTemp, tt.wantFeels, tt.wantWind)
+		}
+		if math.Signbit(got.FeelsLike) && got.FeelsLike == 0 {
+			t.Errorf("metric() of %v°F feels like -0°C", tt.feelsLike)
+		}
+		if got.Units != unitsMetric {
+			t.Errorf("metric() units = %q", got.Units)
+		}
+		if w.Units != unitsImperial || w.Temp != tt.temp {
+			t.Errorf("metric() changed the weather it converted")
+		}
+	}
+}
+
+// TestPromptTemperatureMatchesDisplay checks that the prompt states the
+// temperature the pages show, to the decimal and to the whole degree
+func TestPromptTemperatureMatchesDisplay(t *testing.T) {
+	useTestConfig(t)
+
+	weathers := []*WeatherData{
+		{Temp: 14.6, Units: unitsMetric},
+		{Temp: 14.5, Units: unitsMetric},
+		{Temp: -4.5, Units: unitsMetric},
+		{Temp: -0.04, Units: unitsMetric},
+		{Temp: 31.9, Units: unitsImperial},
+		{Temp: 50, Units: unitsImperial},
+		{Temp: 98.6, Units: unitsImperial},
+	}
+	for _, w := range weathers {
+		w.roundMeasurements()
+		shown := formatTemp(w.metric().Temp, unitsMetric)
+
+		control := generatePrompt(w, "Oslo, NO", "", "", "request-a", "control")
+		if !strings.Contains(control, "a temperature of "+shown+" ") {
+			t.Errorf("%v %s: control prompt doesn't state %s:\n%s", w.Temp, w.Units, shown, control)
+		}
+
+		// Whole degrees round what's shown, halves away from zero
+		value, err := strconv.ParseFloat(strings.TrimSuffix(shown, "°C"), 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		whole := strconv.Itoa(int(math.Round(value))) + "°C"
+		cinematic := generatePrompt(w, "Oslo, NO", "", "", "request-a", "cinematic")
+		if !strings.Contains(cinematic, " day at "+whole+".") {
+			t.Errorf("%v %s: cinematic prompt doesn't state %s:\n%s", w.Temp, w.Units, whole, cinematic)
+		}
+		if fields := promptFieldsFor(PromptInput{Weather: w.metric()}); fields.WholeTemp() != int(math.Round(value)) {
+			t.Errorf("%v %s: WholeTemp = %d, shown as %s", w.Temp, w.Units, fields.WholeTemp(), shown)
+		}
+	}
+}
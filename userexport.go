@@ -0,0 +1,640 @@
+package main
+
+import (
+	"archive/zip"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DataExport is an archive of everything stored about a user, built in the
+// background for them to download
+type DataExport struct {
+	ID           string
+	UserID       string
+	Status       string // dataExportBuilding, dataExportReady or dataExportFailed
+	Path         string // the zip, once ready
+	Size         int64
+	ErrorMessage string
+	CreatedAt    string
+	CompletedAt  string
+	ExpiresAt    string // when the archive and its link are deleted, UTC
+}
+
+// Data export statuses
+const (
+	dataExportBuilding = "building"
+	dataExportReady    = "ready"
+	dataExportFailed   = "error"
+)
+
+// dataExportTTL is how long an export can be downloaded
+const dataExportTTL = 48 * time.Hour
+
+// dataExportStaleAfter is when an export still building is given up on, as
+// the instance building it must have stopped
+const dataExportStaleAfter = time.Hour
+
+// Stale reports whether the export was building for so long it won't finish
+func (e *DataExport) Stale() bool {
+	if e.Status != dataExportBuilding {
+		return false
+	}
+	created, err := parseSQLiteTime(e.CreatedAt)
+	return err == nil && time.Since(created) > dataExportStaleAfter
+}
+
+// SizeLabel is the archive's size for people
+func (e *DataExport) SizeLabel() string {
+	if e.Size < 1<<20 {
+		return fmt.Sprintf("%d KB", (e.Size+1023)>>10)
+	}
+	return fmt.Sprintf("%.1f MB", float64(e.Size)/(1<<20))
+}
+
+// TrialGeneration is a request made in trial mode
+type TrialGeneration struct {
+	RequestID string `json:"request_id"`
+	IP        string `json:"ip"`
+	CreatedAt string `json:"created_at"`
+}
+
+// personalData is the JSON document of a data export. Paths of photos and
+// results are relative to the root of the archive.
+type personalData struct {
+	Format           string             `json:"format"`
+	UserID           string             `json:"user_id"`
+	ExportedAt       string             `json:"exported_at"`
+	Settings         *exportedSettings  `json:"settings"` // nil if never saved
+	SavedLocations   []exportedPlace    `json:"saved_locations"`
+	Requests         []exportedRequest  `json:"requests"`
+	Schedules        []exportedSchedule `json:"schedules"`
+	Draft            *exportedDraft     `json:"draft,omitempty"`
+	TrialGenerations []TrialGeneration  `json:"trial_generations"`
+	Consents         []Consent          `json:"consents"`
+}
+
+// dataExportFormat names the layout of personalData
+const dataExportFormat = "skyweave-data-export/1"
+
+type exportedSettings struct {
+	Units             string `json:"units"`
+	Locale            string `json:"locale"`
+	DefaultLocationID string `json:"default_location_id,omitempty"`
+	Email             string `json:"email,omitempty"`
+	Model             string `json:"model,omitempty"`
+	Preset            string `json:"preset,omitempty"`
+	Intensity         string `json:"intensity"`
+}
+
+type exportedPlace struct {
+	ID        string  `json:"id"`
+	Label     string  `json:"label"`
+	Name      string  `json:"name"`
+	Country   string  `json:"country,omitempty"`
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+}
+
+type exportedRequest struct {
+	ID              string             `json:"id"`
+	Status          string             `json:"status"`
+	CreatedAt       string             `json:"created_at"`
+	ParentRequestID string             `json:"parent_request_id,omitempty"`
+	BatchID         string             `json:"batch_id,omitempty"`
+	Location        sidecarLocation    `json:"location"`
+	TargetDate      string             `json:"target_date"`
+	EndDate         string             `json:"end_date,omitempty"`
+	TimeOfDay       string             `json:"time_of_day,omitempty"`
+	Intensity       string             `json:"intensity"`
+	Preset          string             `json:"preset,omitempty"`
+	PresetMode      string             `json:"preset_mode,omitempty"`
+	Caption         string             `json:"caption,omitempty"`
+	Prompt          string             `json:"prompt,omitempty"`
+	Weather         *sidecarWeather    `json:"weather,omitempty"`
+	Tags            []string           `json:"tags"`
+	Photo           string             `json:"photo,omitempty"`
+	Revisions       []exportedRevision `json:"revisions"`
+}
+
+type exportedRevision struct {
+	ID               string   `json:"id"`
+	ParentRevisionID string   `json:"parent_revision_id,omitempty"`
+	Kind             string   `json:"kind"`
+	Prompt           string   `json:"prompt"`
+	Seed             int      `json:"seed,omitempty"`
+	Intensity        string   `json:"intensity"`
+	Model            string   `json:"model"`
+	Status           string   `json:"status"`
+	Primary          bool     `json:"primary"`
+	CreatedAt        string   `json:"created_at"`
+	Rating           int      `json:"rating,omitempty"`
+	Issues           []string `json:"issues,omitempty"`
+	Image            string   `json:"image,omitempty"`
+	Postcard         string   `json:"postcard,omitempty"`
+}
+
+type exportedSchedule struct {
+	ID              string `json:"id"`
+	SourceRequestID string `json:"source_request_id"`
+	RunDate         string `json:"run_date"`
+	Summary         string `json:"summary,omitempty"`
+	Status          string `json:"status"`
+	RequestID       string `json:"request_id,omitempty"`
+	CreatedAt       string `json:"created_at"`
+}
+
+type exportedDraft struct {
+	Fields  map[string]string `json:"fields"`
+	SavedAt string            `json:"saved_at"`
+}
+
+// archiveFile is a stored file copied into a data export
+type archiveFile struct {
+	Name string // path inside the archive
+	Path string // path on disk
+}
+
+// collectPersonalData gathers a user's data and the files that go with it
+func collectPersonalData(userID string) (*personalData, []archiveFile, error) {
+	data := &personalData{
+		Format:           dataExportFormat,
+		UserID:           userID,
+		ExportedAt:       time.Now().UTC().Format(time.RFC3339),
+		SavedLocations:   []exportedPlace{},
+		Requests:         []exportedRequest{},
+		Schedules:        []exportedSchedule{},
+		TrialGenerations: []TrialGeneration{},
+		Consents:         []Consent{},
+	}
+	var files []archiveFile
+
+	settings, err := getUserSettings(userID)
+	if err == nil {
+		data.Settings = &exportedSettings{
+			Units:             settings.Units,
+			Locale:            settings.Locale,
+			DefaultLocationID: settings.DefaultLocationID,
+			Email:             settings.Email,
+			Model:             settings.Model,
+			Preset:            settings.Preset,
+			Intensity:         settings.Intensity,
+		}
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		return nil, nil, err
+	}
+
+	locations, err := getSavedLocations(userID)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, loc := range locations {
+		data.SavedLocations = append(data.SavedLocations, exportedPlace{
+			ID:        loc.ID,
+			Label:     loc.Label,
+			Name:      loc.LocationName,
+			Country:   loc.Country,
+			Latitude:  loc.Latitude,
+			Longitude: loc.Longitude,
+		})
+	}
+
+	schedules, err := getSchedules(userID)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, s := range schedules {
+		data.Schedules = append(data.Schedules, exportedSchedule{
+			ID:              s.ID,
+			SourceRequestID: s.SourceRequestID,
+			RunDate:         s.RunDate,
+			Summary:         s.Summary,
+			Status:          s.Status,
+			RequestID:       s.RequestID,
+			CreatedAt:       s.CreatedAt,
+		})
+	}
+
+	draft, err := getDraft(userID)
+	if err == nil {
+		data.Draft = &exportedDraft{Fields: map[string]string{}, SavedAt: draft.UpdatedAt}
+		for name := range draft.Fields {
+			data.Draft.Fields[name] = draft.Fields.Get(name)
+		}
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		return nil, nil, err
+	}
+
+	// A negative limit is no limit to SQLite
+	requests, err := getRecentRequests(userID, -1)
+	if err != nil {
+		return nil, nil, err
+	}
+	photos := map[string]string{} // re-runs share their original's photo
+	for _, req := range requests {
+		exported, err := exportRequest(req)
+		if err != nil {
+			return nil, nil, err
+		}
+		if req.ImagePath != "" && fileExists(req.ImagePath) {
+			name, ok := photos[req.ImagePath]
+			if !ok {
+				name = "photos/" + req.ID + filepath.Ext(req.ImagePath)
+				photos[req.ImagePath] = name
+				files = append(files, archiveFile{Name: name, Path: req.ImagePath})
+			}
+			exported.Photo = name
+		}
+
+		revisions, err := getRevisions(req.ID)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, rev := range revisions {
+			rating, issues := getFeedback(rev.ID)
+			exportedRev := exportedRevision{
+				ID:               rev.ID,
+				ParentRevisionID: rev.ParentRevisionID,
+				Kind:             rev.Kind,
+				Prompt:           rev.Prompt,
+				Seed:             rev.Seed,
+				Intensity:        rev.Intensity,
+				Model:            rev.Model,
+				Status:           rev.Status,
+				Primary:          rev.IsPrimary,
+				CreatedAt:        rev.CreatedAt,
+				Rating:           rating,
+				Issues:           issues,
+			}
+			if rev.ResultImagePath != "" && fileExists(rev.ResultImagePath) {
+				exportedRev.Image = "results/" + rev.ID + filepath.Ext(rev.ResultImagePath)
+				files = append(files, archiveFile{Name: exportedRev.Image, Path: rev.ResultImagePath})
+			}
+			if rev.PostcardPath != "" && fileExists(rev.PostcardPath) {
+				exportedRev.Postcard = "results/" + rev.ID + "-postcard" + filepath.Ext(rev.PostcardPath)
+				files = append(files, archiveFile{Name: exportedRev.Postcard, Path: rev.PostcardPath})
+			}
+			exported.Revisions = append(exported.Revisions, exportedRev)
+		}
+		data.Requests = append(data.Requests, *exported)
+	}
+
+	trials, err := getTrialGenerations(userID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if trials != nil {
+		data.TrialGenerations = trials
+	}
+
+	consents, err := getConsents(userID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if consents != nil {
+		data.Consents = consents
+	}
+	return data, files, nil
+}
+
+// exportRequest converts a request to its exported form, without files or revisions
+func exportRequest(req *Request) (*exportedRequest, error) {
+	weather, err := newSidecarWeather(req)
+	if err != nil {
+		return nil, err
+	}
+	tags, err := getRequestTags(req.ID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+	if tags == nil {
+		tags = []string{}
+	}
+	return &exportedRequest{
+		ID:              req.ID,
+		Status:          req.Status,
+		CreatedAt:       req.CreatedAt,
+		ParentRequestID: req.ParentRequestID,
+		BatchID:         req.BatchID,
+		Location: sidecarLocation{
+			Input:     req.LocationInput,
+			Name:      req.PlaceName(),
+			Country:   req.Country,
+			Latitude:  req.Latitude,
+			Longitude: req.Longitude,
+		},
+		TargetDate: req.TargetDate,
+		EndDate:    req.EndDate,
+		TimeOfDay:  req.TimeOfDay,
+		Intensity:  req.Intensity,
+		Preset:     req.Preset,
+		PresetMode: req.PresetMode,
+		Caption:    req.Caption,
+		Prompt:     req.AIPrompt,
+		Weather:    weather,
+		Tags:       tags,
+		Revisions:  []exportedRevision{},
+	}, nil
+}
+
+// fileExists reports whether a stored file is still on disk
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// writeDataExport writes a user's data export to path: the JSON document
+// and the photos and results it refers to
+func writeDataExport(userID, path string) (int64, error) {
+	data, files, err := collectPersonalData(userID)
+	if err != nil {
+		return 0, err
+	}
+	document, err := json.MarshalIndent(data, "", "  ")
+	if err != nil {
+		return 0, err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return 0, err
+	}
+	err = writeFileAtomic(path, func(out io.Writer) error {
+		archive := zip.NewWriter(out)
+		entry, err := archive.CreateHeader(&zip.FileHeader{Name: "skyweave-data.json", Method: zip.Deflate, Modified: time.Now()})
+		if err == nil {
+			_, err = entry.Write(document)
+		}
+		for _, file := range files {
+			if err != nil {
+				break
+			}
+			err = addArchiveFile(archive, file)
+		}
+		if err == nil {
+			err = archive.Close()
+		}
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// addArchiveFile copies a stored image into the archive. Images are already
+// compressed, so they're stored as is.
+func addArchiveFile(archive *zip.Writer, file archiveFile) error {
+	in, err := os.Open(file.Path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	entry, err := archive.CreateHeader(&zip.FileHeader{Name: file.Name, Method: zip.Store, Modified: info.ModTime()})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(entry, in)
+	return err
+}
+
+// buildDataExport builds a requested export and records the outcome,
+// emailing the user its link when it's ready and they have an address
+func buildDataExport(export *DataExport) {
+	path := filepath.Join(dataDir, "exports", export.ID+".zip")
+	size, err := writeDataExport(export.UserID, path)
+	if err != nil {
+		log.Printf("Failed to build data export %s: %v", export.ID, err)
+		export.Status, export.ErrorMessage = dataExportFailed, err.Error()
+	} else {
+		export.Status, export.Path, export.Size = dataExportReady, path, size
+	}
+	if err := finishDataExport(export); err != nil {
+		log.Printf("Failed to save data export %s: %v", export.ID, err)
+		return
+	}
+	if export.Status == dataExportReady {
+		log.Printf("Built data export %s for user %s (%d bytes)", export.ID, export.UserID, size)
+		notifyDataExportReady(export)
+	}
+}
+
+// notifyDataExportReady emails the export's signed link. It needs
+// PUBLIC_URL, since there's no request to build the link from, and
+// IMAGE_SIGNING_KEY, since the link has to work without a session.
+func notifyDataExportReady(export *DataExport) {
+	cfg := currentConfig()
+	if !emailConfigured() || cfg.PublicURL == nil || cfg.ImageSigningKey == "" {
+		return
+	}
+	settings, err := getUserSettings(export.UserID)
+	if err != nil || settings.Email == "" {
+		return
+	}
+	link := cfg.PublicURL.String() + dataExportPath(export)
+	body := fmt.Sprintf(`<p>Your SkyWeave data export is ready: <a href="%s">download it</a> (%s).</p>
+<p>The link works until %s UTC, after which the export is deleted.</p>`,
+		template.HTMLEscapeString(link), export.SizeLabel(), export.ExpiresAt)
+	if err := sendEmail([]string{settings.Email}, "Your SkyWeave data export is ready", body); err != nil {
+		log.Printf("Failed to email data export %s: %v", export.ID, err)
+	}
+}
+
+// exportSignature signs a data export's download until expires (Unix seconds)
+func exportSignature(key, exportID string, expires int64) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	fmt.Fprintf(mac, "export\n%s\n%d", exportID, expires)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// dataExportPath is the download link of an export, signed until the
+// export expires when IMAGE_SIGNING_KEY is set. Without a key, the link
+// only works for the user the export belongs to.
+func dataExportPath(export *DataExport) string {
+	path := "/exports/" + url.PathEscape(export.ID)
+	key := currentConfig().ImageSigningKey
+	expires, err := parseSQLiteTime(export.ExpiresAt)
+	if key == "" || err != nil {
+		return path
+	}
+	query := url.Values{}
+	query.Set("expires", strconv.FormatInt(expires.Unix(), 10))
+	query.Set("sig", exportSignature(key, export.ID, expires.Unix()))
+	return path + "?" + query.Encode()
+}
+
+// hasValidExportSignature reports whether r is a signed export link that
+// hasn't expired
+func hasValidExportSignature(r *http.Request) bool {
+	key := currentConfig().ImageSigningKey
+	query := r.URL.Query()
+	sig := query.Get("sig")
+	if key == "" || sig == "" {
+		return false
+	}
+
+	expires, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return false
+	}
+	return hmac.Equal([]byte(sig), []byte(exportSignature(key, r.PathValue("id"), expires)))
+}
+
+// startDataExportCleanup deletes expired exports every hour
+func startDataExportCleanup() {
+	ticker := time.NewTicker(time.Hour)
+	goSafe("", func() {
+		cleanupDataExports()
+		for range ticker.C {
+			cleanupDataExports()
+		}
+	})
+}
+
+// cleanupDataExports deletes the archives and rows of expired exports
+func cleanupDataExports() {
+	exports, err := getExpiredDataExports()
+	if err != nil {
+		log.Printf("Failed to load expired data exports: %v", err)
+		return
+	}
+	for _, export := range exports {
+		if export.Path != "" {
+			if err := os.Remove(export.Path); err != nil && !os.IsNotExist(err) {
+				log.Printf("Failed to delete data export %s: %v", export.ID, err)
+				continue
+			}
+		}
+		if err := deleteDataExport(export.ID); err != nil {
+			log.Printf("Failed to delete data export %s: %v", export.ID, err)
+		}
+	}
+}
+
+// dataExportHandler shows the user's latest export: a button to request one,
+// its progress, or its download link
+func dataExportHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserID(w, r)
+	if err != nil {
+		http.Error(w, "Failed to generate user ID", http.StatusInternalServerError)
+		return
+	}
+
+	export, err := getLatestDataExport(userID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		log.Printf("Failed to load data export of user %s: %v", userID, err)
+		dbHTTPError(w, err, "Failed to load your data export")
+		return
+	}
+
+	data := struct {
+		Locale      string
+		Export      *DataExport
+		DownloadURL string
+		Signed      bool
+	}{
+		Locale: loadUserSettings(r, userID).Locale,
+		Export: export,
+		Signed: currentConfig().ImageSigningKey != "",
+	}
+	if export != nil && export.Status == dataExportReady {
+		data.DownloadURL = absoluteURL(r, dataExportPath(export))
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	templates.ExecuteTemplate(w, "data_export.html", data)
+}
+
+// requestDataExportHandler starts building an export of the user's data,
+// unless one is already being built
+func requestDataExportHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserID(w, r)
+	if err != nil {
+		http.Error(w, "Failed to generate user ID", http.StatusInternalServerError)
+		return
+	}
+
+	latest, err := getLatestDataExport(userID)
+	if err == nil && latest.Status == dataExportBuilding && !latest.Stale() {
+		http.Redirect(w, r, "/settings/export", http.StatusSeeOther)
+		return
+	}
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		log.Printf("Failed to load data export of user %s: %v", userID, err)
+		dbHTTPError(w, err, "Failed to start your data export")
+		return
+	}
+
+	id, err := generateID(16)
+	if err != nil {
+		http.Error(w, "Failed to generate export ID", http.StatusInternalServerError)
+		return
+	}
+	export := &DataExport{
+		ID:        id,
+		UserID:    userID,
+		Status:    dataExportBuilding,
+		ExpiresAt: sqliteTime(time.Now().Add(dataExportTTL)),
+	}
+	if err := createDataExport(export); err != nil {
+		log.Printf("Failed to create data export for user %s: %v", userID, err)
+		dbHTTPError(w, err, "Failed to start your data export")
+		return
+	}
+	goSafe("", func() { buildDataExport(export) })
+
+	http.Redirect(w, r, "/settings/export", http.StatusSeeOther)
+}
+
+// downloadDataExportHandler sends an export's archive, to anyone with a
+// signed link or to the user it belongs to
+func downloadDataExportHandler(w http.ResponseWriter, r *http.Request) {
+	export, err := getDataExport(r.PathValue("id"))
+	if err != nil {
+		lookupError(w, err, "Export")
+		return
+	}
+	if !hasValidExportSignature(r) {
+		userID, err := getUserID(w, r)
+		if err != nil || userID != export.UserID {
+			http.NotFound(w, r)
+			return
+		}
+	}
+
+	expires, err := parseSQLiteTime(export.ExpiresAt)
+	if err == nil && time.Now().After(expires) {
+		http.Error(w, "This export has expired", http.StatusGone)
+		return
+	}
+	if export.Status != dataExportReady {
+		http.Error(w, "This export isn't ready", http.StatusNotFound)
+		return
+	}
+
+	name := "skyweave-data-" + strings.SplitN(export.CreatedAt, " ", 2)[0] + ".zip"
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, name))
+	serveMediaFile(w, r, export.Path)
+}
@@ -3,12 +3,22 @@ package main
 import (
 	"crypto/rand"
 	"encoding/hex"
+	"encoding/json"
+	"fmt"
 	"io"
+	"log"
+	"mime"
 	"mime/multipart"
+	"net/http"
 	"os"
 	"path/filepath"
+	"time"
 )
 
+// dataDir holds the database, uploads and results. It's set from DATA_DIR
+// at startup, so containers can point it at a mounted volume.
+var dataDir = "./data"
+
 // generateID generates a random hex string of specified length
 func generateID(length int) (string, error) {
 	bytes := make([]byte, length)
@@ -18,27 +28,113 @@ func generateID(length int) (string, error) {
 	return hex.EncodeToString(bytes), nil
 }
 
-// saveUploadedFile saves an uploaded file to the data/uploads directory
-func saveUploadedFile(file multipart.File, header *multipart.FileHeader, requestID string) (string, error) {
-	uploadDir := filepath.Join("./data", "uploads")
-	if err := os.MkdirAll(uploadDir, 0755); err != nil {
+// saveUploadedFile sanitizes an uploaded image and stores it as a blob.
+// The stored file is always a freshly encoded JPEG; the raw upload bytes are never kept.
+func saveUploadedFile(file multipart.File, limits UploadLimits) (string, error) {
+	data, err := sanitizeImage(file, limits)
+	if err != nil {
 		return "", err
 	}
+	return storeBlob(data, ".jpg")
+}
 
-	// Create filename: requestID_originalname
-	ext := filepath.Ext(header.Filename)
-	filename := requestID + ext
-	filepath := filepath.Join(uploadDir, filename)
+// writeFileAtomic writes a file through write into a temporary file next to
+// path, then renames it into place. Readers see the old file or the complete
+// new one, never a partial one, even if the process dies mid-write.
+func writeFileAtomic(path string, write func(io.Writer) error) error {
+	file, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tmp := file.Name()
+	defer os.Remove(tmp)
 
-	dst, err := os.Create(filepath)
+	err = write(file)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
 	if err != nil {
-		return "", err
+		return err
+	}
+	// CreateTemp makes files only the owner can read
+	if err := os.Chmod(tmp, 0644); err != nil {
+		return err
 	}
-	defer dst.Close()
+	return os.Rename(tmp, path)
+}
 
-	if _, err = io.Copy(dst, file); err != nil {
-		return "", err
+// removeStaleTempFiles deletes the temporary files writeFileAtomic leaves
+// behind when the process dies mid-write. Recent ones are kept, since another
+// instance sharing DATA_DIR may still be writing them.
+func removeStaleTempFiles() {
+	for _, dir := range []string{filepath.Join("blobs", "*", "*"), "maps", "exports"} {
+		matches, err := filepath.Glob(filepath.Join(dataDir, dir, ".*.tmp"))
+		if err != nil {
+			continue
+		}
+		for _, path := range matches {
+			info, err := os.Stat(path)
+			if err != nil || time.Since(info.ModTime()) < time.Hour {
+				continue
+			}
+			if err := os.Remove(path); err != nil {
+				log.Printf("Failed to remove temporary file %s: %v", path, err)
+			}
+		}
+	}
+}
+
+// writeJSON encodes v as a JSON response with the given status code
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Failed to encode JSON response: %v", err)
+	}
+}
+
+// serveMediaFile serves a stored image (or other result file) with an
+// explicit type, length and validator. http.ServeContent answers Range and
+// If-Range requests, so mobile browsers and download managers can resume and
+// players can seek. Responses aren't cached without revalidating unless the
+// caller set a Cache-Control of its own.
+func serveMediaFile(w http.ResponseWriter, r *http.Request, path string) {
+	file, err := os.Open(path)
+	if err != nil {
+		http.Error(w, "Image file not found", http.StatusNotFound)
+		return
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil || info.IsDir() {
+		http.Error(w, "Image file not found", http.StatusNotFound)
+		return
 	}
 
-	return filepath, nil
+	// Stored files have trusted extensions; never let the browser sniff
+	contentType := mime.TypeByExtension(filepath.Ext(path))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	// Every revision has its own file, so name, size and time identify it
+	w.Header().Set("ETag", fmt.Sprintf(`"%s-%x-%x"`, filepath.Base(path), info.Size(), info.ModTime().UnixNano()))
+	if w.Header().Get("Cache-Control") == "" {
+		w.Header().Set("Cache-Control", "private, no-cache")
+	}
+
+	http.ServeContent(w, r, filepath.Base(path), info.ModTime(), file)
+}
+
+// envOrDefault returns the environment variable value, or def if it is unset or empty
+func envOrDefault(key, def string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return def
 }
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// maxLocationLength caps the characters of location input
+const maxLocationLength = 200
+
+// timesOfDay are the lighting choices of the start form, empty keeping the photo's own
+var timesOfDay = []string{"dawn", "morning", "noon", "afternoon", "dusk", "night"}
+
+// FieldErrors maps form fields to what's wrong with their values, for showing
+// next to each field or returning to API clients
+type FieldErrors map[string]string
+
+// FieldSuggestions maps fields to a valid value close to the rejected one,
+// like the nearest date weather is available for
+type FieldSuggestions map[string]string
+
+// fieldLabels names the start form's fields in the error summary, in the
+// order they appear on the form
+var fieldLabels = []struct{ Field, Label string }{
+	{"photo", "Photo"},
+	{"location_mode", "Location type"},
+	{"location", "Location"},
+	{"date", "Target date"},
+	{"end_date", "End date"},
+	{"range_mode", "Range"},
+	{"time_of_day", "Time of day"},
+	{"preset", "Scenario"},
+	{"preset_mode", "Scenario mode"},
+	{"intensity", "Intensity"},
+	{"units", "Units"},
+	{"captcha", "CAPTCHA"},
+}
+
+// Summary lists the errors as "Label: message" in form order, for the list
+// at the top of the form
+func (e FieldErrors) Summary() []string {
+	var summary []string
+	for _, f := range fieldLabels {
+		if message, ok := e[f.Field]; ok {
+			summary = append(summary, f.Label+": "+message)
+		}
+	}
+	return summary
+}
+
+// add records a field's error, keeping the first one found
+func (e FieldErrors) add(field, message string) {
+	if _, ok := e[field]; !ok {
+		e[field] = message
+	}
+}
+
+// submissionForm is the validated start form, apart from the photo
+type submissionForm struct {
+	Location     string
+	LocationMode string
+	Dates        []time.Time
+	StartDate    string
+	TimeOfDay    string
+	Intensity    string
+	Units        string
+	Preset       string
+	PresetMode   string
+	RangeMode    string
+	Suggestions  FieldSuggestions // valid values for some of the rejected fields
+}
+
+// validateSubmission checks every field of the start form except the photo,
+// collecting all problems rather than stopping at the first. Trial visitors
+// can't submit ranges. The form is only usable when errs is empty.
+func validateSubmission(r *http.Request, trial bool) (*submissionForm, FieldErrors) {
+	errs := FieldErrors{}
+	form := &submissionForm{
+		Location:     strings.TrimSpace(r.FormValue("location")),
+		LocationMode: r.FormValue("location_mode"),
+		StartDate:    r.FormValue("date"),
+		TimeOfDay:    r.FormValue("time_of_day"),
+		Units:        r.FormValue("units"),
+		Preset:       r.FormValue("preset"),
+		RangeMode:    r.FormValue("range_mode"),
+		Suggestions:  FieldSuggestions{},
+	}
+
+	if form.LocationMode == "" {
+		form.LocationMode = locationModeAuto
+	}
+	validateLocation(errs, form.Location, form.LocationMode)
+	validateTimeOfDay(errs, form.TimeOfDay)
+
+	var ok bool
+	if form.Intensity, ok = parseIntensity(r.FormValue("intensity")); !ok {
+		errs.add("intensity", "Choose subtle, natural or dramatic")
+	}
+
+	if form.Units == "" {
+		form.Units = preferredUnits(r)
+	}
+	if !isValidUnits(form.Units) {
+		errs.add("units", "Choose metric or imperial")
+	}
+
+	// A preset scenario is used instead of, or blended with, the real weather
+	endDate := r.FormValue("end_date")
+	if form.Preset != "" {
+		if preset, err := getPreset(form.Preset); err != nil || !preset.Enabled {
+			errs.add("preset", "This scenario isn't available")
+		}
+		form.PresetMode = r.FormValue("preset_mode")
+		if form.PresetMode == "" {
+			form.PresetMode = presetModeReplace
+		}
+		if !isValidPresetMode(form.PresetMode) {
+			errs.add("preset_mode", "Choose instead of or blended with the real weather")
+		}
+		// Without real weather a range would only repeat the same image
+		if form.PresetMode == presetModeReplace {
+			endDate = ""
+		}
+	}
+
+	form.Dates = validateDates(errs, form.Suggestions, form.StartDate, endDate)
+	if form.RangeMode == "" {
+		form.RangeMode = rangeModeSummary
+	}
+	if form.RangeMode != rangeModeSummary && form.RangeMode != rangeModeDaily {
+		errs.add("range_mode", "Choose one image or one image per day")
+	}
+	if trial && len(form.Dates) > 1 {
+		errs.add("end_date", "Date ranges aren't available in the free trial")
+	}
+
+	return form, errs
+}
+
+// validateLocation checks location input and the mode it's read in
+func validateLocation(errs FieldErrors, location, mode string) {
+	switch {
+	case !isValidLocationMode(mode):
+		errs.add("location_mode", "Choose a city name, postal code or coordinates")
+	case location == "":
+		errs.add("location", "Enter a location")
+	case utf8.RuneCountInString(location) > maxLocationLength:
+		errs.add("location", fmt.Sprintf("Locations can be at most %d characters", maxLocationLength))
+	case mode == locationModeCoords:
+		if _, _, ok := parseCoordinates(location); !ok {
+			errs.add("location", `Enter coordinates as "lat,lon", like 51.5,-0.12`)
+		}
+	}
+}
+
+// validateTimeOfDay checks a time of day, empty keeping the photo's own
+func validateTimeOfDay(errs FieldErrors, timeOfDay string) {
+	if timeOfDay != "" && !slices.Contains(timesOfDay, timeOfDay) {
+		errs.add("time_of_day", "Choose one of "+strings.Join(timesOfDay, ", ")+", or leave it empty")
+	}
+}
+
+// validatePhoto checks the uploaded photo's presence, size and type before it's
+// read. Its content is checked when it's decoded.
+func validatePhoto(errs FieldErrors, header *multipart.FileHeader, limits UploadLimits) {
+	switch {
+	case header == nil:
+		errs.add("photo", "Choose a photo or enter a link to one")
+	case header.Size > limits.MaxBytes:
+		errs.add("photo", "Photos can be at most "+humanFileSize(limits.MaxBytes))
+	case !limits.AllowsFile(header.Filename):
+		errs.add("photo", "Please upload a "+limits.FormatList()+" image")
+	}
+}
+
+// validateDates checks a date or date range against weatherWindow. Dates
+// outside it get the nearest day inside as a suggestion.
+func validateDates(errs FieldErrors, suggest FieldSuggestions, start, end string) []time.Time {
+	if start == "" {
+		errs.add("date", "Choose a date")
+		return nil
+	}
+	dates, err := parseDateRange(start, end)
+	if err != nil {
+		field := "end_date"
+		if _, startErr := time.Parse(time.DateOnly, start); startErr != nil {
+			field = "date"
+		}
+		errs.add(field, upperFirst(err.Error()))
+		return nil
+	}
+
+	first, last := weatherWindow(time.Now())
+	outside := func(field string, date time.Time) {
+		nearest := nearestInWindow(date, first, last)
+		reason := fmt.Sprintf("Forecasts only reach %d days ahead", maxForecastDays)
+		if date.Before(first) {
+			reason = "Weather records start on " + first.Format("January 2, 2006")
+		}
+		errs.add(field, fmt.Sprintf("%s; the nearest available day is %s", reason, nearest.Format("January 2, 2006")))
+		suggest[field] = nearest.Format(time.DateOnly)
+	}
+	if dates[0].Before(first) || dates[0].After(last) {
+		outside("date", dates[0])
+		return nil
+	}
+	if end := dates[len(dates)-1]; end.After(last) {
+		outside("end_date", end)
+		return nil
+	}
+	return dates
+}
+
+// upperFirst capitalizes the first letter of an error message for display
+func upperFirst(s string) string {
+	if s == "" {
+		return s
+	}
+	return strings.ToUpper(s[:1]) + s[1:]
+}
+
+// wantsJSON reports whether a client asked for a JSON response rather than a page
+func wantsJSON(r *http.Request) bool {
+	accept := r.Header.Get("Accept")
+	return strings.Contains(accept, "application/json") || strings.Contains(accept, "+json")
+}
+
+// rejectSubmission answers a submission with invalid fields: with the start
+// form, filled in with what was entered and each error next to its field, or
+// with the errors as JSON for clients that asked for it
+func rejectSubmission(w http.ResponseWriter, r *http.Request, userID string, errs FieldErrors,
+	suggestions FieldSuggestions, status int) {
+	if wantsJSON(r) {
+		writeFieldErrors(w, errs, suggestions, status)
+		return
+	}
+	// Keep what was entered in case the user leaves instead of fixing it
+	keepDraft(userID, r.Form)
+
+	var upload *multipart.FileHeader
+	if r.MultipartForm != nil && len(r.MultipartForm.File["photo"]) > 0 {
+		upload = r.MultipartForm.File["photo"][0]
+	}
+	renderStart(w, r, userID, &startFormState{
+		Values:      r.Form,
+		Errors:      errs,
+		Suggestions: suggestions,
+		Upload:      upload,
+		Status:      status,
+	})
+}
+
+// writeFieldErrors answers an invalid submission as JSON, naming each field
+// that needs fixing
+func writeFieldErrors(w http.ResponseWriter, errs FieldErrors, suggestions FieldSuggestions, status int) {
+	if len(suggestions) == 0 {
+		suggestions = nil
+	}
+	writeJSON(w, status, struct {
+		Error       string           `json:"error"`
+		Code        string           `json:"code"`
+		Fields      FieldErrors      `json:"fields"`
+		Suggestions FieldSuggestions `json:"suggestions,omitempty"`
+	}{"Some fields need to be fixed", "invalid_fields", errs, suggestions})
+}
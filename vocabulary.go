@@ -0,0 +1,272 @@
+package main
+
+import (
+	"hash/fnv"
+	"math"
+	"strings"
+)
+
+// phraseBucket maps values below Max to a set of interchangeable phrasings.
+// An empty variant list means nothing is added to the prompt for that range.
+type phraseBucket struct {
+	Max      float64
+	Variants []string
+}
+
+// conditionEntry phrases a group of OpenWeather condition codes
+type conditionEntry struct {
+	Codes    []int
+	Variants []string
+}
+
+// temperatureVocabulary describes the temperature in °C
+var temperatureVocabulary = []phraseBucket{
+	{Max: 0, Variants: []string{"freezing cold", "bitterly cold", "icy cold"}},
+	{Max: 10, Variants: []string{"cold", "chilly", "crisp and cold"}},
+	{Max: 20, Variants: []string{"cool", "mild and cool", "fresh"}},
+	{Max: 28, Variants: []string{"warm", "pleasantly warm", "balmy"}},
+	{Max: math.Inf(1), Variants: []string{"hot", "sweltering", "scorching"}},
+}
+
+// cloudVocabulary describes cloud coverage in percent
+var cloudVocabulary = []phraseBucket{
+	{Max: 20, Variants: []string{"clear skies", "open, cloudless skies", "bright clear skies"}},
+	{Max: 50, Variants: []string{"partly cloudy skies", "scattered clouds drifting across the sky", "a sky dotted with clouds"}},
+	{Max: 80, Variants: []string{"mostly cloudy skies", "heavy banks of cloud", "a largely clouded-over sky"}},
+	{Max: math.Inf(1), Variants: []string{"overcast skies", "a solid grey overcast", "a thick, unbroken cloud layer"}},
+}
+
+// visibilityVocabulary describes visibility in meters
+var visibilityVocabulary = []phraseBucket{
+	{Max: 1000, Variants: []string{"with very poor visibility", "with the distance almost completely obscured"}},
+	{Max: 5000, Variants: []string{"with reduced visibility", "with distant details softened and hazy"}},
+	{Max: math.Inf(1)},
+}
+
+// rainVocabulary describes rainfall in mm
+var rainVocabulary = []phraseBucket{
+	{Max: 2.5, Variants: []string{"light rain", "a gentle drizzle of rain", "light, scattered raindrops"}},
+	{Max: 10, Variants: []string{"moderate rain", "steady rain", "a persistent rainfall"}},
+	{Max: math.Inf(1), Variants: []string{"heavy rain", "a torrential downpour", "driving, heavy rain"}},
+}
+
+// snowVocabulary describes snowfall in mm
+var snowVocabulary = []phraseBucket{
+	{Max: 2.5, Variants: []string{"light snow", "a dusting of light snowflakes", "sparse, drifting snowflakes"}},
+	{Max: 10, Variants: []string{"moderate snow", "steady snowfall", "a soft, continuous snowfall"}},
+	{Max: math.Inf(1), Variants: []string{"heavy snow", "a thick, heavy snowfall", "dense, blizzard-like snow"}},
+}
+
+// windVocabulary describes wind speed in m/s
+var windVocabulary = []phraseBucket{
+	{Max: 5},
+	{Max: 10, Variants: []string{"with moderate winds", "with a steady breeze"}},
+	{Max: math.Inf(1), Variants: []string{"with strong winds", "with gusty, powerful winds"}},
+}
+
+// timeOfDayVocabulary describes the lighting for each selectable time of day
+var timeOfDayVocabulary = map[string]string{
+	"dawn":      "The scene should be captured during dawn/sunrise with warm golden light on the horizon and soft, diffused lighting.",
+	"morning":   "The scene should be captured in the morning (8-11 AM) with fresh, bright daylight and clear shadows.",
+	"noon":      "The scene should be captured at noon with overhead sunlight creating short, harsh shadows and maximum brightness.",
+	"afternoon": "The scene should be captured in the afternoon (2-5 PM) with warm, angled sunlight and longer shadows.",
+	"dusk":      "The scene should be captured during dusk/sunset with warm orange-pink hues in the sky and soft, glowing light.",
+	"night":     "The scene should be captured at night with dark skies, artificial lighting or moonlight, and deep shadows.",
+	"":          "Maintain the original time of day and lighting angle from the photo.",
+}
+
+// conditionVocabulary covers every OpenWeather condition code
+// (https://openweathermap.org/weather-conditions)
+var conditionVocabulary = []conditionEntry{
+	// Group 2xx: Thunderstorm
+	{Codes: []int{200, 230}, Variants: []string{
+		"a thunderstorm with light rain and distant lightning",
+		"a rumbling thunderstorm with a light shower and flashes of lightning",
+	}},
+	{Codes: []int{201, 231}, Variants: []string{
+		"a thunderstorm with rain and bright forks of lightning",
+		"a stormy sky with rain and lightning flashing through dark clouds",
+	}},
+	{Codes: []int{202, 232}, Variants: []string{
+		"a violent thunderstorm with heavy rain and vivid lightning strikes",
+		"a fierce electrical storm with pouring rain under black clouds",
+	}},
+	{Codes: []int{210, 211}, Variants: []string{
+		"a dry thunderstorm with dark, brooding clouds and lightning",
+		"a thundery sky with towering storm clouds and lightning",
+	}},
+	{Codes: []int{212, 221}, Variants: []string{
+		"a heavy, ragged thunderstorm with dramatic lightning across a dark sky",
+		"an intense storm front with jagged lightning and turbulent clouds",
+	}},
+
+	// Group 3xx: Drizzle
+	{Codes: []int{300, 310}, Variants: []string{
+		"a light drizzle with damp surfaces",
+		"a fine, misty drizzle",
+	}},
+	{Codes: []int{301, 311, 313, 321}, Variants: []string{
+		"a steady drizzle with wet, glistening surfaces",
+		"persistent drizzle and showers leaving everything damp",
+	}},
+	{Codes: []int{302, 312, 314}, Variants: []string{
+		"a heavy drizzle with puddles forming",
+		"dense drizzle soaking the scene",
+	}},
+
+	// Group 5xx: Rain
+	{Codes: []int{500}, Variants: []string{
+		"light rain with wet, reflective surfaces",
+		"a soft, light rain",
+	}},
+	{Codes: []int{501}, Variants: []string{
+		"moderate rain with puddles and reflections",
+		"steady rain with rain-darkened surfaces",
+	}},
+	{Codes: []int{502, 503, 504}, Variants: []string{
+		"very heavy rain with sheets of water and streaming surfaces",
+		"an intense downpour with visible rain streaks",
+	}},
+	{Codes: []int{511}, Variants: []string{
+		"freezing rain coating surfaces with a thin glaze of ice",
+		"icy rain leaving a glassy sheen on every surface",
+	}},
+	{Codes: []int{520, 521, 522, 531}, Variants: []string{
+		"passing rain showers with breaks between bursts of rain",
+		"shower clouds releasing bursts of rain",
+	}},
+
+	// Group 6xx: Snow
+	{Codes: []int{600, 620}, Variants: []string{
+		"light snow with a thin white dusting on the ground",
+		"gentle snowflakes drifting down",
+	}},
+	{Codes: []int{601, 621}, Variants: []string{
+		"snowfall with a fresh white layer covering the ground",
+		"steady snow blanketing the scene",
+	}},
+	{Codes: []int{602, 622}, Variants: []string{
+		"heavy snow with deep drifts and limited visibility",
+		"a heavy snowstorm burying the landscape",
+	}},
+	{Codes: []int{611, 612, 613}, Variants: []string{
+		"sleet with icy pellets and slushy ground",
+		"wet, icy sleet falling onto slushy surfaces",
+	}},
+	{Codes: []int{615, 616}, Variants: []string{
+		"a mix of rain and snow with slushy ground",
+		"wet snow mixed with rain",
+	}},
+
+	// Group 7xx: Atmosphere
+	{Codes: []int{701}, Variants: []string{
+		"a light mist hanging in the air",
+		"soft mist veiling the distance",
+	}},
+	{Codes: []int{711}, Variants: []string{
+		"smoky air with a brownish, muted light",
+		"a smoke-filled sky dimming the sunlight",
+	}},
+	{Codes: []int{721}, Variants: []string{
+		"a hazy atmosphere with washed-out distant details",
+		"a soft haze diffusing the light",
+	}},
+	{Codes: []int{731, 761}, Variants: []string{
+		"dusty air with a yellowish tint",
+		"swirling dust clouding the view",
+	}},
+	{Codes: []int{741}, Variants: []string{
+		"thick fog obscuring the background",
+		"dense, low-lying fog swallowing distant objects",
+	}},
+	{Codes: []int{751}, Variants: []string{
+		"blowing sand and an orange-tinted sky",
+		"a sandstorm haze filling the air",
+	}},
+	{Codes: []int{762}, Variants: []string{
+		"volcanic ash darkening the sky",
+		"a grey, ash-laden atmosphere",
+	}},
+	{Codes: []int{771}, Variants: []string{
+		"sudden squalls with bending trees and driven rain",
+		"violent gusts sweeping through the scene",
+	}},
+	{Codes: []int{781}, Variants: []string{
+		"a tornado funnel cloud on the horizon under an ominous sky",
+		"a menacing tornado with swirling debris in the distance",
+	}},
+
+	// Group 800: Clear
+	{Codes: []int{800}, Variants: []string{
+		"clear, sunny weather",
+		"bright sunshine under a clear sky",
+	}},
+
+	// Group 80x: Clouds
+	{Codes: []int{801}, Variants: []string{
+		"a few small clouds in an otherwise clear sky",
+		"fair weather with a handful of clouds",
+	}},
+	{Codes: []int{802}, Variants: []string{
+		"scattered clouds with patches of sunshine",
+		"broken sunlight between scattered clouds",
+	}},
+	{Codes: []int{803}, Variants: []string{
+		"broken cloud cover with only occasional sun",
+		"mostly cloudy weather with brief sunny breaks",
+	}},
+	{Codes: []int{804}, Variants: []string{
+		"a fully overcast, grey sky",
+		"flat, diffuse light under complete overcast",
+	}},
+}
+
+// conditionPhrases indexes conditionVocabulary by condition code
+var conditionPhrases = make(map[int][]string)
+
+func init() {
+	for _, entry := range conditionVocabulary {
+		for _, code := range entry.Codes {
+			conditionPhrases[code] = entry.Variants
+		}
+	}
+}
+
+// pickVariant deterministically picks one phrasing for a request, so the same
+// request always produces the same prompt while different requests vary
+func pickVariant(variants []string, seed, slot string) string {
+	if len(variants) == 0 {
+		return ""
+	}
+	h := fnv.New32a()
+	h.Write([]byte(seed + "|" + slot))
+	return variants[int(h.Sum32()%uint32(len(variants)))]
+}
+
+// bucketPhrase picks a phrasing from the first bucket whose Max exceeds value
+func bucketPhrase(buckets []phraseBucket, value float64, seed, slot string) string {
+	for _, bucket := range buckets {
+		if value < bucket.Max {
+			return pickVariant(bucket.Variants, seed, slot)
+		}
+	}
+	return ""
+}
+
+// conditionPhrase describes the weather condition, falling back to the
+// provider's condition/description text for unknown codes
+func conditionPhrase(weatherData *WeatherData, seed string) string {
+	if variants, ok := conditionPhrases[weatherData.ConditionID]; ok {
+		return pickVariant(variants, seed, "condition")
+	}
+
+	condition := weatherData.Condition
+	if condition == "" {
+		condition = "clear"
+	}
+	description := weatherData.Description
+	if description == "" {
+		description = "clear sky"
+	}
+	return strings.ToLower(condition) + " (" + description + ")"
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// Run with -update to rewrite the golden files after changing the vocabulary
+// or the prompt templates on purpose, then review the diff.
+var updateGolden = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// useTestConfig publishes a configuration with the built-in prompt templates,
+// restoring the previous one when the test ends
+func useTestConfig(t *testing.T) {
+	t.Helper()
+	templates, err := loadPromptTemplates("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := config.Load()
+	config.Store(&Config{
+		PromptTemplates: templates,
+		PromptVariants:  []string{defaultPromptVariant},
+		PromptGenerator: rulePromptGenerator{},
+	})
+	t.Cleanup(func() { config.Store(previous) })
+}
+
+// checkGolden compares got with testdata/name, or rewrites it with -update
+func checkGolden(t *testing.T, name, got string) {
+	t.Helper()
+	path := filepath.Join("testdata", name)
+	if *updateGolden {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(got), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("%v (run go test -update to create it)", err)
+	}
+	if got != string(want) {
+		gotLines, wantLines := strings.Split(got, "\n"), strings.Split(string(want), "\n")
+		for i := 0; i < max(len(gotLines), len(wantLines)); i++ {
+			var g, w string
+			if i < len(gotLines) {
+				g = gotLines[i]
+			}
+			if i < len(wantLines) {
+				w = wantLines[i]
+			}
+			if g != w {
+				t.Fatalf("%s differs at line %d:\n got: %s\nwant: %s\n(run go test -update if the change is intended)",
+					path, i+1, g, w)
+			}
+		}
+	}
+}
+
+// conditionCodes lists every code in conditionVocabulary, in order
+func conditionCodes() []int {
+	var codes []int
+	for _, entry := range conditionVocabulary {
+		codes = append(codes, entry.Codes...)
+	}
+	sort.Ints(codes)
+	return codes
+}
+
+// goldenWeather is the weather the condition prompts are generated for:
+// mild, partly cloudy and calm, so the condition phrase stands out
+func goldenWeather(code int) *WeatherData {
+	return &WeatherData{
+		Temp:        14.6,
+		Humidity:    70,
+		Clouds:      40,
+		Visibility:  10000,
+		WindSpeed:   3.2,
+		ConditionID: code,
+		Units:       unitsMetric,
+	}
+}
+
+func TestConditionVocabularyCodesAreUnique(t *testing.T) {
+	seen := map[int]bool{}
+	for _, entry := range conditionVocabulary {
+		if len(entry.Variants) == 0 {
+			t.Errorf("codes %v have no phrasing", entry.Codes)
+		}
+		for _, code := range entry.Codes {
+			if seen[code] {
+				t.Errorf("code %d is phrased twice", code)
+			}
+			seen[code] = true
+		}
+	}
+}
+
+func TestConditionPromptsGolden(t *testing.T) {
+	useTestConfig(t)
+
+	// Two requests per code, so both phrasings of most codes are covered
+	var b strings.Builder
+	for _, code := range conditionCodes() {
+		for _, seed := range []string{"request-a", "request-b"} {
+			prompt := generatePrompt(goldenWeather(code), "Oslo, NO", "", "", seed, defaultPromptVariant)
+			fmt.Fprintf(&b, "%d %s\n%s\n\n", code, seed, prompt)
+		}
+	}
+	checkGolden(t, "prompts/conditions.golden", b.String())
+}
+
+func TestPromptVariantsGolden(t *testing.T) {
+	useTestConfig(t)
+
+	scenarios := []struct {
+		name      string
+		weather   *WeatherData
+		timeOfDay string
+		scene     string
+	}{
+		{"freezing snow at dawn", &WeatherData{Temp: -4.5, Clouds: 95, Visibility: 800, WindSpeed: 11.3,
+			ConditionID: 602, Snow: 12.4, Units: unitsMetric}, "dawn", "a mountain hut"},
+		{"hot clear noon", &WeatherData{Temp: 31.05, Clouds: 0, Visibility: 10000, WindSpeed: 1.2,
+			ConditionID: 800, Units: unitsMetric}, "noon", ""},
+		{"imperial drizzle at dusk", &WeatherData{Temp: 50, Clouds: 70, Visibility: 4000, WindSpeed: 15,
+			ConditionID: 301, Rain: 0.04, Units: unitsImperial}, "dusk", "a harbor with boats"},
+		{"unknown code", &WeatherData{Temp: 20, Clouds: 20, Visibility: 10000, WindSpeed: 5,
+			ConditionID: 999, Condition: "Rain", Description: "odd rain", Units: unitsMetric}, "", ""},
+	}
+
+	variants := make([]string, 0, len(promptVariantTemplates))
+	for name := range promptVariantTemplates {
+		variants = append(variants, name)
+	}
+	sort.Strings(variants)
+
+	var b strings.Builder
+	for _, variant := range variants {
+		for _, s := range scenarios {
+			prompt := generatePrompt(s.weather, "Bergen, NO", s.timeOfDay, s.scene, "request-"+s.name, variant)
+			fmt.Fprintf(&b, "%s / %s\n%s\n\n", variant, s.name, prompt)
+		}
+	}
+	checkGolden(t, "prompts/variants.golden", b.String())
+}
+
+func TestPickVariantIsDeterministic(t *testing.T) {
+	variants := []string{"one", "two", "three"}
+	seeds := []string{"0123456789abcdef", "fedcba9876543210", "request-a", ""}
+	for _, seed := range seeds {
+		first := pickVariant(variants, seed, "condition")
+		for i := 0; i < 10; i++ {
+			if got := pickVariant(variants, seed, "condition"); got != first {
+				t.Fatalf("pickVariant(%q) picked %q, then %q", seed, first, got)
+			}
+		}
+	}
+
+	// The same request always words a prompt the same way
+	useTestConfig(t)
+	for _, code := range conditionCodes() {
+		first := generatePrompt(goldenWeather(code), "Oslo, NO", "noon", "", "0123456789abcdef", defaultPromptVariant)
+		if again := generatePrompt(goldenWeather(code), "Oslo, NO", "noon", "", "0123456789abcdef", defaultPromptVariant); again != first {
+			t.Fatalf("code %d: prompt changed between calls:\n%s\n%s", code, first, again)
+		}
+	}
+
+	// Different requests see every phrasing
+	for _, entry := range conditionVocabulary {
+		var seen []string
+		for i := 0; i < 64 && len(seen) < len(entry.Variants); i++ {
+			phrase := pickVariant(entry.Variants, fmt.Sprintf("request-%d", i), "condition")
+			if !slices.Contains(seen, phrase) {
+				seen = append(seen, phrase)
+			}
+		}
+		if len(seen) != len(entry.Variants) {
+			t.Errorf("codes %v: only %d of %d phrasings picked across 64 requests", entry.Codes, len(seen), len(entry.Variants))
+		}
+	}
+
+	if got := pickVariant(nil, "request-a", "wind"); got != "" {
+		t.Errorf("pickVariant(nil) = %q, want nothing", got)
+	}
+}
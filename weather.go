@@ -6,20 +6,10 @@ import (
 	"io"
 	"net/http"
 	"net/url"
-	"os"
+	"strconv"
 	"time"
 )
 
-var openWeatherAPIKey string
-
-func init() {
-	openWeatherAPIKey = os.Getenv("OPENWEATHER_API_KEY")
-	if openWeatherAPIKey == "" {
-		// For development, allow empty key (will skip API calls)
-		fmt.Println("Warning: OPENWEATHER_API_KEY not set")
-	}
-}
-
 // GeocodingResult represents a geocoding API response
 type GeocodingResult struct {
 	Name    string            `json:"name"`
@@ -30,6 +20,27 @@ type GeocodingResult struct {
 	Local   map[string]string `json:"local_names,omitempty"`
 }
 
+// LocationSuggestion represents a geocoding candidate offered by the autocomplete endpoint
+type LocationSuggestion struct {
+	Label   string  `json:"label"`
+	Name    string  `json:"name"`
+	State   string  `json:"state,omitempty"`
+	Country string  `json:"country"`
+	Lat     float64 `json:"lat"`
+	Lon     float64 `json:"lon"`
+	// Name variants of the place by language, see placeNames
+	Local map[string]string `json:"local_names,omitempty"`
+}
+
+// How long provider responses are cached. Places and past weather don't
+// change; forecasts and the current day's observations do.
+const (
+	geocodeCacheTTL      = 24 * time.Hour
+	pastWeatherCacheTTL  = 7 * 24 * time.Hour
+	todayWeatherCacheTTL = 15 * time.Minute
+	forecastCacheTTL     = time.Hour
+)
+
 // HistoricalWeatherResponse represents historical weather data from History API
 type HistoricalWeatherResponse struct {
 	Message string `json:"message"`
@@ -115,40 +126,133 @@ type WeatherData struct {
 	Visibility  int
 	WindSpeed   float64
 	WindDeg     int
+	ConditionID int // OpenWeather condition code, e.g. 500 for light rain
 	Condition   string
 	Description string
 	Rain        float64
 	Snow        float64
+	Units       string // unitsMetric or unitsImperial, as requested from the provider
+	Provider    string // weather snapshot source, see weatherProvider* constants
+	Raw         []byte `json:"-"` // unparsed provider response
 }
 
-// geocodeLocation converts location string to coordinates
-// Supports: "city,country", "zipcode,country", or just "city"
-func geocodeLocation(location string) (*GeocodingResult, error) {
-	if openWeatherAPIKey == "" {
+// Weather snapshot providers, one per response format
+const (
+	weatherProviderHistory  = "openweather_history"
+	weatherProviderForecast = "openweather_forecast_daily"
+	weatherProviderArchive  = "open_meteo_archive"
+)
+
+// Kinds of weather data the providers return
+const (
+	weatherTypeObserved   = "observed"   // measured at weather stations
+	weatherTypeReanalysis = "reanalysis" // modelled from past observations
+	weatherTypeForecast   = "forecast"   // predicted
+)
+
+// weatherDataType returns the kind of data a weather provider returns
+func weatherDataType(provider string) string {
+	switch provider {
+	case weatherProviderHistory:
+		return weatherTypeObserved
+	case weatherProviderArchive:
+		return weatherTypeReanalysis
+	case weatherProviderForecast:
+		return weatherTypeForecast
+	default:
+		return ""
+	}
+}
+
+// weatherSourceLabel describes where a weather snapshot came from, for display
+func weatherSourceLabel(provider string) string {
+	switch provider {
+	case weatherProviderHistory:
+		return "OpenWeather History API (hourly observations)"
+	case weatherProviderForecast:
+		return "OpenWeather 16-day forecast"
+	case weatherProviderArchive:
+		return "Open-Meteo historical archive (ERA5 reanalysis, beyond the one-year History API window)"
+	default:
+		return provider
+	}
+}
+
+// WeatherSourceLabel describes where the request's weather came from
+func (r *Request) WeatherSourceLabel() string {
+	return weatherSourceLabel(r.WeatherSource)
+}
+
+// WeatherDataType is the kind of weather data the request was made with,
+// empty when a preset replaced the weather
+func (r *Request) WeatherDataType() string {
+	return weatherDataType(r.WeatherSource)
+}
+
+// WeatherDisclaimer explains how far the request's weather can be trusted
+func (r *Request) WeatherDisclaimer() string {
+	switch r.WeatherDataType() {
+	case weatherTypeObserved:
+		return "Measured conditions, averaged over the day."
+	case weatherTypeReanalysis:
+		return "Reconstructed from historical observations by a weather model; local conditions may have differed."
+	case weatherTypeForecast:
+		return "A forecast, not measured weather. The actual conditions may turn out differently, especially more than a few days ahead."
+	default:
+		return ""
+	}
+}
+
+// geocodeLocation converts location input to coordinates using the given input mode.
+// Supports: "city,country", "zipcode,country", "lat,lon", or auto-detection.
+func geocodeLocation(location, mode string) (*GeocodingResult, error) {
+	apiKey := currentConfig().OpenWeatherAPIKey
+	if apiKey == "" {
 		return nil, fmt.Errorf("OpenWeather API key not configured")
 	}
 
-	// Try to detect if it's a zip code (contains only numbers and optionally country code)
-	isZipCode := false
-	for _, char := range location {
-		if char >= '0' && char <= '9' {
-			isZipCode = true
-			break
-		}
+	if mode == "" || mode == locationModeAuto {
+		mode = detectLocationMode(location)
+	}
+
+	key := "geocode:" + cacheKey(mode, location)
+	var cached GeocodingResult
+	if cacheGetJSON(key, &cached) {
+		return &cached, nil
 	}
+	result, err := fetchGeocode(location, mode, apiKey)
+	// Coordinates that couldn't be named are left for the next lookup to try
+	if err == nil && result.Country != "" {
+		cacheSetJSON(key, result, geocodeCacheTTL)
+	}
+	return result, err
+}
+
+// fetchGeocode looks up location input with the geocoding API
+func fetchGeocode(location, mode, apiKey string) (*GeocodingResult, error) {
 
 	var apiURL string
-	if isZipCode {
-		// Use zip code API
+	switch mode {
+	case locationModeCoords:
+		lat, lon, ok := parseCoordinates(location)
+		if !ok {
+			return nil, fmt.Errorf("%w: invalid coordinates, expected \"lat,lon\"", ErrLocationNotFound)
+		}
+		return reverseGeocode(lat, lon), nil
+	case locationModeZip:
+		query, ok := parsePostalCode(location)
+		if !ok {
+			return nil, fmt.Errorf("%w: unrecognized postal code, expected \"code,country\" (e.g. 90210,US)", ErrLocationNotFound)
+		}
 		apiURL = fmt.Sprintf("http://api.openweathermap.org/geo/1.0/zip?zip=%s&appid=%s",
-			url.QueryEscape(location), openWeatherAPIKey)
-	} else {
+			url.QueryEscape(query), apiKey)
+	default:
 		// Use direct geocoding API
 		apiURL = fmt.Sprintf("http://api.openweathermap.org/geo/1.0/direct?q=%s&limit=1&appid=%s",
-			url.QueryEscape(location), openWeatherAPIKey)
+			url.QueryEscape(location), apiKey)
 	}
 
-	resp, err := http.Get(apiURL)
+	resp, err := openWeatherClient.Get(apiURL)
 	if err != nil {
 		return nil, fmt.Errorf("geocoding API request failed: %w", err)
 	}
@@ -159,62 +263,159 @@ func geocodeLocation(location string) (*GeocodingResult, error) {
 		return nil, fmt.Errorf("failed to read geocoding response: %w", err)
 	}
 
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrLocationNotFound
+	}
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("geocoding API error: %s - %s", resp.Status, string(body))
+		return nil, providerError(providerOpenWeather, "geocoding API", resp, body, nil)
 	}
 
-	if isZipCode {
+	if mode == locationModeZip {
 		// Single result for zip code
 		var result GeocodingResult
 		if err := json.Unmarshal(body, &result); err != nil {
 			return nil, fmt.Errorf("failed to parse zip code response: %w", err)
 		}
 		return &result, nil
-	} else {
-		// Array result for direct geocoding
-		var results []GeocodingResult
-		if err := json.Unmarshal(body, &results); err != nil {
-			return nil, fmt.Errorf("failed to parse geocoding response: %w", err)
-		}
-		if len(results) == 0 {
-			return nil, fmt.Errorf("location not found")
-		}
-		return &results[0], nil
 	}
+
+	// Array result for direct geocoding
+	var results []GeocodingResult
+	if err := json.Unmarshal(body, &results); err != nil {
+		return nil, fmt.Errorf("failed to parse geocoding response: %w", err)
+	}
+	if len(results) == 0 {
+		return nil, ErrLocationNotFound
+	}
+	return &results[0], nil
+}
+
+// reverseGeocode names a coordinate pair using the reverse geocoding API.
+// The coordinates are kept as given; if no name can be found they are used as the name.
+func reverseGeocode(lat, lon float64) *GeocodingResult {
+	result := &GeocodingResult{
+		Name: fmt.Sprintf("%.4f, %.4f", lat, lon),
+		Lat:  lat,
+		Lon:  lon,
+	}
+
+	apiURL := fmt.Sprintf("http://api.openweathermap.org/geo/1.0/reverse?lat=%f&lon=%f&limit=1&appid=%s",
+		lat, lon, currentConfig().OpenWeatherAPIKey)
+
+	resp, err := openWeatherClient.Get(apiURL)
+	if err != nil {
+		return result
+	}
+	defer resp.Body.Close()
+
+	var results []GeocodingResult
+	if resp.StatusCode != http.StatusOK || json.NewDecoder(resp.Body).Decode(&results) != nil || len(results) == 0 {
+		return result
+	}
+
+	result.Name = results[0].Name
+	result.Country = results[0].Country
+	result.State = results[0].State
+	return result
+}
+
+// searchLocations returns up to limit geocoding candidates for a free-text query,
+// caching results so repeated keystrokes don't hit the API
+func searchLocations(query string, limit int) ([]GeocodingResult, error) {
+	apiKey := currentConfig().OpenWeatherAPIKey
+	if apiKey == "" {
+		return nil, fmt.Errorf("OpenWeather API key not configured")
+	}
+
+	key := "locations:" + cacheKey(query, strconv.Itoa(limit))
+	var cached []GeocodingResult
+	if cacheGetJSON(key, &cached) {
+		return cached, nil
+	}
+
+	apiURL := fmt.Sprintf("http://api.openweathermap.org/geo/1.0/direct?q=%s&limit=%d&appid=%s",
+		url.QueryEscape(query), limit, apiKey)
+
+	resp, err := openWeatherClient.Get(apiURL)
+	if err != nil {
+		return nil, fmt.Errorf("geocoding API request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read geocoding response: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, providerError(providerOpenWeather, "geocoding API", resp, body, nil)
+	}
+
+	var results []GeocodingResult
+	if err := json.Unmarshal(body, &results); err != nil {
+		return nil, fmt.Errorf("failed to parse geocoding response: %w", err)
+	}
+
+	cacheSetJSON(key, results, geocodeCacheTTL)
+
+	return results, nil
+}
+
+// formatLocationLabel builds a human readable label such as "Paris, Texas, US"
+func formatLocationLabel(result *GeocodingResult) string {
+	label := result.Name
+	if result.State != "" {
+		label += ", " + result.State
+	}
+	if result.Country != "" {
+		label += ", " + result.Country
+	}
+	return label
 }
 
 // getHistoricalWeather fetches weather data for a specific date and location
-func getHistoricalWeather(lat, lon float64, targetDate time.Time) (*WeatherData, error) {
-	if openWeatherAPIKey == "" {
+// in the given units. The target date is a calendar date at the location, so
+// "today" and the day's boundaries are computed in the location's zone.
+func getHistoricalWeather(lat, lon float64, targetDate time.Time, loc *time.Location, units string) (*WeatherData, error) {
+	apiKey := currentConfig().OpenWeatherAPIKey
+	if apiKey == "" {
 		return nil, fmt.Errorf("OpenWeather API key not configured")
 	}
 
-	now := time.Now()
+	now := time.Now().In(loc)
 	oneYearAgo := now.AddDate(-1, 0, 0)
 
-	// Check if date is within the last year
-	if targetDate.Before(oneYearAgo) {
-		return nil, fmt.Errorf("historical data only available for the past year (since %s)", oneYearAgo.Format("2006-01-02"))
+	// The History API only covers the past year; older dates come from the
+	// Open-Meteo archive instead
+	if daysBetween(oneYearAgo, targetDate) < 0 {
+		if targetDate.Format("2006-01-02") < archiveStartDate {
+			return nil, fmt.Errorf("%w: historical data only available since %s",
+				ErrWeatherUnavailable, archiveStartDate)
+		}
+		return getArchiveWeather(lat, lon, targetDate, units)
 	}
 
 	// If date is in the future (up to 16 days), use forecast API
-	if targetDate.After(now) {
-		daysAhead := int(targetDate.Sub(now).Hours() / 24)
-		if daysAhead > 16 {
-			return nil, fmt.Errorf("forecast only available for up to 16 days ahead")
+	if daysAhead := daysBetween(now, targetDate); daysAhead > 0 {
+		if daysAhead > maxForecastDays {
+			return nil, fmt.Errorf("%w: forecast only available for up to %d days ahead", ErrWeatherUnavailable, maxForecastDays)
 		}
-		return getForecastWeather(lat, lon, daysAhead)
+		return getForecastWeather(lat, lon, daysAhead, units)
 	}
 
-	// Use History API for past dates
-	// Set time to noon of target date
-	startTime := time.Date(targetDate.Year(), targetDate.Month(), targetDate.Day(), 0, 0, 0, 0, time.UTC)
+	// Use History API for past dates, covering the whole local day
+	startTime := time.Date(targetDate.Year(), targetDate.Month(), targetDate.Day(), 0, 0, 0, 0, loc)
 	endTime := startTime.Add(24 * time.Hour)
 
-	apiURL := fmt.Sprintf("https://history.openweathermap.org/data/2.5/history/city?lat=%f&lon=%f&type=hour&start=%d&end=%d&units=metric&appid=%s",
-		lat, lon, startTime.Unix(), endTime.Unix(), openWeatherAPIKey)
+	key := fmt.Sprintf("weather:history:%f,%f:%d:%s", lat, lon, startTime.Unix(), units)
+	if body, ok := cacheGet(key); ok {
+		return parseWeatherSnapshot(weatherProviderHistory, units, body)
+	}
+
+	apiURL := fmt.Sprintf("https://history.openweathermap.org/data/2.5/history/city?lat=%f&lon=%f&type=hour&start=%d&end=%d&units=%s&appid=%s",
+		lat, lon, startTime.Unix(), endTime.Unix(), units, apiKey)
 
-	resp, err := http.Get(apiURL)
+	resp, err := openWeatherClient.Get(apiURL)
 	if err != nil {
 		return nil, fmt.Errorf("history API request failed: %w", err)
 	}
@@ -226,28 +427,33 @@ func getHistoricalWeather(lat, lon float64, targetDate time.Time) (*WeatherData,
 	}
 
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("history API error: %s - %s", resp.Status, string(body))
-	}
-
-	var histData HistoricalWeatherResponse
-	if err := json.Unmarshal(body, &histData); err != nil {
-		return nil, fmt.Errorf("failed to parse history response: %w", err)
+		return nil, providerError(providerOpenWeather, "history API", resp, body, ErrWeatherUnavailable)
 	}
 
-	if len(histData.List) == 0 {
-		return nil, fmt.Errorf("no historical data available for this date")
+	weatherData, err := parseWeatherSnapshot(weatherProviderHistory, units, body)
+	if err == nil {
+		ttl := pastWeatherCacheTTL
+		if endTime.After(time.Now()) {
+			ttl = todayWeatherCacheTTL
+		}
+		cacheSet(key, body, ttl)
 	}
-
-	// Average the hourly data to get daily summary
-	return aggregateHistoricalData(&histData), nil
+	return weatherData, err
 }
 
 // getForecastWeather fetches forecast data for future dates
-func getForecastWeather(lat, lon float64, daysAhead int) (*WeatherData, error) {
-	apiURL := fmt.Sprintf("https://api.openweathermap.org/data/2.5/forecast/daily?lat=%f&lon=%f&cnt=%d&units=metric&appid=%s",
-		lat, lon, daysAhead+1, openWeatherAPIKey)
+func getForecastWeather(lat, lon float64, daysAhead int, units string) (*WeatherData, error) {
+	// Forecasts are updated through the day, and the days they cover start
+	// today, so entries are also keyed by the hour they were fetched in
+	key := fmt.Sprintf("weather:forecast:%f,%f:%d:%s:%d", lat, lon, daysAhead, units, time.Now().Unix()/3600)
+	if body, ok := cacheGet(key); ok {
+		return parseWeatherSnapshot(weatherProviderForecast, units, body)
+	}
+
+	apiURL := fmt.Sprintf("https://api.openweathermap.org/data/2.5/forecast/daily?lat=%f&lon=%f&cnt=%d&units=%s&appid=%s",
+		lat, lon, daysAhead+1, units, currentConfig().OpenWeatherAPIKey)
 
-	resp, err := http.Get(apiURL)
+	resp, err := openWeatherClient.Get(apiURL)
 	if err != nil {
 		return nil, fmt.Errorf("forecast API request failed: %w", err)
 	}
@@ -259,22 +465,74 @@ func getForecastWeather(lat, lon float64, daysAhead int) (*WeatherData, error) {
 	}
 
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("forecast API error: %s - %s", resp.Status, string(body))
+		return nil, providerError(providerOpenWeather, "forecast API", resp, body, ErrWeatherUnavailable)
 	}
 
-	var forecastData ForecastResponse
-	if err := json.Unmarshal(body, &forecastData); err != nil {
-		return nil, fmt.Errorf("failed to parse forecast response: %w", err)
+	weatherData, err := parseWeatherSnapshot(weatherProviderForecast, units, body)
+	if err == nil {
+		cacheSet(key, body, forecastCacheTTL)
 	}
+	return weatherData, err
+}
 
-	if len(forecastData.List) == 0 {
-		return nil, fmt.Errorf("no forecast data available")
-	}
+// parseWeatherSnapshot parses a raw provider response into WeatherData. It is
+// used both for fresh responses and to replay stored weather snapshots; units
+// must be the units the response was requested in.
+func parseWeatherSnapshot(provider, units string, raw []byte) (*WeatherData, error) {
+	var weatherData *WeatherData
+
+	switch provider {
+	case weatherProviderHistory:
+		if err := validateResponse(historySchema, raw, ErrWeatherUnavailable); err != nil {
+			return nil, err
+		}
+		var histData HistoricalWeatherResponse
+		if err := json.Unmarshal(raw, &histData); err != nil {
+			return nil, fmt.Errorf("failed to parse history response: %w", err)
+		}
+
+		if len(histData.List) == 0 {
+			return nil, fmt.Errorf("%w: no historical data available for this date", ErrWeatherUnavailable)
+		}
+
+		// Average the hourly data to get daily summary
+		weatherData = aggregateHistoricalData(&histData)
+
+	case weatherProviderForecast:
+		if err := validateResponse(forecastSchema, raw, ErrWeatherUnavailable); err != nil {
+			return nil, err
+		}
+		var forecastData ForecastResponse
+		if err := json.Unmarshal(raw, &forecastData); err != nil {
+			return nil, fmt.Errorf("failed to parse forecast response: %w", err)
+		}
 
-	// Get the target day (last day in the list)
-	targetDay := forecastData.List[len(forecastData.List)-1]
+		if len(forecastData.List) == 0 {
+			return nil, fmt.Errorf("%w: no forecast data available", ErrWeatherUnavailable)
+		}
+
+		// Get the target day (last day in the list)
+		targetDay := forecastData.List[len(forecastData.List)-1]
+		weatherData = convertForecastToWeatherData(&targetDay)
+
+	case weatherProviderArchive:
+		if err := validateResponse(archiveSchema, raw, ErrWeatherUnavailable); err != nil {
+			return nil, err
+		}
+		var err error
+		if weatherData, err = parseArchiveWeather(raw); err != nil {
+			return nil, err
+		}
+
+	default:
+		return nil, fmt.Errorf("unknown weather provider %q", provider)
+	}
 
-	return convertForecastToWeatherData(&targetDay), nil
+	weatherData.Units = units
+	weatherData.Provider = provider
+	weatherData.Raw = raw
+	weatherData.roundMeasurements()
+	return weatherData, nil
 }
 
 // aggregateHistoricalData averages hourly data into daily summary
@@ -286,12 +544,14 @@ func aggregateHistoricalData(histData *HistoricalWeatherResponse) *WeatherData {
 	var totalTemp, totalFeels, totalWind float64
 	var totalPressure, totalHumidity, totalClouds int
 	var rain, snow float64
+	conditionID := 0
 	condition := ""
 	description := ""
 
 	// Get most common weather condition
 	if len(histData.List[len(histData.List)/2].Weather) > 0 {
 		midpoint := histData.List[len(histData.List)/2]
+		conditionID = midpoint.Weather[0].ID
 		condition = midpoint.Weather[0].Main
 		description = midpoint.Weather[0].Description
 	}
@@ -322,6 +582,7 @@ func aggregateHistoricalData(histData *HistoricalWeatherResponse) *WeatherData {
 		Clouds:      int(float64(totalClouds) / count),
 		Visibility:  10000, // default value
 		WindSpeed:   totalWind / count,
+		ConditionID: conditionID,
 		Condition:   condition,
 		Description: description,
 		Rain:        rain,
@@ -361,9 +622,11 @@ func convertForecastToWeatherData(forecast *struct {
 	Snow float64 `json:"snow,omitempty"`
 	Pop  float64 `json:"pop"`
 }) *WeatherData {
+	conditionID := 0
 	condition := ""
 	description := ""
 	if len(forecast.Weather) > 0 {
+		conditionID = forecast.Weather[0].ID
 		condition = forecast.Weather[0].Main
 		description = forecast.Weather[0].Description
 	}
@@ -377,6 +640,7 @@ func convertForecastToWeatherData(forecast *struct {
 		Visibility:  10000, // default
 		WindSpeed:   forecast.Speed,
 		WindDeg:     forecast.Deg,
+		ConditionID: conditionID,
 		Condition:   condition,
 		Description: description,
 		Rain:        forecast.Rain,
@@ -384,131 +648,10 @@ func convertForecastToWeatherData(forecast *struct {
 	}
 }
 
-// generatePrompt creates an AI prompt for image editing based on weather data
-func generatePrompt(weatherData *WeatherData, locationName string, timeOfDay string) string {
-	// Extract weather condition
-	condition := weatherData.Condition
-	if condition == "" {
-		condition = "clear"
-	}
-	description := weatherData.Description
-	if description == "" {
-		description = "clear sky"
-	}
-
-	// Time of day description
-	timeDesc := ""
-	if timeOfDay != "" {
-		switch timeOfDay {
-		case "dawn":
-			timeDesc = " The scene should be captured during dawn/sunrise with warm golden light on the horizon and soft, diffused lighting. "
-		case "morning":
-			timeDesc = " The scene should be captured in the morning (8-11 AM) with fresh, bright daylight and clear shadows. "
-		case "noon":
-			timeDesc = " The scene should be captured at noon with overhead sunlight creating short, harsh shadows and maximum brightness. "
-		case "afternoon":
-			timeDesc = " The scene should be captured in the afternoon (2-5 PM) with warm, angled sunlight and longer shadows. "
-		case "dusk":
-			timeDesc = " The scene should be captured during dusk/sunset with warm orange-pink hues in the sky and soft, glowing light. "
-		case "night":
-			timeDesc = " The scene should be captured at night with dark skies, artificial lighting or moonlight, and deep shadows. "
-		}
-	} else {
-		timeDesc = " Maintain the original time of day and lighting angle from the photo. "
-	}
-
-	// Temperature in Celsius
-	temp := weatherData.Temp
-	tempDesc := ""
-	if temp < 0 {
-		tempDesc = "freezing cold"
-	} else if temp < 10 {
-		tempDesc = "cold"
-	} else if temp < 20 {
-		tempDesc = "cool"
-	} else if temp < 28 {
-		tempDesc = "warm"
-	} else {
-		tempDesc = "hot"
-	}
-
-	// Cloud coverage
-	cloudiness := ""
-	if weatherData.Clouds < 20 {
-		cloudiness = "clear skies"
-	} else if weatherData.Clouds < 50 {
-		cloudiness = "partly cloudy skies"
-	} else if weatherData.Clouds < 80 {
-		cloudiness = "mostly cloudy skies"
-	} else {
-		cloudiness = "overcast skies"
-	}
-
-	// Visibility
-	visibilityDesc := ""
-	if weatherData.Visibility < 1000 {
-		visibilityDesc = "with very poor visibility"
-	} else if weatherData.Visibility < 5000 {
-		visibilityDesc = "with reduced visibility"
-	}
-
-	// Rain/Snow
-	precipitation := ""
-	if weatherData.Rain > 0 {
-		if weatherData.Rain < 2.5 {
-			precipitation = "light rain"
-		} else if weatherData.Rain < 10 {
-			precipitation = "moderate rain"
-		} else {
-			precipitation = "heavy rain"
-		}
-	} else if weatherData.Snow > 0 {
-		if weatherData.Snow < 2.5 {
-			precipitation = "light snow"
-		} else if weatherData.Snow < 10 {
-			precipitation = "moderate snow"
-		} else {
-			precipitation = "heavy snow"
-		}
-	}
-
-	// Wind
-	windDesc := ""
-	if weatherData.WindSpeed > 10 {
-		windDesc = "with strong winds"
-	} else if weatherData.WindSpeed > 5 {
-		windDesc = "with moderate winds"
+// promptLocation names a geocoded location for prompts, e.g. "Paris, FR"
+func promptLocation(name, country string) string {
+	if country != "" {
+		return name + ", " + country
 	}
-
-	// Build the prompt
-	prompt := fmt.Sprintf(
-		"Transform this landscape photo to accurately depict %s weather conditions. "+
-			"The scene should show %s (%s) with %s and a temperature of %.1f°C (%s). ",
-		locationName, condition, description, cloudiness, temp, tempDesc,
-	)
-
-	// Add time of day description
-	prompt += timeDesc
-
-	if precipitation != "" {
-		prompt += fmt.Sprintf("Add %s falling in the scene. ", precipitation)
-	}
-
-	if visibilityDesc != "" {
-		prompt += fmt.Sprintf("The atmosphere should appear %s. ", visibilityDesc)
-	}
-
-	if windDesc != "" {
-		prompt += fmt.Sprintf("Show signs of wind %s such as swaying trees or grass. ", windDesc)
-	}
-
-	prompt += fmt.Sprintf(
-		"The lighting should match the cloudiness level (clouds: %d%%). "+
-			"Maintain the original composition and main subjects of the photo while "+
-			"authentically applying these weather conditions. The result should look "+
-			"natural and photorealistic.",
-		weatherData.Clouds,
-	)
-
-	return prompt
+	return name
 }
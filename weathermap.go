@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WEATHER_MAP_LAYER values, and the Weather Maps 2.0 operation of each layer
+const (
+	weatherMapPrecipitation = "precipitation"
+	weatherMapClouds        = "clouds"
+	weatherMapOff           = "off"
+)
+
+var weatherMapOperations = map[string]string{
+	weatherMapPrecipitation: "PA0",
+	weatherMapClouds:        "CL",
+}
+
+// defaultMapTileURL is the base map drawn under the weather layer. Its
+// tiles must be credited to the OpenStreetMap contributors.
+const defaultMapTileURL = "https://tile.openstreetmap.org/{z}/{x}/{y}.png"
+
+const (
+	weatherMapZoom   = 7 // a tile is about 300 km across at the equator
+	weatherMapWidth  = 512
+	weatherMapHeight = 320
+	mapTileSize      = 256
+
+	// Maps of the past don't change and are kept until they're pruned;
+	// current conditions and forecasts are fetched again after an hour
+	weatherMapCacheTTL   = 7 * 24 * time.Hour
+	weatherMapRefreshAge = time.Hour
+
+	// weatherMapCurrentWindow is how close to now the target time has to be
+	// for current conditions to stand in when the timed layer can't be had
+	weatherMapCurrentWindow = 3 * time.Hour
+)
+
+// timeOfDayHours is the local hour each time of day is mapped at; noon
+// when none was picked
+var timeOfDayHours = map[string]int{
+	"dawn": 6, "morning": 9, "noon": 12, "afternoon": 15, "dusk": 18, "night": 22,
+}
+
+// weatherMapBuilds holds a lock per map file, so a map requested twice at
+// once is only built once
+var weatherMapBuilds sync.Map
+
+// weatherMapTime is the moment a request's weather map shows: the hour of
+// its time of day on its target date, at the location
+func weatherMapTime(req *Request) (time.Time, error) {
+	date, err := time.ParseInLocation("2006-01-02", req.TargetDate, locationZone(req.UTCOffset))
+	if err != nil {
+		return time.Time{}, err
+	}
+	hour, ok := timeOfDayHours[req.TimeOfDay]
+	if !ok {
+		hour = 12
+	}
+	return date.Add(time.Duration(hour) * time.Hour), nil
+}
+
+// weatherMapPath returns the file of a request's weather map, building it
+// unless a fresh enough one is cached on disk
+func weatherMapPath(req *Request, layer string) (string, error) {
+	at, err := weatherMapTime(req)
+	if err != nil {
+		return "", err
+	}
+	name := fmt.Sprintf("%s_%.3f_%.3f_%d.png", layer, req.Latitude, req.Longitude, at.Unix())
+	path := filepath.Join(dataDir, "maps", name)
+
+	lock, _ := weatherMapBuilds.LoadOrStore(path, &sync.Mutex{})
+	lock.(*sync.Mutex).Lock()
+	defer lock.(*sync.Mutex).Unlock()
+
+	if info, err := os.Stat(path); err == nil {
+		observed := at.Before(time.Now().Add(-weatherMapCurrentWindow))
+		if observed || time.Since(info.ModTime()) < weatherMapRefreshAge {
+			return path, nil
+		}
+	}
+
+	img, err := renderWeatherMap(req.Latitude, req.Longitude, layer, at)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", err
+	}
+	return path, writeFileAtomic(path, func(w io.Writer) error {
+		return png.Encode(w, img)
+	})
+}
+
+// renderWeatherMap draws the weather layer at a time over the base map,
+// centered on a point that's marked with a dot
+func renderWeatherMap(lat, lon float64, layer string, at time.Time) (image.Image, error) {
+	// Pixel coordinates of the point in the Web Mercator world at the zoom
+	worldSize := float64(mapTileSize << weatherMapZoom)
+	sinLat := math.Sin(math.Max(-85.05, math.Min(85.05, lat)) * math.Pi / 180)
+	centerX := int((lon + 180) / 360 * worldSize)
+	centerY := int((0.5 - math.Log((1+sinLat)/(1-sinLat))/(4*math.Pi)) * worldSize)
+	left, top := centerX-weatherMapWidth/2, centerY-weatherMapHeight/2
+
+	canvas := image.NewRGBA(image.Rect(0, 0, weatherMapWidth, weatherMapHeight))
+	draw.Draw(canvas, canvas.Bounds(), &image.Uniform{color.RGBA{0xe5, 0xe7, 0xeb, 0xff}}, image.Point{}, draw.Src)
+
+	tiles := 1 << weatherMapZoom
+	for ty := floorDiv(top, mapTileSize); ty <= floorDiv(top+weatherMapHeight-1, mapTileSize); ty++ {
+		if ty < 0 || ty >= tiles {
+			continue // beyond the poles
+		}
+		for tx := floorDiv(left, mapTileSize); tx <= floorDiv(left+weatherMapWidth-1, mapTileSize); tx++ {
+			// Tiles wrap around at the antimeridian
+			x := ((tx % tiles) + tiles) % tiles
+			origin := image.Pt(tx*mapTileSize-left, ty*mapTileSize-top)
+			dest := image.Rectangle{Min: origin, Max: origin.Add(image.Pt(mapTileSize, mapTileSize))}
+
+			base, err := fetchMapTile(weatherMapZoom, x, ty)
+			if err != nil {
+				return nil, err
+			}
+			draw.Draw(canvas, dest, base, base.Bounds().Min, draw.Over)
+
+			overlay, err := fetchWeatherTile(layer, weatherMapZoom, x, ty, at)
+			if err != nil {
+				return nil, err
+			}
+			draw.Draw(canvas, dest, overlay, overlay.Bounds().Min, draw.Over)
+		}
+	}
+
+	drawMapMarker(canvas, weatherMapWidth/2, weatherMapHeight/2)
+	return canvas, nil
+}
+
+// floorDiv divides rounding towards negative infinity
+func floorDiv(a, b int) int {
+	if a < 0 {
+		return -((-a + b - 1) / b)
+	}
+	return a / b
+}
+
+// drawMapMarker draws a red dot with a white outline at x, y
+func drawMapMarker(img *image.RGBA, x, y int) {
+	const radius, outline = 6, 2
+	for dy := -radius - outline; dy <= radius+outline; dy++ {
+		for dx := -radius - outline; dx <= radius+outline; dx++ {
+			switch d := dx*dx + dy*dy; {
+			case d <= radius*radius:
+				img.Set(x+dx, y+dy, color.RGBA{0xdc, 0x26, 0x26, 0xff})
+			case d <= (radius+outline)*(radius+outline):
+				img.Set(x+dx, y+dy, color.White)
+			}
+		}
+	}
+}
+
+// fetchMapTile fetches a base map tile from MAP_TILE_URL
+func fetchMapTile(z, x, y int) (image.Image, error) {
+	tileURL := strings.NewReplacer("{z}", strconv.Itoa(z), "{x}", strconv.Itoa(x), "{y}", strconv.Itoa(y)).
+		Replace(currentConfig().MapTileURL)
+	return fetchTile(mapTileClient, providerMapTiles, "map tiles", tileURL)
+}
+
+// fetchWeatherTile fetches a tile of OpenWeather's weather layer at a time
+// from Weather Maps 2.0. Its history and forecasts need a subscription that
+// includes them; without one, maps of around now use the current conditions
+// of Weather Maps 1.0 instead.
+func fetchWeatherTile(layer string, z, x, y int, at time.Time) (image.Image, error) {
+	apiKey := currentConfig().OpenWeatherAPIKey
+	tileURL := fmt.Sprintf("https://maps.openweathermap.org/maps/2.0/weather/%s/%d/%d/%d?date=%d&appid=%s",
+		weatherMapOperations[layer], z, x, y, at.Unix(), apiKey)
+	// Keys without the subscription are turned away, which isn't worth an alert
+	tile, err := fetchTile(openWeatherClient, "", "weather maps API", tileURL)
+	if err == nil || time.Since(at).Abs() > weatherMapCurrentWindow {
+		return tile, err
+	}
+
+	current, currentErr := fetchTile(openWeatherClient, providerOpenWeather, "weather maps API",
+		fmt.Sprintf("https://tile.openweathermap.org/map/%s_new/%d/%d/%d.png?appid=%s", layer, z, x, y, apiKey))
+	if currentErr != nil {
+		return nil, err
+	}
+	return current, nil
+}
+
+// fetchTile downloads and decodes a PNG map tile
+func fetchTile(client *http.Client, provider, api, tileURL string) (image.Image, error) {
+	httpReq, err := http.NewRequest(http.MethodGet, tileURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	// Tile servers such as OpenStreetMap's turn away clients that don't say who they are
+	userAgent := "SkyWeave weather map"
+	if publicURL := currentConfig().PublicURL; publicURL != nil {
+		userAgent += " (+" + publicURL.String() + ")"
+	}
+	httpReq.Header.Set("User-Agent", userAgent)
+
+	resp, err := client.Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("%s request failed: %w", api, err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s response: %w", api, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, providerError(provider, api, resp, body, ErrWeatherUnavailable)
+	}
+	tile, err := png.Decode(bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("%s returned an invalid tile: %w", api, err)
+	}
+	return tile, nil
+}
+
+// startWeatherMapCleanup prunes cached weather maps every hour
+func startWeatherMapCleanup() {
+	ticker := time.NewTicker(time.Hour)
+	goSafe("", func() {
+		for range ticker.C {
+			cleanupWeatherMaps()
+		}
+	})
+}
+
+// cleanupWeatherMaps deletes weather maps older than weatherMapCacheTTL
+func cleanupWeatherMaps() {
+	dir := filepath.Join(dataDir, "maps")
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Failed to list weather maps: %v", err)
+		}
+		return
+	}
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || time.Since(info.ModTime()) < weatherMapCacheTTL {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, entry.Name())); err != nil && !os.IsNotExist(err) {
+			log.Printf("Failed to delete weather map %s: %v", entry.Name(), err)
+		}
+	}
+}
+
+// weatherMapHandler serves the weather map of a request's place and time,
+// which the confirmation page shows next to the numbers
+func weatherMapHandler(w http.ResponseWriter, r *http.Request) {
+	cfg := currentConfig()
+	if cfg.WeatherMapLayer == weatherMapOff || cfg.OpenWeatherAPIKey == "" {
+		http.NotFound(w, r)
+		return
+	}
+	req, ok := fragmentRequest(w, r)
+	if !ok {
+		return
+	}
+	if req.Status == "pending" || req.Status == "geocoding" || req.Status == "weather_fetching" {
+		http.Error(w, "Weather not fetched yet", http.StatusNotFound)
+		return
+	}
+
+	path, err := weatherMapPath(req, cfg.WeatherMapLayer)
+	if err != nil {
+		log.Printf("Failed to build weather map of request %s: %v", req.ID, err)
+		http.Error(w, "Weather map unavailable", http.StatusBadGateway)
+		return
+	}
+	serveMediaFile(w, r, path)
+}